@@ -0,0 +1,372 @@
+package accounts
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"naevis/apierror"
+	"naevis/config"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// minPasswordLength is the shortest password accepted at registration.
+const minPasswordLength = 8
+
+// dummyHash is a bcrypt hash, at the cost of real ones, that logins with
+// an unknown email are compared against, so they take as long as logins
+// with a wrong password and do not reveal which emails have accounts.
+const dummyHash = "$2a$10$39uW2gAREq7cQdPQwjBvOeKmhsqpE6cqntxw/pvJgkREecBcXcsXG"
+
+// User is a registered account and its public profile.
+type User struct {
+	ID          int64  `json:"id"`
+	Email       string `json:"email"`
+	DisplayName string `json:"display_name"`
+	Bio         string `json:"bio"`
+	AvatarURL   string `json:"avatar_url"`
+	Role        string `json:"role"`
+	CreatedAt   string `json:"created_at"`
+}
+
+// Service stores user accounts and issues access tokens.
+type Service struct {
+	db         *sql.DB
+	secret     []byte
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+	// bootstrapAdmin is the email of the account made the first admin.
+	bootstrapAdmin string
+}
+
+// New creates the account service. Without a configured secret a random
+// one is generated, which invalidates issued tokens on every restart.
+func New(db *sql.DB, cfg config.Auth) (*Service, error) {
+	secret := []byte(cfg.JWTSecret)
+	if len(secret) == 0 {
+		log.Println("No auth.jwt_secret configured; access tokens will not survive a restart")
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+	}
+	s := &Service{
+		db:             db,
+		secret:         secret,
+		accessTTL:      cfg.AccessTokenTTL.Duration,
+		refreshTTL:     cfg.RefreshTokenTTL.Duration,
+		bootstrapAdmin: strings.ToLower(strings.TrimSpace(cfg.BootstrapAdmin)),
+	}
+	if err := s.bootstrap(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// bootstrap makes the bootstrap admin's account an admin if it is
+// registered and there is no admin yet.
+func (s *Service) bootstrap() error {
+	if s.bootstrapAdmin == "" {
+		return nil
+	}
+	res, err := s.db.Exec(`
+	UPDATE users SET role = 'admin', updated_at = CURRENT_TIMESTAMP
+	WHERE email = ? AND NOT EXISTS (SELECT 1 FROM users WHERE role = 'admin');`, s.bootstrapAdmin)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("Made %s the first admin", s.bootstrapAdmin)
+	}
+	return nil
+}
+
+type contextKey struct{}
+
+// Authenticate attaches the claims of a valid bearer token to the request
+// context. Requests without a token pass through anonymously; requests
+// with an invalid one, or one of a session that has ended, are rejected.
+func (s *Service) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if auth == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token, ok := strings.CutPrefix(auth, "Bearer ")
+		if !ok {
+			apierror.Write(w, "Unsupported authorization scheme", http.StatusUnauthorized)
+			return
+		}
+		claims, err := parseToken(s.secret, token)
+		if err == nil {
+			claims, err = s.current(claims)
+		}
+		switch {
+		case errors.Is(err, errInvalidToken), errors.Is(err, errSessionEnded):
+			apierror.WriteCode(w, apierror.CodeInvalidToken, err.Error(), http.StatusUnauthorized)
+			return
+		case err != nil:
+			apierror.Write(w, "Failed to check session", http.StatusInternalServerError)
+			log.Printf("Error checking session: %v", err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, claims)))
+	})
+}
+
+// errSessionEnded is returned for a token of a session that was logged
+// out, revoked or expired, or of a deleted account.
+var errSessionEnded = errors.New("session ended")
+
+// current returns claims as they stand now, or errSessionEnded. The role
+// is the account's current one, and MFA holds only while the session
+// still has its second factor.
+func (s *Service) current(claims Claims) (Claims, error) {
+	var role string
+	var mfa bool
+	err := s.db.QueryRow(`
+	SELECT u.role, s.mfa FROM sessions s JOIN users u ON u.id = s.user_id
+	WHERE s.id = ? AND s.user_id = ? AND s.revoked = 0 AND s.expires_at > ?;`,
+		claims.Session, claims.Subject, time.Now().UTC().Format(time.DateTime)).Scan(&role, &mfa)
+	if err == sql.ErrNoRows {
+		return Claims{}, errSessionEnded
+	}
+	if err != nil {
+		return Claims{}, err
+	}
+	claims.Role = role
+	claims.MFA = claims.MFA && mfa
+	return claims, nil
+}
+
+// FromContext returns the claims of the authenticated caller, if any.
+func FromContext(ctx context.Context) (Claims, bool) {
+	claims, ok := ctx.Value(contextKey{}).(Claims)
+	return claims, ok
+}
+
+// issue creates an access token for a user's session. mfa records that
+// the session was started with a second factor.
+func (s *Service) issue(id int64, role, session string, mfa bool) (string, error) {
+	now := time.Now()
+	return signToken(s.secret, Claims{
+		Subject: id,
+		Role:    role,
+		Session: session,
+		MFA:     mfa,
+		Issued:  now.Unix(),
+		Expires: now.Add(s.accessTTL).Unix(),
+	})
+}
+
+type credentials struct {
+	Email       string `json:"email"`
+	Password    string `json:"password"`
+	DisplayName string `json:"display_name"`
+	// Code is a TOTP or recovery code, required at login once two-factor
+	// authentication is enabled.
+	Code string `json:"code"`
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// RegisterHandler handles POST /accounts/register.
+func (s *Service) RegisterHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		apierror.Write(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var c credentials
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		apierror.WriteCode(w, apierror.CodeInvalidJSON, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	c.Email = strings.ToLower(strings.TrimSpace(c.Email))
+	if !strings.Contains(c.Email, "@") {
+		apierror.Write(w, "A valid email is required", http.StatusBadRequest)
+		return
+	}
+	if len(c.Password) < minPasswordLength {
+		apierror.Write(w, "Password is too short", http.StatusBadRequest)
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(c.Password), bcrypt.DefaultCost)
+	if err != nil {
+		apierror.Write(w, "Failed to register", http.StatusInternalServerError)
+		return
+	}
+
+	res, err := s.db.Exec(`
+	INSERT INTO users (email, password_hash, display_name, created_at, updated_at)
+	VALUES (?, ?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+	ON CONFLICT(email) DO NOTHING;`, c.Email, string(hash), c.DisplayName)
+	if err != nil {
+		apierror.Write(w, "Failed to register", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		apierror.Write(w, "Email is already registered", http.StatusConflict)
+		return
+	}
+	id, _ := res.LastInsertId()
+	if c.Email == s.bootstrapAdmin {
+		if err := s.bootstrap(); err != nil {
+			apierror.Write(w, "Failed to register", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	user, err := s.load(id)
+	if err != nil {
+		apierror.Write(w, "Failed to register", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusCreated, user)
+}
+
+// LoginHandler handles POST /accounts/login with an email and password. It
+// starts a session and returns a short-lived access token together with a
+// refresh token for POST /accounts/refresh. Accounts with two-factor
+// authentication must also send a TOTP or recovery code.
+func (s *Service) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		apierror.Write(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var c credentials
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		apierror.WriteCode(w, apierror.CodeInvalidJSON, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	var id int64
+	var hash, role string
+	var twoFactor bool
+	err := s.db.QueryRow(`SELECT id, password_hash, role, totp_enabled FROM users WHERE email = ?;`,
+		strings.ToLower(strings.TrimSpace(c.Email))).Scan(&id, &hash, &role, &twoFactor)
+	if err == sql.ErrNoRows {
+		bcrypt.CompareHashAndPassword([]byte(dummyHash), []byte(c.Password))
+		apierror.Write(w, "Invalid email or password", http.StatusUnauthorized)
+		return
+	}
+	if err == nil && bcrypt.CompareHashAndPassword([]byte(hash), []byte(c.Password)) != nil {
+		apierror.Write(w, "Invalid email or password", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		apierror.Write(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
+
+	if twoFactor {
+		if c.Code == "" {
+			apierror.WriteCode(w, apierror.CodeTwoFactorRequired, "Two-factor code required", http.StatusUnauthorized)
+			return
+		}
+		ok, err := s.checkSecondFactor(id, c.Code)
+		var locked *lockedOut
+		if errors.As(err, &locked) {
+			writeLockedOut(w, locked)
+			return
+		}
+		if err != nil {
+			apierror.Write(w, "Failed to log in", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			apierror.Write(w, "Invalid two-factor code", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	session, refresh, err := s.startSession(id, r.UserAgent(), twoFactor)
+	if err != nil {
+		apierror.Write(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
+	s.respondWithTokens(w, id, role, session, twoFactor, refresh)
+}
+
+// MeHandler handles GET, PUT and DELETE /me for the authenticated user's
+// profile. PUT updates display_name, bio and avatar_url.
+func (s *Service) MeHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := FromContext(r.Context())
+	if !ok {
+		apierror.Write(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var p User
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			apierror.WriteCode(w, apierror.CodeInvalidJSON, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if _, err := s.db.Exec(`
+		UPDATE users SET display_name = ?, bio = ?, avatar_url = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?;`, p.DisplayName, p.Bio, p.AvatarURL, claims.Subject); err != nil {
+			apierror.Write(w, "Failed to update profile", http.StatusInternalServerError)
+			return
+		}
+	case http.MethodDelete:
+		if _, err := s.db.Exec(`DELETE FROM users WHERE id = ?;`, claims.Subject); err != nil {
+			apierror.Write(w, "Failed to delete account", http.StatusInternalServerError)
+			return
+		}
+		s.db.Exec(`DELETE FROM sessions WHERE user_id = ?;`, claims.Subject)
+		s.db.Exec(`DELETE FROM recovery_codes WHERE user_id = ?;`, claims.Subject)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		apierror.Write(w, "Only GET, PUT and DELETE requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := s.load(claims.Subject)
+	if err == sql.ErrNoRows {
+		apierror.Write(w, "Account not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		apierror.Write(w, "Failed to load profile", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, user)
+}
+
+// load reads a user by ID.
+func (s *Service) load(id int64) (User, error) {
+	var u User
+	err := s.db.QueryRow(`
+	SELECT id, email, display_name, bio, avatar_url, role, created_at FROM users WHERE id = ?;`, id).
+		Scan(&u.ID, &u.Email, &u.DisplayName, &u.Bio, &u.AvatarURL, &u.Role, &u.CreatedAt)
+	return u, err
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	response, err := json.Marshal(v)
+	if err != nil {
+		apierror.Write(w, "Error encoding JSON", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(response)
+}
@@ -0,0 +1,227 @@
+package accounts
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"naevis/apierror"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Session is a login that can mint new access tokens with its refresh
+// token. Refresh tokens rotate on every use and each use slides the
+// expiry forward.
+type Session struct {
+	ID         string `json:"id"`
+	UserAgent  string `json:"user_agent"`
+	CreatedAt  string `json:"created_at"`
+	LastUsedAt string `json:"last_used_at"`
+	ExpiresAt  string `json:"expires_at"`
+	Current    bool   `json:"current"`
+}
+
+// newSecret returns n random bytes, hex encoded.
+func newSecret(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// startSession creates a session and returns its ID and refresh token.
+// The refresh token is "{session id}.{secret}"; only the secret's hash is
+// stored. mfa records whether the login used a second factor.
+func (s *Service) startSession(userID int64, userAgent string, mfa bool) (string, string, error) {
+	id, err := newSecret(12)
+	if err != nil {
+		return "", "", err
+	}
+	secret, err := newSecret(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	_, err = s.db.Exec(`
+	INSERT INTO sessions (id, user_id, refresh_hash, user_agent, mfa, created_at, last_used_at, expires_at)
+	VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?);`,
+		id, userID, hashSecret(secret), userAgent, mfa, s.refreshExpiry())
+	if err != nil {
+		return "", "", err
+	}
+	return id, id + "." + secret, nil
+}
+
+// refreshExpiry is the sliding expiry of a session used now.
+func (s *Service) refreshExpiry() string {
+	return time.Now().UTC().Add(s.refreshTTL).Format(time.DateTime)
+}
+
+// RefreshHandler handles POST /accounts/refresh. It exchanges a refresh
+// token for a new access token and a rotated refresh token. Presenting an
+// already rotated token revokes the session, since it means the token was
+// copied.
+func (s *Service) RefreshHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		apierror.Write(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apierror.WriteCode(w, apierror.CodeInvalidJSON, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	id, secret, ok := strings.Cut(req.RefreshToken, ".")
+	if !ok {
+		apierror.WriteCode(w, apierror.CodeInvalidToken, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	var userID int64
+	var current, previous, role string
+	var revoked, mfa bool
+	err := s.db.QueryRow(`
+	SELECT s.user_id, s.refresh_hash, s.previous_hash, s.revoked, s.mfa, u.role
+	FROM sessions s JOIN users u ON u.id = s.user_id
+	WHERE s.id = ? AND s.expires_at > ?;`, id, time.Now().UTC().Format(time.DateTime)).
+		Scan(&userID, &current, &previous, &revoked, &mfa, &role)
+	if err == sql.ErrNoRows || revoked {
+		apierror.WriteCode(w, apierror.CodeInvalidToken, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		apierror.Write(w, "Failed to refresh session", http.StatusInternalServerError)
+		return
+	}
+
+	presented := hashSecret(secret)
+	if subtle.ConstantTimeCompare([]byte(presented), []byte(current)) != 1 {
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(previous)) == 1 {
+			s.db.Exec(`UPDATE sessions SET revoked = 1 WHERE id = ?;`, id)
+		}
+		apierror.WriteCode(w, apierror.CodeInvalidToken, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	next, err := newSecret(32)
+	if err != nil {
+		apierror.Write(w, "Failed to refresh session", http.StatusInternalServerError)
+		return
+	}
+	res, err := s.db.Exec(`
+	UPDATE sessions SET refresh_hash = ?, previous_hash = refresh_hash,
+		last_used_at = CURRENT_TIMESTAMP, expires_at = ?
+	WHERE id = ? AND refresh_hash = ?;`, hashSecret(next), s.refreshExpiry(), id, current)
+	if err != nil {
+		apierror.Write(w, "Failed to refresh session", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		// A concurrent refresh won the race.
+		apierror.WriteCode(w, apierror.CodeInvalidToken, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	s.respondWithTokens(w, userID, role, id, mfa, id+"."+next)
+}
+
+// respondWithTokens writes a new access token alongside a refresh token.
+func (s *Service) respondWithTokens(w http.ResponseWriter, userID int64, role, sessionID string, mfa bool, refresh string) {
+	token, err := s.issue(userID, role, sessionID, mfa)
+	if err != nil {
+		apierror.Write(w, "Failed to issue token", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, tokenResponse{
+		AccessToken:  token,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(s.accessTTL / time.Second),
+		RefreshToken: refresh,
+	})
+}
+
+// LogoutHandler handles POST /accounts/logout and revokes the session of
+// the presented access token.
+func (s *Service) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		apierror.Write(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims, ok := FromContext(r.Context())
+	if !ok {
+		apierror.Write(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+	if _, err := s.db.Exec(`UPDATE sessions SET revoked = 1 WHERE id = ? AND user_id = ?;`,
+		claims.Session, claims.Subject); err != nil {
+		apierror.Write(w, "Failed to log out", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SessionsHandler handles GET /me/sessions to list the caller's active
+// sessions and DELETE /me/sessions/{ID} to revoke one.
+func (s *Service) SessionsHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := FromContext(r.Context())
+	if !ok {
+		apierror.Write(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/me/sessions"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		s.listSessions(w, claims)
+	case r.Method == http.MethodDelete && id != "":
+		res, err := s.db.Exec(`UPDATE sessions SET revoked = 1 WHERE id = ? AND user_id = ?;`, id, claims.Subject)
+		if err != nil {
+			apierror.Write(w, "Failed to revoke session", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			apierror.Write(w, "Session not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		apierror.Write(w, "Use GET /me/sessions or DELETE /me/sessions/{ID}", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Service) listSessions(w http.ResponseWriter, claims Claims) {
+	rows, err := s.db.Query(`
+	SELECT id, user_agent, created_at, last_used_at, expires_at FROM sessions
+	WHERE user_id = ? AND revoked = 0 AND expires_at > ?
+	ORDER BY last_used_at DESC;`, claims.Subject, time.Now().UTC().Format(time.DateTime))
+	if err != nil {
+		apierror.Write(w, "Failed to list sessions", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var sess Session
+		if err := rows.Scan(&sess.ID, &sess.UserAgent, &sess.CreatedAt, &sess.LastUsedAt, &sess.ExpiresAt); err != nil {
+			apierror.Write(w, "Failed to list sessions", http.StatusInternalServerError)
+			return
+		}
+		sess.Current = sess.ID == claims.Session
+		sessions = append(sessions, sess)
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
@@ -0,0 +1,407 @@
+package accounts
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"naevis/apierror"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// totpStep and totpDigits are the RFC 6238 defaults understood by
+	// every authenticator app.
+	totpStep   = 30
+	totpDigits = 6
+	// totpSkew is the number of steps accepted either side of now.
+	totpSkew = 1
+	// recoveryCodes is the number of one-time codes issued on enrollment.
+	recoveryCodes = 10
+	// maxCodeFailures invalid TOTP or recovery codes in a row lock an
+	// account's second factor for codeLockout, so codes cannot be guessed.
+	maxCodeFailures = 5
+	codeLockout     = 15 * time.Minute
+)
+
+// privilegedRoles must use two-factor authentication to reach admin routes.
+var privilegedRoles = map[string]bool{"admin": true, "operator": true}
+
+// ValidRole reports whether role is one an account may have.
+func ValidRole(role string) bool {
+	return role == "user" || privilegedRoles[role]
+}
+
+// Admin reports whether the claims would pass RequireAdmin: a privileged
+// role signed in with a second factor.
+func (c Claims) Admin() bool {
+	return privilegedRoles[c.Role] && c.MFA
+}
+
+// roleRanks orders the roles by what they may do.
+var roleRanks = map[string]int{"user": 1, "operator": 2, "admin": 3}
+
+// HasRole reports whether the claims act with role or a higher one. A
+// privileged role counts only when signed in with a second factor, and
+// is a user's otherwise.
+func (c Claims) HasRole(role string) bool {
+	acting := c.Role
+	if privilegedRoles[acting] && !c.MFA {
+		acting = "user"
+	}
+	return roleRanks[acting] >= roleRanks[role]
+}
+
+var base32NoPad = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode computes the code of secret for a time step.
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, n%1000000)
+}
+
+// verifyTOTP checks code against secret and returns the matched step.
+// Steps at or before lastStep are rejected so a code works only once.
+func verifyTOTP(secret string, code string, lastStep int64) (int64, bool) {
+	key, err := base32NoPad.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	now := time.Now().Unix() / totpStep
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// lockedOut is returned by checkSecondFactor for an account that sent
+// too many invalid codes, until it may try again.
+type lockedOut struct {
+	until time.Time
+}
+
+func (e *lockedOut) Error() string {
+	return "two-factor codes refused until " + e.until.UTC().Format(time.DateTime)
+}
+
+// writeLockedOut replies to a request refused with err, a *lockedOut.
+func writeLockedOut(w http.ResponseWriter, err *lockedOut) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(err.until).Seconds())+1))
+	apierror.WriteCode(w, apierror.CodeTwoFactorLocked, "Too many invalid two-factor codes; try again later", http.StatusTooManyRequests)
+}
+
+// checkSecondFactor verifies a TOTP or recovery code for a user with
+// two-factor authentication enabled, consuming it. After maxCodeFailures
+// invalid codes in a row it refuses every code with a *lockedOut for
+// codeLockout.
+func (s *Service) checkSecondFactor(userID int64, code string) (bool, error) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if code == "" {
+		return false, nil
+	}
+
+	var secret string
+	var lastStep, lockedUntil int64
+	if err := s.db.QueryRow(`SELECT totp_secret, totp_last_step, totp_locked_until FROM users WHERE id = ?;`, userID).
+		Scan(&secret, &lastStep, &lockedUntil); err != nil {
+		return false, err
+	}
+	now := time.Now()
+	if now.Unix() < lockedUntil {
+		return false, &lockedOut{until: time.Unix(lockedUntil, 0)}
+	}
+
+	ok, err := s.verifySecondFactor(userID, secret, lastStep, code)
+	if err != nil {
+		return false, err
+	}
+	if ok {
+		_, err = s.db.Exec(`UPDATE users SET totp_failures = 0 WHERE id = ?;`, userID)
+		return err == nil, err
+	}
+	// The count restarts once it locks the account.
+	_, err = s.db.Exec(`
+	UPDATE users SET
+		totp_locked_until = CASE WHEN totp_failures + 1 >= ? THEN ? ELSE totp_locked_until END,
+		totp_failures = CASE WHEN totp_failures + 1 >= ? THEN 0 ELSE totp_failures + 1 END
+	WHERE id = ?;`, maxCodeFailures, now.Add(codeLockout).Unix(), maxCodeFailures, userID)
+	return false, err
+}
+
+// verifySecondFactor checks code as a TOTP code, then as a recovery code,
+// and consumes it if it is valid.
+func (s *Service) verifySecondFactor(userID int64, secret string, lastStep int64, code string) (bool, error) {
+	if step, ok := verifyTOTP(secret, code, lastStep); ok {
+		res, err := s.db.Exec(`UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?;`,
+			step, userID, step)
+		if err != nil {
+			return false, err
+		}
+		n, _ := res.RowsAffected()
+		return n == 1, nil
+	}
+
+	res, err := s.db.Exec(`
+	UPDATE recovery_codes SET used_at = CURRENT_TIMESTAMP
+	WHERE user_id = ? AND code_hash = ? AND used_at IS NULL;`, userID, hashSecret(strings.ToLower(code)))
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+// TwoFactorHandler manages the caller's two-factor authentication:
+//
+//	POST   /me/2fa         start enrollment, returning a new secret
+//	POST   /me/2fa/verify  confirm enrollment with a code, returning recovery codes
+//	DELETE /me/2fa         disable with {"code": ...}
+func (s *Service) TwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := FromContext(r.Context())
+	if !ok {
+		apierror.Write(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/me/2fa":
+		s.enroll(w, claims)
+	case r.Method == http.MethodPost && r.URL.Path == "/me/2fa/verify":
+		s.confirmEnrollment(w, r, claims)
+	case r.Method == http.MethodDelete && r.URL.Path == "/me/2fa":
+		s.disableTwoFactor(w, r, claims)
+	default:
+		apierror.Write(w, "Use POST /me/2fa, POST /me/2fa/verify or DELETE /me/2fa", http.StatusMethodNotAllowed)
+	}
+}
+
+// enroll stores a pending secret. It does not take effect until a code
+// generated from it is confirmed.
+func (s *Service) enroll(w http.ResponseWriter, claims Claims) {
+	var email string
+	var enabled bool
+	err := s.db.QueryRow(`SELECT email, totp_enabled FROM users WHERE id = ?;`, claims.Subject).Scan(&email, &enabled)
+	if err == sql.ErrNoRows {
+		apierror.Write(w, "Account not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		apierror.Write(w, "Failed to start enrollment", http.StatusInternalServerError)
+		return
+	}
+	if enabled {
+		apierror.Write(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		apierror.Write(w, "Failed to start enrollment", http.StatusInternalServerError)
+		return
+	}
+	secret := base32NoPad.EncodeToString(key)
+	if _, err := s.db.Exec(`UPDATE users SET totp_secret = ?, totp_last_step = 0 WHERE id = ?;`,
+		secret, claims.Subject); err != nil {
+		apierror.Write(w, "Failed to start enrollment", http.StatusInternalServerError)
+		return
+	}
+
+	uri := url.URL{
+		Scheme: "otpauth",
+		Host:   "totp",
+		Path:   "/QUICkie:" + email,
+		RawQuery: url.Values{
+			"secret": {secret},
+			"issuer": {"QUICkie"},
+		}.Encode(),
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"secret": secret, "otpauth_url": uri.String()})
+}
+
+// confirmEnrollment enables two-factor authentication once the caller
+// proves their authenticator has the pending secret.
+func (s *Service) confirmEnrollment(w http.ResponseWriter, r *http.Request, claims Claims) {
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apierror.WriteCode(w, apierror.CodeInvalidJSON, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	var secret string
+	var enabled bool
+	err := s.db.QueryRow(`SELECT totp_secret, totp_enabled FROM users WHERE id = ?;`, claims.Subject).
+		Scan(&secret, &enabled)
+	if err != nil {
+		apierror.Write(w, "Failed to verify code", http.StatusInternalServerError)
+		return
+	}
+	if enabled || secret == "" {
+		apierror.Write(w, "No enrollment in progress", http.StatusConflict)
+		return
+	}
+	step, ok := verifyTOTP(secret, strings.TrimSpace(req.Code), 0)
+	if !ok {
+		apierror.Write(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	codes := make([]string, recoveryCodes)
+	tx, err := s.db.Begin()
+	if err != nil {
+		apierror.Write(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?;`, claims.Subject); err != nil {
+		apierror.Write(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	for i := range codes {
+		if codes[i], err = newSecret(5); err != nil {
+			apierror.Write(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+			return
+		}
+		if _, err := tx.Exec(`INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?);`,
+			claims.Subject, hashSecret(codes[i])); err != nil {
+			apierror.Write(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+			return
+		}
+	}
+	if _, err := tx.Exec(`UPDATE users SET totp_enabled = 1, totp_last_step = ? WHERE id = ?;`,
+		step, claims.Subject); err != nil {
+		apierror.Write(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	// The session that enrolled has just proven the second factor.
+	if _, err := tx.Exec(`UPDATE sessions SET mfa = 1 WHERE id = ?;`, claims.Session); err != nil {
+		apierror.Write(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		apierror.Write(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string][]string{"recovery_codes": codes})
+}
+
+// disableTwoFactor turns two-factor authentication off after checking a
+// current code, and drops the caller's recovery codes.
+func (s *Service) disableTwoFactor(w http.ResponseWriter, r *http.Request, claims Claims) {
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apierror.WriteCode(w, apierror.CodeInvalidJSON, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	ok, err := s.checkSecondFactor(claims.Subject, req.Code)
+	var locked *lockedOut
+	if errors.As(err, &locked) {
+		writeLockedOut(w, locked)
+		return
+	}
+	if err != nil {
+		apierror.Write(w, "Failed to verify code", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		apierror.Write(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	if _, err := s.db.Exec(`UPDATE users SET totp_enabled = 0, totp_secret = '' WHERE id = ?;`, claims.Subject); err != nil {
+		apierror.Write(w, "Failed to disable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	s.db.Exec(`DELETE FROM recovery_codes WHERE user_id = ?;`, claims.Subject)
+	s.db.Exec(`UPDATE sessions SET mfa = 0 WHERE user_id = ?;`, claims.Subject)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RequireAdmin restricts next to admin and operator accounts whose access
+// token was obtained with a second factor.
+func (s *Service) RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := FromContext(r.Context())
+		if !ok {
+			apierror.Write(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		if !privilegedRoles[claims.Role] {
+			apierror.Write(w, "Admin role required", http.StatusForbidden)
+			return
+		}
+		if !claims.MFA {
+			apierror.WriteCode(w, apierror.CodeTwoFactorRequired, "Two-factor authentication required; enroll at /me/2fa and log in again", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RoleHandler handles PUT /admin/users/{ID}/role with {"role": ...}.
+// Only admins may change roles, so operators cannot make themselves or
+// others admins.
+func (s *Service) RoleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		apierror.Write(w, "Only PUT requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if claims, _ := FromContext(r.Context()); claims.Role != "admin" || !claims.Admin() {
+		apierror.Write(w, "Admin role required to change roles", http.StatusForbidden)
+		return
+	}
+	id, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/admin/users/"), "/role")
+	if !ok || id == "" {
+		apierror.Write(w, "Use PUT /admin/users/{ID}/role", http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apierror.WriteCode(w, apierror.CodeInvalidJSON, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if !ValidRole(req.Role) {
+		apierror.Write(w, "role must be user, operator or admin", http.StatusBadRequest)
+		return
+	}
+
+	res, err := s.db.Exec(`UPDATE users SET role = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?;`, req.Role, id)
+	if err != nil {
+		apierror.Write(w, "Failed to update role", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		apierror.Write(w, "Account not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,256 @@
+package activity
+
+import (
+	"database/sql"
+	"encoding/json"
+	"naevis/accounts"
+	"naevis/apierror"
+	"naevis/cursor"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultLimit = 50
+	maxLimit     = 500
+)
+
+// Kinds of feed items.
+const (
+	KindSubmission = "submission"
+	KindReview     = "review"
+	KindFavorite   = "favorite"
+)
+
+// Item is one entry of a user's activity feed.
+type Item struct {
+	Kind       string `json:"kind"`
+	EntityType string `json:"entity_type"`
+	EntityId   string `json:"entity_id"`
+	Action     string `json:"action,omitempty"`
+	ItemId     string `json:"item_id,omitempty"`
+	ItemType   string `json:"item_type,omitempty"`
+	CreatedAt  string `json:"created_at"`
+}
+
+type page struct {
+	Items      []Item `json:"items"`
+	Limit      int64  `json:"limit"`
+	Offset     int64  `json:"offset"`
+	HasMore    bool   `json:"has_more"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// feedCursor is the position of a page of the feed: the sort key of the
+// last item before it. Events and favorites are told apart by Source, as
+// their row ids overlap.
+type feedCursor struct {
+	CreatedAt string `json:"created_at"`
+	Source    int    `json:"source"`
+	ID        int64  `json:"id"`
+}
+
+// Feed serves the authenticated user's activity: the events they
+// submitted, split into reviews and other submissions, and the entities
+// they favorited.
+type Feed struct {
+	db   *sql.DB
+	cold bool
+}
+
+// New creates a Feed.
+func New(db *sql.DB) *Feed {
+	return &Feed{db: db}
+}
+
+// SetCold lets requests with tier=all include events moved to the cold
+// tier, which must be attached.
+func (f *Feed) SetCold(enabled bool) {
+	f.cold = enabled
+}
+
+// feedQuery merges the sources of a user's activity, newest first, ties
+// broken by source and row id so every item has a place to resume after.
+// Its parameters are the user ID twice, an optional kind filter twice,
+// then whether a cursor is given and its created_at, source and id.
+const feedQuery = `
+SELECT kind, entity_type, entity_id, action, item_id, item_type, created_at, source, rid FROM (
+	SELECT CASE WHEN lower(action) IN ('review', 'reviewed') THEN 'review' ELSE 'submission' END AS kind,
+		entity_type, entity_id, action, item_id, item_type, COALESCE(created_at, '') AS created_at, 0 AS source, id AS rid
+	FROM events WHERE user_id = ?
+	UNION ALL
+	SELECT 'favorite', entity_type, entity_id, '', '', '', COALESCE(created_at, ''), 1, rowid
+	FROM favorites WHERE user_id = ?
+)
+WHERE (? = '' OR kind = ?) AND (? = 0 OR (created_at, source, rid) < (?, ?, ?))
+ORDER BY created_at DESC, source DESC, rid DESC
+LIMIT ? OFFSET ?;`
+
+// feedQueryAll is feedQuery over both event tiers, whose ids never
+// overlap. Its parameters are the user ID three times, then as for
+// feedQuery.
+const feedQueryAll = `
+SELECT kind, entity_type, entity_id, action, item_id, item_type, created_at, source, rid FROM (
+	SELECT CASE WHEN lower(action) IN ('review', 'reviewed') THEN 'review' ELSE 'submission' END AS kind,
+		entity_type, entity_id, action, item_id, item_type, COALESCE(created_at, '') AS created_at, 0 AS source, id AS rid
+	FROM (
+		SELECT id, entity_type, entity_id, action, item_id, item_type, created_at FROM events WHERE user_id = ?
+		UNION ALL
+		SELECT id, entity_type, entity_id, action, item_id, item_type, created_at FROM cold.events WHERE user_id = ?
+	)
+	UNION ALL
+	SELECT 'favorite', entity_type, entity_id, '', '', '', COALESCE(created_at, ''), 1, rowid
+	FROM favorites WHERE user_id = ?
+)
+WHERE (? = '' OR kind = ?) AND (? = 0 OR (created_at, source, rid) < (?, ?, ?))
+ORDER BY created_at DESC, source DESC, rid DESC
+LIMIT ? OFFSET ?;`
+
+// ActivityHandler handles GET
+// /me/activity?kind=&limit=N&offset=N|cursor=CURSOR&tier=. Only hot
+// events are listed unless tier is "all". Pages with more after them
+// carry the cursor of the next.
+func (f *Feed) ActivityHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apierror.Write(w, "Only GET requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims, ok := accounts.FromContext(r.Context())
+	if !ok {
+		apierror.Write(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	q := r.URL.Query()
+	limit, err := intParam(q.Get("limit"), defaultLimit)
+	if err != nil || limit <= 0 {
+		apierror.Write(w, "Invalid limit", http.StatusBadRequest)
+		return
+	}
+	if limit > maxLimit {
+		limit = maxLimit
+	}
+	offset, err := intParam(q.Get("offset"), 0)
+	if err != nil || offset < 0 {
+		apierror.Write(w, "Invalid offset", http.StatusBadRequest)
+		return
+	}
+	var after feedCursor
+	hasCursor := q.Get("cursor") != ""
+	if hasCursor {
+		if offset > 0 {
+			apierror.Write(w, "Use offset or cursor, not both", http.StatusBadRequest)
+			return
+		}
+		if cursor.Decode(q.Get("cursor"), &after) != nil {
+			apierror.Write(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+	kind := q.Get("kind")
+	switch kind {
+	case "", KindSubmission, KindReview, KindFavorite:
+	default:
+		apierror.Write(w, "kind must be submission, review or favorite", http.StatusBadRequest)
+		return
+	}
+
+	var rows *sql.Rows
+	switch q.Get("tier") {
+	case "", "hot":
+		rows, err = f.db.Query(feedQuery, claims.Subject, claims.Subject, kind, kind,
+			hasCursor, after.CreatedAt, after.Source, after.ID, limit+1, offset)
+	case "all":
+		if !f.cold {
+			apierror.Write(w, "Cold tier is not enabled", http.StatusBadRequest)
+			return
+		}
+		rows, err = f.db.Query(feedQueryAll, claims.Subject, claims.Subject, claims.Subject, kind, kind,
+			hasCursor, after.CreatedAt, after.Source, after.ID, limit+1, offset)
+	default:
+		apierror.Write(w, "tier must be hot or all", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		apierror.Write(w, "Failed to load activity", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	items := []Item{}
+	var keys []feedCursor
+	for rows.Next() {
+		var it Item
+		var key feedCursor
+		if err := rows.Scan(&it.Kind, &it.EntityType, &it.EntityId, &it.Action, &it.ItemId, &it.ItemType, &it.CreatedAt,
+			&key.Source, &key.ID); err != nil {
+			apierror.Write(w, "Failed to load activity", http.StatusInternalServerError)
+			return
+		}
+		key.CreatedAt = it.CreatedAt
+		items = append(items, it)
+		keys = append(keys, key)
+	}
+
+	result := page{Items: items, Limit: limit, Offset: offset}
+	if int64(len(items)) > limit {
+		result.Items = items[:limit]
+		result.HasMore = true
+		result.NextCursor = cursor.Encode(keys[limit-1])
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// FavoritesHandler handles PUT and DELETE
+// /me/favorites/{ENTITY_TYPE}/{ENTITY_ID}.
+func (f *Feed) FavoritesHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := accounts.FromContext(r.Context())
+	if !ok {
+		apierror.Write(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+	entityType, entityId, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/me/favorites/"), "/")
+	if entityType == "" || entityId == "" {
+		apierror.Write(w, "Use /me/favorites/{ENTITY_TYPE}/{ENTITY_ID}", http.StatusNotFound)
+		return
+	}
+
+	var err error
+	switch r.Method {
+	case http.MethodPut:
+		_, err = f.db.Exec(`
+		INSERT INTO favorites (user_id, entity_type, entity_id, created_at)
+		VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(user_id, entity_type, entity_id) DO NOTHING;`, claims.Subject, entityType, entityId)
+	case http.MethodDelete:
+		_, err = f.db.Exec(`DELETE FROM favorites WHERE user_id = ? AND entity_type = ? AND entity_id = ?;`,
+			claims.Subject, entityType, entityId)
+	default:
+		apierror.Write(w, "Only PUT and DELETE requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		apierror.Write(w, "Failed to update favorites", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func intParam(s string, def int64) (int64, error) {
+	if s == "" {
+		return def, nil
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	response, err := json.Marshal(v)
+	if err != nil {
+		apierror.Write(w, "Error encoding JSON", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(response)
+}
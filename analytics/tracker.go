@@ -0,0 +1,286 @@
+package analytics
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"naevis/apierror"
+	"naevis/clock"
+	"naevis/ingest"
+	"naevis/sampling"
+	"naevis/structs"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// queueSize bounds the number of hits waiting to be written.
+	queueSize = 10000
+	// batchSize is the maximum number of hits written per transaction.
+	batchSize = 500
+	// flushInterval is how long a partial batch may wait before it is written.
+	flushInterval = time.Second
+)
+
+// pixel is a 1x1 transparent GIF returned by the /t endpoint.
+var pixel = []byte{
+	0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0xff, 0xff, 0xff, 0x21, 0xf9, 0x04, 0x01, 0x00,
+	0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x01, 0x00,
+	0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3b,
+}
+
+// Tracker is the ingestion fast path for clicks and impressions. Hits skip
+// MongoDB enrichment and are written to tracking_events in batches.
+type Tracker struct {
+	db        *sql.DB
+	sampler   *sampling.Sampler
+	validator *ingest.Validator
+	// maxBodyBytes caps the body posted to /track.
+	maxBodyBytes int64
+	clock        clock.Clock
+	// mu makes a batch of hits queue whole or not at all.
+	mu      sync.Mutex
+	hits    chan structs.Index
+	flushes chan chan struct{}
+	done    chan struct{}
+}
+
+// NewTracker creates a Tracker and starts its background writer, which
+// flushes partial batches on ticks of clk. Hits are checked by validator,
+// like events, and bodies posted to /track are capped at maxBodyBytes.
+func NewTracker(db *sql.DB, sampler *sampling.Sampler, validator *ingest.Validator, maxBodyBytes int64, clk clock.Clock) *Tracker {
+	t := &Tracker{
+		db:           db,
+		sampler:      sampler,
+		validator:    validator,
+		maxBodyBytes: maxBodyBytes,
+		clock:        clk,
+		hits:         make(chan structs.Index, queueSize),
+		flushes:      make(chan chan struct{}),
+		done:         make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// Track queues a hit for writing. Hits sampled out are counted but not
+// queued; the others are counted once written. It reports false when the queue is full and the hit was dropped.
+func (t *Tracker) Track(hit structs.Index) bool {
+	return t.TrackAll([]structs.Index{hit})
+}
+
+// TrackAll queues hits for writing, all of them or, when the queue has no
+// room for every hit, none; it then reports false and no hit is counted.
+func (t *Tracker) TrackAll(hits []structs.Index) bool {
+	// Only the writer takes hits off the queue, so the room seen under the
+	// lock can only grow until the hits are queued.
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if cap(t.hits)-len(t.hits) < len(hits) {
+		return false
+	}
+	for _, hit := range hits {
+		if t.sampler.Keep(hit) {
+			t.hits <- hit
+		}
+	}
+	return true
+}
+
+// Flush writes every hit queued so far and returns once they are stored.
+func (t *Tracker) Flush() {
+	flushed := make(chan struct{})
+	select {
+	case t.flushes <- flushed:
+		<-flushed
+	case <-t.done:
+	}
+}
+
+// Close stops accepting hits and waits until the queue has been flushed.
+func (t *Tracker) Close() {
+	close(t.hits)
+	<-t.done
+}
+
+// run collects hits into batches and writes them when a batch is full or
+// the flush interval elapses.
+func (t *Tracker) run() {
+	defer close(t.done)
+
+	ticker := t.clock.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]structs.Index, 0, batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.writeBatch(batch); err != nil {
+			log.Printf("Error writing %d tracking hits: %v", len(batch), err)
+		} else {
+			for _, hit := range batch {
+				t.sampler.Stored(hit)
+			}
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case hit, ok := <-t.hits:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, hit)
+			if len(batch) >= batchSize {
+				flush()
+			}
+		case <-ticker.C():
+			flush()
+		case flushed := <-t.flushes:
+			// Hits queued before the request are taken first.
+			for n := len(t.hits); n > 0; n-- {
+				batch = append(batch, <-t.hits)
+				if len(batch) >= batchSize {
+					flush()
+				}
+			}
+			flush()
+			close(flushed)
+		}
+	}
+}
+
+// writeBatch inserts a batch of hits in a single transaction.
+func (t *Tracker) writeBatch(batch []structs.Index) error {
+	tx, err := t.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+	INSERT INTO tracking_events (entity_type, action, entity_id, item_id, item_type, tenant)
+	VALUES (?, ?, ?, ?, ?, ?);`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, hit := range batch {
+		if _, err := stmt.Exec(hit.EntityType, hit.Action, hit.EntityId, hit.ItemId, hit.ItemType, hit.Tenant); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// PixelHandler handles GET /t?entity_type=...&action=...&entity_id=... and
+// responds with a transparent GIF so it can be embedded as an image.
+func (t *Tracker) PixelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apierror.Write(w, "Only GET requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	hit := structs.Index{
+		EntityType: q.Get("entity_type"),
+		Action:     q.Get("action"),
+		EntityId:   q.Get("entity_id"),
+		ItemId:     q.Get("item_id"),
+		ItemType:   q.Get("item_type"),
+		Tenant:     r.Header.Get("X-Tenant-ID"),
+	}
+	if t.validator.Check(hit) == nil {
+		t.Track(hit)
+	}
+
+	// The pixel is always served, even if the hit was invalid or dropped,
+	// so pages never render a broken image.
+	w.Header().Set("Content-Type", "image/gif")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(pixel)
+}
+
+// TrackHandler handles POST /track with either a single hit or a JSON array
+// of hits in the same shape as /event. The hits are accepted together or,
+// with 422 when one is invalid or 503 when the queue is full, not at all.
+func (t *Tracker) TrackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		apierror.Write(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, t.maxBodyBytes))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		apierror.Write(w, "Body larger than "+strconv.FormatInt(tooLarge.Limit, 10)+" bytes", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		apierror.Write(w, "Failed to read body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	hits, batch, err := decodeHits(body)
+	if err != nil {
+		apierror.WriteCode(w, apierror.CodeInvalidJSON, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if len(hits) > queueSize {
+		apierror.Write(w, "At most "+strconv.Itoa(queueSize)+" hits per request", http.StatusRequestEntityTooLarge)
+		return
+	}
+	var fields []apierror.FieldError
+	for i := range hits {
+		hits[i].Tenant = r.Header.Get("X-Tenant-ID")
+		var invalid *ingest.ValidationError
+		if !errors.As(t.validator.Check(hits[i]), &invalid) {
+			continue
+		}
+		for _, f := range invalid.Fields {
+			if batch {
+				f.Field = fmt.Sprintf("[%d].%s", i, f.Field)
+			}
+			fields = append(fields, f)
+		}
+	}
+	if fields != nil {
+		apierror.WriteFields(w, apierror.CodeInvalidEvent, "Invalid hits", http.StatusUnprocessableEntity, fields)
+		return
+	}
+	// A batch is queued whole or not at all, so a client retrying after
+	// 503 never counts a hit twice.
+	if !t.TrackAll(hits) {
+		apierror.WriteCode(w, apierror.CodeQueueFull, "Tracking queue full", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// decodeHits accepts either a JSON object or a JSON array of objects, and
+// reports which it was.
+func decodeHits(body []byte) (hits []structs.Index, batch bool, err error) {
+	if err := json.Unmarshal(body, &hits); err == nil {
+		return hits, true, nil
+	}
+
+	var hit structs.Index
+	if err := json.Unmarshal(body, &hit); err != nil {
+		return nil, false, err
+	}
+	return []structs.Index{hit}, false, nil
+}
@@ -0,0 +1,144 @@
+package apierror
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Class groups errors by how a client should react to them.
+type Class string
+
+const (
+	// Validation errors mean the request itself is wrong; resending it
+	// unchanged fails again.
+	Validation Class = "validation"
+	// Auth errors mean the caller is not authenticated or not allowed.
+	Auth Class = "auth"
+	// NotFound errors mean the addressed resource does not exist.
+	NotFound Class = "not_found"
+	// Conflict errors mean the request clashes with the current state.
+	Conflict Class = "conflict"
+	// Transient errors are expected to clear up; retry with backoff.
+	Transient Class = "transient"
+	// Internal errors are server bugs or unexpected failures.
+	Internal Class = "internal"
+)
+
+// Codes for errors that clients need to tell apart from others with the
+// same status. Other errors use the code of their status.
+const (
+	CodeInvalidJSON       = "invalid_json"
+	CodeInvalidToken      = "invalid_token"
+	CodeTwoFactorRequired = "two_factor_required"
+	CodeTwoFactorLocked   = "two_factor_locked"
+	CodeQueueFull         = "queue_full"
+	CodeDigestMismatch    = "digest_mismatch"
+	CodeSignatureRequired = "signature_required"
+	CodeInvalidSignature  = "invalid_signature"
+	CodeStaleSignature    = "stale_signature"
+	CodeReplayedRequest   = "replayed_request"
+	CodeQuotaExceeded     = "quota_exceeded"
+	CodeInvalidEvent      = "invalid_event"
+	CodeStandby           = "standby"
+	CodeFeedExpired       = "feed_expired"
+)
+
+// retryAfter is the Retry-After hint, in seconds, sent with transient
+// errors.
+const retryAfter = "1"
+
+// Error is the error body returned by every endpoint:
+//
+//	{"error": {"code": "invalid_json", "class": "validation", "message": "Invalid JSON", "retryable": false}}
+//
+// Errors about a request body may list the fields at fault.
+type Error struct {
+	Code      string       `json:"code"`
+	Class     Class        `json:"class"`
+	Message   string       `json:"message"`
+	Retryable bool         `json:"retryable"`
+	Fields    []FieldError `json:"fields,omitempty"`
+}
+
+// FieldError is what is wrong with one field of a request body.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// classify maps a status to its class and default code.
+func classify(status int) (Class, string) {
+	switch status {
+	case http.StatusBadRequest:
+		return Validation, "invalid_request"
+	case http.StatusMethodNotAllowed:
+		return Validation, "method_not_allowed"
+	case http.StatusRequestEntityTooLarge:
+		return Validation, "payload_too_large"
+	case http.StatusUnsupportedMediaType:
+		return Validation, "unsupported_media_type"
+	case http.StatusUnprocessableEntity:
+		return Validation, "unprocessable"
+	case http.StatusUnauthorized:
+		return Auth, "unauthenticated"
+	case http.StatusForbidden:
+		return Auth, "forbidden"
+	case http.StatusNotFound:
+		return NotFound, "not_found"
+	case http.StatusConflict:
+		return Conflict, "conflict"
+	case http.StatusGone:
+		return NotFound, "gone"
+	case http.StatusPreconditionFailed:
+		return Conflict, "precondition_failed"
+	case http.StatusPreconditionRequired:
+		return Conflict, "precondition_required"
+	case http.StatusInsufficientStorage:
+		return Conflict, "insufficient_storage"
+	case http.StatusTooManyRequests:
+		return Transient, "rate_limited"
+	case http.StatusMisdirectedRequest:
+		return Transient, "misdirected"
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return Transient, "unavailable"
+	case http.StatusLoopDetected:
+		return Internal, "loop_detected"
+	}
+	if status >= 500 {
+		return Internal, "internal"
+	}
+	return Validation, "invalid_request"
+}
+
+// Write replies with a structured error. It takes the same arguments as
+// http.Error; the class, code and retryability follow from the status.
+func Write(w http.ResponseWriter, message string, status int) {
+	WriteCode(w, "", message, status)
+}
+
+// WriteCode is like Write with a specific error code. An empty code uses
+// the status's default.
+func WriteCode(w http.ResponseWriter, code, message string, status int) {
+	WriteFields(w, code, message, status, nil)
+}
+
+// WriteFields is like WriteCode, listing the fields at fault.
+func WriteFields(w http.ResponseWriter, code, message string, status int, fields []FieldError) {
+	class, def := classify(status)
+	if code == "" {
+		code = def
+	}
+	body, _ := json.Marshal(struct {
+		Error Error `json:"error"`
+	}{Error{Code: code, Class: class, Message: message, Retryable: class == Transient, Fields: fields}})
+
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	if class == Transient && h.Get("Retry-After") == "" {
+		h.Set("Retry-After", retryAfter)
+	}
+	w.WriteHeader(status)
+	w.Write(append(body, '\n'))
+}
@@ -0,0 +1,301 @@
+package blobs
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"naevis/apierror"
+	"naevis/config"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Blob describes a stored attachment.
+type Blob struct {
+	SHA256      string `json:"sha256"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
+}
+
+// Store keeps content-addressed attachments. A blob's key is the SHA-256
+// of its contents, so uploading the same file twice stores it once. Events
+// reference blobs by key; blobs that no stored event references are
+// garbage collected, so deleting events also deletes their attachments.
+type Store struct {
+	db      *sql.DB
+	backend Backend
+	maxSize int64
+	grace   time.Duration
+
+	// uploadDir holds partial resumable uploads.
+	uploadDir string
+	locks     uploadLocks
+}
+
+// New creates a blob store from cfg. It returns nil when attachments are
+// not configured.
+func New(db *sql.DB, cfg config.Attachments) *Store {
+	s := &Store{db: db, maxSize: cfg.MaxSize, grace: cfg.Grace.Duration}
+	switch {
+	case cfg.S3.Bucket != "":
+		s.backend = NewS3(cfg.S3)
+	case cfg.Dir != "":
+		s.backend = Disk{Dir: cfg.Dir}
+	default:
+		return nil
+	}
+	switch {
+	case cfg.UploadDir != "":
+		s.uploadDir = cfg.UploadDir
+	case cfg.Dir != "":
+		s.uploadDir = filepath.Join(cfg.Dir, "uploads")
+	default:
+		s.uploadDir = filepath.Join(os.TempDir(), "quickie-uploads")
+	}
+	return s
+}
+
+// ValidKey reports whether key is a lowercase hex SHA-256 digest.
+func ValidKey(key string) bool {
+	if len(key) != sha256.Size*2 {
+		return false
+	}
+	for _, c := range key {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Missing returns the keys that do not name a stored blob.
+func (s *Store) Missing(keys []string) ([]string, error) {
+	var missing []string
+	for _, key := range keys {
+		var n int
+		err := s.db.QueryRow(`SELECT COUNT(*) FROM blobs WHERE sha256 = ?;`, key).Scan(&n)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			missing = append(missing, key)
+		}
+	}
+	return missing, nil
+}
+
+// ServeHTTP handles POST /blobs to upload a blob and GET or HEAD
+// /blobs/{SHA256} to download one. Large blobs can be uploaded in
+// resumable chunks under /blobs/uploads.
+func (s *Store) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.Trim(strings.TrimPrefix(r.URL.Path, "/blobs"), "/")
+	if key == "uploads" || strings.HasPrefix(key, "uploads/") {
+		s.uploads(w, r, strings.TrimPrefix(strings.TrimPrefix(key, "uploads"), "/"))
+		return
+	}
+	switch {
+	case key == "" && r.Method == http.MethodPost:
+		s.upload(w, r)
+	case key == "":
+		apierror.Write(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+	case !ValidKey(key):
+		apierror.Write(w, "Use /blobs/{SHA256}", http.StatusNotFound)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		s.download(w, r, key)
+	default:
+		apierror.Write(w, "Only GET and HEAD requests allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// upload spools the body to a temporary file while hashing it, then
+// stores it under its digest unless a blob with that digest exists.
+func (s *Store) upload(w http.ResponseWriter, r *http.Request) {
+	tmp, err := os.CreateTemp("", "quickie-blob-*")
+	if err != nil {
+		apierror.Write(w, "Failed to store blob", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), http.MaxBytesReader(w, r.Body, s.maxSize))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		apierror.Write(w, "Blob larger than "+strconv.FormatInt(s.maxSize, 10)+" bytes", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		apierror.Write(w, "Failed to read body", http.StatusBadRequest)
+		return
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	blob := Blob{SHA256: hex.EncodeToString(h.Sum(nil)), Size: size, ContentType: contentType}
+	if err := s.put(r.Context(), blob, tmp); err != nil {
+		log.Printf("Error storing blob %s: %v", blob.SHA256, err)
+		apierror.Write(w, "Failed to store blob", http.StatusInternalServerError)
+		return
+	}
+
+	// Existing blobs get the same reply, so uploads do not reveal what
+	// other tenants have stored.
+	response, _ := json.Marshal(blob)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/blobs/"+blob.SHA256)
+	w.WriteHeader(http.StatusCreated)
+	w.Write(response)
+}
+
+// put stores the contents of f as blob unless it already exists. Either
+// way the blob's upload time is refreshed, which restarts its grace
+// period before garbage collection.
+func (s *Store) put(ctx context.Context, blob Blob, f *os.File) error {
+	res, err := s.db.Exec(`UPDATE blobs SET uploaded_at = CURRENT_TIMESTAMP WHERE sha256 = ?;`, blob.SHA256)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := s.backend.Put(ctx, blob.SHA256, f, blob.Size); err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`
+	INSERT INTO blobs (sha256, size, content_type, created_at, uploaded_at)
+	VALUES (?, ?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+	ON CONFLICT(sha256) DO UPDATE SET uploaded_at = excluded.uploaded_at;`,
+		blob.SHA256, blob.Size, blob.ContentType)
+	return err
+}
+
+// download streams a blob. Blobs never change, so they are cached
+// forever and, when the backend can seek, served with range support.
+func (s *Store) download(w http.ResponseWriter, r *http.Request, key string) {
+	var contentType string
+	err := s.db.QueryRow(`SELECT content_type FROM blobs WHERE sha256 = ?;`, key).Scan(&contentType)
+	if err == sql.ErrNoRows {
+		apierror.Write(w, "Blob not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		apierror.Write(w, "Failed to load blob", http.StatusInternalServerError)
+		return
+	}
+
+	body, size, err := s.backend.Get(r.Context(), key)
+	if err == ErrNotFound {
+		apierror.Write(w, "Blob not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading blob %s: %v", key, err)
+		apierror.Write(w, "Failed to load blob", http.StatusBadGateway)
+		return
+	}
+	defer body.Close()
+
+	h := w.Header()
+	h.Set("Content-Type", contentType)
+	h.Set("ETag", `"`+key+`"`)
+	h.Set("Cache-Control", "public, max-age=31536000, immutable")
+	sum, _ := hex.DecodeString(key)
+	h.Set("Repr-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(sum)+":")
+	if rs, ok := body.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, "", time.Time{}, rs)
+		return
+	}
+	if r.Header.Get("If-None-Match") == `"`+key+`"` {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if size >= 0 {
+		h.Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		io.Copy(w, body)
+	}
+}
+
+// Run collects unreferenced blobs every interval until ctx is cancelled.
+func (s *Store) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.Collect(ctx); err != nil {
+			log.Printf("Error collecting blobs: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Collect drops references held by deleted events, then deletes blobs
+// that have been unreferenced for longer than the grace period. Resumable
+// uploads idle for as long are deleted too.
+func (s *Store) Collect(ctx context.Context) error {
+	if err := s.expireUploads(); err != nil {
+		return err
+	}
+	if _, err := s.db.Exec(`
+	DELETE FROM event_attachments WHERE event_id NOT IN (SELECT id FROM events);`); err != nil {
+		return err
+	}
+
+	rows, err := s.db.Query(`
+	SELECT sha256 FROM blobs
+	WHERE uploaded_at < ? AND sha256 NOT IN (SELECT sha256 FROM event_attachments);`,
+		time.Now().UTC().Add(-s.grace).Format(time.DateTime))
+	if err != nil {
+		return err
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return err
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := s.backend.Delete(ctx, key); err != nil {
+			return err
+		}
+		if _, err := s.db.Exec(`DELETE FROM blobs WHERE sha256 = ?;`, key); err != nil {
+			return err
+		}
+	}
+	if len(keys) > 0 {
+		log.Printf("Deleted %d unreferenced blobs", len(keys))
+	}
+	return nil
+}
@@ -0,0 +1,342 @@
+package blobs
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"naevis/apierror"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// tusVersion is the tus resumable upload protocol version spoken by
+// /blobs/uploads.
+const tusVersion = "1.0.0"
+
+// offsetType is the media type of PATCH bodies.
+const offsetType = "application/offset+octet-stream"
+
+// uploadLocks keeps concurrent PATCHes of one upload from interleaving.
+type uploadLocks struct {
+	mu    sync.Mutex
+	locks map[string]bool
+}
+
+func (l *uploadLocks) tryLock(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.locks[id] {
+		return false
+	}
+	if l.locks == nil {
+		l.locks = make(map[string]bool)
+	}
+	l.locks[id] = true
+	return true
+}
+
+func (l *uploadLocks) unlock(id string) {
+	l.mu.Lock()
+	delete(l.locks, id)
+	l.mu.Unlock()
+}
+
+func (s *Store) uploadPath(id string) string {
+	return filepath.Join(s.uploadDir, id)
+}
+
+// uploads serves the tus protocol (core, creation and termination) under
+// /blobs/uploads. A client creates an upload with its Upload-Length, then
+// PATCHes chunks at the Upload-Offset the server reports; after a dropped
+// connection it asks for the offset with HEAD and continues from there.
+// The finished upload is stored as a blob, whose key is returned in
+// Blob-SHA256.
+func (s *Store) uploads(w http.ResponseWriter, r *http.Request, id string) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", "creation,termination")
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(s.maxSize, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if v := r.Header.Get("Tus-Resumable"); v != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		apierror.Write(w, "Unsupported Tus-Resumable version", http.StatusPreconditionFailed)
+		return
+	}
+
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		s.createUpload(w, r)
+	case id == "":
+		apierror.Write(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+	case r.Method == http.MethodHead:
+		s.uploadStatus(w, id)
+	case r.Method == http.MethodPatch:
+		s.appendUpload(w, r, id)
+	case r.Method == http.MethodDelete:
+		s.deleteUpload(w, id)
+	default:
+		apierror.Write(w, "Only HEAD, PATCH and DELETE requests allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Store) createUpload(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		apierror.Write(w, "Missing or invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if length > s.maxSize {
+		apierror.Write(w, "Upload larger than "+strconv.FormatInt(s.maxSize, 10)+" bytes", http.StatusRequestEntityTooLarge)
+		return
+	}
+	contentType := r.Header.Get("Upload-Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	if err := os.MkdirAll(s.uploadDir, 0o755); err != nil {
+		apierror.Write(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+	f, err := os.OpenFile(s.uploadPath(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		apierror.Write(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+	f.Close()
+	if _, err := s.db.Exec(`
+	INSERT INTO blob_uploads (id, length, received, content_type, created_at, updated_at)
+	VALUES (?, ?, 0, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP);`, id, length, contentType); err != nil {
+		os.Remove(s.uploadPath(id))
+		apierror.Write(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/blobs/uploads/"+id)
+	w.Header().Set("Upload-Offset", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// upload is the state of a resumable upload.
+type upload struct {
+	length, offset int64
+	contentType    string
+	sha256         string
+}
+
+func (s *Store) loadUpload(id string) (upload, error) {
+	var u upload
+	err := s.db.QueryRow(`SELECT length, received, content_type, sha256 FROM blob_uploads WHERE id = ?;`, id).
+		Scan(&u.length, &u.offset, &u.contentType, &u.sha256)
+	return u, err
+}
+
+func (s *Store) uploadStatus(w http.ResponseWriter, id string) {
+	u, err := s.loadUpload(id)
+	if err == sql.ErrNoRows {
+		apierror.Write(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		apierror.Write(w, "Failed to load upload", http.StatusInternalServerError)
+		return
+	}
+	h := w.Header()
+	h.Set("Cache-Control", "no-store")
+	h.Set("Upload-Offset", strconv.FormatInt(u.offset, 10))
+	h.Set("Upload-Length", strconv.FormatInt(u.length, 10))
+	if u.sha256 != "" {
+		h.Set("Blob-SHA256", u.sha256)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// appendUpload writes a chunk at the upload's offset. Bytes received
+// before a connection drops are kept, so the client can resume from the
+// offset HEAD reports.
+func (s *Store) appendUpload(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Header.Get("Content-Type") != offsetType {
+		apierror.Write(w, "Content-Type must be "+offsetType, http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		apierror.Write(w, "Missing or invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+	if !s.locks.tryLock(id) {
+		apierror.Write(w, "Upload is being written by another request", http.StatusConflict)
+		return
+	}
+	defer s.locks.unlock(id)
+
+	u, err := s.loadUpload(id)
+	if err == sql.ErrNoRows {
+		apierror.Write(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		apierror.Write(w, "Failed to load upload", http.StatusInternalServerError)
+		return
+	}
+	if offset != u.offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(u.offset, 10))
+		apierror.Write(w, "Upload-Offset does not match the upload", http.StatusConflict)
+		return
+	}
+	if u.sha256 != "" {
+		w.Header().Set("Blob-SHA256", u.sha256)
+		w.Header().Set("Upload-Offset", strconv.FormatInt(u.offset, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	f, err := os.OpenFile(s.uploadPath(id), os.O_WRONLY, 0)
+	if err != nil {
+		apierror.Write(w, "Failed to open upload", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	// Drop anything past the recorded offset, left by a crash between a
+	// write and its offset update.
+	if err := f.Truncate(u.offset); err != nil {
+		apierror.Write(w, "Failed to write upload", http.StatusInternalServerError)
+		return
+	}
+	if _, err := f.Seek(u.offset, io.SeekStart); err != nil {
+		apierror.Write(w, "Failed to write upload", http.StatusInternalServerError)
+		return
+	}
+
+	remaining := u.length - u.offset
+	n, copyErr := io.Copy(f, io.LimitReader(r.Body, remaining+1))
+	if n > remaining {
+		f.Truncate(u.offset)
+		apierror.Write(w, "Chunk exceeds Upload-Length", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err := f.Sync(); err != nil {
+		apierror.Write(w, "Failed to write upload", http.StatusInternalServerError)
+		return
+	}
+	u.offset += n
+	if _, err := s.db.Exec(`UPDATE blob_uploads SET received = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?;`,
+		u.offset, id); err != nil {
+		apierror.Write(w, "Failed to write upload", http.StatusInternalServerError)
+		return
+	}
+	if copyErr != nil {
+		// The client is probably gone; it resumes from the new offset.
+		log.Printf("Upload %s interrupted at %d of %d bytes: %v", id, u.offset, u.length, copyErr)
+		apierror.Write(w, "Chunk interrupted", http.StatusBadRequest)
+		return
+	}
+
+	if u.offset == u.length && u.sha256 == "" {
+		key, err := s.finishUpload(r, id, u)
+		if err != nil {
+			log.Printf("Error storing upload %s: %v", id, err)
+			apierror.Write(w, "Failed to store blob", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Blob-SHA256", key)
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finishUpload hashes a complete upload and stores it as a blob. The
+// upload's record keeps the key until it expires, so a client that lost
+// the final response can still learn it with HEAD.
+func (s *Store) finishUpload(r *http.Request, id string, u upload) (string, error) {
+	f, err := os.Open(s.uploadPath(id))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	blob := Blob{SHA256: hex.EncodeToString(h.Sum(nil)), Size: u.length, ContentType: u.contentType}
+	if err := s.put(r.Context(), blob, f); err != nil {
+		return "", err
+	}
+	if _, err := s.db.Exec(`UPDATE blob_uploads SET sha256 = ? WHERE id = ?;`, blob.SHA256, id); err != nil {
+		return "", err
+	}
+	os.Remove(s.uploadPath(id))
+	return blob.SHA256, nil
+}
+
+func (s *Store) deleteUpload(w http.ResponseWriter, id string) {
+	if !s.locks.tryLock(id) {
+		apierror.Write(w, "Upload is being written by another request", http.StatusConflict)
+		return
+	}
+	defer s.locks.unlock(id)
+
+	res, err := s.db.Exec(`DELETE FROM blob_uploads WHERE id = ?;`, id)
+	if err != nil {
+		apierror.Write(w, "Failed to delete upload", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		apierror.Write(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	os.Remove(s.uploadPath(id))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// expireUploads deletes uploads not written to within the grace period.
+func (s *Store) expireUploads() error {
+	rows, err := s.db.Query(`SELECT id FROM blob_uploads WHERE updated_at < ?;`,
+		time.Now().UTC().Add(-s.grace).Format(time.DateTime))
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if !s.locks.tryLock(id) {
+			continue
+		}
+		_, err := s.db.Exec(`DELETE FROM blob_uploads WHERE id = ?;`, id)
+		if err == nil {
+			err = os.Remove(s.uploadPath(id))
+		}
+		s.locks.unlock(id)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
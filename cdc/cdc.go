@@ -0,0 +1,177 @@
+package cdc
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"expvar"
+	"log"
+	"naevis/structs"
+	"sync"
+	"time"
+)
+
+// Change is one record read from a source.
+type Change struct {
+	Event structs.Index
+	Data  structs.MongoData
+	// Checkpoint is the opaque source position just after this change.
+	Checkpoint []byte
+}
+
+// EmitFunc hands a change to the hub. The change is stored and its
+// checkpoint persisted before EmitFunc returns.
+type EmitFunc func(Change) error
+
+// Source is a change data capture source such as a MongoDB change stream
+// or a tailed file.
+type Source interface {
+	// Name identifies the source; it keys the stored checkpoint.
+	Name() string
+	// Run streams changes after checkpoint (nil for the beginning) until
+	// ctx is cancelled or an error occurs.
+	Run(ctx context.Context, checkpoint []byte, emit EmitFunc) error
+}
+
+// StoreFunc persists a change's event and enrichment data. It returns an
+// error made by Skip for a change that can never be stored.
+type StoreFunc func(event structs.Index, data structs.MongoData) error
+
+// Skip marks err as final for the change it stopped: the hub counts the
+// change as skipped and moves past it instead of retrying it.
+func Skip(err error) error {
+	return &skipError{err}
+}
+
+type skipError struct{ err error }
+
+func (e *skipError) Error() string { return e.err.Error() }
+func (e *skipError) Unwrap() error { return e.err }
+
+// retryDelay is how long a failed source waits before it is restarted.
+const retryDelay = 5 * time.Second
+
+// metrics holds per-source counters, published under "cdc" in expvar.
+var metrics = expvar.NewMap("cdc")
+
+// Hub runs sources, stores their changes and checkpoints their progress.
+type Hub struct {
+	db    *sql.DB
+	store StoreFunc
+
+	mu      sync.Mutex
+	sources []Source
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// NewHub creates a hub that stores changes with store.
+func NewHub(db *sql.DB, store StoreFunc) *Hub {
+	return &Hub{db: db, store: store}
+}
+
+// Add registers a source. Sources added after Start are not run.
+func (h *Hub) Add(src Source) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.sources = append(h.sources, src)
+}
+
+// Start runs every registered source in its own goroutine.
+func (h *Hub) Start() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+	for _, src := range h.sources {
+		h.wg.Add(1)
+		go func(src Source) {
+			defer h.wg.Done()
+			h.run(ctx, src)
+		}(src)
+	}
+}
+
+// Stop cancels all sources and waits for them to return.
+func (h *Hub) Stop() {
+	h.mu.Lock()
+	cancel := h.cancel
+	h.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	h.wg.Wait()
+}
+
+// run restarts src from its last checkpoint until ctx is cancelled.
+func (h *Hub) run(ctx context.Context, src Source) {
+	stats := new(expvar.Map).Init()
+	metrics.Set(src.Name(), stats)
+
+	emit := func(c Change) error {
+		c.Event.Lineage = structs.Lineage{Connector: "cdc", Origin: src.Name()}
+		var skipped *skipError
+		err := h.store(c.Event, c.Data)
+		switch {
+		case errors.As(err, &skipped):
+			stats.Add("skipped", 1)
+			log.Printf("CDC source %s: skipping change: %v", src.Name(), skipped.err)
+		case err != nil:
+			return err
+		}
+		if err := h.saveCheckpoint(src.Name(), c.Checkpoint); err != nil {
+			return err
+		}
+		if skipped == nil {
+			stats.Add("changes", 1)
+		}
+		stats.Set("last_change", timeVar(time.Now()))
+		return nil
+	}
+
+	for {
+		checkpoint, err := h.loadCheckpoint(src.Name())
+		if err == nil {
+			err = src.Run(ctx, checkpoint, emit)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			stats.Add("errors", 1)
+			log.Printf("CDC source %s failed: %v", src.Name(), err)
+		}
+		stats.Add("restarts", 1)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryDelay):
+		}
+	}
+}
+
+func (h *Hub) loadCheckpoint(name string) ([]byte, error) {
+	var token []byte
+	err := h.db.QueryRow(`SELECT token FROM resume_tokens WHERE source = ?;`, name).Scan(&token)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return token, err
+}
+
+func (h *Hub) saveCheckpoint(name string, token []byte) error {
+	_, err := h.db.Exec(`
+	INSERT INTO resume_tokens (source, token, updated_at) VALUES (?, ?, CURRENT_TIMESTAMP)
+	ON CONFLICT(source) DO UPDATE SET token = excluded.token, updated_at = excluded.updated_at;`,
+		name, token)
+	return err
+}
+
+// timeVar publishes a timestamp in expvar.
+type timeVar time.Time
+
+func (t timeVar) String() string {
+	return `"` + time.Time(t).UTC().Format(time.RFC3339) + `"`
+}
@@ -0,0 +1,104 @@
+package cdc
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"naevis/structs"
+)
+
+// pollInterval is how often a tailed file is checked for new lines.
+const pollInterval = time.Second
+
+// FileTail is a source that follows an append-only NDJSON file of events.
+// Its checkpoint is the byte offset of the next unread line.
+type FileTail struct {
+	Path string
+}
+
+// Name implements Source.
+func (f *FileTail) Name() string {
+	return "file:" + f.Path
+}
+
+// Run implements Source. Lines that are not valid JSON are skipped. If
+// the file shrinks below the checkpoint it is assumed to be rotated and
+// is read again from the start.
+func (f *FileTail) Run(ctx context.Context, checkpoint []byte, emit EmitFunc) error {
+	var offset int64
+	if len(checkpoint) > 0 {
+		v, err := strconv.ParseInt(string(checkpoint), 10, 64)
+		if err != nil {
+			return err
+		}
+		offset = v
+	}
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		next, err := f.readFrom(offset, emit)
+		if err != nil {
+			return err
+		}
+		offset = next
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// readFrom emits every complete line after offset and returns the offset
+// following the last complete line.
+func (f *FileTail) readFrom(offset int64, emit EmitFunc) (int64, error) {
+	file, err := os.Open(f.Path)
+	if os.IsNotExist(err) {
+		return offset, nil
+	}
+	if err != nil {
+		return offset, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return offset, err
+	}
+	if info.Size() < offset {
+		offset = 0
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return offset, err
+	}
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// A partial line is re-read once it has been completed.
+			return offset, nil
+		}
+		if err != nil {
+			return offset, err
+		}
+		offset += int64(len(line))
+
+		var event structs.Index
+		if json.Unmarshal(line, &event) != nil {
+			continue
+		}
+		c := Change{Event: event, Checkpoint: []byte(strconv.FormatInt(offset, 10))}
+		if err := emit(c); err != nil {
+			return offset, err
+		}
+	}
+}
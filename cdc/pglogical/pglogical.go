@@ -0,0 +1,254 @@
+// Package pglogical is a change data capture source reading PostgreSQL
+// logical replication slots.
+package pglogical
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"naevis/cdc"
+	"naevis/config"
+	"naevis/structs"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// pollInterval is how often a slot is checked for new changes.
+const pollInterval = time.Second
+
+// pgBatch bounds the changes read from a slot at once. Decoding stops at
+// the first transaction end past it.
+const pgBatch = 1000
+
+// pgEnrichment names how PostgreSQL rows enrich events in their lineage.
+const pgEnrichment = "pg-logical-row/1"
+
+// pgActions names the change kinds of wal2json as the MongoDB change
+// stream does.
+var pgActions = map[string]string{"I": "insert", "U": "update", "D": "delete"}
+
+// Source is a cdc.Source that reads a PostgreSQL logical replication slot
+// decoded by wal2json. Changes are peeked, and the slot only advances past
+// a transaction once all of its changes are checkpointed. The checkpoint
+// is the commit LSN of the transaction of the last change emitted and the
+// change's position within it, so a transaction read again is resumed
+// after that change.
+type Source struct {
+	cfg config.PGLogical
+}
+
+// New creates a source for a configured slot.
+func New(cfg config.PGLogical) *Source {
+	if cfg.Key == "" {
+		cfg.Key = "id"
+	}
+	return &Source{cfg: cfg}
+}
+
+// Name implements cdc.Source.
+func (p *Source) Name() string {
+	return "pg:" + p.cfg.Slot
+}
+
+// pgPosition is a change within the stream of a slot.
+type pgPosition struct {
+	commit uint64
+	change int
+}
+
+// after reports whether q comes after p.
+func (p pgPosition) after(q pgPosition) bool {
+	return p.commit > q.commit || p.commit == q.commit && p.change > q.change
+}
+
+func (p pgPosition) checkpoint() []byte {
+	return []byte(formatLSN(p.commit) + "#" + strconv.Itoa(p.change))
+}
+
+// pgChange is a change as wal2json format version 2 writes it.
+type pgChange struct {
+	Action   string     `json:"action"`
+	Schema   string     `json:"schema"`
+	Table    string     `json:"table"`
+	Columns  []pgColumn `json:"columns"`
+	Identity []pgColumn `json:"identity"`
+}
+
+type pgColumn struct {
+	Name  string `json:"name"`
+	Value any    `json:"value"`
+}
+
+// Run implements cdc.Source.
+func (p *Source) Run(ctx context.Context, checkpoint []byte, emit cdc.EmitFunc) error {
+	var last pgPosition
+	if len(checkpoint) > 0 {
+		lsn, change, ok := strings.Cut(string(checkpoint), "#")
+		n, err := strconv.Atoi(change)
+		if !ok || err != nil {
+			return fmt.Errorf("invalid checkpoint %q", checkpoint)
+		}
+		if last.commit, err = parseLSN(lsn); err != nil {
+			return err
+		}
+		last.change = n
+	}
+
+	db, err := sql.Open("postgres", p.cfg.DSN)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		next, err := p.read(ctx, db, last, emit)
+		if err != nil {
+			return err
+		}
+		last = next
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// read emits the changes after last decoded so far, advances the slot
+// past the transactions read whole and returns the new last position.
+func (p *Source) read(ctx context.Context, db *sql.DB, last pgPosition, emit cdc.EmitFunc) (pgPosition, error) {
+	rows, err := db.QueryContext(ctx, `
+	SELECT lsn::text, data FROM pg_logical_slot_peek_changes($1, NULL, $2, 'format-version', '2');`,
+		p.cfg.Slot, pgBatch)
+	if err != nil {
+		return last, err
+	}
+	var txn []pgChange
+	var changes []cdc.Change
+	var done uint64
+	for rows.Next() {
+		var lsn, data string
+		if err := rows.Scan(&lsn, &data); err != nil {
+			rows.Close()
+			return last, err
+		}
+		// Numbers are kept as written, so large keys survive.
+		var c pgChange
+		d := json.NewDecoder(strings.NewReader(data))
+		d.UseNumber()
+		if err := d.Decode(&c); err != nil {
+			rows.Close()
+			return last, fmt.Errorf("decoding change at %s: %w", lsn, err)
+		}
+		switch c.Action {
+		case "B":
+			txn = txn[:0]
+		case "I", "U", "D":
+			txn = append(txn, c)
+		case "C":
+			commit, err := parseLSN(lsn)
+			if err != nil {
+				rows.Close()
+				return last, err
+			}
+			for i, c := range txn {
+				at := pgPosition{commit: commit, change: i + 1}
+				if !at.after(last) {
+					continue
+				}
+				if change, ok := p.materialize(c); ok {
+					change.Checkpoint = at.checkpoint()
+					changes = append(changes, change)
+				}
+			}
+			txn = txn[:0]
+			done = commit
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return last, err
+	}
+
+	for _, c := range changes {
+		if err := emit(c); err != nil {
+			return last, err
+		}
+	}
+	if done == 0 {
+		return last, nil
+	}
+	// Every change of the transactions up to done is checkpointed, or
+	// skipped for its table, so the slot need not keep them.
+	if _, err := db.ExecContext(ctx, `SELECT pg_replication_slot_advance($1, $2::pg_lsn);`,
+		p.cfg.Slot, formatLSN(done)); err != nil {
+		return last, err
+	}
+	if next := (pgPosition{commit: done, change: 1<<31 - 1}); next.after(last) {
+		last = next
+	}
+	return last, nil
+}
+
+// materialize turns a change to one of the configured tables into an
+// event. The row becomes the additional info.
+func (p *Source) materialize(c pgChange) (cdc.Change, bool) {
+	entityType, ok := p.cfg.Tables[c.Schema+"."+c.Table]
+	if !ok {
+		return cdc.Change{}, false
+	}
+	columns := c.Columns
+	if c.Action == "D" {
+		columns = c.Identity
+	}
+	row := make(map[string]any, len(columns))
+	for _, col := range columns {
+		row[col.Name] = col.Value
+	}
+	key, ok := row[p.cfg.Key]
+	if !ok {
+		// An update changing the key names the old one in its identity.
+		for _, col := range c.Identity {
+			if col.Name == p.cfg.Key {
+				key, ok = col.Value, true
+			}
+		}
+	}
+	if !ok || key == nil {
+		return cdc.Change{}, false
+	}
+	doc, err := json.Marshal(row)
+	if err != nil {
+		return cdc.Change{}, false
+	}
+	event := structs.Index{
+		EntityType: entityType,
+		Action:     pgActions[c.Action],
+		EntityId:   fmt.Sprint(key),
+	}
+	return cdc.Change{Event: event, Data: structs.MongoData{AdditionalInfo: string(doc), Enrichment: pgEnrichment}}, true
+}
+
+// parseLSN parses a PostgreSQL LSN, written as two hexadecimal halves
+// such as 16/B374D848.
+func parseLSN(s string) (uint64, error) {
+	hi, lo, ok := strings.Cut(s, "/")
+	h, err1 := strconv.ParseUint(hi, 16, 32)
+	l, err2 := strconv.ParseUint(lo, 16, 32)
+	if !ok || err1 != nil || err2 != nil {
+		return 0, fmt.Errorf("invalid LSN %q", s)
+	}
+	return h<<32 | l, nil
+}
+
+func formatLSN(lsn uint64) string {
+	return fmt.Sprintf("%X/%X", lsn>>32, uint32(lsn))
+}
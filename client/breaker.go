@@ -0,0 +1,97 @@
+package client
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without contacting the server while its
+// host's circuit breaker is open.
+var ErrCircuitOpen = errors.New("quickie: circuit breaker open")
+
+// BreakerPolicy controls the per-host circuit breaker. After Failures
+// consecutive failed attempts the breaker opens and requests fail fast for
+// Cooldown; then a single trial request is let through, and its outcome
+// closes or reopens the breaker.
+type BreakerPolicy struct {
+	Failures int
+	Cooldown time.Duration
+}
+
+// DefaultBreakerPolicy opens after five consecutive failures for 30s.
+var DefaultBreakerPolicy = BreakerPolicy{Failures: 5, Cooldown: 30 * time.Second}
+
+type breakers struct {
+	policy BreakerPolicy
+	mu     sync.Mutex
+	hosts  map[string]*breaker
+}
+
+func newBreakers(policy BreakerPolicy) *breakers {
+	return &breakers{policy: policy, hosts: make(map[string]*breaker)}
+}
+
+func (b *breakers) get(host string) *breaker {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	br, ok := b.hosts[host]
+	if !ok {
+		br = &breaker{policy: b.policy}
+		b.hosts[host] = br
+	}
+	return br
+}
+
+type breaker struct {
+	policy BreakerPolicy
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	trial     bool
+}
+
+// allow reports ErrCircuitOpen while the breaker is open, and lets one
+// trial through once the cooldown is over.
+func (b *breaker) allow() error {
+	if b.policy.Failures <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.policy.Failures {
+		return nil
+	}
+	if time.Now().Before(b.openUntil) || b.trial {
+		return ErrCircuitOpen
+	}
+	b.trial = true
+	return nil
+}
+
+// record counts an attempt's outcome. Only transport errors and
+// retryable server errors count as failures; a validation error says
+// nothing about the host's health.
+func (b *breaker) record(err error) {
+	if b.policy.Failures <= 0 {
+		return
+	}
+	failed := false
+	if err != nil {
+		var apiErr *APIError
+		failed = !errors.As(err, &apiErr) || apiErr.Retryable
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+	if !failed {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.policy.Failures {
+		b.openUntil = time.Now().Add(b.policy.Cooldown)
+	}
+}
@@ -0,0 +1,354 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"naevis/apierror"
+	"naevis/ingest"
+	"naevis/structs"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// Config configures a Client. Only BaseURL is required.
+type Config struct {
+	// BaseURL is the server address, such as "https://quickie.example:4433".
+	BaseURL string
+	// Tenant is sent as X-Tenant-ID.
+	Tenant string
+	// Token is an access token sent as a bearer token.
+	Token string
+	// HTTPClient defaults to an HTTP/3 client, as the server only speaks QUIC.
+	HTTPClient *http.Client
+	// Retry defaults to DefaultRetryPolicy.
+	Retry *RetryPolicy
+	// Breaker defaults to DefaultBreakerPolicy.
+	Breaker *BreakerPolicy
+	// Steering, if set, spreads requests over the regions BaseURL lists,
+	// fastest first.
+	Steering *SteeringPolicy
+}
+
+// Client is a Go client for the QUICkie API. It retries transient
+// failures according to its RetryPolicy, honoring the server's retryable
+// hints and Retry-After, and stops calling a host whose circuit breaker is
+// open, failing over to the next region if it has a SteeringPolicy. It is
+// safe for concurrent use.
+type Client struct {
+	base     *url.URL
+	tenant   string
+	token    string
+	http     *http.Client
+	retry    RetryPolicy
+	breakers *breakers
+	steering *steering
+}
+
+// New creates a Client from cfg.
+func New(cfg Config) (*Client, error) {
+	base, err := url.Parse(cfg.BaseURL)
+	if err != nil || base.Host == "" {
+		return nil, fmt.Errorf("invalid base URL %q", cfg.BaseURL)
+	}
+	c := &Client{
+		base:   base,
+		tenant: cfg.Tenant,
+		token:  cfg.Token,
+		http:   cfg.HTTPClient,
+		retry:  DefaultRetryPolicy,
+	}
+	if c.http == nil {
+		c.http = &http.Client{Transport: &http3.Transport{}, Timeout: 30 * time.Second}
+	}
+	if cfg.Retry != nil {
+		c.retry = *cfg.Retry
+	}
+	breaker := DefaultBreakerPolicy
+	if cfg.Breaker != nil {
+		breaker = *cfg.Breaker
+	}
+	c.breakers = newBreakers(breaker)
+	if cfg.Steering != nil {
+		c.steering = newSteering(*cfg.Steering, base)
+	}
+	return c, nil
+}
+
+// APIError is an error response from the server. Fields lists the
+// fields of the request body at fault, if the server named them.
+type APIError struct {
+	Status    int
+	Code      string
+	Class     apierror.Class
+	Message   string
+	Retryable bool
+	Fields    []apierror.FieldError
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("quickie: %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// SendEvent posts an event to /event.
+func (c *Client) SendEvent(ctx context.Context, event structs.Index) error {
+	return c.sendEvent(ctx, event, newIdempotencyKey())
+}
+
+// UpsertEvent posts an event to /event?upsert=true, refreshing the event
+// last upserted for its entity and item instead of adding another.
+func (c *Client) UpsertEvent(ctx context.Context, event structs.Index) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, http.MethodPost, "/event", url.Values{"upsert": {"true"}}, body, "application/json", newIdempotencyKey(), nil)
+}
+
+// sendEvent posts an event under a given idempotency key.
+func (c *Client) sendEvent(ctx context.Context, event structs.Index, key string) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, http.MethodPost, "/event", nil, body, "application/json", key, nil)
+}
+
+// SendFrames posts events to /event/cbor as compact CBOR frames, which
+// are far smaller than JSON for runs of similar events. Set each event's
+// Time to report when it happened.
+func (c *Client) SendFrames(ctx context.Context, events []structs.Index) error {
+	var body bytes.Buffer
+	if err := ingest.WriteCBOR(&body, events); err != nil {
+		return err
+	}
+	return c.do(ctx, http.MethodPost, "/event/cbor", nil, body.Bytes(), "application/cbor-seq", newIdempotencyKey(), nil)
+}
+
+// SearchPage is a page of search results. Total counts the results of the
+// whole search; Next and Prev are the paths of the neighbouring pages.
+// Facets holds the counts asked for with SearchWithFacets.
+type SearchPage struct {
+	Items  []structs.Result `json:"items"`
+	Total  int64            `json:"total"`
+	Limit  int64            `json:"limit"`
+	Offset int64            `json:"offset"`
+	Next   string           `json:"next,omitempty"`
+	Prev   string           `json:"prev,omitempty"`
+	Facets []structs.Facet  `json:"facets,omitempty"`
+}
+
+// Search queries /events/{entityType} for the page of limit results
+// passing filter, starting at offset. sort is FIELD:asc|desc, by
+// relevance when empty, or by distance when filter has Near. A zero limit takes the server's default.
+func (c *Client) Search(ctx context.Context, entityType, query string, filter structs.Filter, sort string, limit, offset int) (*SearchPage, error) {
+	return c.SearchWithFacets(ctx, entityType, query, filter, sort, limit, offset, nil)
+}
+
+// SearchWithFacets is Search, also counting the results passing filter
+// per value of each field of facets: "category", "location" or "type".
+func (c *Client) SearchWithFacets(ctx context.Context, entityType, query string, filter structs.Filter, sort string, limit, offset int, facets []string) (*SearchPage, error) {
+	params := url.Values{"query": {query}}
+	for name, v := range map[string]string{
+		"from": filter.From, "to": filter.To, "category": filter.Category, "location": filter.Location, "sort": sort,
+	} {
+		if v != "" {
+			params.Set(name, v)
+		}
+	}
+	if filter.MinPrice != nil {
+		params.Set("min_price", strconv.FormatFloat(*filter.MinPrice, 'f', -1, 64))
+	}
+	if filter.MaxPrice != nil {
+		params.Set("max_price", strconv.FormatFloat(*filter.MaxPrice, 'f', -1, 64))
+	}
+	if filter.Fuzziness > 0 {
+		params.Set("fuzziness", strconv.Itoa(filter.Fuzziness))
+	}
+	if filter.Near != nil {
+		params.Set("near", strconv.FormatFloat(filter.Near.Lat, 'f', -1, 64)+","+strconv.FormatFloat(filter.Near.Lng, 'f', -1, 64))
+		if filter.RadiusKm > 0 {
+			params.Set("radius_km", strconv.FormatFloat(filter.RadiusKm, 'f', -1, 64))
+		}
+	}
+	if limit > 0 {
+		params.Set("limit", strconv.Itoa(limit))
+	}
+	if offset > 0 {
+		params.Set("offset", strconv.Itoa(offset))
+	}
+	if len(facets) > 0 {
+		params.Set("facets", strings.Join(facets, ","))
+	}
+	var page SearchPage
+	if err := c.do(ctx, http.MethodGet, "/events/"+url.PathEscape(entityType), params, nil, "", "", &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// Suggest completes the names of entities of entityType starting with
+// prefix, those with the most events first. A zero limit takes the
+// server's default.
+func (c *Client) Suggest(ctx context.Context, entityType, prefix string, limit int) ([]structs.Suggestion, error) {
+	params := url.Values{"q": {prefix}}
+	if limit > 0 {
+		params.Set("limit", strconv.Itoa(limit))
+	}
+	var items []structs.Suggestion
+	if err := c.do(ctx, http.MethodGet, "/suggest/"+url.PathEscape(entityType), params, nil, "", "", &items); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// Call sends a request to an API path that has no method of its own,
+// such as the admin endpoints, encoding in as the JSON body unless it is
+// nil and decoding the JSON response into out unless it is nil. Writes
+// carry an idempotency key, so they are retried like the other methods.
+func (c *Client) Call(ctx context.Context, method, path string, query url.Values, in, out any) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	var key string
+	if method != http.MethodGet && method != http.MethodHead {
+		key = newIdempotencyKey()
+	}
+	return c.do(ctx, method, path, query, body, "application/json", key, out)
+}
+
+// newIdempotencyKey returns a random key identifying one logical request
+// across its retries.
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// do sends a request, retrying per the retry policy, and decodes a JSON
+// response into out when out is non-nil. A body is sent as contentType. A
+// non-empty key is sent as the Idempotency-Key of every attempt. Each
+// attempt goes to the first region whose breaker is closed, skipping those
+// that failed an earlier attempt while others remain.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body []byte, contentType, key string, out any) error {
+	ref := &url.URL{Path: path, RawQuery: query.Encode()}
+	bases := c.bases(ctx)
+	failed := make(map[string]bool)
+
+	for attempt := 1; ; attempt++ {
+		base, breaker, err := c.pick(bases, failed)
+		if err != nil {
+			return err
+		}
+
+		resp, err := c.send(ctx, method, base.ResolveReference(ref).String(), body, contentType, key)
+		var retryAfter time.Duration
+		if err == nil {
+			retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+			err = decode(resp, out)
+		}
+		breaker.record(err)
+		if err != nil {
+			failed[base.Host] = true
+		}
+
+		if err == nil || attempt >= c.retry.MaxAttempts || !retryable(ctx, err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(c.retry.delay(attempt, retryAfter)):
+		}
+	}
+}
+
+// pick returns the first of bases whose breaker lets a request through,
+// preferring those not in failed.
+func (c *Client) pick(bases []*url.URL, failed map[string]bool) (*url.URL, *breaker, error) {
+	for _, retry := range []bool{false, true} {
+		for _, base := range bases {
+			if failed[base.Host] != retry {
+				continue
+			}
+			if b := c.breakers.get(base.Host); b.allow() == nil {
+				return base, b, nil
+			}
+		}
+	}
+	return nil, nil, ErrCircuitOpen
+}
+
+func (c *Client) send(ctx context.Context, method, u string, body []byte, contentType, key string) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+		// Lets the server reject bodies corrupted on the way.
+		sum := sha256.Sum256(body)
+		req.Header.Set("Content-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":")
+	}
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	if c.tenant != "" {
+		req.Header.Set("X-Tenant-ID", c.tenant)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return c.http.Do(req)
+}
+
+// decode turns an error response into an *APIError and decodes a
+// successful one into out.
+func decode(resp *http.Response, out any) error {
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 400 {
+		e := &APIError{Status: resp.StatusCode}
+		var body struct {
+			Error apierror.Error `json:"error"`
+		}
+		if json.Unmarshal(data, &body) == nil && body.Error.Code != "" {
+			e.Code, e.Class, e.Message, e.Retryable = body.Error.Code, body.Error.Class, body.Error.Message, body.Error.Retryable
+			e.Fields = body.Error.Fields
+		} else {
+			// Not one of ours, e.g. from a proxy; fall back on the status.
+			e.Code = http.StatusText(resp.StatusCode)
+			e.Message = string(bytes.TrimSpace(data))
+			e.Retryable = retryableStatus(resp.StatusCode)
+		}
+		return e
+	}
+
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,345 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"naevis/structs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrQueueFull is returned by Enqueue when the queue is at its size cap
+// and the overflow policy is RejectNew.
+var ErrQueueFull = errors.New("quickie: offline queue full")
+
+// Overflow decides what happens to events that would exceed the size cap.
+type Overflow int
+
+const (
+	// RejectNew makes Enqueue fail with ErrQueueFull.
+	RejectNew Overflow = iota
+	// DropNewest discards the new event.
+	DropNewest
+	// DropOldest discards the oldest buffered events to make room.
+	DropOldest
+)
+
+const (
+	// defaultMaxBytes caps the queue when QueueConfig.MaxBytes is unset.
+	defaultMaxBytes = 64 << 20
+	// compactBytes is the sent prefix worth rewriting the log to drop.
+	compactBytes = 1 << 20
+)
+
+// QueueConfig configures a Queue.
+type QueueConfig struct {
+	// Dir holds the queue files. It is created if missing.
+	Dir string
+	// MaxBytes caps the size of buffered events; defaults to 64 MiB.
+	MaxBytes int64
+	Overflow Overflow
+	// OnDrop, if set, is called for each event that is discarded, either
+	// by the overflow policy or because the server rejected it as invalid.
+	OnDrop func(event structs.Index, err error)
+}
+
+// record is one line of the queue log. The idempotency key is fixed at
+// enqueue time so a resend after a crash is recognizable as a duplicate.
+type record struct {
+	Key   string        `json:"key"`
+	Event structs.Index `json:"event"`
+}
+
+// Queue buffers events on disk while the server is unreachable and sends
+// them in order once it is back. Events are appended to queue.log and
+// synced before Enqueue returns; queue.pos holds the offset of the first
+// unsent one. Use one Queue per directory.
+type Queue struct {
+	client *Client
+	cfg    QueueConfig
+
+	flushMu sync.Mutex // serializes Flush
+
+	mu   sync.Mutex
+	log  *os.File
+	size int64
+	pos  int64
+}
+
+// NewQueue opens or creates the queue in cfg.Dir. Events left over from a
+// previous run are kept and sent by the next Flush.
+func NewQueue(c *Client, cfg QueueConfig) (*Queue, error) {
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = defaultMaxBytes
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(cfg.Dir, "queue.log"), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	q := &Queue{client: c, cfg: cfg, log: f}
+
+	// Drop a record torn by a crash mid-write.
+	if q.size, err = lastNewline(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Truncate(q.size); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if b, err := os.ReadFile(q.posPath()); err == nil {
+		q.pos, _ = strconv.ParseInt(string(bytes.TrimSpace(b)), 10, 64)
+	}
+	if q.pos < 0 || q.pos > q.size {
+		q.pos = 0
+	}
+	return q, nil
+}
+
+// lastNewline returns the length of f up to and including its last
+// newline.
+func lastNewline(f *os.File) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 4096)
+	for end := info.Size(); end > 0; {
+		start := max(end-int64(len(buf)), 0)
+		n, err := f.ReadAt(buf[:end-start], start)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			return start + int64(i) + 1, nil
+		}
+		end = start
+	}
+	return 0, nil
+}
+
+func (q *Queue) posPath() string {
+	return filepath.Join(q.cfg.Dir, "queue.pos")
+}
+
+// Pending returns the size in bytes of the events waiting to be sent.
+func (q *Queue) Pending() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size - q.pos
+}
+
+// Enqueue durably buffers an event for the next Flush.
+func (q *Queue) Enqueue(event structs.Index) error {
+	line, err := json.Marshal(record{Key: newIdempotencyKey(), Event: event})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.size-q.pos+int64(len(line)) > q.cfg.MaxBytes {
+		switch q.cfg.Overflow {
+		case DropNewest:
+			q.dropped(event, ErrQueueFull)
+			return nil
+		case DropOldest:
+			if err := q.dropOldest(int64(len(line))); err != nil {
+				return err
+			}
+		default:
+			return ErrQueueFull
+		}
+	}
+
+	n, err := q.log.Write(line)
+	q.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return q.log.Sync()
+}
+
+// dropOldest advances past the oldest events until need bytes fit. It
+// must be called with q.mu held.
+func (q *Queue) dropOldest(need int64) error {
+	for q.size-q.pos+need > q.cfg.MaxBytes && q.pos < q.size {
+		rec, next, err := q.read(q.pos)
+		if err != nil {
+			return err
+		}
+		q.pos = next
+		q.dropped(rec.Event, ErrQueueFull)
+	}
+	return q.savePos()
+}
+
+func (q *Queue) dropped(event structs.Index, err error) {
+	if q.cfg.OnDrop != nil {
+		q.cfg.OnDrop(event, err)
+	}
+}
+
+// read decodes the record at off and returns the offset after it. It must
+// be called with q.mu held.
+func (q *Queue) read(off int64) (record, int64, error) {
+	line, err := bufio.NewReader(io.NewSectionReader(q.log, off, q.size-off)).ReadBytes('\n')
+	if err != nil {
+		return record{}, off, err
+	}
+	var rec record
+	if err := json.Unmarshal(line, &rec); err != nil {
+		// Skip a corrupt line rather than wedging the queue.
+		return record{}, off + int64(len(line)), err
+	}
+	return rec, off + int64(len(line)), nil
+}
+
+func (q *Queue) savePos() error {
+	tmp := q.posPath() + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatInt(q.pos, 10)), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.posPath())
+}
+
+// Flush sends buffered events in order until the queue is empty or a send
+// fails. Events the server rejects as invalid are dropped so they cannot
+// block the queue; any other failure stops the flush and leaves the event
+// at the head of the queue.
+func (q *Queue) Flush(ctx context.Context) error {
+	q.flushMu.Lock()
+	defer q.flushMu.Unlock()
+
+	q.mu.Lock()
+	err := q.compact()
+	q.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for {
+		q.mu.Lock()
+		if q.pos >= q.size {
+			err := q.reset()
+			q.mu.Unlock()
+			return err
+		}
+		pos := q.pos
+		rec, next, err := q.read(pos)
+		q.mu.Unlock()
+		if next == pos {
+			return err
+		}
+
+		if err == nil {
+			err = q.client.sendEvent(ctx, rec.Event, rec.Key)
+			var apiErr *APIError
+			if errors.As(err, &apiErr) && !apiErr.Retryable {
+				q.dropped(rec.Event, err)
+				err = nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		q.mu.Lock()
+		// DropOldest may have moved past this event already.
+		if next > q.pos {
+			q.pos = next
+		}
+		err = q.savePos()
+		q.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// compact rewrites the log without its sent prefix once that prefix is
+// most of the file, so a long outage under DropOldest does not grow the
+// file without bound. Offsets change, so it must be called with both
+// q.flushMu and q.mu held.
+func (q *Queue) compact() error {
+	if q.pos < compactBytes || q.pos < q.size/2 {
+		return nil
+	}
+	path := q.log.Name()
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(tmp, io.NewSectionReader(q.log, q.pos, q.size-q.pos))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	q.log.Close()
+	q.log, q.size, q.pos = f, n, 0
+	return q.savePos()
+}
+
+// reset empties the log once every event is sent. It must be called with
+// q.mu held.
+func (q *Queue) reset() error {
+	if q.size == 0 {
+		return nil
+	}
+	if err := q.log.Truncate(0); err != nil {
+		return err
+	}
+	q.size, q.pos = 0, 0
+	return q.savePos()
+}
+
+// Run flushes the queue every interval until ctx is cancelled. Failed
+// flushes are retried on the next tick.
+func (q *Queue) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		q.Flush(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close closes the queue files. Buffered events stay on disk.
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.log.Close()
+}
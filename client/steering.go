@@ -0,0 +1,190 @@
+package client
+
+import (
+	"cmp"
+	"context"
+	"naevis/structs"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+)
+
+// SteeringPolicy steers requests to the region of a multi-region
+// deployment answering fastest. The client asks BaseURL, or failing it
+// any region it already knows, for the regions every Refresh, times each
+// healthy region's /health, and sends requests to the fastest whose
+// circuit breaker is closed. A failed attempt is retried in the next
+// region.
+type SteeringPolicy struct {
+	// Near, "LAT,LNG", is sent for the server to rank the regions by
+	// distance, which orders regions whose latency could not be measured.
+	Near string
+	// Refresh defaults to five minutes.
+	Refresh time.Duration
+}
+
+// probeTimeout bounds the wait for a region's health.
+const probeTimeout = 5 * time.Second
+
+// steering holds the regions of a Client, fastest first.
+type steering struct {
+	policy SteeringPolicy
+
+	// refreshing serializes refreshes; mu guards the fields below.
+	refreshing sync.Mutex
+	mu         sync.Mutex
+	regions    []steeringRegion
+	refreshed  time.Time
+}
+
+// steeringRegion is a region a Client may send requests to.
+type steeringRegion struct {
+	name string
+	base *url.URL
+}
+
+func newSteering(policy SteeringPolicy, base *url.URL) *steering {
+	if policy.Refresh <= 0 {
+		policy.Refresh = 5 * time.Minute
+	}
+	return &steering{policy: policy, regions: []steeringRegion{{base: base}}}
+}
+
+// Region returns the name of the region requests are sent to first, or ""
+// before the regions are known or without a SteeringPolicy.
+func (c *Client) Region() string {
+	if c.steering == nil {
+		return ""
+	}
+	c.steering.mu.Lock()
+	defer c.steering.mu.Unlock()
+	return c.steering.regions[0].name
+}
+
+// bases returns the addresses to send a request to, in order of
+// preference, refreshing the regions first when they are stale.
+func (c *Client) bases(ctx context.Context) []*url.URL {
+	if c.steering == nil {
+		return []*url.URL{c.base}
+	}
+	s := c.steering
+	s.mu.Lock()
+	stale := time.Since(s.refreshed) >= s.policy.Refresh
+	s.mu.Unlock()
+	// Only one request refreshes; the others go on with the regions
+	// known.
+	if stale && s.refreshing.TryLock() {
+		c.refreshRegions(ctx)
+		s.refreshing.Unlock()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bases := make([]*url.URL, len(s.regions))
+	for i, r := range s.regions {
+		bases[i] = r.base
+	}
+	return bases
+}
+
+// refreshRegions fetches the regions and orders them by latency. The
+// regions known stay in use if none can be fetched.
+func (c *Client) refreshRegions(ctx context.Context) {
+	s := c.steering
+	s.mu.Lock()
+	sources := []*url.URL{c.base}
+	for _, r := range s.regions {
+		if r.base.String() != c.base.String() {
+			sources = append(sources, r.base)
+		}
+	}
+	s.mu.Unlock()
+
+	params := url.Values{}
+	if s.policy.Near != "" {
+		params.Set("near", s.policy.Near)
+	}
+	var list structs.RegionList
+	var err error
+	for _, source := range sources {
+		u := source.ResolveReference(&url.URL{Path: "/regions", RawQuery: params.Encode()})
+		var resp *http.Response
+		if resp, err = c.send(ctx, http.MethodGet, u.String(), nil, "", ""); err == nil {
+			if err = decode(resp, &list); err == nil && len(list.Regions) > 0 {
+				break
+			}
+		}
+	}
+
+	var regions []steeringRegion
+	if err == nil {
+		regions = c.rankRegions(ctx, list.Regions)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// A failed refresh waits for the next, not for the next request.
+	s.refreshed = time.Now()
+	if len(regions) > 0 {
+		s.regions = regions
+	}
+}
+
+// rankRegions times each healthy region's /health and returns the regions
+// that answered, fastest first, then the rest in the server's order.
+func (c *Client) rankRegions(ctx context.Context, list []structs.Region) []steeringRegion {
+	type probed struct {
+		steeringRegion
+		rtt time.Duration
+		ok  bool
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	regions := make([]probed, 0, len(list))
+	for _, r := range list {
+		base, err := url.Parse(r.URL)
+		if err != nil || base.Host == "" {
+			continue
+		}
+		regions = append(regions, probed{steeringRegion: steeringRegion{name: r.Name, base: base}})
+		if !r.Healthy {
+			continue
+		}
+		p := &regions[len(regions)-1]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			u := p.base.ResolveReference(&url.URL{Path: "/health"})
+			resp, err := c.send(ctx, http.MethodGet, u.String(), nil, "", "")
+			if err == nil {
+				p.ok = decode(resp, nil) == nil
+				p.rtt = time.Since(start)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Stable, so the regions that did not answer keep the server's order.
+	slices.SortStableFunc(regions, func(a, b probed) int {
+		switch {
+		case a.ok && b.ok:
+			return cmp.Compare(a.rtt, b.rtt)
+		case a.ok:
+			return -1
+		case b.ok:
+			return 1
+		}
+		return 0
+	})
+	ranked := make([]steeringRegion, len(regions))
+	for i, r := range regions {
+		ranked[i] = r.steeringRegion
+	}
+	return ranked
+}
@@ -0,0 +1,4 @@
+"""Python client for the QUICkie API. See client.py, generated by cmd/codegen."""
+
+from .client import *  # noqa: F401,F403
+from .client import __all__  # noqa: F401
@@ -0,0 +1,43 @@
+// Package clock is the time source of the subsystems that batch, expire
+// or move events on a schedule. Production code passes Real; the
+// simulation in package sim passes a fake clock it advances itself.
+package clock
+
+import "time"
+
+// Clock tells the time and makes tickers.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers ticks like a time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Real is the wall clock.
+var Real Clock = wall{}
+
+type wall struct{}
+
+func (wall) Now() time.Time {
+	return time.Now()
+}
+
+func (wall) NewTicker(d time.Duration) Ticker {
+	return wallTicker{time.NewTicker(d)}
+}
+
+type wallTicker struct {
+	t *time.Ticker
+}
+
+func (t wallTicker) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t wallTicker) Stop() {
+	t.t.Stop()
+}
@@ -0,0 +1,309 @@
+// Command codegen writes the Python and TypeScript API clients from the
+// operations and types in spec.go. Run it with "make codegen" after
+// changing an endpoint or one of the reflected structs.
+package main
+
+import (
+	"bytes"
+	"embed"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+//go:embed templates/*.tmpl
+var templateFS embed.FS
+
+// outputs maps each template to the file it generates, relative to -out.
+var outputs = map[string]string{
+	"python.tmpl":     "python/quickie/client.py",
+	"typescript.tmpl": "typescript/src/client.ts",
+}
+
+// Kind is a JSON value kind.
+type Kind string
+
+const (
+	String  Kind = "string"
+	Integer Kind = "integer"
+	Number  Kind = "number"
+	Boolean Kind = "boolean"
+	Array   Kind = "array"
+	Object  Kind = "object"
+)
+
+// TypeRef is the JSON type of a field. Objects are named by Ref; arrays
+// hold Elem.
+type TypeRef struct {
+	Kind Kind
+	Ref  string
+	Elem *TypeRef
+}
+
+// Field is one JSON field of a Type.
+type Field struct {
+	Name string
+	Type TypeRef
+	// Optional fields are omitted when empty.
+	Optional bool
+}
+
+// Type is an API type.
+type Type struct {
+	Name   string
+	Fields []Field
+}
+
+func main() {
+	out := flag.String("out", "clients", "directory the clients are written to")
+	flag.Parse()
+
+	model, err := buildTypes()
+	if err != nil {
+		log.Fatalf("Failed to build types: %v", err)
+	}
+	data := struct {
+		Types      []Type
+		Operations []Operation
+	}{model, operations}
+
+	tmpl, err := template.New("").Funcs(funcs).ParseFS(templateFS, "templates/*.tmpl")
+	if err != nil {
+		log.Fatalf("Failed to parse templates: %v", err)
+	}
+	for name, path := range outputs {
+		var buf bytes.Buffer
+		if err := tmpl.ExecuteTemplate(&buf, name, data); err != nil {
+			log.Fatalf("Failed to render %s: %v", name, err)
+		}
+		path = filepath.Join(*out, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			log.Fatalf("Failed to create %s: %v", filepath.Dir(path), err)
+		}
+		if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+			log.Fatalf("Failed to write %s: %v", path, err)
+		}
+		log.Printf("Wrote %s", path)
+	}
+}
+
+// buildTypes reflects the struct types listed in types. Structs they
+// reference must be listed too.
+func buildTypes() ([]Type, error) {
+	names := make(map[reflect.Type]string, len(types))
+	for _, t := range types {
+		names[t.Type] = t.Name
+	}
+
+	var ref func(t reflect.Type) (TypeRef, error)
+	ref = func(t reflect.Type) (TypeRef, error) {
+		switch t.Kind() {
+		case reflect.String:
+			return TypeRef{Kind: String}, nil
+		case reflect.Bool:
+			return TypeRef{Kind: Boolean}, nil
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return TypeRef{Kind: Integer}, nil
+		case reflect.Float32, reflect.Float64:
+			return TypeRef{Kind: Number}, nil
+		case reflect.Slice, reflect.Array:
+			elem, err := ref(t.Elem())
+			if err != nil {
+				return TypeRef{}, err
+			}
+			return TypeRef{Kind: Array, Elem: &elem}, nil
+		case reflect.Pointer:
+			return ref(t.Elem())
+		case reflect.Struct:
+			if name, ok := names[t]; ok {
+				return TypeRef{Kind: Object, Ref: name}, nil
+			}
+			return TypeRef{}, fmt.Errorf("struct %s is not listed in types", t)
+		}
+		return TypeRef{}, fmt.Errorf("unsupported type %s", t)
+	}
+
+	var model []Type
+	for _, t := range types {
+		typ := Type{Name: t.Name}
+		for _, f := range reflect.VisibleFields(t.Type) {
+			if !f.IsExported() || f.Anonymous {
+				continue
+			}
+			tag := f.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name, opts, _ := strings.Cut(tag, ",")
+			if name == "" {
+				name = f.Name
+			}
+			r, err := ref(f.Type)
+			if err != nil {
+				return nil, fmt.Errorf("%s.%s: %w", t.Name, f.Name, err)
+			}
+			typ.Fields = append(typ.Fields, Field{Name: name, Type: r, Optional: strings.Contains(opts, "omitempty")})
+		}
+		model = append(model, typ)
+	}
+	return model, nil
+}
+
+var (
+	upper     = regexp.MustCompile(`[A-Z]`)
+	pathParam = regexp.MustCompile(`\{(\w+)\}`)
+)
+
+// funcs are the helpers available to the templates.
+// pyKeywords are the Python keywords that may name a parameter.
+var pyKeywords = map[string]bool{
+	"and": true, "as": true, "class": true, "def": true, "del": true, "for": true, "from": true,
+	"global": true, "if": true, "import": true, "in": true, "is": true, "lambda": true,
+	"not": true, "or": true, "pass": true, "return": true, "while": true, "with": true, "yield": true,
+}
+
+var funcs = template.FuncMap{
+	"snake": func(s string) string {
+		return upper.ReplaceAllStringFunc(s, func(c string) string { return "_" + strings.ToLower(c) })
+	},
+	"camel":  camel,
+	"lower":  strings.ToLower,
+	"pyType": pyType,
+	// pyName is a parameter name usable in Python, keywords taking a
+	// trailing underscore.
+	"pyName": func(s string) string {
+		if pyKeywords[s] {
+			return s + "_"
+		}
+		return s
+	},
+	"pyDefault": func(t TypeRef) string {
+		switch t.Kind {
+		case Array:
+			return "field(default_factory=list)"
+		case Object:
+			return "field(default_factory=" + t.Ref + ")"
+		}
+		return pyDefaults[t.Kind]
+	},
+	// pyField is the Python expression reading f from the dict d.
+	"pyField": func(f Field) string {
+		get := fmt.Sprintf("d.get(%q)", f.Name)
+		switch f.Type.Kind {
+		case Object, Array:
+			return pyDecode(f.Type, get)
+		case Number:
+			return fmt.Sprintf("float(d.get(%q, 0))", f.Name)
+		}
+		return fmt.Sprintf("d.get(%q, %s)", f.Name, pyDefaults[f.Type.Kind])
+	},
+	// pyPath turns "/a/{b}" into the f-string f"/a/{_quote(b)}".
+	"pyPath": func(path string) string {
+		if !pathParam.MatchString(path) {
+			return `"` + path + `"`
+		}
+		return `f"` + pathParam.ReplaceAllString(path, "{_quote($1)}") + `"`
+	},
+	"tsType": tsType,
+	// tsPath turns "/a/{b_c}" into the template literal `/a/${enc(bC)}`.
+	"tsPath": func(path string) string {
+		if !pathParam.MatchString(path) {
+			return `"` + path + `"`
+		}
+		return "`" + pathParam.ReplaceAllStringFunc(path, func(m string) string {
+			return "${encodeURIComponent(" + camel(m[1:len(m)-1]) + ")}"
+		}) + "`"
+	},
+	// tsQuery is the object literal of op's query parameters.
+	"tsQuery": func(op Operation) string {
+		var kv []string
+		for _, p := range filterParams(op, "query") {
+			if name := camel(p.Name); name == p.Name {
+				kv = append(kv, name)
+			} else {
+				kv = append(kv, p.Name+": "+name)
+			}
+		}
+		if kv == nil {
+			return "{}"
+		}
+		return "{ " + strings.Join(kv, ", ") + " }"
+	},
+	"queryParams": func(op Operation) []Param {
+		return filterParams(op, "query")
+	},
+}
+
+var pyDefaults = map[Kind]string{String: `""`, Integer: "0", Number: "0.0", Boolean: "False"}
+
+func filterParams(op Operation, in string) []Param {
+	var ps []Param
+	for _, p := range op.Params {
+		if p.In == in {
+			ps = append(ps, p)
+		}
+	}
+	return ps
+}
+
+// camel turns snake_case into camelCase.
+func camel(s string) string {
+	parts := strings.Split(s, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+func pyType(t TypeRef) string {
+	switch t.Kind {
+	case String:
+		return "str"
+	case Integer:
+		return "int"
+	case Number:
+		return "float"
+	case Boolean:
+		return "bool"
+	case Array:
+		return "List[" + pyType(*t.Elem) + "]"
+	}
+	return t.Ref
+}
+
+// pyDecode is the Python expression converting the JSON value expr to t.
+func pyDecode(t TypeRef, expr string) string {
+	switch t.Kind {
+	case Object:
+		return t.Ref + ".from_dict(" + expr + ")"
+	case Array:
+		if t.Elem.Kind == Object || t.Elem.Kind == Array {
+			return "[" + pyDecode(*t.Elem, "x") + " for x in " + expr + " or []]"
+		}
+		return "list(" + expr + " or [])"
+	}
+	return expr
+}
+
+func tsType(t TypeRef) string {
+	switch t.Kind {
+	case String:
+		return "string"
+	case Integer, Number:
+		return "number"
+	case Boolean:
+		return "boolean"
+	case Array:
+		return tsType(*t.Elem) + "[]"
+	}
+	return t.Ref
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"naevis/related"
+	"naevis/structs"
+	"naevis/trending"
+	"reflect"
+)
+
+// Param is a path or query parameter of an operation.
+type Param struct {
+	Name string
+	In   string // "path" or "query"
+	Type string // "string", "number" or "boolean"
+	// Optional query parameters are omitted when unset.
+	Optional bool
+}
+
+// Operation is one client method.
+type Operation struct {
+	// Name is the method name in camel case, such as "sendEvent".
+	Name   string
+	Doc    string
+	Method string
+	Path   string
+	Params []Param
+	// Body names the request body type, if any.
+	Body string
+	// BodyList means the body is an array of Body.
+	BodyList bool
+	// Returns names the response type; empty for none.
+	Returns string
+	// List means the response is an array of Returns.
+	List bool
+	// Idempotent operations carry an Idempotency-Key so that retries are
+	// safe.
+	Idempotent bool
+}
+
+// trendingPage mirrors the response of GET /trending.
+type trendingPage struct {
+	Items []trending.Entry `json:"items"`
+	AsOf  string           `json:"as_of"`
+}
+
+// searchPage mirrors the response of GET /events/{entity_type}.
+type searchPage struct {
+	Items  []structs.Result `json:"items"`
+	Total  int64            `json:"total"`
+	Limit  int64            `json:"limit"`
+	Offset int64            `json:"offset"`
+	Next   string           `json:"next,omitempty"`
+	Prev   string           `json:"prev,omitempty"`
+	Facets []structs.Facet  `json:"facets,omitempty"`
+}
+
+// types are the API types, reflected from the server's own structs so the
+// clients cannot drift from them.
+var types = []struct {
+	Name string
+	Type reflect.Type
+}{
+	{"Event", reflect.TypeFor[structs.Index]()},
+	{"Highlight", reflect.TypeFor[structs.Highlight]()},
+	{"Result", reflect.TypeFor[structs.Result]()},
+	{"FacetValue", reflect.TypeFor[structs.FacetValue]()},
+	{"Facet", reflect.TypeFor[structs.Facet]()},
+	{"SearchPage", reflect.TypeFor[searchPage]()},
+	{"Suggestion", reflect.TypeFor[structs.Suggestion]()},
+	{"TrendingEntry", reflect.TypeFor[trending.Entry]()},
+	{"TrendingPage", reflect.TypeFor[trendingPage]()},
+	{"RelatedEntity", reflect.TypeFor[related.Related]()},
+	{"Region", reflect.TypeFor[structs.Region]()},
+	{"RegionList", reflect.TypeFor[structs.RegionList]()},
+}
+
+// operations are the ingest and query endpoints exposed by the clients.
+var operations = []Operation{
+	{
+		Name: "sendEvent", Doc: "Ingest one event.",
+		Method: "POST", Path: "/event", Body: "Event", Idempotent: true,
+	},
+	{
+		Name: "track", Doc: "Record a batch of clicks or impressions.",
+		Method: "POST", Path: "/track", Body: "Event", BodyList: true, Idempotent: true,
+	},
+	{
+		Name: "search", Doc: "Search entities of a type.",
+		Method: "GET", Path: "/events/{entity_type}",
+		Params: []Param{
+			{Name: "entity_type", In: "path", Type: "string"},
+			{Name: "query", In: "query", Type: "string"},
+			{Name: "limit", In: "query", Type: "number", Optional: true},
+			{Name: "offset", In: "query", Type: "number", Optional: true},
+			{Name: "from", In: "query", Type: "string", Optional: true},
+			{Name: "to", In: "query", Type: "string", Optional: true},
+			{Name: "category", In: "query", Type: "string", Optional: true},
+			{Name: "location", In: "query", Type: "string", Optional: true},
+			{Name: "min_price", In: "query", Type: "number", Optional: true},
+			{Name: "max_price", In: "query", Type: "number", Optional: true},
+			{Name: "sort", In: "query", Type: "string", Optional: true},
+			{Name: "facets", In: "query", Type: "string", Optional: true},
+			{Name: "fuzziness", In: "query", Type: "number", Optional: true},
+			{Name: "highlight", In: "query", Type: "boolean", Optional: true},
+			{Name: "near", In: "query", Type: "string", Optional: true},
+			{Name: "radius_km", In: "query", Type: "number", Optional: true},
+		},
+		Returns: "SearchPage",
+	},
+	{
+		Name: "suggest", Doc: "Complete the names of entities of a type from a typed prefix.",
+		Method: "GET", Path: "/suggest/{entity_type}",
+		Params: []Param{
+			{Name: "entity_type", In: "path", Type: "string"},
+			{Name: "q", In: "query", Type: "string"},
+			{Name: "limit", In: "query", Type: "number", Optional: true},
+		},
+		Returns: "Suggestion", List: true,
+	},
+	{
+		Name: "trending", Doc: "List trending entities of a type.",
+		Method: "GET", Path: "/trending",
+		Params: []Param{
+			{Name: "type", In: "query", Type: "string"},
+			{Name: "limit", In: "query", Type: "number", Optional: true},
+		},
+		Returns: "TrendingPage",
+	},
+	{
+		Name: "related", Doc: "List entities often seen with an entity.",
+		Method: "GET", Path: "/entities/{entity_type}/{entity_id}/related",
+		Params: []Param{
+			{Name: "entity_type", In: "path", Type: "string"},
+			{Name: "entity_id", In: "path", Type: "string"},
+			{Name: "limit", In: "query", Type: "number", Optional: true},
+		},
+		Returns: "RelatedEntity", List: true,
+	},
+	{
+		Name: "regions", Doc: "List the regions, nearest healthy region first.",
+		Method: "GET", Path: "/regions",
+		Params: []Param{
+			{Name: "near", In: "query", Type: "string", Optional: true},
+		},
+		Returns: "RegionList",
+	},
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"naevis/structs"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+func init() {
+	commands["send"] = command{
+		usage: "-type ENTITY_TYPE -action ACTION [-id ENTITY_ID] [-item ITEM_ID -item-type ITEM_TYPE]",
+		help:  "send an event",
+		run:   send,
+	}
+	commands["search"] = command{
+		usage: "[-limit N] [-offset N] [-sort FIELD:asc|desc] [-from DATE] [-to DATE] [-category C] [-location L] ENTITY_TYPE [QUERY]",
+		help:  "search the events of an entity type",
+		run:   search,
+	}
+	commands["stats"] = command{
+		usage: "[-type ENTITY_TYPE] [-action ACTION] [-tenant TENANT]",
+		help:  "show all-time event totals",
+		run:   stats,
+	}
+	commands["dead-letters"] = command{
+		usage: "[list [-limit N] [-all] | retry ID | discard ID]",
+		help:  "list, retry or discard dead-lettered events",
+		run:   deadLetters,
+	}
+	commands["vars"] = command{
+		usage: "[NAME...]",
+		help:  "show server metrics",
+		run:   vars,
+	}
+}
+
+func send(ctx context.Context, e *env, args []string) error {
+	fs := flag.NewFlagSet("send", flag.ContinueOnError)
+	var event structs.Index
+	fs.StringVar(&event.EntityType, "type", "", "entity type")
+	fs.StringVar(&event.Action, "action", "", "action")
+	fs.StringVar(&event.EntityId, "id", "", "entity ID")
+	fs.StringVar(&event.ItemId, "item", "", "item ID")
+	fs.StringVar(&event.ItemType, "item-type", "", "item type")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if event.EntityType == "" || event.Action == "" || fs.NArg() > 0 {
+		return usageError("-type and -action are required")
+	}
+
+	var result map[string]any
+	if err := e.client.Call(ctx, http.MethodPost, "/event", nil, event, &result); err != nil {
+		return err
+	}
+	return e.out.print(result, table{})
+}
+
+func search(ctx context.Context, e *env, args []string) error {
+	fs := flag.NewFlagSet("search", flag.ContinueOnError)
+	limit := fs.Int("limit", 0, "results per page")
+	offset := fs.Int("offset", 0, "results to skip")
+	sort := fs.String("sort", "", "FIELD:asc|desc")
+	var filter structs.Filter
+	fs.StringVar(&filter.From, "from", "", "earliest date")
+	fs.StringVar(&filter.To, "to", "", "latest date")
+	fs.StringVar(&filter.Category, "category", "", "category")
+	fs.StringVar(&filter.Location, "location", "", "location")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		return usageError("an entity type and an optional query are required")
+	}
+
+	page, err := e.client.Search(ctx, fs.Arg(0), fs.Arg(1), filter, *sort, *limit, *offset)
+	if err != nil {
+		return err
+	}
+	return e.out.print(page, table{path: "items", columns: []string{"id", "name", "type", "category", "location", "date", "price"}})
+}
+
+func stats(ctx context.Context, e *env, args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	entityType := fs.String("type", "", "entity type")
+	action := fs.String("action", "", "action")
+	tenant := fs.String("tenant", "", "tenant")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return usageError("unexpected argument %q", fs.Arg(0))
+	}
+
+	query := url.Values{}
+	for name, v := range map[string]string{"entity_type": *entityType, "action": *action, "tenant": *tenant} {
+		if v != "" {
+			query.Set(name, v)
+		}
+	}
+	var result any
+	if err := e.client.Call(ctx, http.MethodGet, "/stats", query, nil, &result); err != nil {
+		return err
+	}
+	return e.out.print(result, table{path: "totals", columns: []string{"entity_type", "action", "tenant", "count"}})
+}
+
+func deadLetters(ctx context.Context, e *env, args []string) error {
+	action := "list"
+	if len(args) > 0 && (args[0] == "list" || args[0] == "retry" || args[0] == "discard") {
+		action, args = args[0], args[1:]
+	}
+
+	if action == "list" {
+		fs := flag.NewFlagSet("dead-letters", flag.ContinueOnError)
+		limit := fs.Int("limit", 0, "entries to list")
+		all := fs.Bool("all", false, "list every tenant's entries")
+		if err := parseFlags(fs, args); err != nil {
+			return err
+		}
+		query := url.Values{}
+		if *limit > 0 {
+			query.Set("limit", strconv.Itoa(*limit))
+		}
+		if *all {
+			query.Set("all", "1")
+		}
+		var result any
+		if err := e.client.Call(ctx, http.MethodGet, "/admin/dead-letters", query, nil, &result); err != nil {
+			return err
+		}
+		return e.out.print(result, table{columns: []string{"id", "tenant", "stage", "error", "attempts", "updated_at"}})
+	}
+
+	if len(args) != 1 {
+		return usageError("%s takes a dead letter ID", action)
+	}
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || id <= 0 {
+		return usageError("invalid dead letter ID %q", args[0])
+	}
+	path := "/admin/dead-letters/" + strconv.FormatInt(id, 10)
+	if action == "retry" {
+		var result map[string]any
+		if err := e.client.Call(ctx, http.MethodPost, path+"/retry", nil, nil, &result); err != nil {
+			return err
+		}
+		return e.out.print(result, table{})
+	}
+	if err := e.client.Call(ctx, http.MethodDelete, path, nil, nil, nil); err != nil {
+		return err
+	}
+	return e.out.print(map[string]any{"message": "Dead letter discarded"}, table{})
+}
+
+func vars(ctx context.Context, e *env, args []string) error {
+	var result map[string]any
+	if err := e.client.Call(ctx, http.MethodGet, "/admin/vars", nil, nil, &result); err != nil {
+		return err
+	}
+	if len(args) > 0 {
+		picked := make(map[string]any, len(args))
+		for _, name := range args {
+			v, ok := result[name]
+			if !ok {
+				return usageError("no metric %q", name)
+			}
+			picked[name] = v
+		}
+		result = picked
+	}
+	return e.out.print(result, table{})
+}
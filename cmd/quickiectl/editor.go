@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// errInterrupted is returned by readLine when the line is abandoned with
+// Ctrl-C.
+var errInterrupted = errors.New("interrupted")
+
+// lineReader reads the lines of a session.
+type lineReader interface {
+	readLine(prompt string) (string, error)
+}
+
+// plainReader reads lines without editing, for input that is not a
+// terminal; it prints no prompt, so piped sessions print only results.
+type plainReader struct {
+	in *bufio.Reader
+}
+
+func (r plainReader) readLine(string) (string, error) {
+	line, err := r.in.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+// completer returns the completions of the word ending line, and where
+// that word starts.
+type completer func(line string) (start int, candidates []string)
+
+// editor reads lines from a terminal in raw mode, with cursor movement,
+// history on the arrow keys and completion on Tab.
+type editor struct {
+	in       *bufio.Reader
+	out      io.Writer
+	history  *history
+	complete completer
+	// raw switches the terminal to raw mode and returns the restore
+	// function; nil when the caller already did.
+	raw func() (func(), error)
+}
+
+// Keys.
+const (
+	keyCtrlA     = 1
+	keyCtrlC     = 3
+	keyCtrlD     = 4
+	keyCtrlE     = 5
+	keyBackspace = 8
+	keyTab       = 9
+	keyLF        = 10
+	keyCR        = 13
+	keyCtrlU     = 21
+	keyEscape    = 27
+	keyDelete    = 127
+)
+
+func (e *editor) readLine(prompt string) (string, error) {
+	if e.raw != nil {
+		restore, err := e.raw()
+		if err != nil {
+			return "", err
+		}
+		defer restore()
+	}
+
+	var line []rune
+	pos := 0
+	// browsing is the history entry shown, len(entries) for the line
+	// being typed, which is kept in draft meanwhile.
+	entries := e.history.entries()
+	browsing := len(entries)
+	var draft []rune
+
+	redraw := func() {
+		fmt.Fprintf(e.out, "\r%s%s\x1b[K", prompt, string(line))
+		if back := len(line) - pos; back > 0 {
+			fmt.Fprintf(e.out, "\x1b[%dD", back)
+		}
+	}
+	show := func(i int) {
+		if browsing == len(entries) {
+			draft = line
+		}
+		browsing = i
+		if i == len(entries) {
+			line = draft
+		} else {
+			line = []rune(entries[i])
+		}
+		pos = len(line)
+		redraw()
+	}
+	redraw()
+
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return string(line), nil
+			}
+			return "", err
+		}
+
+		switch r {
+		case keyCR, keyLF:
+			fmt.Fprint(e.out, "\r\n")
+			return string(line), nil
+		case keyCtrlC:
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", errInterrupted
+		case keyCtrlD:
+			if len(line) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+		case keyCtrlA:
+			pos = 0
+		case keyCtrlE:
+			pos = len(line)
+		case keyCtrlU:
+			line, pos = line[pos:], 0
+		case keyBackspace, keyDelete:
+			if pos > 0 {
+				line = append(line[:pos-1:pos-1], line[pos:]...)
+				pos--
+			}
+		case keyTab:
+			line, pos = e.completeAt(prompt, line, pos)
+		case keyEscape:
+			// Arrow keys are ESC [ A-D.
+			if b, _ := e.in.ReadByte(); b != '[' {
+				continue
+			}
+			switch b, _ := e.in.ReadByte(); b {
+			case 'A':
+				if browsing > 0 {
+					show(browsing - 1)
+				}
+			case 'B':
+				if browsing < len(entries) {
+					show(browsing + 1)
+				}
+			case 'C':
+				pos = min(pos+1, len(line))
+			case 'D':
+				pos = max(pos-1, 0)
+			}
+		default:
+			if r < ' ' {
+				continue
+			}
+			line = append(line[:pos:pos], append([]rune{r}, line[pos:]...)...)
+			pos++
+		}
+		redraw()
+	}
+}
+
+// completeAt completes the word before pos. A single candidate is
+// inserted with a space after it; several are extended to their common
+// prefix, or listed when that adds nothing.
+func (e *editor) completeAt(prompt string, line []rune, pos int) ([]rune, int) {
+	if e.complete == nil {
+		return line, pos
+	}
+	before := string(line[:pos])
+	start, candidates := e.complete(before)
+	if len(candidates) == 0 {
+		return line, pos
+	}
+	word := before[start:]
+
+	insert := candidates[0] + " "
+	if len(candidates) > 1 {
+		insert = commonPrefix(candidates)
+		if insert == word {
+			fmt.Fprintf(e.out, "\r\n%s\r\n", strings.Join(candidates, "  "))
+			return line, pos
+		}
+	}
+	head := []rune(before[:start] + insert)
+	return append(head, line[pos:]...), len(head)
+}
+
+func commonPrefix(words []string) string {
+	prefix := words[0]
+	for _, w := range words[1:] {
+		for !strings.HasPrefix(w, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
@@ -0,0 +1,213 @@
+// Command quickiectl administers a QUICkie server from the shell.
+//
+//	quickiectl [flags] <command> [arguments]
+//
+// Every command prints its result as a table, JSON or YAML (-output), or
+// nothing with -quiet, and exits with a status telling failures apart:
+//
+//	0  success
+//	1  server or network error
+//	2  usage error
+//	3  the server rejected the request as invalid
+//	4  not authenticated or not allowed
+//	5  not found
+//	6  conflict with the stored state
+//
+// The server address, token and tenant default to $QUICKIE_URL,
+// $QUICKIE_TOKEN and $QUICKIE_TENANT.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"naevis/apierror"
+	"naevis/client"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// Exit statuses.
+const (
+	exitOK         = 0
+	exitServer     = 1
+	exitUsage      = 2
+	exitValidation = 3
+	exitAuth       = 4
+	exitNotFound   = 5
+	exitConflict   = 6
+)
+
+// errUsage marks errors in the command line.
+var errUsage = errors.New("usage")
+
+// usageError reports a bad command line.
+func usageError(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", errUsage, fmt.Sprintf(format, args...))
+}
+
+// command is a subcommand. run parses args and does the work, printing
+// through out.
+type command struct {
+	usage string
+	help  string
+	run   func(ctx context.Context, env *env, args []string) error
+}
+
+var commands = map[string]command{}
+
+// env is what commands share.
+type env struct {
+	client *client.Client
+	out    *printer
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// newHTTPClient returns the HTTP client of the API client; tests replace
+// it.
+var newHTTPClient = func(insecure bool) *http.Client {
+	return &http.Client{
+		Transport: &http3.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure}},
+		Timeout:   30 * time.Second,
+	}
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run runs the command line args and returns the exit status.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("quickiectl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	server := fs.String("server", envOr("QUICKIE_URL", "https://localhost:4433"), "server address")
+	token := fs.String("token", os.Getenv("QUICKIE_TOKEN"), "access token")
+	tenant := fs.String("tenant", os.Getenv("QUICKIE_TENANT"), "tenant to act as")
+	insecure := fs.Bool("insecure", false, "skip TLS certificate verification, for self-signed certificates")
+	output := fs.String("output", "table", "output format: table, json or yaml")
+	quiet := fs.Bool("quiet", false, "print nothing on success")
+	fs.Usage = func() { usage(fs) }
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+
+	out, err := newPrinter(stdout, *output, *quiet)
+	if err != nil {
+		fmt.Fprintf(stderr, "quickiectl: %v\n", err)
+		return exitUsage
+	}
+	if fs.NArg() == 0 {
+		usage(fs)
+		return exitUsage
+	}
+	name := fs.Arg(0)
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(stderr, "quickiectl: unknown command %q\n", name)
+		usage(fs)
+		return exitUsage
+	}
+
+	c, err := client.New(client.Config{
+		BaseURL:    *server,
+		Tenant:     *tenant,
+		Token:      *token,
+		HTTPClient: newHTTPClient(*insecure),
+	})
+	if err != nil {
+		fmt.Fprintf(stderr, "quickiectl: %v\n", err)
+		return exitUsage
+	}
+
+	err = cmd.run(context.Background(), &env{client: c, out: out, stdin: stdin, stdout: stdout, stderr: stderr}, fs.Args()[1:])
+	if err == nil {
+		return exitOK
+	}
+	status := exitStatus(err)
+	if status == exitUsage {
+		fmt.Fprintf(stderr, "quickiectl %s: %v\nusage: quickiectl %s %s\n", name, err, name, cmd.usage)
+		return status
+	}
+	out.error(stderr, err)
+	return status
+}
+
+// exitStatus maps an error to the exit status describing it.
+func exitStatus(err error) int {
+	if errors.Is(err, errUsage) {
+		return exitUsage
+	}
+	var apiErr *client.APIError
+	if !errors.As(err, &apiErr) {
+		return exitServer
+	}
+	switch apiErr.Class {
+	case apierror.Validation:
+		return exitValidation
+	case apierror.Auth:
+		return exitAuth
+	case apierror.NotFound:
+		return exitNotFound
+	case apierror.Conflict:
+		return exitConflict
+	case apierror.Transient, apierror.Internal:
+		return exitServer
+	}
+	// A response without our error body, e.g. from a proxy.
+	switch {
+	case apiErr.Status == http.StatusUnauthorized || apiErr.Status == http.StatusForbidden:
+		return exitAuth
+	case apiErr.Status == http.StatusNotFound:
+		return exitNotFound
+	case apiErr.Status == http.StatusConflict:
+		return exitConflict
+	case apiErr.Status >= 400 && apiErr.Status < 500:
+		return exitValidation
+	}
+	return exitServer
+}
+
+func usage(fs *flag.FlagSet) {
+	w := fs.Output()
+	fmt.Fprintln(w, "usage: quickiectl [flags] <command> [arguments]")
+	fmt.Fprintln(w, "\nCommands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-14s %s\n", name, commands[name].help)
+	}
+	fmt.Fprintln(w, "\nFlags:")
+	fs.PrintDefaults()
+}
+
+func envOr(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// parseFlags parses the flags of a command, keeping flag's own messages
+// off the output; errors are reported as usage errors instead.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(args); err != nil {
+		return usageError("%v", err)
+	}
+	return nil
+}
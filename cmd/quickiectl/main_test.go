@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"naevis/apierror"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeServer answers the endpoints the commands call.
+func fakeServer(t *testing.T) {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"total":5,"totals":[{"entity_type":"event","action":"view","tenant":"","count":3},{"entity_type":"place","action":"like","tenant":"acme","count":2}]}`))
+	})
+	mux.HandleFunc("/event", func(w http.ResponseWriter, r *http.Request) {
+		var event map[string]any
+		json.NewDecoder(r.Body).Decode(&event)
+		if event["entity_type"] == "bad" {
+			apierror.WriteFields(w, apierror.CodeInvalidEvent, "Invalid event", http.StatusUnprocessableEntity, []apierror.FieldError{{Field: "entity_type", Message: "unknown"}})
+			return
+		}
+		w.Write([]byte(`{"message":"Event received and stored successfully"}`))
+	})
+	mux.HandleFunc("/admin/vars", func(w http.ResponseWriter, r *http.Request) {
+		apierror.Write(w, "Admin role required", http.StatusForbidden)
+	})
+	mux.HandleFunc("/admin/dead-letters/", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/admin/dead-letters/404/retry":
+			apierror.Write(w, "Dead letter not found", http.StatusNotFound)
+		case "/admin/dead-letters/500/retry":
+			apierror.Write(w, "Failed to retry", http.StatusInternalServerError)
+		default:
+			w.Write([]byte(`{"message":"Event stored"}`))
+		}
+	})
+	serve(t, mux)
+}
+
+// serve points the commands at h.
+func serve(t *testing.T, h http.Handler) {
+	t.Helper()
+	srv := httptest.NewTLSServer(h)
+	t.Cleanup(srv.Close)
+
+	orig := newHTTPClient
+	newHTTPClient = func(bool) *http.Client { return srv.Client() }
+	t.Cleanup(func() { newHTTPClient = orig })
+	t.Setenv("QUICKIE_URL", srv.URL)
+}
+
+func runCmd(args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	status := run(args, strings.NewReader(""), &stdout, &stderr)
+	return status, stdout.String(), stderr.String()
+}
+
+func TestOutputFormats(t *testing.T) {
+	fakeServer(t)
+
+	for _, tc := range []struct {
+		format string
+		want   string
+	}{
+		{"table", `ENTITY_TYPE  ACTION  TENANT  COUNT
+event        view            3
+place        like    acme    2
+`},
+		{"yaml", `total: 5
+totals:
+  - action: view
+    count: 3
+    entity_type: event
+    tenant: ""
+  - action: like
+    count: 2
+    entity_type: place
+    tenant: acme
+`},
+		{"json", `{
+  "total": 5,
+  "totals": [
+    {
+      "action": "view",
+      "count": 3,
+      "entity_type": "event",
+      "tenant": ""
+    },
+    {
+      "action": "like",
+      "count": 2,
+      "entity_type": "place",
+      "tenant": "acme"
+    }
+  ]
+}
+`},
+	} {
+		t.Run(tc.format, func(t *testing.T) {
+			status, out, errOut := runCmd("-output", tc.format, "stats")
+			if status != exitOK {
+				t.Fatalf("exit %d: %s", status, errOut)
+			}
+			if out != tc.want {
+				t.Errorf("got\n%s\nwant\n%s", out, tc.want)
+			}
+		})
+	}
+}
+
+func TestQuiet(t *testing.T) {
+	fakeServer(t)
+	status, out, _ := runCmd("-quiet", "send", "-type", "event", "-action", "view")
+	if status != exitOK || out != "" {
+		t.Errorf("quiet send: exit %d, output %q", status, out)
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	fakeServer(t)
+
+	for _, tc := range []struct {
+		name string
+		args []string
+		want int
+	}{
+		{"ok", []string{"dead-letters", "retry", "1"}, exitOK},
+		{"unknown command", []string{"frobnicate"}, exitUsage},
+		{"bad output", []string{"-output", "xml", "stats"}, exitUsage},
+		{"missing flag", []string{"send", "-type", "event"}, exitUsage},
+		{"bad id", []string{"dead-letters", "retry", "x"}, exitUsage},
+		{"validation", []string{"send", "-type", "bad", "-action", "view"}, exitValidation},
+		{"auth", []string{"vars"}, exitAuth},
+		{"not found", []string{"dead-letters", "retry", "404"}, exitNotFound},
+		{"server", []string{"dead-letters", "retry", "500"}, exitServer},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if status, _, errOut := runCmd(tc.args...); status != tc.want {
+				t.Errorf("exit %d, want %d: %s", status, tc.want, errOut)
+			}
+		})
+	}
+}
+
+func TestErrorOutput(t *testing.T) {
+	fakeServer(t)
+
+	_, _, errOut := runCmd("send", "-type", "bad", "-action", "view")
+	if !strings.Contains(errOut, "entity_type: unknown") {
+		t.Errorf("table error lacks the field error: %q", errOut)
+	}
+
+	_, _, errOut = runCmd("-output", "json", "send", "-type", "bad", "-action", "view")
+	var body struct {
+		Error struct {
+			Status int    `json:"status"`
+			Class  string `json:"class"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(errOut), &body); err != nil || body.Error.Status != 422 || body.Error.Class != "validation" {
+		t.Errorf("json error = %q (%v)", errOut, err)
+	}
+}
+
+func TestYAMLScalars(t *testing.T) {
+	var b bytes.Buffer
+	v, _ := generic(map[string]any{
+		"plain": "abc", "reserved": "yes", "number": "42", "spaces": "a b", "empty": "",
+		"list": []any{}, "object": map[string]any{}, "nested": []any{[]any{"x"}},
+	})
+	writeYAML(&b, v, 0)
+	want := `empty: ""
+list: []
+nested:
+  -
+    - x
+number: "42"
+object: {}
+plain: abc
+reserved: "yes"
+spaces: "a b"
+`
+	if b.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", b.String(), want)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"naevis/client"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// printer writes results in the chosen format.
+type printer struct {
+	w      io.Writer
+	format string
+	quiet  bool
+}
+
+func newPrinter(w io.Writer, format string, quiet bool) (*printer, error) {
+	switch format {
+	case "table", "json", "yaml":
+		return &printer{w: w, format: format, quiet: quiet}, nil
+	}
+	return nil, fmt.Errorf("unknown output format %q: use table, json or yaml", format)
+}
+
+// table is how a result shows as a table: one row per element of the
+// list under key path of the result, or of the result itself when path is
+// empty, with the given fields as columns. A single object is one row;
+// without columns, an object is listed as key and value rows.
+type table struct {
+	path    string
+	columns []string
+}
+
+// print writes v, a response decoded from JSON or a value encoding to it.
+func (p *printer) print(v any, t table) error {
+	if p.quiet {
+		return nil
+	}
+	v, err := generic(v)
+	if err != nil {
+		return err
+	}
+	switch p.format {
+	case "json":
+		b, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(p.w, "%s\n", b)
+		return err
+	case "yaml":
+		var b bytes.Buffer
+		writeYAML(&b, v, 0)
+		_, err := p.w.Write(b.Bytes())
+		return err
+	}
+	return writeTable(p.w, v, t)
+}
+
+// error writes err to w in the chosen format. Errors are written even
+// with -quiet, as the exit status alone may not say enough.
+func (p *printer) error(w io.Writer, err error) {
+	var apiErr *client.APIError
+	if p.format == "table" {
+		fmt.Fprintf(w, "quickiectl: %v\n", err)
+		if errors.As(err, &apiErr) {
+			for _, f := range apiErr.Fields {
+				fmt.Fprintf(w, "  %s: %s\n", f.Field, f.Message)
+			}
+		}
+		return
+	}
+
+	body := map[string]any{"message": err.Error()}
+	if errors.As(err, &apiErr) {
+		body = map[string]any{"status": apiErr.Status, "code": apiErr.Code, "class": apiErr.Class, "message": apiErr.Message}
+		if len(apiErr.Fields) > 0 {
+			body["fields"] = apiErr.Fields
+		}
+	}
+	(&printer{w: w, format: p.format}).print(map[string]any{"error": body}, table{})
+}
+
+// generic turns v into the maps, slices and scalars JSON decodes to.
+func generic(v any) (any, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var out any
+	return out, d.Decode(&out)
+}
+
+func writeTable(w io.Writer, v any, t table) error {
+	if t.path != "" {
+		if m, ok := v.(map[string]any); ok {
+			v = m[t.path]
+		}
+	}
+
+	var header []string
+	var rows [][]string
+	switch v := v.(type) {
+	case []any:
+		columns := t.columns
+		if columns == nil {
+			columns = unionKeys(v)
+		}
+		header = columns
+		for _, e := range v {
+			m, _ := e.(map[string]any)
+			rows = append(rows, cells(m, columns))
+		}
+	case map[string]any:
+		if t.columns != nil {
+			header = t.columns
+			rows = append(rows, cells(v, t.columns))
+			break
+		}
+		header = []string{"key", "value"}
+		for _, k := range sortedKeys(v) {
+			rows = append(rows, []string{k, cell(v[k])})
+		}
+	default:
+		_, err := fmt.Fprintln(w, cell(v))
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for i, h := range header {
+		header[i] = strings.ToUpper(h)
+	}
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+func cells(m map[string]any, columns []string) []string {
+	row := make([]string, len(columns))
+	for i, c := range columns {
+		row[i] = cell(m[c])
+	}
+	return row
+}
+
+// cell formats a value for a table cell: scalars as they are, anything
+// else as compact JSON, with tabs and newlines that would break the
+// table escaped.
+func cell(v any) string {
+	var s string
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		s = v
+	case json.Number:
+		s = v.String()
+	case bool:
+		s = strconv.FormatBool(v)
+	default:
+		b, _ := json.Marshal(v)
+		s = string(b)
+	}
+	return strings.NewReplacer("\t", `\t`, "\n", `\n`, "\r", `\r`).Replace(s)
+}
+
+func unionKeys(rows []any) []string {
+	seen := make(map[string]bool)
+	var keys []string
+	for _, e := range rows {
+		m, _ := e.(map[string]any)
+		for _, k := range sortedKeys(m) {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	return keys
+}
+
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writeYAML writes v as a YAML block indented by indent levels. Keys are
+// sorted, so output is stable.
+func writeYAML(b *bytes.Buffer, v any, indent int) {
+	pad := strings.Repeat("  ", indent)
+	switch v := v.(type) {
+	case map[string]any:
+		if len(v) == 0 {
+			b.WriteString(pad + "{}\n")
+			return
+		}
+		for _, k := range sortedKeys(v) {
+			b.WriteString(pad + yamlScalar(k) + ":")
+			writeYAMLValue(b, v[k], indent)
+		}
+	case []any:
+		if len(v) == 0 {
+			b.WriteString(pad + "[]\n")
+			return
+		}
+		for _, e := range v {
+			if m, ok := e.(map[string]any); ok && len(m) > 0 {
+				// The first key goes on the dash line.
+				var item bytes.Buffer
+				writeYAML(&item, m, indent+1)
+				b.WriteString(pad + "- ")
+				b.Write(item.Bytes()[len(pad)+2:])
+				continue
+			}
+			b.WriteString(pad + "-")
+			writeYAMLValue(b, e, indent)
+		}
+	default:
+		b.WriteString(pad + yamlScalar(v) + "\n")
+	}
+}
+
+// writeYAMLValue writes v after a key or dash already written at indent.
+func writeYAMLValue(b *bytes.Buffer, v any, indent int) {
+	switch x := v.(type) {
+	case map[string]any:
+		if len(x) == 0 {
+			b.WriteString(" {}\n")
+			return
+		}
+	case []any:
+		if len(x) == 0 {
+			b.WriteString(" []\n")
+			return
+		}
+	default:
+		b.WriteString(" " + yamlScalar(v) + "\n")
+		return
+	}
+	b.WriteString("\n")
+	writeYAML(b, v, indent+1)
+}
+
+// plain matches strings that need no quotes in YAML.
+var plain = regexp.MustCompile(`^[A-Za-z_/][A-Za-z0-9_./@+-]*$`)
+
+// reserved are plain strings YAML would read as something else.
+var reserved = map[string]bool{
+	"true": true, "false": true, "yes": true, "no": true, "on": true, "off": true,
+	"y": true, "n": true, "null": true,
+}
+
+func yamlScalar(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(v)
+	case json.Number:
+		return v.String()
+	case string:
+		if plain.MatchString(v) && !reserved[strings.ToLower(v)] {
+			return v
+		}
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"naevis/structs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// historySize caps the lines kept in the history file.
+const historySize = 500
+
+func init() {
+	commands["repl"] = command{
+		usage: "",
+		help:  "run commands at an interactive prompt",
+		run:   repl,
+	}
+}
+
+// builtins are the commands only the REPL has.
+var builtins = map[string]string{
+	"help":    "list commands, or show the usage of one",
+	"history": "list the lines entered so far",
+	"output":  "switch the output format: table, json or yaml",
+	"types":   "list the entity types stored, for completion",
+	"exit":    "leave the REPL",
+}
+
+// session is a REPL session.
+type session struct {
+	env     *env
+	history *history
+	// types are the entity types the server has stored events of, as
+	// reported by /stats; they are completed after -type and search.
+	types []string
+}
+
+// repl reads commands until end of input or exit. On a terminal lines
+// are edited in place, with history on the arrow keys and completion of
+// commands, flags, entity types and result fields on Tab; elsewhere
+// lines are read as they come, so a script can be piped in.
+func repl(ctx context.Context, e *env, args []string) error {
+	if len(args) > 0 {
+		return usageError("unexpected argument %q", args[0])
+	}
+	s := &session{env: e, history: openHistory()}
+	s.loadTypes(ctx)
+
+	var lines lineReader = plainReader{bufio.NewReader(e.stdin)}
+	if f, ok := e.stdin.(*os.File); ok && isTerminal(int(f.Fd())) {
+		fd := int(f.Fd())
+		lines = &editor{
+			in:       bufio.NewReader(f),
+			out:      e.stdout,
+			history:  s.history,
+			complete: s.complete,
+			raw:      func() (func(), error) { return makeRaw(fd) },
+		}
+	}
+
+	for {
+		line, err := lines.readLine("quickie> ")
+		switch {
+		case errors.Is(err, errInterrupted):
+			continue
+		case errors.Is(err, io.EOF):
+			return nil
+		case err != nil:
+			return err
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		s.history.add(line)
+		if !s.exec(ctx, line) {
+			return nil
+		}
+	}
+}
+
+// exec runs one line and reports whether to read another.
+func (s *session) exec(ctx context.Context, line string) bool {
+	e := s.env
+	words, err := splitWords(line)
+	if err != nil {
+		fmt.Fprintf(e.stderr, "%v\n", err)
+		return true
+	}
+	name, args := words[0], words[1:]
+
+	switch name {
+	case "exit", "quit":
+		return false
+	case "help":
+		s.help(args)
+		return true
+	case "history":
+		for i, entry := range s.history.entries() {
+			fmt.Fprintf(e.stdout, "%5d  %s\n", i+1, entry)
+		}
+		return true
+	case "output":
+		if len(args) != 1 {
+			fmt.Fprintf(e.stderr, "output is %s; use output table|json|yaml\n", e.out.format)
+			return true
+		}
+		out, err := newPrinter(e.stdout, args[0], e.out.quiet)
+		if err != nil {
+			fmt.Fprintf(e.stderr, "%v\n", err)
+			return true
+		}
+		*e.out = *out
+		return true
+	case "types":
+		s.loadTypes(ctx)
+		for _, t := range s.types {
+			fmt.Fprintln(e.stdout, t)
+		}
+		return true
+	}
+
+	cmd, ok := commands[name]
+	if !ok || name == "repl" {
+		fmt.Fprintf(e.stderr, "unknown command %q; try help\n", name)
+		return true
+	}
+	if err := cmd.run(ctx, e, args); err != nil {
+		if exitStatus(err) == exitUsage {
+			fmt.Fprintf(e.stderr, "%v\nusage: %s %s\n", err, name, cmd.usage)
+		} else {
+			e.out.error(e.stderr, err)
+		}
+	}
+	return true
+}
+
+func (s *session) help(args []string) {
+	w := s.env.stdout
+	if len(args) == 1 {
+		if cmd, ok := commands[args[0]]; ok {
+			fmt.Fprintf(w, "%s %s\n  %s\n", args[0], cmd.usage, cmd.help)
+			return
+		}
+	}
+	for _, name := range s.commandNames() {
+		if cmd, ok := commands[name]; ok {
+			fmt.Fprintf(w, "  %-14s %s\n", name, cmd.help)
+		} else {
+			fmt.Fprintf(w, "  %-14s %s\n", name, builtins[name])
+		}
+	}
+}
+
+// loadTypes fetches the entity types from the totals in /stats. Without
+// them, types just do not complete.
+func (s *session) loadTypes(ctx context.Context) {
+	var stats struct {
+		Totals []struct {
+			EntityType string `json:"entity_type"`
+		} `json:"totals"`
+	}
+	if err := s.env.client.Call(ctx, http.MethodGet, "/stats", nil, nil, &stats); err != nil {
+		return
+	}
+	seen := make(map[string]bool)
+	s.types = s.types[:0]
+	for _, t := range stats.Totals {
+		if !seen[t.EntityType] {
+			seen[t.EntityType] = true
+			s.types = append(s.types, t.EntityType)
+		}
+	}
+	sort.Strings(s.types)
+}
+
+func (s *session) commandNames() []string {
+	var names []string
+	for name := range commands {
+		if name != "repl" {
+			names = append(names, name)
+		}
+	}
+	for name := range builtins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// flagPattern finds the flags in a usage line.
+var flagPattern = regexp.MustCompile(`(?:^|[\s\[|])(-[a-z][a-z-]*)`)
+
+// resultFields are the fields search results can be sorted by.
+var resultFields = func() []string {
+	var fields []string
+	t := reflect.TypeFor[structs.Result]()
+	for i := range t.NumField() {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		fields = append(fields, name)
+	}
+	sort.Strings(fields)
+	return fields
+}()
+
+// complete completes the last word of line: a command name first, then
+// its flags, entity types after -type or as the first argument of
+// search, result fields after -sort and formats after output.
+func (s *session) complete(line string) (int, []string) {
+	start := strings.LastIndexAny(line, " \t") + 1
+	word := line[start:]
+	words := strings.Fields(line[:start])
+
+	var options []string
+	switch {
+	case len(words) == 0:
+		options = s.commandNames()
+	case words[0] == "output":
+		options = []string{"json", "table", "yaml"}
+	case words[0] == "help":
+		options = s.commandNames()
+	case words[len(words)-1] == "-type":
+		options = s.types
+	case words[len(words)-1] == "-sort":
+		for _, f := range resultFields {
+			options = append(options, f+":asc", f+":desc")
+		}
+	case strings.HasPrefix(word, "-"):
+		if cmd, ok := commands[words[0]]; ok {
+			for _, m := range flagPattern.FindAllStringSubmatch(cmd.usage, -1) {
+				options = append(options, m[1])
+			}
+		}
+	case words[0] == "search" && positional(words[1:]) == 0:
+		options = s.types
+	}
+
+	var candidates []string
+	seen := make(map[string]bool)
+	for _, o := range options {
+		if strings.HasPrefix(o, word) && !seen[o] {
+			seen[o] = true
+			candidates = append(candidates, o)
+		}
+	}
+	sort.Strings(candidates)
+	return start, candidates
+}
+
+// positional counts the arguments among words that are not flags or flag
+// values. Every flag of the commands but -all takes a value.
+func positional(words []string) int {
+	n := 0
+	for i := 0; i < len(words); i++ {
+		switch {
+		case words[i] == "-all" || strings.Contains(words[i], "="):
+		case strings.HasPrefix(words[i], "-"):
+			i++
+		default:
+			n++
+		}
+	}
+	return n
+}
+
+// splitWords splits a line into words at spaces, keeping spaces inside
+// single or double quotes and after a backslash.
+func splitWords(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range line {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inWord = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errors.New("unterminated quote or escape")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	if len(words) == 0 {
+		return nil, errors.New("empty line")
+	}
+	return words, nil
+}
+
+// history is the lines entered, kept in ~/.quickiectl_history across
+// sessions when the home directory is known.
+type history struct {
+	path  string
+	lines []string
+}
+
+func openHistory() *history {
+	h := &history{}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return h
+	}
+	h.path = filepath.Join(home, ".quickiectl_history")
+	if b, err := os.ReadFile(h.path); err == nil {
+		h.lines = strings.Split(strings.TrimRight(string(b), "\n"), "\n")
+		if len(h.lines) == 1 && h.lines[0] == "" {
+			h.lines = nil
+		}
+	}
+	return h
+}
+
+func (h *history) entries() []string {
+	return h.lines
+}
+
+// add appends line unless it repeats the last one, trimming the file to
+// historySize lines now and then.
+func (h *history) add(line string) {
+	if n := len(h.lines); n > 0 && h.lines[n-1] == line {
+		return
+	}
+	h.lines = append(h.lines, line)
+	if h.path == "" {
+		return
+	}
+	if len(h.lines) > 2*historySize {
+		h.lines = h.lines[len(h.lines)-historySize:]
+		os.WriteFile(h.path, []byte(strings.Join(h.lines, "\n")+"\n"), 0o600)
+		return
+	}
+	f, err := os.OpenFile(h.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	f.WriteString(line + "\n")
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestREPL(t *testing.T) {
+	fakeServer(t)
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	script := "stats -type event\noutput yaml\nsend -type bad -action view\nbogus\n\nexit\nstats\n"
+	var stdout, stderr bytes.Buffer
+	if status := run([]string{"repl"}, strings.NewReader(script), &stdout, &stderr); status != exitOK {
+		t.Fatalf("exit %d: %s", status, stderr.String())
+	}
+
+	if !strings.Contains(stdout.String(), "ENTITY_TYPE") {
+		t.Errorf("stats printed no table: %q", stdout.String())
+	}
+	if !strings.Contains(stderr.String(), "class: validation") {
+		t.Errorf("error after output yaml not in YAML: %q", stderr.String())
+	}
+	if !strings.Contains(stderr.String(), `unknown command "bogus"`) {
+		t.Errorf("unknown command not reported: %q", stderr.String())
+	}
+	if strings.Count(stdout.String(), "ENTITY_TYPE") != 1 {
+		t.Errorf("commands after exit ran: %q", stdout.String())
+	}
+
+	b, err := os.ReadFile(filepath.Join(home, ".quickiectl_history"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "stats -type event\noutput yaml\nsend -type bad -action view\nbogus\nexit\n"
+	if string(b) != want {
+		t.Errorf("history file = %q, want %q", b, want)
+	}
+}
+
+func TestComplete(t *testing.T) {
+	s := &session{types: []string{"event", "merch", "place"}}
+	for _, tc := range []struct {
+		line  string
+		start int
+		want  []string
+	}{
+		{"st", 0, []string{"stats"}},
+		{"search ", 7, []string{"event", "merch", "place"}},
+		{"search p", 7, []string{"place"}},
+		{"search place ", 13, nil},
+		{"search -limit 5 m", 16, []string{"merch"}},
+		{"stats -ty", 6, []string{"-type"}},
+		{"stats -type ", 12, []string{"event", "merch", "place"}},
+		{"search -sort na", 13, []string{"name:asc", "name:desc"}},
+		{"output y", 7, []string{"yaml"}},
+		{"dead-letters list -", 18, []string{"-all", "-limit"}},
+	} {
+		start, got := s.complete(tc.line)
+		if start != tc.start || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("complete(%q) = %d %q, want %d %q", tc.line, start, got, tc.start, tc.want)
+		}
+	}
+}
+
+func TestEditor(t *testing.T) {
+	s := &session{types: []string{"event", "place"}}
+	h := &history{lines: []string{"stats", "vars"}}
+	for _, tc := range []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"typed", "stats\r", "stats"},
+		{"backspace", "statx\x7fs\r", "stats"},
+		{"complete command", "sea\t\r", "search "},
+		{"complete type", "search ev\t\r", "search event "},
+		{"common prefix", "s\t\r", "s"},
+		{"history", "\x1b[A\x1b[A\r", "stats"},
+		{"history back to draft", "x\x1b[A\x1b[B\r", "x"},
+		{"cursor", "tats\x01s\r", "stats"},
+		{"insert mid-line", "sats\x1b[D\x1b[D\x1b[Dt\r", "stats"},
+		{"kill", "junk\x15vars\r", "vars"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			e := &editor{in: bufio.NewReader(strings.NewReader(tc.input)), out: &out, history: h, complete: s.complete}
+			got, err := e.readLine("> ")
+			if err != nil || got != tc.want {
+				t.Errorf("readLine = %q, %v; want %q", got, err, tc.want)
+			}
+		})
+	}
+
+	e := &editor{in: bufio.NewReader(strings.NewReader("abc\x03")), out: &bytes.Buffer{}, history: h}
+	if _, err := e.readLine("> "); err != errInterrupted {
+		t.Errorf("Ctrl-C: err = %v", err)
+	}
+}
+
+func TestSplitWords(t *testing.T) {
+	got, err := splitWords(`search event "live music" -location 'New York' a\ b`)
+	want := []string{"search", "event", "live music", "-location", "New York", "a b"}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("splitWords = %q, %v", got, err)
+	}
+	if _, err := splitWords(`search "open`); err == nil {
+		t.Error("unterminated quote accepted")
+	}
+}
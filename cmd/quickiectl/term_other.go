@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+
+package main
+
+import "errors"
+
+// isTerminal reports false, as line editing is not supported here; the
+// REPL then reads plain lines.
+func isTerminal(int) bool {
+	return false
+}
+
+func makeRaw(int) (func(), error) {
+	return nil, errors.New("raw terminal mode is not supported on this platform")
+}
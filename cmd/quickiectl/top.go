@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func init() {
+	commands["top"] = command{
+		usage: "[-interval DURATION] [-n FRAMES] [-dead-letters N]",
+		help:  "watch ingest rate, queue depth, errors and dead letters live",
+		run:   top,
+	}
+}
+
+// errorCounters are the expvar counters top shows as error rates.
+var errorCounters = []struct{ label, group, key string }{
+	{"ingest queue full", "ingest", "queue_full"},
+	{"ingest store failed", "ingest", "queue_failed"},
+	{"dead-lettered", "dead_letters", "added"},
+	{"rate limited", "ratelimit", "limited"},
+	{"bad signatures", "signatures", "invalid"},
+	{"webhooks failed", "webhooks", "failed"},
+	{"SLA breaches", "sla", "breaches"},
+}
+
+// sample is what top reads from the server at one moment.
+type sample struct {
+	at          time.Time
+	vars        map[string]any
+	totals      map[string]int64
+	deadLetters []any
+}
+
+// frame is what top shows: the latest counters, with rates over the time
+// since the previous sample.
+type frame struct {
+	Time        time.Time   `json:"time"`
+	Stored      int64       `json:"stored"`
+	Rate        float64     `json:"rate"`
+	QueueDepth  int64       `json:"queue_depth"`
+	Types       []typeRate  `json:"types"`
+	Errors      []errorRate `json:"errors"`
+	DeadLetters []any       `json:"dead_letters"`
+}
+
+type typeRate struct {
+	EntityType string  `json:"entity_type"`
+	Total      int64   `json:"total"`
+	Rate       float64 `json:"rate"`
+}
+
+type errorRate struct {
+	Name  string  `json:"name"`
+	Total int64   `json:"total"`
+	Rate  float64 `json:"rate"`
+}
+
+// top samples the server every interval and redraws a dashboard, until
+// interrupted or, with -n, after that many frames. Rates are per second
+// over the interval. With -output json or yaml it prints each frame as a
+// document instead, for feeding other tools.
+func top(ctx context.Context, e *env, args []string) error {
+	fs := flag.NewFlagSet("top", flag.ContinueOnError)
+	interval := fs.Duration("interval", 2*time.Second, "time between frames")
+	frames := fs.Int("n", 0, "frames to show; 0 runs until interrupted")
+	letters := fs.Int("dead-letters", 5, "recent dead letters to show")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 || *interval <= 0 || *frames < 0 || *letters < 0 {
+		return usageError("invalid arguments")
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+	f, ok := e.stdout.(*os.File)
+	redraw := ok && isTerminal(int(f.Fd()))
+
+	prev, err := collect(ctx, e, *letters)
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for n := 0; *frames == 0 || n < *frames; n++ {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		cur, err := collect(ctx, e, *letters)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fr := newFrame(prev, cur)
+		prev = cur
+
+		if e.out.quiet {
+			continue
+		}
+		if e.out.format != "table" {
+			if err := e.out.print(fr, table{}); err != nil {
+				return err
+			}
+			continue
+		}
+		if redraw {
+			// Home the cursor and clear the screen.
+			fmt.Fprint(e.stdout, "\x1b[H\x1b[2J")
+		} else if n > 0 {
+			fmt.Fprintln(e.stdout)
+		}
+		render(e.stdout, fr)
+	}
+	return nil
+}
+
+// collect reads the counters, the totals per entity type and the most
+// recent dead letters.
+func collect(ctx context.Context, e *env, letters int) (sample, error) {
+	s := sample{at: time.Now(), totals: make(map[string]int64)}
+	if err := e.client.Call(ctx, http.MethodGet, "/admin/vars", nil, nil, &s.vars); err != nil {
+		return s, err
+	}
+
+	var stats struct {
+		Totals []struct {
+			EntityType string `json:"entity_type"`
+			Count      int64  `json:"count"`
+		} `json:"totals"`
+	}
+	if err := e.client.Call(ctx, http.MethodGet, "/stats", nil, nil, &stats); err != nil {
+		return s, err
+	}
+	for _, t := range stats.Totals {
+		s.totals[t.EntityType] += t.Count
+	}
+
+	if letters > 0 {
+		query := url.Values{"all": {"1"}, "limit": {fmt.Sprint(letters)}}
+		if err := e.client.Call(ctx, http.MethodGet, "/admin/dead-letters", query, nil, &s.deadLetters); err != nil {
+			return s, err
+		}
+	}
+	return s, nil
+}
+
+// newFrame computes rates between two samples.
+func newFrame(prev, cur sample) frame {
+	secs := cur.at.Sub(prev.at).Seconds()
+	rate := func(now, before int64) float64 {
+		if secs <= 0 || now < before {
+			return 0
+		}
+		return float64(now-before) / secs
+	}
+
+	stored := counter(cur.vars, "ingest", "stored")
+	fr := frame{
+		Time:        cur.at,
+		Stored:      stored,
+		Rate:        rate(stored, counter(prev.vars, "ingest", "stored")),
+		QueueDepth:  counter(cur.vars, "ingest", "queue_depth"),
+		Types:       []typeRate{},
+		Errors:      []errorRate{},
+		DeadLetters: cur.deadLetters,
+	}
+	if fr.DeadLetters == nil {
+		fr.DeadLetters = []any{}
+	}
+	for entityType, total := range cur.totals {
+		fr.Types = append(fr.Types, typeRate{entityType, total, rate(total, prev.totals[entityType])})
+	}
+	// Busiest first, then by name for a steady order.
+	sort.Slice(fr.Types, func(i, j int) bool {
+		a, b := fr.Types[i], fr.Types[j]
+		if a.Rate != b.Rate {
+			return a.Rate > b.Rate
+		}
+		return a.EntityType < b.EntityType
+	})
+	for _, c := range errorCounters {
+		total := counter(cur.vars, c.group, c.key)
+		fr.Errors = append(fr.Errors, errorRate{c.label, total, rate(total, counter(prev.vars, c.group, c.key))})
+	}
+	return fr
+}
+
+// counter reads the integer vars[group][key], or 0.
+func counter(vars map[string]any, group, key string) int64 {
+	m, _ := vars[group].(map[string]any)
+	switch v := m[key].(type) {
+	case float64:
+		return int64(v)
+	case int64:
+		return v
+	}
+	return 0
+}
+
+// barWidth is the width of the full bar of the busiest entity type.
+const barWidth = 30
+
+func render(w io.Writer, fr frame) {
+	fmt.Fprintf(w, "quickie top - %s\n\n", fr.Time.Format(time.TimeOnly))
+	fmt.Fprintf(w, "ingest  %8.1f events/s   stored %d   queue depth %d\n\n", fr.Rate, fr.Stored, fr.QueueDepth)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ENTITY TYPE\tEVENTS/S\tTOTAL\t")
+	busiest := 0.0
+	for _, t := range fr.Types {
+		busiest = max(busiest, t.Rate)
+	}
+	for _, t := range fr.Types {
+		bar := 0
+		if busiest > 0 {
+			bar = int(t.Rate / busiest * barWidth)
+		}
+		fmt.Fprintf(tw, "%s\t%.1f\t%d\t%s\n", t.EntityType, t.Rate, t.Total, strings.Repeat("#", bar))
+	}
+	tw.Flush()
+
+	fmt.Fprintln(w)
+	tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ERRORS\tPER S\tTOTAL")
+	for _, e := range fr.Errors {
+		fmt.Fprintf(tw, "%s\t%.1f\t%d\n", e.Name, e.Rate, e.Total)
+	}
+	tw.Flush()
+
+	if len(fr.DeadLetters) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "\nRECENT DEAD LETTERS")
+	writeTable(w, fr.DeadLetters, table{columns: []string{"id", "tenant", "stage", "error", "updated_at"}})
+}
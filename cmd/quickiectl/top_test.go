@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewFrame(t *testing.T) {
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	prev := sample{
+		at:     at,
+		vars:   map[string]any{"ingest": map[string]any{"stored": 100.0}, "dead_letters": map[string]any{"added": 1.0}},
+		totals: map[string]int64{"event": 80, "place": 20},
+	}
+	cur := sample{
+		at:     at.Add(2 * time.Second),
+		vars:   map[string]any{"ingest": map[string]any{"stored": 120.0, "queue_depth": 7.0}, "dead_letters": map[string]any{"added": 3.0}},
+		totals: map[string]int64{"event": 84, "place": 36, "merch": 2},
+	}
+	fr := newFrame(prev, cur)
+
+	if fr.Rate != 10 || fr.Stored != 120 || fr.QueueDepth != 7 {
+		t.Errorf("frame = rate %v stored %d depth %d, want 10 120 7", fr.Rate, fr.Stored, fr.QueueDepth)
+	}
+	want := []typeRate{{"place", 36, 8}, {"event", 84, 2}, {"merch", 2, 1}}
+	if fmt.Sprint(fr.Types) != fmt.Sprint(want) {
+		t.Errorf("types = %v, want %v", fr.Types, want)
+	}
+	for _, e := range fr.Errors {
+		if e.Name == "dead-lettered" && (e.Total != 3 || e.Rate != 1) {
+			t.Errorf("dead-lettered = %+v, want total 3 at 1/s", e)
+		}
+	}
+}
+
+func TestTop(t *testing.T) {
+	var stored atomic.Int64
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/vars", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"ingest":{"stored":%d,"queue_depth":2}}`, stored.Add(10))
+	})
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"totals":[{"entity_type":"event","action":"view","count":%d}]}`, stored.Load())
+	})
+	mux.HandleFunc("/admin/dead-letters", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"id":4,"tenant":"acme","stage":"store","error":"disk full","updated_at":"2024-01-01 00:00:00"}]`))
+	})
+	serve(t, mux)
+
+	status, out, errOut := runCmd("top", "-interval", "10ms", "-n", "2")
+	if status != exitOK {
+		t.Fatalf("exit %d: %s", status, errOut)
+	}
+	if strings.Count(out, "quickie top") != 2 {
+		t.Errorf("want 2 frames:\n%s", out)
+	}
+	for _, s := range []string{"queue depth 2", "event", "dead-lettered", "disk full"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("frame lacks %q:\n%s", s, out)
+		}
+	}
+	if strings.Contains(out, "\x1b[") {
+		t.Error("redrew a screen that is not a terminal")
+	}
+
+	status, out, _ = runCmd("-output", "json", "top", "-interval", "10ms", "-n", "1")
+	if status != exitOK || !strings.Contains(out, `"queue_depth": 2`) {
+		t.Errorf("json frame: exit %d\n%s", status, out)
+	}
+}
@@ -0,0 +1,414 @@
+// Command sqlcheck type-checks the module and finds every statement
+// passed to database/sql. Each must be a constant, an element of a
+// package-level slice of constants, or the Format of a sqlguard.Template,
+// whose text must be a constant and which must be declared at package
+// level; anything else is reported, since it may have been built from
+// user input. The constant statements make up the catalog in
+// sqlguard/catalog.go, which the guard checks at run time. Run "make sqlcatalog" after changing a query and "make
+// sqlcheck" to verify.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/constant"
+	"go/format"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"log"
+	"naevis/sqlguard"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// module is the import path of the repository root.
+const module = "naevis"
+
+// catalogPath is where the catalog is written, relative to the root.
+const catalogPath = "sqlguard/catalog.go"
+
+// otherDrivers are the drivers of databases other than SQLite. Packages
+// importing one speak that database's dialect to it, unguarded, so they
+// are neither checked nor catalogued.
+var otherDrivers = map[string]bool{
+	"github.com/lib/pq": true,
+}
+
+// queryArg maps the database/sql methods that take a statement to the
+// index of that argument.
+var queryArg = map[string]int{
+	"Exec": 0, "ExecContext": 1,
+	"Query": 0, "QueryContext": 1,
+	"QueryRow": 0, "QueryRowContext": 1,
+	"Prepare": 0, "PrepareContext": 1,
+}
+
+func main() {
+	write := flag.Bool("w", false, "rewrite "+catalogPath+" instead of checking it")
+	flag.Parse()
+
+	fset := token.NewFileSet()
+	imp := importer.ForCompiler(fset, "source", nil)
+	statements := make(map[string]bool)
+	var problems []string
+
+	err := filepath.WalkDir(".", func(path string, d os.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+		if path != "." && (strings.HasPrefix(d.Name(), ".") || d.Name() == "clients" || d.Name() == "testdata") {
+			return filepath.SkipDir
+		}
+		files, err := parseDir(fset, path)
+		if err != nil || len(files) == 0 || importsOtherDriver(files) {
+			return err
+		}
+		importPath := module
+		if path != "." {
+			importPath += "/" + filepath.ToSlash(path)
+		}
+		found, err := check(fset, imp, importPath, files, statements)
+		problems = append(problems, found...)
+		return err
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, p := range problems {
+		fmt.Fprintln(os.Stderr, p)
+	}
+	src := render(statements)
+	if *write {
+		if err := os.WriteFile(catalogPath, src, 0o644); err != nil {
+			log.Fatal(err)
+		}
+	} else if old, err := os.ReadFile(catalogPath); err != nil || !bytes.Equal(old, src) {
+		fmt.Fprintln(os.Stderr, catalogPath+" is out of date; run make sqlcatalog")
+		problems = append(problems, "stale catalog")
+	}
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+}
+
+// parseDir parses the non-test Go files in dir that build on this
+// platform, so files for other platforms do not redeclare its names.
+func parseDir(fset *token.FileSet, dir string) ([]*ast.File, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return nil, err
+	}
+	var files []*ast.File
+	for _, path := range paths {
+		if strings.HasSuffix(path, "_test.go") {
+			continue
+		}
+		if ok, err := build.Default.MatchFile(dir, filepath.Base(path)); err != nil {
+			return nil, err
+		} else if !ok {
+			continue
+		}
+		f, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// importsOtherDriver reports whether files import the driver of a
+// database other than SQLite.
+func importsOtherDriver(files []*ast.File) bool {
+	for _, f := range files {
+		for _, imp := range f.Imports {
+			if path, _ := strconv.Unquote(imp.Path.Value); otherDrivers[path] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// check type-checks the package importPath made of files, records its
+// constant statements and returns the problems found.
+func check(fset *token.FileSet, imp types.Importer, importPath string, files []*ast.File, statements map[string]bool) ([]string, error) {
+	info := &types.Info{
+		Types:      make(map[ast.Expr]types.TypeAndValue),
+		Defs:       make(map[*ast.Ident]types.Object),
+		Uses:       make(map[*ast.Ident]types.Object),
+		Selections: make(map[*ast.SelectorExpr]*types.Selection),
+	}
+	conf := types.Config{Importer: imp}
+	if _, err := conf.Check(importPath, fset, files, info); err != nil {
+		return nil, fmt.Errorf("type-checking %s: %v", importPath, err)
+	}
+	c := newChecker(fset, info, files)
+	var problems []string
+	for _, f := range files {
+		problems = append(problems, c.inspect(f, statements)...)
+	}
+	return problems, nil
+}
+
+// checker inspects the files of a package.
+type checker struct {
+	fset *token.FileSet
+	info *types.Info
+	// ranges maps the values of range loops to what they range over, and
+	// vars the package-level variables to their initial values; assigned
+	// holds the variables assigned to after they are declared.
+	ranges   map[types.Object]ast.Expr
+	vars     map[types.Object]ast.Expr
+	assigned map[types.Object]bool
+}
+
+func newChecker(fset *token.FileSet, info *types.Info, files []*ast.File) *checker {
+	c := &checker{
+		fset:     fset,
+		info:     info,
+		ranges:   make(map[types.Object]ast.Expr),
+		vars:     make(map[types.Object]ast.Expr),
+		assigned: make(map[types.Object]bool),
+	}
+	for _, f := range files {
+		for _, d := range f.Decls {
+			gen, ok := d.(*ast.GenDecl)
+			if !ok || gen.Tok != token.VAR {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				vs := spec.(*ast.ValueSpec)
+				if len(vs.Values) != len(vs.Names) {
+					continue
+				}
+				for i, name := range vs.Names {
+					c.vars[info.Defs[name]] = vs.Values[i]
+				}
+			}
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.RangeStmt:
+				if v, ok := n.Value.(*ast.Ident); ok && n.Tok == token.DEFINE {
+					c.ranges[info.Defs[v]] = n.X
+				}
+			case *ast.AssignStmt:
+				if n.Tok != token.DEFINE {
+					for _, lhs := range n.Lhs {
+						c.assign(lhs)
+					}
+				}
+			case *ast.IncDecStmt:
+				c.assign(n.X)
+			}
+			return true
+		})
+	}
+	return c
+}
+
+// assign records an assignment to e, or to an element of it.
+func (c *checker) assign(e ast.Expr) {
+	for {
+		switch x := e.(type) {
+		case *ast.IndexExpr:
+			e = x.X
+			continue
+		case *ast.ParenExpr:
+			e = x.X
+			continue
+		case *ast.Ident:
+			if obj := c.info.Uses[x]; obj != nil {
+				c.assigned[obj] = true
+			}
+		}
+		return
+	}
+}
+
+// constants returns the strings e may hold when all are constants: e is
+// a constant, a slice literal of them, a package-level variable holding
+// one that is never assigned to, or the value of a range loop over any of
+// these.
+func (c *checker) constants(e ast.Expr) ([]string, bool) {
+	if tv := c.info.Types[e]; tv.Value != nil {
+		if tv.Value.Kind() != constant.String {
+			return nil, false
+		}
+		return []string{constant.StringVal(tv.Value)}, true
+	}
+	switch e := e.(type) {
+	case *ast.ParenExpr:
+		return c.constants(e.X)
+	case *ast.Ident:
+		obj := c.info.Uses[e]
+		if obj == nil || c.assigned[obj] {
+			return nil, false
+		}
+		if x, ok := c.ranges[obj]; ok {
+			return c.constants(x)
+		}
+		if x, ok := c.vars[obj]; ok {
+			return c.constants(x)
+		}
+	case *ast.CompositeLit:
+		var all []string
+		for _, elt := range e.Elts {
+			if kv, ok := elt.(*ast.KeyValueExpr); ok {
+				elt = kv.Value
+			}
+			values, ok := c.constants(elt)
+			if !ok {
+				return nil, false
+			}
+			all = append(all, values...)
+		}
+		return all, true
+	}
+	return nil, false
+}
+
+// inspect records the constant statements in f and reports the others,
+// and the templates not declared at package level with a constant text.
+func (c *checker) inspect(f *ast.File, statements map[string]bool) []string {
+	var problems []string
+	report := func(pos token.Pos, format string, args ...any) {
+		problems = append(problems, fmt.Sprintf("%s: ", c.fset.Position(pos))+fmt.Sprintf(format, args...))
+	}
+	for _, d := range f.Decls {
+		_, inFunc := d.(*ast.FuncDecl)
+		ast.Inspect(d, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			if name := c.sqlguardFunc(call); name == "NewTemplate" || name == "NewSchemaTemplate" {
+				if inFunc {
+					report(call.Pos(), "sqlguard.%s outside a package-level declaration; templates are declared once, at package level", name)
+				} else if tv := c.info.Types[call.Args[0]]; tv.Value == nil {
+					report(call.Args[0].Pos(), "sqlguard.%s text is not a constant", name)
+				}
+				return true
+			}
+			sel, ok := call.Fun.(*ast.SelectorExpr)
+			if !ok || !isSQLMethod(c.info.Selections[sel]) {
+				return true
+			}
+			i := queryArg[sel.Sel.Name]
+			if i >= len(call.Args) {
+				return true
+			}
+			arg := call.Args[i]
+			if values, ok := c.constants(arg); ok {
+				for _, v := range values {
+					statements[sqlguard.Normalize(v)] = true
+				}
+				return true
+			}
+			if c.isFormat(arg) || c.sqlguardFunc(arg) == "Explain" {
+				return true
+			}
+			report(arg.Pos(), "%s statement is not a constant; use query arguments for values, or a sqlguard.Template for statements naming a schema or another part fixed when the server starts",
+				sel.Sel.Name)
+			return true
+		})
+	}
+	return problems
+}
+
+// isSQLMethod reports whether s selects a statement-taking method of
+// sql.DB, sql.Tx or sql.Conn.
+func isSQLMethod(s *types.Selection) bool {
+	if s == nil || s.Kind() != types.MethodVal {
+		return false
+	}
+	if _, ok := queryArg[s.Obj().Name()]; !ok {
+		return false
+	}
+	recv := s.Recv()
+	if p, ok := recv.(*types.Pointer); ok {
+		recv = p.Elem()
+	}
+	named, ok := recv.(*types.Named)
+	if !ok || named.Obj().Pkg() == nil || named.Obj().Pkg().Path() != "database/sql" {
+		return false
+	}
+	switch named.Obj().Name() {
+	case "DB", "Tx", "Conn":
+		return true
+	}
+	return false
+}
+
+// sqlguardFunc returns the name of the sqlguard function e calls, or "".
+func (c *checker) sqlguardFunc(e ast.Expr) string {
+	call, ok := e.(*ast.CallExpr)
+	if !ok {
+		return ""
+	}
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok {
+		return ""
+	}
+	fn, ok := c.info.Uses[sel.Sel].(*types.Func)
+	if !ok || fn.Pkg() == nil || fn.Pkg().Path() != module+"/sqlguard" || fn.Type().(*types.Signature).Recv() != nil {
+		return ""
+	}
+	return fn.Name()
+}
+
+// isFormat reports whether e calls the Format method of a
+// sqlguard.Template.
+func (c *checker) isFormat(e ast.Expr) bool {
+	call, ok := e.(*ast.CallExpr)
+	if !ok {
+		return false
+	}
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok {
+		return false
+	}
+	s := c.info.Selections[sel]
+	if s == nil || s.Kind() != types.MethodVal || s.Obj().Name() != "Format" {
+		return false
+	}
+	recv := s.Recv()
+	if p, ok := recv.(*types.Pointer); ok {
+		recv = p.Elem()
+	}
+	named, ok := recv.(*types.Named)
+	return ok && named.Obj().Pkg() != nil && named.Obj().Pkg().Path() == module+"/sqlguard" && named.Obj().Name() == "Template"
+}
+
+// render writes the catalog source.
+func render(statements map[string]bool) []byte {
+	sorted := make([]string, 0, len(statements))
+	for s := range statements {
+		sorted = append(sorted, s)
+	}
+	sort.Strings(sorted)
+
+	var b bytes.Buffer
+	b.WriteString("// Code generated by cmd/sqlcheck; DO NOT EDIT.\n\npackage sqlguard\n\n")
+	b.WriteString("// statements are the constant statements the module passes to\n// database/sql, normalized.\n")
+	b.WriteString("var statements = []string{\n")
+	for _, s := range sorted {
+		b.WriteString("\t" + strconv.Quote(s) + ",\n")
+	}
+	b.WriteString("}\n")
+	src, err := format.Source(b.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+	return src
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const source = `package example
+
+import (
+	"database/sql"
+	"fmt"
+	"naevis/sqlguard"
+)
+
+const countSQL = "SELECT COUNT(*) FROM items;"
+
+var schema = []string{
+	"CREATE TABLE IF NOT EXISTS items (id INTEGER);",
+	"CREATE INDEX IF NOT EXISTS items_id ON items (id);",
+}
+
+var groups = [][]string{schema, {"DELETE FROM items;"}}
+
+var mutable = []string{"SELECT 1;"}
+
+var (
+	schemaSQL = sqlguard.NewSchemaTemplate("SELECT COUNT(*) FROM %s.items;")
+	named     = "SELECT name FROM %s;"
+	badSQL    = sqlguard.NewTemplate(named)
+)
+
+func run(db *sql.DB, table, where string) {
+	db.Query(countSQL)
+	for _, stmt := range schema {
+		db.Exec(stmt)
+	}
+	for _, group := range groups {
+		for _, stmt := range group {
+			db.Exec(stmt)
+		}
+	}
+	mutable[0] = where
+	for _, stmt := range mutable {
+		db.Exec(stmt)
+	}
+	db.Query(schemaSQL.Format("main"))
+	db.Query(sqlguard.Explain(countSQL))
+	db.Query(fmt.Sprintf("SELECT * FROM %s WHERE %s;", table, where))
+	db.Query("SELECT * FROM items WHERE " + where)
+	local := sqlguard.NewTemplate("SELECT id FROM %s;")
+	db.Query(local.Format(table))
+}
+`
+
+func TestCheck(t *testing.T) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "example.go", source, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statements := make(map[string]bool)
+	problems, err := check(fset, importer.ForCompiler(fset, "source", nil), "naevis/example", []*ast.File{f}, statements)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for s := range statements {
+		got = append(got, s)
+	}
+	slices.Sort(got)
+	want := []string{
+		"CREATE INDEX IF NOT EXISTS items_id ON items (id);",
+		"CREATE TABLE IF NOT EXISTS items (id INTEGER);",
+		"DELETE FROM items;",
+		"SELECT COUNT(*) FROM items;",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("catalogued %q, want %q", got, want)
+	}
+
+	// Problems are reported by line.
+	var lines []string
+	for _, p := range problems {
+		pos, _, _ := strings.Cut(p, ": ")
+		lines = append(lines, pos)
+	}
+	wantLines := []string{
+		"example.go:23:35", // a template text that is not a constant
+		"example.go:38:11", // a slice assigned to
+		"example.go:42:11", // a statement built with Sprintf
+		"example.go:43:11", // or concatenated
+		"example.go:44:11", // a template declared in a function
+	}
+	if !slices.Equal(lines, wantLines) {
+		t.Errorf("problems at %v, want %v:\n%s", lines, wantLines, strings.Join(problems, "\n"))
+	}
+}
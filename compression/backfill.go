@@ -0,0 +1,144 @@
+package compression
+
+import (
+	"context"
+	"database/sql"
+	"expvar"
+	"log"
+	"naevis/routing"
+	"naevis/sqlguard"
+	"time"
+)
+
+// backfillBatch is how many rows the backfill reads at a time.
+const backfillBatch = 500
+
+// backfillPause is the pause between batches, which leaves room for
+// ingest writes.
+const backfillPause = 100 * time.Millisecond
+
+// metrics counts the rows the backfill compressed and the bytes it saved,
+// published under "compression" in expvar.
+var metrics = expvar.NewMap("compression")
+
+// Backfill compresses large values written before compression was
+// enabled: events.additional_info, in every database events are routed
+// to, and entity_documents.body.
+type Backfill struct {
+	db *sql.DB
+}
+
+// Statements on the events of the schema %s.
+var (
+	uncompressedSQL = sqlguard.NewSchemaTemplate(`
+	SELECT id, 0, additional_info FROM %s.event_rows
+	WHERE id > ? AND typeof(additional_info) = 'text' AND length(additional_info) >= ?
+	ORDER BY id LIMIT ?;`)
+	compressSQL = sqlguard.NewSchemaTemplate(`UPDATE %s.event_rows SET additional_info = ? WHERE id = ?;`)
+)
+
+// NewBackfill creates a backfill job.
+func NewBackfill(db *sql.DB) *Backfill {
+	return &Backfill{db: db}
+}
+
+// Run compresses every eligible row once, stopping early when ctx is
+// cancelled.
+func (b *Backfill) Run(ctx context.Context) {
+	if minSize.Load() <= 0 {
+		return
+	}
+	for _, schema := range routing.Schemas() {
+		b.run(ctx, "events", schema)
+	}
+	b.run(ctx, "entity_documents", routing.Main)
+}
+
+// run compresses the eligible rows of table in schema and logs the outcome.
+func (b *Backfill) run(ctx context.Context, table, schema string) {
+	n, err := b.table(ctx, table, schema)
+	if err != nil {
+		log.Printf("Error compressing %s: %v", table, err)
+	}
+	if n > 0 {
+		log.Printf("Compressed %d %s rows", n, table)
+	}
+}
+
+// table compresses the eligible rows of table in schema, returning how
+// many it compressed.
+func (b *Backfill) table(ctx context.Context, table, schema string) (int, error) {
+	var after int64
+	total := 0
+	for {
+		rows, err := b.query(table, schema, after)
+		if err != nil {
+			return total, err
+		}
+		type row struct {
+			id      int64
+			version int64
+			value   string
+		}
+		var batch []row
+		for rows.Next() {
+			var r row
+			if err := rows.Scan(&r.id, &r.version, &r.value); err != nil {
+				rows.Close()
+				return total, err
+			}
+			batch = append(batch, r)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil || len(batch) == 0 {
+			return total, err
+		}
+
+		for _, r := range batch {
+			after = r.id
+			packed, err := Text(r.value).Value()
+			if err != nil {
+				return total, err
+			}
+			blob, ok := packed.([]byte)
+			if !ok {
+				continue
+			}
+			if err := b.update(table, schema, r.id, r.version, blob); err != nil {
+				return total, err
+			}
+			total++
+			metrics.Add(table, 1)
+			metrics.Add("saved_bytes", int64(len(r.value)-len(blob)))
+		}
+
+		select {
+		case <-ctx.Done():
+			return total, ctx.Err()
+		case <-time.After(backfillPause):
+		}
+	}
+}
+
+// query lists the uncompressed values of table after the given rowid.
+func (b *Backfill) query(table, schema string, after int64) (*sql.Rows, error) {
+	if table == "events" {
+		return b.db.Query(uncompressedSQL.Format(schema), after, minSize.Load(), backfillBatch)
+	}
+	return b.db.Query(`
+	SELECT rowid, version, body FROM entity_documents
+	WHERE rowid > ? AND typeof(body) = 'text' AND length(body) >= ?
+	ORDER BY rowid LIMIT ?;`, after, minSize.Load(), backfillBatch)
+}
+
+// update stores a compressed value. A document changed since it was read
+// keeps its new body.
+func (b *Backfill) update(table, schema string, id, version int64, blob []byte) error {
+	var err error
+	if table == "events" {
+		_, err = b.db.Exec(compressSQL.Format(schema), blob, id)
+	} else {
+		_, err = b.db.Exec(`UPDATE entity_documents SET body = ? WHERE rowid = ? AND version = ?;`, blob, id, version)
+	}
+	return err
+}
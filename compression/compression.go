@@ -0,0 +1,70 @@
+// Package compression stores large text columns zstd-compressed. Text
+// values of at least the minimum size are written as compressed BLOBs and
+// decompressed when scanned; smaller values stay plain TEXT, so existing
+// rows and other readers of short values are unaffected.
+package compression
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// magic starts every zstd frame.
+var magic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+var (
+	minSize atomic.Int64
+
+	encoder, _ = zstd.NewWriter(nil)
+	decoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+)
+
+// SetMinSize compresses values of at least n bytes from now on. Zero or
+// less stops compressing; values already compressed are still read.
+func SetMinSize(n int) {
+	minSize.Store(int64(n))
+}
+
+// Text is a string column that is compressed when large.
+type Text string
+
+// Value implements driver.Valuer. Values that do not shrink are stored as
+// they are.
+func (t Text) Value() (driver.Value, error) {
+	n := minSize.Load()
+	if n <= 0 || int64(len(t)) < n {
+		return string(t), nil
+	}
+	packed := encoder.EncodeAll([]byte(t), nil)
+	if len(packed) >= len(t) {
+		return string(t), nil
+	}
+	return packed, nil
+}
+
+// Scan implements sql.Scanner, decompressing BLOBs written by Value.
+func (t *Text) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		*t = ""
+	case string:
+		*t = Text(v)
+	case []byte:
+		if !bytes.HasPrefix(v, magic) {
+			*t = Text(v)
+			return nil
+		}
+		plain, err := decoder.DecodeAll(v, nil)
+		if err != nil {
+			return fmt.Errorf("compression: %w", err)
+		}
+		*t = Text(plain)
+	default:
+		return fmt.Errorf("compression: cannot scan %T into Text", src)
+	}
+	return nil
+}
@@ -0,0 +1,748 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Config holds the server settings loaded from a JSON file.
+type Config struct {
+	// Sampling lists the per entity_type/action sampling rules.
+	Sampling []SampleRule `json:"sampling"`
+	// RollupInterval is how often the roll-up tables are refreshed.
+	RollupInterval Duration `json:"rollup_interval"`
+	// Mongo configures the MongoDB connection and exposed collections.
+	Mongo Mongo `json:"mongo"`
+	// TailFiles lists append-only NDJSON files ingested as change sources.
+	TailFiles []string `json:"tail_files"`
+	// PGLogical lists PostgreSQL replication slots ingested as change
+	// sources.
+	PGLogical []PGLogical `json:"pg_logical"`
+	// FileDrop configures ingestion of files dropped into a directory.
+	FileDrop FileDrop `json:"file_drop"`
+	// SFTP lists partner servers whose files are pulled into FileDrop.Dir.
+	SFTP []SFTPPartner `json:"sftp"`
+	// MailIn configures the inbound SMTP listener.
+	MailIn MailIn `json:"mail_in"`
+	// SMTP configures outbound owner notifications.
+	SMTP SMTP `json:"smtp"`
+	// Push configures FCM and APNs push notifications.
+	Push Push `json:"push"`
+	// Webhooks lists endpoints sent CloudEvents when entities change.
+	Webhooks []Webhook `json:"webhooks"`
+	// Auth configures user accounts and access tokens.
+	Auth Auth `json:"auth"`
+	// Trending configures the trending entities ranking.
+	Trending Trending `json:"trending"`
+	// Related configures the related entities batch job.
+	Related Related `json:"related"`
+	// Flags are the default feature flags, keyed by name. Flags set
+	// through /admin/flags override them.
+	Flags map[string]Flag `json:"flags"`
+	// Attachments configures binary attachments referenced by events.
+	Attachments Attachments `json:"attachments"`
+	// Signatures configures HTTP message signatures from partners.
+	Signatures Signatures `json:"signatures"`
+	// Headers configures the security headers set on responses.
+	Headers Headers `json:"headers"`
+	// Quotas caps the storage used by entity types.
+	Quotas Quotas `json:"quotas"`
+	// Tiering moves old events into a cold database file.
+	Tiering Tiering `json:"tiering"`
+	// Databases stores the events of some entity types in separate
+	// database files.
+	Databases []Database `json:"databases"`
+	// Shards spreads tenants across server instances.
+	Shards Shards `json:"shards"`
+	// Gossip discovers the instances sharing tenants.
+	Gossip Gossip `json:"gossip"`
+	// RateLimit caps request rates across the cluster.
+	RateLimit RateLimit `json:"rate_limit"`
+	// Idempotency deduplicates retried ingest requests.
+	Idempotency Idempotency `json:"idempotency"`
+	// Dedup skips events posted with the same content as a recent one.
+	Dedup Dedup `json:"dedup"`
+	// AsyncIngest stores events posted to /event in the background.
+	AsyncIngest AsyncIngest `json:"async_ingest"`
+	// Costs attributes resource use to tenants for chargeback.
+	Costs Costs `json:"costs"`
+	// SLA sets per-tenant ingest latency targets.
+	SLA SLA `json:"sla"`
+	// Compression configures zstd compression of large text columns.
+	Compression Compression `json:"compression"`
+	// Planner configures ANALYZE runs and query plan checks.
+	Planner Planner `json:"planner"`
+	// SQLGuard is "audit" (the default) to log SQL statements missing
+	// from the statement catalog, "enforce" to reject them, or "off".
+	SQLGuard string `json:"sql_guard"`
+	// TCPFallback also serves HTTP/1.1 and HTTP/2 over TCP on the same
+	// port, for clients that cannot reach UDP.
+	TCPFallback bool `json:"tcp_fallback"`
+	// IDs configures the entity IDs generated for events posted without
+	// one.
+	IDs IDs `json:"ids"`
+	// Validation restricts the entity types, actions and sources events
+	// may have.
+	Validation Validation `json:"validation"`
+	// MaxBodyBytes caps the JSON event posted to /event or put to
+	// /event/{ID}, and the hits posted to /track; larger bodies get 413.
+	// Defaults to 1 MiB.
+	MaxBodyBytes int64 `json:"max_body_bytes"`
+	// Visibility limits response fields to some roles.
+	Visibility Visibility `json:"visibility"`
+	// Public opens reads of some entity types to unauthenticated callers.
+	Public Public `json:"public"`
+	// Standby keeps a warm standby of the instance's events.
+	Standby Standby `json:"standby"`
+	// Recovery checks the database files at startup.
+	Recovery Recovery `json:"recovery"`
+	// Operations runs exports, imports, reindexes and replays in the
+	// background.
+	Operations Operations `json:"operations"`
+	// Storage names the driver events are stored with. Defaults to
+	// "sqlite", the server's database; "postgres" stores them in the
+	// PostgreSQL database at StorageDSN. Other drivers cannot be used
+	// with the standby, tiering or quotas, which read the SQLite database.
+	Storage    string `json:"storage"`
+	StorageDSN string `json:"storage_dsn"`
+	// SQLite tunes the connections to the SQLite databases.
+	SQLite SQLite `json:"sqlite"`
+	// Regions steers clients to the nearest healthy region.
+	Regions Regions `json:"regions"`
+}
+
+// Regions lists the regions of a multi-region deployment, which GET
+// /regions ranks for each client, nearest healthy region first. Self
+// names this instance's region. Every Interval (30s by default) each
+// other region's /health is polled.
+type Regions struct {
+	Self     string   `json:"self"`
+	Regions  []Region `json:"regions"`
+	Interval Duration `json:"interval"`
+}
+
+// Region is a region clients reach at URL, such as
+// "https://eu.quickie.example:4433". Location, "LAT,LNG", ranks it by
+// distance from clients sending theirs. Clients with an address in
+// Networks, CIDRs such as "10.1.0.0/16", are nearest to it whatever their
+// location.
+type Region struct {
+	Name     string   `json:"name"`
+	URL      string   `json:"url"`
+	Location string   `json:"location"`
+	Networks []string `json:"networks"`
+}
+
+// SQLite sets the pragmas of every connection to the database files.
+// JournalMode is "wal" by default, so reads go on while events are
+// written; "delete", "truncate" and "persist" are SQLite's rollback
+// journals. Synchronous is "off", "normal", "full" (SQLite's default) or
+// "extra"; "normal" is safe with WAL and writes faster. Connections wait
+// up to BusyTimeout (5s by default) for each other's writes. CacheSizeKiB
+// is each connection's page cache; by default it is sized to the
+// container's memory, or SQLite's 2 MiB without a memory limit. In-memory
+// databases keep their own journal.
+type SQLite struct {
+	JournalMode  string   `json:"journal_mode"`
+	Synchronous  string   `json:"synchronous"`
+	BusyTimeout  Duration `json:"busy_timeout"`
+	CacheSizeKiB int64    `json:"cache_size_kib"`
+}
+
+// Operations runs long tasks through /operations. Outputs, such as export
+// files, are written to Dir (default "operations"). An ended operation,
+// its result and its output are kept for Retention (24h by default).
+type Operations struct {
+	Dir       string   `json:"dir"`
+	Retention Duration `json:"retention"`
+}
+
+// Recovery checks every database file before the server opens it: the
+// WAL must checkpoint cleanly and the file must pass PRAGMA quick_check,
+// or integrity_check with FullCheck. A corrupt file is quarantined, moved
+// aside under a ".corrupt-" name, and replaced with the newest intact
+// backup of it in Backups, a directory of copies named after the files
+// (events.db, or events.db followed by a dot and anything). Without one
+// the server refuses to start. See docs/recovery.md.
+type Recovery struct {
+	Backups   string `json:"backups"`
+	FullCheck bool   `json:"full_check"`
+}
+
+// Standby keeps a warm standby. An instance with Token serves the change
+// feed of its events at /replication/changes to callers presenting it.
+// One with Primary, the base URL of such an instance, is a standby: it
+// applies the feed every Interval and refuses writes until it is promoted,
+// through POST /admin/standby/promote or, when PromoteAfter is set, once
+// the feed has failed for that long. Changes stay in the feed for
+// Retention; a standby further behind must be seeded again. See
+// docs/standby.md.
+type Standby struct {
+	Primary      string   `json:"primary"`
+	Token        string   `json:"token"`
+	Interval     Duration `json:"interval"`
+	PromoteAfter Duration `json:"promote_after"`
+	Retention    Duration `json:"retention"`
+}
+
+// Visibility hides JSON response fields from callers whose role may not
+// see them. Fields maps a field name, matched at any depth and inside
+// additional_info, to the roles that see it: "user", "operator" or
+// "admin". Everyone else, unauthenticated callers included, gets
+// responses without the field. Operators and admins count as such only
+// when signed in with a second factor, as on the admin routes.
+type Visibility struct {
+	Fields map[string][]string `json:"fields"`
+}
+
+// Public lets unauthenticated callers, such as a public website, search,
+// complete, read and list the related entities, documents and trends of
+// EntityTypes, with contact details and internal IDs removed from the
+// responses; Redact names more JSON fields to remove. Signed-in callers
+// get the same redacted responses unless they are operators or admins
+// with a second factor. Those endpoints then need an access token for
+// other entity types and for writes, and so does ingest, except the /t
+// and /track analytics beacons. Origins lists the websites whose browsers
+// may call, for CORS. Responses to crawlers may be kept by shared caches for
+// CrawlerMaxAge. Public mode is off when EntityTypes is empty.
+type Public struct {
+	EntityTypes   []string `json:"entity_types"`
+	Redact        []string `json:"redact"`
+	Origins       []string `json:"origins"`
+	CrawlerMaxAge Duration `json:"crawler_max_age"`
+}
+
+// Headers adjusts the built-in security headers. Routes maps route
+// groups to headers to set, or with an empty value to remove; "" is every
+// route and a route ending in a slash covers every path below it.
+// HSTSMaxAge is the Strict-Transport-Security max-age sent by the TCP
+// fallback listener; zero disables it.
+type Headers struct {
+	Routes     map[string]map[string]string `json:"routes"`
+	HSTSMaxAge Duration                     `json:"hsts_max_age"`
+}
+
+// Signatures verifies RFC 9421 HTTP message signatures. Requests to the
+// Required routes must be signed; a route ending in a slash covers every
+// path below it. Keys maps key IDs to partner keys; more can be
+// registered through /admin/signing-keys. A signature must have been
+// created within MaxAge of the server's clock and carry a nonce, which
+// cannot be reused with the same key.
+type Signatures struct {
+	Required []string              `json:"required"`
+	Keys     map[string]SigningKey `json:"keys"`
+	MaxAge   Duration              `json:"max_age"`
+}
+
+// SigningKey is a partner's key for Algorithm, one of "ed25519",
+// "ecdsa-p256-sha256", "rsa-pss-sha512" and "rsa-v1_5-sha256" with a PEM
+// public key, or "hmac-sha256" with a base64 shared secret.
+type SigningKey struct {
+	Partner   string `json:"partner"`
+	Algorithm string `json:"algorithm"`
+	Key       string `json:"key"`
+}
+
+// Attachments stores uploaded blobs under Dir, or in an S3 bucket when
+// S3.Bucket is set; they are disabled when neither is. Blobs are at most
+// MaxSize bytes. Every GCInterval, blobs no event references any more are
+// deleted once they are older than Grace, which leaves time to send the
+// event after uploading; resumable uploads idle for Grace are dropped.
+// Partial resumable uploads are kept in UploadDir, which defaults to
+// Dir/uploads or the system temporary directory.
+type Attachments struct {
+	Dir        string   `json:"dir"`
+	UploadDir  string   `json:"upload_dir"`
+	S3         S3       `json:"s3"`
+	MaxSize    int64    `json:"max_size"`
+	Grace      Duration `json:"grace"`
+	GCInterval Duration `json:"gc_interval"`
+}
+
+// S3 is an S3-compatible bucket. Endpoint defaults to AWS in Region; set
+// it for other providers. Keys are stored under Prefix.
+type S3 struct {
+	Endpoint        string `json:"endpoint"`
+	Region          string `json:"region"`
+	Bucket          string `json:"bucket"`
+	Prefix          string `json:"prefix"`
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+}
+
+// Flag turns a feature on for everyone when Enabled, otherwise for the
+// listed Tenants and for Percent (0-100) of callers.
+type Flag struct {
+	Enabled bool     `json:"enabled"`
+	Tenants []string `json:"tenants"`
+	Percent int      `json:"percent"`
+}
+
+// Related counts entities seen together in user sessions over the last
+// Window. A session ends after SessionGap without events. The counts are
+// recomputed every Interval.
+type Related struct {
+	Interval   Duration `json:"interval"`
+	Window     Duration `json:"window"`
+	SessionGap Duration `json:"session_gap"`
+}
+
+// Trending scores entities by their events over the last Window, each
+// weighted down by half every HalfLife. Scores are recomputed every
+// Interval.
+type Trending struct {
+	Interval Duration `json:"interval"`
+	Window   Duration `json:"window"`
+	HalfLife Duration `json:"half_life"`
+}
+
+// Auth signs access tokens with JWTSecret. They expire after
+// AccessTokenTTL. Sessions used to refresh them expire after
+// RefreshTokenTTL without use; every refresh extends that window.
+// BootstrapAdmin is the email of the account made the first admin, at
+// startup or when it registers, as long as there is no admin yet; only
+// admins may change roles after that.
+type Auth struct {
+	JWTSecret       string   `json:"jwt_secret"`
+	AccessTokenTTL  Duration `json:"access_token_ttl"`
+	RefreshTokenTTL Duration `json:"refresh_token_ttl"`
+	BootstrapAdmin  string   `json:"bootstrap_admin"`
+}
+
+// Push enables each platform whose credentials are set.
+type Push struct {
+	FCM  FCM  `json:"fcm"`
+	APNs APNs `json:"apns"`
+}
+
+// FCM authenticates with a Google service account JSON file.
+type FCM struct {
+	CredentialsFile string `json:"credentials_file"`
+}
+
+// APNs authenticates with a .p8 signing key. Topic is the app bundle ID.
+type APNs struct {
+	KeyFile string `json:"key_file"`
+	KeyID   string `json:"key_id"`
+	TeamID  string `json:"team_id"`
+	Topic   string `json:"topic"`
+	Sandbox bool   `json:"sandbox"`
+}
+
+// Webhook is an endpoint sent every change to EntityTypes, or to every
+// entity type when empty. Deliveries are signed with Secret.
+type Webhook struct {
+	URL         string   `json:"url"`
+	Secret      string   `json:"secret"`
+	EntityTypes []string `json:"entity_types"`
+}
+
+// SMTP is the relay used to email entity owners. Notifications are
+// disabled when Addr is empty. BaseURL is the public address of this
+// server, used in unsubscribe links.
+type SMTP struct {
+	Addr        string `json:"addr"`
+	From        string `json:"from"`
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	BaseURL     string `json:"base_url"`
+	TemplateDir string `json:"template_dir"`
+}
+
+// MailIn accepts structured mail on Addr, e.g. "127.0.0.1:2525". It is
+// disabled when Addr is empty. SubjectPattern is a regular expression
+// whose named groups (entity_type, action, entity_id, item_id, item_type,
+// source) fill the event when the message carries no JSON.
+type MailIn struct {
+	Addr           string   `json:"addr"`
+	SubjectPattern string   `json:"subject_pattern"`
+	AllowedSenders []string `json:"allowed_senders"`
+}
+
+// FileDrop watches Dir for NDJSON and CSV files every Interval. It is
+// disabled when Dir is empty.
+type FileDrop struct {
+	Dir      string   `json:"dir"`
+	Interval Duration `json:"interval"`
+}
+
+// Mongo configures the MongoDB connection. Mongo-backed features are
+// disabled when URI is empty.
+type Mongo struct {
+	URI         string            `json:"uri"`
+	Database    string            `json:"database"`
+	Collections []MongoCollection `json:"collections"`
+	// Watch lists collections whose changes are ingested as events.
+	Watch []MongoWatch `json:"watch"`
+}
+
+// MongoWatch materializes the change stream of Collection as events of
+// EntityType, which defaults to the collection name.
+type MongoWatch struct {
+	Collection string `json:"collection"`
+	EntityType string `json:"entity_type"`
+}
+
+// PGLogical materializes the changes of Tables as events. They are read
+// through the logical replication slot Slot of the database at DSN, which
+// must use the wal2json output plugin. Tables maps schema-qualified table
+// names to entity types; changes to other tables are skipped. Key names
+// the column holding entity IDs, "id" by default.
+type PGLogical struct {
+	DSN    string            `json:"dsn"`
+	Slot   string            `json:"slot"`
+	Tables map[string]string `json:"tables"`
+	Key    string            `json:"key"`
+}
+
+// MongoCollection exposes a collection through /mongo/{name} to signed-in
+// callers with at least Role, "user" by default. Only the listed Fields
+// are returned and may be used as filters. Types declares the BSON type
+// filter values are converted to, by field: "string", the default,
+// "int", "double", "bool", "objectid" or "date" (RFC 3339). When
+// OwnerField is set, callers other than admins only see the documents
+// whose OwnerField holds their user ID.
+type MongoCollection struct {
+	Name       string            `json:"name"`
+	Fields     []string          `json:"fields"`
+	Types      map[string]string `json:"types"`
+	Role       string            `json:"role"`
+	OwnerField string            `json:"owner_field"`
+}
+
+// Duration is a time.Duration written as a string such as "90s" or "5m".
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalJSON parses a duration string.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// MarshalJSON writes the duration as a string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// Planner runs ANALYZE every Interval, reading at most AnalysisLimit rows
+// per index when positive, then checks the plans of the statement catalog
+// for changes.
+type Planner struct {
+	Interval      Duration `json:"interval"`
+	AnalysisLimit int      `json:"analysis_limit"`
+}
+
+// Compression stores event additional_info and entity documents of at
+// least MinSize bytes zstd-compressed; zero disables it. Existing rows are
+// compressed by a backfill at startup.
+type Compression struct {
+	MinSize int `json:"min_size"`
+}
+
+// Tiering moves events older than After from the hot database into the
+// SQLite file at ColdPath, BatchSize rows at a time every Interval. It is
+// disabled when ColdPath is empty. After should exceed the windows of the
+// trending and related jobs, which only read hot events.
+type Tiering struct {
+	ColdPath  string   `json:"cold_path"`
+	After     Duration `json:"after"`
+	Interval  Duration `json:"interval"`
+	BatchSize int      `json:"batch_size"`
+}
+
+// Database stores the events of EntityTypes in the SQLite file at Path,
+// attached as Name, so their writes do not contend with the main
+// database. Name must be a lowercase identifier and should not change, as
+// event ids are allocated per name. Routed events are not moved to the
+// cold tier.
+type Database struct {
+	Name        string   `json:"name"`
+	Path        string   `json:"path"`
+	EntityTypes []string `json:"entity_types"`
+}
+
+// Shards assigns each tenant to the instance that stores its events.
+// Instances maps instance names to base URLs, such as
+// "https://eu-1.quickie.example:4433", and Tenants maps tenants to
+// instance names; Default owns the other tenants, which are spread over
+// the instances by consistent hashing when it is empty. Self names this
+// instance, and sharding is off when it is empty. Coordinator is a URL
+// serving the same map as JSON, polled every Interval; it replaces the
+// map from the config. Ingest requests for another instance's tenant are
+// redirected with 307, or forwarded to it when Proxy is set. With gossip
+// on, Instances may be left empty, and the map with the highest Version
+// spreads to every instance.
+type Shards struct {
+	Self        string            `json:"self"`
+	Instances   map[string]string `json:"instances"`
+	Tenants     map[string]string `json:"tenants"`
+	Default     string            `json:"default"`
+	Coordinator string            `json:"coordinator"`
+	Interval    Duration          `json:"interval"`
+	Proxy       bool              `json:"proxy"`
+	Version     int64             `json:"version"`
+}
+
+// Gossip finds the other instances through the memberlist gossip
+// protocol, listening on Bind ("host:port") and advertising Advertise when
+// set. Join lists instances to contact first; one reachable instance is
+// enough. Key, a base64 AES key of 16, 24 or 32 bytes, encrypts the
+// gossip. URL is this instance's base URL, told to the others for
+// forwarding. Discovery is off when Bind is empty.
+type Gossip struct {
+	Bind      string   `json:"bind"`
+	Advertise string   `json:"advertise"`
+	Join      []string `json:"join"`
+	Key       string   `json:"key"`
+	URL       string   `json:"url"`
+}
+
+// RateLimit caps request rates. Instances send their counts to the peers
+// found by gossip every Sync, so limits hold across the cluster, give or
+// take the requests of one Sync; without gossip they hold per instance.
+type RateLimit struct {
+	Sync  Duration   `json:"sync"`
+	Rules []RateRule `json:"rules"`
+}
+
+// RateRule allows Limit requests per Window for each value of Key:
+// "tenant", "ip", "user" (the authenticated user, or the IP of anonymous
+// requests) or "crawler" (the crawler, whatever its IP). It applies to
+// paths starting with one of Paths, or every path when empty, and to the
+// requests of Agent: "crawler", "human", or either when empty. Key
+// "crawler" needs Agent "crawler". Name identifies the rule across
+// instances.
+type RateRule struct {
+	Name   string   `json:"name"`
+	Key    string   `json:"key"`
+	Limit  int64    `json:"limit"`
+	Window Duration `json:"window"`
+	Paths  []string `json:"paths"`
+	Agent  string   `json:"agent"`
+}
+
+// Idempotency keeps the responses to ingest requests sent with an
+// Idempotency-Key for TTL and replays them to retries. Expired keys are
+// deleted every Interval. With sharding on, keys are kept by the instance
+// owning the tenant, which every retry reaches.
+type Idempotency struct {
+	TTL      Duration `json:"ttl"`
+	Interval Duration `json:"interval"`
+}
+
+// Dedup skips events posted to /event whose content matches an event of
+// the tenant stored within Window. It is disabled when Window is zero.
+type Dedup struct {
+	Window Duration `json:"window"`
+}
+
+// AsyncIngest, when Workers is positive, has POST /event answer 202 once
+// a JSON event is validated and queued, while Workers goroutines enrich
+// and store queued events. A negative Workers runs one per CPU the
+// process may use, its container's quota included. Queue bounds the events waiting, 1000 by
+// default; events posted while it is full get 503. Queued events are lost
+// if the instance stops.
+type AsyncIngest struct {
+	Workers int `json:"workers"`
+	Queue   int `json:"queue"`
+}
+
+// Costs saves each tenant's counted usage and measures its storage every
+// Interval.
+type Costs struct {
+	Interval Duration `json:"interval"`
+}
+
+// SLA tracks, per tenant, the latency from receiving an event to storing
+// it and to delivering its push or email notifications, over the last
+// Window. Every Interval, a tenant whose latency at Percentile exceeds its
+// target is alerted on. Tenants maps tenants to their targets; the others
+// have Default. A zero target is not checked.
+type SLA struct {
+	Window     Duration             `json:"window"`
+	Interval   Duration             `json:"interval"`
+	Percentile float64              `json:"percentile"`
+	Default    SLATarget            `json:"default"`
+	Tenants    map[string]SLATarget `json:"tenants"`
+}
+
+// SLATarget is the latency a tenant's events should be stored and
+// delivered within.
+type SLATarget struct {
+	Stored    Duration `json:"stored"`
+	Delivered Duration `json:"delivered"`
+}
+
+// IDs configures entity ID generation. Scheme is "ulid" (the default),
+// "uuidv7", "snowflake", or "none" to store events posted without an
+// entity ID without one. Node, 0 to 1023, tells instances apart in
+// snowflake IDs; when zero it is derived from shards.self.
+type IDs struct {
+	Scheme string `json:"scheme"`
+	Node   int64  `json:"node"`
+}
+
+// Validation lists the entity types, actions and sources accepted in
+// events. An empty list accepts any value, and events without a source
+// are always accepted. The lists must include those of the events the
+// server records itself: experiment exposures ("experiment", "exposure")
+// and document changes ("created", "updated").
+type Validation struct {
+	EntityTypes []string `json:"entity_types"`
+	Actions     []string `json:"actions"`
+	Sources     []string `json:"sources"`
+}
+
+// Quotas lists per entity_type storage quotas, measured every Interval.
+type Quotas struct {
+	Interval    Duration `json:"interval"`
+	EntityTypes []Quota  `json:"entity_types"`
+}
+
+// Quota caps the events stored for EntityType at MaxRows rows and MaxBytes
+// bytes of event data; zero is unlimited. Action is what happens once the
+// quota is exceeded: "alert" (the default) logs it, "reject" refuses new
+// events of the type and "prune" deletes its oldest events.
+type Quota struct {
+	EntityType string `json:"entity_type"`
+	MaxRows    int64  `json:"max_rows"`
+	MaxBytes   int64  `json:"max_bytes"`
+	Action     string `json:"action"`
+}
+
+// SampleRule stores one in Rate events matching EntityType and Action.
+// An empty Action matches every action of the entity type.
+type SampleRule struct {
+	EntityType string `json:"entity_type"`
+	Action     string `json:"action"`
+	Rate       int    `json:"rate"`
+}
+
+// SFTPPartner is a partner SFTP server polled every Interval. Files in
+// RemoteDir matching Pattern (all ingestible files when empty) are
+// downloaded using the private key in KeyFile. The server's host key must
+// be listed in KnownHostsFile.
+type SFTPPartner struct {
+	Name           string   `json:"name"`
+	Host           string   `json:"host"`
+	User           string   `json:"user"`
+	KeyFile        string   `json:"key_file"`
+	KnownHostsFile string   `json:"known_hosts_file"`
+	RemoteDir      string   `json:"remote_dir"`
+	Pattern        string   `json:"pattern"`
+	Interval       Duration `json:"interval"`
+}
+
+// Load reads the configuration at path. A missing file is not an error and
+// yields the default configuration.
+func Load(path string) (Config, error) {
+	cfg := Config{
+		RollupInterval: Duration{5 * time.Minute},
+		FileDrop:       FileDrop{Interval: Duration{10 * time.Second}},
+		Trending: Trending{
+			Interval: Duration{5 * time.Minute},
+			Window:   Duration{72 * time.Hour},
+			HalfLife: Duration{12 * time.Hour},
+		},
+		Related: Related{
+			Interval:   Duration{time.Hour},
+			Window:     Duration{30 * 24 * time.Hour},
+			SessionGap: Duration{30 * time.Minute},
+		},
+		Auth: Auth{
+			AccessTokenTTL:  Duration{15 * time.Minute},
+			RefreshTokenTTL: Duration{30 * 24 * time.Hour},
+		},
+		Attachments: Attachments{
+			MaxSize:    32 << 20,
+			Grace:      Duration{24 * time.Hour},
+			GCInterval: Duration{time.Hour},
+		},
+		Signatures: Signatures{MaxAge: Duration{5 * time.Minute}},
+		Headers:    Headers{HSTSMaxAge: Duration{365 * 24 * time.Hour}},
+		Quotas:     Quotas{Interval: Duration{time.Minute}},
+		Tiering: Tiering{
+			After:     Duration{90 * 24 * time.Hour},
+			Interval:  Duration{time.Hour},
+			BatchSize: 1000,
+		},
+		Shards:       Shards{Interval: Duration{30 * time.Second}},
+		RateLimit:    RateLimit{Sync: Duration{time.Second}},
+		Idempotency:  Idempotency{TTL: Duration{24 * time.Hour}, Interval: Duration{time.Hour}},
+		Compression:  Compression{MinSize: 1024},
+		Planner:      Planner{Interval: Duration{6 * time.Hour}, AnalysisLimit: 1000},
+		AsyncIngest:  AsyncIngest{Queue: 1000},
+		Costs:        Costs{Interval: Duration{10 * time.Minute}},
+		SLA:          SLA{Window: Duration{5 * time.Minute}, Interval: Duration{time.Minute}, Percentile: 99},
+		MaxBodyBytes: 1 << 20,
+		Public:       Public{CrawlerMaxAge: Duration{10 * time.Minute}},
+		Standby:      Standby{Interval: Duration{time.Second}, Retention: Duration{24 * time.Hour}},
+		Operations:   Operations{Dir: "operations", Retention: Duration{24 * time.Hour}},
+		SQLite:       SQLite{JournalMode: "wal", BusyTimeout: Duration{5 * time.Second}},
+		Regions:      Regions{Interval: Duration{30 * time.Second}},
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, err
+	}
+	for i := range cfg.SFTP {
+		if cfg.SFTP[i].Interval.Duration <= 0 {
+			cfg.SFTP[i].Interval = Duration{15 * time.Minute}
+		}
+	}
+	if err := cfg.checkIntervals(); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// checkIntervals reports the first interval of a background job that is
+// not positive, as a ticker cannot run on it.
+func (cfg Config) checkIntervals() error {
+	for _, iv := range []struct {
+		name string
+		d    Duration
+	}{
+		{"rollup_interval", cfg.RollupInterval},
+		{"file_drop.interval", cfg.FileDrop.Interval},
+		{"trending.interval", cfg.Trending.Interval},
+		{"related.interval", cfg.Related.Interval},
+		{"attachments.gc_interval", cfg.Attachments.GCInterval},
+		{"quotas.interval", cfg.Quotas.Interval},
+		{"tiering.interval", cfg.Tiering.Interval},
+		{"shards.interval", cfg.Shards.Interval},
+		{"rate_limit.sync", cfg.RateLimit.Sync},
+		{"idempotency.interval", cfg.Idempotency.Interval},
+		{"costs.interval", cfg.Costs.Interval},
+		{"sla.interval", cfg.SLA.Interval},
+		{"planner.interval", cfg.Planner.Interval},
+		{"standby.interval", cfg.Standby.Interval},
+		{"regions.interval", cfg.Regions.Interval},
+	} {
+		if iv.d.Duration <= 0 {
+			return fmt.Errorf("config: %s must be positive, not %v", iv.name, iv.d.Duration)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,311 @@
+// Package costs attributes resource use to tenants for chargeback: the
+// events they write, the time spent serving their queries, the response
+// bytes sent to them and the bytes their stored events take up. Usage is
+// counted in memory and added to the month's totals in tenant_usage every
+// interval, when storage is measured too. Usage over HTTP is attributed
+// to the verified caller, see Payer, never to X-Tenant-ID, which any
+// caller can send.
+package costs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"log"
+	"naevis/accounts"
+	"naevis/apierror"
+	"naevis/routing"
+	"naevis/signatures"
+	"naevis/sqlguard"
+	"naevis/structs"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// storageSQL measures the bytes each tenant's events take up in a schema,
+// counted as the storage quotas count them.
+var storageSQL = sqlguard.NewSchemaTemplate(`
+SELECT tenant, IFNULL(SUM(IFNULL(length(entity_id), 0) + IFNULL(length(item_id), 0) + IFNULL(length(additional_info), 0)), 0)
+FROM %s.event_rows GROUP BY tenant;`)
+
+// counters is the usage of a tenant not yet added to tenant_usage.
+type counters struct {
+	writes, queryMicros, egress int64
+}
+
+// Meter counts the usage of each tenant.
+type Meter struct {
+	db *sql.DB
+	// skipStorage is set when events are stored outside db.
+	skipStorage bool
+
+	mu      sync.Mutex
+	pending map[string]*counters
+}
+
+// New creates a Meter.
+func New(db *sql.DB) *Meter {
+	return &Meter{db: db, pending: make(map[string]*counters)}
+}
+
+func (m *Meter) add(tenant string, fn func(c *counters)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := m.pending[tenant]
+	if c == nil {
+		c = &counters{}
+		m.pending[tenant] = c
+	}
+	fn(c)
+}
+
+// SkipStorage stops measuring the stored bytes, for events stored by a
+// driver other than SQLite, which measure would not see.
+func (m *Meter) SkipStorage() {
+	m.skipStorage = true
+}
+
+// Unattributed is the tenant usage is attributed to when the caller has
+// no verified identity.
+const Unattributed = "unattributed"
+
+// Payer returns who the usage of r is attributed to: the partner that
+// signed it, else the signed-in user as "user:ID", else Unattributed. It
+// must be called behind the middlewares that verify both.
+func Payer(r *http.Request) string {
+	if signer, ok := signatures.FromContext(r.Context()); ok {
+		return signer.Partner
+	}
+	if claims, ok := accounts.FromContext(r.Context()); ok {
+		return "user:" + strconv.FormatInt(claims.Subject, 10)
+	}
+	return Unattributed
+}
+
+// Wrote counts a stored event against its Payer, or its Tenant for
+// events that did not come in over HTTP.
+func (m *Meter) Wrote(event structs.Index) {
+	tenant := event.Payer
+	if tenant == "" {
+		tenant = event.Tenant
+	}
+	m.add(tenant, func(c *counters) { c.writes++ })
+}
+
+// Middleware counts the response bytes of every request, and the time
+// taken to serve GET requests as query time, against the request's Payer.
+func (m *Meter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		cw := &countingWriter{ResponseWriter: w}
+		next.ServeHTTP(cw, r)
+		elapsed := time.Since(start)
+		m.add(Payer(r), func(c *counters) {
+			c.egress += cw.n
+			if r.Method == http.MethodGet {
+				c.queryMicros += elapsed.Microseconds()
+			}
+		})
+	})
+}
+
+// countingWriter counts the bytes of a response body.
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *countingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Run adds the pending usage and, unless SkipStorage was called, the
+// measured storage to the month's totals every interval until ctx is cancelled.
+func (m *Meter) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := m.flush(); err != nil {
+			log.Printf("Error saving tenant usage: %v", err)
+		}
+		if !m.skipStorage {
+			if err := m.measure(); err != nil {
+				log.Printf("Error measuring tenant storage: %v", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// flush adds the pending usage to the current month's totals.
+func (m *Meter) flush() error {
+	m.mu.Lock()
+	pending := m.pending
+	m.pending = make(map[string]*counters)
+	m.mu.Unlock()
+
+	month := time.Now().UTC().Format("2006-01")
+	for tenant, c := range pending {
+		if _, err := m.db.Exec(`
+		INSERT INTO tenant_usage (month, tenant, writes, query_ms, egress_bytes) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (month, tenant) DO UPDATE SET
+			writes = writes + excluded.writes,
+			query_ms = query_ms + excluded.query_ms,
+			egress_bytes = egress_bytes + excluded.egress_bytes;`,
+			month, tenant, c.writes, float64(c.queryMicros)/1000, c.egress); err != nil {
+			// Keep what could not be saved for the next flush.
+			m.add(tenant, func(p *counters) {
+				p.writes += c.writes
+				p.queryMicros += c.queryMicros
+				p.egress += c.egress
+			})
+			return err
+		}
+	}
+	return nil
+}
+
+// measure records each tenant's stored bytes as the month's latest, and
+// its peak.
+func (m *Meter) measure() error {
+	storage := make(map[string]int64)
+	for _, schema := range routing.Schemas() {
+		rows, err := m.db.Query(storageSQL.Format(schema))
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var tenant string
+			var bytes int64
+			if err := rows.Scan(&tenant, &bytes); err != nil {
+				rows.Close()
+				return err
+			}
+			storage[tenant] += bytes
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	month := time.Now().UTC().Format("2006-01")
+	for tenant, bytes := range storage {
+		if _, err := m.db.Exec(`
+		INSERT INTO tenant_usage (month, tenant, storage_bytes, peak_storage_bytes) VALUES (?, ?, ?, ?)
+		ON CONFLICT (month, tenant) DO UPDATE SET
+			storage_bytes = excluded.storage_bytes,
+			peak_storage_bytes = MAX(peak_storage_bytes, excluded.storage_bytes);`,
+			month, tenant, bytes, bytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Usage is a tenant's usage in a month.
+type Usage struct {
+	Month            string  `json:"month"`
+	Tenant           string  `json:"tenant"`
+	Writes           int64   `json:"writes"`
+	QueryMS          float64 `json:"query_ms"`
+	EgressBytes      int64   `json:"egress_bytes"`
+	StorageBytes     int64   `json:"storage_bytes"`
+	PeakStorageBytes int64   `json:"peak_storage_bytes"`
+}
+
+// Report returns every tenant's usage in month, formatted as 2006-01.
+func (m *Meter) Report(month string) ([]Usage, error) {
+	rows, err := m.db.Query(`
+	SELECT month, tenant, writes, query_ms, egress_bytes, storage_bytes, peak_storage_bytes
+	FROM tenant_usage WHERE month = ? ORDER BY tenant;`, month)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	report := []Usage{}
+	for rows.Next() {
+		var u Usage
+		if err := rows.Scan(&u.Month, &u.Tenant, &u.Writes, &u.QueryMS, &u.EgressBytes, &u.StorageBytes, &u.PeakStorageBytes); err != nil {
+			return nil, err
+		}
+		report = append(report, u)
+	}
+	return report, rows.Err()
+}
+
+// AdminHandler handles GET /admin/costs?month=2006-01, which reports
+// every tenant's usage in the month, the current one by default, as JSON
+// or, with format=csv, as a CSV file. Usage counted since the last
+// interval is saved first.
+func (m *Meter) AdminHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apierror.Write(w, "Only GET requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	month := r.URL.Query().Get("month")
+	if month == "" {
+		month = time.Now().UTC().Format("2006-01")
+	}
+	if _, err := time.Parse("2006-01", month); err != nil {
+		apierror.Write(w, "month must be formatted as YYYY-MM", http.StatusBadRequest)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		apierror.Write(w, "format must be json or csv", http.StatusBadRequest)
+		return
+	}
+
+	if err := m.flush(); err != nil {
+		log.Printf("Error saving tenant usage: %v", err)
+	}
+	report, err := m.Report(month)
+	if err != nil {
+		apierror.Write(w, "Failed to load usage", http.StatusInternalServerError)
+		log.Printf("Error loading tenant usage: %v", err)
+		return
+	}
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="costs-`+month+`.csv"`)
+		w.WriteHeader(http.StatusOK)
+		out := csv.NewWriter(w)
+		out.Write([]string{"month", "tenant", "writes", "query_ms", "egress_bytes", "storage_bytes", "peak_storage_bytes"})
+		for _, u := range report {
+			out.Write([]string{
+				u.Month, u.Tenant, strconv.FormatInt(u.Writes, 10), strconv.FormatFloat(u.QueryMS, 'f', 3, 64),
+				strconv.FormatInt(u.EgressBytes, 10), strconv.FormatInt(u.StorageBytes, 10), strconv.FormatInt(u.PeakStorageBytes, 10),
+			})
+		}
+		out.Flush()
+		return
+	}
+
+	response, err := json.Marshal(report)
+	if err != nil {
+		apierror.Write(w, "Error encoding JSON", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
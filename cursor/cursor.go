@@ -0,0 +1,36 @@
+// Package cursor encodes the position of a page in a listing as an
+// opaque token. Listings ordered by a unique key hand out the key of the
+// last item of a page as the cursor of the next, and continue after it
+// with a keyset query: deep pages cost as much as the first, and events
+// added meanwhile do not shift later pages.
+package cursor
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+)
+
+// ErrInvalid is returned by Decode for a token it did not make.
+var ErrInvalid = errors.New("invalid cursor")
+
+// Encode returns the token of key, a value of a JSON-encodable type.
+func Encode(key any) string {
+	data, err := json.Marshal(key)
+	if err != nil {
+		panic("cursor: " + err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Decode decodes token into key, which Encode was given the value of.
+func Decode(token string, key any) error {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return ErrInvalid
+	}
+	if err := json.Unmarshal(data, key); err != nil {
+		return ErrInvalid
+	}
+	return nil
+}
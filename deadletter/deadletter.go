@@ -0,0 +1,282 @@
+// Package deadletter keeps events that could not be enriched or stored,
+// with the error, so they are not lost: admins list them, retry them once
+// the cause is fixed, or discard them.
+package deadletter
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"log"
+	"naevis/apierror"
+	"naevis/structs"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metrics counts events dead-lettered, retried successfully and
+// discarded, published under "dead_letters" in expvar.
+var metrics = expvar.NewMap("dead_letters")
+
+// Entry is a dead-lettered event. Stage is where it failed, such as
+// "enrich" or "store"; Attempts counts the admin retries that failed too.
+type Entry struct {
+	ID        int64         `json:"id"`
+	Tenant    string        `json:"tenant"`
+	Event     structs.Index `json:"event"`
+	Stage     string        `json:"stage"`
+	Error     string        `json:"error"`
+	Attempts  int           `json:"attempts"`
+	CreatedAt string        `json:"created_at"`
+	UpdatedAt string        `json:"updated_at"`
+}
+
+// envelope keeps the fields of an event taken from the request rather
+// than its body, so a retry stores it as it would have been.
+type envelope struct {
+	structs.Index
+	Tenant         string          `json:"tenant"`
+	IdempotencyKey string          `json:"idempotency_key,omitempty"`
+	ContentHash    string          `json:"content_hash,omitempty"`
+	Upsert         bool            `json:"upsert,omitempty"`
+	UserId         int64           `json:"user_id,omitempty"`
+	ReceivedAt     time.Time       `json:"received_at"`
+	Time           time.Time       `json:"time"`
+	Lineage        structs.Lineage `json:"lineage"`
+}
+
+func wrap(event structs.Index) envelope {
+	return envelope{event, event.Tenant, event.IdempotencyKey, event.ContentHash, event.Upsert, event.UserId, event.ReceivedAt, event.Time, event.Lineage}
+}
+
+func (e envelope) unwrap() structs.Index {
+	event := e.Index
+	event.Tenant, event.IdempotencyKey, event.ContentHash, event.Upsert = e.Tenant, e.IdempotencyKey, e.ContentHash, e.Upsert
+	event.UserId, event.ReceivedAt, event.Time, event.Lineage = e.UserId, e.ReceivedAt, e.Time, e.Lineage
+	return event
+}
+
+// RetryFunc runs a dead-lettered event through ingest again. It must not
+// dead-letter the event itself.
+type RetryFunc func(structs.Index) error
+
+// Store keeps dead-lettered events.
+type Store struct {
+	db    *sql.DB
+	retry RetryFunc
+}
+
+// New creates a Store retrying events with retry.
+func New(db *sql.DB, retry RetryFunc) *Store {
+	return &Store{db: db, retry: retry}
+}
+
+// Add dead-letters event, which failed at stage with cause.
+func (s *Store) Add(event structs.Index, stage string, cause error) error {
+	payload, err := json.Marshal(wrap(event))
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC().Format(time.DateTime)
+	if _, err := s.db.Exec(`
+	INSERT INTO dead_letters (tenant, payload, stage, error, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?);`,
+		event.Tenant, payload, stage, cause.Error(), now, now); err != nil {
+		return err
+	}
+	metrics.Add("added", 1)
+	return nil
+}
+
+// List returns the dead-lettered events of tenant, or of every tenant
+// when all is set, oldest first.
+func (s *Store) List(tenant string, all bool, limit int) ([]Entry, error) {
+	rows, err := s.db.Query(`
+	SELECT id, tenant, payload, stage, error, attempts, created_at, updated_at FROM dead_letters
+	WHERE ? OR tenant = ? ORDER BY id LIMIT ?;`, all, tenant, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []Entry{}
+	for rows.Next() {
+		var e Entry
+		var payload []byte
+		if err := rows.Scan(&e.ID, &e.Tenant, &payload, &e.Stage, &e.Error, &e.Attempts, &e.CreatedAt, &e.UpdatedAt); err != nil {
+			return nil, err
+		}
+		var env envelope
+		if err := json.Unmarshal(payload, &env); err != nil {
+			return nil, err
+		}
+		e.Event = env.Index
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+var errNotFound = errors.New("dead letter not found")
+
+// Retry runs dead letter id through ingest again, removing it once it is
+// stored and recording the error otherwise.
+func (s *Store) Retry(id int64) error {
+	var payload []byte
+	err := s.db.QueryRow(`SELECT payload FROM dead_letters WHERE id = ?;`, id).Scan(&payload)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+	var env envelope
+	if err := json.Unmarshal(payload, &env); err != nil {
+		return err
+	}
+
+	if cause := s.retry(env.unwrap()); cause != nil {
+		if _, err := s.db.Exec(`
+		UPDATE dead_letters SET error = ?, attempts = attempts + 1, updated_at = ? WHERE id = ?;`,
+			cause.Error(), time.Now().UTC().Format(time.DateTime), id); err != nil {
+			log.Printf("Error recording dead letter retry: %v", err)
+		}
+		return cause
+	}
+	metrics.Add("retried", 1)
+	_, err = s.db.Exec(`DELETE FROM dead_letters WHERE id = ?;`, id)
+	return err
+}
+
+// RetryAll retries the dead letters of tenant, oldest first, calling
+// progress after each with the dead letters retried and their total. It
+// returns how many were stored and how many failed again, and stops early
+// when ctx is cancelled.
+func (s *Store) RetryAll(ctx context.Context, tenant string, progress func(done, total int64)) (stored, failed int64, err error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id FROM dead_letters WHERE tenant = ? ORDER BY id;`, tenant)
+	if err != nil {
+		return 0, 0, err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	total := int64(len(ids))
+	progress(0, total)
+	for i, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return stored, failed, err
+		}
+		switch err := s.Retry(id); {
+		case errors.Is(err, errNotFound):
+			// Retried or discarded meanwhile.
+		case err != nil:
+			failed++
+		default:
+			stored++
+		}
+		progress(int64(i+1), total)
+	}
+	return stored, failed, nil
+}
+
+// Discard removes dead letter id without storing it.
+func (s *Store) Discard(id int64) error {
+	res, err := s.db.Exec(`DELETE FROM dead_letters WHERE id = ?;`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errNotFound
+	}
+	metrics.Add("discarded", 1)
+	return nil
+}
+
+// AdminHandler manages dead-lettered events:
+//
+//	GET    /admin/dead-letters                list them, of X-Tenant-ID or with ?all=1 every tenant
+//	POST   /admin/dead-letters/{ID}/retry     ingest one again
+//	DELETE /admin/dead-letters/{ID}           discard one
+func (s *Store) AdminHandler(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/dead-letters"), "/")
+	idText, action, _ := strings.Cut(rest, "/")
+
+	if rest == "" {
+		if r.Method != http.MethodGet {
+			apierror.Write(w, "Only GET requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		limit := 100
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				apierror.Write(w, "limit must be a positive integer", http.StatusBadRequest)
+				return
+			}
+			limit = min(n, 1000)
+		}
+		entries, err := s.List(r.Header.Get("X-Tenant-ID"), r.URL.Query().Get("all") == "1", limit)
+		if err != nil {
+			apierror.Write(w, "Failed to list dead letters", http.StatusInternalServerError)
+			log.Printf("Error listing dead letters: %v", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, entries)
+		return
+	}
+
+	id, err := strconv.ParseInt(idText, 10, 64)
+	if err != nil || id <= 0 {
+		apierror.Write(w, "Dead letter not found", http.StatusNotFound)
+		return
+	}
+	switch {
+	case r.Method == http.MethodPost && action == "retry":
+		err := s.Retry(id)
+		switch {
+		case errors.Is(err, errNotFound):
+			apierror.Write(w, "Dead letter not found", http.StatusNotFound)
+		case err != nil:
+			apierror.Write(w, "Retry failed: "+err.Error(), http.StatusBadGateway)
+		default:
+			writeJSON(w, http.StatusOK, map[string]string{"message": "Event stored"})
+		}
+	case r.Method == http.MethodDelete && action == "":
+		err := s.Discard(id)
+		switch {
+		case errors.Is(err, errNotFound):
+			apierror.Write(w, "Dead letter not found", http.StatusNotFound)
+		case err != nil:
+			apierror.Write(w, "Failed to discard dead letter", http.StatusInternalServerError)
+			log.Printf("Error discarding dead letter: %v", err)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		apierror.Write(w, "Use GET /admin/dead-letters, POST /admin/dead-letters/{ID}/retry or DELETE /admin/dead-letters/{ID}", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	response, err := json.Marshal(v)
+	if err != nil {
+		apierror.Write(w, "Error encoding JSON", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(response)
+}
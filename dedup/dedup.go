@@ -0,0 +1,113 @@
+// Package dedup skips events whose content was already stored recently.
+// Each event posted to /event is hashed in a canonical form, and the hash
+// is claimed per tenant in the transaction storing the event; an event
+// whose hash was claimed within the window is a duplicate and is not
+// stored. Unlike an Idempotency-Key, this catches resubmissions that
+// clients did not mark as retries.
+package dedup
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"log"
+	"naevis/config"
+	"naevis/structs"
+	"slices"
+	"time"
+)
+
+// metrics counts duplicates skipped and expired hashes, published under
+// "dedup" in expvar.
+var metrics = expvar.NewMap("dedup")
+
+// Deduplicator claims content hashes for a window.
+type Deduplicator struct {
+	db     *sql.DB
+	window time.Duration
+}
+
+// New creates a Deduplicator for cfg.
+func New(db *sql.DB, cfg config.Dedup) *Deduplicator {
+	return &Deduplicator{db: db, window: cfg.Window.Duration}
+}
+
+// Enabled reports whether events are deduplicated, i.e. the window is
+// not zero.
+func (d *Deduplicator) Enabled() bool {
+	return d.window > 0
+}
+
+// Window is how long a content hash stays claimed.
+func (d *Deduplicator) Window() time.Duration {
+	return d.window
+}
+
+// Hash returns the hash of event's content: its fields, submitter,
+// attachments in any order and, for events reporting one, time. The
+// tenant is not part of it, as hashes are kept per tenant.
+func Hash(event structs.Index) string {
+	// Empty and omitted attachments encode alike, as null.
+	attachments := append([]string(nil), event.Attachments...)
+	slices.Sort(attachments)
+	var at string
+	if !event.Time.IsZero() {
+		at = event.Time.UTC().Format(time.RFC3339Nano)
+	}
+	// An array keeps the encoding canonical: fixed order, no names.
+	b, _ := json.Marshal([]any{
+		event.EntityType, event.Action, event.Source, event.EntityId, event.ItemId, event.ItemType,
+		event.UserId, at, attachments,
+	})
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// Claim records event's content hash for the event id within tx and
+// reports whether the content is new: not claimed by another event of the
+// tenant within the window. Events without a hash are always new.
+func (d *Deduplicator) Claim(tx *sql.Tx, event structs.Index, id int64) (bool, error) {
+	if event.ContentHash == "" || !d.Enabled() {
+		return true, nil
+	}
+	now := time.Now().UTC()
+	res, err := tx.Exec(`
+	INSERT INTO main.event_hashes (tenant, hash, event_id, created_at) VALUES (?, ?, ?, ?)
+	ON CONFLICT (tenant, hash) DO UPDATE SET event_id = excluded.event_id, created_at = excluded.created_at
+	WHERE created_at < ?;`,
+		event.Tenant, event.ContentHash, id, now.Format(time.DateTime), now.Add(-d.window).Format(time.DateTime))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		metrics.Add("duplicates", 1)
+	}
+	return n == 1, err
+}
+
+// Run deletes hashes older than the window every interval until ctx is
+// cancelled.
+func (d *Deduplicator) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		cutoff := time.Now().UTC().Add(-d.window).Format(time.DateTime)
+		res, err := d.db.Exec(`DELETE FROM event_hashes WHERE created_at < ?;`, cutoff)
+		if err != nil {
+			log.Printf("Error expiring event hashes: %v", err)
+		} else if n, _ := res.RowsAffected(); n > 0 {
+			metrics.Add("expired", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package dictionary
+
+import (
+	"database/sql"
+	"sync"
+)
+
+// Kinds of interned strings.
+const (
+	EntityType = "entity_type"
+	Action     = "action"
+	ItemType   = "item_type"
+)
+
+type key struct {
+	kind, value string
+}
+
+// Dictionary interns repetitive strings in the dictionary table, caching
+// their ids. Ids are never reused, so the cache never goes stale.
+type Dictionary struct {
+	db *sql.DB
+
+	mu  sync.RWMutex
+	ids map[key]int64
+}
+
+// New creates a Dictionary.
+func New(db *sql.DB) *Dictionary {
+	return &Dictionary{db: db, ids: make(map[key]int64)}
+}
+
+// ID returns the id of value, adding it to the dictionary if needed. Call
+// it outside the transaction storing the row, so a rollback cannot leave
+// a cached id without its entry.
+func (d *Dictionary) ID(kind, value string) (int64, error) {
+	k := key{kind, value}
+	d.mu.RLock()
+	id, ok := d.ids[k]
+	d.mu.RUnlock()
+	if ok {
+		return id, nil
+	}
+
+	err := d.db.QueryRow(`
+	INSERT INTO dictionary (kind, value) VALUES (?, ?)
+	ON CONFLICT(kind, value) DO UPDATE SET value = excluded.value
+	RETURNING id;`, kind, value).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	d.mu.Lock()
+	d.ids[k] = id
+	d.mu.Unlock()
+	return id, nil
+}
@@ -0,0 +1,243 @@
+package digest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"naevis/apierror"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// memoryLimit is the largest request body verified in memory; larger
+	// ones are spooled to a temporary file, and the largest response body
+	// that gets a Content-Digest.
+	memoryLimit = 1 << 20
+	// maxBody caps request bodies that carry a digest.
+	maxBody = 64 << 20
+)
+
+// algorithms are the supported digest algorithms by their RFC 9530 key.
+var algorithms = map[string]func() hash.Hash{
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+}
+
+// errMismatch means a body does not match its digest.
+var errMismatch = errors.New("body does not match its digest")
+
+// Middleware verifies request bodies against their Content-Digest and
+// Repr-Digest headers (RFC 9530) and adds a sha-256 Content-Digest to
+// responses. The body is read in full before next runs, so a corrupted
+// request is rejected before anything is stored. Repr-Digest is checked
+// only for requests without Content-Encoding, whose content and
+// representation are the same. Responses larger than 1 MiB stream
+// without a digest.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		want := parse(r.Header.Get("Content-Digest"))
+		if r.Header.Get("Content-Encoding") == "" {
+			for alg, sum := range parse(r.Header.Get("Repr-Digest")) {
+				if have, ok := want[alg]; ok && !bytes.Equal(have, sum) {
+					apierror.WriteCode(w, apierror.CodeDigestMismatch, "Content-Digest and Repr-Digest disagree", http.StatusBadRequest)
+					return
+				}
+				want[alg] = sum
+			}
+		}
+
+		if len(want) > 0 {
+			body, err := verify(r.Body, want)
+			var tooLarge *http.MaxBytesError
+			switch {
+			case errors.Is(err, errMismatch):
+				apierror.WriteCode(w, apierror.CodeDigestMismatch, "Body does not match its digest", http.StatusBadRequest)
+				return
+			case errors.As(err, &tooLarge):
+				apierror.Write(w, "Body too large", http.StatusRequestEntityTooLarge)
+				return
+			case err != nil:
+				log.Printf("Error verifying request digest: %v", err)
+				apierror.Write(w, "Failed to read body", http.StatusBadRequest)
+				return
+			}
+			defer body.Close()
+			r.Body = body
+		}
+
+		dw := &writer{ResponseWriter: w, status: http.StatusOK}
+		defer dw.finish()
+		if r.Method == http.MethodHead {
+			dw.passthrough = true
+		}
+		next.ServeHTTP(dw, r)
+	})
+}
+
+// parse reads the supported entries of a digest dictionary such as
+// "sha-256=:X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=:".
+func parse(header string) map[string][]byte {
+	sums := make(map[string][]byte)
+	for _, member := range strings.Split(header, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(member), "=")
+		if !ok || algorithms[strings.ToLower(key)] == nil {
+			continue
+		}
+		value, ok = strings.CutPrefix(value, ":")
+		if !ok {
+			continue
+		}
+		value, ok = strings.CutSuffix(value, ":")
+		if !ok {
+			continue
+		}
+		sum, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			continue
+		}
+		sums[strings.ToLower(key)] = sum
+	}
+	return sums
+}
+
+// verify reads body, spooling it to disk past memoryLimit, and checks it
+// against every wanted digest. It returns a reader over the same bytes.
+func verify(body io.ReadCloser, want map[string][]byte) (io.ReadCloser, error) {
+	defer body.Close()
+
+	hashes := make(map[string]hash.Hash, len(want))
+	writers := make([]io.Writer, 0, len(want)+1)
+	for alg := range want {
+		hashes[alg] = algorithms[alg]()
+		writers = append(writers, hashes[alg])
+	}
+
+	var buf bytes.Buffer
+	n, err := io.Copy(io.MultiWriter(append(writers, &buf)...), io.LimitReader(body, memoryLimit))
+	if err != nil {
+		return nil, err
+	}
+	var out io.ReadCloser = io.NopCloser(&buf)
+	if n == memoryLimit {
+		f, err := os.CreateTemp("", "quickie-body-*")
+		if err != nil {
+			return nil, err
+		}
+		os.Remove(f.Name())
+		if _, err := io.Copy(io.MultiWriter(append(writers, f)...), io.LimitReader(body, maxBody-memoryLimit+1)); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if size, _ := f.Seek(0, io.SeekCurrent); size > maxBody-memoryLimit {
+			f.Close()
+			return nil, &http.MaxBytesError{Limit: maxBody}
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+		out = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(&buf, f), f}
+	}
+
+	for alg, sum := range want {
+		if subtle.ConstantTimeCompare(hashes[alg].Sum(nil), sum) != 1 {
+			out.Close()
+			return nil, errMismatch
+		}
+	}
+	return out, nil
+}
+
+// writer buffers small responses to add their Content-Digest. Once a
+// response outgrows memoryLimit it is streamed as is.
+type writer struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	buf         bytes.Buffer
+	passthrough bool
+}
+
+func (w *writer) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = status
+	if w.passthrough || status == http.StatusNoContent || status == http.StatusNotModified || status < 200 {
+		w.passthrough = true
+		w.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.passthrough {
+		return w.ResponseWriter.Write(p)
+	}
+	if w.buf.Len()+len(p) > memoryLimit {
+		if err := w.stream(); err != nil {
+			return 0, err
+		}
+		return w.ResponseWriter.Write(p)
+	}
+	return w.buf.Write(p)
+}
+
+// FlushError sends what was buffered and streams the rest of the response
+// as is, without a digest, so handlers reporting progress are heard.
+func (w *writer) FlushError() error {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.passthrough {
+		if err := w.stream(); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// stream sends the buffered response and passes the rest through.
+func (w *writer) stream() error {
+	w.passthrough = true
+	w.ResponseWriter.WriteHeader(w.status)
+	_, err := w.ResponseWriter.Write(w.buf.Bytes())
+	w.buf.Reset()
+	return err
+}
+
+// finish sends a buffered response with its digest.
+func (w *writer) finish() {
+	if w.passthrough {
+		return
+	}
+	sum := sha256.Sum256(w.buf.Bytes())
+	h := w.Header()
+	h.Set("Content-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":")
+	if h.Get("Content-Encoding") == "" && h.Get("Content-Range") == "" && h.Get("Repr-Digest") == "" {
+		h.Set("Repr-Digest", h.Get("Content-Digest"))
+	}
+	h.Set("Content-Length", strconv.Itoa(w.buf.Len()))
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(w.buf.Bytes())
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *writer) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
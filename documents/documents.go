@@ -0,0 +1,256 @@
+package documents
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"naevis/accounts"
+	"naevis/apierror"
+	"naevis/compression"
+	"naevis/costs"
+	"naevis/structs"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxBody caps a document or patch.
+const maxBody = 1 << 20
+
+// mergePatchType is the media type of RFC 7396 JSON Merge Patch bodies.
+const mergePatchType = "application/merge-patch+json"
+
+// IngestFunc stores the event recorded for each document change.
+type IngestFunc func(event structs.Index) error
+
+// Store keeps the latest version of each entity's document so producers
+// can send JSON Merge Patches instead of the full document. Versions are
+// sent as strong ETags; a patch must name the version it was computed
+// against in If-Match, and every change is ingested as a created or
+// updated event of the entity.
+type Store struct {
+	db     *sql.DB
+	ingest IngestFunc
+}
+
+// New creates a document store. Change events are stored with ingest.
+func New(db *sql.DB, ingest IngestFunc) *Store {
+	return &Store{db: db, ingest: ingest}
+}
+
+// errStale means the document changed since the version in If-Match.
+var errStale = errors.New("document version does not match")
+
+func etag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// matches reports whether an If-Match header value names version.
+func matches(header string, version int64) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag(version) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeHTTP handles GET, PUT and PATCH /documents/{ENTITY_TYPE}/{ENTITY_ID}
+// for the caller's tenant.
+func (s *Store) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	entityType, entityId, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/documents/"), "/"), "/")
+	if entityType == "" || entityId == "" || strings.Contains(entityId, "/") {
+		apierror.Write(w, "Use /documents/{ENTITY_TYPE}/{ENTITY_ID}", http.StatusNotFound)
+		return
+	}
+	tenant := r.Header.Get("X-Tenant-ID")
+
+	switch r.Method {
+	case http.MethodGet:
+		var body compression.Text
+		var version int64
+		err := s.db.QueryRow(`
+		SELECT body, version FROM entity_documents
+		WHERE tenant = ? AND entity_type = ? AND entity_id = ?;`, tenant, entityType, entityId).Scan(&body, &version)
+		if err == sql.ErrNoRows {
+			apierror.Write(w, "Document not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			apierror.Write(w, "Failed to load document", http.StatusInternalServerError)
+			return
+		}
+		if matches(r.Header.Get("If-None-Match"), version) {
+			w.Header().Set("ETag", etag(version))
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", etag(version))
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, string(body))
+		return
+	case http.MethodPut, http.MethodPatch:
+	default:
+		apierror.Write(w, "Only GET, PUT and PATCH requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.Method == http.MethodPatch {
+		if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != mergePatchType {
+			apierror.Write(w, "Content-Type must be "+mergePatchType, http.StatusUnsupportedMediaType)
+			return
+		}
+		if r.Header.Get("If-Match") == "" {
+			apierror.Write(w, "Patches require If-Match with the document's ETag", http.StatusPreconditionRequired)
+			return
+		}
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBody))
+	if err != nil {
+		apierror.Write(w, "Document too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	change, err := decode(data)
+	if err != nil {
+		apierror.WriteCode(w, apierror.CodeInvalidJSON, "Body must be a JSON object", http.StatusBadRequest)
+		return
+	}
+
+	version, created, err := s.apply(tenant, entityType, entityId, change, r.Method == http.MethodPatch,
+		r.Header.Get("If-Match"), r.Header.Get("If-None-Match"))
+	switch {
+	case errors.Is(err, errStale):
+		apierror.Write(w, "Document version does not match", http.StatusPreconditionFailed)
+		return
+	case errors.Is(err, sql.ErrNoRows):
+		apierror.Write(w, "Document not found", http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("Error storing document %s/%s: %v", entityType, entityId, err)
+		apierror.Write(w, "Failed to store document", http.StatusInternalServerError)
+		return
+	}
+
+	event := structs.Index{EntityType: entityType, Action: "updated", EntityId: entityId, Tenant: tenant,
+		Payer: costs.Payer(r), Lineage: structs.Lineage{Connector: "documents"}}
+	if created {
+		event.Action = "created"
+	}
+	if claims, ok := accounts.FromContext(r.Context()); ok {
+		event.UserId = claims.Subject
+	}
+	if err := s.ingest(event); err != nil {
+		log.Printf("Error ingesting change of document %s/%s: %v", entityType, entityId, err)
+	}
+
+	w.Header().Set("ETag", etag(version))
+	if created {
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apply stores a full document or merges a patch into the current one,
+// checking the preconditions against the current version in the same
+// transaction. It returns the new version and whether the document was
+// created.
+func (s *Store) apply(tenant, entityType, entityId string, change map[string]any, patch bool, ifMatch, ifNoneMatch string) (int64, bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+
+	var current compression.Text
+	var version int64
+	err = tx.QueryRow(`
+	SELECT body, version FROM entity_documents
+	WHERE tenant = ? AND entity_type = ? AND entity_id = ?;`, tenant, entityType, entityId).Scan(&current, &version)
+	exists := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		return 0, false, err
+	}
+
+	switch {
+	case !exists && patch:
+		return 0, false, sql.ErrNoRows
+	case !exists && ifMatch != "":
+		return 0, false, errStale
+	case exists && ifMatch != "" && !matches(ifMatch, version):
+		return 0, false, errStale
+	case exists && ifNoneMatch == "*":
+		return 0, false, errStale
+	}
+
+	doc := change
+	if patch {
+		base, err := decode([]byte(current))
+		if err != nil {
+			return 0, false, err
+		}
+		doc = mergePatch(base, change).(map[string]any)
+	}
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return 0, false, err
+	}
+
+	version++
+	if _, err := tx.Exec(`
+	INSERT INTO entity_documents (tenant, entity_type, entity_id, version, body, updated_at)
+	VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+	ON CONFLICT(tenant, entity_type, entity_id) DO UPDATE SET
+		version = excluded.version, body = excluded.body, updated_at = excluded.updated_at;`,
+		tenant, entityType, entityId, version, compression.Text(body)); err != nil {
+		return 0, false, err
+	}
+	return version, !exists, tx.Commit()
+}
+
+// decode parses a JSON object, keeping numbers exact.
+func decode(data []byte) (map[string]any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc map[string]any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, errors.New("document is not a JSON object")
+	}
+	// More stops at a closing bracket, so read on to the end instead.
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("trailing data after document")
+	}
+	return doc, nil
+}
+
+// mergePatch applies an RFC 7396 merge patch to target: object members
+// are merged recursively, null removes a member, and any other value
+// replaces the target.
+func mergePatch(target, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]any)
+	if !ok {
+		t = make(map[string]any, len(p))
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
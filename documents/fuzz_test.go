@@ -0,0 +1,47 @@
+package documents
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// FuzzMergePatch checks that documents and patches decode without
+// panicking, that a patched document is still one, and that applying a
+// patch twice changes nothing more, as RFC 7396 patches are idempotent.
+func FuzzMergePatch(f *testing.F) {
+	f.Add(`{"name":"Cafe","tags":["a"],"hours":{"mon":"9-5"}}`, `{"hours":{"mon":null,"tue":"9-5"},"tags":null}`)
+	f.Add(`{"a":1}`, `{"a":{"b":{"c":null}}}`)
+	f.Add(`{"n":12345678901234567890}`, `{"n":1e400}`)
+	f.Add(`{"a":1}}`, `{}`)
+
+	f.Fuzz(func(t *testing.T, target, patch string) {
+		doc, err := decode([]byte(target))
+		if err != nil {
+			return
+		}
+		change, err := decode([]byte(patch))
+		if err != nil {
+			return
+		}
+
+		once := encode(t, mergePatch(doc, change))
+		patched, err := decode(once)
+		if err != nil {
+			t.Fatalf("patched document %s does not decode: %v", once, err)
+		}
+		twice := encode(t, mergePatch(patched, change))
+		if !reflect.DeepEqual(once, twice) {
+			t.Fatalf("patching twice changed the document:\n%s\n%s", once, twice)
+		}
+	})
+}
+
+func encode(t *testing.T, doc any) []byte {
+	t.Helper()
+	b, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatalf("encoding %v: %v", doc, err)
+	}
+	return b
+}
@@ -0,0 +1,314 @@
+package experiments
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"naevis/accounts"
+	"naevis/apierror"
+	"naevis/costs"
+	"naevis/structs"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Experiment statuses. Only running experiments assign variants.
+const (
+	StatusRunning = "running"
+	StatusPaused  = "paused"
+	StatusStopped = "stopped"
+)
+
+// Variant is one arm of an experiment. Units are split between variants in
+// proportion to their weights.
+type Variant struct {
+	Name   string `json:"name"`
+	Weight int    `json:"weight"`
+}
+
+// Experiment is an A/B test definition.
+type Experiment struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Status      string    `json:"status"`
+	Variants    []Variant `json:"variants"`
+}
+
+// IngestFunc stores an exposure event.
+type IngestFunc func(event structs.Index) error
+
+// Service defines experiments, assigns clients to variants and records
+// exposures. Assignment is a hash of the experiment and the caller, so it
+// is stable without storing anything per client: authenticated callers
+// are bucketed by user, anonymous ones by the X-Client-ID header, both
+// within their tenant.
+type Service struct {
+	db     *sql.DB
+	ingest IngestFunc
+}
+
+// New creates an experiment service. Exposures are stored with ingest.
+func New(db *sql.DB, ingest IngestFunc) *Service {
+	return &Service{db: db, ingest: ingest}
+}
+
+// assign picks the variant of unit deterministically.
+func assign(e Experiment, unit string) string {
+	total := 0
+	for _, v := range e.Variants {
+		total += v.Weight
+	}
+	if total == 0 {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(e.Name + "\x00" + unit))
+	bucket := int(binary.BigEndian.Uint64(sum[:8]) % uint64(total))
+	for _, v := range e.Variants {
+		if bucket < v.Weight {
+			return v.Name
+		}
+		bucket -= v.Weight
+	}
+	return ""
+}
+
+// unit identifies the caller for assignment.
+func unit(r *http.Request) string {
+	tenant := r.Header.Get("X-Tenant-ID")
+	if claims, ok := accounts.FromContext(r.Context()); ok {
+		return tenant + "\x00u:" + strconv.FormatInt(claims.Subject, 10)
+	}
+	if client := r.Header.Get("X-Client-ID"); client != "" {
+		return tenant + "\x00c:" + client
+	}
+	return ""
+}
+
+// load reads experiments, optionally only those with status.
+func (s *Service) load(status string) ([]Experiment, error) {
+	rows, err := s.db.Query(`
+	SELECT e.name, e.description, e.status, IFNULL(v.name, ''), IFNULL(v.weight, 0)
+	FROM experiments e LEFT JOIN experiment_variants v ON v.experiment = e.name
+	WHERE ? = '' OR e.status = ?
+	ORDER BY e.name, v.position;`, status, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	experiments := []Experiment{}
+	for rows.Next() {
+		var e Experiment
+		var v Variant
+		if err := rows.Scan(&e.Name, &e.Description, &e.Status, &v.Name, &v.Weight); err != nil {
+			return nil, err
+		}
+		if n := len(experiments); n == 0 || experiments[n-1].Name != e.Name {
+			e.Variants = []Variant{}
+			experiments = append(experiments, e)
+		}
+		if v.Name != "" {
+			last := &experiments[len(experiments)-1]
+			last.Variants = append(last.Variants, v)
+		}
+	}
+	return experiments, rows.Err()
+}
+
+// AssignmentsHandler handles GET /experiments/assignments, returning the
+// caller's variant of every running experiment.
+func (s *Service) AssignmentsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apierror.Write(w, "Only GET requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	u := unit(r)
+	if u == "" {
+		apierror.Write(w, "Authentication or an X-Client-ID header is required", http.StatusBadRequest)
+		return
+	}
+
+	experiments, err := s.load(StatusRunning)
+	if err != nil {
+		apierror.Write(w, "Failed to load experiments", http.StatusInternalServerError)
+		return
+	}
+	assignments := make(map[string]string)
+	for _, e := range experiments {
+		if v := assign(e, u); v != "" {
+			assignments[e.Name] = v
+		}
+	}
+	writeJSON(w, http.StatusOK, assignments)
+}
+
+// ExposureHandler handles POST /experiments/{NAME}/exposure, sent when the
+// client actually shows its variant. The variant is recomputed rather than
+// trusted, and recorded as an "experiment"/"exposure" event whose item is
+// the variant.
+func (s *Service) ExposureHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		apierror.Write(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/experiments/"), "/exposure")
+	if !ok || name == "" {
+		apierror.Write(w, "Use POST /experiments/{NAME}/exposure", http.StatusNotFound)
+		return
+	}
+	u := unit(r)
+	if u == "" {
+		apierror.Write(w, "Authentication or an X-Client-ID header is required", http.StatusBadRequest)
+		return
+	}
+
+	experiments, err := s.load(StatusRunning)
+	if err != nil {
+		apierror.Write(w, "Failed to load experiments", http.StatusInternalServerError)
+		return
+	}
+	var variant string
+	for _, e := range experiments {
+		if e.Name == name {
+			variant = assign(e, u)
+		}
+	}
+	if variant == "" {
+		apierror.Write(w, "Experiment not running", http.StatusNotFound)
+		return
+	}
+
+	event := structs.Index{
+		EntityType: "experiment",
+		Action:     "exposure",
+		EntityId:   name,
+		ItemType:   "variant",
+		ItemId:     variant,
+		Tenant:     r.Header.Get("X-Tenant-ID"),
+		Payer:      costs.Payer(r),
+		Lineage:    structs.Lineage{Connector: "experiments"},
+	}
+	if claims, ok := accounts.FromContext(r.Context()); ok {
+		event.UserId = claims.Subject
+	}
+	if err := s.ingest(event); err != nil {
+		log.Printf("Error storing exposure for %s: %v", name, err)
+		apierror.Write(w, "Failed to store exposure", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"experiment": name, "variant": variant})
+}
+
+// AdminHandler manages experiment definitions:
+//
+//	GET    /admin/experiments         list experiments
+//	PUT    /admin/experiments/{NAME}  create or replace an experiment
+//	DELETE /admin/experiments/{NAME}  delete an experiment
+//
+// Changing the variants of a running experiment reshuffles assignments,
+// so pause it and start a new one instead.
+func (s *Service) AdminHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/experiments"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		experiments, err := s.load("")
+		if err != nil {
+			apierror.Write(w, "Failed to load experiments", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, experiments)
+	case r.Method == http.MethodPut && name != "":
+		var e Experiment
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			apierror.WriteCode(w, apierror.CodeInvalidJSON, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		e.Name = name
+		if e.Status == "" {
+			e.Status = StatusRunning
+		}
+		if err := validate(e); err != "" {
+			apierror.Write(w, err, http.StatusBadRequest)
+			return
+		}
+		if err := s.save(e); err != nil {
+			apierror.Write(w, "Failed to save experiment", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, e)
+	case r.Method == http.MethodDelete && name != "":
+		if _, err := s.db.Exec(`DELETE FROM experiment_variants WHERE experiment = ?;`, name); err != nil {
+			apierror.Write(w, "Failed to delete experiment", http.StatusInternalServerError)
+			return
+		}
+		if _, err := s.db.Exec(`DELETE FROM experiments WHERE name = ?;`, name); err != nil {
+			apierror.Write(w, "Failed to delete experiment", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		apierror.Write(w, "Use GET /admin/experiments or PUT/DELETE /admin/experiments/{NAME}", http.StatusMethodNotAllowed)
+	}
+}
+
+func validate(e Experiment) string {
+	switch e.Status {
+	case StatusRunning, StatusPaused, StatusStopped:
+	default:
+		return "status must be running, paused or stopped"
+	}
+	if len(e.Variants) < 2 {
+		return "an experiment needs at least two variants"
+	}
+	names := make(map[string]bool)
+	for _, v := range e.Variants {
+		if v.Name == "" || v.Weight < 0 || names[v.Name] {
+			return "variants need unique names and non-negative weights"
+		}
+		names[v.Name] = true
+	}
+	return ""
+}
+
+// save replaces an experiment and its variants.
+func (s *Service) save(e Experiment) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+	INSERT INTO experiments (name, description, status, created_at, updated_at)
+	VALUES (?, ?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+	ON CONFLICT(name) DO UPDATE SET description = excluded.description, status = excluded.status,
+		updated_at = CURRENT_TIMESTAMP;`, e.Name, e.Description, e.Status); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM experiment_variants WHERE experiment = ?;`, e.Name); err != nil {
+		return err
+	}
+	for i, v := range e.Variants {
+		if _, err := tx.Exec(`
+		INSERT INTO experiment_variants (experiment, name, weight, position) VALUES (?, ?, ?, ?);`,
+			e.Name, v.Name, v.Weight, i); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	response, err := json.Marshal(v)
+	if err != nil {
+		apierror.Write(w, "Error encoding JSON", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(response)
+}
@@ -0,0 +1,195 @@
+package filedrop
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"naevis/ingest"
+	"naevis/structs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	// settleTime is how long a file must be unmodified before it is read,
+	// so partially uploaded files are left alone.
+	settleTime = 5 * time.Second
+	// checkpointEvery is how many records are stored between checkpoints.
+	checkpointEvery = 100
+)
+
+// IngestFunc stores one event read from a dropped file.
+type IngestFunc func(event structs.Index) error
+
+// Watcher ingests NDJSON and CSV files dropped into a directory. Ingested
+// files move to processed/, unreadable ones to quarantine/ along with a
+// .err file naming the bad line; records before it have already been
+// stored. Progress within a file is checkpointed, so a restart resumes
+// after the last stored record.
+type Watcher struct {
+	db     *sql.DB
+	dir    string
+	ingest IngestFunc
+}
+
+// NewWatcher creates a watcher for dir.
+func NewWatcher(db *sql.DB, dir string, ingest IngestFunc) *Watcher {
+	return &Watcher{db: db, dir: dir, ingest: ingest}
+}
+
+// Run scans the directory every interval until ctx is cancelled.
+func (wt *Watcher) Run(ctx context.Context, interval time.Duration) {
+	for _, sub := range []string{"processed", "quarantine"} {
+		if err := os.MkdirAll(filepath.Join(wt.dir, sub), 0o755); err != nil {
+			log.Printf("Error preparing drop directory %s: %v", wt.dir, err)
+			return
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := wt.Scan(); err != nil {
+			log.Printf("Error scanning drop directory %s: %v", wt.dir, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Scan ingests every settled file currently in the directory, oldest
+// first.
+func (wt *Watcher) Scan() error {
+	entries, err := os.ReadDir(wt.dir)
+	if err != nil {
+		return err
+	}
+
+	type candidate struct {
+		name    string
+		modTime time.Time
+	}
+	var files []candidate
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		if _, ok := ingest.FormatOf(e.Name()); !ok {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		if time.Since(info.ModTime()) < settleTime {
+			continue
+		}
+		files = append(files, candidate{e.Name(), info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+
+	for _, f := range files {
+		if err := wt.processFile(f.name); err != nil {
+			// Storage errors are retried on the next scan.
+			return fmt.Errorf("%s: %v", f.name, err)
+		}
+	}
+	return nil
+}
+
+// processFile ingests one file and moves it out of the drop directory.
+// Parse errors and invalid events quarantine the file; other errors are
+// returned.
+func (wt *Watcher) processFile(name string) error {
+	format, _ := ingest.FormatOf(name)
+	path := filepath.Join(wt.dir, name)
+
+	done, err := wt.checkpoint(name)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	last := done
+	err = ingest.Read(format, f, func(line int, event structs.Index) error {
+		if line <= done {
+			return nil
+		}
+		event.Lineage = structs.Lineage{Connector: "filedrop", Origin: name, Offset: int64(line)}
+		if err := wt.ingest(event); err != nil {
+			// An invalid record fails the same way on every retry.
+			var invalid *ingest.ValidationError
+			if errors.As(err, &invalid) {
+				return &ingest.ParseError{Line: line, Err: err}
+			}
+			return err
+		}
+		last = line
+		if (last-done)%checkpointEvery == 0 {
+			return wt.saveCheckpoint(name, last)
+		}
+		return nil
+	})
+	f.Close()
+
+	var parseErr *ingest.ParseError
+	switch {
+	case errors.As(err, &parseErr):
+		log.Printf("Quarantining dropped file %s: %v", name, err)
+		return wt.finish(name, "quarantine", err)
+	case err != nil:
+		if saveErr := wt.saveCheckpoint(name, last); saveErr != nil {
+			log.Printf("Error checkpointing %s: %v", name, saveErr)
+		}
+		return err
+	}
+
+	log.Printf("Ingested dropped file %s (%d records)", name, last-done)
+	return wt.finish(name, "processed", nil)
+}
+
+// finish moves a file into sub and clears its checkpoint.
+func (wt *Watcher) finish(name, sub string, reason error) error {
+	dest := filepath.Join(wt.dir, sub, name)
+	if err := os.Rename(filepath.Join(wt.dir, name), dest); err != nil {
+		return err
+	}
+	if reason != nil {
+		if err := os.WriteFile(dest+".err", []byte(reason.Error()+"\n"), 0o644); err != nil {
+			return err
+		}
+	}
+	_, err := wt.db.Exec(`DELETE FROM file_checkpoints WHERE dir = ? AND name = ?;`, wt.dir, name)
+	return err
+}
+
+// checkpoint returns the last line stored for a file, or 0.
+func (wt *Watcher) checkpoint(name string) (int, error) {
+	var line int
+	err := wt.db.QueryRow(`SELECT line FROM file_checkpoints WHERE dir = ? AND name = ?;`, wt.dir, name).Scan(&line)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return line, err
+}
+
+func (wt *Watcher) saveCheckpoint(name string, line int) error {
+	_, err := wt.db.Exec(`
+	INSERT INTO file_checkpoints (dir, name, line, updated_at) VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+	ON CONFLICT(dir, name) DO UPDATE SET line = excluded.line, updated_at = excluded.updated_at;`,
+		wt.dir, name, line)
+	return err
+}
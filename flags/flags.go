@@ -0,0 +1,236 @@
+package flags
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"naevis/accounts"
+	"naevis/apierror"
+	"naevis/config"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Flag is a feature flag. It is on for everyone when Enabled, otherwise
+// for the listed tenants and for Percent of callers.
+type Flag struct {
+	Name    string   `json:"name"`
+	Enabled bool     `json:"enabled"`
+	Tenants []string `json:"tenants"`
+	Percent int      `json:"percent"`
+	// Source is "config" or "admin"; admin flags override config ones.
+	Source string `json:"source"`
+}
+
+// on reports whether the flag is on for a caller.
+func (f Flag) on(tenant, unit string) bool {
+	if f.Enabled {
+		return true
+	}
+	for _, t := range f.Tenants {
+		if t == tenant {
+			return true
+		}
+	}
+	if f.Percent <= 0 || unit == "" {
+		return false
+	}
+	sum := sha256.Sum256([]byte(f.Name + "\x00" + unit))
+	return int(binary.BigEndian.Uint64(sum[:8])%100) < f.Percent
+}
+
+// Store holds the flags from the config file merged with those set
+// through the admin API, which are kept in SQLite.
+type Store struct {
+	db       *sql.DB
+	defaults map[string]config.Flag
+
+	mu    sync.RWMutex
+	flags map[string]Flag
+}
+
+// New creates a Store and loads the flags.
+func New(db *sql.DB, defaults map[string]config.Flag) (*Store, error) {
+	s := &Store{db: db, defaults: defaults}
+	return s, s.Reload()
+}
+
+// Run reloads the flags every interval until ctx is cancelled, picking
+// up changes made through other instances.
+func (s *Store) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := s.Reload(); err != nil {
+			log.Printf("Error reloading feature flags: %v", err)
+		}
+	}
+}
+
+// Reload rebuilds the flags from the config defaults and the database.
+func (s *Store) Reload() error {
+	flags := make(map[string]Flag)
+	for name, f := range s.defaults {
+		flags[name] = Flag{Name: name, Enabled: f.Enabled, Tenants: f.Tenants, Percent: f.Percent, Source: "config"}
+	}
+
+	rows, err := s.db.Query(`SELECT name, enabled, tenants, percent FROM feature_flags;`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		f := Flag{Source: "admin"}
+		var tenants string
+		if err := rows.Scan(&f.Name, &f.Enabled, &tenants, &f.Percent); err != nil {
+			return err
+		}
+		if tenants != "" {
+			f.Tenants = strings.Split(tenants, ",")
+		}
+		flags[f.Name] = f
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.flags = flags
+	s.mu.Unlock()
+	return nil
+}
+
+type contextKey struct{}
+
+// caller is what flags are evaluated against.
+type caller struct {
+	store        *Store
+	tenant, unit string
+}
+
+// Middleware makes the store available to Enabled for every request. It
+// must run after accounts.Authenticate so percentages can bucket by user.
+func (s *Store) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := caller{store: s, tenant: r.Header.Get("X-Tenant-ID")}
+		if claims, ok := accounts.FromContext(r.Context()); ok {
+			c.unit = c.tenant + "\x00u:" + strconv.FormatInt(claims.Subject, 10)
+		} else if client := r.Header.Get("X-Client-ID"); client != "" {
+			c.unit = c.tenant + "\x00c:" + client
+		} else if c.tenant != "" {
+			c.unit = c.tenant
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, c)))
+	})
+}
+
+// Enabled reports whether the named flag is on for the request that ctx
+// belongs to. Unknown flags, and contexts that did not pass through
+// Middleware, are off.
+func Enabled(ctx context.Context, name string) bool {
+	c, ok := ctx.Value(contextKey{}).(caller)
+	if !ok {
+		return false
+	}
+	c.store.mu.RLock()
+	f, ok := c.store.flags[name]
+	c.store.mu.RUnlock()
+	return ok && f.on(c.tenant, c.unit)
+}
+
+// list returns all flags sorted by name.
+func (s *Store) list() []Flag {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	flags := make([]Flag, 0, len(s.flags))
+	for _, f := range s.flags {
+		flags = append(flags, f)
+	}
+	sort.Slice(flags, func(i, j int) bool { return flags[i].Name < flags[j].Name })
+	return flags
+}
+
+// FlagsHandler handles GET /flags, listing the flags that are on for the
+// caller so clients can dark-launch features too.
+func (s *Store) FlagsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apierror.Write(w, "Only GET requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	on := []string{}
+	for _, f := range s.list() {
+		if Enabled(r.Context(), f.Name) {
+			on = append(on, f.Name)
+		}
+	}
+	writeJSON(w, http.StatusOK, on)
+}
+
+// AdminHandler manages flags:
+//
+//	GET    /admin/flags         list every flag and its source
+//	PUT    /admin/flags/{NAME}  set a flag, overriding the config file
+//	DELETE /admin/flags/{NAME}  remove the override
+func (s *Store) AdminHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/flags"), "/")
+
+	var err error
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		writeJSON(w, http.StatusOK, s.list())
+		return
+	case r.Method == http.MethodPut && name != "":
+		var f Flag
+		if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+			apierror.WriteCode(w, apierror.CodeInvalidJSON, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if f.Percent < 0 || f.Percent > 100 {
+			apierror.Write(w, "percent must be between 0 and 100", http.StatusBadRequest)
+			return
+		}
+		_, err = s.db.Exec(`
+		INSERT INTO feature_flags (name, enabled, tenants, percent, updated_at)
+		VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(name) DO UPDATE SET enabled = excluded.enabled, tenants = excluded.tenants,
+			percent = excluded.percent, updated_at = CURRENT_TIMESTAMP;`,
+			name, f.Enabled, strings.Join(f.Tenants, ","), f.Percent)
+	case r.Method == http.MethodDelete && name != "":
+		_, err = s.db.Exec(`DELETE FROM feature_flags WHERE name = ?;`, name)
+	default:
+		apierror.Write(w, "Use GET /admin/flags or PUT/DELETE /admin/flags/{NAME}", http.StatusMethodNotAllowed)
+		return
+	}
+	if err == nil {
+		err = s.Reload()
+	}
+	if err != nil {
+		apierror.Write(w, "Failed to update flag", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	response, err := json.Marshal(v)
+	if err != nil {
+		apierror.Write(w, "Error encoding JSON", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(response)
+}
@@ -0,0 +1,303 @@
+package follows
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"naevis/accounts"
+	"naevis/apierror"
+	"naevis/cursor"
+	"naevis/structs"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultLimit = 50
+	maxLimit     = 500
+)
+
+// Reasons a follower is notified.
+const (
+	// ReasonChanged is an event on the followed entity itself.
+	ReasonChanged = "changed"
+	// ReasonRelated is an event on another entity whose item is the
+	// followed entity, such as a new event at a followed place.
+	ReasonRelated = "related"
+)
+
+// Notification is an in-app notice about a followed entity.
+type Notification struct {
+	ID         int64  `json:"id"`
+	Reason     string `json:"reason"`
+	EntityType string `json:"entity_type"`
+	EntityId   string `json:"entity_id"`
+	Action     string `json:"action"`
+	ItemType   string `json:"item_type,omitempty"`
+	ItemId     string `json:"item_id,omitempty"`
+	CreatedAt  string `json:"created_at"`
+	Read       bool   `json:"read"`
+}
+
+// Follow is an entity the user follows.
+type Follow struct {
+	EntityType string `json:"entity_type"`
+	EntityId   string `json:"entity_id"`
+	CreatedAt  string `json:"created_at"`
+}
+
+// Service lets users follow places, businesses, events and other entities
+// and notifies them when those change. A nil *Service is valid and
+// records nothing.
+type Service struct {
+	db *sql.DB
+}
+
+// New creates a follow service.
+func New(db *sql.DB) *Service {
+	return &Service{db: db}
+}
+
+// EntityChanged notifies the followers of the event's entity and, when the
+// event names an item, the followers of that item. The submitter is never
+// notified about their own event.
+func (s *Service) EntityChanged(event structs.Index) {
+	if s == nil {
+		return
+	}
+	s.notify(event, ReasonChanged, event.EntityType, event.EntityId)
+	if event.ItemType != "" && event.ItemId != "" {
+		s.notify(event, ReasonRelated, event.ItemType, event.ItemId)
+	}
+}
+
+func (s *Service) notify(event structs.Index, reason, entityType, entityId string) {
+	_, err := s.db.Exec(`
+	INSERT INTO user_notifications (user_id, reason, entity_type, entity_id, action, item_type, item_id, created_at)
+	SELECT user_id, ?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP FROM follows
+	WHERE entity_type = ? AND entity_id = ? AND user_id != ?;`,
+		reason, event.EntityType, event.EntityId, event.Action, event.ItemType, event.ItemId,
+		entityType, entityId, event.UserId)
+	if err != nil {
+		log.Printf("Error notifying followers of %s/%s: %v", entityType, entityId, err)
+	}
+}
+
+// Counts returns the follower count of each of ids, omitting entities
+// without followers.
+func (s *Service) Counts(entityType string, ids []string) (map[string]int64, error) {
+	counts := make(map[string]int64)
+	if s == nil || len(ids) == 0 {
+		return counts, nil
+	}
+
+	// The IDs are passed as one JSON array so the statement stays constant.
+	list, err := json.Marshal(ids)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(`
+	SELECT entity_id, COUNT(*) FROM follows
+	WHERE entity_type = ? AND entity_id IN (SELECT value FROM json_each(?))
+	GROUP BY entity_id;`, entityType, string(list))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var n int64
+		if err := rows.Scan(&id, &n); err != nil {
+			return nil, err
+		}
+		counts[id] = n
+	}
+	return counts, rows.Err()
+}
+
+// FollowsHandler handles GET /me/follows and PUT and DELETE
+// /me/follows/{ENTITY_TYPE}/{ENTITY_ID}.
+func (s *Service) FollowsHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := accounts.FromContext(r.Context())
+	if !ok {
+		apierror.Write(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/me/follows"), "/")
+	if rest == "" {
+		if r.Method != http.MethodGet {
+			apierror.Write(w, "Only GET requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.listFollows(w, claims.Subject)
+		return
+	}
+	entityType, entityId, _ := strings.Cut(rest, "/")
+	if entityType == "" || entityId == "" {
+		apierror.Write(w, "Use /me/follows/{ENTITY_TYPE}/{ENTITY_ID}", http.StatusNotFound)
+		return
+	}
+
+	var err error
+	switch r.Method {
+	case http.MethodPut:
+		_, err = s.db.Exec(`
+		INSERT INTO follows (user_id, entity_type, entity_id, created_at)
+		VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(user_id, entity_type, entity_id) DO NOTHING;`, claims.Subject, entityType, entityId)
+	case http.MethodDelete:
+		_, err = s.db.Exec(`DELETE FROM follows WHERE user_id = ? AND entity_type = ? AND entity_id = ?;`,
+			claims.Subject, entityType, entityId)
+	default:
+		apierror.Write(w, "Only PUT and DELETE requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		apierror.Write(w, "Failed to update follows", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Service) listFollows(w http.ResponseWriter, userID int64) {
+	rows, err := s.db.Query(`
+	SELECT entity_type, entity_id, created_at FROM follows
+	WHERE user_id = ? ORDER BY created_at DESC;`, userID)
+	if err != nil {
+		apierror.Write(w, "Failed to list follows", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	follows := []Follow{}
+	for rows.Next() {
+		var f Follow
+		if err := rows.Scan(&f.EntityType, &f.EntityId, &f.CreatedAt); err != nil {
+			apierror.Write(w, "Failed to list follows", http.StatusInternalServerError)
+			return
+		}
+		follows = append(follows, f)
+	}
+	writeJSON(w, http.StatusOK, follows)
+}
+
+type page struct {
+	Items      []Notification `json:"items"`
+	Limit      int64          `json:"limit"`
+	Offset     int64          `json:"offset"`
+	HasMore    bool           `json:"has_more"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+// notificationCursor is the position of a page of notifications: the id
+// of the last notification before it.
+type notificationCursor struct {
+	ID int64 `json:"id"`
+}
+
+// NotificationsHandler handles GET
+// /me/notifications?unread=1&limit=N&offset=N|cursor=CURSOR and POST
+// /me/notifications/read, which marks every notification read. Pages with
+// more after them carry the cursor of the next.
+func (s *Service) NotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := accounts.FromContext(r.Context())
+	if !ok {
+		apierror.Write(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	if r.URL.Path == "/me/notifications/read" {
+		if r.Method != http.MethodPost {
+			apierror.Write(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if _, err := s.db.Exec(`
+		UPDATE user_notifications SET read_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND read_at IS NULL;`, claims.Subject); err != nil {
+			apierror.Write(w, "Failed to mark notifications read", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodGet {
+		apierror.Write(w, "Only GET requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	limit, err := intParam(q.Get("limit"), defaultLimit)
+	if err != nil || limit <= 0 {
+		apierror.Write(w, "Invalid limit", http.StatusBadRequest)
+		return
+	}
+	if limit > maxLimit {
+		limit = maxLimit
+	}
+	offset, err := intParam(q.Get("offset"), 0)
+	if err != nil || offset < 0 {
+		apierror.Write(w, "Invalid offset", http.StatusBadRequest)
+		return
+	}
+	var after notificationCursor
+	if token := q.Get("cursor"); token != "" {
+		if offset > 0 {
+			apierror.Write(w, "Use offset or cursor, not both", http.StatusBadRequest)
+			return
+		}
+		if cursor.Decode(token, &after) != nil || after.ID <= 0 {
+			apierror.Write(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+
+	rows, err := s.db.Query(`
+	SELECT id, reason, entity_type, entity_id, action, item_type, item_id, created_at, read_at IS NOT NULL
+	FROM user_notifications
+	WHERE user_id = ? AND (? = '' OR read_at IS NULL) AND (? = 0 OR id < ?)
+	ORDER BY id DESC LIMIT ? OFFSET ?;`, claims.Subject, q.Get("unread"), after.ID, after.ID, limit+1, offset)
+	if err != nil {
+		apierror.Write(w, "Failed to load notifications", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	items := []Notification{}
+	for rows.Next() {
+		var n Notification
+		if err := rows.Scan(&n.ID, &n.Reason, &n.EntityType, &n.EntityId, &n.Action,
+			&n.ItemType, &n.ItemId, &n.CreatedAt, &n.Read); err != nil {
+			apierror.Write(w, "Failed to load notifications", http.StatusInternalServerError)
+			return
+		}
+		items = append(items, n)
+	}
+
+	result := page{Items: items, Limit: limit, Offset: offset}
+	if int64(len(items)) > limit {
+		result.Items = items[:limit]
+		result.HasMore = true
+		result.NextCursor = cursor.Encode(notificationCursor{ID: items[limit-1].ID})
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func intParam(s string, def int64) (int64, error) {
+	if s == "" {
+		return def, nil
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	response, err := json.Marshal(v)
+	if err != nil {
+		apierror.Write(w, "Error encoding JSON", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(response)
+}
@@ -0,0 +1,353 @@
+// Package fulltext keeps the events_fts FTS5 index of stored events and
+// answers ranked searches over it. Events are indexed by their name and
+// description, taken from additional_info when it is a JSON object, and by
+// the full additional_info text. Each database events are routed to has
+// its own index, a vocabulary of the words indexed that fuzzy searches
+// correct typos against, and a prefix index of entity names that
+// completes names as they are typed.
+package fulltext
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"naevis/routing"
+	"naevis/sqlguard"
+	"naevis/structs"
+	"strings"
+	"time"
+)
+
+type tenantKey struct{}
+
+// WithTenant returns a context whose searches only see events of tenant.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// matchesSQL selects the results of a search into matches: the
+// best-ranked event of each entity passing the filters, with the fields
+// filtered on read from additional_info when it is a JSON object. A
+// search near a point passes true, the point's latitude twice and its
+// longitude, to measure distances as geo.DistanceKm does. Each filter is
+// passed twice: to test whether it is set, then to compare with; the
+// bounding box of a search near a point is passed as near returns it, and
+// the radius twice.
+const matchesSQL = `
+	WITH matched AS (
+		SELECT entity_id, name, description, rank, latitude, longitude,
+			IFNULL(CAST(info ->> '$.category' AS TEXT), '') AS category,
+			IFNULL(CAST(info ->> '$.location' AS TEXT), '') AS location,
+			IFNULL(CAST(info ->> '$.date' AS TEXT), '') AS date,
+			IFNULL(CAST(info ->> '$.price' AS TEXT), '') AS price,
+			IFNULL(CAST(info ->> '$.rating' AS TEXT), '') AS rating
+		FROM (
+			SELECT entity_id, name, l.latitude, l.longitude,
+				CASE WHEN description != '' THEN description ELSE snippet(events_fts, 2, '', '', '…', 24) END AS description,
+				bm25(events_fts, 10.0, 5.0, 1.0) AS rank,
+				CASE WHEN json_valid(additional_info) AND json_type(additional_info) = 'object' THEN additional_info ELSE '{}' END AS info
+			FROM %[1]s.events_fts LEFT JOIN %[1]s.event_locations l ON l.event_id = events_fts.rowid
+			WHERE events_fts MATCH ? AND entity_type = ? AND tenant = ?
+		)
+	),
+	measured AS (
+		SELECT *, CASE WHEN ? THEN 2 * 6371.0 * asin(min(1, sqrt(
+			pow(sin(radians(latitude - ?) / 2), 2) +
+			cos(radians(?)) * cos(radians(latitude)) * pow(sin(radians(longitude - ?) / 2), 2)))) END AS distance
+		FROM matched
+	),
+	matches AS (
+		SELECT * FROM (
+			SELECT *, ROW_NUMBER() OVER (PARTITION BY entity_id ORDER BY rank) AS best FROM measured
+			WHERE (? = '' OR (date != '' AND substr(date, 1, 10) >= ?))
+				AND (? = '' OR (date != '' AND substr(date, 1, 10) <= ?))
+				AND (? = '' OR category = ? COLLATE NOCASE)
+				AND (? = '' OR instr(lower(location), lower(?)) > 0)
+				AND (? IS NULL OR (price != '' AND CAST(price AS REAL) >= ?))
+				AND (? IS NULL OR (price != '' AND CAST(price AS REAL) <= ?))
+				AND (? IS NULL OR (latitude BETWEEN ? AND ? AND
+					CASE WHEN ? THEN longitude >= ? OR longitude <= ? ELSE longitude BETWEEN ? AND ? END))
+				AND (? = 0 OR distance <= ?)
+		)
+		WHERE best = 1
+	)`
+
+// Statements on the index of the schema %[1]s.
+var (
+	indexSQL = sqlguard.NewSchemaTemplate(`
+	INSERT OR REPLACE INTO %[1]s.events_fts (rowid, name, description, additional_info, entity_type, entity_id, tenant)
+	VALUES (?, ?, ?, ?, ?, ?, ?);`)
+	// countSQL counts the results of a search, and those with each value
+	// of category and location when the facet is asked for by passing true.
+	countSQL = sqlguard.NewSchemaTemplate(matchesSQL + `
+	SELECT '', '', COUNT(*) FROM matches
+	UNION ALL
+	SELECT 'category', category, COUNT(*) FROM matches WHERE ? AND category != '' GROUP BY category
+	UNION ALL
+	SELECT 'location', location, COUNT(*) FROM matches WHERE ? AND location != '' GROUP BY location;`)
+	// pageSQL reads a page of the results of a search, sorted by the key
+	// of the field passed, descending when true is passed next. Results
+	// without the key come last; ties keep the order of relevance.
+	pageSQL = sqlguard.NewSchemaTemplate(matchesSQL + `
+	SELECT entity_id, name, description, category, location, date, price, rating, latitude, longitude FROM (
+		SELECT *, CASE ?
+			WHEN 'relevance' THEN -rank
+			WHEN 'date' THEN julianday(substr(date, 1, 10))
+			WHEN 'price' THEN CASE WHEN json_valid(price) AND json_type(price) IN ('integer', 'real') THEN CAST(price AS REAL) END
+			WHEN 'rating' THEN CASE WHEN json_valid(rating) AND json_type(rating) IN ('integer', 'real') THEN CAST(rating AS REAL) END
+			WHEN 'distance' THEN distance
+		END AS key
+		FROM matches
+	)
+	ORDER BY key IS NULL, CASE WHEN ? THEN -key ELSE key END, rank, entity_id
+	LIMIT ? OFFSET ?;`)
+	missingSQL = sqlguard.NewSchemaTemplate(`
+	SELECT r.id, IFNULL(et.value, ''), IFNULL(r.entity_id, ''), r.tenant, r.additional_info
+	FROM %[1]s.event_rows r LEFT JOIN main.dictionary et ON et.id = r.entity_type_id
+	WHERE r.id > ? AND NOT EXISTS (SELECT 1 FROM %[1]s.events_fts WHERE rowid = r.id)
+	ORDER BY r.id LIMIT ?;`)
+)
+
+// Index adds a stored event to the index, the words of its name and
+// description to the vocabulary of fuzzy searches, its coordinates to the
+// locations of searches near a point, and the name of its entity to the
+// prefix index of suggestions, within the transaction storing it.
+func Index(tx *sql.Tx, id int64, event structs.Index, additionalInfo string) error {
+	name, description := fields(additionalInfo)
+	schema := routing.Schema(event.EntityType)
+	if _, err := tx.Exec(indexSQL.Format(schema),
+		id, name, description, additionalInfo, event.EntityType, event.EntityId, event.Tenant); err != nil {
+		return err
+	}
+	if err := indexTerms(tx, schema, name, description); err != nil {
+		return err
+	}
+	if err := indexLocation(tx, schema, id, additionalInfo); err != nil {
+		return err
+	}
+	return indexName(tx, schema, id, event.EntityType, event.Tenant, event.EntityId, name)
+}
+
+// fields returns the name and description of an entity described by
+// additional_info, if it is a JSON object.
+func fields(additionalInfo string) (name, description string) {
+	var doc map[string]any
+	if json.Unmarshal([]byte(additionalInfo), &doc) != nil {
+		return "", ""
+	}
+	name, _ = doc["name"].(string)
+	if name == "" {
+		name, _ = doc["title"].(string)
+	}
+	description, _ = doc["description"].(string)
+	return name, description
+}
+
+// Engine searches the index. It implements handlers.Engine.
+type Engine struct {
+	db *sql.DB
+}
+
+// New creates an Engine.
+func New(db *sql.DB) *Engine {
+	return &Engine{db: db}
+}
+
+// Search returns the page p of the entities of entityType whose events
+// match query and pass filter, ranked by BM25 with matches in the name
+// weighing most, then the description. Each entity is found once, by its
+// best-ranked event. Filters, sorting and paging are left to SQLite, so
+// the total and facets count every entity found.
+func (e *Engine) Search(ctx context.Context, entityType, query string, filter structs.Filter, p structs.Paging) (structs.Matches, error) {
+	found := structs.Matches{Results: []structs.Result{}, Facets: make(map[string]map[string]int64)}
+	for _, field := range p.Facets {
+		found.Facets[field] = map[string]int64{}
+	}
+	words := queryWords(query)
+	if len(words) == 0 {
+		return found, nil
+	}
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	schema := routing.Schema(entityType)
+
+	var alternatives [][]string
+	if filter.Fuzziness > 0 {
+		var err error
+		if alternatives, err = e.alternatives(ctx, schema, words, filter.Fuzziness); err != nil {
+			return found, err
+		}
+	}
+	args := matchArgs(matchQuery(words, alternatives), entityType, tenant, filter)
+
+	_, category := found.Facets["category"]
+	_, location := found.Facets["location"]
+	rows, err := e.db.QueryContext(ctx, countSQL.Format(schema), append(args, category, location)...)
+	if err != nil {
+		return found, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var field, value string
+		var n int64
+		if err := rows.Scan(&field, &value, &n); err != nil {
+			return found, err
+		}
+		if field == "" {
+			found.Total = n
+		} else {
+			found.Facets[field][value] = n
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return found, err
+	}
+	if counts, ok := found.Facets["type"]; ok && found.Total > 0 {
+		counts[entityType] = found.Total
+	}
+	if found.Total <= p.Offset {
+		return found, nil
+	}
+
+	rows, err = e.db.QueryContext(ctx, pageSQL.Format(schema), append(args, p.Sort.Field, p.Sort.Desc, p.Limit, p.Offset)...)
+	if err != nil {
+		return found, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		r := structs.Result{Type: entityType}
+		if err := rows.Scan(&r.ID, &r.Name, &r.Description, &r.Category, &r.Location, &r.Date, &r.Price, &r.Rating, &r.Latitude, &r.Longitude); err != nil {
+			return found, err
+		}
+		found.Results = append(found.Results, r)
+	}
+	return found, rows.Err()
+}
+
+// matchArgs returns the arguments of matchesSQL.
+func matchArgs(match, entityType, tenant string, filter structs.Filter) []any {
+	args := []any{match, entityType, tenant}
+	radius := 0.0
+	if filter.Near != nil {
+		args = append(args, true, filter.Near.Lat, filter.Near.Lat, filter.Near.Lng)
+		radius = filter.RadiusKm
+	} else {
+		args = append(args, false, 0, 0, 0)
+	}
+	args = append(args,
+		filter.From, filter.From, filter.To, filter.To,
+		filter.Category, filter.Category, filter.Location, filter.Location,
+		filter.MinPrice, filter.MinPrice, filter.MaxPrice, filter.MaxPrice)
+	args = append(args, near(filter)...)
+	return append(args, radius, radius)
+}
+
+// matchQuery turns query words into an FTS5 query matching every word, the
+// last one as a prefix so results follow typing. A word with alternatives,
+// the indexed words it may be a misspelling of, matches any of them too.
+// Words are quoted, so FTS5 operators in the text are searched for rather
+// than interpreted.
+func matchQuery(words []string, alternatives [][]string) string {
+	parts := make([]string, len(words))
+	for i, w := range words {
+		parts[i] = `"` + w + `"`
+		if i == len(words)-1 {
+			parts[i] += "*"
+		}
+		if i < len(alternatives) && len(alternatives[i]) > 0 {
+			parts[i] = "(" + parts[i] + ` OR "` + strings.Join(alternatives[i], `" OR "`) + `")`
+		}
+	}
+	// FTS5 only ANDs bare phrases implicitly, not groups.
+	return strings.Join(parts, " AND ")
+}
+
+const (
+	// backfillBatch is how many events the backfill indexes at a time.
+	backfillBatch = 500
+	// backfillPause is the pause between batches, which leaves room for
+	// ingest writes.
+	backfillPause = 100 * time.Millisecond
+)
+
+// Backfill indexes the events stored before the index existed.
+type Backfill struct {
+	db *sql.DB
+}
+
+// NewBackfill creates a backfill job.
+func NewBackfill(db *sql.DB) *Backfill {
+	return &Backfill{db: db}
+}
+
+// Run indexes every stored event missing from the index, stopping early
+// when ctx is cancelled.
+func (b *Backfill) Run(ctx context.Context) {
+	n, err := b.run(ctx)
+	if err != nil {
+		log.Printf("Error indexing events for full-text search: %v", err)
+	}
+	if n > 0 {
+		log.Printf("Indexed %d events for full-text search", n)
+	}
+}
+
+func (b *Backfill) run(ctx context.Context) (int, error) {
+	total := 0
+	for _, schema := range routing.Schemas() {
+		names, err := b.backfillNames(schema)
+		if err != nil {
+			return total, err
+		}
+		if names > 0 {
+			log.Printf("Indexed the names of %d entities for suggestions", names)
+		}
+		located, err := b.backfillLocations(schema)
+		if err != nil {
+			return total, err
+		}
+		if located > 0 {
+			log.Printf("Indexed the locations of %d events for searches near a point", located)
+		}
+		words, err := b.backfillTerms(schema)
+		if err != nil {
+			return total, err
+		}
+		if words > 0 {
+			log.Printf("Indexed %d words for fuzzy search", words)
+		}
+		n, err := b.runSchema(ctx, schema)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// runSchema indexes the missing events of one schema.
+func (b *Backfill) runSchema(ctx context.Context, schema string) (int, error) {
+	var after int64
+	total := 0
+	for {
+		rows, err := b.db.Query(missingSQL.Format(schema), after, backfillBatch)
+		if err != nil {
+			return total, err
+		}
+		batch, err := scanPending(rows)
+		if err != nil || len(batch) == 0 {
+			return total, err
+		}
+		if err := indexPending(b.db, batch); err != nil {
+			return total, err
+		}
+		after = batch[len(batch)-1].id
+		total += len(batch)
+
+		select {
+		case <-ctx.Done():
+			return total, ctx.Err()
+		case <-time.After(backfillPause):
+		}
+	}
+}
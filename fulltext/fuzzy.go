@@ -0,0 +1,210 @@
+package fulltext
+
+import (
+	"context"
+	"database/sql"
+	"naevis/sqlguard"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// MaxFuzziness is the most typos a query word may have.
+	MaxFuzziness = 2
+	// minTermLength is the length, in runes, of the shortest words kept in
+	// the vocabulary; shorter ones are never corrected.
+	minTermLength = 3
+	// maxAlternatives caps the indexed words a misspelt word also matches.
+	maxAlternatives = 10
+)
+
+// Statements on the search_terms vocabulary of the schema %[1]s: the words
+// of the names and descriptions indexed, which fuzzy searches correct
+// query words to. The stemmed words of events_fts itself are no good for
+// measuring typos against.
+var (
+	termSQL = sqlguard.NewSchemaTemplate(`
+	INSERT INTO %[1]s.search_terms (term, length, uses) VALUES (?, ?, 1)
+	ON CONFLICT (term) DO UPDATE SET uses = uses + 1;`)
+	// termsSQL lists the words whose length is within the given bounds.
+	termsSQL = sqlguard.NewSchemaTemplate(`
+	SELECT term, uses FROM %[1]s.search_terms WHERE length BETWEEN ? AND ?;`)
+	// describedSQL lists the names and descriptions of an index whose
+	// words have not been backfilled.
+	describedSQL = sqlguard.NewSchemaTemplate(`
+	SELECT name, description FROM %[1]s.events_fts
+	WHERE (name != '' OR description != '') AND NOT EXISTS (SELECT 1 FROM %[1]s.search_terms);`)
+	backfillTermSQL = sqlguard.NewSchemaTemplate(`
+	INSERT OR IGNORE INTO %[1]s.search_terms (term, length, uses) VALUES (?, ?, ?);`)
+)
+
+// queryWords splits free text into words.
+func queryWords(text string) []string {
+	return strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// terms returns the distinct vocabulary words of texts, in lower case.
+func terms(texts ...string) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, text := range texts {
+		for _, w := range queryWords(strings.ToLower(text)) {
+			if utf8.RuneCountInString(w) >= minTermLength && !seen[w] {
+				seen[w] = true
+				out = append(out, w)
+			}
+		}
+	}
+	return out
+}
+
+// indexTerms adds the words of a name and description to the vocabulary.
+func indexTerms(tx *sql.Tx, schema, name, description string) error {
+	for _, t := range terms(name, description) {
+		if _, err := tx.Exec(termSQL.Format(schema), t, utf8.RuneCountInString(t)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxEdits is the number of typos tolerated in word for a fuzziness:
+// none in words of under three letters, and at most one in words of under
+// six, as a short word a few edits away from another is just another word.
+func maxEdits(word string, fuzziness int) int {
+	switch n := utf8.RuneCountInString(word); {
+	case n < minTermLength:
+		return 0
+	case n < 6:
+		return min(fuzziness, 1)
+	}
+	return min(fuzziness, MaxFuzziness)
+}
+
+// alternatives returns, for each of words, the indexed words within its
+// tolerated typos, closest and then most used first.
+func (e *Engine) alternatives(ctx context.Context, schema string, words []string, fuzziness int) ([][]string, error) {
+	out := make([][]string, len(words))
+	for i, w := range words {
+		w = strings.ToLower(w)
+		edits := maxEdits(w, fuzziness)
+		if edits == 0 {
+			continue
+		}
+		n := utf8.RuneCountInString(w)
+		rows, err := e.db.QueryContext(ctx, termsSQL.Format(schema), n-edits, n+edits)
+		if err != nil {
+			return nil, err
+		}
+		type candidate struct {
+			term     string
+			distance int
+			uses     int64
+		}
+		var found []candidate
+		for rows.Next() {
+			var c candidate
+			if err := rows.Scan(&c.term, &c.uses); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if c.term == w {
+				continue
+			}
+			if c.distance = distance(w, c.term, edits); c.distance <= edits {
+				found = append(found, c)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		sort.Slice(found, func(a, b int) bool {
+			if found[a].distance != found[b].distance {
+				return found[a].distance < found[b].distance
+			}
+			return found[a].uses > found[b].uses
+		})
+		for _, c := range found[:min(len(found), maxAlternatives)] {
+			out[i] = append(out[i], c.term)
+		}
+	}
+	return out, nil
+}
+
+// distance is the optimal string alignment distance between a and b: the
+// insertions, deletions, substitutions and swaps of adjacent runes turning
+// one into the other. Past limit it returns limit+1.
+func distance(a, b string, limit int) int {
+	s, t := []rune(a), []rune(b)
+	if d := len(s) - len(t); d > limit || -d > limit {
+		return limit + 1
+	}
+	// Three rows of the matrix: two back, one back and current.
+	prev2 := make([]int, len(t)+1)
+	prev := make([]int, len(t)+1)
+	cur := make([]int, len(t)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(s); i++ {
+		cur[0] = i
+		best := cur[0]
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && s[i-1] == t[j-2] && s[i-2] == t[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+			best = min(best, cur[j])
+		}
+		if best > limit {
+			return limit + 1
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return min(prev[len(t)], limit+1)
+}
+
+// backfillTerms fills the vocabulary of schema from its full-text index
+// once, when the vocabulary is new.
+func (b *Backfill) backfillTerms(schema string) (int, error) {
+	rows, err := b.db.Query(describedSQL.Format(schema))
+	if err != nil {
+		return 0, err
+	}
+	uses := make(map[string]int64)
+	for rows.Next() {
+		var name, description string
+		if err := rows.Scan(&name, &description); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		for _, t := range terms(name, description) {
+			uses[t]++
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(uses) == 0 {
+		return 0, err
+	}
+
+	tx, err := b.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	for t, n := range uses {
+		if _, err := tx.Exec(backfillTermSQL.Format(schema), t, utf8.RuneCountInString(t), n); err != nil {
+			return 0, err
+		}
+	}
+	return len(uses), tx.Commit()
+}
@@ -0,0 +1,115 @@
+package fulltext
+
+import (
+	"database/sql"
+	"encoding/json"
+	"naevis/geo"
+	"naevis/sqlguard"
+	"naevis/structs"
+)
+
+// Statements on the event_locations table of the schema %[1]s: the
+// coordinates of the events whose additional_info has them, which searches
+// near a point filter by bounding box before measuring distances.
+var (
+	locationSQL = sqlguard.NewSchemaTemplate(`
+	INSERT OR REPLACE INTO %[1]s.event_locations (event_id, latitude, longitude) VALUES (?, ?, ?);`)
+	// locatedSQL lists the events of an index that may have coordinates
+	// when the locations have not been backfilled.
+	locatedSQL = sqlguard.NewSchemaTemplate(`
+	SELECT rowid, additional_info FROM %[1]s.events_fts
+	WHERE instr(additional_info, 'lat') > 0 AND NOT EXISTS (SELECT 1 FROM %[1]s.event_locations);`)
+)
+
+// position returns the coordinates in additional_info, given as latitude
+// and longitude or lat and lng, if it is a JSON object holding valid ones.
+func position(additionalInfo string) (structs.Point, bool) {
+	var doc map[string]any
+	if json.Unmarshal([]byte(additionalInfo), &doc) != nil {
+		return structs.Point{}, false
+	}
+	lat, ok := coordinate(doc, "latitude", "lat")
+	if !ok || lat < -90 || lat > 90 {
+		return structs.Point{}, false
+	}
+	lng, ok := coordinate(doc, "longitude", "lng")
+	if !ok || lng < -180 || lng > 180 {
+		return structs.Point{}, false
+	}
+	return structs.Point{Lat: lat, Lng: lng}, true
+}
+
+// coordinate reads the first of names holding a number.
+func coordinate(doc map[string]any, names ...string) (float64, bool) {
+	for _, name := range names {
+		if v, ok := doc[name].(float64); ok {
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+// indexLocation records the coordinates of an event, if it has any.
+func indexLocation(tx *sql.Tx, schema string, id int64, additionalInfo string) error {
+	p, ok := position(additionalInfo)
+	if !ok {
+		return nil
+	}
+	_, err := tx.Exec(locationSQL.Format(schema), id, p.Lat, p.Lng)
+	return err
+}
+
+// near returns the bounding box parameters of searchSQL for filter: a
+// flag set when filtering by location, then the latitude range, whether
+// the longitude range wraps, and the longitude range twice.
+func near(filter structs.Filter) []any {
+	if filter.Near == nil {
+		return []any{nil, 0, 0, false, 0, 0, 0, 0}
+	}
+	box := geo.Box{MinLat: -90, MaxLat: 90, MinLng: -180, MaxLng: 180}
+	if filter.RadiusKm > 0 {
+		box = geo.BoxAround(*filter.Near, filter.RadiusKm)
+	}
+	return []any{1, box.MinLat, box.MaxLat, box.Wraps, box.MinLng, box.MaxLng, box.MinLng, box.MaxLng}
+}
+
+// backfillLocations fills the locations of schema from its full-text index
+// once, when the table is new.
+func (b *Backfill) backfillLocations(schema string) (int, error) {
+	rows, err := b.db.Query(locatedSQL.Format(schema))
+	if err != nil {
+		return 0, err
+	}
+	type row struct {
+		id int64
+		p  structs.Point
+	}
+	var located []row
+	for rows.Next() {
+		var id int64
+		var info string
+		if err := rows.Scan(&id, &info); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if p, ok := position(info); ok {
+			located = append(located, row{id, p})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(located) == 0 {
+		return 0, err
+	}
+
+	tx, err := b.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	for _, r := range located {
+		if _, err := tx.Exec(locationSQL.Format(schema), r.id, r.p.Lat, r.p.Lng); err != nil {
+			return 0, err
+		}
+	}
+	return len(located), tx.Commit()
+}
@@ -0,0 +1,124 @@
+package fulltext
+
+import (
+	"html"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// snippetWords is the length of a highlighted snippet, in words.
+const snippetWords = 24
+
+// Highlighter marks the words of a text matching a query with <mark>
+// tags, the way searches match them: a word matches a query word it
+// starts with, a query word starting with it, as stems do, or one within
+// the typos of the search's fuzziness.
+type Highlighter struct {
+	words     []string
+	fuzziness int
+}
+
+// NewHighlighter creates a Highlighter for query.
+func NewHighlighter(query string, fuzziness int) *Highlighter {
+	words := queryWords(strings.ToLower(query))
+	return &Highlighter{words: words, fuzziness: fuzziness}
+}
+
+// span is a word of a text, by byte offsets.
+type span struct {
+	start, end int
+}
+
+// spans returns the words of text.
+func spans(text string) []span {
+	var out []span
+	start := -1
+	for i, r := range text {
+		word := unicode.IsLetter(r) || unicode.IsNumber(r)
+		switch {
+		case word && start < 0:
+			start = i
+		case !word && start >= 0:
+			out = append(out, span{start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		out = append(out, span{start, len(text)})
+	}
+	return out
+}
+
+// matches reports whether word, in lower case, matches a query word.
+func (h *Highlighter) matches(word string) bool {
+	for _, q := range h.words {
+		switch {
+		case strings.HasPrefix(word, q),
+			utf8.RuneCountInString(word) >= minTermLength && strings.HasPrefix(q, word):
+			return true
+		}
+		if edits := maxEdits(q, h.fuzziness); edits > 0 && distance(q, word, edits) <= edits {
+			return true
+		}
+	}
+	return false
+}
+
+// Mark returns text, HTML-escaped, with its matching words in <mark>
+// tags, and whether any matched.
+func (h *Highlighter) Mark(text string) (string, bool) {
+	words := spans(text)
+	return h.mark(text, words, 0, len(words))
+}
+
+// Snippet is Mark for at most snippetWords words of text around the
+// first match, with an ellipsis where text is cut.
+func (h *Highlighter) Snippet(text string) (string, bool) {
+	words := spans(text)
+	first := -1
+	for i, s := range words {
+		if h.matches(strings.ToLower(text[s.start:s.end])) {
+			first = i
+			break
+		}
+	}
+	if first < 0 {
+		return "", false
+	}
+	// A few words of context before the match.
+	from := max(0, min(first-snippetWords/4, len(words)-snippetWords))
+	to := min(len(words), from+snippetWords)
+	return h.mark(text, words, from, to)
+}
+
+// mark renders words[from:to] of text, with what lies between them.
+func (h *Highlighter) mark(text string, words []span, from, to int) (string, bool) {
+	var b strings.Builder
+	start, end := 0, len(text)
+	if from > 0 {
+		start = words[from].start
+		b.WriteString("…")
+	}
+	if to < len(words) {
+		end = words[to-1].end
+	}
+	found := false
+	pos := start
+	for _, s := range words[from:to] {
+		b.WriteString(html.EscapeString(text[pos:s.start]))
+		word := text[s.start:s.end]
+		if h.matches(strings.ToLower(word)) {
+			found = true
+			b.WriteString("<mark>" + html.EscapeString(word) + "</mark>")
+		} else {
+			b.WriteString(html.EscapeString(word))
+		}
+		pos = s.end
+	}
+	b.WriteString(html.EscapeString(text[pos:end]))
+	if to < len(words) {
+		b.WriteString("…")
+	}
+	return b.String(), found
+}
@@ -0,0 +1,114 @@
+package fulltext
+
+import (
+	"context"
+	"database/sql"
+	"naevis/compression"
+	"naevis/routing"
+	"naevis/sqlguard"
+	"naevis/structs"
+	"time"
+)
+
+// Statements reading the events of a tenant in the schema %[1]s, of the
+// entity type passed twice or of all when it is empty.
+var (
+	reindexSQL = sqlguard.NewSchemaTemplate(`
+	SELECT r.id, IFNULL(et.value, ''), IFNULL(r.entity_id, ''), r.tenant, r.additional_info
+	FROM %[1]s.event_rows r LEFT JOIN main.dictionary et ON et.id = r.entity_type_id
+	WHERE r.id > ? AND r.tenant = ? AND (? = '' OR et.value = ?)
+	ORDER BY r.id LIMIT ?;`)
+	reindexCountSQL = sqlguard.NewSchemaTemplate(`
+	SELECT COUNT(*)
+	FROM %[1]s.event_rows r LEFT JOIN main.dictionary et ON et.id = r.entity_type_id
+	WHERE r.tenant = ? AND (? = '' OR et.value = ?);`)
+)
+
+// pending is a stored event to index.
+type pending struct {
+	id    int64
+	event structs.Index
+	info  compression.Text
+}
+
+// scanPending reads and closes rows of missingSQL or reindexSQL.
+func scanPending(rows *sql.Rows) ([]pending, error) {
+	defer rows.Close()
+	var batch []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.event.EntityType, &p.event.EntityId, &p.event.Tenant, &p.info); err != nil {
+			return nil, err
+		}
+		batch = append(batch, p)
+	}
+	return batch, rows.Err()
+}
+
+// indexPending indexes batch in one transaction.
+func indexPending(db *sql.DB, batch []pending) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, p := range batch {
+		if err := Index(tx, p.id, p.event, string(p.info)); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Reindex indexes the stored events of tenant again, of entityType or of
+// every entity type when it is empty, repairing their entries. progress
+// is called after every batch with the events indexed and the total. It
+// stops early when ctx is cancelled.
+func Reindex(ctx context.Context, db *sql.DB, tenant, entityType string, progress func(done, total int64)) (int64, error) {
+	schemas := routing.Schemas()
+	if entityType != "" {
+		schemas = []string{routing.Schema(entityType)}
+	}
+	var total int64
+	for _, schema := range schemas {
+		var n int64
+		if err := db.QueryRowContext(ctx, reindexCountSQL.Format(schema),
+			tenant, entityType, entityType).Scan(&n); err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	progress(0, total)
+
+	var done int64
+	for _, schema := range schemas {
+		var after int64
+		for {
+			rows, err := db.QueryContext(ctx, reindexSQL.Format(schema),
+				after, tenant, entityType, entityType, backfillBatch)
+			if err != nil {
+				return done, err
+			}
+			batch, err := scanPending(rows)
+			if err != nil {
+				return done, err
+			}
+			if len(batch) == 0 {
+				break
+			}
+			if err := indexPending(db, batch); err != nil {
+				return done, err
+			}
+			after = batch[len(batch)-1].id
+			done += int64(len(batch))
+			progress(done, max(total, done))
+
+			select {
+			case <-ctx.Done():
+				return done, ctx.Err()
+			case <-time.After(backfillPause):
+			}
+		}
+	}
+	return done, nil
+}
@@ -0,0 +1,187 @@
+package fulltext
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"naevis/apierror"
+	"naevis/routing"
+	"naevis/sqlguard"
+	"naevis/structs"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultSuggestions = 10
+	maxSuggestions     = 50
+	// maxCandidates caps the names read per prefix before ranking, so a
+	// one-letter prefix costs no more than a longer one.
+	maxCandidates = 1000
+)
+
+// Statements on the entity_names prefix index of the schema %[1]s. Names
+// are keyed by nameKey, so a prefix is a range of keys.
+var (
+	// nameSQL keeps the latest name of an entity and counts its named
+	// events; reindexing an event does not count it again.
+	nameSQL = sqlguard.NewSchemaTemplate(`
+	INSERT INTO %[1]s.entity_names (entity_type, tenant, entity_id, name, key, events, event_id)
+	VALUES (?, ?, ?, ?, ?, 1, ?)
+	ON CONFLICT (entity_type, tenant, entity_id) DO UPDATE SET
+		name = excluded.name, key = excluded.key,
+		events = events + (excluded.event_id != event_id), event_id = excluded.event_id;`)
+	// suggestSQL reads the first candidates in key order, which the
+	// entity_names_key index serves, then ranks them by events.
+	suggestSQL = sqlguard.NewSchemaTemplate(`
+	SELECT entity_id, name FROM (
+		SELECT entity_id, name, key, events FROM %[1]s.entity_names
+		WHERE entity_type = ? AND tenant = ? AND key >= ? AND key < ?
+		ORDER BY key LIMIT ?
+	)
+	ORDER BY events DESC, key LIMIT ?;`)
+	// namedSQL lists the named entities of an index whose names have not
+	// been backfilled, with the name of their latest event.
+	namedSQL = sqlguard.NewSchemaTemplate(`
+	SELECT entity_type, entity_id, tenant, name, MAX(rowid), COUNT(*) FROM %[1]s.events_fts
+	WHERE name != '' AND entity_id != '' AND NOT EXISTS (SELECT 1 FROM %[1]s.entity_names)
+	GROUP BY entity_type, entity_id, tenant;`)
+	backfillNameSQL = sqlguard.NewSchemaTemplate(`
+	INSERT OR IGNORE INTO %[1]s.entity_names (entity_type, tenant, entity_id, name, key, events, event_id)
+	VALUES (?, ?, ?, ?, ?, ?, ?);`)
+)
+
+// nameKey normalizes a name, or a prefix of one, for prefix matching:
+// lower case, with runs of spaces collapsed.
+func nameKey(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// indexName records the name of an entity in the prefix index.
+func indexName(tx *sql.Tx, schema string, id int64, entityType, tenant, entityId, name string) error {
+	if name == "" || entityId == "" {
+		return nil
+	}
+	_, err := tx.Exec(nameSQL.Format(schema),
+		entityType, tenant, entityId, name, nameKey(name), id)
+	return err
+}
+
+// Suggester completes entity names as they are typed.
+type Suggester struct {
+	db *sql.DB
+}
+
+// NewSuggester creates a Suggester.
+func NewSuggester(db *sql.DB) *Suggester {
+	return &Suggester{db: db}
+}
+
+// ServeHTTP handles GET /suggest/{ENTITY_TYPE}?q=PREFIX&limit=N for the
+// caller's tenant, listing the entities whose name starts with the prefix,
+// those with the most events first.
+func (s *Suggester) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apierror.Write(w, "Only GET requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	entityType := strings.Trim(strings.TrimPrefix(r.URL.Path, "/suggest/"), "/")
+	if entityType == "" || strings.Contains(entityType, "/") {
+		apierror.Write(w, "Use /suggest/{ENTITY_TYPE}", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	prefix := nameKey(q.Get("q"))
+	if prefix == "" {
+		apierror.Write(w, "Missing q parameter", http.StatusBadRequest)
+		return
+	}
+	limit := defaultSuggestions
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			apierror.Write(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxSuggestions)
+	}
+
+	items, err := s.Suggest(entityType, r.Header.Get("X-Tenant-ID"), prefix, limit)
+	if err != nil {
+		log.Printf("Error suggesting %s names: %v", entityType, err)
+		apierror.Write(w, "Failed to load suggestions", http.StatusInternalServerError)
+		return
+	}
+	response, err := json.Marshal(items)
+	if err != nil {
+		apierror.Write(w, "Error encoding JSON", http.StatusInternalServerError)
+		return
+	}
+	// Typing back over a prefix asks for it again.
+	w.Header().Set("Cache-Control", "private, max-age=30")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// Suggest returns at most limit entities of entityType and tenant whose
+// name starts with prefix, a nameKey.
+func (s *Suggester) Suggest(entityType, tenant, prefix string, limit int) ([]structs.Suggestion, error) {
+	// No valid UTF-8 contains 0xFF, so every key starting with prefix sorts
+	// below prefix+"\xff".
+	rows, err := s.db.Query(suggestSQL.Format(routing.Schema(entityType)),
+		entityType, tenant, prefix, prefix+"\xff", maxCandidates, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []structs.Suggestion{}
+	for rows.Next() {
+		var item structs.Suggestion
+		if err := rows.Scan(&item.EntityId, &item.Name); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// backfillNames fills the prefix index of schema from its full-text index
+// once, when the prefix index is new.
+func (b *Backfill) backfillNames(schema string) (int, error) {
+	type row struct {
+		entityType, entityId, tenant, name string
+		id, events                         int64
+	}
+	rows, err := b.db.Query(namedSQL.Format(schema))
+	if err != nil {
+		return 0, err
+	}
+	var named []row
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.entityType, &r.entityId, &r.tenant, &r.name, &r.id, &r.events); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		named = append(named, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(named) == 0 {
+		return 0, err
+	}
+
+	tx, err := b.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	for _, r := range named {
+		if _, err := tx.Exec(backfillNameSQL.Format(schema),
+			r.entityType, r.tenant, r.entityId, r.name, nameKey(r.name), r.events, r.id); err != nil {
+			return 0, err
+		}
+	}
+	return len(named), tx.Commit()
+}
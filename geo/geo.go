@@ -0,0 +1,86 @@
+// Package geo measures distances between points on the Earth for
+// searches near a place.
+package geo
+
+import (
+	"errors"
+	"math"
+	"naevis/structs"
+	"strconv"
+	"strings"
+)
+
+// earthRadiusKm is the mean radius of the Earth.
+const earthRadiusKm = 6371.0
+
+// DistanceKm is the great-circle distance between a and b, by the
+// haversine formula.
+func DistanceKm(a, b structs.Point) float64 {
+	lat1, lat2 := radians(a.Lat), radians(b.Lat)
+	dLat, dLng := lat2-lat1, radians(b.Lng-a.Lng)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+func radians(deg float64) float64 {
+	return deg * math.Pi / 180
+}
+
+// Box is a latitude and longitude range.
+type Box struct {
+	MinLat, MaxLat, MinLng, MaxLng float64
+	// Wraps means the longitude range crosses the antimeridian, so
+	// longitudes below MaxLng or above MinLng are inside.
+	Wraps bool
+}
+
+// BoxAround returns a box holding every point within radiusKm of center,
+// for cheap filtering before measuring distances. Near a pole it spans
+// every longitude.
+func BoxAround(center structs.Point, radiusKm float64) Box {
+	dLat := radiusKm / earthRadiusKm * 180 / math.Pi
+	b := Box{MinLat: math.Max(center.Lat-dLat, -90), MaxLat: math.Min(center.Lat+dLat, 90), MinLng: -180, MaxLng: 180}
+	if b.MinLat == -90 || b.MaxLat == 90 {
+		return b
+	}
+	dLng := dLat / math.Cos(radians(center.Lat))
+	if dLng >= 180 {
+		return b
+	}
+	b.MinLng, b.MaxLng = center.Lng-dLng, center.Lng+dLng
+	switch {
+	case b.MinLng < -180:
+		b.MinLng, b.Wraps = b.MinLng+360, true
+	case b.MaxLng > 180:
+		b.MaxLng, b.Wraps = b.MaxLng-360, true
+	}
+	return b
+}
+
+// ParsePoint parses "LAT,LNG" in degrees.
+func ParsePoint(s string) (structs.Point, error) {
+	lat, lng, ok := strings.Cut(s, ",")
+	if !ok {
+		return structs.Point{}, errors.New("want LAT,LNG")
+	}
+	var p structs.Point
+	var err error
+	if p.Lat, err = strconv.ParseFloat(strings.TrimSpace(lat), 64); err != nil || math.IsNaN(p.Lat) || p.Lat < -90 || p.Lat > 90 {
+		return structs.Point{}, errors.New("latitude must be between -90 and 90")
+	}
+	if p.Lng, err = strconv.ParseFloat(strings.TrimSpace(lng), 64); err != nil || math.IsNaN(p.Lng) || p.Lng < -180 || p.Lng > 180 {
+		return structs.Point{}, errors.New("longitude must be between -180 and 180")
+	}
+	return p, nil
+}
+
+// Within reports whether a result at lat and lng, which may be nil, lies
+// within radiusKm of center, and how far it is. A zero radius does not
+// limit the distance.
+func Within(center structs.Point, radiusKm float64, lat, lng *float64) (float64, bool) {
+	if lat == nil || lng == nil {
+		return 0, false
+	}
+	d := DistanceKm(center, structs.Point{Lat: *lat, Lng: *lng})
+	return d, radiusKm == 0 || d <= radiusKm
+}
@@ -0,0 +1,219 @@
+package gossip
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"naevis/apierror"
+	"naevis/ingest"
+	"naevis/jobs"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statusTimeout bounds the wait for a peer's status.
+const statusTimeout = 5 * time.Second
+
+// started is when this instance started.
+var started = time.Now().UTC()
+
+// Status is the health of one instance. Database is "ok" or the error
+// pinging it. Metrics, the instance's expvar maps, are only included when
+// drilling down into it.
+type Status struct {
+	StartedAt   time.Time                  `json:"started_at"`
+	HealthScore int                        `json:"health_score"`
+	Database    string                     `json:"database"`
+	Ingest      Ingest                     `json:"ingest"`
+	Jobs        []jobs.Status              `json:"jobs"`
+	Metrics     map[string]json.RawMessage `json:"metrics,omitempty"`
+}
+
+// Ingest is an instance's ingest counters.
+type Ingest struct {
+	Stored    int64 `json:"stored"`
+	PerMinute int64 `json:"per_minute"`
+}
+
+// Node is a member with its status, or the error fetching it.
+type Node struct {
+	Member
+	Status *Status `json:"status,omitempty"`
+	Error  string  `json:"error,omitempty"`
+}
+
+// Totals sum the status of the members reached.
+type Totals struct {
+	Members         int   `json:"members"`
+	Alive           int   `json:"alive"`
+	Unreachable     int   `json:"unreachable"`
+	Stored          int64 `json:"stored"`
+	IngestPerMinute int64 `json:"ingest_per_minute"`
+}
+
+// AdminHandler handles GET /admin/node, the status of this instance (with
+// its metrics with ?metrics=1); GET /admin/cluster, the status of every
+// member this instance knows of, gone ones included, and their totals;
+// and GET /admin/cluster/{NAME}, the status of one member with its
+// metrics. Peers are asked for their status with the caller's
+// credentials.
+func (c *Cluster) AdminHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apierror.Write(w, "Only GET requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.URL.Path == "/admin/node" {
+		writeJSON(w, c.status(r.Context(), r.URL.Query().Get("metrics") == "1"))
+		return
+	}
+
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/cluster"), "/")
+	if name != "" {
+		c.mu.Lock()
+		m, ok := c.members[name]
+		var member Member
+		if ok {
+			member = *m
+		}
+		c.mu.Unlock()
+		if !ok {
+			apierror.Write(w, "Unknown member", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, c.node(r, member, true))
+		return
+	}
+
+	c.mu.Lock()
+	members := make([]Member, 0, len(c.members))
+	for _, m := range c.members {
+		members = append(members, *m)
+	}
+	c.mu.Unlock()
+	sort.Slice(members, func(i, j int) bool { return members[i].Name < members[j].Name })
+
+	nodes := make([]Node, len(members))
+	var wg sync.WaitGroup
+	for i, m := range members {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			nodes[i] = c.node(r, m, false)
+		}()
+	}
+	wg.Wait()
+
+	totals := Totals{Members: len(nodes)}
+	for _, n := range nodes {
+		if n.State == alive {
+			totals.Alive++
+		}
+		if n.Status == nil {
+			if n.State == alive {
+				totals.Unreachable++
+			}
+			continue
+		}
+		totals.Stored += n.Status.Ingest.Stored
+		totals.IngestPerMinute += n.Status.Ingest.PerMinute
+	}
+
+	writeJSON(w, struct {
+		Self         string `json:"self"`
+		ShardVersion int64  `json:"shard_version"`
+		Totals       Totals `json:"totals"`
+		Nodes        []Node `json:"nodes"`
+	}{c.router.Self(), c.router.Assignment().Version, totals, nodes})
+}
+
+// node returns member with its status: this instance's own, or fetched
+// from the member if it is alive.
+func (c *Cluster) node(r *http.Request, member Member, detail bool) Node {
+	n := Node{Member: member}
+	switch {
+	case member.Self:
+		s := c.status(r.Context(), detail)
+		n.Status = &s
+	case member.State == alive:
+		s, err := c.fetch(r, member.URL, detail)
+		if err != nil {
+			n.Error = err.Error()
+		} else {
+			n.Status = s
+		}
+	}
+	return n
+}
+
+// status returns the status of this instance.
+func (c *Cluster) status(ctx context.Context, detail bool) Status {
+	s := Status{
+		StartedAt:   started,
+		HealthScore: c.list.GetHealthScore(),
+		Database:    "ok",
+		Ingest:      Ingest{Stored: ingest.Total(), PerMinute: ingest.PerMinute()},
+		Jobs:        jobs.List(),
+	}
+	ctx, cancel := context.WithTimeout(ctx, statusTimeout)
+	defer cancel()
+	if err := c.db.PingContext(ctx); err != nil {
+		s.Database = err.Error()
+	}
+	if detail {
+		s.Metrics = make(map[string]json.RawMessage)
+		expvar.Do(func(kv expvar.KeyValue) {
+			if _, ok := kv.Value.(*expvar.Map); ok {
+				s.Metrics[kv.Key] = json.RawMessage(kv.Value.String())
+			}
+		})
+	}
+	return s
+}
+
+// fetch asks the instance at base for its status.
+func (c *Cluster) fetch(r *http.Request, base string, detail bool) (*Status, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	u = u.JoinPath("/admin/node")
+	if detail {
+		u.RawQuery = "metrics=1"
+	}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", r.Header.Get("Authorization"))
+	resp, err := c.client.Do(req)
+	if err != nil {
+		metrics.Add("status_errors", 1)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		metrics.Add("status_errors", 1)
+		return nil, fmt.Errorf("status returned %s", resp.Status)
+	}
+	var s Status
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	response, err := json.Marshal(v)
+	if err != nil {
+		apierror.Write(w, "Error encoding JSON", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
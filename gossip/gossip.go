@@ -0,0 +1,312 @@
+// Package gossip finds the other instances of a deployment with the
+// memberlist gossip protocol, so they need not be listed in every config.
+// Live members, and the base URLs they advertise, become the instances
+// tenants are sharded over, and the shard map with the highest version
+// spreads from instance to instance.
+package gossip
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"naevis/config"
+	"naevis/shards"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/quic-go/quic-go/http3"
+)
+
+const (
+	// joinRetry is the pause between attempts to join the cluster, as the
+	// instances listed may start later.
+	joinRetry = 10 * time.Second
+	// leaveTimeout bounds the wait for the others to learn this instance
+	// is leaving.
+	leaveTimeout = 5 * time.Second
+)
+
+// metrics counts members joining, leaving and changing, shard maps
+// adopted, failed join attempts, peers whose status could not be fetched
+// and messages that could not be sent, published under "gossip" in
+// expvar.
+var metrics = expvar.NewMap("gossip")
+
+// meta is what an instance tells the others about itself.
+type meta struct {
+	URL string `json:"url"`
+}
+
+// Member is an instance as this one knows it.
+type Member struct {
+	Name    string    `json:"name"`
+	Address string    `json:"address"`
+	URL     string    `json:"url"`
+	State   string    `json:"state"`
+	Since   time.Time `json:"since"`
+	Self    bool      `json:"self"`
+}
+
+// Cluster is this instance's membership of the cluster.
+type Cluster struct {
+	list   *memberlist.Memberlist
+	router *shards.Router
+	db     *sql.DB
+	client *http.Client
+	join   []string
+	meta   []byte
+
+	mu       sync.Mutex
+	members  map[string]*Member
+	handlers map[byte]func(msg []byte)
+}
+
+// New starts gossiping on cfg.Bind as the instance router serves, which
+// must have a name. It returns nil when discovery is off.
+func New(cfg config.Gossip, router *shards.Router, db *sql.DB) (*Cluster, error) {
+	if cfg.Bind == "" {
+		return nil, nil
+	}
+	if router.Self() == "" {
+		return nil, fmt.Errorf("gossip needs shards.self to name this instance")
+	}
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("gossip needs the base URL of this instance")
+	}
+	m, err := json.Marshal(meta{URL: cfg.URL})
+	if err != nil {
+		return nil, err
+	}
+	c := &Cluster{
+		router: router,
+		db:     db,
+		// Instances only speak QUIC.
+		client: &http.Client{
+			Transport: &http3.Transport{},
+			Timeout:   statusTimeout,
+		},
+		join:     cfg.Join,
+		meta:     m,
+		members:  make(map[string]*Member),
+		handlers: make(map[byte]func([]byte)),
+	}
+
+	conf := memberlist.DefaultLANConfig()
+	conf.Name = router.Self()
+	conf.Delegate = c
+	conf.Events = c
+	conf.Logger = log.New(logWriter{}, "", 0)
+	if conf.BindAddr, conf.BindPort, err = hostPort(cfg.Bind); err != nil {
+		return nil, fmt.Errorf("bind: %v", err)
+	}
+	if cfg.Advertise != "" {
+		if conf.AdvertiseAddr, conf.AdvertisePort, err = hostPort(cfg.Advertise); err != nil {
+			return nil, fmt.Errorf("advertise: %v", err)
+		}
+	}
+	if cfg.Key != "" {
+		if conf.SecretKey, err = base64.StdEncoding.DecodeString(cfg.Key); err != nil {
+			return nil, fmt.Errorf("key: %v", err)
+		}
+	}
+
+	if c.list, err = memberlist.Create(conf); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// hostPort splits a "host:port" address.
+func hostPort(addr string) (string, int, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port %q", port)
+	}
+	return host, p, nil
+}
+
+// Run joins the cluster through the instances listed in the config,
+// retrying until one answers, and leaves it when ctx is cancelled.
+func (c *Cluster) Run(ctx context.Context) {
+	for len(c.join) > 0 {
+		_, err := c.list.Join(c.join)
+		if err == nil {
+			break
+		}
+		metrics.Add("join_errors", 1)
+		log.Printf("Error joining cluster: %v", err)
+
+		select {
+		case <-ctx.Done():
+			c.list.Shutdown()
+			return
+		case <-time.After(joinRetry):
+		}
+	}
+
+	<-ctx.Done()
+	if err := c.list.Leave(leaveTimeout); err != nil {
+		log.Printf("Error leaving cluster: %v", err)
+	}
+	c.list.Shutdown()
+}
+
+// NodeMeta implements memberlist.Delegate.
+func (c *Cluster) NodeMeta(limit int) []byte {
+	return c.meta
+}
+
+// Subscribe has fn receive the messages of kind that peers Broadcast.
+func (c *Cluster) Subscribe(kind byte, fn func(msg []byte)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handlers[kind] = fn
+}
+
+// Broadcast sends msg, of kind, to every other live member over TCP.
+// Members that cannot be reached miss it.
+func (c *Cluster) Broadcast(kind byte, msg []byte) {
+	buf := append([]byte{kind}, msg...)
+	var wg sync.WaitGroup
+	for _, n := range c.list.Members() {
+		if n.Name == c.router.Self() {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.list.SendReliable(n, buf); err != nil {
+				metrics.Add("send_errors", 1)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// NotifyMsg implements memberlist.Delegate, passing messages to the
+// handler of their kind.
+func (c *Cluster) NotifyMsg(buf []byte) {
+	if len(buf) == 0 {
+		return
+	}
+	c.mu.Lock()
+	fn := c.handlers[buf[0]]
+	c.mu.Unlock()
+	if fn != nil {
+		fn(append([]byte(nil), buf[1:]...))
+	}
+}
+
+// GetBroadcasts implements memberlist.Delegate.
+func (c *Cluster) GetBroadcasts(overhead, limit int) [][]byte {
+	return nil
+}
+
+// LocalState implements memberlist.Delegate. The shard map is exchanged
+// whenever two instances sync their state.
+func (c *Cluster) LocalState(join bool) []byte {
+	state, err := json.Marshal(c.router.Assignment())
+	if err != nil {
+		return nil
+	}
+	return state
+}
+
+// MergeRemoteState implements memberlist.Delegate, adopting the remote
+// shard map if it is newer.
+func (c *Cluster) MergeRemoteState(buf []byte, join bool) {
+	var m shards.Map
+	if err := json.Unmarshal(buf, &m); err != nil {
+		log.Printf("Error decoding gossiped shard map: %v", err)
+		return
+	}
+	adopted, err := c.router.Adopt(m)
+	if err != nil {
+		log.Printf("Error adopting gossiped shard map: %v", err)
+		return
+	}
+	if adopted {
+		metrics.Add("maps_adopted", 1)
+		log.Printf("Adopted shard map version %d", m.Version)
+	}
+}
+
+// Member states. The State of the nodes memberlist passes to NotifyLeave
+// is not updated, so departed members are not told apart from failed ones.
+const (
+	alive = "alive"
+	gone  = "gone"
+)
+
+// NotifyJoin implements memberlist.EventDelegate.
+func (c *Cluster) NotifyJoin(n *memberlist.Node) {
+	metrics.Add("joins", 1)
+	c.update(n, alive)
+}
+
+// NotifyLeave implements memberlist.EventDelegate, called when a member
+// leaves or is found dead.
+func (c *Cluster) NotifyLeave(n *memberlist.Node) {
+	metrics.Add("leaves", 1)
+	c.update(n, gone)
+}
+
+// NotifyUpdate implements memberlist.EventDelegate.
+func (c *Cluster) NotifyUpdate(n *memberlist.Node) {
+	metrics.Add("updates", 1)
+	c.update(n, alive)
+}
+
+// update records the state of n and gives the router the live members.
+func (c *Cluster) update(n *memberlist.Node, state string) {
+	var m meta
+	json.Unmarshal(n.Meta, &m)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	old := c.members[n.Name]
+	if old == nil || old.State != state || old.URL != m.URL {
+		c.members[n.Name] = &Member{
+			Name:    n.Name,
+			Address: n.Address(),
+			URL:     m.URL,
+			State:   state,
+			Since:   time.Now().UTC(),
+			Self:    n.Name == c.router.Self(),
+		}
+	}
+
+	live := make(map[string]string)
+	for _, member := range c.members {
+		if member.State == alive && member.URL != "" {
+			live[member.Name] = member.URL
+		}
+	}
+	if err := c.router.SetMembers(live); err != nil {
+		log.Printf("Error updating shard members: %v", err)
+	}
+}
+
+// logWriter passes memberlist's log lines to the standard logger, less
+// its debug lines.
+type logWriter struct{}
+
+func (logWriter) Write(p []byte) (int, error) {
+	if !bytes.Contains(p, []byte("[DEBUG]")) {
+		log.Print(string(bytes.TrimRight(p, "\n")))
+	}
+	return len(p), nil
+}
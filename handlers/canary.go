@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"naevis/flags"
+	"naevis/geo"
+	"naevis/structs"
+	"slices"
+	"time"
+)
+
+// CanaryFlag is the feature flag selecting requests for the canary search
+// engine. Set its percent to control the share of /events/{type} traffic.
+const CanaryFlag = "search_canary"
+
+// Engine answers searches for one entity type, returning the page p of
+// the results passing filter.
+type Engine interface {
+	Search(ctx context.Context, entityType, query string, filter structs.Filter, p structs.Paging) (structs.Matches, error)
+}
+
+// EngineFunc adapts a function to Engine.
+type EngineFunc func(ctx context.Context, entityType, query string, filter structs.Filter, p structs.Paging) (structs.Matches, error)
+
+func (f EngineFunc) Search(ctx context.Context, entityType, query string, filter structs.Filter, p structs.Paging) (structs.Matches, error) {
+	return f(ctx, entityType, query, filter, p)
+}
+
+// catalog is the original search path. The catalog is small, so it is
+// filtered, sorted and paged in memory.
+var catalog = EngineFunc(func(_ context.Context, entityType, query string, filter structs.Filter, p structs.Paging) (structs.Matches, error) {
+	results := []structs.Result{}
+	for _, r := range GetResultsOfType(entityType, query) {
+		if matches(filter, r) {
+			results = append(results, r)
+		}
+	}
+	if filter.Near != nil {
+		for i := range results {
+			if d, ok := geo.Within(*filter.Near, 0, results[i].Latitude, results[i].Longitude); ok {
+				results[i].DistanceKm = &d
+			}
+		}
+	}
+	sortResults(results, p.Sort)
+	total := int64(len(results))
+	start := min(p.Offset, total)
+	end := min(start+p.Limit, total)
+	return structs.Matches{Results: results[start:end], Total: total, Facets: countFacets(p.Facets, results)}, nil
+})
+
+// canaryStats are published under "search_canary" in /admin/vars.
+var canaryStats = expvar.NewMap("search_canary")
+
+// search runs the query on the primary engine, or for requests selected
+// by CanaryFlag on the canary engine while the primary runs alongside for
+// comparison. Canary results are served unless the canary fails.
+func (s *Search) search(ctx context.Context, entityType, query string, filter structs.Filter, p structs.Paging) (structs.Matches, error) {
+	if s.canary == nil || !flags.Enabled(ctx, CanaryFlag) {
+		return s.engine.Search(ctx, entityType, query, filter, p)
+	}
+	canaryStats.Add("requests", 1)
+
+	type outcome struct {
+		results structs.Matches
+		err     error
+		took    time.Duration
+	}
+	run := func(e Engine) outcome {
+		start := time.Now()
+		results, err := e.Search(ctx, entityType, query, filter, p)
+		return outcome{results, err, time.Since(start)}
+	}
+
+	primaryDone := make(chan outcome, 1)
+	go func() { primaryDone <- run(s.engine) }()
+	canary := run(s.canary)
+	primary := <-primaryDone
+
+	canaryStats.Add("primary_ns", int64(primary.took))
+	canaryStats.Add("canary_ns", int64(canary.took))
+	if canary.err != nil {
+		canaryStats.Add("errors", 1)
+		log.Printf("Error in canary search for %s %q, serving primary: %v", entityType, query, canary.err)
+		return primary.results, primary.err
+	}
+	if primary.err == nil && !slices.Equal(resultIDs(primary.results.Results), resultIDs(canary.results.Results)) {
+		canaryStats.Add("divergences", 1)
+		log.Printf("Canary search diverged for %s %q: primary %v in %v, canary %v in %v",
+			entityType, query, resultIDs(primary.results.Results), primary.took, resultIDs(canary.results.Results), canary.took)
+	}
+	return canary.results, nil
+}
+
+func resultIDs(results []structs.Result) []string {
+	ids := make([]string, len(results))
+	for i, r := range results {
+		ids[i] = r.ID
+	}
+	return ids
+}
@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"math"
+	"naevis/fulltext"
+	"naevis/structs"
+	"net/url"
+	"testing"
+)
+
+// FuzzSearchParams checks that any query string of a search parses
+// without panicking, that an accepted filter is within the documented
+// bounds, and that it can be checked against any result.
+func FuzzSearchParams(f *testing.F) {
+	f.Add("query=cafe&from=2024-01-01&to=2024-02-01&min_price=1.5&sort=price:desc&facets=category,type", "2024-01-15", "3")
+	f.Add("near=52.52,13.40&radius_km=5&fuzziness=2&sort=distance", "", "")
+	f.Add("near=NaN,0&radius_km=Inf&min_price=-0&facets=,", "2024", "x")
+	f.Add("from=2024-13-01&sort=:&facets=type,type", "\xff", "1e400")
+
+	f.Fuzz(func(t *testing.T, query, date, price string) {
+		q, err := url.ParseQuery(query)
+		if err != nil {
+			return
+		}
+		parseSort(q.Get("sort"))
+		parseFacets(q.Get("facets"))
+		filter, err := parseFilter(q)
+		if err != nil {
+			return
+		}
+
+		if filter.Fuzziness < 0 || filter.Fuzziness > fulltext.MaxFuzziness {
+			t.Fatalf("fuzziness %d accepted", filter.Fuzziness)
+		}
+		if p := filter.Near; p != nil && !(p.Lat >= -90 && p.Lat <= 90 && p.Lng >= -180 && p.Lng <= 180) {
+			t.Fatalf("near %+v accepted", *p)
+		}
+		if filter.RadiusKm < 0 || math.IsNaN(filter.RadiusKm) || math.IsInf(filter.RadiusKm, 0) {
+			t.Fatalf("radius_km %v accepted", filter.RadiusKm)
+		}
+		for _, p := range []*float64{filter.MinPrice, filter.MaxPrice} {
+			if p != nil && (math.IsNaN(*p) || math.IsInf(*p, 0)) {
+				t.Fatalf("price %v accepted", *p)
+			}
+		}
+
+		lat, lng := 10.0, 20.0
+		matches(filter, structs.Result{Date: date, Price: price, Latitude: &lat, Longitude: &lng})
+		matches(filter, structs.Result{Date: date, Price: price})
+	})
+}
@@ -2,10 +2,29 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"math"
+	"naevis/apierror"
+	"naevis/follows"
+	"naevis/fulltext"
+	"naevis/geo"
 	"naevis/structs"
 	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
+)
+
+const (
+	defaultLimit = 20
+	maxLimit     = 100
+	// maxFacetValues caps the values listed per facet.
+	maxFacetValues = 100
 )
 
 // Function to get results based on entity type
@@ -26,6 +45,8 @@ func GetResultsOfType(entityType string, query string) []structs.Result {
 				Description: "A conference on Go and Zig programming languages.",
 				Image:       "https://example.com/event.jpg",
 				Link:        "https://eventsite.com/register",
+				Latitude:    coord(37.7842),
+				Longitude:   coord(-122.4016),
 			},
 			structs.Result{
 				Type:        "event",
@@ -38,6 +59,8 @@ func GetResultsOfType(entityType string, query string) []structs.Result {
 				Description: "The biggest AI event of the year!",
 				Image:       "https://example.com/ai_summit.jpg",
 				Link:        "https://aisummit.com",
+				Latitude:    coord(37.3875),
+				Longitude:   coord(-122.0575),
 			},
 		)
 
@@ -53,6 +76,8 @@ func GetResultsOfType(entityType string, query string) []structs.Result {
 				Description: "A beautiful park in the city center.",
 				Image:       "https://example.com/central_park.jpg",
 				Link:        "https://maps.google.com?q=Central+Park",
+				Latitude:    coord(40.7829),
+				Longitude:   coord(-73.9654),
 			},
 			structs.Result{
 				Type:        "place",
@@ -64,6 +89,8 @@ func GetResultsOfType(entityType string, query string) []structs.Result {
 				Description: "One of the most breathtaking canyons in the world.",
 				Image:       "https://example.com/grand_canyon.jpg",
 				Link:        "https://maps.google.com?q=Grand+Canyon",
+				Latitude:    coord(36.1069),
+				Longitude:   coord(-112.1129),
 			},
 		)
 
@@ -104,6 +131,8 @@ func GetResultsOfType(entityType string, query string) []structs.Result {
 				Description: "A startup focused on AI and cloud computing.",
 				Image:       "https://example.com/technova.jpg",
 				Link:        "https://technova.com",
+				Latitude:    coord(37.3875),
+				Longitude:   coord(-122.0575),
 			},
 			structs.Result{
 				Type:        "business",
@@ -116,6 +145,8 @@ func GetResultsOfType(entityType string, query string) []structs.Result {
 				Description: "Leading organic food supplier with sustainable farming practices.",
 				Image:       "https://example.com/greenfoods.jpg",
 				Link:        "https://greenfoods.com",
+				Latitude:    coord(34.0522),
+				Longitude:   coord(-118.2437),
 			},
 		)
 
@@ -129,12 +160,56 @@ func GetResultsOfType(entityType string, query string) []structs.Result {
 	return resarr
 }
 
-// GetEventsByTypeHandler handles requests to /events/{ENTITY_TYPE}?query=QUERY
-func GetEventsByTypeHandler(w http.ResponseWriter, r *http.Request) {
+// coord returns a pointer to a coordinate of the catalog.
+func coord(v float64) *float64 {
+	return &v
+}
+
+// page is one page of search results. Total counts the results of the
+// whole search; Next and Prev link the neighbouring pages, if any.
+type page struct {
+	Items  []structs.Result `json:"items"`
+	Total  int64            `json:"total"`
+	Limit  int64            `json:"limit"`
+	Offset int64            `json:"offset"`
+	Next   string           `json:"next,omitempty"`
+	Prev   string           `json:"prev,omitempty"`
+	Facets []structs.Facet  `json:"facets,omitempty"`
+}
+
+// Search serves search results annotated with follower counts.
+type Search struct {
+	follows *follows.Service
+	engine  Engine
+	canary  Engine
+}
+
+// NewSearch creates a Search over the built-in catalog. f may be nil, in
+// which case every result has zero followers.
+func NewSearch(f *follows.Service) *Search {
+	return &Search{follows: f, engine: catalog}
+}
+
+// SetCanary sets the engine that requests selected by CanaryFlag are
+// routed to.
+func (s *Search) SetCanary(e Engine) {
+	s.canary = e
+}
+
+// GetEventsByTypeHandler handles requests to
+// /events/{ENTITY_TYPE}?query=QUERY&limit=N&offset=N, optionally filtered
+// with from and to (YYYY-MM-DD), category, location, and min_price and
+// max_price, and sorted with sort=FIELD:asc|desc. fuzziness=0..2 lets each
+// query word have as many typos. facets=FIELD,... counts the filtered
+// results per value of each field, for filter sidebars. highlight=true
+// marks where the query matched in each result. near=LAT,LNG keeps the
+// results with coordinates, within radius_km of it if given, nearest
+// first unless sorted otherwise.
+func (s *Search) GetEventsByTypeHandler(w http.ResponseWriter, r *http.Request) {
 	// Extract ENTITY_TYPE from the URL path
 	pathParts := strings.Split(strings.TrimPrefix(r.URL.Path, "/events/"), "/")
 	if len(pathParts) == 0 || pathParts[0] == "" {
-		http.Error(w, "Missing ENTITY_TYPE in URL", http.StatusBadRequest)
+		apierror.Write(w, "Missing ENTITY_TYPE in URL", http.StatusBadRequest)
 		return
 	}
 	entityType := pathParts[0]
@@ -144,19 +219,102 @@ func GetEventsByTypeHandler(w http.ResponseWriter, r *http.Request) {
 	// Get query parameter
 	query := r.URL.Query().Get("query")
 	if query == "" {
-		http.Error(w, "Missing query parameter", http.StatusBadRequest)
+		apierror.Write(w, "Missing query parameter", http.StatusBadRequest)
 		return
 	}
 
 	if r.Method != http.MethodGet {
-		http.Error(w, "Only GET requests allowed", http.StatusMethodNotAllowed)
+		apierror.Write(w, "Only GET requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	limit, err := intParam(q.Get("limit"), defaultLimit)
+	if err != nil || limit <= 0 {
+		apierror.Write(w, "Invalid limit", http.StatusBadRequest)
+		return
+	}
+	if limit > maxLimit {
+		limit = maxLimit
+	}
+	offset, err := intParam(q.Get("offset"), 0)
+	if err != nil || offset < 0 {
+		apierror.Write(w, "Invalid offset", http.StatusBadRequest)
+		return
+	}
+
+	filter, err := parseFilter(q)
+	if err != nil {
+		apierror.Write(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	order, err := parseSort(q.Get("sort"))
+	if err != nil {
+		apierror.Write(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if filter.Near != nil && q.Get("sort") == "" {
+		order = structs.Sort{Field: "distance"}
+	}
 
-	// Convert the events slice to JSON.
-	response, err := json.Marshal(GetResultsOfType(entityType, query))
+	facets, err := parseFacets(q.Get("facets"))
 	if err != nil {
-		http.Error(w, "Error encoding JSON", http.StatusInternalServerError)
+		apierror.Write(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	highlight := false
+	if v := q.Get("highlight"); v != "" {
+		if highlight, err = strconv.ParseBool(v); err != nil {
+			apierror.Write(w, "highlight must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx := fulltext.WithTenant(r.Context(), r.Header.Get("X-Tenant-ID"))
+	found, err := s.search(ctx, entityType, query, filter, structs.Paging{Sort: order, Limit: limit, Offset: offset, Facets: facets})
+	if err != nil {
+		log.Printf("Error searching %s: %v", entityType, err)
+		apierror.Write(w, "Search failed", http.StatusInternalServerError)
+		return
+	}
+	results := append([]structs.Result{}, found.Results...)
+	if filter.Near != nil {
+		for i := range results {
+			if d, ok := geo.Within(*filter.Near, 0, results[i].Latitude, results[i].Longitude); ok {
+				results[i].DistanceKm = &d
+			}
+		}
+	}
+
+	ids := make([]string, len(results))
+	for i, res := range results {
+		ids[i] = res.ID
+	}
+	counts, err := s.follows.Counts(entityType, ids)
+	if err != nil {
+		log.Printf("Error counting followers: %v", err)
+	}
+	for i := range results {
+		results[i].Followers = counts[results[i].ID]
+	}
+	if highlight {
+		highlightResults(results, query, filter.Fuzziness)
+	}
+
+	result := page{Items: results, Total: found.Total, Limit: limit, Offset: offset, Facets: facetList(facets, found.Facets)}
+	if offset+int64(len(results)) < found.Total {
+		result.Next = pageLink(r, limit, offset+limit)
+	}
+	if offset > 0 {
+		result.Prev = pageLink(r, limit, max(offset-limit, 0))
+	}
+
+	// Convert the page to JSON.
+	response, err := json.Marshal(result)
+	if err != nil {
+		apierror.Write(w, "Error encoding JSON", http.StatusInternalServerError)
 		return
 	}
 
@@ -164,5 +322,253 @@ func GetEventsByTypeHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	w.Write(response)
+}
+
+// highlightResults marks where query matched in the name and description
+// of results.
+func highlightResults(results []structs.Result, query string, fuzziness int) {
+	h := fulltext.NewHighlighter(query, fuzziness)
+	for i := range results {
+		name, inName := h.Mark(results[i].Name)
+		description, inDescription := h.Snippet(results[i].Description)
+		if !inName && !inDescription {
+			continue
+		}
+		hl := &structs.Highlight{Description: description}
+		if inName {
+			hl.Name = name
+		}
+		results[i].Highlight = hl
+	}
+}
+
+// pageLink returns the URL of the request's page at offset.
+func pageLink(r *http.Request, limit, offset int64) string {
+	q := r.URL.Query()
+	q.Set("limit", strconv.FormatInt(limit, 10))
+	q.Set("offset", strconv.FormatInt(offset, 10))
+	return r.URL.Path + "?" + q.Encode()
+}
+
+// parseFilter reads the search filter from the query parameters.
+func parseFilter(q url.Values) (structs.Filter, error) {
+	f := structs.Filter{
+		From:     q.Get("from"),
+		To:       q.Get("to"),
+		Category: q.Get("category"),
+		Location: q.Get("location"),
+	}
+	for _, d := range []string{f.From, f.To} {
+		if _, err := time.Parse(time.DateOnly, d); d != "" && err != nil {
+			return f, fmt.Errorf("Invalid date %q, want YYYY-MM-DD", d)
+		}
+	}
+	if f.From != "" && f.To != "" && f.From > f.To {
+		return f, errors.New("Invalid date range, from is after to")
+	}
+	var err error
+	if f.MinPrice, err = priceParam(q.Get("min_price")); err != nil {
+		return f, errors.New("Invalid min_price")
+	}
+	if f.MaxPrice, err = priceParam(q.Get("max_price")); err != nil {
+		return f, errors.New("Invalid max_price")
+	}
+	if v := q.Get("fuzziness"); v != "" {
+		if f.Fuzziness, err = strconv.Atoi(v); err != nil || f.Fuzziness < 0 || f.Fuzziness > fulltext.MaxFuzziness {
+			return f, fmt.Errorf("Invalid fuzziness, want 0 to %d", fulltext.MaxFuzziness)
+		}
+	}
+	if v := q.Get("near"); v != "" {
+		near, err := geo.ParsePoint(v)
+		if err != nil {
+			return f, fmt.Errorf("Invalid near: %v", err)
+		}
+		f.Near = &near
+	}
+	if v := q.Get("radius_km"); v != "" {
+		if f.Near == nil {
+			return f, errors.New("radius_km needs near")
+		}
+		if f.RadiusKm, err = strconv.ParseFloat(v, 64); err != nil || !(f.RadiusKm > 0) || math.IsInf(f.RadiusKm, 0) {
+			return f, errors.New("Invalid radius_km")
+		}
+	}
+	return f, nil
+}
+
+func priceParam(s string) (*float64, error) {
+	if s == "" {
+		return nil, nil
+	}
+	p, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(p) || math.IsInf(p, 0) {
+		return nil, errors.New("invalid price")
+	}
+	return &p, nil
+}
+
+// matches reports whether r passes f.
+func matches(f structs.Filter, r structs.Result) bool {
+	date := r.Date[:min(len(r.Date), len(time.DateOnly))]
+	switch {
+	case f.From != "" && (date == "" || date < f.From),
+		f.To != "" && (date == "" || date > f.To),
+		f.Category != "" && !strings.EqualFold(r.Category, f.Category),
+		f.Location != "" && !strings.Contains(strings.ToLower(r.Location), strings.ToLower(f.Location)):
+		return false
+	}
+	if f.Near != nil {
+		if _, ok := geo.Within(*f.Near, f.RadiusKm, r.Latitude, r.Longitude); !ok {
+			return false
+		}
+	}
+	if f.MinPrice == nil && f.MaxPrice == nil {
+		return true
+	}
+	price, err := strconv.ParseFloat(r.Price, 64)
+	return err == nil &&
+		(f.MinPrice == nil || price >= *f.MinPrice) &&
+		(f.MaxPrice == nil || price <= *f.MaxPrice)
+}
+
+// facetFields are the fields results can be faceted by, with the value of
+// each result.
+var facetFields = map[string]func(r structs.Result) string{
+	"category": func(r structs.Result) string { return r.Category },
+	"location": func(r structs.Result) string { return r.Location },
+	"type":     func(r structs.Result) string { return r.Type },
+}
+
+// parseFacets reads facets=FIELD,FIELD.
+func parseFacets(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var fields []string
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if _, ok := facetFields[field]; !ok {
+			return nil, fmt.Errorf("Invalid facet %q, want category, location or type", field)
+		}
+		if !slices.Contains(fields, field) {
+			fields = append(fields, field)
+		}
+	}
+	return fields, nil
+}
 
+// countFacets counts results per value of each field. Results without a
+// value are not counted.
+func countFacets(fields []string, results []structs.Result) map[string]map[string]int64 {
+	counts := make(map[string]map[string]int64, len(fields))
+	for _, field := range fields {
+		value := facetFields[field]
+		counts[field] = map[string]int64{}
+		for _, r := range results {
+			if v := value(r); v != "" {
+				counts[field][v]++
+			}
+		}
+	}
+	return counts
+}
+
+// facetList lists the counts of each field, most frequent values first.
+func facetList(fields []string, counts map[string]map[string]int64) []structs.Facet {
+	var facets []structs.Facet
+	for _, field := range fields {
+		values := make([]structs.FacetValue, 0, len(counts[field]))
+		for v, n := range counts[field] {
+			values = append(values, structs.FacetValue{Value: v, Count: n})
+		}
+		sort.Slice(values, func(i, j int) bool {
+			if values[i].Count != values[j].Count {
+				return values[i].Count > values[j].Count
+			}
+			return values[i].Value < values[j].Value
+		})
+		facets = append(facets, structs.Facet{Name: field, Values: values[:min(len(values), maxFacetValues)]})
+	}
+	return facets
+}
+
+// sortKeys are the fields results can be sorted by, with the key each
+// result sorts by and whether it has one. Relevance is the engine's order.
+var sortKeys = map[string]func(i int, r structs.Result) (float64, bool){
+	"relevance": func(i int, _ structs.Result) (float64, bool) { return float64(-i), true },
+	"date": func(_ int, r structs.Result) (float64, bool) {
+		t, err := time.Parse(time.DateOnly, r.Date[:min(len(r.Date), len(time.DateOnly))])
+		return float64(t.Unix()), err == nil
+	},
+	"price": func(_ int, r structs.Result) (float64, bool) {
+		p, err := strconv.ParseFloat(r.Price, 64)
+		return p, err == nil
+	},
+	"rating": func(_ int, r structs.Result) (float64, bool) {
+		p, err := strconv.ParseFloat(r.Rating, 64)
+		return p, err == nil
+	},
+	"distance": func(_ int, r structs.Result) (float64, bool) {
+		if r.DistanceKm == nil {
+			return 0, false
+		}
+		return *r.DistanceKm, true
+	},
+}
+
+// parseSort reads sort=FIELD:asc|desc, a field of sortKeys. The direction
+// defaults to desc for relevance and asc for the other fields.
+func parseSort(s string) (structs.Sort, error) {
+	if s == "" {
+		return structs.Sort{Field: "relevance", Desc: true}, nil
+	}
+	field, dir, _ := strings.Cut(s, ":")
+	if _, ok := sortKeys[field]; !ok {
+		return structs.Sort{}, fmt.Errorf("Invalid sort field %q, want relevance, date, price, rating or distance", field)
+	}
+	switch dir {
+	case "":
+		return structs.Sort{Field: field, Desc: field == "relevance"}, nil
+	case "asc", "desc":
+		return structs.Sort{Field: field, Desc: dir == "desc"}, nil
+	}
+	return structs.Sort{}, fmt.Errorf("Invalid sort direction %q, want asc or desc", dir)
+}
+
+// sortResults sorts results, in the engine's order of relevance, in place.
+// Results without the field come last in either direction.
+func sortResults(results []structs.Result, o structs.Sort) {
+	if o.Field == "relevance" && o.Desc {
+		return
+	}
+	type keyed struct {
+		key float64
+		ok  bool
+		r   structs.Result
+	}
+	keys := make([]keyed, len(results))
+	for i, r := range results {
+		k, ok := sortKeys[o.Field](i, r)
+		keys[i] = keyed{k, ok, r}
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.ok != b.ok {
+			return a.ok
+		}
+		if o.Desc {
+			return a.key > b.key
+		}
+		return a.key < b.key
+	})
+	for i, k := range keys {
+		results[i] = k.r
+	}
+}
+
+func intParam(s string, def int64) (int64, error) {
+	if s == "" {
+		return def, nil
+	}
+	return strconv.ParseInt(s, 10, 64)
 }
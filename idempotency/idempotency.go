@@ -0,0 +1,231 @@
+// Package idempotency deduplicates retried requests. The first request
+// sent with an Idempotency-Key is served and its response kept; retries
+// with the same key get that response again, marked with an
+// Idempotent-Replayed header, instead of being served twice. Keys are
+// kept per tenant in the database of the instance serving the tenant, so
+// with sharding on, a retry that reaches another instance is sent to the
+// owner and deduplicated there.
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"io"
+	"log"
+	"naevis/apierror"
+	"naevis/config"
+	"net/http"
+	"time"
+)
+
+const (
+	// maxBody caps the bodies of deduplicated requests; larger requests
+	// are served without deduplication.
+	maxBody = 8 << 20
+	// abandonAfter is how long a key may stay in flight before a retry
+	// takes it over, as the instance serving it may have stopped.
+	abandonAfter = time.Minute
+	// maxKey caps the length of keys.
+	maxKey = 255
+)
+
+// metrics counts requests served first, replayed, refused as in flight
+// or mismatched, and expired keys, published under "idempotency" in
+// expvar.
+var metrics = expvar.NewMap("idempotency")
+
+// Store keeps the responses to requests sent with an Idempotency-Key.
+type Store struct {
+	db      *sql.DB
+	ttl     time.Duration
+	expirer func(cutoff time.Time) (int64, error)
+}
+
+// New creates a Store for cfg.
+func New(db *sql.DB, cfg config.Idempotency) *Store {
+	return &Store{db: db, ttl: cfg.TTL.Duration}
+}
+
+// ExpireWith has Run also call expire with each cutoff, for event keys a
+// storage driver keeps outside the server's database.
+func (s *Store) ExpireWith(expire func(cutoff time.Time) (int64, error)) {
+	s.expirer = expire
+}
+
+// Run deletes expired keys, those of responses and those stored with
+// events, every interval until ctx is cancelled.
+func (s *Store) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now().UTC()
+		cutoff := now.Add(-s.ttl).Format(time.DateTime)
+		res, err := s.db.Exec(`DELETE FROM idempotency_keys WHERE created_at < ?;`, cutoff)
+		if err != nil {
+			log.Printf("Error expiring idempotency keys: %v", err)
+		} else if n, _ := res.RowsAffected(); n > 0 {
+			metrics.Add("expired", n)
+		}
+		if _, err := s.db.Exec(`DELETE FROM event_keys WHERE created_at < ?;`, cutoff); err != nil {
+			log.Printf("Error expiring event keys: %v", err)
+		}
+		if s.expirer != nil {
+			if _, err := s.expirer(now.Add(-s.ttl)); err != nil {
+				log.Printf("Error expiring stored event keys: %v", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Middleware deduplicates POST, PUT and DELETE requests carrying an
+// Idempotency-Key. A retry arriving while the first request is still
+// served is refused with 409; a key reused for a different request, with
+// 422. Responses with a 5xx status are not kept, so the request can be
+// retried.
+func (s *Store) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" || r.Method != http.MethodPost && r.Method != http.MethodPut && r.Method != http.MethodDelete {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxKey {
+			apierror.Write(w, "Idempotency-Key too long", http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxBody+1))
+		if err != nil {
+			apierror.Write(w, "Failed to read body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+		if len(body) > maxBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		tenant := r.Header.Get("X-Tenant-ID")
+		fingerprint := fingerprint(r, body)
+		first, err := s.claim(tenant, key, fingerprint)
+		if err != nil {
+			log.Printf("Error claiming idempotency key: %v", err)
+			apierror.Write(w, "Failed to check Idempotency-Key", http.StatusInternalServerError)
+			return
+		}
+		if !first {
+			s.replay(w, tenant, key, fingerprint)
+			return
+		}
+
+		metrics.Add("first", 1)
+		rec := &recorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		if err := s.save(tenant, key, rec); err != nil {
+			log.Printf("Error saving idempotent response: %v", err)
+		}
+	})
+}
+
+// fingerprint identifies the request a key was first used for.
+func fingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.RequestURI()+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// claim records the key as in flight and reports whether this request is
+// the first with it. A key left in flight for abandonAfter is taken over.
+func (s *Store) claim(tenant, key, fingerprint string) (bool, error) {
+	now := time.Now().UTC()
+	res, err := s.db.Exec(`
+	INSERT INTO idempotency_keys (tenant, key, fingerprint, created_at) VALUES (?, ?, ?, ?)
+	ON CONFLICT (tenant, key) DO UPDATE SET created_at = excluded.created_at
+	WHERE status IS NULL AND created_at < ? AND fingerprint = excluded.fingerprint;`,
+		tenant, key, fingerprint, now.Format(time.DateTime), now.Add(-abandonAfter).Format(time.DateTime))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// replay answers a retry with the kept response.
+func (s *Store) replay(w http.ResponseWriter, tenant, key, fingerprint string) {
+	var kept string
+	var status sql.NullInt64
+	var contentType string
+	var body []byte
+	err := s.db.QueryRow(`
+	SELECT fingerprint, status, content_type, body FROM idempotency_keys WHERE tenant = ? AND key = ?;`,
+		tenant, key).Scan(&kept, &status, &contentType, &body)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		// The first request failed and released the key in between.
+		apierror.Write(w, "Request with this Idempotency-Key failed; retry it", http.StatusConflict)
+		return
+	case err != nil:
+		log.Printf("Error loading idempotent response: %v", err)
+		apierror.Write(w, "Failed to check Idempotency-Key", http.StatusInternalServerError)
+		return
+	case kept != fingerprint:
+		metrics.Add("mismatched", 1)
+		apierror.Write(w, "Idempotency-Key was used for a different request", http.StatusUnprocessableEntity)
+		return
+	case !status.Valid:
+		metrics.Add("in_flight", 1)
+		w.Header().Set("Retry-After", "1")
+		apierror.Write(w, "A request with this Idempotency-Key is in progress", http.StatusConflict)
+		return
+	}
+
+	metrics.Add("replayed", 1)
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(int(status.Int64))
+	w.Write(body)
+}
+
+// save keeps the response rec recorded, or releases the key after a
+// server error.
+func (s *Store) save(tenant, key string, rec *recorder) error {
+	if rec.status >= 500 {
+		_, err := s.db.Exec(`DELETE FROM idempotency_keys WHERE tenant = ? AND key = ?;`, tenant, key)
+		return err
+	}
+	_, err := s.db.Exec(`
+	UPDATE idempotency_keys SET status = ?, content_type = ?, body = ? WHERE tenant = ? AND key = ?;`,
+		rec.status, rec.Header().Get("Content-Type"), rec.body.Bytes(), tenant, key)
+	return err
+}
+
+// recorder copies a response as it is written.
+type recorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *recorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(p []byte) (int, error) {
+	r.body.Write(p)
+	return r.ResponseWriter.Write(p)
+}
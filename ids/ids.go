@@ -0,0 +1,151 @@
+// Package ids generates entity IDs for events posted without one. Every
+// scheme yields IDs that sort, as strings, in the order they were
+// generated, so they double as pagination cursors: within an instance IDs
+// are strictly increasing, even when the clock steps back, and across
+// instances they are ordered by the millisecond they were made in.
+package ids
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"naevis/config"
+	"sync"
+	"time"
+)
+
+// Schemes.
+const (
+	// ULID is a 26-character Crockford base32 ULID, the default.
+	ULID = "ulid"
+	// UUIDv7 is an RFC 9562 version 7 UUID.
+	UUIDv7 = "uuidv7"
+	// Snowflake is a 63-bit snowflake ID, as 19 zero-padded digits so
+	// IDs sort as strings as they do as numbers.
+	Snowflake = "snowflake"
+	// None generates no IDs.
+	None = "none"
+)
+
+// snowflakeEpoch is when snowflake timestamps start.
+var snowflakeEpoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC).UnixMilli()
+
+const (
+	snowflakeNodes    = 1 << 10
+	snowflakeSequence = 1 << 12
+)
+
+// crockford is the ULID alphabet.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// Generator makes IDs of one scheme. It is safe for concurrent use.
+type Generator struct {
+	scheme string
+	node   int64
+
+	mu sync.Mutex
+	ms int64
+	// hi and lo hold the random bits of the last ID, incremented when
+	// several IDs are made in one millisecond; snowflake IDs count in lo.
+	hi, lo uint64
+}
+
+// New creates a Generator for cfg. Snowflake IDs take cfg.Node, or a
+// node derived from self, the instance's name, when it is zero.
+func New(cfg config.IDs, self string) (*Generator, error) {
+	g := &Generator{scheme: cfg.Scheme, node: cfg.Node}
+	switch g.scheme {
+	case "":
+		g.scheme = ULID
+	case ULID, UUIDv7, None:
+	case Snowflake:
+		if g.node < 0 || g.node >= snowflakeNodes {
+			return nil, fmt.Errorf("ids: node %d out of range 0-%d", g.node, snowflakeNodes-1)
+		}
+		if g.node == 0 && self != "" {
+			h := fnv.New32a()
+			h.Write([]byte(self))
+			g.node = int64(h.Sum32() % snowflakeNodes)
+		}
+	default:
+		return nil, fmt.Errorf("ids: unknown scheme %q", cfg.Scheme)
+	}
+	return g, nil
+}
+
+// New returns a new ID, or "" with the None scheme.
+func (g *Generator) New() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	switch g.scheme {
+	case ULID:
+		// 48 bits of time and 80 random bits.
+		g.next(16, 64)
+		var id [16]byte
+		binary.BigEndian.PutUint64(id[0:8], uint64(g.ms)<<16|g.hi)
+		binary.BigEndian.PutUint64(id[8:16], g.lo)
+		return encodeULID(id)
+	case UUIDv7:
+		// 48 bits of time, the version, 12 random bits, the variant and
+		// 62 random bits.
+		g.next(12, 62)
+		var id [16]byte
+		binary.BigEndian.PutUint64(id[0:8], uint64(g.ms)<<16|0x7000|g.hi)
+		binary.BigEndian.PutUint64(id[8:16], 0x8000000000000000|g.lo)
+		b := hex.EncodeToString(id[:])
+		return b[0:8] + "-" + b[8:12] + "-" + b[12:16] + "-" + b[16:20] + "-" + b[20:32]
+	case Snowflake:
+		ms := time.Now().UnixMilli() - snowflakeEpoch
+		switch {
+		case ms > g.ms:
+			g.ms, g.lo = ms, 0
+		case g.lo+1 < snowflakeSequence:
+			g.lo++
+		default:
+			g.ms, g.lo = g.ms+1, 0
+		}
+		id := g.ms<<22 | g.node<<12 | int64(g.lo)
+		return fmt.Sprintf("%019d", id)
+	}
+	return ""
+}
+
+// next advances the time and random bits for a new ID whose random part
+// is hiBits and loBits wide. Within one millisecond, or when the clock
+// steps back, the random bits are incremented instead of drawn again,
+// moving on to the next millisecond when they run out.
+func (g *Generator) next(hiBits, loBits uint) {
+	ms := time.Now().UnixMilli()
+	if ms > g.ms {
+		var b [16]byte
+		rand.Read(b[:])
+		g.ms = ms
+		g.hi = binary.BigEndian.Uint64(b[0:8]) & (1<<hiBits - 1)
+		g.lo = binary.BigEndian.Uint64(b[8:16]) & (1<<loBits - 1)
+		return
+	}
+	g.lo = (g.lo + 1) & (1<<loBits - 1)
+	if g.lo != 0 {
+		return
+	}
+	g.hi = (g.hi + 1) & (1<<hiBits - 1)
+	if g.hi == 0 {
+		g.ms++
+	}
+}
+
+// encodeULID writes id in Crockford base32, most significant bits first.
+func encodeULID(id [16]byte) string {
+	hi := binary.BigEndian.Uint64(id[0:8])
+	lo := binary.BigEndian.Uint64(id[8:16])
+	var out [26]byte
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
@@ -0,0 +1,334 @@
+package ingest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"naevis/structs"
+	"time"
+)
+
+// CBOR frames are the compact event encoding for constrained devices. A
+// stream is a CBOR sequence (RFC 8742) of maps with small integer keys:
+//
+//	0: entity_type  1: action  2: entity_id  3: item_id  4: item_type
+//	5: time in milliseconds  6: source
+//
+// Omitted string fields repeat the previous frame's value, so a sensor
+// reporting on one entity only sends what changes. The first time is
+// milliseconds since the Unix epoch; each later one is the delta from the
+// previous frame's. A frame without a time has the previous frame's time,
+// and a stream without times is timed on arrival.
+const (
+	keyEntityType = iota
+	keyAction
+	keyEntityId
+	keyItemId
+	keyItemType
+	keyTime
+	keySource
+)
+
+// CBOR major types.
+const (
+	cborUint   = 0
+	cborNegInt = 1
+	cborBytes  = 2
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+	cborTag    = 6
+	cborSimple = 7
+)
+
+const (
+	// maxFrameString caps string fields, which are identifiers.
+	maxFrameString = 1024
+	// maxFrameKeys caps the entries of one frame, including unknown ones.
+	maxFrameKeys = 32
+	// maxSkipDepth caps the nesting of unknown values being skipped.
+	maxSkipDepth = 8
+	// maxFrameTime is the last millisecond of year 9999, the latest time
+	// a frame may carry; deltas are capped by it too, so they cannot
+	// overflow.
+	maxFrameTime = 253402300799999
+)
+
+// ReadCBOR decodes a stream of CBOR frames. The line passed to fn is the
+// 1-based frame number.
+func ReadCBOR(r io.Reader, fn RecordFunc) error {
+	d := cborReader{r: bufio.NewReader(r)}
+	var prev structs.Index
+	var last int64
+	hasTime := false
+
+	for frame := 1; ; frame++ {
+		if _, err := d.r.Peek(1); err == io.EOF {
+			return nil
+		}
+		major, n, err := d.head()
+		if err != nil {
+			return &ParseError{Line: frame, Err: err}
+		}
+		if major != cborMap {
+			return &ParseError{Line: frame, Err: fmt.Errorf("frame is CBOR major type %d, want a map", major)}
+		}
+		if n > maxFrameKeys {
+			return &ParseError{Line: frame, Err: fmt.Errorf("frame has %d keys", n)}
+		}
+
+		event := prev
+		for range n {
+			if err := d.field(&event, &last, &hasTime); err != nil {
+				return &ParseError{Line: frame, Err: err}
+			}
+		}
+		if hasTime {
+			event.Time = time.UnixMilli(last).UTC()
+		}
+		prev = event
+		if err := fn(frame, event); err != nil {
+			return err
+		}
+	}
+}
+
+// field decodes one key/value pair of a frame into event.
+func (d *cborReader) field(event *structs.Index, last *int64, hasTime *bool) error {
+	major, key, err := d.head()
+	if err != nil {
+		return err
+	}
+	if major != cborUint {
+		return errors.New("frame key is not an unsigned integer")
+	}
+
+	var dst *string
+	switch key {
+	case keyEntityType:
+		dst = &event.EntityType
+	case keyAction:
+		dst = &event.Action
+	case keyEntityId:
+		dst = &event.EntityId
+	case keyItemId:
+		dst = &event.ItemId
+	case keyItemType:
+		dst = &event.ItemType
+	case keySource:
+		dst = &event.Source
+	case keyTime:
+		ms, err := d.int()
+		if err != nil {
+			return fmt.Errorf("time: %w", err)
+		}
+		if ms < -maxFrameTime || ms > maxFrameTime {
+			return fmt.Errorf("time %d out of range", ms)
+		}
+		if *hasTime {
+			ms += *last
+		}
+		if ms < 0 || ms > maxFrameTime {
+			return fmt.Errorf("time %d out of range", ms)
+		}
+		*last, *hasTime = ms, true
+		return nil
+	default:
+		// Unknown keys are skipped so newer devices can talk to older
+		// servers.
+		return d.skip(0)
+	}
+
+	major, n, err := d.head()
+	if err != nil {
+		return err
+	}
+	if major != cborText {
+		return fmt.Errorf("key %d is CBOR major type %d, want a text string", key, major)
+	}
+	if n > maxFrameString {
+		return fmt.Errorf("key %d is %d bytes long", key, n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		return unexpected(err)
+	}
+	*dst = string(b)
+	return nil
+}
+
+// WriteCBOR encodes events as CBOR frames, omitting fields that repeat
+// the previous event and delta-encoding times. Events without a time are
+// sent without one, so a stream should time all of its events or none.
+func WriteCBOR(w io.Writer, events []structs.Index) error {
+	bw := bufio.NewWriter(w)
+	var prev structs.Index
+	var last int64
+	hasTime := false
+
+	for i, event := range events {
+		type kv struct {
+			key uint64
+			val string
+		}
+		var fields []kv
+		for _, f := range []struct {
+			key       uint64
+			val, prev string
+		}{
+			{keyEntityType, event.EntityType, prev.EntityType},
+			{keyAction, event.Action, prev.Action},
+			{keyEntityId, event.EntityId, prev.EntityId},
+			{keyItemId, event.ItemId, prev.ItemId},
+			{keyItemType, event.ItemType, prev.ItemType},
+			{keySource, event.Source, prev.Source},
+		} {
+			if i == 0 && f.val == "" || i > 0 && f.val == f.prev {
+				continue
+			}
+			fields = append(fields, kv{f.key, f.val})
+		}
+
+		var delta int64
+		timed := !event.Time.IsZero()
+		if timed {
+			ms := event.Time.UnixMilli()
+			delta = ms
+			if hasTime {
+				delta = ms - last
+			}
+			last, hasTime = ms, true
+		}
+
+		n := uint64(len(fields))
+		if timed {
+			n++
+		}
+		writeHead(bw, cborMap, n)
+		for _, f := range fields {
+			writeHead(bw, cborUint, f.key)
+			writeHead(bw, cborText, uint64(len(f.val)))
+			bw.WriteString(f.val)
+		}
+		if timed {
+			writeHead(bw, cborUint, keyTime)
+			if delta >= 0 {
+				writeHead(bw, cborUint, uint64(delta))
+			} else {
+				writeHead(bw, cborNegInt, uint64(-1-delta))
+			}
+		}
+		prev = event
+	}
+	return bw.Flush()
+}
+
+// cborReader reads the subset of CBOR used by frames. Indefinite lengths
+// are not supported.
+type cborReader struct {
+	r *bufio.Reader
+}
+
+// head reads an item's initial byte and argument.
+func (d *cborReader) head() (major byte, arg uint64, err error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return 0, 0, unexpected(err)
+	}
+	major, info := b>>5, b&0x1f
+	switch {
+	case info < 24:
+		return major, uint64(info), nil
+	case info <= 27:
+		size := 1 << (info - 24)
+		var buf [8]byte
+		if _, err := io.ReadFull(d.r, buf[8-size:]); err != nil {
+			return 0, 0, unexpected(err)
+		}
+		return major, binary.BigEndian.Uint64(buf[:]), nil
+	case info == 31:
+		return 0, 0, errors.New("indefinite-length CBOR items are not supported")
+	}
+	return 0, 0, fmt.Errorf("invalid CBOR additional info %d", info)
+}
+
+// int reads a signed integer that fits in an int64.
+func (d *cborReader) int() (int64, error) {
+	major, n, err := d.head()
+	if err != nil {
+		return 0, err
+	}
+	if n > 1<<63-1 {
+		return 0, errors.New("integer overflows int64")
+	}
+	switch major {
+	case cborUint:
+		return int64(n), nil
+	case cborNegInt:
+		return -1 - int64(n), nil
+	}
+	return 0, fmt.Errorf("CBOR major type %d is not an integer", major)
+}
+
+// skip discards one item.
+func (d *cborReader) skip(depth int) error {
+	if depth > maxSkipDepth {
+		return errors.New("CBOR nested too deeply")
+	}
+	major, n, err := d.head()
+	if err != nil {
+		return err
+	}
+	switch major {
+	case cborBytes, cborText:
+		if n > maxFrameString {
+			return fmt.Errorf("CBOR string is %d bytes long", n)
+		}
+		_, err := d.r.Discard(int(n))
+		return unexpected(err)
+	case cborArray, cborMap:
+		if n > maxFrameKeys {
+			return fmt.Errorf("CBOR container has %d items", n)
+		}
+		if major == cborMap {
+			n *= 2
+		}
+		for range n {
+			if err := d.skip(depth + 1); err != nil {
+				return err
+			}
+		}
+	case cborTag:
+		return d.skip(depth + 1)
+	}
+	return nil
+}
+
+func writeHead(w *bufio.Writer, major byte, arg uint64) {
+	switch {
+	case arg < 24:
+		w.WriteByte(major<<5 | byte(arg))
+	case arg <= 0xff:
+		w.WriteByte(major<<5 | 24)
+		w.WriteByte(byte(arg))
+	case arg <= 0xffff:
+		w.WriteByte(major<<5 | 25)
+		w.Write(binary.BigEndian.AppendUint16(nil, uint16(arg)))
+	case arg <= 0xffffffff:
+		w.WriteByte(major<<5 | 26)
+		w.Write(binary.BigEndian.AppendUint32(nil, uint32(arg)))
+	default:
+		w.WriteByte(major<<5 | 27)
+		w.Write(binary.BigEndian.AppendUint64(nil, arg))
+	}
+}
+
+// unexpected turns io.EOF inside an item into io.ErrUnexpectedEOF.
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
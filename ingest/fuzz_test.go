@@ -0,0 +1,88 @@
+package ingest
+
+import (
+	"bytes"
+	"naevis/structs"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// FuzzReadCBOR checks that any stream decodes without panicking and that
+// the frames it decodes to survive being written and read back.
+func FuzzReadCBOR(f *testing.F) {
+	var seed bytes.Buffer
+	WriteCBOR(&seed, []structs.Index{
+		{EntityType: "sensor", Action: "reading", EntityId: "s-1", Time: time.UnixMilli(1700000000000)},
+		{EntityType: "sensor", Action: "reading", EntityId: "s-2", Time: time.UnixMilli(1700000000250)},
+		{EntityType: "sensor", Action: "alarm", EntityId: "s-2", ItemId: "i", ItemType: "zone", Source: "edge"},
+	})
+	f.Add(seed.Bytes())
+	f.Add([]byte{0xa1, 0x05, 0x1b, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{0xa1, 0x18, 0x40, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x81, 0x00})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var events []structs.Index
+		err := ReadCBOR(bytes.NewReader(data), func(_ int, event structs.Index) error {
+			events = append(events, event)
+			return nil
+		})
+		if err != nil {
+			return
+		}
+
+		var buf bytes.Buffer
+		if err := WriteCBOR(&buf, events); err != nil {
+			t.Fatalf("writing decoded frames: %v", err)
+		}
+		var again []structs.Index
+		if err := ReadCBOR(&buf, func(_ int, event structs.Index) error {
+			again = append(again, event)
+			return nil
+		}); err != nil {
+			t.Fatalf("reading written frames: %v", err)
+		}
+		if !reflect.DeepEqual(events, again) {
+			t.Fatalf("round trip changed frames:\n%+v\n%+v", events, again)
+		}
+	})
+}
+
+// FuzzReadNDJSON checks that lenient reads never panic and report bad
+// records with the line they were on.
+func FuzzReadNDJSON(f *testing.F) {
+	f.Add("{\"entity_type\":\"place\",\"action\":\"view\",\"entity_id\":\"p-1\"}\n{}\n")
+	f.Add("{\"entity_type\":1}\n\n[]\n")
+	f.Add(strings.Repeat("{", 100))
+
+	f.Fuzz(func(t *testing.T, data string) {
+		lines := strings.Count(data, "\n") + 1
+		ReadLenient(NDJSON, strings.NewReader(data), func(line int, _ structs.Index) error {
+			if line < 1 || line > lines {
+				t.Fatalf("record on line %d of %d", line, lines)
+			}
+			return nil
+		}, func(err *ParseError) error {
+			if err.Line < 1 || err.Line > lines {
+				t.Fatalf("bad record on line %d of %d", err.Line, lines)
+			}
+			return nil
+		})
+	})
+}
+
+// FuzzReadCSV checks that lenient reads of any file never panic.
+func FuzzReadCSV(f *testing.F) {
+	f.Add("entity_type,action,entity_id,time\nplace,view,p-1,2024-01-01T00:00:00Z\n")
+	f.Add("entity_type\n\"unterminated\n")
+	f.Add("a,a,a\n1,2\n")
+
+	f.Fuzz(func(t *testing.T, data string) {
+		ReadLenient(CSV, strings.NewReader(data), func(int, structs.Index) error {
+			return nil
+		}, func(*ParseError) error {
+			return nil
+		})
+	})
+}
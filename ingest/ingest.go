@@ -0,0 +1,212 @@
+package ingest
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"naevis/structs"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// RecordFunc receives each decoded record with its 1-based line number.
+// Returning an error stops reading and the error is returned unchanged.
+type RecordFunc func(line int, event structs.Index) error
+
+// ParseError reports a record that could not be decoded.
+type ParseError struct {
+	Line int
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// BadRecordFunc receives a record that could not be decoded. Returning
+// nil skips the record; returning an error stops reading and the error is
+// returned unchanged.
+type BadRecordFunc func(err *ParseError) error
+
+// stop is the BadRecordFunc of strict reads: the first bad record stops
+// reading.
+func stop(err *ParseError) error {
+	return err
+}
+
+// Format identifies a file format by name.
+type Format string
+
+const (
+	NDJSON Format = "ndjson"
+	CSV    Format = "csv"
+	CBOR   Format = "cbor"
+)
+
+// FormatOf returns the format of a file from its extension.
+func FormatOf(name string) (Format, bool) {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".ndjson", ".jsonl":
+		return NDJSON, true
+	case ".csv":
+		return CSV, true
+	case ".cbor":
+		return CBOR, true
+	}
+	return "", false
+}
+
+// Read decodes every record of r in the given format.
+func Read(format Format, r io.Reader, fn RecordFunc) error {
+	switch format {
+	case NDJSON:
+		return ReadNDJSON(r, fn)
+	case CSV:
+		return ReadCSV(r, fn)
+	case CBOR:
+		return ReadCBOR(r, fn)
+	}
+	return fmt.Errorf("unsupported format %q", format)
+}
+
+// ReadLenient decodes every record of r like Read, but passes records
+// that cannot be decoded to bad instead of stopping at the first. A CBOR
+// stream cannot be resynchronized after a bad frame, so it still stops
+// there.
+func ReadLenient(format Format, r io.Reader, fn RecordFunc, bad BadRecordFunc) error {
+	switch format {
+	case NDJSON:
+		return readNDJSON(r, fn, bad)
+	case CSV:
+		return readCSV(r, fn, bad)
+	}
+	return Read(format, r, fn)
+}
+
+// ReadNDJSON decodes one JSON event per line. Blank lines are skipped. An
+// optional "time" field, RFC 3339, reports when the event happened.
+func ReadNDJSON(r io.Reader, fn RecordFunc) error {
+	return readNDJSON(r, fn, stop)
+}
+
+func readNDJSON(r io.Reader, fn RecordFunc, bad BadRecordFunc) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		var record struct {
+			structs.Index
+			Time string `json:"time"`
+		}
+		err := json.Unmarshal([]byte(text), &record)
+		if err == nil {
+			record.Index.Time, err = parseTime(record.Time)
+		}
+		if err != nil {
+			if err := bad(&ParseError{Line: line, Err: err}); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := fn(line, record.Index); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// ReadCSV decodes a CSV file whose header row names the event fields
+// (entity_type, action, entity_id, item_id, item_type, source, time).
+// Unknown columns are ignored.
+func ReadCSV(r io.Reader, fn RecordFunc) error {
+	return readCSV(r, fn, stop)
+}
+
+func readCSV(r io.Reader, fn RecordFunc, bad BadRecordFunc) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	// A bad header leaves nothing to read the rest by.
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return &ParseError{Line: 1, Err: err}
+	}
+
+	index := make(map[string]int, len(header))
+	for i, name := range header {
+		index[strings.TrimSpace(strings.ToLower(name))] = i
+	}
+	if _, ok := index["entity_type"]; !ok {
+		return &ParseError{Line: 1, Err: errors.New("header has no entity_type column")}
+	}
+
+	line := 1
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		line++
+		if err != nil {
+			if err := bad(&ParseError{Line: line, Err: err}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		field := func(name string) string {
+			if i, ok := index[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		event := structs.Index{
+			EntityType: field("entity_type"),
+			Action:     field("action"),
+			EntityId:   field("entity_id"),
+			ItemId:     field("item_id"),
+			ItemType:   field("item_type"),
+			Source:     field("source"),
+		}
+		if event.Time, err = parseTime(field("time")); err != nil {
+			if err := bad(&ParseError{Line: line, Err: err}); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := fn(line, event); err != nil {
+			return err
+		}
+	}
+}
+
+// parseTime parses the RFC 3339 time of a record, or returns the zero
+// time for an empty one.
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q", s)
+	}
+	return t.UTC(), nil
+}
@@ -0,0 +1,59 @@
+package ingest
+
+import (
+	"expvar"
+	"log"
+	"naevis/structs"
+	"sync"
+)
+
+// Queue stores events in the background: handlers enqueue events and
+// answer at once, while a pool of workers enriches and stores them, so
+// request latency does not follow storage latency. Queued events are lost
+// if the process stops before they are stored.
+type Queue struct {
+	events chan structs.Index
+	store  func(structs.Index) error
+	wg     sync.WaitGroup
+}
+
+// NewQueue creates a Queue holding up to size events, stored by store in
+// workers goroutines.
+func NewQueue(workers, size int, store func(structs.Index) error) *Queue {
+	q := &Queue{events: make(chan structs.Index, size), store: store}
+	metrics.Set("queue_depth", expvar.Func(func() any { return len(q.events) }))
+	q.wg.Add(workers)
+	for range workers {
+		go q.run()
+	}
+	return q
+}
+
+// Enqueue queues event for storing. It reports false when the queue is
+// full and the event was not queued.
+func (q *Queue) Enqueue(event structs.Index) bool {
+	select {
+	case q.events <- event:
+		metrics.Add("queued", 1)
+		return true
+	default:
+		metrics.Add("queue_full", 1)
+		return false
+	}
+}
+
+// Close stops accepting events and waits until the queue is drained.
+func (q *Queue) Close() {
+	close(q.events)
+	q.wg.Wait()
+}
+
+func (q *Queue) run() {
+	defer q.wg.Done()
+	for event := range q.events {
+		if err := q.store(event); err != nil {
+			metrics.Add("queue_failed", 1)
+			log.Printf("Error storing queued %s/%s event: %v", event.EntityType, event.EntityId, err)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package ingest
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+// metrics counts stored and queued events, published under "ingest" in
+// expvar.
+var metrics = expvar.NewMap("ingest")
+
+// window is how far back the ingest rate looks, in seconds.
+const window = 60
+
+// rate counts stored events per second over the last window seconds.
+var rate struct {
+	mu      sync.Mutex
+	seconds [window]int64
+	counts  [window]int64
+}
+
+// Stored records that an event was stored.
+func Stored() {
+	metrics.Add("stored", 1)
+
+	now := time.Now().Unix()
+	rate.mu.Lock()
+	defer rate.mu.Unlock()
+	i := now % window
+	if rate.seconds[i] != now {
+		rate.seconds[i], rate.counts[i] = now, 0
+	}
+	rate.counts[i]++
+}
+
+// PerMinute returns the number of events stored in the last minute.
+func PerMinute() int64 {
+	now := time.Now().Unix()
+	rate.mu.Lock()
+	defer rate.mu.Unlock()
+	var n int64
+	for i, s := range rate.seconds {
+		if now-s < window {
+			n += rate.counts[i]
+		}
+	}
+	return n
+}
+
+// Total returns the number of events stored since the instance started.
+func Total() int64 {
+	if v, ok := metrics.Get("stored").(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
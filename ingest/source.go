@@ -0,0 +1,26 @@
+package ingest
+
+import "naevis/structs"
+
+// SourceSeparator joins an event's source to the IDs it qualifies.
+const SourceSeparator = ":"
+
+// QualifiedID returns id as stored for source: SOURCE:ID, or id itself
+// when there is no source.
+func QualifiedID(source, id string) string {
+	if source == "" || id == "" {
+		return id
+	}
+	return source + SourceSeparator + id
+}
+
+// Qualify returns event with its entity ID, item ID and idempotency key
+// qualified by its source, so upstream systems whose IDs collide keep
+// separate entities and deduplicate separately. Every query and filter
+// names entities by their qualified IDs.
+func Qualify(event structs.Index) structs.Index {
+	event.EntityId = QualifiedID(event.Source, event.EntityId)
+	event.ItemId = QualifiedID(event.Source, event.ItemId)
+	event.IdempotencyKey = QualifiedID(event.Source, event.IdempotencyKey)
+	return event
+}
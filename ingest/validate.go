@@ -0,0 +1,108 @@
+package ingest
+
+import (
+	"naevis/apierror"
+	"naevis/config"
+	"naevis/structs"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Length limits of event fields, in bytes.
+const (
+	maxNameLength  = 64  // entity_type, action, item_type and source
+	maxIDLength    = 256 // entity_id and item_id
+	maxAttachments = 32
+)
+
+// AllTypes stands for every entity type where one is expected, as in the
+// Grafana targets of package rollups, so no event may have it as its
+// entity type.
+const AllTypes = "*"
+
+// ValidationError lists what is wrong with an event.
+type ValidationError struct {
+	Fields []apierror.FieldError
+}
+
+func (e *ValidationError) Error() string {
+	parts := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		parts[i] = f.Field + ": " + f.Message
+	}
+	return "invalid event: " + strings.Join(parts, "; ")
+}
+
+// Validator checks events before they are stored: required fields,
+// lengths, and the configured entity types, actions and sources.
+type Validator struct {
+	entityTypes map[string]bool
+	actions     map[string]bool
+	sources     map[string]bool
+}
+
+// NewValidator creates a Validator for cfg.
+func NewValidator(cfg config.Validation) *Validator {
+	return &Validator{entityTypes: set(cfg.EntityTypes), actions: set(cfg.Actions), sources: set(cfg.Sources)}
+}
+
+func set(values []string) map[string]bool {
+	if len(values) == 0 {
+		return nil
+	}
+	m := make(map[string]bool, len(values))
+	for _, v := range values {
+		m[v] = true
+	}
+	return m
+}
+
+// Check returns a *ValidationError listing every field of event at fault,
+// or nil.
+func (v *Validator) Check(event structs.Index) error {
+	var fields []apierror.FieldError
+	add := func(field, message string) {
+		fields = append(fields, apierror.FieldError{Field: field, Message: message})
+	}
+	for _, f := range []struct {
+		name, value string
+		required    bool
+		max         int
+		allowed     map[string]bool
+	}{
+		{"entity_type", event.EntityType, true, maxNameLength, v.entityTypes},
+		{"action", event.Action, true, maxNameLength, v.actions},
+		{"entity_id", event.EntityId, true, maxIDLength, nil},
+		{"item_id", event.ItemId, false, maxIDLength, nil},
+		{"item_type", event.ItemType, false, maxNameLength, nil},
+		{"source", event.Source, false, maxNameLength, v.sources},
+	} {
+		switch {
+		case f.value == "":
+			if f.required {
+				add(f.name, "required")
+			}
+		case len(f.value) > f.max:
+			add(f.name, "longer than "+strconv.Itoa(f.max)+" bytes")
+		case !utf8.ValidString(f.value) || strings.IndexFunc(f.value, unicode.IsControl) >= 0:
+			add(f.name, "must be valid UTF-8 without control characters")
+		case f.allowed != nil && !f.allowed[f.value]:
+			add(f.name, "not one of the accepted values")
+		}
+	}
+	if event.EntityType == AllTypes {
+		add("entity_type", "must not be "+strconv.Quote(AllTypes))
+	}
+	if strings.Contains(event.Source, SourceSeparator) {
+		add("source", "must not contain "+strconv.Quote(SourceSeparator))
+	}
+	if len(event.Attachments) > maxAttachments {
+		add("attachments", "more than "+strconv.Itoa(maxAttachments)+" attachments")
+	}
+	if fields != nil {
+		return &ValidationError{Fields: fields}
+	}
+	return nil
+}
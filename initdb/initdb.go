@@ -3,30 +3,160 @@ package initdb
 import (
 	"database/sql"
 	"fmt"
+	"naevis/config"
+	"naevis/limits"
+	"naevis/sqlguard"
+	"strings"
 )
 
-// initDB opens (or creates) a SQLite database and ensures
-// that the required table is created.
-func InitDB(dbPath string) (*sql.DB, error) {
-	db, err := sql.Open("sqlite", dbPath)
+// journalModes are the values of the journal_mode setting, with the
+// statement setting each on an attached schema.
+var journalModes = map[string]*sqlguard.Template{
+	"delete":   sqlguard.NewSchemaTemplate(`PRAGMA %s.journal_mode = delete;`),
+	"truncate": sqlguard.NewSchemaTemplate(`PRAGMA %s.journal_mode = truncate;`),
+	"persist":  sqlguard.NewSchemaTemplate(`PRAGMA %s.journal_mode = persist;`),
+	"wal":      sqlguard.NewSchemaTemplate(`PRAGMA %s.journal_mode = wal;`),
+}
+
+// synchronousModes are the values of the synchronous setting.
+var synchronousModes = map[string]bool{"off": true, "normal": true, "full": true, "extra": true}
+
+// options returns the connection options of InitDB's databases: the
+// pragmas of cfg, with the page cache sized to the container's memory
+// unless cfg sizes it, and transactions taking the write lock when they
+// begin, so two of them cannot deadlock upgrading their locks. In-memory
+// databases keep their own journal.
+func options(cfg config.SQLite, memory bool) (string, error) {
+	var opts []string
+	// The timeout comes first, as changing the journal mode takes a lock.
+	if cfg.BusyTimeout.Duration > 0 {
+		opts = append(opts, fmt.Sprintf("_pragma=busy_timeout(%d)", cfg.BusyTimeout.Milliseconds()))
+	}
+	if mode := strings.ToLower(cfg.JournalMode); mode != "" && !memory {
+		if journalModes[mode] == nil {
+			return "", fmt.Errorf("unknown journal_mode %q", cfg.JournalMode)
+		}
+		opts = append(opts, "_pragma=journal_mode("+mode+")")
+	}
+	if mode := strings.ToLower(cfg.Synchronous); mode != "" {
+		if !synchronousModes[mode] {
+			return "", fmt.Errorf("unknown synchronous %q", cfg.Synchronous)
+		}
+		opts = append(opts, "_pragma=synchronous("+mode+")")
+	}
+	kib := cfg.CacheSizeKiB
+	if kib <= 0 {
+		kib = limits.PageCacheKiB()
+	}
+	if kib > 0 {
+		opts = append(opts, fmt.Sprintf("_pragma=cache_size(-%d)", kib))
+	}
+	return strings.Join(append(opts, "_txlock=immediate"), "&"), nil
+}
+
+// InitDB opens (or creates) a SQLite database with the pragmas of cfg
+// and applies the migrations it has not had, the first of which creates
+// the tables. A dbPath of Memory opens a new in-memory database.
+func InitDB(dbPath string, cfg config.SQLite) (*sql.DB, error) {
+	return initDB(dbPath, cfg, Latest)
+}
+
+// MigrateDB migrates the database at dbPath to the schema version target,
+// reverting newer migrations, and closes it.
+func MigrateDB(dbPath string, cfg config.SQLite, target int) error {
+	db, err := initDB(dbPath, cfg, target)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	return db.Close()
+}
 
-	// Create the events table if it does not exist.
-	createTableSQL := `
-	CREATE TABLE IF NOT EXISTS events (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		entity_type TEXT,
-		action TEXT,
-		entity_id TEXT,
-		item_id TEXT,
-		item_type TEXT,
-		additional_info TEXT
-	);`
-	if _, err = db.Exec(createTableSQL); err != nil {
-		return nil, fmt.Errorf("failed to create table: %v", err)
+// initDB opens the database at dbPath and migrates it to target.
+func initDB(dbPath string, cfg config.SQLite, target int) (*sql.DB, error) {
+	opts, err := options(cfg, dbPath == Memory)
+	if err != nil {
+		return nil, err
+	}
+	var db *sql.DB
+	if dbPath == Memory {
+		db, err = openMemory(sqlguard.DriverName, opts)
+	} else {
+		db, err = sql.Open(sqlguard.DriverName, dbPath+"?"+opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if dbPath != Memory {
+		if err = setJournalModes(db, cfg.JournalMode); err != nil {
+			return nil, err
+		}
 	}
 
+	if err = Migrate(db, target); err != nil {
+		return nil, fmt.Errorf("failed to migrate: %v", err)
+	}
 	return db, nil
 }
+
+// setJournalModes sets the journal mode of the attached database files,
+// the cold tier and routed databases, which the connection options only
+// set for the main one. A file keeps WAL once it is set.
+func setJournalModes(db *sql.DB, mode string) error {
+	if mode == "" {
+		return nil
+	}
+	rows, err := db.Query(`SELECT name FROM pragma_database_list WHERE name NOT IN ('main', 'temp');`)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	// The mode was checked by options; names are the attached schemas.
+	set := journalModes[strings.ToLower(mode)]
+	for _, name := range names {
+		if _, err := db.Exec(set.Format(name)); err != nil {
+			return fmt.Errorf("failed to set journal mode of %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// addColumnSQL adds the column %[2]s, defined as %[3]s, to the table
+// %[1]s.
+var addColumnSQL = sqlguard.NewTemplate(`ALTER TABLE main.%s ADD COLUMN %s %s;`)
+
+func init() {
+	for _, c := range columns {
+		addColumnSQL.Register(c.table, c.name, c.def)
+	}
+}
+
+// EnsureColumn adds a column to table unless it already exists. Only the
+// statements adding the columns listed in columns pass the SQL guard.
+func EnsureColumn(db *sql.DB, table, name, def string) error {
+	exists, err := hasColumn(db, table, name)
+	if err != nil || exists {
+		return err
+	}
+	_, err = db.Exec(addColumnSQL.Format(table, name, def))
+	return err
+}
+
+// hasColumn reports whether the main database's table has a column called
+// name.
+func hasColumn(db *sql.DB, table, name string) (bool, error) {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?, 'main') WHERE name = ?;`, table, name).Scan(&n)
+	return n > 0, err
+}
@@ -0,0 +1,126 @@
+package initdb
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// Databases created before migrations existed were built by statements
+// run on every startup, which added columns and converted the events table
+// as the schema grew. upgradeLegacy brings such a database to the shape
+// the baseline migration expects, so that its statements, which tolerate
+// existing objects, complete it. On a new database it does nothing.
+func init() {
+	Register(1, "baseline", upgradeLegacy, nil)
+}
+
+// column is a column added to a table after it was first created.
+type column struct {
+	table, name, def string
+}
+
+// columns lists the columns added with ALTER TABLE before migrations
+// existed. The baseline creates the tables with them; new columns are
+// migrations, see migrations/README.md.
+var columns = []column{
+	{"events", "created_at", "DATETIME"},
+	{"events", "tenant", "TEXT NOT NULL DEFAULT ''"},
+	{"tracking_events", "tenant", "TEXT NOT NULL DEFAULT ''"},
+	{"events", "user_id", "INTEGER"},
+	{"users", "totp_secret", "TEXT NOT NULL DEFAULT ''"},
+	{"users", "totp_enabled", "INTEGER NOT NULL DEFAULT 0"},
+	{"users", "totp_last_step", "INTEGER NOT NULL DEFAULT 0"},
+	{"sessions", "mfa", "INTEGER NOT NULL DEFAULT 0"},
+}
+
+// internSchema creates the tables of the baseline that replaced the
+// events table: event_rows holds the rows with entity_type, action and
+// item_type interned in dictionary. The baseline's events view joins the
+// strings back in, so readers and writers of events are unaffected.
+var internSchema = []string{
+	`CREATE TABLE IF NOT EXISTS dictionary (
+		id INTEGER PRIMARY KEY,
+		kind TEXT NOT NULL,
+		value TEXT NOT NULL,
+		UNIQUE (kind, value)
+	);`,
+	`CREATE TABLE IF NOT EXISTS event_rows (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		entity_type_id INTEGER,
+		action_id INTEGER,
+		entity_id TEXT,
+		item_id TEXT,
+		item_type_id INTEGER,
+		additional_info TEXT,
+		created_at DATETIME,
+		tenant TEXT NOT NULL DEFAULT '',
+		user_id INTEGER
+	);`,
+}
+
+// internCopy moves the rows of an events table into event_rows, keeping
+// their ids and the AUTOINCREMENT sequence. events is qualified, as routed
+// databases shadow it with a view; see package routing.
+var internCopy = []string{
+	`INSERT OR IGNORE INTO dictionary (kind, value)
+	SELECT 'entity_type', entity_type FROM main.events WHERE entity_type IS NOT NULL
+	UNION SELECT 'action', action FROM main.events WHERE action IS NOT NULL
+	UNION SELECT 'item_type', item_type FROM main.events WHERE item_type IS NOT NULL;`,
+	`INSERT INTO event_rows (id, entity_type_id, action_id, entity_id, item_id, item_type_id, additional_info, created_at, tenant, user_id)
+	SELECT e.id, et.id, a.id, e.entity_id, e.item_id, it.id, e.additional_info, e.created_at, e.tenant, e.user_id
+	FROM main.events e
+	LEFT JOIN dictionary et ON et.kind = 'entity_type' AND et.value = e.entity_type
+	LEFT JOIN dictionary a ON a.kind = 'action' AND a.value = e.action
+	LEFT JOIN dictionary it ON it.kind = 'item_type' AND it.value = e.item_type;`,
+	`DELETE FROM sqlite_sequence WHERE name = 'event_rows';`,
+	`INSERT INTO sqlite_sequence (name, seq) SELECT 'event_rows', seq FROM sqlite_sequence WHERE name = 'events';`,
+	`DROP TABLE main.events;`,
+}
+
+// upgradeLegacy adds the missing legacy columns to the tables that exist
+// and moves the rows of an events table into event_rows.
+func upgradeLegacy(db *sql.DB) error {
+	for _, c := range columns {
+		var n int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?;`, c.table).Scan(&n); err != nil {
+			return err
+		}
+		if n == 0 {
+			continue
+		}
+		if err := EnsureColumn(db, c.table, c.name, c.def); err != nil {
+			return fmt.Errorf("failed to add column %s.%s: %v", c.table, c.name, err)
+		}
+	}
+	return internEvents(db)
+}
+
+// internEvents converts an events table into event_rows. It does nothing
+// when there is no events table. The copy runs in one transaction before
+// the server starts, so it blocks only startup.
+func internEvents(db *sql.DB) error {
+	var kind string
+	err := db.QueryRow(`SELECT type FROM sqlite_master WHERE name = 'events';`).Scan(&kind)
+	if errors.Is(err, sql.ErrNoRows) || kind == "view" {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, group := range [][]string{internSchema, internCopy} {
+		for _, stmt := range group {
+			if _, err := tx.Exec(stmt); err != nil {
+				return fmt.Errorf("failed to intern events: %v", err)
+			}
+		}
+	}
+	return tx.Commit()
+}
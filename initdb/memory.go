@@ -0,0 +1,42 @@
+package initdb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"sync/atomic"
+)
+
+// Memory is the path InitDB keeps the database in memory for, so demos and
+// tests do not touch disk. Unlike SQLite's own :memory:, which gives every
+// connection a database of its own, the connections of the pool share it.
+const Memory = ":memory:"
+
+// memoryDBs numbers the in-memory databases InitDB opened, so each is new.
+var memoryDBs atomic.Int64
+
+// InMemory returns the URI of the in-memory database name. Every
+// connection of the process opening it shares the database and locks it
+// as it would a file, so writers wait for each other through busy_timeout.
+// It is dropped when its last connection closes.
+func InMemory(name string) string {
+	return "file:/" + url.PathEscape(name) + "?vfs=memdb"
+}
+
+// openMemory opens a new in-memory database with the connection options
+// opts.
+func openMemory(driverName, opts string) (*sql.DB, error) {
+	name := fmt.Sprintf("events-%d.db", memoryDBs.Add(1))
+	db, err := sql.Open(driverName, InMemory(name)+"&"+opts)
+	if err != nil {
+		return nil, err
+	}
+	// The pool closes idle connections as it pleases; one held for the
+	// life of the process keeps the database from being dropped with them.
+	if _, err := db.Conn(context.Background()); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
@@ -0,0 +1,245 @@
+package initdb
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"naevis/sqlguard"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrationFiles holds the schema migrations, see migrations/README.md.
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+// migrationSQL runs the statements of a migration file. Only those of the
+// embedded files pass the SQL guard.
+var migrationSQL = sqlguard.NewTemplate(`%s`)
+
+func init() {
+	migrations, err := Migrations()
+	if err != nil {
+		// Migrate reports the error.
+		return
+	}
+	for _, m := range migrations {
+		if m.Up != "" {
+			migrationSQL.Register(m.Up)
+		}
+		if m.Down != "" {
+			migrationSQL.Register(m.Down)
+		}
+	}
+}
+
+// Latest is the target of Migrate for the newest schema version.
+const Latest = -1
+
+// Migration is a versioned change to the schema: the statements of
+// NNNN_NAME.up.sql apply it, and those of NNNN_NAME.down.sql, when there
+// is one, revert it. Changes SQL cannot express are steps written in Go,
+// see Register, which run before the statements.
+type Migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string
+	UpStep   Step
+	DownStep Step
+}
+
+// Step is the Go part of a migration. It runs outside the migration's
+// transaction, so it must commit its own work and be safe to run again
+// after failing part way, as the migration is then retried whole.
+type Step func(db *sql.DB) error
+
+// steps holds the registered Go steps by version.
+var steps = make(map[int]Migration)
+
+// Register adds Go steps to migration version, called name like its
+// files. up runs when the migration is applied and down, which may be nil,
+// when it is reverted. A migration may consist of steps alone. Register
+// is meant to be called from init functions and panics if the version
+// already has steps.
+func Register(version int, name string, up, down Step) {
+	if version <= 0 || up == nil {
+		panic(fmt.Sprintf("initdb: invalid migration step %d_%s", version, name))
+	}
+	if _, ok := steps[version]; ok {
+		panic(fmt.Sprintf("initdb: migration %d registered twice", version))
+	}
+	steps[version] = Migration{Version: version, Name: name, UpStep: up, DownStep: down}
+}
+
+// Migrations returns the embedded and registered migrations, oldest
+// first. Versions must be unique and each must have an up file or an up
+// step.
+func Migrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*Migration)
+	for _, e := range entries {
+		name := e.Name()
+		var base, direction string
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			base, direction = strings.TrimSuffix(name, ".up.sql"), "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			base, direction = strings.TrimSuffix(name, ".down.sql"), "down"
+		case strings.HasSuffix(name, ".sql"):
+			return nil, fmt.Errorf("migration %s is neither .up.sql nor .down.sql", name)
+		default:
+			continue
+		}
+		prefix, label, _ := strings.Cut(base, "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s does not start with a positive version", name)
+		}
+		body, err := fs.ReadFile(migrationFiles, path.Join("migrations", name))
+		if err != nil {
+			return nil, err
+		}
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: label}
+			byVersion[version] = m
+		} else if m.Name != label {
+			return nil, fmt.Errorf("migration %d is named both %s and %s", version, m.Name, label)
+		}
+		if direction == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	for version, step := range steps {
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: step.Name}
+			byVersion[version] = m
+		} else if m.Name != step.Name {
+			return nil, fmt.Errorf("migration %d is named both %s and %s", version, m.Name, step.Name)
+		}
+		m.UpStep, m.DownStep = step.UpStep, step.DownStep
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" && m.UpStep == nil {
+			return nil, fmt.Errorf("migration %d_%s has no up file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// SchemaVersion returns the version of the newest migration applied to
+// db, 0 for none.
+func SchemaVersion(db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRow(`SELECT IFNULL(MAX(version), 0) FROM schema_migrations;`).Scan(&version)
+	return version, err
+}
+
+// Migrate applies the migrations up to version target, or reverts those
+// above it, each in a transaction of its own. A target of Latest applies
+// every migration. A database migrated past the newest migration this
+// binary knows of is left alone with an error, since it was upgraded by a
+// newer binary.
+func Migrate(db *sql.DB, target int) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at DATETIME NOT NULL
+	);`); err != nil {
+		return err
+	}
+	migrations, err := Migrations()
+	if err != nil {
+		return err
+	}
+	latest := 0
+	if len(migrations) > 0 {
+		latest = migrations[len(migrations)-1].Version
+	}
+	if target == Latest {
+		target = latest
+	}
+	if target > latest {
+		return fmt.Errorf("no migration %d; the newest is %d", target, latest)
+	}
+	current, err := SchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if current > latest {
+		return fmt.Errorf("database schema version %d is newer than this binary's %d", current, latest)
+	}
+
+	for _, m := range migrations {
+		if m.Version > current && m.Version <= target {
+			if err := applyMigration(db, m, true); err != nil {
+				return err
+			}
+		}
+	}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.Version <= current && m.Version > target {
+			if m.Down == "" && m.DownStep == nil {
+				return fmt.Errorf("migration %d_%s cannot be reverted: it has no down file or step", m.Version, m.Name)
+			}
+			if err := applyMigration(db, m, false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// applyMigration runs m's up or down step, then the statements of its up
+// or down file and the change to schema_migrations in one transaction.
+func applyMigration(db *sql.DB, m Migration, up bool) error {
+	direction, step, statements := "up", m.UpStep, m.Up
+	if !up {
+		direction, step, statements = "down", m.DownStep, m.Down
+	}
+	if step != nil {
+		if err := step(db); err != nil {
+			return fmt.Errorf("migration %d_%s %s: %v", m.Version, m.Name, direction, err)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if statements != "" {
+		if _, err := tx.Exec(migrationSQL.Format(statements)); err != nil {
+			return fmt.Errorf("migration %d_%s %s: %v", m.Version, m.Name, direction, err)
+		}
+	}
+	if up {
+		_, err = tx.Exec(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?);`,
+			m.Version, m.Name, time.Now().UTC().Format(time.DateTime))
+	} else {
+		_, err = tx.Exec(`DELETE FROM schema_migrations WHERE version = ?;`, m.Version)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,138 @@
+package initdb
+
+import (
+	"database/sql"
+	"naevis/config"
+	"path/filepath"
+	"testing"
+)
+
+// inspect opens the database at path without the SQL guard, which admits
+// only the module's own statements.
+func inspect(t *testing.T, path string) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// count returns the single integer query returns.
+func count(t *testing.T, db *sql.DB, query string, args ...any) int {
+	t.Helper()
+	var n int
+	if err := db.QueryRow(query, args...).Scan(&n); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	return n
+}
+
+// schemaObjects counts the tables, views and triggers of the schema,
+// leaving out SQLite's own and schema_migrations.
+const schemaObjects = `SELECT COUNT(*) FROM sqlite_master
+	WHERE type IN ('table', 'view', 'trigger') AND name NOT LIKE 'sqlite_%' AND name NOT LIKE 'events_fts_%'
+	AND name != 'schema_migrations';`
+
+// latest returns the newest migration's version.
+func latest(t *testing.T) int {
+	t.Helper()
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+// checkBaseline fails unless the database at path is at the latest
+// version and events written through the view are stored and counted.
+func checkBaseline(t *testing.T, path string) {
+	t.Helper()
+	db := inspect(t, path)
+	if v, want := count(t, db, `SELECT IFNULL(MAX(version), 0) FROM schema_migrations;`), latest(t); v != want {
+		t.Fatalf("schema version %d, want %d", v, want)
+	}
+	if _, err := db.Exec(`INSERT INTO events (entity_type, action, entity_id, tenant) VALUES ('place', 'view', 'p1', 't1');`); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, db, `SELECT COUNT(*) FROM event_rows;`); n != 1 {
+		t.Errorf("%d event rows, want 1", n)
+	}
+	if n := count(t, db, `SELECT count FROM event_totals WHERE entity_type = 'place' AND action = 'view' AND tenant = 't1';`); n != 1 {
+		t.Errorf("total %d, want 1", n)
+	}
+	if n := count(t, db, `SELECT COUNT(*) FROM pragma_table_info('users') WHERE name = 'totp_secret';`); n != 1 {
+		t.Error("users has no totp_secret")
+	}
+}
+
+func TestMigrateUpDownUp(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.db")
+	if err := MigrateDB(path, config.SQLite{}, Latest); err != nil {
+		t.Fatal(err)
+	}
+	checkBaseline(t, path)
+
+	if err := MigrateDB(path, config.SQLite{}, 0); err != nil {
+		t.Fatal(err)
+	}
+	db := inspect(t, path)
+	if n := count(t, db, schemaObjects); n != 0 {
+		t.Errorf("%d schema objects left at version 0", n)
+	}
+	if v := count(t, db, `SELECT IFNULL(MAX(version), 0) FROM schema_migrations;`); v != 0 {
+		t.Errorf("schema version %d after reverting, want 0", v)
+	}
+	db.Close()
+
+	if err := MigrateDB(path, config.SQLite{}, Latest); err != nil {
+		t.Fatal(err)
+	}
+	checkBaseline(t, path)
+}
+
+func TestMigrateLegacy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.db")
+	db := inspect(t, path)
+	// A database as the startup statements left it before events were
+	// interned and before the columns added later.
+	for _, stmt := range []string{
+		`CREATE TABLE events (id INTEGER PRIMARY KEY AUTOINCREMENT, entity_type TEXT, action TEXT,
+			entity_id TEXT, item_id TEXT, item_type TEXT, additional_info TEXT);`,
+		`CREATE TABLE tracking_events (id INTEGER PRIMARY KEY AUTOINCREMENT, entity_type TEXT, action TEXT,
+			entity_id TEXT, item_id TEXT, item_type TEXT, created_at DATETIME DEFAULT CURRENT_TIMESTAMP);`,
+		`CREATE TABLE users (id INTEGER PRIMARY KEY AUTOINCREMENT, email TEXT NOT NULL UNIQUE,
+			password_hash TEXT NOT NULL, display_name TEXT NOT NULL DEFAULT '', bio TEXT NOT NULL DEFAULT '',
+			avatar_url TEXT NOT NULL DEFAULT '', role TEXT NOT NULL DEFAULT 'user', created_at DATETIME, updated_at DATETIME);`,
+		`CREATE TABLE schema_migrations (version INTEGER PRIMARY KEY, name TEXT NOT NULL, applied_at DATETIME NOT NULL);`,
+		`INSERT INTO events (id, entity_type, action, entity_id) VALUES (41, 'place', 'like', 'p1');`,
+		`INSERT INTO users (email, password_hash) VALUES ('a@example.com', 'x');`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	if err := MigrateDB(path, config.SQLite{}, Latest); err != nil {
+		t.Fatal(err)
+	}
+	db = inspect(t, path)
+	if n := count(t, db, `SELECT COUNT(*) FROM events WHERE id = 41 AND entity_type = 'place' AND action = 'like' AND tenant = '';`); n != 1 {
+		t.Error("legacy event not carried over")
+	}
+	if n := count(t, db, `SELECT count FROM event_totals WHERE entity_type = 'place' AND action = 'like';`); n != 1 {
+		t.Errorf("legacy event total %d, want 1", n)
+	}
+	if n := count(t, db, `SELECT COUNT(*) FROM users WHERE totp_enabled = 0;`); n != 1 {
+		t.Error("legacy user lost or without totp_enabled")
+	}
+	// New rows continue the legacy ids.
+	if _, err := db.Exec(`INSERT INTO events (entity_type, action) VALUES ('place', 'view');`); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, db, `SELECT MAX(id) FROM event_rows;`); n != 42 {
+		t.Errorf("new event id %d, want 42", n)
+	}
+}
@@ -0,0 +1,50 @@
+-- Reverts the baseline by dropping every table it creates, and with them
+-- all data. Only a database that is to be recreated should be migrated
+-- to version 0.
+DROP VIEW IF EXISTS events;
+DROP TABLE IF EXISTS operations;
+DROP TABLE IF EXISTS event_locations;
+DROP TABLE IF EXISTS search_terms;
+DROP TABLE IF EXISTS event_totals;
+DROP TABLE IF EXISTS event_rows;
+DROP TABLE IF EXISTS dictionary;
+DROP TABLE IF EXISTS event_lineage;
+DROP TABLE IF EXISTS event_upserts;
+DROP TABLE IF EXISTS tenant_usage;
+DROP TABLE IF EXISTS dead_letters;
+DROP TABLE IF EXISTS event_hashes;
+DROP TABLE IF EXISTS generated_ids;
+DROP TABLE IF EXISTS event_keys;
+DROP TABLE IF EXISTS idempotency_keys;
+DROP TABLE IF EXISTS job_state;
+DROP TABLE IF EXISTS entity_names;
+DROP TABLE IF EXISTS events_fts;
+DROP TABLE IF EXISTS query_plans;
+DROP TABLE IF EXISTS signature_nonces;
+DROP TABLE IF EXISTS signing_keys;
+DROP TABLE IF EXISTS blob_uploads;
+DROP TABLE IF EXISTS event_attachments;
+DROP TABLE IF EXISTS blobs;
+DROP TABLE IF EXISTS entity_documents;
+DROP TABLE IF EXISTS feature_flags;
+DROP TABLE IF EXISTS experiment_variants;
+DROP TABLE IF EXISTS experiments;
+DROP TABLE IF EXISTS related_entities;
+DROP TABLE IF EXISTS trending_scores;
+DROP TABLE IF EXISTS user_notifications;
+DROP TABLE IF EXISTS follows;
+DROP TABLE IF EXISTS favorites;
+DROP TABLE IF EXISTS recovery_codes;
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS users;
+DROP TABLE IF EXISTS push_deliveries;
+DROP TABLE IF EXISTS push_devices;
+DROP TABLE IF EXISTS notification_prefs;
+DROP TABLE IF EXISTS entity_owners;
+DROP TABLE IF EXISTS pulled_files;
+DROP TABLE IF EXISTS file_checkpoints;
+DROP TABLE IF EXISTS resume_tokens;
+DROP TABLE IF EXISTS rollup_daily;
+DROP TABLE IF EXISTS rollup_hourly;
+DROP TABLE IF EXISTS event_counters;
+DROP TABLE IF EXISTS tracking_events;
@@ -0,0 +1,553 @@
+-- The schema of the main database as it was when migrations were
+-- introduced. Databases created before then were brought to it by Go
+-- steps, see legacy.go, so every statement tolerates existing objects.
+
+-- High-volume click/impression hits from /t and /track. Kept apart from
+-- events so batched writes never contend with enrichment.
+CREATE TABLE IF NOT EXISTS tracking_events (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	entity_type TEXT,
+	action TEXT,
+	entity_id TEXT,
+	item_id TEXT,
+	item_type TEXT,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	tenant TEXT NOT NULL DEFAULT ''
+);
+-- Exact per entity_type/action totals, including events that were
+-- sampled out and never stored.
+CREATE TABLE IF NOT EXISTS event_counters (
+	entity_type TEXT NOT NULL,
+	action TEXT NOT NULL,
+	seen INTEGER NOT NULL DEFAULT 0,
+	stored INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (entity_type, action)
+);
+-- Hourly and daily counts per type/action/tenant. Roll-ups outlive the
+-- raw rows they were computed from.
+CREATE TABLE IF NOT EXISTS rollup_hourly (
+	bucket TEXT NOT NULL,
+	entity_type TEXT NOT NULL,
+	action TEXT NOT NULL,
+	tenant TEXT NOT NULL,
+	count INTEGER NOT NULL,
+	PRIMARY KEY (bucket, entity_type, action, tenant)
+);
+CREATE TABLE IF NOT EXISTS rollup_daily (
+	bucket TEXT NOT NULL,
+	entity_type TEXT NOT NULL,
+	action TEXT NOT NULL,
+	tenant TEXT NOT NULL,
+	count INTEGER NOT NULL,
+	PRIMARY KEY (bucket, entity_type, action, tenant)
+);
+-- Last processed position of each change data capture source, for
+-- crash recovery.
+CREATE TABLE IF NOT EXISTS resume_tokens (
+	source TEXT PRIMARY KEY,
+	token BLOB NOT NULL,
+	updated_at DATETIME
+);
+-- Last stored line of each dropped file still being ingested.
+CREATE TABLE IF NOT EXISTS file_checkpoints (
+	dir TEXT NOT NULL,
+	name TEXT NOT NULL,
+	line INTEGER NOT NULL,
+	updated_at DATETIME,
+	PRIMARY KEY (dir, name)
+);
+-- Files downloaded from partner SFTP servers, for deduplication.
+CREATE TABLE IF NOT EXISTS pulled_files (
+	partner TEXT NOT NULL,
+	name TEXT NOT NULL,
+	sha256 TEXT NOT NULL,
+	duplicate INTEGER NOT NULL DEFAULT 0,
+	pulled_at DATETIME,
+	PRIMARY KEY (partner, name)
+);
+CREATE INDEX IF NOT EXISTS pulled_files_sha256 ON pulled_files (partner, sha256);
+-- Contact emails of entity owners and their notification settings.
+CREATE TABLE IF NOT EXISTS entity_owners (
+	entity_type TEXT NOT NULL,
+	entity_id TEXT NOT NULL,
+	email TEXT NOT NULL,
+	PRIMARY KEY (entity_type, entity_id)
+);
+CREATE TABLE IF NOT EXISTS notification_prefs (
+	email TEXT PRIMARY KEY,
+	updates INTEGER NOT NULL DEFAULT 1,
+	reviews INTEGER NOT NULL DEFAULT 1,
+	flags INTEGER NOT NULL DEFAULT 1,
+	unsubscribed INTEGER NOT NULL DEFAULT 0,
+	token TEXT NOT NULL UNIQUE
+);
+-- Device tokens subscribed to entity changes, and every push attempt.
+CREATE TABLE IF NOT EXISTS push_devices (
+	token TEXT NOT NULL,
+	platform TEXT NOT NULL,
+	entity_type TEXT NOT NULL,
+	entity_id TEXT NOT NULL,
+	created_at DATETIME,
+	PRIMARY KEY (token, entity_type, entity_id)
+);
+CREATE INDEX IF NOT EXISTS push_devices_entity ON push_devices (entity_type, entity_id);
+CREATE TABLE IF NOT EXISTS push_deliveries (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	token TEXT NOT NULL,
+	platform TEXT NOT NULL,
+	entity_type TEXT NOT NULL,
+	entity_id TEXT NOT NULL,
+	action TEXT NOT NULL,
+	status TEXT NOT NULL,
+	error TEXT NOT NULL DEFAULT '',
+	created_at DATETIME
+);
+CREATE INDEX IF NOT EXISTS push_deliveries_token ON push_deliveries (token, id);
+-- Registered user accounts.
+CREATE TABLE IF NOT EXISTS users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	email TEXT NOT NULL UNIQUE,
+	password_hash TEXT NOT NULL,
+	display_name TEXT NOT NULL DEFAULT '',
+	bio TEXT NOT NULL DEFAULT '',
+	avatar_url TEXT NOT NULL DEFAULT '',
+	role TEXT NOT NULL DEFAULT 'user',
+	created_at DATETIME,
+	updated_at DATETIME,
+	totp_secret TEXT NOT NULL DEFAULT '',
+	totp_enabled INTEGER NOT NULL DEFAULT 0,
+	totp_last_step INTEGER NOT NULL DEFAULT 0
+);
+-- Login sessions. refresh_hash is the current refresh token's hash;
+-- previous_hash detects replay of a rotated one.
+CREATE TABLE IF NOT EXISTS sessions (
+	id TEXT PRIMARY KEY,
+	user_id INTEGER NOT NULL,
+	refresh_hash TEXT NOT NULL,
+	previous_hash TEXT NOT NULL DEFAULT '',
+	user_agent TEXT NOT NULL DEFAULT '',
+	revoked INTEGER NOT NULL DEFAULT 0,
+	created_at DATETIME,
+	last_used_at DATETIME,
+	expires_at DATETIME,
+	mfa INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS sessions_user ON sessions (user_id, last_used_at);
+-- One-time recovery codes for two-factor authentication, hashed.
+CREATE TABLE IF NOT EXISTS recovery_codes (
+	user_id INTEGER NOT NULL,
+	code_hash TEXT NOT NULL,
+	used_at DATETIME,
+	PRIMARY KEY (user_id, code_hash)
+);
+-- Entities a user marked as favorites.
+CREATE TABLE IF NOT EXISTS favorites (
+	user_id INTEGER NOT NULL,
+	entity_type TEXT NOT NULL,
+	entity_id TEXT NOT NULL,
+	created_at DATETIME,
+	PRIMARY KEY (user_id, entity_type, entity_id)
+);
+-- Entities a user follows, and the notifications generated for them.
+CREATE TABLE IF NOT EXISTS follows (
+	user_id INTEGER NOT NULL,
+	entity_type TEXT NOT NULL,
+	entity_id TEXT NOT NULL,
+	created_at DATETIME,
+	PRIMARY KEY (user_id, entity_type, entity_id)
+);
+CREATE INDEX IF NOT EXISTS follows_entity ON follows (entity_type, entity_id);
+CREATE TABLE IF NOT EXISTS user_notifications (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	reason TEXT NOT NULL,
+	entity_type TEXT NOT NULL,
+	entity_id TEXT NOT NULL,
+	action TEXT NOT NULL,
+	item_type TEXT NOT NULL DEFAULT '',
+	item_id TEXT NOT NULL DEFAULT '',
+	created_at DATETIME,
+	read_at DATETIME
+);
+CREATE INDEX IF NOT EXISTS user_notifications_user ON user_notifications (user_id, id);
+-- Top trending entities per tenant and type, rewritten by each refresh.
+CREATE TABLE IF NOT EXISTS trending_scores (
+	tenant TEXT NOT NULL,
+	entity_type TEXT NOT NULL,
+	entity_id TEXT NOT NULL,
+	rank INTEGER NOT NULL,
+	score REAL NOT NULL,
+	events INTEGER NOT NULL,
+	updated_at DATETIME,
+	PRIMARY KEY (tenant, entity_type, rank)
+);
+-- Entities most often seen in the same sessions as each entity.
+CREATE TABLE IF NOT EXISTS related_entities (
+	tenant TEXT NOT NULL,
+	entity_type TEXT NOT NULL,
+	entity_id TEXT NOT NULL,
+	rank INTEGER NOT NULL,
+	related_type TEXT NOT NULL,
+	related_id TEXT NOT NULL,
+	sessions INTEGER NOT NULL,
+	updated_at DATETIME,
+	PRIMARY KEY (tenant, entity_type, entity_id, rank)
+);
+-- A/B experiments and their weighted variants.
+CREATE TABLE IF NOT EXISTS experiments (
+	name TEXT PRIMARY KEY,
+	description TEXT NOT NULL DEFAULT '',
+	status TEXT NOT NULL,
+	created_at DATETIME,
+	updated_at DATETIME
+);
+CREATE TABLE IF NOT EXISTS experiment_variants (
+	experiment TEXT NOT NULL,
+	name TEXT NOT NULL,
+	weight INTEGER NOT NULL,
+	position INTEGER NOT NULL,
+	PRIMARY KEY (experiment, name)
+);
+-- Feature flags set through the admin API. tenants is comma-separated.
+CREATE TABLE IF NOT EXISTS feature_flags (
+	name TEXT PRIMARY KEY,
+	enabled INTEGER NOT NULL DEFAULT 0,
+	tenants TEXT NOT NULL DEFAULT '',
+	percent INTEGER NOT NULL DEFAULT 0,
+	updated_at DATETIME
+);
+-- Latest full document of each entity, materialized from PUTs and
+-- merge patches. version is the document's ETag.
+CREATE TABLE IF NOT EXISTS entity_documents (
+	tenant TEXT NOT NULL,
+	entity_type TEXT NOT NULL,
+	entity_id TEXT NOT NULL,
+	version INTEGER NOT NULL,
+	body TEXT NOT NULL,
+	updated_at DATETIME,
+	PRIMARY KEY (tenant, entity_type, entity_id)
+);
+-- Content-addressed attachments and the events referencing them.
+-- uploaded_at is refreshed by re-uploads and starts the grace period
+-- before an unreferenced blob is deleted.
+CREATE TABLE IF NOT EXISTS blobs (
+	sha256 TEXT PRIMARY KEY,
+	size INTEGER NOT NULL,
+	content_type TEXT NOT NULL,
+	created_at DATETIME,
+	uploaded_at DATETIME
+);
+CREATE TABLE IF NOT EXISTS event_attachments (
+	event_id INTEGER NOT NULL,
+	sha256 TEXT NOT NULL,
+	PRIMARY KEY (event_id, sha256)
+);
+CREATE INDEX IF NOT EXISTS event_attachments_sha256 ON event_attachments (sha256);
+-- Resumable uploads in progress. sha256 is set once the upload is
+-- complete and stored as a blob.
+CREATE TABLE IF NOT EXISTS blob_uploads (
+	id TEXT PRIMARY KEY,
+	length INTEGER NOT NULL,
+	received INTEGER NOT NULL,
+	content_type TEXT NOT NULL,
+	sha256 TEXT NOT NULL DEFAULT '',
+	created_at DATETIME,
+	updated_at DATETIME
+);
+-- Partner keys for HTTP message signatures, registered through
+-- /admin/signing-keys.
+CREATE TABLE IF NOT EXISTS signing_keys (
+	key_id TEXT PRIMARY KEY,
+	partner TEXT NOT NULL,
+	algorithm TEXT NOT NULL,
+	key TEXT NOT NULL,
+	updated_at DATETIME
+);
+-- Nonces of verified signatures, kept until expires_at (Unix seconds)
+-- when the signature is too old to be replayed anyway.
+CREATE TABLE IF NOT EXISTS signature_nonces (
+	key_id TEXT NOT NULL,
+	nonce TEXT NOT NULL,
+	expires_at INTEGER NOT NULL,
+	PRIMARY KEY (key_id, nonce)
+);
+-- Last query plan of each statement in the SQL catalog, keyed by a hash
+-- of the statement. previous_plan is kept until a change is accepted.
+CREATE TABLE IF NOT EXISTS query_plans (
+	hash TEXT PRIMARY KEY,
+	statement TEXT NOT NULL,
+	plan TEXT NOT NULL,
+	previous_plan TEXT NOT NULL DEFAULT '',
+	checked_at DATETIME,
+	changed_at DATETIME
+);
+-- Full-text index of stored events, keyed by event id. Maintained by
+-- package fulltext.
+CREATE VIRTUAL TABLE IF NOT EXISTS events_fts USING fts5(
+	name, description, additional_info,
+	entity_type UNINDEXED, entity_id UNINDEXED, tenant UNINDEXED,
+	tokenize = 'porter unicode61'
+);
+-- Latest name of each named entity, keyed for prefix matching.
+-- Maintained by package fulltext for suggestions.
+CREATE TABLE IF NOT EXISTS entity_names (
+	entity_type TEXT NOT NULL,
+	tenant TEXT NOT NULL,
+	entity_id TEXT NOT NULL,
+	name TEXT NOT NULL,
+	key TEXT NOT NULL,
+	events INTEGER NOT NULL,
+	event_id INTEGER NOT NULL,
+	PRIMARY KEY (entity_type, tenant, entity_id)
+);
+-- Progress markers for background jobs.
+CREATE TABLE IF NOT EXISTS job_state (
+	name TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+);
+-- Responses to requests sent with an Idempotency-Key; status is NULL
+-- while the first request is being served.
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+	tenant TEXT NOT NULL,
+	key TEXT NOT NULL,
+	fingerprint TEXT NOT NULL,
+	status INTEGER,
+	content_type TEXT NOT NULL DEFAULT '',
+	body BLOB,
+	created_at DATETIME NOT NULL,
+	PRIMARY KEY (tenant, key)
+);
+CREATE INDEX IF NOT EXISTS idempotency_keys_created ON idempotency_keys (created_at);
+-- The Idempotency-Key each event was posted with, written in the
+-- transaction storing the event, in whichever database it is routed to.
+CREATE TABLE IF NOT EXISTS event_keys (
+	tenant TEXT NOT NULL,
+	key TEXT NOT NULL,
+	event_id INTEGER NOT NULL,
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (tenant, key)
+);
+CREATE INDEX IF NOT EXISTS event_keys_created ON event_keys (created_at);
+-- Entity IDs generated by the server, each taken by the event first
+-- stored with it.
+CREATE TABLE IF NOT EXISTS generated_ids (
+	tenant TEXT NOT NULL,
+	entity_type TEXT NOT NULL,
+	entity_id TEXT NOT NULL,
+	event_id INTEGER NOT NULL,
+	PRIMARY KEY (tenant, entity_type, entity_id)
+);
+-- Content hashes of recent events, for deduplication.
+CREATE TABLE IF NOT EXISTS event_hashes (
+	tenant TEXT NOT NULL,
+	hash TEXT NOT NULL,
+	event_id INTEGER NOT NULL,
+	created_at DATETIME NOT NULL,
+	PRIMARY KEY (tenant, hash)
+);
+CREATE INDEX IF NOT EXISTS event_hashes_created ON event_hashes (created_at);
+-- Events that could not be enriched or stored, with the fields taken
+-- from their request, kept for an admin to retry or discard.
+CREATE TABLE IF NOT EXISTS dead_letters (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	tenant TEXT NOT NULL,
+	payload TEXT NOT NULL,
+	stage TEXT NOT NULL,
+	error TEXT NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	created_at DATETIME NOT NULL,
+	updated_at DATETIME NOT NULL
+);
+CREATE INDEX IF NOT EXISTS dead_letters_tenant ON dead_letters (tenant, id);
+-- Each tenant's usage per month, for cost attribution. storage_bytes
+-- is the latest measurement of the month.
+CREATE TABLE IF NOT EXISTS tenant_usage (
+	month TEXT NOT NULL,
+	tenant TEXT NOT NULL,
+	writes INTEGER NOT NULL DEFAULT 0,
+	query_ms REAL NOT NULL DEFAULT 0,
+	egress_bytes INTEGER NOT NULL DEFAULT 0,
+	storage_bytes INTEGER NOT NULL DEFAULT 0,
+	peak_storage_bytes INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (month, tenant)
+);
+-- The event each upserted entity and item was last stored as, so
+-- re-ingesting them refreshes that event instead of adding one.
+CREATE TABLE IF NOT EXISTS event_upserts (
+	tenant TEXT NOT NULL,
+	entity_type TEXT NOT NULL,
+	entity_id TEXT NOT NULL,
+	item_id TEXT NOT NULL,
+	event_id INTEGER NOT NULL,
+	PRIMARY KEY (tenant, entity_type, entity_id, item_id)
+);
+-- Where each event came from and how it was enriched, for data
+-- governance. Kept when the event is pruned or moved to the cold tier.
+CREATE TABLE IF NOT EXISTS event_lineage (
+	event_id INTEGER PRIMARY KEY,
+	tenant TEXT NOT NULL,
+	connector TEXT NOT NULL,
+	origin TEXT NOT NULL DEFAULT '',
+	position INTEGER NOT NULL DEFAULT 0,
+	source TEXT NOT NULL DEFAULT '',
+	enrichments TEXT NOT NULL DEFAULT '[]',
+	received_at DATETIME,
+	stored_at DATETIME NOT NULL
+);
+-- Events are stored in event_rows with entity_type, action and item_type
+-- interned in dictionary. The events view joins the strings back in, and
+-- its triggers intern the strings written through it.
+CREATE TABLE IF NOT EXISTS dictionary (
+	id INTEGER PRIMARY KEY,
+	kind TEXT NOT NULL,
+	value TEXT NOT NULL,
+	UNIQUE (kind, value)
+);
+CREATE TABLE IF NOT EXISTS event_rows (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	entity_type_id INTEGER,
+	action_id INTEGER,
+	entity_id TEXT,
+	item_id TEXT,
+	item_type_id INTEGER,
+	additional_info TEXT,
+	created_at DATETIME,
+	tenant TEXT NOT NULL DEFAULT '',
+	user_id INTEGER
+);
+CREATE VIEW IF NOT EXISTS events AS
+SELECT r.id AS id, et.value AS entity_type, a.value AS action, r.entity_id AS entity_id, r.item_id AS item_id,
+	it.value AS item_type, r.additional_info AS additional_info, r.created_at AS created_at,
+	r.tenant AS tenant, r.user_id AS user_id
+FROM event_rows r
+LEFT JOIN dictionary et ON et.id = r.entity_type_id
+LEFT JOIN dictionary a ON a.id = r.action_id
+LEFT JOIN dictionary it ON it.id = r.item_type_id;
+CREATE TRIGGER IF NOT EXISTS events_insert INSTEAD OF INSERT ON events BEGIN
+	INSERT OR IGNORE INTO dictionary (kind, value)
+	SELECT 'entity_type', NEW.entity_type WHERE NEW.entity_type IS NOT NULL
+	UNION ALL SELECT 'action', NEW.action WHERE NEW.action IS NOT NULL
+	UNION ALL SELECT 'item_type', NEW.item_type WHERE NEW.item_type IS NOT NULL;
+	INSERT INTO event_rows (id, entity_type_id, action_id, entity_id, item_id, item_type_id, additional_info, created_at, tenant, user_id)
+	VALUES (NEW.id,
+		(SELECT id FROM dictionary WHERE kind = 'entity_type' AND value = NEW.entity_type),
+		(SELECT id FROM dictionary WHERE kind = 'action' AND value = NEW.action),
+		NEW.entity_id, NEW.item_id,
+		(SELECT id FROM dictionary WHERE kind = 'item_type' AND value = NEW.item_type),
+		NEW.additional_info, NEW.created_at, IFNULL(NEW.tenant, ''), NEW.user_id);
+END;
+CREATE TRIGGER IF NOT EXISTS events_update INSTEAD OF UPDATE ON events BEGIN
+	INSERT OR IGNORE INTO dictionary (kind, value)
+	SELECT 'entity_type', NEW.entity_type WHERE NEW.entity_type IS NOT NULL
+	UNION ALL SELECT 'action', NEW.action WHERE NEW.action IS NOT NULL
+	UNION ALL SELECT 'item_type', NEW.item_type WHERE NEW.item_type IS NOT NULL;
+	UPDATE event_rows SET
+		entity_type_id = (SELECT id FROM dictionary WHERE kind = 'entity_type' AND value = NEW.entity_type),
+		action_id = (SELECT id FROM dictionary WHERE kind = 'action' AND value = NEW.action),
+		entity_id = NEW.entity_id,
+		item_id = NEW.item_id,
+		item_type_id = (SELECT id FROM dictionary WHERE kind = 'item_type' AND value = NEW.item_type),
+		additional_info = NEW.additional_info,
+		created_at = NEW.created_at,
+		tenant = IFNULL(NEW.tenant, ''),
+		user_id = NEW.user_id
+	WHERE id = OLD.id;
+END;
+CREATE TRIGGER IF NOT EXISTS events_delete INSTEAD OF DELETE ON events BEGIN
+	DELETE FROM event_rows WHERE id = OLD.id;
+END;
+-- Number of events and tracking hits ever stored per entity type, action
+-- and tenant, kept current by triggers. Like the roll-ups, totals are not
+-- reduced when raw rows are pruned. Tables are qualified, as routed
+-- databases shadow events and event_totals with views; see package
+-- routing.
+CREATE TABLE IF NOT EXISTS event_totals (
+	entity_type TEXT NOT NULL,
+	action TEXT NOT NULL,
+	tenant TEXT NOT NULL,
+	count INTEGER NOT NULL,
+	PRIMARY KEY (entity_type, action, tenant)
+);
+-- Seed from the roll-ups behind their watermark, which include pruned
+-- rows, and the raw rows after it. Databases upgraded from before
+-- migrations may already have totals; they are counted again.
+DELETE FROM main.event_totals;
+INSERT INTO main.event_totals (entity_type, action, tenant, count)
+SELECT entity_type, action, tenant, SUM(n)
+FROM (
+	SELECT entity_type, action, tenant, count AS n FROM rollup_hourly
+	WHERE bucket < IFNULL((SELECT value FROM job_state WHERE name = 'rollups'), '')
+	UNION ALL
+	SELECT IFNULL(entity_type, ''), IFNULL(action, ''), tenant, 1 FROM main.events
+	WHERE created_at IS NULL OR created_at >= IFNULL((SELECT value FROM job_state WHERE name = 'rollups'), '')
+	UNION ALL
+	SELECT IFNULL(entity_type, ''), IFNULL(action, ''), tenant, 1 FROM tracking_events
+	WHERE created_at IS NULL OR created_at >= IFNULL((SELECT value FROM job_state WHERE name = 'rollups'), '')
+)
+GROUP BY 1, 2, 3;
+CREATE TRIGGER IF NOT EXISTS event_rows_totals AFTER INSERT ON event_rows BEGIN
+	INSERT INTO event_totals (entity_type, action, tenant, count)
+	VALUES (IFNULL((SELECT value FROM dictionary WHERE id = NEW.entity_type_id), ''),
+		IFNULL((SELECT value FROM dictionary WHERE id = NEW.action_id), ''), NEW.tenant, 1)
+	ON CONFLICT (entity_type, action, tenant) DO UPDATE SET count = count + 1;
+END;
+CREATE TRIGGER IF NOT EXISTS tracking_events_totals AFTER INSERT ON tracking_events BEGIN
+	INSERT INTO event_totals (entity_type, action, tenant, count)
+	VALUES (IFNULL(NEW.entity_type, ''), IFNULL(NEW.action, ''), NEW.tenant, 1)
+	ON CONFLICT (entity_type, action, tenant) DO UPDATE SET count = count + 1;
+END;
+CREATE INDEX IF NOT EXISTS event_rows_user ON event_rows (user_id, created_at);
+CREATE INDEX IF NOT EXISTS event_rows_entity_type ON event_rows (entity_type_id, id);
+-- Cover the time-range scans of the roll-up and trending jobs, and the
+-- roll-up series queries, so they never read the tables themselves.
+CREATE INDEX IF NOT EXISTS event_rows_created ON event_rows (created_at, entity_type_id, action_id, tenant, entity_id);
+CREATE INDEX IF NOT EXISTS tracking_events_created ON tracking_events (created_at, entity_type, action, tenant, entity_id);
+CREATE INDEX IF NOT EXISTS rollup_hourly_series ON rollup_hourly (bucket, entity_type, action, tenant, count);
+CREATE INDEX IF NOT EXISTS rollup_daily_series ON rollup_daily (bucket, entity_type, action, tenant, count);
+-- Events pruned or moved to the cold tier leave the full-text index.
+CREATE TRIGGER IF NOT EXISTS event_rows_fts AFTER DELETE ON event_rows BEGIN
+	DELETE FROM events_fts WHERE rowid = OLD.id;
+END;
+CREATE INDEX IF NOT EXISTS entity_names_key ON entity_names (entity_type, tenant, key);
+-- Words of the names and descriptions indexed, for fuzzy searches.
+-- Maintained by package fulltext.
+CREATE TABLE IF NOT EXISTS search_terms (
+	term TEXT PRIMARY KEY,
+	length INTEGER NOT NULL,
+	uses INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS search_terms_length ON search_terms (length, term, uses);
+-- A name leaves the suggestions with the event that set it.
+CREATE TRIGGER IF NOT EXISTS event_rows_names AFTER DELETE ON event_rows BEGIN
+	DELETE FROM entity_names WHERE event_id = OLD.id;
+END;
+-- Coordinates of the events located, for searches near a point.
+-- Maintained by package fulltext.
+CREATE TABLE IF NOT EXISTS event_locations (
+	event_id INTEGER PRIMARY KEY,
+	latitude REAL NOT NULL,
+	longitude REAL NOT NULL
+);
+CREATE INDEX IF NOT EXISTS event_locations_position ON event_locations (latitude, longitude);
+CREATE TRIGGER IF NOT EXISTS event_rows_locations AFTER DELETE ON event_rows BEGIN
+	DELETE FROM event_locations WHERE event_id = OLD.id;
+END;
+-- Background operations started through /operations. Maintained by
+-- package operations.
+CREATE TABLE IF NOT EXISTS operations (
+	id TEXT PRIMARY KEY,
+	kind TEXT NOT NULL,
+	tenant TEXT NOT NULL,
+	state TEXT NOT NULL,
+	done INTEGER NOT NULL DEFAULT 0,
+	total INTEGER NOT NULL DEFAULT 0,
+	result TEXT,
+	error TEXT,
+	file TEXT,
+	content_type TEXT,
+	created_at DATETIME NOT NULL,
+	finished_at DATETIME,
+	expires_at DATETIME
+);
+CREATE INDEX IF NOT EXISTS operations_tenant ON operations (tenant, created_at);
+CREATE INDEX IF NOT EXISTS operations_expires ON operations (expires_at);
@@ -0,0 +1,4 @@
+-- Invalid two-factor codes in a row, and the Unix time until which an
+-- account locked out for too many of them refuses codes.
+ALTER TABLE users ADD COLUMN totp_failures INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN totp_locked_until INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,238 @@
+package initdb
+
+import (
+	"database/sql"
+	"fmt"
+	"naevis/sqlguard"
+	"strings"
+	"time"
+)
+
+// Statements of AddColumnOnline, which builds them from the table's stored
+// schema and so registers each before running it.
+var (
+	// storedSQL runs a statement read from sqlite_master, or derived from
+	// one by shadowCreateSQL.
+	storedSQL     = sqlguard.NewTemplate(`%s`)
+	syncInsertSQL = sqlguard.NewTemplate(`CREATE TRIGGER %[1]s_ins AFTER INSERT ON %[2]s BEGIN
+		INSERT OR REPLACE INTO %[3]s %[4]s WHERE rowid = NEW.rowid; END;`)
+	syncUpdateSQL = sqlguard.NewTemplate(`CREATE TRIGGER %[1]s_upd AFTER UPDATE ON %[2]s BEGIN
+		DELETE FROM %[1]s WHERE rowid = OLD.rowid;
+		INSERT OR REPLACE INTO %[3]s %[4]s WHERE rowid = NEW.rowid; END;`)
+	syncDeleteSQL = sqlguard.NewTemplate(`CREATE TRIGGER %[1]s_del AFTER DELETE ON %[2]s BEGIN
+		DELETE FROM %[1]s WHERE rowid = OLD.rowid; END;`)
+	batchEndSQL    = sqlguard.NewTemplate(`SELECT MAX(rowid) FROM (SELECT rowid FROM %s WHERE rowid > ? ORDER BY rowid LIMIT ?)`)
+	batchCopySQL   = sqlguard.NewTemplate(`INSERT OR IGNORE INTO %s %s WHERE rowid > ? AND rowid <= ?`)
+	dropTableSQL   = sqlguard.NewTemplate(`DROP TABLE %s`)
+	renameTableSQL = sqlguard.NewTemplate(`ALTER TABLE %s RENAME TO %s`)
+	dropShadowSQL  = []*sqlguard.Template{
+		sqlguard.NewTemplate(`DROP TRIGGER IF EXISTS %s_ins`),
+		sqlguard.NewTemplate(`DROP TRIGGER IF EXISTS %s_upd`),
+		sqlguard.NewTemplate(`DROP TRIGGER IF EXISTS %s_del`),
+		sqlguard.NewTemplate(`DROP TABLE IF EXISTS %s`),
+	}
+)
+
+// OnlineOptions tunes AddColumnOnline.
+type OnlineOptions struct {
+	// BatchSize is the number of rows copied per transaction.
+	BatchSize int
+	// Pause is slept between batches to leave room for other writers.
+	Pause time.Duration
+}
+
+// AddColumnOnline adds a column to table without holding the write lock
+// for a full rewrite. It creates a shadow copy of the table that already
+// has the column, keeps it in sync with triggers, backfills existing rows
+// in small batches and finally swaps the shadow into place.
+//
+// backfill is an SQL expression over the table's columns used to fill the
+// new column for existing rows, e.g. "CURRENT_TIMESTAMP" or "lower(name)".
+// Unlike ALTER TABLE it may be non-constant. The column is appended after
+// the existing definitions, so tables ending in table-level constraints
+// are not supported. The statements it runs are registered with the SQL
+// guard as it goes, so it must run before the guard is sealed.
+func AddColumnOnline(db *sql.DB, table, name, def, backfill string, opts OnlineOptions) error {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 10000
+	}
+
+	exists, err := hasColumn(db, table, name)
+	if err != nil || exists {
+		return err
+	}
+
+	var createSQL string
+	err = db.QueryRow(`SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?;`, table).Scan(&createSQL)
+	if err != nil {
+		return fmt.Errorf("failed to read schema of %s: %v", table, err)
+	}
+
+	// Indexes and triggers are dropped with the old table and recreated on
+	// the swapped one.
+	dependents, err := dependentSQL(db, table)
+	if err != nil {
+		return err
+	}
+
+	cols, err := columnNames(db, table)
+	if err != nil {
+		return err
+	}
+
+	shadow := "_osc_" + table
+	shadowSQL, err := shadowCreateSQL(createSQL, shadow, name+" "+def)
+	if err != nil {
+		return err
+	}
+
+	// Start from a clean shadow in case a previous run was interrupted.
+	if err := dropShadow(db, shadow); err != nil {
+		return err
+	}
+	storedSQL.Register(shadowSQL)
+	if _, err := db.Exec(storedSQL.Format(shadowSQL)); err != nil {
+		return fmt.Errorf("failed to create shadow table: %v", err)
+	}
+
+	colList := strings.Join(cols, ", ")
+	copySelect := fmt.Sprintf("SELECT rowid, %s, %s FROM %s", colList, backfill, table)
+	insertCols := fmt.Sprintf("%s (rowid, %s, %s)", shadow, colList, name)
+
+	// Keep rows changed during the backfill in sync. Trigger writes win
+	// over the batch copy because the copy uses INSERT OR IGNORE.
+	for _, t := range []*sqlguard.Template{syncInsertSQL, syncUpdateSQL, syncDeleteSQL} {
+		t.Register(shadow, table, insertCols, copySelect)
+		if _, err := db.Exec(t.Format(shadow, table, insertCols, copySelect)); err != nil {
+			return fmt.Errorf("failed to create sync trigger: %v", err)
+		}
+	}
+
+	// Backfill in rowid order, one short transaction per batch.
+	batchEndSQL.Register(table)
+	batchCopySQL.Register(insertCols, copySelect)
+	var last int64
+	for {
+		var maxID sql.NullInt64
+		err := db.QueryRow(batchEndSQL.Format(table), last, opts.BatchSize).Scan(&maxID)
+		if err != nil {
+			return fmt.Errorf("backfill of %s failed: %v", table, err)
+		}
+		if !maxID.Valid {
+			break
+		}
+
+		_, err = db.Exec(batchCopySQL.Format(insertCols, copySelect), last, maxID.Int64)
+		if err != nil {
+			return fmt.Errorf("backfill of %s failed: %v", table, err)
+		}
+		last = maxID.Int64
+
+		if opts.Pause > 0 {
+			time.Sleep(opts.Pause)
+		}
+	}
+
+	// Swap. Only this final step blocks writers.
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	dropTableSQL.Register(table)
+	if _, err := tx.Exec(dropTableSQL.Format(table)); err != nil {
+		return fmt.Errorf("failed to swap %s: %v", table, err)
+	}
+	renameTableSQL.Register(shadow, table)
+	if _, err := tx.Exec(renameTableSQL.Format(shadow, table)); err != nil {
+		return fmt.Errorf("failed to swap %s: %v", table, err)
+	}
+	for _, stmt := range dependents {
+		storedSQL.Register(stmt)
+		if _, err := tx.Exec(storedSQL.Format(stmt)); err != nil {
+			return fmt.Errorf("failed to swap %s: %v", table, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// OnlineColumn returns a migration step that adds a column with
+// AddColumnOnline, for columns with a computed backfill or on tables too
+// large to rewrite under the write lock. Register it for the migration's
+// version:
+//
+//	func init() {
+//		Register(2, "sessions_region", OnlineColumn("sessions", "region", "TEXT NOT NULL DEFAULT ''", "''", OnlineOptions{}), nil)
+//	}
+//
+// The step does nothing once the column exists, so it may be run again.
+func OnlineColumn(table, name, def, backfill string, opts OnlineOptions) Step {
+	return func(db *sql.DB) error {
+		return AddColumnOnline(db, table, name, def, backfill, opts)
+	}
+}
+
+// dependentSQL returns the CREATE statements of the indexes and triggers
+// defined on table, excluding automatic indexes.
+func dependentSQL(db *sql.DB, table string) ([]string, error) {
+	rows, err := db.Query(`
+	SELECT sql FROM sqlite_master
+	WHERE tbl_name = ? AND type IN ('index', 'trigger') AND sql IS NOT NULL
+	ORDER BY type, name;`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stmts []string
+	for rows.Next() {
+		var stmt string
+		if err := rows.Scan(&stmt); err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, stmt)
+	}
+	return stmts, rows.Err()
+}
+
+// columnNames returns the columns of table in declaration order.
+func columnNames(db *sql.DB, table string) ([]string, error) {
+	rows, err := db.Query(`SELECT name FROM pragma_table_info(?);`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var cols []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		cols = append(cols, name)
+	}
+	return cols, rows.Err()
+}
+
+// shadowCreateSQL rewrites a CREATE TABLE statement to create shadow with
+// an extra column appended.
+func shadowCreateSQL(createSQL, shadow, columnDef string) (string, error) {
+	open := strings.Index(createSQL, "(")
+	end := strings.LastIndex(createSQL, ")")
+	if open < 0 || end < open {
+		return "", fmt.Errorf("unexpected table definition: %s", createSQL)
+	}
+	return fmt.Sprintf("CREATE TABLE %s %s, %s%s", shadow, createSQL[open:end], columnDef, createSQL[end:]), nil
+}
+
+// dropShadow removes a shadow table and its sync triggers.
+func dropShadow(db *sql.DB, shadow string) error {
+	for _, t := range dropShadowSQL {
+		t.Register(shadow)
+		if _, err := db.Exec(t.Format(shadow)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package initdb
+
+import (
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"naevis/config"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestAddColumnOnline adds a column while another connection inserts,
+// updates and deletes rows, mirroring each write in a reference table.
+// Afterwards the table must hold exactly the reference rows, each with
+// the backfill computed, and keep its index.
+func TestAddColumnOnline(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "osc.db")
+	db, err := sql.Open("sqlite", path+"?_pragma=journal_mode(wal)&_pragma=busy_timeout(10000)&_txlock=immediate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, stmt := range []string{
+		`CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT NOT NULL);`,
+		`CREATE INDEX items_name ON items (name);`,
+		`CREATE TABLE reference (id INTEGER PRIMARY KEY, name TEXT NOT NULL);`,
+		`WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < 2000)
+			INSERT INTO items SELECT i, 'Item ' || i FROM n;`,
+		`INSERT INTO reference SELECT id, name FROM items;`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var (
+		stop   = make(chan struct{})
+		writes atomic.Int64
+		wg     sync.WaitGroup
+		errc   = make(chan error, 1)
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		rnd := rand.New(rand.NewSource(1))
+		next := 2001
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			var stmt string
+			var args []any
+			switch rnd.Intn(3) {
+			case 0:
+				stmt, args = `INSERT INTO %s (id, name) VALUES (?, ?);`, []any{next, fmt.Sprintf("New %d", next)}
+				next++
+			case 1:
+				stmt, args = `UPDATE %s SET name = name || ' Changed' WHERE id = ?;`, []any{1 + rnd.Intn(next-1)}
+			default:
+				stmt, args = `DELETE FROM %s WHERE id = ?;`, []any{1 + rnd.Intn(next-1)}
+			}
+			swapped, err := func() (bool, error) {
+				tx, err := db.Begin()
+				if err != nil {
+					return false, err
+				}
+				defer tx.Rollback()
+				// Writes after the swap would leave the new column
+				// empty; the copy is over then.
+				var n int
+				if err := tx.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('items') WHERE name = 'upper_name';`).Scan(&n); err != nil || n > 0 {
+					return n > 0, err
+				}
+				for _, table := range []string{"items", "reference"} {
+					if _, err := tx.Exec(fmt.Sprintf(stmt, table), args...); err != nil {
+						return false, err
+					}
+				}
+				return false, tx.Commit()
+			}()
+			if err != nil {
+				errc <- err
+				return
+			}
+			if swapped {
+				return
+			}
+			writes.Add(1)
+			// Leave gaps, as SQLite's busy handler would otherwise
+			// starve the copy.
+			time.Sleep(200 * time.Microsecond)
+		}
+	}()
+
+	err = AddColumnOnline(db, "items", "upper_name", "TEXT", "upper(name)", OnlineOptions{BatchSize: 20, Pause: time.Millisecond})
+	close(stop)
+	wg.Wait()
+	during := writes.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errc:
+		t.Fatalf("write during the copy: %v", err)
+	default:
+	}
+	if during == 0 {
+		t.Fatal("no writes during the copy")
+	}
+
+	for _, check := range []struct {
+		what, query string
+	}{
+		{"rows missing from items", `SELECT COUNT(*) FROM (SELECT id, name FROM reference EXCEPT SELECT id, name FROM items);`},
+		{"rows not in the reference", `SELECT COUNT(*) FROM (SELECT id, name FROM items EXCEPT SELECT id, name FROM reference);`},
+		{"rows without the backfill", `SELECT COUNT(*) FROM items WHERE upper_name IS NOT upper(name);`},
+		{"shadow objects left", `SELECT COUNT(*) FROM sqlite_master WHERE name LIKE '_osc_%';`},
+	} {
+		if n := count(t, db, check.query); n != 0 {
+			t.Errorf("%d %s", n, check.what)
+		}
+	}
+	if n := count(t, db, `SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = 'items_name' AND tbl_name = 'items';`); n != 1 {
+		t.Error("index not recreated on the swapped table")
+	}
+	t.Logf("%d writes during the copy", during)
+}
+
+// TestOnlineColumnMigration applies a registered OnlineColumn step as a
+// new migration and reverts it with its down step.
+func TestOnlineColumnMigration(t *testing.T) {
+	previous := latest(t)
+	version := previous + 1
+	Register(version, "sessions_region", OnlineColumn("sessions", "region", "TEXT NOT NULL DEFAULT ''", "'eu'", OnlineOptions{}),
+		func(db *sql.DB) error {
+			// Test statements are not in the SQL guard's catalog.
+			drop := `ALTER TABLE sessions DROP COLUMN region;`
+			storedSQL.Register(drop)
+			_, err := db.Exec(storedSQL.Format(drop))
+			return err
+		})
+	t.Cleanup(func() { delete(steps, version) })
+
+	path := filepath.Join(t.TempDir(), "events.db")
+	if err := MigrateDB(path, config.SQLite{}, previous); err != nil {
+		t.Fatal(err)
+	}
+	db := inspect(t, path)
+	if _, err := db.Exec(`INSERT INTO sessions (id, user_id, refresh_hash) VALUES ('s1', 1, 'h');`); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	if err := MigrateDB(path, config.SQLite{}, Latest); err != nil {
+		t.Fatal(err)
+	}
+	db = inspect(t, path)
+	if v := count(t, db, `SELECT IFNULL(MAX(version), 0) FROM schema_migrations;`); v != version {
+		t.Errorf("schema version %d, want %d", v, version)
+	}
+	if n := count(t, db, `SELECT COUNT(*) FROM sessions WHERE id = 's1' AND region = 'eu';`); n != 1 {
+		t.Error("existing session not backfilled")
+	}
+	db.Close()
+
+	if err := MigrateDB(path, config.SQLite{}, previous); err != nil {
+		t.Fatal(err)
+	}
+	db = inspect(t, path)
+	if n := count(t, db, `SELECT COUNT(*) FROM pragma_table_info('sessions') WHERE name = 'region';`); n != 0 {
+		t.Error("column left after reverting")
+	}
+}
@@ -0,0 +1,9 @@
+// Package integration holds the end-to-end tests of the server. They
+// build the quickie binary, boot it on a QUIC port with its SQLite files,
+// a cold tier and a webhook receiver, and drive it with the Go client, so
+// they are kept behind the integration build tag:
+//
+//	go test -tags=integration ./integration
+//
+// Set QUICKIE_TEST_MONGO_URI to also run the server against a MongoDB.
+package integration
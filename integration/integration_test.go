@@ -0,0 +1,232 @@
+//go:build integration
+
+package integration
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"naevis/structs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// TestStack boots the server and follows events through it: ingested as
+// JSON, CBOR frames and a streamed NDJSON body, retried under the same
+// Idempotency-Key, delivered to the webhook receiver, enriched and
+// stored, found by search, and, once the server is restarted with a short
+// retention, moved to the cold tier. Tracking hits are accepted alongside.
+func TestStack(t *testing.T) {
+	ctx := context.Background()
+	s := newStack(t)
+	s.start()
+
+	var want []string
+	t.Run("ingest", func(t *testing.T) {
+		for i := 1; i <= 3; i++ {
+			event := structs.Index{EntityType: "places", Action: "view", EntityId: fmt.Sprintf("json-%d", i)}
+			if err := s.client.SendEvent(ctx, event); err != nil {
+				t.Fatalf("sending %s: %v", event.EntityId, err)
+			}
+			want = append(want, event.EntityId)
+		}
+
+		now := time.Now()
+		frames := []structs.Index{
+			{EntityType: "places", Action: "view", EntityId: "cbor-1", Time: now},
+			{EntityType: "places", Action: "view", EntityId: "cbor-2", Time: now.Add(time.Second)},
+		}
+		if err := s.client.SendFrames(ctx, frames); err != nil {
+			t.Fatalf("sending frames: %v", err)
+		}
+		want = append(want, "cbor-1", "cbor-2")
+
+		// The body is written while the server reads it.
+		body, w := io.Pipe()
+		go func() {
+			enc := json.NewEncoder(w)
+			for _, id := range []string{"ndjson-1", "ndjson-2"} {
+				enc.Encode(structs.Index{EntityType: "places", Action: "view", EntityId: id})
+				time.Sleep(100 * time.Millisecond)
+			}
+			w.Close()
+		}()
+		req, err := http.NewRequest(http.MethodPost, s.base+"/event", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		req.Header.Set("X-Tenant-ID", tenant)
+		resp, err := s.http.Do(req)
+		if err != nil {
+			t.Fatalf("streaming events: %v", err)
+		}
+		var summary struct{ Received, Stored int }
+		err = json.NewDecoder(resp.Body).Decode(&summary)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK || summary.Stored != 2 {
+			t.Fatalf("streaming events: %d %+v %v", resp.StatusCode, summary, err)
+		}
+		want = append(want, "ndjson-1", "ndjson-2")
+	})
+
+	t.Run("replay", func(t *testing.T) {
+		body := []byte(`{"entity_type": "places", "action": "view", "entity_id": "replayed"}`)
+		var status int
+		for i, replayed := range []string{"", "true"} {
+			req, err := http.NewRequest(http.MethodPost, s.base+"/event", bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Tenant-ID", tenant)
+			req.Header.Set("Idempotency-Key", "integration-replay")
+			resp, err := s.http.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if i == 0 {
+				status = resp.StatusCode
+			}
+			if resp.StatusCode >= 300 || resp.StatusCode != status || resp.Header.Get("Idempotent-Replayed") != replayed {
+				t.Errorf("request %d: %d, Idempotent-Replayed %q", i+1, resp.StatusCode, resp.Header.Get("Idempotent-Replayed"))
+			}
+		}
+		want = append(want, "replayed")
+		slices.Sort(want)
+	})
+
+	t.Run("track", func(t *testing.T) {
+		body := []byte(`[{"entity_type": "places", "action": "click", "entity_id": "json-1"},
+			{"entity_type": "places", "action": "click", "entity_id": "json-2"}]`)
+		req, err := http.NewRequest(http.MethodPost, s.base+"/track", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Tenant-ID", tenant)
+		resp, err := s.http.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			t.Errorf("tracking hits: %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("webhooks", func(t *testing.T) {
+		var got []string
+		timeout := time.After(15 * time.Second)
+		for len(got) < len(want) {
+			select {
+			case event := <-s.hooks:
+				if event.Type != "com.quickie.entity.view" || event.Data.Tenant != tenant {
+					t.Errorf("delivery %s: type %s, tenant %q", event.ID, event.Type, event.Data.Tenant)
+				}
+				id, _ := strings.CutPrefix(event.Subject, "places/")
+				got = append(got, id)
+			case <-timeout:
+				t.Fatalf("%d of %d deliveries after 15s: %v", len(got), len(want), got)
+			}
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, want) {
+			t.Errorf("deliveries for %v, want %v", got, want)
+		}
+	})
+
+	t.Run("enrichment", func(t *testing.T) {
+		var got []string
+		for _, c := range s.feed() {
+			if c.Event == nil {
+				t.Errorf("change %v", c)
+				continue
+			}
+			if c.Event.AdditionalInfo == "" || c.Event.Tenant != tenant {
+				t.Errorf("event %s stored with additional_info %q, tenant %q", c.Event.EntityId, c.Event.AdditionalInfo, c.Event.Tenant)
+			}
+			got = append(got, c.Event.EntityId)
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, want) {
+			t.Errorf("stored %v, want %v", got, want)
+		}
+	})
+
+	t.Run("query", func(t *testing.T) {
+		// The enrichment stub describes every event the same way.
+		page, err := s.client.Search(ctx, "places", "dummy", structs.Filter{}, "", 100, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, r := range page.Items {
+			got = append(got, r.ID)
+		}
+		slices.Sort(got)
+		if page.Total != int64(len(want)) || !slices.Equal(got, want) {
+			t.Errorf("search found %d: %v, want %v", page.Total, got, want)
+		}
+	})
+
+	t.Run("mongo", func(t *testing.T) {
+		if os.Getenv("QUICKIE_TEST_MONGO_URI") == "" {
+			t.Skip("QUICKIE_TEST_MONGO_URI not set")
+		}
+		var docs any
+		s.get("/mongo/places", nil, &docs)
+	})
+
+	t.Run("retention", func(t *testing.T) {
+		s.stop()
+		s.writeConfig(map[string]any{
+			"standby": map[string]any{"token": replicationToken},
+			"tiering": map[string]any{"cold_path": filepath.Join(s.dir, "cold.db"), "after": "1s", "interval": "1s"},
+		})
+		s.start()
+
+		deadline := time.Now().Add(30 * time.Second)
+		for {
+			var hot []string
+			for _, c := range s.feed() {
+				if !c.Cold {
+					hot = append(hot, c.String())
+				}
+			}
+			if len(hot) == 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("events still hot after 30s: %v", hot)
+			}
+			time.Sleep(500 * time.Millisecond)
+		}
+		s.stop()
+
+		// The cold tier is a database file of its own.
+		db, err := sql.Open("sqlite", filepath.Join(s.dir, "cold.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		var n int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM events;`).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n != len(want) {
+			t.Errorf("%d events in the cold tier, want %d", n, len(want))
+		}
+	})
+}
@@ -0,0 +1,343 @@
+//go:build integration
+
+package integration
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"naevis/client"
+	"naevis/webhooks"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+const (
+	// tenant is the tenant every request is made for.
+	tenant = "acme"
+	// hookSecret signs the deliveries to the webhook receiver.
+	hookSecret = "integration-secret"
+	// replicationToken guards the change feed.
+	replicationToken = "integration-token"
+)
+
+// binary is the server built by TestMain.
+var binary string
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "quickie-integration")
+	if err != nil {
+		log.Fatal(err)
+	}
+	binary = filepath.Join(dir, "quickie")
+	build := exec.Command("go", "build", "-o", binary, ".")
+	build.Dir = ".."
+	build.Stdout, build.Stderr = os.Stdout, os.Stderr
+	if err := build.Run(); err != nil {
+		log.Fatalf("Failed to build the server: %v", err)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// stack is a running server with the services around it. Its files live
+// in dir, so a server started again on it finds its databases.
+type stack struct {
+	t     *testing.T
+	dir   string
+	addr  string
+	roots *x509.CertPool
+	hooks chan webhooks.Event
+	cmd   *exec.Cmd
+	// done is closed when the server has exited, with err.
+	done chan struct{}
+	err  error
+
+	// base is the server's URL; http and client talk to it over HTTP/3.
+	base   string
+	http   *http.Client
+	client *client.Client
+}
+
+// newStack creates the certificate and the webhook receiver of a stack,
+// without starting the server.
+func newStack(t *testing.T) *stack {
+	s := &stack{t: t, dir: t.TempDir(), hooks: make(chan webhooks.Event, 100)}
+	s.roots = writeCert(t, s.dir)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.addr = conn.LocalAddr().String()
+	conn.Close()
+
+	receiver := httptest.NewServer(http.HandlerFunc(s.receive))
+	t.Cleanup(func() {
+		if s.done != nil {
+			select {
+			case <-s.done:
+			default:
+				s.cmd.Process.Kill()
+				<-s.done
+			}
+		}
+		receiver.Close()
+		if t.Failed() {
+			data, _ := os.ReadFile(filepath.Join(s.dir, "server.log"))
+			t.Logf("server log:\n%s", data)
+		}
+	})
+	s.writeConfig(map[string]any{
+		"webhooks": []map[string]any{{"url": receiver.URL, "secret": hookSecret}},
+		"standby":  map[string]any{"token": replicationToken},
+		"flags":    map[string]any{"search_canary": map[string]any{"enabled": true}},
+		"tiering":  map[string]any{"cold_path": filepath.Join(s.dir, "cold.db"), "after": "24h", "interval": "1s"},
+	})
+
+	s.base = "https://" + s.addr
+	return s
+}
+
+// writeConfig writes the server's configuration, with MongoDB when
+// QUICKIE_TEST_MONGO_URI is set.
+func (s *stack) writeConfig(cfg map[string]any) {
+	if uri := os.Getenv("QUICKIE_TEST_MONGO_URI"); uri != "" {
+		cfg["mongo"] = map[string]any{
+			"uri":         uri,
+			"database":    "quickie_integration",
+			"collections": []map[string]any{{"name": "places", "fields": []string{"name"}}},
+		}
+	}
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(s.dir, "quickie.json"), data, 0o600); err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+// receive serves the webhook receiver, accepting correctly signed
+// deliveries.
+func (s *stack) receive(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := webhooks.Verify(hookSecret, r.Header.Get(webhooks.SignatureHeader), body, time.Now(), time.Minute); err != nil {
+		s.t.Errorf("webhook delivery: %v", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var event webhooks.Event
+	if err := json.Unmarshal(body, &event); err != nil {
+		s.t.Errorf("webhook delivery: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s.hooks <- event
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// start starts the server and waits until it is healthy. Its output goes
+// to server.log, which is logged if the test fails.
+func (s *stack) start() {
+	out, err := os.OpenFile(filepath.Join(s.dir, "server.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	s.cmd = exec.Command(binary, "-config", "quickie.json", "-db", "events.db", "-addr", s.addr)
+	s.cmd.Dir = s.dir
+	s.cmd.Stdout, s.cmd.Stderr = out, out
+	if err = s.cmd.Start(); err != nil {
+		out.Close()
+		s.t.Fatal(err)
+	}
+	s.http = &http.Client{
+		Transport: &http3.Transport{TLSClientConfig: &tls.Config{RootCAs: s.roots}},
+		Timeout:   30 * time.Second,
+	}
+	s.client, err = client.New(client.Config{BaseURL: s.base, Tenant: tenant, HTTPClient: s.http})
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	s.done = make(chan struct{})
+	go func() {
+		s.err = s.cmd.Wait()
+		out.Close()
+		close(s.done)
+	}()
+
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		resp, err := s.http.Get(s.base + "/health")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return
+			}
+		}
+		select {
+		case <-s.done:
+			s.t.Fatalf("server exited before becoming healthy: %v", s.err)
+		case <-time.After(100 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			s.t.Fatalf("server not healthy after 30s: %v", err)
+		}
+	}
+}
+
+// stop stops the server with SIGTERM, as systemd would, and fails the
+// test unless it exits cleanly within the grace period.
+func (s *stack) stop() {
+	s.t.Helper()
+	// Idle QUIC connections would hold the shutdown for its grace period.
+	s.http.Transport.(*http3.Transport).Close()
+	if err := s.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		s.t.Fatal(err)
+	}
+	select {
+	case <-s.done:
+		if s.err != nil {
+			s.t.Fatalf("server exited with %v", s.err)
+		}
+	case <-time.After(20 * time.Second):
+		s.t.Fatal("server still running 20s after SIGTERM")
+	}
+}
+
+// get fetches path from the server with the tenant header and decodes
+// the JSON response into out.
+func (s *stack) get(path string, header http.Header, out any) {
+	s.t.Helper()
+	req, err := http.NewRequest(http.MethodGet, s.base+path, nil)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("X-Tenant-ID", tenant)
+	resp, err := s.http.Do(req)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		s.t.Fatalf("GET %s: %d %s", path, resp.StatusCode, body)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		s.t.Fatalf("GET %s: %v", path, err)
+	}
+}
+
+// writeCert writes a self-signed certificate for 127.0.0.1 to dir as
+// cert.pem and key.pem, where the server loads them from, and returns a
+// pool trusting it.
+func writeCert(t *testing.T, dir string) *x509.CertPool {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "quickie integration"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		DNSNames:              []string{"localhost"},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, block := range map[string]*pem.Block{
+		"cert.pem": {Type: "CERTIFICATE", Bytes: der},
+		"key.pem":  {Type: "PRIVATE KEY", Bytes: keyDER},
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return roots
+}
+
+// feed reads the whole change feed, keeping the last state of each event.
+func (s *stack) feed() map[int64]change {
+	s.t.Helper()
+	changes := make(map[int64]change)
+	cursor := ""
+	for {
+		var page struct {
+			Changes []change `json:"changes"`
+			Cursor  string   `json:"cursor"`
+			Behind  int64    `json:"behind"`
+		}
+		s.get("/replication/changes?cursor="+url.QueryEscape(cursor), http.Header{"X-Replication-Token": {replicationToken}}, &page)
+		for _, c := range page.Changes {
+			changes[c.ID] = c
+		}
+		cursor = page.Cursor
+		if page.Behind == 0 {
+			return changes
+		}
+	}
+}
+
+// change is an entry of the change feed.
+type change struct {
+	ID    int64 `json:"id"`
+	Event *struct {
+		EntityType     string `json:"entity_type"`
+		EntityId       string `json:"entity_id"`
+		AdditionalInfo string `json:"additional_info"`
+		Tenant         string `json:"tenant"`
+	} `json:"event"`
+	Cold bool `json:"cold"`
+}
+
+func (c change) String() string {
+	if c.Event == nil {
+		return fmt.Sprintf("%d deleted", c.ID)
+	}
+	return fmt.Sprintf("%d %s/%s cold=%t", c.ID, c.Event.EntityType, c.Event.EntityId, c.Cold)
+}
@@ -0,0 +1,73 @@
+// Package jobs keeps track of the background jobs an instance runs, for
+// the admin views of the instance and the cluster.
+package jobs
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Job states.
+const (
+	Running  = "running"
+	Finished = "finished"
+)
+
+// Status is the state of a background job. Interval is zero for jobs that
+// run once.
+type Status struct {
+	Name       string     `json:"name"`
+	Interval   string     `json:"interval,omitempty"`
+	State      string     `json:"state"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+var (
+	mu   sync.Mutex
+	jobs = make(map[string]*Status)
+	// running counts the jobs that have not returned.
+	running sync.WaitGroup
+)
+
+// Go runs the job name in its own goroutine with ctx, recording when it
+// starts and returns. interval is how often it runs, if it repeats. Jobs
+// must return once ctx is cancelled.
+func Go(ctx context.Context, name string, interval time.Duration, run func(ctx context.Context)) {
+	s := &Status{Name: name, State: Running, StartedAt: time.Now().UTC()}
+	if interval > 0 {
+		s.Interval = interval.String()
+	}
+	mu.Lock()
+	jobs[name] = s
+	mu.Unlock()
+
+	running.Add(1)
+	go func() {
+		defer running.Done()
+		run(ctx)
+		mu.Lock()
+		defer mu.Unlock()
+		now := time.Now().UTC()
+		s.State, s.FinishedAt = Finished, &now
+	}()
+}
+
+// Wait waits until every job started has returned.
+func Wait() {
+	running.Wait()
+}
+
+// List returns the state of every job started, by name.
+func List() []Status {
+	mu.Lock()
+	defer mu.Unlock()
+	list := make([]Status, 0, len(jobs))
+	for _, s := range jobs {
+		list = append(list, *s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
@@ -0,0 +1,54 @@
+package limits
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"naevis/apierror"
+	"net/http"
+	"time"
+)
+
+// pingTimeout bounds the wait for the database to answer a health check.
+const pingTimeout = 5 * time.Second
+
+// Health serves the health of the instance: whether its database answers,
+// and the limits it runs under.
+type Health struct {
+	db *sql.DB
+}
+
+// NewHealth creates the health handler.
+func NewHealth(db *sql.DB) *Health {
+	return &Health{db: db}
+}
+
+// Check returns an error when the database does not answer.
+func (h *Health) Check(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	return h.db.PingContext(ctx)
+}
+
+// ServeHTTP handles GET /health. It answers 503 when the database does not
+// answer, so probes can tell an instance to be restarted.
+func (h *Health) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apierror.Write(w, "Only GET requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	result := struct {
+		Status   string `json:"status"`
+		Database string `json:"database"`
+		Limits   Limits `json:"limits"`
+	}{Status: "ok", Database: "ok", Limits: Current()}
+
+	status := http.StatusOK
+	if err := h.Check(r.Context()); err != nil {
+		result.Status, result.Database = "unavailable", err.Error()
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,201 @@
+// Package limits detects the CPU and memory the process may use from the
+// cgroup it runs in, so the server sizes itself to its container rather
+// than to the host: GOMAXPROCS, the GC's memory limit, the async ingest
+// pool and SQLite's page cache follow the container's limits.
+package limits
+
+import (
+	"bufio"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// cgroupRoot is where the cgroup filesystem is mounted.
+const cgroupRoot = "/sys/fs/cgroup"
+
+// Limits are the resources the process runs with.
+type Limits struct {
+	// CPUs is the CPU quota of the cgroup, in CPUs, and Memory its memory
+	// limit in bytes; either is 0 when there is none.
+	CPUs   float64 `json:"cpus"`
+	Memory int64   `json:"memory_bytes"`
+	// Source is the cgroup version they were read from, "cgroup2" or
+	// "cgroup1", or "none" when the process is not limited.
+	Source string `json:"source"`
+	// GOMAXPROCS and GCMemoryLimit, the soft limit the GC keeps the heap
+	// under (0 when unlimited), are what took effect, set by Apply or by
+	// the environment.
+	GOMAXPROCS    int   `json:"gomaxprocs"`
+	GCMemoryLimit int64 `json:"gc_memory_limit_bytes"`
+	// PageCacheKiB is the SQLite page cache of each connection, 0 for
+	// SQLite's default.
+	PageCacheKiB int64 `json:"page_cache_kib"`
+}
+
+// current is the Limits Apply took effect with.
+var current atomic.Pointer[Limits]
+
+// Apply detects the process's limits and sizes the runtime to them:
+// GOMAXPROCS to the CPU quota rounded up, and the GC's memory limit to
+// 90% of the memory limit, leaving room for memory outside the Go heap.
+// GOMAXPROCS and GOMEMLIMIT set in the environment are kept.
+func Apply() Limits {
+	l := Detect()
+	if l.CPUs > 0 && os.Getenv("GOMAXPROCS") == "" {
+		if n := int(math.Ceil(l.CPUs)); n < runtime.NumCPU() {
+			runtime.GOMAXPROCS(n)
+		}
+	}
+	if l.Memory > 0 && os.Getenv("GOMEMLIMIT") == "" {
+		debug.SetMemoryLimit(l.Memory / 10 * 9)
+	}
+	l.GOMAXPROCS = runtime.GOMAXPROCS(0)
+	if m := debug.SetMemoryLimit(-1); m != math.MaxInt64 {
+		l.GCMemoryLimit = m
+	}
+	l.PageCacheKiB = pageCacheKiB(l.Memory)
+	current.Store(&l)
+	if l.Source != "none" {
+		log.Printf("Running under %s limits: %g CPUs, %d bytes of memory; GOMAXPROCS %d", l.Source, l.CPUs, l.Memory, l.GOMAXPROCS)
+	}
+	return l
+}
+
+// Current returns the limits Apply took effect with, or the zero Limits
+// before it is called.
+func Current() Limits {
+	if l := current.Load(); l != nil {
+		return *l
+	}
+	return Limits{}
+}
+
+// Workers is the size of a worker pool meant to keep every CPU the
+// process may use busy.
+func Workers() int {
+	return runtime.GOMAXPROCS(0)
+}
+
+// PageCacheKiB is the SQLite page cache each connection should get, in
+// KiB, or 0 for SQLite's default of about 2 MiB.
+func PageCacheKiB() int64 {
+	return Current().PageCacheKiB
+}
+
+// pageCacheKiB gives each connection 1/256 of the memory limit, between
+// 1 MiB and 64 MiB, so a small container does not spend its memory on
+// caches and a large one is not held to SQLite's default.
+func pageCacheKiB(memory int64) int64 {
+	if memory == 0 {
+		return 0
+	}
+	return min(max(memory/256/1024, 1024), 64*1024)
+}
+
+// Detect reads the limits of the process's cgroup, v2 first.
+func Detect() Limits {
+	if l, ok := detectV2(); ok {
+		return l
+	}
+	if l, ok := detectV1(); ok {
+		return l
+	}
+	return Limits{Source: "none"}
+}
+
+// detectV2 reads cpu.max and memory.max of the process's cgroup. A
+// container usually sees its own cgroup at the root.
+func detectV2() (Limits, bool) {
+	dir := cgroupRoot
+	if path := cgroupPath(); path != "" {
+		if _, err := os.Stat(filepath.Join(cgroupRoot, path, "cpu.max")); err == nil {
+			dir = filepath.Join(cgroupRoot, path)
+		}
+	}
+	cpu, cpuErr := os.ReadFile(filepath.Join(dir, "cpu.max"))
+	memory, memErr := os.ReadFile(filepath.Join(dir, "memory.max"))
+	if cpuErr != nil && memErr != nil {
+		return Limits{}, false
+	}
+
+	var l Limits
+	// cpu.max is "$MAX $PERIOD", with a MAX of "max" for no quota.
+	if f := strings.Fields(string(cpu)); len(f) == 2 && f[0] != "max" {
+		quota, err1 := strconv.ParseFloat(f[0], 64)
+		period, err2 := strconv.ParseFloat(f[1], 64)
+		if err1 == nil && err2 == nil && period > 0 {
+			l.CPUs = quota / period
+		}
+	}
+	if s := strings.TrimSpace(string(memory)); s != "max" {
+		l.Memory, _ = strconv.ParseInt(s, 10, 64)
+	}
+	l.Source = source(l, "cgroup2")
+	return l, true
+}
+
+// detectV1 reads the CFS quota of the cpu controller and the limit of the
+// memory controller.
+func detectV1() (Limits, bool) {
+	quota, quotaErr := readInt(filepath.Join(cgroupRoot, "cpu", "cpu.cfs_quota_us"))
+	period, periodErr := readInt(filepath.Join(cgroupRoot, "cpu", "cpu.cfs_period_us"))
+	memory, memErr := readInt(filepath.Join(cgroupRoot, "memory", "memory.limit_in_bytes"))
+	if (quotaErr != nil || periodErr != nil) && memErr != nil {
+		return Limits{}, false
+	}
+
+	var l Limits
+	// A quota of -1 is none.
+	if quotaErr == nil && periodErr == nil && quota > 0 && period > 0 {
+		l.CPUs = float64(quota) / float64(period)
+	}
+	// No limit reads as the largest page-aligned int64.
+	if memErr == nil && memory < 1<<62 {
+		l.Memory = memory
+	}
+	l.Source = source(l, "cgroup1")
+	return l, true
+}
+
+// source is version when l limits anything, "none" otherwise.
+func source(l Limits, version string) string {
+	if l.CPUs == 0 && l.Memory == 0 {
+		return "none"
+	}
+	return version
+}
+
+// cgroupPath returns the process's cgroup in the unified, v2 hierarchy
+// from /proc/self/cgroup.
+func cgroupPath() string {
+	f, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Lines are "ID:CONTROLLERS:PATH", "0::PATH" for v2.
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) == 3 && parts[0] == "0" && parts[1] == "" {
+			return parts[2]
+		}
+	}
+	return ""
+}
+
+// readInt reads the integer in the file at path.
+func readInt(path string) (int64, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+}
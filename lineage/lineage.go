@@ -0,0 +1,76 @@
+// Package lineage records the provenance of every stored event: the
+// connector it came in by, where in a file or stream it was read, the
+// upstream source of its IDs and the enrichments applied to it, with
+// their versions. The record is written in the transaction storing the
+// event and rewritten when the event is refreshed or replaced.
+package lineage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"naevis/structs"
+	"time"
+)
+
+// ErrNotFound is returned by Load for an event without lineage.
+var ErrNotFound = errors.New("lineage not found")
+
+// Record is the lineage of a stored event.
+type Record struct {
+	EventID int64 `json:"event_id"`
+	structs.Lineage
+	Source      string   `json:"source,omitempty"`
+	Enrichments []string `json:"enrichments"`
+	ReceivedAt  string   `json:"received_at,omitempty"`
+	StoredAt    string   `json:"stored_at"`
+}
+
+// Save records, within tx, the lineage of event stored as id with the
+// enrichments applied to it, as NAME/VERSION. Empty ones are left out.
+func Save(tx *sql.Tx, id int64, event structs.Index, enrichments ...string) error {
+	applied := []string{}
+	for _, e := range enrichments {
+		if e != "" {
+			applied = append(applied, e)
+		}
+	}
+	list, err := json.Marshal(applied)
+	if err != nil {
+		return err
+	}
+	connector := event.Lineage.Connector
+	if connector == "" {
+		connector = "unknown"
+	}
+	var receivedAt any
+	if !event.ReceivedAt.IsZero() {
+		receivedAt = event.ReceivedAt.UTC().Format(time.DateTime)
+	}
+	_, err = tx.Exec(`
+	INSERT OR REPLACE INTO main.event_lineage
+		(event_id, tenant, connector, origin, position, source, enrichments, received_at, stored_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);`,
+		id, event.Tenant, connector, event.Lineage.Origin, event.Lineage.Offset, event.Source, string(list),
+		receivedAt, time.Now().UTC().Format(time.DateTime))
+	return err
+}
+
+// Load returns the lineage of event id of tenant.
+func Load(db *sql.DB, id int64, tenant string) (Record, error) {
+	r := Record{EventID: id}
+	var list string
+	var receivedAt sql.NullString
+	err := db.QueryRow(`
+	SELECT connector, origin, position, source, enrichments, received_at, stored_at
+	FROM event_lineage WHERE event_id = ? AND tenant = ?;`, id, tenant).Scan(
+		&r.Connector, &r.Origin, &r.Offset, &r.Source, &list, &receivedAt, &r.StoredAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return r, ErrNotFound
+	}
+	if err != nil {
+		return r, err
+	}
+	r.ReceivedAt = receivedAt.String
+	return r, json.Unmarshal([]byte(list), &r.Enrichments)
+}
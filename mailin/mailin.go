@@ -0,0 +1,318 @@
+package mailin
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"naevis/config"
+	"naevis/structs"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// maxMessageBytes caps the size of an accepted message.
+	maxMessageBytes = 10 << 20
+	// idleTimeout closes connections that stop sending commands.
+	idleTimeout = 5 * time.Minute
+)
+
+// defaultSubject matches subjects such as "events/flagged/event123".
+const defaultSubject = `^(?P<entity_type>[\w-]+)/(?P<action>[\w-]+)/(?P<entity_id>[^\s/]+)`
+
+// IngestFunc stores one event parsed from a message.
+type IngestFunc func(event structs.Index) error
+
+// Server is a minimal SMTP listener for legacy systems that can only send
+// mail. A message becomes events from, in order of preference, a JSON
+// attachment, a JSON body, or a subject matching the configured pattern.
+// It offers neither TLS nor authentication, so it should only listen on a
+// trusted interface; AllowedSenders further restricts MAIL FROM.
+type Server struct {
+	addr    string
+	subject *regexp.Regexp
+	allowed map[string]bool
+	ingest  IngestFunc
+}
+
+// New creates an SMTP server from cfg.
+func New(cfg config.MailIn, ingest IngestFunc) (*Server, error) {
+	pattern := cfg.SubjectPattern
+	if pattern == "" {
+		pattern = defaultSubject
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subject pattern: %v", err)
+	}
+
+	s := &Server{addr: cfg.Addr, subject: re, ingest: ingest}
+	if len(cfg.AllowedSenders) > 0 {
+		s.allowed = make(map[string]bool)
+		for _, a := range cfg.AllowedSenders {
+			s.allowed[strings.ToLower(a)] = true
+		}
+	}
+	return s, nil
+}
+
+// ListenAndServe accepts SMTP connections until the listener fails.
+func (s *Server) ListenAndServe() error {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("SMTP ingestion listening on %s...", s.addr)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serve(conn)
+	}
+}
+
+// serve runs one SMTP session.
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+
+	reply := func(code int, msg string) {
+		tp.PrintfLine("%d %s", code, msg)
+	}
+	reply(220, "QUICkie ESMTP ready")
+
+	var from string
+	var rcpt int
+	for {
+		conn.SetDeadline(time.Now().Add(idleTimeout))
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+
+		switch strings.ToUpper(verb) {
+		case "HELO", "EHLO":
+			from, rcpt = "", 0
+			reply(250, "QUICkie")
+		case "MAIL":
+			addr, err := parsePath(arg, "FROM:")
+			if err != nil {
+				reply(501, "Syntax error in MAIL command")
+				continue
+			}
+			if s.allowed != nil && !s.allowed[strings.ToLower(addr)] {
+				reply(550, "Sender not allowed")
+				continue
+			}
+			from, rcpt = addr, 0
+			reply(250, "OK")
+		case "RCPT":
+			if from == "" {
+				reply(503, "MAIL first")
+				continue
+			}
+			if _, err := parsePath(arg, "TO:"); err != nil {
+				reply(501, "Syntax error in RCPT command")
+				continue
+			}
+			rcpt++
+			reply(250, "OK")
+		case "DATA":
+			if rcpt == 0 {
+				reply(503, "RCPT first")
+				continue
+			}
+			reply(354, "End data with <CR><LF>.<CR><LF>")
+			data, err := io.ReadAll(io.LimitReader(tp.DotReader(), maxMessageBytes+1))
+			if err != nil {
+				return
+			}
+			if len(data) > maxMessageBytes {
+				reply(552, "Message too large")
+			} else if n, err := s.deliver(data); err != nil {
+				log.Printf("Rejected mail from %s: %v", from, err)
+				reply(554, "Message rejected: "+err.Error())
+			} else {
+				reply(250, fmt.Sprintf("OK, %d events stored", n))
+			}
+			from, rcpt = "", 0
+		case "RSET":
+			from, rcpt = "", 0
+			reply(250, "OK")
+		case "NOOP":
+			reply(250, "OK")
+		case "QUIT":
+			reply(221, "Bye")
+			return
+		default:
+			reply(502, "Command not implemented")
+		}
+	}
+}
+
+// parsePath extracts the address from "FROM:<addr>" or "TO:<addr>".
+func parsePath(arg, prefix string) (string, error) {
+	if !strings.HasPrefix(strings.ToUpper(arg), prefix) {
+		return "", errors.New("missing " + prefix)
+	}
+	rest := strings.TrimSpace(arg[len(prefix):])
+	// Drop ESMTP parameters such as SIZE=1234.
+	rest, _, _ = strings.Cut(rest, " ")
+	return strings.Trim(rest, "<>"), nil
+}
+
+// deliver parses a message and ingests its events.
+func (s *Server) deliver(data []byte) (int, error) {
+	events, err := s.parse(data)
+	if err != nil {
+		return 0, err
+	}
+	for i, event := range events {
+		if err := s.ingest(event); err != nil {
+			return i, err
+		}
+	}
+	return len(events), nil
+}
+
+// parse extracts events from a raw RFC 5322 message.
+func (s *Server) parse(data []byte) ([]structs.Index, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	var bodies [][]byte
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(msg.Body, params["boundary"])
+		var texts [][]byte
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+			b, err := io.ReadAll(transferDecoder(part, part.Header.Get("Content-Transfer-Encoding")))
+			if err != nil {
+				return nil, err
+			}
+			// JSON attachments take precedence over text parts.
+			if partType == "application/json" {
+				bodies = append(bodies, b)
+			} else if partType == "text/plain" || partType == "" {
+				texts = append(texts, b)
+			}
+		}
+		bodies = append(bodies, texts...)
+	} else {
+		b, err := io.ReadAll(transferDecoder(msg.Body, msg.Header.Get("Content-Transfer-Encoding")))
+		if err != nil {
+			return nil, err
+		}
+		bodies = append(bodies, b)
+	}
+
+	id := msg.Header.Get("Message-Id")
+	for _, b := range bodies {
+		if events, ok := decodeJSON(b); ok {
+			return traced(events, id), nil
+		}
+	}
+
+	dec := new(mime.WordDecoder)
+	subject, err := dec.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		subject = msg.Header.Get("Subject")
+	}
+	if event, ok := s.fromSubject(subject); ok {
+		return traced([]structs.Index{event}, id), nil
+	}
+	return nil, errors.New("no JSON payload and subject does not match the template")
+}
+
+// traced sets the lineage of events found in order in the message id.
+func traced(events []structs.Index, id string) []structs.Index {
+	for i := range events {
+		events[i].Lineage = structs.Lineage{Connector: "mail", Origin: id, Offset: int64(i + 1)}
+	}
+	return events
+}
+
+// transferDecoder undoes a Content-Transfer-Encoding. mime/multipart
+// decodes quoted-printable parts itself and removes their header.
+func transferDecoder(r io.Reader, encoding string) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
+
+// decodeJSON accepts a JSON event or array of events.
+func decodeJSON(b []byte) ([]structs.Index, bool) {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return nil, false
+	}
+
+	var events []structs.Index
+	if json.Unmarshal(b, &events) == nil {
+		return events, true
+	}
+	var event structs.Index
+	if json.Unmarshal(b, &event) == nil {
+		return []structs.Index{event}, true
+	}
+	return nil, false
+}
+
+// fromSubject fills an event from the named groups of the subject pattern.
+func (s *Server) fromSubject(subject string) (structs.Index, bool) {
+	m := s.subject.FindStringSubmatch(strings.TrimSpace(subject))
+	if m == nil {
+		return structs.Index{}, false
+	}
+
+	var event structs.Index
+	for i, name := range s.subject.SubexpNames() {
+		switch name {
+		case "entity_type":
+			event.EntityType = m[i]
+		case "action":
+			event.Action = m[i]
+		case "entity_id":
+			event.EntityId = m[i]
+		case "item_id":
+			event.ItemId = m[i]
+		case "item_type":
+			event.ItemType = m[i]
+		case "source":
+			event.Source = m[i]
+		}
+	}
+	return event, event.EntityType != ""
+}
@@ -1,16 +1,84 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"database/sql"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"mime"
+	"naevis/accounts"
+	"naevis/activity"
+	"naevis/analytics"
+	"naevis/apierror"
+	"naevis/blobs"
+	"naevis/cdc"
+	"naevis/cdc/pglogical"
+	"naevis/clock"
+	"naevis/compression"
+	"naevis/config"
+	"naevis/costs"
+	"naevis/deadletter"
+	"naevis/dedup"
+	"naevis/dictionary"
+	"naevis/digest"
+	"naevis/documents"
+	"naevis/experiments"
+	"naevis/filedrop"
+	"naevis/flags"
+	"naevis/follows"
+	"naevis/fulltext"
+	"naevis/gossip"
 	"naevis/handlers"
+	"naevis/idempotency"
+	"naevis/ids"
+	"naevis/ingest"
 	"naevis/initdb"
+	"naevis/jobs"
+	"naevis/limits"
+	"naevis/lineage"
+	"naevis/mailin"
 	"naevis/mongops"
+	"naevis/notify"
+	"naevis/operations"
+	"naevis/planwatch"
+	"naevis/public"
+	"naevis/quotas"
+	"naevis/ratelimit"
+	"naevis/recovery"
+	"naevis/regions"
+	"naevis/related"
+	"naevis/rollups"
+	"naevis/routing"
+	"naevis/sampling"
+	"naevis/secheaders"
+	"naevis/service"
+	"naevis/sftppull"
+	"naevis/shards"
+	"naevis/signatures"
+	"naevis/sla"
+	"naevis/sqlguard"
+	"naevis/standby"
+	"naevis/storage"
+	_ "naevis/storage/memory"
+	_ "naevis/storage/postgres"
 	"naevis/structs"
+	"naevis/tiering"
+	"naevis/trending"
+	"naevis/visibility"
+	"naevis/webhooks"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/quic-go/quic-go/http3"
 	_ "modernc.org/sqlite"
@@ -18,46 +86,730 @@ import (
 
 // Server holds our dependencies such as the SQLite DB.
 type Server struct {
-	db *sql.DB
+	db      *sql.DB
+	sampler *sampling.Sampler
+	mailer  *notify.Mailer
+	pusher  *notify.Pusher
+	hooks   *webhooks.Deliverer
+	follows *follows.Service
+	blobs   *blobs.Store
+	quotas  *quotas.Enforcer
+	dict    *dictionary.Dictionary
+	clock   clock.Clock
+	// store keeps the events.
+	store storage.Storage
+	// maxBodyBytes caps the body of a single JSON event.
+	maxBodyBytes int64
+	// ids names the entities of events posted without an entity ID.
+	ids *ids.Generator
+	// validator rejects malformed events before they are stored.
+	validator *ingest.Validator
+	// dedup skips events posted with the content of a recent one.
+	dedup *dedup.Deduplicator
+	// deadLetters keeps events that could not be enriched or stored.
+	deadLetters *deadletter.Store
+	// costs counts the events each tenant writes.
+	costs *costs.Meter
+	// queue, when async ingest is on, stores events posted to /event in
+	// the background.
+	queue *ingest.Queue
+	// cold is set when the cold tier is attached, so exports may include
+	// it.
+	cold bool
+	// inDB is set when store keeps events in db, where lineage and the
+	// full-text index cover them.
+	inDB bool
 }
 
 func main() {
+	configPath := flag.String("config", "quickie.json", "path to the JSON configuration file")
+	dbPath := flag.String("db", "events.db", "path to the SQLite database, or "+initdb.Memory+" to keep every database in memory")
+	storageName := flag.String("storage", "", "driver events are stored with, overriding the storage setting; \"memory\" keeps them in memory")
+	migrate := flag.Int("migrate", initdb.Latest, "migrate the database to this schema version, reverting newer migrations, and exit")
+	addr := flag.String("addr", ":4433", "address to serve QUIC on, and TCP with tcp_fallback")
+	certFile := flag.String("cert", "cert.pem", "path to the TLS certificate")
+	keyFile := flag.String("key", "key.pem", "path to the TLS certificate's private key")
+	flag.Parse()
+	// Relative paths are taken from the binary's directory on Windows.
+	if err := service.Chdir(); err != nil {
+		log.Fatalf("Failed to change directory: %v", err)
+	}
+	// Size the runtime to the container before anything is sized by it.
+	limits.Apply()
+	if *storageName == "memory" && !flagSet("db") {
+		// Nothing else touches disk either.
+		*dbPath = initdb.Memory
+	}
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	if *storageName != "" {
+		cfg.Storage = *storageName
+	}
+	// Features reading events from SQLite see none stored by other
+	// drivers: those configured are refused, the others are not served.
+	inDB := storage.InDatabase(cfg.Storage)
+	if features := sqliteFeatures(cfg); !inDB && len(features) > 0 {
+		log.Fatalf("Refusing to start: %s read events from SQLite, which the %s storage driver does not store them in", strings.Join(features, ", "), cfg.Storage)
+	}
+	fromDB := func(h http.Handler) http.Handler {
+		if inDB {
+			return h
+		}
+		return unavailable(cfg.Storage)
+	}
+
+	// Only statements from the catalog reach SQLite.
+	if err := sqlguard.SetMode(cfg.SQLGuard); err != nil {
+		log.Fatalf("Failed to configure SQL guard: %v", err)
+	}
+
+	memory := *dbPath == initdb.Memory
+	if memory {
+		// The cold tier and routed databases are kept in memory too, under
+		// their configured names.
+		if cfg.Tiering.ColdPath != "" {
+			cfg.Tiering.ColdPath = initdb.InMemory(cfg.Tiering.ColdPath)
+		}
+		for i, d := range cfg.Databases {
+			cfg.Databases[i].Path = initdb.InMemory(d.Path)
+		}
+	} else {
+		// Never serve from a damaged database file; a corrupt one is
+		// replaced with its latest backup when there is one.
+		paths := []string{*dbPath}
+		if cfg.Tiering.ColdPath != "" {
+			paths = append(paths, cfg.Tiering.ColdPath)
+		}
+		for _, d := range cfg.Databases {
+			paths = append(paths, d.Path)
+		}
+		if err := recovery.Check(paths, cfg.Recovery); err != nil {
+			log.Fatalf("Refusing to start: %v", err)
+		}
+	}
+
+	// Old events live in a cold database attached to every connection.
+	if cfg.Tiering.ColdPath != "" {
+		tiering.Attach(cfg.Tiering.ColdPath)
+	}
+
+	// Busy entity types can live in their own database files.
+	if err := routing.Attach(cfg.Databases); err != nil {
+		log.Fatalf("Failed to configure databases: %v", err)
+	}
+
+	if flagSet("migrate") {
+		if err := initdb.MigrateDB(*dbPath, cfg.SQLite, *migrate); err != nil {
+			log.Fatalf("Failed to migrate DB: %v", err)
+		}
+		log.Printf("Migrated %s", *dbPath)
+		return
+	}
+
 	// Initialize SQLite DB.
-	db, err := initdb.InitDB("events.db")
+	db, err := initdb.InitDB(*dbPath, cfg.SQLite)
 	if err != nil {
 		log.Fatalf("Failed to initialize DB: %v", err)
 	}
 	defer db.Close()
 
+	// Background work runs until the server stops.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Large payloads are stored compressed, including those written before.
+	compression.SetMinSize(cfg.Compression.MinSize)
+	jobs.Go(ctx, "compression_backfill", 0, compression.NewBackfill(db).Run)
+
+	// Index events stored before full-text search existed.
+	if inDB {
+		jobs.Go(ctx, "fulltext_backfill", 0, fulltext.NewBackfill(db).Run)
+	}
+
+	// Connect to MongoDB when configured.
+	if cfg.Mongo.URI != "" {
+		if err := mongops.Connect(cfg.Mongo.URI); err != nil {
+			log.Fatalf("Failed to connect to MongoDB: %v", err)
+		}
+		defer mongops.Disconnect()
+	}
+
+	// A standby applies the change feed of its primary until it is
+	// promoted. Jobs writing events of their own wait for the promotion;
+	// the primary's changes reach the standby through the feed.
+	cold := cfg.Tiering.ColdPath != ""
+	changes, err := standby.NewFeed(db, cfg.Standby, cold)
+	if err != nil {
+		log.Fatalf("Failed to create the change feed: %v", err)
+	}
+	replica, err := standby.New(db, cfg.Standby, cold)
+	if err != nil {
+		log.Fatalf("Failed to configure the standby: %v", err)
+	}
+
+	if cold {
+		mover, err := tiering.New(db, cfg.Tiering, clock.Real)
+		if err != nil {
+			log.Fatalf("Failed to create cold tier: %v", err)
+		}
+		replica.WhenPrimary(func() {
+			jobs.Go(ctx, "tiering", cfg.Tiering.Interval.Duration, func(ctx context.Context) {
+				mover.Run(ctx, cfg.Tiering.Interval.Duration)
+			})
+		})
+	}
+	if changes != nil {
+		jobs.Go(ctx, "change_log_prune", time.Hour, func(ctx context.Context) {
+			changes.Run(ctx, time.Hour)
+		})
+	}
+	if replica != nil {
+		jobs.Go(ctx, "standby", cfg.Standby.Interval.Duration, func(ctx context.Context) {
+			replica.Run(ctx, cfg.Standby.Interval.Duration)
+		})
+	}
+
+	// Keep planner statistics current and watch for plan regressions.
+	plans := planwatch.New(db, cfg.Planner)
+	jobs.Go(ctx, "planwatch", cfg.Planner.Interval.Duration, func(ctx context.Context) {
+		plans.Run(ctx, cfg.Planner.Interval.Duration)
+	})
+
+	// Noisy entity types are sampled; their counters stay exact.
+	sampler := sampling.New(db, cfg.Sampling)
+
+	// A runaway entity type must not crowd out the others.
+	enforcer, err := quotas.New(db, cfg.Quotas)
+	if err != nil {
+		log.Fatalf("Failed to configure storage quotas: %v", err)
+	}
+	replica.WhenPrimary(func() {
+		jobs.Go(ctx, "quotas", cfg.Quotas.Interval.Duration, func(ctx context.Context) {
+			enforcer.Run(ctx, cfg.Quotas.Interval.Duration)
+		})
+	})
+
 	// Create our server instance.
-	srv := &Server{db: db}
+	srv := &Server{db: db, sampler: sampler, follows: follows.New(db), quotas: enforcer, dict: dictionary.New(db), clock: clock.Real, maxBodyBytes: cfg.MaxBodyBytes}
+	if srv.ids, err = ids.New(cfg.IDs, cfg.Shards.Self); err != nil {
+		log.Fatalf("Failed to configure ID generation: %v", err)
+	}
+	srv.validator = ingest.NewValidator(cfg.Validation)
+	srv.cold = cfg.Tiering.ColdPath != ""
+	srv.inDB = inDB
+	srv.dedup = dedup.New(db, cfg.Dedup)
+	srv.store, err = storage.Open(cfg.Storage, storage.Env{DB: db, Dictionary: srv.dict, Dedup: srv.dedup, DSN: cfg.StorageDSN})
+	if err != nil {
+		log.Fatalf("Failed to open storage: %v", err)
+	}
+	srv.costs = costs.New(db)
+	if !inDB {
+		srv.costs.SkipStorage()
+	}
+	srv.deadLetters = deadletter.New(db, func(event structs.Index) error {
+		_, err := srv.process(event, mongops.FetchDataFromMongoDB)
+		if errors.Is(err, storage.ErrDuplicateEvent) || errors.Is(err, storage.ErrDuplicateContent) {
+			// Stored since, by a retry of the sender's.
+			return nil
+		}
+		return err
+	})
+	jobs.Go(ctx, "costs", cfg.Costs.Interval.Duration, func(ctx context.Context) {
+		srv.costs.Run(ctx, cfg.Costs.Interval.Duration)
+	})
+	if cfg.AsyncIngest.Workers < 0 {
+		cfg.AsyncIngest.Workers = limits.Workers()
+	}
+	if cfg.AsyncIngest.Workers > 0 {
+		srv.queue = ingest.NewQueue(cfg.AsyncIngest.Workers, cfg.AsyncIngest.Queue, func(event structs.Index) error {
+			_, err := srv.ingest(event)
+			if errors.Is(err, storage.ErrDuplicateEvent) || errors.Is(err, storage.ErrDuplicateContent) {
+				return nil
+			}
+			return err
+		})
+	}
+	if srv.dedup.Enabled() {
+		jobs.Go(ctx, "dedup_gc", cfg.Dedup.Window.Duration, func(ctx context.Context) {
+			srv.dedup.Run(ctx, cfg.Dedup.Window.Duration)
+		})
+	}
+
+	// Email entity owners about changes when a relay is configured.
+	if cfg.SMTP.Addr != "" {
+		if srv.mailer, err = notify.NewMailer(db, cfg.SMTP); err != nil {
+			log.Fatalf("Failed to configure notifications: %v", err)
+		}
+	}
+
+	// Push entity changes to subscribed devices.
+	if cfg.Push.FCM.CredentialsFile != "" || cfg.Push.APNs.KeyFile != "" {
+		if srv.pusher, err = notify.NewPusher(db, cfg.Push); err != nil {
+			log.Fatalf("Failed to configure push notifications: %v", err)
+		}
+	}
+
+	// Send entity changes to webhook endpoints as CloudEvents.
+	if len(cfg.Webhooks) > 0 {
+		if srv.hooks, err = webhooks.New(cfg.Webhooks); err != nil {
+			log.Fatalf("Failed to configure webhooks: %v", err)
+		}
+	}
+
+	// Events may reference attachments uploaded to /blobs.
+	if srv.blobs = blobs.New(db, cfg.Attachments); srv.blobs != nil {
+		jobs.Go(ctx, "blobs_gc", cfg.Attachments.GCInterval.Duration, func(ctx context.Context) {
+			srv.blobs.Run(ctx, cfg.Attachments.GCInterval.Duration)
+		})
+	}
+
+	// Clicks and impressions bypass enrichment and are written in batches.
+	tracker := analytics.NewTracker(db, sampler, srv.validator, cfg.MaxBodyBytes, clock.Real)
+
+	// Accept events by mail from systems that cannot call the API.
+	if cfg.MailIn.Addr != "" {
+		mailServer, err := mailin.New(cfg.MailIn, func(event structs.Index) error {
+			_, err := srv.ingest(event)
+			return err
+		})
+		if err != nil {
+			log.Fatalf("Failed to configure mail ingestion: %v", err)
+		}
+		replica.WhenPrimary(func() {
+			go func() {
+				log.Fatal(mailServer.ListenAndServe())
+			}()
+		})
+	}
+
+	// Keep hourly/daily roll-ups current for long-term metrics, rank
+	// entities by recent activity for the home screen and precompute
+	// "also viewed" recommendations.
+	trends := trending.New(db, cfg.Trending)
+	if inDB {
+		rollup := rollups.NewJob(db)
+		jobs.Go(ctx, "rollups", cfg.RollupInterval.Duration, func(ctx context.Context) {
+			rollup.Run(ctx, cfg.RollupInterval.Duration)
+		})
+		jobs.Go(ctx, "trending", cfg.Trending.Interval.Duration, func(ctx context.Context) {
+			trends.Run(ctx, cfg.Trending.Interval.Duration)
+		})
+		recommender := related.NewJob(db, cfg.Related)
+		jobs.Go(ctx, "related", cfg.Related.Interval.Duration, func(ctx context.Context) {
+			recommender.Run(ctx, cfg.Related.Interval.Duration)
+		})
+	}
+
+	// Materialize change data capture sources as events.
+	// Changes go through ingest like any event, enriched with the data
+	// they carry. Ones that can never be stored are skipped, so they do
+	// not hold their source at the same checkpoint.
+	hub := cdc.NewHub(db, func(event structs.Index, data structs.MongoData) error {
+		_, err := srv.ingestWith(event, func(structs.Index) (structs.MongoData, error) {
+			return data, nil
+		})
+		var invalid *ingest.ValidationError
+		var failed *stageError
+		switch {
+		case errors.Is(err, storage.ErrDuplicateEvent), errors.Is(err, storage.ErrDuplicateContent):
+			return nil
+		case errors.As(err, &invalid), errors.Is(err, quotas.ErrExceeded):
+			return cdc.Skip(err)
+		case errors.As(err, &failed):
+			// Dead-lettered, to be replayed from there.
+			return cdc.Skip(err)
+		}
+		return err
+	})
+	for _, watch := range cfg.Mongo.Watch {
+		hub.Add(mongops.NewChangeStream(cfg.Mongo.Database, watch))
+	}
+	for _, path := range cfg.TailFiles {
+		hub.Add(&cdc.FileTail{Path: path})
+	}
+	for _, pg := range cfg.PGLogical {
+		hub.Add(pglogical.New(pg))
+	}
+	replica.WhenPrimary(hub.Start)
+
+	// Ingest files that partners drop into the configured directory.
+	if cfg.FileDrop.Dir != "" {
+		watcher := filedrop.NewWatcher(db, cfg.FileDrop.Dir, func(event structs.Index) error {
+			_, err := srv.ingest(event)
+			return err
+		})
+		replica.WhenPrimary(func() {
+			jobs.Go(ctx, "filedrop", cfg.FileDrop.Interval.Duration, func(ctx context.Context) {
+				watcher.Run(ctx, cfg.FileDrop.Interval.Duration)
+			})
+
+			// Partner SFTP servers feed the same drop directory.
+			for _, partner := range cfg.SFTP {
+				jobs.Go(ctx, "sftp_"+partner.Name, partner.Interval.Duration, sftppull.New(db, partner, cfg.FileDrop.Dir).Run)
+			}
+		})
+	}
+
+	// User accounts and access tokens.
+	users, err := accounts.New(db, cfg.Auth)
+	if err != nil {
+		log.Fatalf("Failed to configure accounts: %v", err)
+	}
+
+	// Feature flags for dark launches, per tenant or percentage.
+	featureFlags, err := flags.New(db, cfg.Flags)
+	if err != nil {
+		log.Fatalf("Failed to load feature flags: %v", err)
+	}
+	jobs.Go(ctx, "flags", 30*time.Second, func(ctx context.Context) {
+		featureFlags.Run(ctx, 30*time.Second)
+	})
+
+	// Partners may sign requests; some routes require it.
+	signed, err := signatures.New(db, cfg.Signatures)
+	if err != nil {
+		log.Fatalf("Failed to load signing keys: %v", err)
+	}
+	jobs.Go(ctx, "signing_keys", 30*time.Second, func(ctx context.Context) {
+		signed.Run(ctx, 30*time.Second)
+	})
+
+	// Tenants are spread across instances; ingest requests for another
+	// instance's tenant are sent there.
+	tenants, err := shards.New(cfg.Shards)
+	if err != nil {
+		log.Fatalf("Failed to configure shards: %v", err)
+	}
+	jobs.Go(ctx, "shard_map", cfg.Shards.Interval.Duration, func(ctx context.Context) {
+		tenants.Run(ctx, cfg.Shards.Interval.Duration)
+	})
+
+	// Instances may find each other by gossip instead of a static list.
+	cluster, err := gossip.New(cfg.Gossip, tenants, db)
+	if err != nil {
+		log.Fatalf("Failed to start gossip: %v", err)
+	}
+	if cluster != nil {
+		jobs.Go(ctx, "gossip", 0, cluster.Run)
+	}
+
+	// Rate limits hold across the instances found by gossip.
+	limiter, err := ratelimit.New(cfg.RateLimit, cfg.Shards.Self)
+	if err != nil {
+		log.Fatalf("Failed to configure rate limits: %v", err)
+	}
+	if cluster != nil {
+		limiter.SetPeers(cluster)
+	}
+	jobs.Go(ctx, "rate_limit_sync", cfg.RateLimit.Sync.Duration, func(ctx context.Context) {
+		limiter.Run(ctx, cfg.RateLimit.Sync.Duration)
+	})
+
+	// Clients are steered to the nearest healthy region.
+	steering, err := regions.New(cfg.Regions)
+	if err != nil {
+		log.Fatalf("Failed to configure regions: %v", err)
+	}
+	if steering != nil {
+		jobs.Go(ctx, "regions", cfg.Regions.Interval.Duration, func(ctx context.Context) {
+			steering.Run(ctx, cfg.Regions.Interval.Duration)
+		})
+	}
+
+	// Alert on tenants whose events are stored or delivered too slowly.
+	slaMonitor := sla.New(cfg.SLA)
+	jobs.Go(ctx, "sla", cfg.SLA.Interval.Duration, func(ctx context.Context) {
+		slaMonitor.Run(ctx, cfg.SLA.Interval.Duration)
+	})
+
+	// Retried writes are deduplicated by the instance owning the tenant.
+	idem := idempotency.New(db, cfg.Idempotency)
+	if expirer, ok := srv.store.(storage.KeyExpirer); ok {
+		idem.ExpireWith(expirer.ExpireKeys)
+	}
+	jobs.Go(ctx, "idempotency_gc", cfg.Idempotency.Interval.Duration, func(ctx context.Context) {
+		idem.Run(ctx, cfg.Idempotency.Interval.Duration)
+	})
 
 	// Set up HTTP mux with our event handler.
 	mux := http.NewServeMux()
-	mux.HandleFunc("/event", srv.EventHandler)
-	mux.HandleFunc("/events/", handlers.GetEventsByTypeHandler) // Matches /events/{ENTITY_TYPE}
+	// Public mode lets anonymous callers read some entity types, redacted,
+	// and write nothing.
+	gate := public.New(cfg.Public)
+	mux.Handle("/event", gate.ReadOnly(tenants.Middleware(idem.Middleware(http.HandlerFunc(srv.EventHandler)))))
+	mux.Handle("/event/cbor", gate.ReadOnly(tenants.Middleware(idem.Middleware(http.HandlerFunc(srv.FramesHandler)))))
+	if gate != nil {
+		mux.HandleFunc("/robots.txt", gate.RobotsHandler)
+	}
+	mux.Handle("/event/", gate.Wrap(nil, tenants.Middleware(idem.Middleware(http.HandlerFunc(srv.EventByIDHandler))))) // Matches /event/{ID}
+	search := handlers.NewSearch(srv.follows)
+	// Ranked full-text search, rolled out with the search_canary flag.
+	if inDB {
+		search.SetCanary(fulltext.New(db))
+	}
+	mux.Handle("/events/", gate.Wrap(public.PathType("/events/"), http.HandlerFunc(search.GetEventsByTypeHandler))) // Matches /events/{ENTITY_TYPE}
+	mux.Handle("/suggest/", gate.Wrap(public.PathType("/suggest/"), fromDB(fulltext.NewSuggester(db))))             // Matches /suggest/{ENTITY_TYPE}
+	mux.HandleFunc("/t", tracker.PixelHandler)
+	mux.Handle("/track", tenants.Middleware(idem.Middleware(http.HandlerFunc(tracker.TrackHandler))))
+	// Totals and series span every tenant, so only admins may read them.
+	mux.Handle("/grafana/", users.RequireAdmin(fromDB(rollups.NewGrafana(db)))) // Grafana SimpleJSON datasource
+	mux.Handle("/stats", users.RequireAdmin(fromDB(rollups.NewStats(db))))
+	health := limits.NewHealth(db)
+	mux.Handle("/health", health)
+	if steering != nil {
+		mux.Handle("/regions", steering)
+	}
+	mux.Handle("/stats/events", users.RequireAdmin(fromDB(rollups.NewCounts(db))))
+	mux.Handle("/trending", gate.Wrap(public.QueryType("type"), fromDB(trends)))
+	mux.HandleFunc("/flags", featureFlags.FlagsHandler)
+	experiment := experiments.New(db, func(event structs.Index) error {
+		_, err := srv.ingest(event)
+		return err
+	})
+	mux.HandleFunc("/experiments/assignments", experiment.AssignmentsHandler)
+	mux.Handle("/experiments/", gate.ReadOnly(http.HandlerFunc(experiment.ExposureHandler)))           // Matches /experiments/{NAME}/exposure
+	mux.Handle("/entities/", gate.Wrap(public.PathType("/entities/"), fromDB(related.NewHandler(db)))) // Matches /entities/{ENTITY_TYPE}/{ENTITY_ID}/related
+	docs := documents.New(db, func(event structs.Index) error {
+		_, err := srv.ingest(event)
+		return err
+	})
+	mux.Handle("/documents/", gate.Wrap(public.PathType("/documents/"), docs)) // Matches /documents/{ENTITY_TYPE}/{ENTITY_ID}
+	gateway, err := mongops.NewGateway(cfg.Mongo)
+	if err != nil {
+		log.Fatalf("Failed to configure the MongoDB gateway: %v", err)
+	}
+	mux.Handle("/mongo/", gateway) // Matches /mongo/{COLLECTION}
+	if changes != nil {
+		mux.Handle("/replication/changes", changes)
+	}
+	if srv.blobs != nil {
+		mux.Handle("/blobs", gate.ReadOnly(srv.blobs))
+		mux.Handle("/blobs/", gate.ReadOnly(srv.blobs)) // Matches /blobs/{SHA256}
+	}
+	mux.HandleFunc("/accounts/register", users.RegisterHandler)
+	mux.HandleFunc("/accounts/login", users.LoginHandler)
+	mux.HandleFunc("/accounts/refresh", users.RefreshHandler)
+	mux.HandleFunc("/accounts/logout", users.LogoutHandler)
+	mux.HandleFunc("/me", users.MeHandler)
+	mux.HandleFunc("/me/sessions", users.SessionsHandler)
+	mux.HandleFunc("/me/sessions/", users.SessionsHandler)
+	mux.HandleFunc("/me/2fa", users.TwoFactorHandler)
+	mux.HandleFunc("/me/2fa/verify", users.TwoFactorHandler)
+	feed := activity.New(db)
+	feed.SetCold(cfg.Tiering.ColdPath != "")
+	mux.Handle("/me/activity", fromDB(http.HandlerFunc(feed.ActivityHandler)))
+	mux.HandleFunc("/me/favorites/", feed.FavoritesHandler) // Matches /me/favorites/{ENTITY_TYPE}/{ENTITY_ID}
+	mux.HandleFunc("/me/follows", srv.follows.FollowsHandler)
+	mux.HandleFunc("/me/follows/", srv.follows.FollowsHandler) // Matches /me/follows/{ENTITY_TYPE}/{ENTITY_ID}
+	mux.HandleFunc("/me/notifications", srv.follows.NotificationsHandler)
+	mux.HandleFunc("/me/notifications/read", srv.follows.NotificationsHandler)
+
+	// Admin routes require an admin or operator signed in with 2FA.
+	admin := http.NewServeMux()
+	admin.Handle("/admin/vars", expvar.Handler())
+	admin.HandleFunc("/admin/users/", users.RoleHandler) // Matches /admin/users/{ID}/role
+	admin.HandleFunc("/admin/flags", featureFlags.AdminHandler)
+	admin.HandleFunc("/admin/flags/", featureFlags.AdminHandler) // Matches /admin/flags/{NAME}
+	admin.HandleFunc("/admin/experiments", experiment.AdminHandler)
+	admin.HandleFunc("/admin/experiments/", experiment.AdminHandler) // Matches /admin/experiments/{NAME}
+	admin.HandleFunc("/admin/signing-keys", signed.AdminHandler)
+	admin.HandleFunc("/admin/signing-keys/", signed.AdminHandler) // Matches /admin/signing-keys/{KEY_ID}
+	admin.HandleFunc("/admin/query-plans", plans.AdminHandler)
+	admin.HandleFunc("/admin/query-plans/", plans.AdminHandler) // Matches /admin/query-plans/{HASH}
+	admin.HandleFunc("/admin/sla", slaMonitor.AdminHandler)
+	admin.HandleFunc("/admin/costs", srv.costs.AdminHandler)
+	admin.HandleFunc("/admin/dead-letters", srv.deadLetters.AdminHandler)
+	admin.HandleFunc("/admin/dead-letters/", srv.deadLetters.AdminHandler) // Matches /admin/dead-letters/{ID}[/retry]
+	admin.HandleFunc("/admin/import", srv.ImportHandler)
+	admin.HandleFunc("/admin/export", srv.ExportHandler)
+	admin.Handle("/admin/diff", fromDB(rollups.NewDiff(db)))
+	if cluster != nil {
+		admin.HandleFunc("/admin/node", cluster.AdminHandler)
+		admin.HandleFunc("/admin/cluster", cluster.AdminHandler)
+		admin.HandleFunc("/admin/cluster/", cluster.AdminHandler) // Matches /admin/cluster/{NAME}
+	}
+	if replica != nil {
+		admin.HandleFunc("/admin/standby", replica.AdminHandler)
+		admin.HandleFunc("/admin/standby/promote", replica.AdminHandler)
+	}
+	mux.Handle("/admin/", users.RequireAdmin(admin))
+
+	// Exports, imports, reindexes and replays run in the background too,
+	// for tasks longer than a request should last.
+	ops, err := operations.New(db, cfg.Operations)
+	if err != nil {
+		log.Fatalf("Failed to create operations: %v", err)
+	}
+	ops.Register("export", srv.startExport)
+	ops.Register("import", srv.startImport)
+	ops.Register("reindex", srv.startReindex)
+	ops.Register("replay", srv.startReplay)
+	jobs.Go(ctx, "operations_prune", time.Hour, func(ctx context.Context) {
+		ops.Run(ctx, time.Hour)
+	})
+	mux.Handle("/operations", users.RequireAdmin(ops))
+	mux.Handle("/operations/", users.RequireAdmin(ops)) // Matches /operations/{ID}[/result]
+	if srv.mailer != nil {
+		mux.HandleFunc("/notifications/owners", srv.mailer.OwnerHandler)
+		mux.HandleFunc("/notifications/preferences", srv.mailer.PreferencesHandler)
+		mux.HandleFunc("/notifications/unsubscribe", srv.mailer.UnsubscribeHandler)
+	}
+	if srv.pusher != nil {
+		mux.HandleFunc("/notifications/devices", srv.pusher.DevicesHandler)
+		mux.HandleFunc("/notifications/deliveries", srv.pusher.DeliveriesHandler)
+	}
+
+	// Fields are hidden from the roles not allowed to see them.
+	visible, err := visibility.New(cfg.Visibility)
+	if err != nil {
+		log.Fatalf("Failed to configure field visibility: %v", err)
+	}
+	// The standby replicates whole events whatever the fields' visibility.
+	visible.Exempt("/replication/changes")
+
+	// The statements the SQL guard lets through are fixed from now on.
+	sqlguard.Seal()
 
 	// Start the QUIC server using TLS.
+	headers := secheaders.New(cfg.Headers)
 	quicServer := &http3.Server{
-		Addr:    ":4433",
-		Handler: mux,
+		Addr:    *addr,
+		Handler: headers.Middleware(digest.Middleware(signed.Middleware(users.Authenticate(srv.costs.Middleware(visible.Middleware(featureFlags.Middleware(limiter.Middleware(replica.Middleware(mux))))))))),
+	}
+
+	// Clients without UDP fall back to TCP, where they are told about
+	// HTTP/3 and to stick to HTTPS.
+	var fallback *http.Server
+	if cfg.TCPFallback {
+		fallback = &http.Server{
+			Addr: *addr,
+			Handler: headers.Fallback(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				quicServer.SetQUICHeaders(w.Header())
+				quicServer.Handler.ServeHTTP(w, r)
+			})),
+		}
+		go func() {
+			if err := fallback.ListenAndServeTLS(*certFile, *keyFile); !errors.Is(err, http.ErrServerClosed) {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	// The server is ready once it listens, which systemd and the Windows
+	// service control manager are told; either may stop it.
+	cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+	if err != nil {
+		log.Fatalf("Failed to load certificate: %v", err)
+	}
+	quicServer.TLSConfig = http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}})
+	err = service.Run("quickie", func() error {
+		conn, err := net.ListenPacket("udp", quicServer.Addr)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		log.Printf("QUIC server listening on %s...", conn.LocalAddr())
+		service.Ready(ctx, health.Check)
+		return quicServer.Serve(conn)
+	}, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if fallback != nil {
+			fallback.Shutdown(ctx)
+		}
+		quicServer.Shutdown(ctx)
+		// Connections still open after the grace period are closed.
+		quicServer.Close()
+	})
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	log.Println("QUIC server listening on port 4433...")
-	log.Fatal(quicServer.ListenAndServeTLS("cert.pem", "key.pem"))
+	// Jobs, operations and change data capture stop before the events and hits
+	// accepted so far are stored and the database is closed.
+	cancel()
+	jobs.Wait()
+	ops.Close()
+	hub.Stop()
+	if srv.queue != nil {
+		srv.queue.Close()
+	}
+	tracker.Close()
+	sampler.Close()
+	log.Println("Server stopped")
+}
+
+// sqliteFeatures returns the configured features that read events from
+// the server's SQLite database.
+func sqliteFeatures(cfg config.Config) []string {
+	var features []string
+	if cfg.Standby.Token != "" || cfg.Standby.Primary != "" {
+		features = append(features, "standby")
+	}
+	if cfg.Tiering.ColdPath != "" {
+		features = append(features, "tiering")
+	}
+	if len(cfg.Quotas.EntityTypes) > 0 {
+		features = append(features, "quotas")
+	}
+	return features
 }
 
-// eventHandler receives and processes incoming event POST requests.
+// unavailable answers that a feature reading events from SQLite is not
+// served with the storage driver.
+func unavailable(driver string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apierror.Write(w, "Not available with the "+driver+" storage driver", http.StatusNotImplemented)
+	})
+}
+
+// flagSet reports whether the flag name was given on the command line.
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// eventHandler receives and processes incoming event POST requests. A
+// Content-Type of application/x-ndjson streams many events in one body.
+// With ?upsert=true, an event refreshes the one last upserted for its
+// entity and item instead of adding another. With async ingest on, a JSON
+// event is answered with 202 once it is validated and queued.
 func (s *Server) EventHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+		apierror.Write(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	upsert := false
+	if v := r.URL.Query().Get("upsert"); v != "" {
+		var err error
+		if upsert, err = strconv.ParseBool(v); err != nil {
+			apierror.Write(w, "upsert must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/x-ndjson" {
+		s.streamEvents(w, r, upsert)
+		return
+	}
+	received := time.Now()
 
 	// Read request body.
-	body, err := io.ReadAll(r.Body)
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.maxBodyBytes))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		apierror.Write(w, "Body larger than "+strconv.FormatInt(tooLarge.Limit, 10)+" bytes", http.StatusRequestEntityTooLarge)
+		return
+	}
 	if err != nil {
-		http.Error(w, "Failed to read body", http.StatusBadRequest)
+		apierror.Write(w, "Failed to read body", http.StatusBadRequest)
 		return
 	}
 	defer r.Body.Close()
@@ -65,45 +817,1023 @@ func (s *Server) EventHandler(w http.ResponseWriter, r *http.Request) {
 	// Parse JSON into an Index instance.
 	var event structs.Index
 	if err := json.Unmarshal(body, &event); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		apierror.WriteCode(w, apierror.CodeInvalidJSON, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
+	event.Tenant = r.Header.Get("X-Tenant-ID")
+	event.Payer = costs.Payer(r)
+	event.IdempotencyKey = r.Header.Get("Idempotency-Key")
+	event.Upsert = upsert
+	event.ReceivedAt = received
+	event.Lineage = structs.Lineage{Connector: "http"}
+	// Events of new entities may leave the entity ID to the server, which
+	// returns the one it made.
+	generated := s.assignID(&event)
+	if claims, ok := accounts.FromContext(r.Context()); ok {
+		event.UserId = claims.Subject
+	}
 
 	log.Printf("Received event: %+v", event)
 
-	// Fetch additional data from MongoDB (dummy implementation).
-	mongoData, err := mongops.FetchDataFromMongoDB(event)
-	if err != nil {
-		// Log the error; you can decide whether to fail the request or continue.
-		log.Printf("Error fetching MongoDB data: %v", err)
-		// In this example, we continue without the additional info.
+	if message, status := s.checkAttachments(event); message != "" {
+		apierror.Write(w, message, status)
+		return
 	}
 
-	// Store the event and additional MongoDB data in SQLite.
-	if err := s.storeEvent(event, mongoData); err != nil {
-		http.Error(w, "Failed to store event", http.StatusInternalServerError)
+	if s.queue != nil {
+		s.enqueueEvent(w, event, generated)
+		return
+	}
+
+	id, err := s.ingest(event)
+	var invalid *ingest.ValidationError
+	if errors.As(err, &invalid) {
+		apierror.WriteFields(w, apierror.CodeInvalidEvent, "Invalid event", http.StatusUnprocessableEntity, invalid.Fields)
+		return
+	}
+	if errors.Is(err, storage.ErrDuplicateContent) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, `{"message": "Event received and skipped (duplicate)"}`)
+		return
+	}
+	if errors.Is(err, storage.ErrDuplicateEvent) {
+		// Answer a duplicate as the original submission was.
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, `{"message": "Event received and stored successfully"}`)
+		return
+	}
+	if errors.Is(err, quotas.ErrExceeded) {
+		apierror.WriteCode(w, apierror.CodeQuotaExceeded, "Storage quota exceeded for entity type "+event.EntityType, http.StatusInsufficientStorage)
+		return
+	}
+	if err != nil {
+		apierror.Write(w, "Failed to store event", http.StatusInternalServerError)
 		log.Printf("Error storing event: %v", err)
 		return
 	}
 
-	// Send a success response.
+	// Sampled-out events are counted but not enriched or stored.
+	if id == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, `{"message": "Event received and counted (sampled out)"}`)
+		return
+	}
+
+	// Send a success response, with the id GET /event/{ID} reads the event
+	// by.
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/event/"+strconv.FormatInt(id, 10))
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprintln(w, `{"message": "Event received and stored successfully"}`)
-}
-
-// storeEvent inserts the event data along with MongoDB data into the SQLite database.
-func (s *Server) storeEvent(event structs.Index, mongoData structs.MongoData) error {
-	insertSQL := `
-	INSERT INTO events (entity_type, action, entity_id, item_id, item_type, additional_info)
-	VALUES (?, ?, ?, ?, ?, ?);`
-	_, err := s.db.Exec(insertSQL,
-		event.EntityType,
-		event.Action,
-		event.EntityId,
-		event.ItemId,
-		event.ItemType,
-		mongoData.AdditionalInfo,
-	)
+	if generated != "" {
+		fmt.Fprintf(w, `{"message": "Event received and stored successfully", "id": %d, "entity_id": %q}`+"\n", id, generated)
+		return
+	}
+	fmt.Fprintf(w, `{"message": "Event received and stored successfully", "id": %d}`+"\n", id)
+}
+
+// assignID gives event an entity ID generated by the server when it has
+// none, and returns it as stored, qualified by the event's source. It
+// returns "" when the event has an ID or the scheme generates none.
+func (s *Server) assignID(event *structs.Index) string {
+	if event.EntityId != "" {
+		return ""
+	}
+	if event.EntityId = s.ids.New(); event.EntityId == "" {
+		return ""
+	}
+	event.GeneratedID = true
+	return ingest.QualifiedID(event.Source, event.EntityId)
+}
+
+// generatedID is an entity ID generated for the event at Offset of a
+// stream, its line or frame.
+type generatedID struct {
+	Offset   int    `json:"offset"`
+	EntityID string `json:"entity_id"`
+}
+
+// streamSummary answers a stream of events: how many were received and
+// stored, and the entity IDs generated for those posted without one.
+type streamSummary struct {
+	Received  int           `json:"received"`
+	Stored    int           `json:"stored"`
+	Generated []generatedID `json:"generated,omitempty"`
+}
+
+// checkAttachments returns why the attachments of event cannot be
+// accepted and the status to reply with, or "" when they can.
+func (s *Server) checkAttachments(event structs.Index) (string, int) {
+	if len(event.Attachments) == 0 {
+		return "", 0
+	}
+	if s.blobs == nil {
+		return "Attachments are not enabled", http.StatusBadRequest
+	}
+	missing, err := s.blobs.Missing(event.Attachments)
+	if err != nil {
+		return "Failed to check attachments", http.StatusInternalServerError
+	}
+	if len(missing) > 0 {
+		return "Unknown attachments: " + strings.Join(missing, ", "), http.StatusUnprocessableEntity
+	}
+	return "", 0
+}
+
+// enqueueEvent answers an event posted to /event with async ingest on: it
+// is validated now, and queued to be enriched and stored in the
+// background.
+func (s *Server) enqueueEvent(w http.ResponseWriter, event structs.Index, generated string) {
+	var invalid *ingest.ValidationError
+	if errors.As(s.validator.Check(event), &invalid) {
+		apierror.WriteFields(w, apierror.CodeInvalidEvent, "Invalid event", http.StatusUnprocessableEntity, invalid.Fields)
+		return
+	}
+	if !s.queue.Enqueue(event) {
+		apierror.WriteCode(w, apierror.CodeQueueFull, "Ingest queue full", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if generated != "" {
+		fmt.Fprintf(w, `{"message": "Event accepted", "entity_id": %q}`+"\n", generated)
+		return
+	}
+	fmt.Fprintln(w, `{"message": "Event accepted"}`)
+}
+
+// streamEvents ingests newline-delimited JSON events as they arrive, so
+// a client can stream any number of events in one request. Events are
+// stored line by line; when a line fails, the events before it stay
+// stored and the error names the line to resume from. The summary lists
+// the entity IDs generated for events without one, by line.
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request, upsert bool) {
+	tenant, payer, key := r.Header.Get("X-Tenant-ID"), costs.Payer(r), r.Header.Get("Idempotency-Key")
+	claims, authenticated := accounts.FromContext(r.Context())
+	var summary streamSummary
+	err := ingest.ReadNDJSON(r.Body, func(line int, event structs.Index) error {
+		event.Tenant = tenant
+		event.Payer = payer
+		event.IdempotencyKey = key
+		event.Upsert = upsert
+		event.Lineage = structs.Lineage{Connector: "ndjson", Offset: int64(line)}
+		generated := s.assignID(&event)
+		if authenticated {
+			event.UserId = claims.Subject
+		}
+		if message, status := s.checkAttachments(event); message != "" {
+			return &streamError{line: line, message: message, status: status}
+		}
+		id, err := s.ingest(event)
+		if errors.Is(err, storage.ErrDuplicateContent) || errors.Is(err, storage.ErrDuplicateEvent) {
+			summary.Received++
+			return nil
+		}
+		var invalid *ingest.ValidationError
+		if errors.As(err, &invalid) {
+			return &streamError{line: line, code: apierror.CodeInvalidEvent, message: invalid.Error(), status: http.StatusUnprocessableEntity}
+		}
+		if errors.Is(err, quotas.ErrExceeded) {
+			return &streamError{line: line, code: apierror.CodeQuotaExceeded,
+				message: "Storage quota exceeded for entity type " + event.EntityType, status: http.StatusInsufficientStorage}
+		}
+		if err != nil {
+			log.Printf("Error storing streamed event: %v", err)
+			return &streamError{line: line, message: "Failed to store event", status: http.StatusInternalServerError}
+		}
+		summary.Received++
+		if id != 0 {
+			summary.Stored++
+			if generated != "" {
+				summary.Generated = append(summary.Generated, generatedID{Offset: line, EntityID: generated})
+			}
+		}
+		return nil
+	})
+
+	var streamErr *streamError
+	var parseErr *ingest.ParseError
+	switch {
+	case errors.As(err, &streamErr):
+		apierror.WriteCode(w, streamErr.code, fmt.Sprintf("Line %d: %s (%d events before it received)", streamErr.line, streamErr.message, summary.Received), streamErr.status)
+		return
+	case errors.As(err, &parseErr):
+		apierror.WriteCode(w, apierror.CodeInvalidJSON, fmt.Sprintf("Line %d: invalid JSON (%d events before it received)", parseErr.Line, summary.Received), http.StatusBadRequest)
+		return
+	case err != nil:
+		apierror.Write(w, fmt.Sprintf("Failed to read body (%d events received)", summary.Received), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(summary)
+}
+
+// streamError stops an event stream at a line that could not be ingested.
+type streamError struct {
+	line    int
+	code    string
+	message string
+	status  int
+}
+
+func (e *streamError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.line, e.message)
+}
+
+// maxFramesBody caps a CBOR frame stream posted to /event/cbor.
+const maxFramesBody = 1 << 20
+
+// FramesHandler ingests a stream of compact CBOR event frames from
+// constrained devices. The whole stream is decoded before any event is
+// ingested, so a malformed stream can be resent without duplicates.
+func (s *Server) FramesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		apierror.Write(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "" && ct != "application/cbor" && ct != "application/cbor-seq" {
+		apierror.Write(w, "Content-Type must be application/cbor-seq", http.StatusUnsupportedMediaType)
+		return
+	}
+	received := time.Now()
+
+	var events []structs.Index
+	summary := streamSummary{}
+	err := ingest.ReadCBOR(http.MaxBytesReader(w, r.Body, maxFramesBody), func(frame int, event structs.Index) error {
+		event.Lineage = structs.Lineage{Connector: "cbor", Offset: int64(frame)}
+		if generated := s.assignID(&event); generated != "" {
+			summary.Generated = append(summary.Generated, generatedID{Offset: frame, EntityID: generated})
+		}
+		events = append(events, event)
+		return nil
+	})
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		apierror.Write(w, "Frame stream too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		apierror.Write(w, "Invalid frame stream: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Reject the whole stream if any frame is invalid, before storing any.
+	var fields []apierror.FieldError
+	for i, event := range events {
+		var invalid *ingest.ValidationError
+		if errors.As(s.validator.Check(event), &invalid) {
+			for _, f := range invalid.Fields {
+				fields = append(fields, apierror.FieldError{Field: fmt.Sprintf("[%d].%s", i, f.Field), Message: f.Message})
+			}
+		}
+	}
+	if fields != nil {
+		apierror.WriteFields(w, apierror.CodeInvalidEvent, "Invalid frames", http.StatusUnprocessableEntity, fields)
+		return
+	}
+
+	tenant, payer, key := r.Header.Get("X-Tenant-ID"), costs.Payer(r), r.Header.Get("Idempotency-Key")
+	claims, authenticated := accounts.FromContext(r.Context())
+	for _, event := range events {
+		event.Tenant = tenant
+		event.Payer = payer
+		event.IdempotencyKey = key
+		event.ReceivedAt = received
+		if authenticated {
+			event.UserId = claims.Subject
+		}
+		id, err := s.ingest(event)
+		if errors.Is(err, quotas.ErrExceeded) {
+			apierror.WriteCode(w, apierror.CodeQuotaExceeded, "Storage quota exceeded for entity type "+event.EntityType, http.StatusInsufficientStorage)
+			return
+		}
+		if errors.Is(err, storage.ErrDuplicateContent) || errors.Is(err, storage.ErrDuplicateEvent) {
+			continue
+		}
+		if err != nil {
+			apierror.Write(w, "Failed to store event", http.StatusInternalServerError)
+			log.Printf("Error storing framed event: %v", err)
+			return
+		}
+		if id != 0 {
+			summary.Stored++
+		}
+	}
+
+	summary.Received = len(events)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(summary)
+}
+
+// Bulk imports report progress every importProgressEvery records and list
+// at most maxImportRejects rejected rows.
+const (
+	importProgressEvery = 1000
+	maxImportRejects    = 1000
+)
+
+// importReject is a row of a bulk import that was not stored.
+type importReject struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// importSummary counts the rows of a bulk import.
+type importSummary struct {
+	Line       int            `json:"line"`
+	Received   int            `json:"received"`
+	Stored     int            `json:"stored"`
+	Duplicates int            `json:"duplicates"`
+	Generated  int            `json:"generated"`
+	Rejected   int            `json:"rejected"`
+	Rejects    []importReject `json:"rejected_rows,omitempty"`
+	Truncated  bool           `json:"rejected_rows_truncated,omitempty"`
+	Error      string         `json:"error,omitempty"`
+}
+
+// ImportHandler handles POST /admin/import, which streams a CSV or NDJSON
+// upload of historical events into the tenant's events. The format is
+// taken from ?format=csv|ndjson or the Content-Type; ?file= names the
+// file in the events' lineage. Rows may carry a time of when they
+// happened. Rows that cannot be decoded, are invalid or
+// fail to store are rejected and the import goes on. The response is
+// NDJSON: a {"progress": ...} line every importProgressEvery rows and a
+// final {"summary": ...} listing the rejected rows.
+func (s *Server) ImportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		apierror.Write(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	format := importFormat(r)
+	if format == "" {
+		apierror.Write(w, "Send text/csv or application/x-ndjson, or set format to csv or ndjson", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	out := json.NewEncoder(w)
+	flusher := http.NewResponseController(w)
+	summary := s.importEvents(format, r.Header.Get("X-Tenant-ID"), r.URL.Query().Get("file"), r.Body,
+		func(summary *importSummary) error {
+			err := out.Encode(map[string]any{"progress": map[string]int{
+				"line": summary.Line, "received": summary.Received, "stored": summary.Stored,
+				"duplicates": summary.Duplicates, "rejected": summary.Rejected,
+			}})
+			if err == nil {
+				err = flusher.Flush()
+			}
+			return err
+		})
+	out.Encode(map[string]any{"summary": summary})
+}
+
+// importFormat is the format of the import in r, from ?format= or the
+// Content-Type, or "" when it is neither CSV nor NDJSON.
+func importFormat(r *http.Request) ingest.Format {
+	format := ingest.Format(r.URL.Query().Get("format"))
+	if format == "" {
+		switch mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType {
+		case "text/csv":
+			format = ingest.CSV
+		case "application/x-ndjson", "application/jsonl":
+			format = ingest.NDJSON
+		}
+	}
+	if format != ingest.CSV && format != ingest.NDJSON {
+		return ""
+	}
+	return format
+}
+
+// importEvents stores the events of the upload body in format for tenant,
+// naming file in their lineage, and returns the summary of the import.
+// progress is called every importProgressEvery rows; an error from it
+// stops the import.
+func (s *Server) importEvents(format ingest.Format, tenant, file string, body io.Reader, progress func(*importSummary) error) importSummary {
+	var summary importSummary
+	reject := func(line int, message string) {
+		summary.Rejected++
+		if len(summary.Rejects) < maxImportRejects {
+			summary.Rejects = append(summary.Rejects, importReject{Line: line, Error: message})
+		} else {
+			summary.Truncated = true
+		}
+	}
+	next := func(line int) error {
+		summary.Line = line
+		if (summary.Received+summary.Rejected)%importProgressEvery != 0 {
+			return nil
+		}
+		return progress(&summary)
+	}
+
+	err := ingest.ReadLenient(format, body, func(line int, event structs.Index) error {
+		event.Tenant = tenant
+		event.Lineage = structs.Lineage{Connector: "import", Origin: file, Offset: int64(line)}
+		generated := s.assignID(&event) != ""
+		if message, _ := s.checkAttachments(event); message != "" {
+			reject(line, message)
+			return next(line)
+		}
+		id, err := s.ingest(event)
+		var invalid *ingest.ValidationError
+		switch {
+		case errors.Is(err, storage.ErrDuplicateContent), errors.Is(err, storage.ErrDuplicateEvent):
+			summary.Received++
+			summary.Duplicates++
+		case errors.As(err, &invalid):
+			reject(line, invalid.Error())
+		case errors.Is(err, quotas.ErrExceeded):
+			reject(line, "storage quota exceeded for entity type "+event.EntityType)
+		case err != nil:
+			log.Printf("Error storing imported event: %v", err)
+			reject(line, "failed to store event")
+		default:
+			summary.Received++
+			if id != 0 {
+				summary.Stored++
+				if generated {
+					summary.Generated++
+				}
+			}
+		}
+		return next(line)
+	}, func(parseErr *ingest.ParseError) error {
+		reject(parseErr.Line, parseErr.Err.Error())
+		return next(parseErr.Line)
+	})
+
+	// A stopped import is reported in the summary.
+	var parseErr *ingest.ParseError
+	switch {
+	case errors.As(err, &parseErr):
+		reject(parseErr.Line, parseErr.Err.Error())
+		summary.Error = "Import stopped: " + parseErr.Error()
+	case err != nil:
+		summary.Error = "Import stopped: " + err.Error()
+	}
+	log.Printf("Imported %d events for tenant %q (%d stored, %d rejected)", summary.Received, tenant, summary.Stored, summary.Rejected)
+	return summary
+}
+
+// exportFlushEvery is how many rows an export sends between flushes.
+const exportFlushEvery = 1000
+
+// exportedEvent is a row of an export. Its fields are those
+// /admin/import reads, so an export can be imported elsewhere.
+type exportedEvent struct {
+	ID             int64  `json:"id"`
+	EntityType     string `json:"entity_type"`
+	Action         string `json:"action"`
+	EntityId       string `json:"entity_id"`
+	ItemId         string `json:"item_id"`
+	ItemType       string `json:"item_type"`
+	AdditionalInfo string `json:"additional_info"`
+	UserId         int64  `json:"user_id,omitempty"`
+	Time           string `json:"time"`
+}
+
+// exportQuery is what an export selects and how it is written.
+type exportQuery struct {
+	format ingest.Format
+	// query selects the events; its tenant is the caller's.
+	query storage.Query
+}
+
+// parseExport reads an export from the query parameters
+// entity_type, from, to, format and tier, returning a message for the
+// caller when they are invalid.
+func (s *Server) parseExport(q url.Values) (exportQuery, string) {
+	e := exportQuery{format: ingest.Format(q.Get("format")), query: storage.Query{EntityType: q.Get("entity_type")}}
+	switch e.format {
+	case "":
+		e.format = ingest.NDJSON
+	case ingest.NDJSON, ingest.CSV:
+	default:
+		return e, "format must be ndjson or csv"
+	}
+	from, to := q.Get("from"), q.Get("to")
+	if from != "" {
+		t, err := time.Parse(time.DateOnly, from)
+		if err != nil {
+			return e, fmt.Sprintf("Invalid date %q, want YYYY-MM-DD", from)
+		}
+		e.query.From = t
+	}
+	if to != "" {
+		t, err := time.Parse(time.DateOnly, to)
+		if err != nil {
+			return e, fmt.Sprintf("Invalid date %q, want YYYY-MM-DD", to)
+		}
+		e.query.To = t.AddDate(0, 0, 1)
+	}
+	if from != "" && to != "" && from > to {
+		return e, "Invalid date range, from is after to"
+	}
+	switch q.Get("tier") {
+	case "", "hot":
+	case "all":
+		if !s.cold {
+			return e, "Cold tier is not enabled"
+		}
+		e.query.Cold = true
+	default:
+		return e, "tier must be hot or all"
+	}
+	return e, ""
+}
+
+// name is the file name of the export.
+func (e exportQuery) name() string {
+	name := "events"
+	if e.query.EntityType != "" {
+		name += "-" + e.query.EntityType
+	}
+	if e.format == ingest.CSV {
+		return name + ".csv"
+	}
+	return name + ".ndjson"
+}
+
+// contentType is the media type of the export.
+func (e exportQuery) contentType() string {
+	if e.format == ingest.CSV {
+		return "text/csv; charset=utf-8"
+	}
+	return "application/x-ndjson"
+}
+
+// errExportRead is returned by writeExport when the events cannot be read,
+// rather than written.
+var errExportRead = errors.New("reading events")
+
+// writeExport writes the events of tenant e selects to w. flush is called
+// every exportFlushEvery events with the number written.
+func (s *Server) writeExport(ctx context.Context, w io.Writer, tenant string, e exportQuery, flush func(n int) error) (int, error) {
+	var write func(e exportedEvent) error
+	var flushFormat func() error
+	if e.format == ingest.CSV {
+		out := csv.NewWriter(w)
+		out.Write([]string{"id", "entity_type", "action", "entity_id", "item_id", "item_type", "additional_info", "user_id", "time"})
+		write = func(e exportedEvent) error {
+			return out.Write([]string{strconv.FormatInt(e.ID, 10), e.EntityType, e.Action, e.EntityId, e.ItemId,
+				e.ItemType, e.AdditionalInfo, strconv.FormatInt(e.UserId, 10), e.Time})
+		}
+		flushFormat = func() error {
+			out.Flush()
+			return out.Error()
+		}
+	} else {
+		out := json.NewEncoder(w)
+		write = func(e exportedEvent) error { return out.Encode(e) }
+		flushFormat = func() error { return nil }
+	}
+
+	n := 0
+	// writeErr is set when the events cannot be written, rather than read.
+	var writeErr error
+	q := e.query
+	q.Tenant = tenant
+	err := s.store.Query(ctx, q, func(event structs.Event) error {
+		row := exportedEvent{ID: event.ID, EntityType: event.EntityType, Action: event.Action, EntityId: event.EntityId,
+			ItemId: event.ItemId, ItemType: event.ItemType, AdditionalInfo: event.AdditionalInfo, UserId: event.UserId,
+			Time: event.CreatedAt}
+		if t, err := time.Parse(time.DateTime, event.CreatedAt); err == nil {
+			row.Time = t.Format(time.RFC3339)
+		}
+		if writeErr = write(row); writeErr != nil {
+			return writeErr
+		}
+		if n++; n%exportFlushEvery == 0 {
+			if writeErr = flushFormat(); writeErr != nil {
+				return writeErr
+			}
+			if writeErr = flush(n); writeErr != nil {
+				return writeErr
+			}
+		}
+		return nil
+	})
+	if err != nil && writeErr == nil {
+		return n, fmt.Errorf("%w: %v", errExportRead, err)
+	}
+	if err != nil {
+		return n, err
+	}
+	return n, flushFormat()
+}
+
+// ExportHandler handles GET
+// /admin/export?entity_type=&from=&to=&format=ndjson|csv&tier=hot|all,
+// which streams the tenant's events, oldest first, as NDJSON or CSV. from
+// and to are YYYY-MM-DD, both inclusive; every filter is optional. Only
+// hot events are exported unless tier is "all".
+func (s *Server) ExportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apierror.Write(w, "Only GET requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	e, message := s.parseExport(r.URL.Query())
+	if message != "" {
+		apierror.Write(w, message, http.StatusBadRequest)
+		return
+	}
+
+	tenant := r.Header.Get("X-Tenant-ID")
+	w.Header().Set("Content-Type", e.contentType())
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", e.name()))
+	n, err := s.writeExport(r.Context(), w, tenant, e, func(int) error {
+		return http.NewResponseController(w).Flush()
+	})
+	if errors.Is(err, errExportRead) {
+		log.Printf("Error exporting events: %v", err)
+		if n == 0 {
+			// Nothing was sent yet, so the export can still fail plainly.
+			w.Header().Del("Content-Disposition")
+			apierror.Write(w, "Failed to export events", http.StatusInternalServerError)
+			return
+		}
+		// The status is sent, so a failed export aborts the response
+		// rather than end it as if it were complete.
+		panic(http.ErrAbortHandler)
+	}
+	if err != nil {
+		// The client went away.
+		return
+	}
+	log.Printf("Exported %d events for tenant %q", n, tenant)
+}
+
+// startExport starts an export operation, which takes the parameters of
+// /admin/export and outputs the export file.
+func (s *Server) startExport(r *http.Request, op *operations.Op) (operations.Func, error) {
+	e, message := s.parseExport(op.Params)
+	if message != "" {
+		return nil, operations.Invalid(message)
+	}
+	return func(ctx context.Context, op *operations.Op) (any, error) {
+		out, err := op.Output(e.name(), e.contentType())
+		if err != nil {
+			return nil, err
+		}
+		n, err := s.writeExport(ctx, out, op.Tenant, e, func(n int) error {
+			op.Progress(int64(n), 0)
+			return nil
+		})
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		op.Progress(int64(n), int64(n))
+		return map[string]int{"events": n}, err
+	}, nil
+}
+
+// startImport starts an import operation of the uploaded body, which
+// takes the parameters of /admin/import. Its result is the import
+// summary.
+func (s *Server) startImport(r *http.Request, op *operations.Op) (operations.Func, error) {
+	format := importFormat(r)
+	if format == "" {
+		return nil, operations.Invalid("Send text/csv or application/x-ndjson, or set format to csv or ndjson")
+	}
+	if err := op.SaveInput(r.Body); err != nil {
+		return nil, err
+	}
+	file := op.Params.Get("file")
+	return func(ctx context.Context, op *operations.Op) (any, error) {
+		in, err := op.Input()
+		if err != nil {
+			return nil, err
+		}
+		defer in.Close()
+		summary := s.importEvents(format, op.Tenant, file, in, func(summary *importSummary) error {
+			op.Progress(int64(summary.Received+summary.Rejected), 0)
+			return ctx.Err()
+		})
+		done := int64(summary.Received + summary.Rejected)
+		op.Progress(done, done)
+		if summary.Error != "" {
+			return summary, errors.New(summary.Error)
+		}
+		return summary, nil
+	}, nil
+}
+
+// startReindex starts a reindex operation, which rebuilds the full-text
+// index of the tenant's events, of ?entity_type= or all.
+func (s *Server) startReindex(r *http.Request, op *operations.Op) (operations.Func, error) {
+	if !s.inDB {
+		return nil, operations.Invalid("Events of this storage driver are not indexed")
+	}
+	entityType := op.Params.Get("entity_type")
+	return func(ctx context.Context, op *operations.Op) (any, error) {
+		n, err := fulltext.Reindex(ctx, s.db, op.Tenant, entityType, op.Progress)
+		return map[string]int64{"events": n}, err
+	}, nil
+}
+
+// startReplay starts a replay operation, which retries every dead letter
+// of the tenant.
+func (s *Server) startReplay(r *http.Request, op *operations.Op) (operations.Func, error) {
+	return func(ctx context.Context, op *operations.Op) (any, error) {
+		stored, failed, err := s.deadLetters.RetryAll(ctx, op.Tenant, op.Progress)
+		return map[string]int64{"stored": stored, "failed": failed}, err
+	}, nil
+}
+
+// EventByIDHandler handles GET /event/{ID}, which returns a stored event
+// of the tenant; PUT /event/{ID}, which replaces it with the one in the
+// body; and DELETE /event/{ID}, which retracts it. The ID is returned by
+// POST /event. Callers must be signed in, as the tenant header alone
+// proves nothing: they may read and change the events they submitted, and
+// admins any event of the tenant. Events moved to the cold tier cannot be
+// read or changed here, but GET /event/{ID}/lineage still tells admins
+// where they came from.
+func (s *Server) EventByIDHandler(w http.ResponseWriter, r *http.Request) {
+	path, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/event/"), "/")
+	id, err := strconv.ParseInt(path, 10, 64)
+	if err != nil || id <= 0 || (sub != "" && sub != "lineage") {
+		apierror.Write(w, "Use GET, PUT or DELETE /event/{ID}, or GET /event/{ID}/lineage", http.StatusNotFound)
+		return
+	}
+	tenant := r.Header.Get("X-Tenant-ID")
+	claims, ok := accounts.FromContext(r.Context())
+	if !ok {
+		apierror.Write(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+	mayChange := func(userID int64) bool { return userID == claims.Subject || claims.Admin() }
+
+	if sub == "lineage" {
+		if r.Method != http.MethodGet {
+			apierror.Write(w, "Only GET requests allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !s.inDB {
+			apierror.Write(w, "Lineage is only recorded by the SQLite storage driver", http.StatusNotImplemented)
+			return
+		}
+		if !claims.Admin() {
+			if event, err := s.store.Get(id, tenant); err != nil || !mayChange(event.UserId) {
+				apierror.Write(w, "No lineage recorded for event", http.StatusNotFound)
+				return
+			}
+		}
+		record, err := lineage.Load(s.db, id, tenant)
+		if errors.Is(err, lineage.ErrNotFound) {
+			apierror.Write(w, "No lineage recorded for event", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			apierror.Write(w, "Failed to load lineage", http.StatusInternalServerError)
+			log.Printf("Error loading lineage: %v", err)
+			return
+		}
+		response, err := json.Marshal(record)
+		if err != nil {
+			apierror.Write(w, "Error encoding JSON", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(response)
+		return
+	}
+	if r.Method == http.MethodGet {
+		event, err := s.store.Get(id, tenant)
+		if err == nil && !mayChange(event.UserId) {
+			// Others' events are not found rather than forbidden, so ids
+			// cannot be probed.
+			err = storage.ErrNotFound
+		}
+		if errors.Is(err, storage.ErrNotFound) {
+			apierror.Write(w, "Event not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			apierror.Write(w, "Failed to load event", http.StatusInternalServerError)
+			log.Printf("Error loading event: %v", err)
+			return
+		}
+		response, err := json.Marshal(event)
+		if err != nil {
+			apierror.Write(w, "Error encoding JSON", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(response)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		var event structs.Index
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, s.maxBodyBytes)).Decode(&event)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			apierror.Write(w, "Body larger than "+strconv.FormatInt(tooLarge.Limit, 10)+" bytes", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			apierror.WriteCode(w, apierror.CodeInvalidJSON, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		event.Tenant = tenant
+		event.Payer = costs.Payer(r)
+		event.ReceivedAt = time.Now()
+		event.Lineage = structs.Lineage{Connector: "http"}
+		generated := s.assignID(&event)
+		var invalid *ingest.ValidationError
+		if errors.As(s.validator.Check(event), &invalid) {
+			apierror.WriteFields(w, apierror.CodeInvalidEvent, "Invalid event", http.StatusUnprocessableEntity, invalid.Fields)
+			return
+		}
+		if message, status := s.checkAttachments(event); message != "" {
+			apierror.Write(w, message, status)
+			return
+		}
+		event = ingest.Qualify(event)
+		mongoData, err := mongops.FetchDataFromMongoDB(event)
+		if err != nil {
+			log.Printf("Error fetching MongoDB data: %v", err)
+		}
+		err = s.store.Update(id, event, mongoData, mayChange)
+		if !writeEventError(w, err) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if generated != "" {
+			fmt.Fprintf(w, `{"message": "Event updated successfully", "entity_id": %q}`+"\n", generated)
+			return
+		}
+		fmt.Fprintln(w, `{"message": "Event updated successfully"}`)
+	case http.MethodDelete:
+		if writeEventError(w, s.store.Delete(id, tenant, mayChange)) {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		apierror.Write(w, "Only GET, PUT and DELETE requests allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// writeEventError writes the response for an error changing an event and
+// reports whether there was none.
+func writeEventError(w http.ResponseWriter, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, storage.ErrNotFound):
+		apierror.Write(w, "Event not found", http.StatusNotFound)
+	case errors.Is(err, storage.ErrForbidden):
+		apierror.Write(w, "Only the submitter or an admin may change this event", http.StatusForbidden)
+	case errors.Is(err, storage.ErrMoved):
+		apierror.Write(w, "The entity type of an event cannot change to one stored in another database", http.StatusConflict)
+	default:
+		apierror.Write(w, "Failed to change event", http.StatusInternalServerError)
+		log.Printf("Error changing event: %v", err)
+	}
+	return false
+}
+
+// ingest runs an event through validation, sampling, storage quotas,
+// MongoDB enrichment and storage. It returns the id the event was stored
+// under, or 0 for sampled-out events, which are only counted. Invalid events are
+// rejected with an *ingest.ValidationError. Events that cannot be
+// enriched or stored are dead-lettered, and the error returned.
+func (s *Server) ingest(event structs.Index) (int64, error) {
+	return s.ingestWith(event, mongops.FetchDataFromMongoDB)
+}
+
+// ingestWith is ingest with the event enriched by enrich instead, for
+// sources such as change streams whose changes carry their own data.
+func (s *Server) ingestWith(event structs.Index, enrich func(structs.Index) (structs.MongoData, error)) (int64, error) {
+	stored, err := s.process(event, enrich)
+	var failed *stageError
+	if errors.As(err, &failed) {
+		if err := s.deadLetters.Add(event, failed.stage, failed.err); err != nil {
+			log.Printf("Error dead-lettering event: %v", err)
+		}
+	}
+	return stored, err
+}
+
+// process is ingestWith without dead-lettering.
+func (s *Server) process(event structs.Index, enrich func(structs.Index) (structs.MongoData, error)) (int64, error) {
+	event = s.stamp(event)
+	if err := s.validator.Check(event); err != nil {
+		return 0, err
+	}
+	event = ingest.Qualify(event)
+	if !s.sampler.Keep(event) {
+		return 0, nil
+	}
+	if err := s.quotas.Check(event); err != nil {
+		return 0, err
+	}
+
+	// Fetch additional data from MongoDB (dummy implementation).
+	var mongoData structs.MongoData
+	if err := attempt(func() (err error) {
+		mongoData, err = enrich(event)
+		return err
+	}); err != nil {
+		return 0, &stageError{stage: "enrich", err: err}
+	}
+
+	// Store the event and additional MongoDB data in SQLite.
+	var id int64
+	err := attempt(func() (err error) {
+		id, err = s.storeEvent(event, mongoData)
+		return err
+	})
+	if errors.Is(err, storage.ErrDuplicateEvent) || errors.Is(err, storage.ErrDuplicateContent) {
+		return 0, err
+	}
+	if err != nil {
+		return 0, &stageError{stage: "store", err: err}
+	}
+	sla.Observe(sla.Stored, event)
+
+	s.mailer.EntityChanged(event)
+	s.pusher.EntityChanged(event)
+	s.hooks.EntityChanged(event)
+	s.follows.EntityChanged(event)
+	return id, nil
+}
+
+// stamp sets what every ingested event is stored with: when it was
+// received, if the connector left that unset, the Idempotency-Key it is
+// stored once under, and its content hash when deduplication is on.
+// Events at an offset of a stream share their request's key, so each is
+// stored under the key and its offset.
+func (s *Server) stamp(event structs.Index) structs.Index {
+	if event.ReceivedAt.IsZero() {
+		event.ReceivedAt = time.Now()
+	}
+	if event.IdempotencyKey != "" && event.Lineage.Offset > 0 {
+		event.IdempotencyKey += "#" + strconv.FormatInt(event.Lineage.Offset, 10)
+	}
+	if s.dedup.Enabled() && event.ContentHash == "" {
+		event.ContentHash = dedup.Hash(event)
+	}
+	return event
+}
+
+// ingestAttempts is how many times enrichment and storage are tried
+// before an event is dead-lettered.
+const ingestAttempts = 3
+
+// attempt runs fn until it succeeds, fails with a duplicate, which
+// retrying cannot change, or has been tried ingestAttempts times, backing
+// off between tries. It returns the last error.
+func attempt(fn func() error) error {
+	var err error
+	for i := range ingestAttempts {
+		if i > 0 {
+			time.Sleep(time.Duration(i) * 100 * time.Millisecond)
+		}
+		err = fn()
+		if err == nil || errors.Is(err, storage.ErrDuplicateEvent) || errors.Is(err, storage.ErrDuplicateContent) {
+			return err
+		}
+	}
 	return err
 }
+
+// stageError is an ingest stage, "enrich" or "store", failing for good.
+type stageError struct {
+	stage string
+	err   error
+}
+
+func (e *stageError) Error() string { return e.stage + ": " + e.err.Error() }
+func (e *stageError) Unwrap() error { return e.err }
+
+// storeEvent stores the event with the MongoDB data it was enriched with,
+// and counts it against the tenant's quota and costs and in the sampling
+// counters. It returns the id of the event.
+func (s *Server) storeEvent(event structs.Index, mongoData structs.MongoData) (int64, error) {
+	if event.Time.IsZero() {
+		event.Time = s.clock.Now()
+	}
+	stored, err := s.store.Store(event, mongoData)
+	if err != nil {
+		return 0, err
+	}
+	if !stored.Refreshed {
+		s.quotas.Stored(event, mongoData)
+	}
+	s.costs.Wrote(event)
+	s.sampler.Stored(event)
+	ingest.Stored()
+	return stored.ID, nil
+}
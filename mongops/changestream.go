@@ -0,0 +1,114 @@
+package mongops
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"naevis/cdc"
+	"naevis/config"
+	"naevis/structs"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// changeEvent is the subset of a change stream document we materialize.
+type changeEvent struct {
+	OperationType string `bson:"operationType"`
+	DocumentKey   struct {
+		ID any `bson:"_id"`
+	} `bson:"documentKey"`
+	FullDocument bson.M `bson:"fullDocument"`
+}
+
+// ChangeStream is a cdc.Source that materializes the changes of one
+// collection as events. Its checkpoint is the change stream resume token.
+type ChangeStream struct {
+	database   string
+	collection string
+	entityType string
+}
+
+// NewChangeStream creates a source for a configured collection.
+func NewChangeStream(database string, cfg config.MongoWatch) *ChangeStream {
+	entityType := cfg.EntityType
+	if entityType == "" {
+		entityType = cfg.Collection
+	}
+	return &ChangeStream{
+		database:   database,
+		collection: cfg.Collection,
+		entityType: entityType,
+	}
+}
+
+// Name implements cdc.Source.
+func (cs *ChangeStream) Name() string {
+	return "mongo:" + cs.database + "." + cs.collection
+}
+
+// Run implements cdc.Source.
+func (cs *ChangeStream) Run(ctx context.Context, checkpoint []byte, emit cdc.EmitFunc) error {
+	if !Connected() {
+		return fmt.Errorf("MongoDB is not connected")
+	}
+
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	if checkpoint != nil {
+		opts.SetResumeAfter(bson.Raw(checkpoint))
+	}
+
+	coll := mongoClient.Database(cs.database).Collection(cs.collection)
+	stream, err := coll.Watch(ctx, mongo.Pipeline{}, opts)
+	if err != nil {
+		return err
+	}
+	defer stream.Close(context.Background())
+
+	for stream.Next(ctx) {
+		var change changeEvent
+		if err := stream.Decode(&change); err != nil {
+			return err
+		}
+		c, err := cs.materialize(change)
+		if err != nil {
+			return err
+		}
+		c.Checkpoint = []byte(stream.ResumeToken())
+		if err := emit(c); err != nil {
+			return err
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return stream.Err()
+}
+
+// changeEnrichment names how materialize enriches events in their
+// lineage.
+const changeEnrichment = "mongo-change-document/1"
+
+// materialize turns a change into an event. The document itself becomes
+// the additional info, so no separate enrichment lookup is needed.
+func (cs *ChangeStream) materialize(change changeEvent) (cdc.Change, error) {
+	var info string
+	if change.FullDocument != nil {
+		doc, err := json.Marshal(change.FullDocument)
+		if err != nil {
+			return cdc.Change{}, err
+		}
+		info = string(doc)
+	}
+
+	event := structs.Index{
+		EntityType: cs.entityType,
+		Action:     change.OperationType,
+		EntityId:   fmt.Sprint(change.DocumentKey.ID),
+	}
+	if oid, ok := change.DocumentKey.ID.(bson.ObjectID); ok {
+		event.EntityId = oid.Hex()
+	}
+	return cdc.Change{Event: event, Data: structs.MongoData{AdditionalInfo: info, Enrichment: changeEnrichment}}, nil
+}
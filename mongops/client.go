@@ -0,0 +1,46 @@
+package mongops
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// mongoClient is the shared MongoDB connection. It is nil until Connect
+// succeeds, in which case Mongo-backed features stay disabled.
+var mongoClient *mongo.Client
+
+// Connect opens the shared MongoDB connection and verifies it with a ping.
+func Connect(uri string) error {
+	client, err := mongo.Connect(options.Client().ApplyURI(uri))
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx, nil); err != nil {
+		client.Disconnect(context.Background())
+		return err
+	}
+
+	mongoClient = client
+	return nil
+}
+
+// Disconnect closes the shared MongoDB connection, if any.
+func Disconnect() error {
+	if mongoClient == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return mongoClient.Disconnect(ctx)
+}
+
+// Connected reports whether Connect has succeeded.
+func Connected() bool {
+	return mongoClient != nil
+}
@@ -0,0 +1,223 @@
+package mongops
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"naevis/accounts"
+	"naevis/apierror"
+	"naevis/config"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	defaultLimit = 50
+	maxLimit     = 500
+	queryTimeout = 5 * time.Second
+)
+
+// Gateway exposes selected MongoDB collections read-only over HTTP so
+// clients never need direct database access. Only signed-in callers with
+// the collection's role may read it, and only allowlisted fields are
+// returned or may be filtered on.
+type Gateway struct {
+	database    string
+	collections map[string]config.MongoCollection
+}
+
+// fieldTypes convert filter values to the BSON types they are declared
+// as.
+var fieldTypes = map[string]func(string) (any, error){
+	"string": func(s string) (any, error) { return s, nil },
+	"int": func(s string) (any, error) {
+		return strconv.ParseInt(s, 10, 64)
+	},
+	"double": func(s string) (any, error) {
+		return strconv.ParseFloat(s, 64)
+	},
+	"bool": func(s string) (any, error) {
+		return strconv.ParseBool(s)
+	},
+	"objectid": func(s string) (any, error) {
+		return bson.ObjectIDFromHex(s)
+	},
+	"date": func(s string) (any, error) {
+		return time.Parse(time.RFC3339, s)
+	},
+}
+
+// NewGateway creates a Gateway for the collections configured in cfg.
+func NewGateway(cfg config.Mongo) (*Gateway, error) {
+	g := &Gateway{
+		database:    cfg.Database,
+		collections: make(map[string]config.MongoCollection),
+	}
+	for _, c := range cfg.Collections {
+		if c.Role == "" {
+			c.Role = "user"
+		}
+		if !accounts.ValidRole(c.Role) {
+			return nil, fmt.Errorf("mongo collection %s: unknown role %q", c.Name, c.Role)
+		}
+		for field, t := range c.Types {
+			if fieldTypes[t] == nil {
+				return nil, fmt.Errorf("mongo collection %s: field %s has unknown type %q", c.Name, field, t)
+			}
+		}
+		g.collections[c.Name] = c
+	}
+	return g, nil
+}
+
+// value converts a filter value of field to its declared type.
+func value(coll config.MongoCollection, field, s string) (any, error) {
+	t := coll.Types[field]
+	if t == "" {
+		t = "string"
+	}
+	return fieldTypes[t](s)
+}
+
+type page struct {
+	Items   []bson.M `json:"items"`
+	Limit   int64    `json:"limit"`
+	Offset  int64    `json:"offset"`
+	HasMore bool     `json:"has_more"`
+}
+
+// ServeHTTP handles GET /mongo/{COLLECTION}?limit=N&offset=N&{field}=value.
+// Every query parameter other than limit and offset must name an
+// allowlisted field and is matched by equality, with any of its values
+// when repeated.
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apierror.Write(w, "Only GET requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims, ok := accounts.FromContext(r.Context())
+	if !ok {
+		apierror.Write(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+	if !Connected() {
+		apierror.Write(w, "MongoDB is not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/mongo/"), "/")
+	coll, ok := g.collections[name]
+	if !ok {
+		apierror.Write(w, "Unknown collection", http.StatusNotFound)
+		return
+	}
+	if !claims.HasRole(coll.Role) {
+		apierror.Write(w, "Role "+coll.Role+" required", http.StatusForbidden)
+		return
+	}
+
+	allowed := make(map[string]bool, len(coll.Fields))
+	projection := bson.D{}
+	for _, f := range coll.Fields {
+		allowed[f] = true
+		projection = append(projection, bson.E{Key: f, Value: 1})
+	}
+	if !allowed["_id"] {
+		projection = append(projection, bson.E{Key: "_id", Value: 0})
+	}
+
+	q := r.URL.Query()
+	limit, err := intParam(q.Get("limit"), defaultLimit)
+	if err != nil || limit <= 0 {
+		apierror.Write(w, "Invalid limit", http.StatusBadRequest)
+		return
+	}
+	if limit > maxLimit {
+		limit = maxLimit
+	}
+	offset, err := intParam(q.Get("offset"), 0)
+	if err != nil || offset < 0 {
+		apierror.Write(w, "Invalid offset", http.StatusBadRequest)
+		return
+	}
+
+	filter := bson.D{}
+	for field, values := range q {
+		if field == "limit" || field == "offset" {
+			continue
+		}
+		if !allowed[field] {
+			apierror.Write(w, "Filtering on "+field+" is not allowed", http.StatusBadRequest)
+			return
+		}
+		converted := make(bson.A, len(values))
+		for i, v := range values {
+			if converted[i], err = value(coll, field, v); err != nil {
+				apierror.Write(w, "Invalid value for "+field+": "+v, http.StatusBadRequest)
+				return
+			}
+		}
+		if len(converted) == 1 {
+			filter = append(filter, bson.E{Key: field, Value: converted[0]})
+		} else {
+			filter = append(filter, bson.E{Key: field, Value: bson.D{{Key: "$in", Value: converted}}})
+		}
+	}
+	if coll.OwnerField != "" && !claims.Admin() {
+		owner, err := value(coll, coll.OwnerField, strconv.FormatInt(claims.Subject, 10))
+		if err != nil {
+			apierror.Write(w, "Owner field cannot hold user IDs", http.StatusInternalServerError)
+			return
+		}
+		// Combined with $and, so a filter on the owner field cannot widen it.
+		filter = bson.D{{Key: "$and", Value: bson.A{filter, bson.D{{Key: coll.OwnerField, Value: owner}}}}}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	// Fetch one extra document to tell whether another page exists.
+	opts := options.Find().
+		SetProjection(projection).
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetSkip(offset).
+		SetLimit(limit + 1)
+	cursor, err := mongoClient.Database(g.database).Collection(name).Find(ctx, filter, opts)
+	if err != nil {
+		apierror.Write(w, "Failed to query collection", http.StatusBadGateway)
+		return
+	}
+
+	items := []bson.M{}
+	if err := cursor.All(ctx, &items); err != nil {
+		apierror.Write(w, "Failed to read collection", http.StatusBadGateway)
+		return
+	}
+
+	result := page{Items: items, Limit: limit, Offset: offset}
+	if int64(len(items)) > limit {
+		result.Items = items[:limit]
+		result.HasMore = true
+	}
+
+	response, err := json.Marshal(result)
+	if err != nil {
+		apierror.Write(w, "Error encoding JSON", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
+
+func intParam(s string, def int64) (int64, error) {
+	if s == "" {
+		return def, nil
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
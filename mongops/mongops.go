@@ -6,6 +6,10 @@ import (
 	_ "modernc.org/sqlite"
 )
 
+// Enrichment names the lookup of FetchDataFromMongoDB and its version in
+// event lineage. Bump the version when the lookup changes.
+const Enrichment = "mongo-lookup/1"
+
 // fetchDataFromMongoDB is a stub for fetching data from MongoDB.
 // Replace this with your actual MongoDB querying logic.
 func FetchDataFromMongoDB(event structs.Index) (structs.MongoData, error) {
@@ -17,5 +21,5 @@ func FetchDataFromMongoDB(event structs.Index) (structs.MongoData, error) {
 	// return MongoData{AdditionalInfo: data.SomeField}, nil
 
 	// Returning dummy data for now.
-	return structs.MongoData{AdditionalInfo: "dummy info"}, nil
+	return structs.MongoData{AdditionalInfo: "dummy info", Enrichment: Enrichment}, nil
 }
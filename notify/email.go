@@ -0,0 +1,333 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"naevis/apierror"
+	"naevis/config"
+	"naevis/sla"
+	"naevis/structs"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// Kinds of owner notifications. Each has a preference column and a
+// template named after it.
+const (
+	KindUpdate = "update"
+	KindReview = "review"
+	KindFlag   = "flag"
+)
+
+// kindOf maps event actions to notification kinds.
+var kindOf = map[string]string{
+	"update":   KindUpdate,
+	"updated":  KindUpdate,
+	"review":   KindReview,
+	"reviewed": KindReview,
+	"flag":     KindFlag,
+	"flagged":  KindFlag,
+}
+
+// defaultTemplates are used for kinds without a {kind}.tmpl file in the
+// template directory. The first line of a rendered template is the subject.
+var defaultTemplates = map[string]string{
+	KindUpdate: "Your {{.EntityType}} {{.EntityId}} was updated\n\n" +
+		"Your {{.EntityType}} {{.EntityId}} was updated.\n",
+	KindReview: "New review on your {{.EntityType}} {{.EntityId}}\n\n" +
+		"Your {{.EntityType}} {{.EntityId}} received a new review.\n",
+	KindFlag: "Your {{.EntityType}} {{.EntityId}} was flagged\n\n" +
+		"Your {{.EntityType}} {{.EntityId}} was flagged for moderation.\n",
+}
+
+// footer is appended to every message.
+const footer = "\n--\nTo stop these emails, visit {{.UnsubscribeURL}}\n"
+
+// queueSize bounds the number of notifications waiting to be sent.
+const queueSize = 1000
+
+// mailData is passed to the templates.
+type mailData struct {
+	structs.Index
+	Kind           string
+	UnsubscribeURL string
+}
+
+type job struct {
+	event structs.Index
+	kind  string
+}
+
+// Mailer emails entity owners when their entity is updated, reviewed or
+// flagged. Sending happens in the background so ingest never waits on the
+// mail relay. A nil *Mailer is valid and sends nothing.
+type Mailer struct {
+	db        *sql.DB
+	cfg       config.SMTP
+	templates map[string]*template.Template
+	jobs      chan job
+}
+
+// NewMailer creates a Mailer and starts its sender.
+func NewMailer(db *sql.DB, cfg config.SMTP) (*Mailer, error) {
+	m := &Mailer{
+		db:        db,
+		cfg:       cfg,
+		templates: make(map[string]*template.Template),
+		jobs:      make(chan job, queueSize),
+	}
+	for kind, text := range defaultTemplates {
+		if cfg.TemplateDir != "" {
+			if b, err := os.ReadFile(filepath.Join(cfg.TemplateDir, kind+".tmpl")); err == nil {
+				text = string(b)
+			}
+		}
+		t, err := template.New(kind).Parse(text + footer)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s template: %v", kind, err)
+		}
+		m.templates[kind] = t
+	}
+	go m.run()
+	return m, nil
+}
+
+// EntityChanged queues a notification if the event's action is one owners
+// are notified about.
+func (m *Mailer) EntityChanged(event structs.Index) {
+	if m == nil {
+		return
+	}
+	kind, ok := kindOf[strings.ToLower(event.Action)]
+	if !ok {
+		return
+	}
+	select {
+	case m.jobs <- job{event, kind}:
+	default:
+		log.Printf("Notification queue full, dropping %s notification for %s/%s", kind, event.EntityType, event.EntityId)
+	}
+}
+
+func (m *Mailer) run() {
+	for j := range m.jobs {
+		if err := m.send(j); err != nil {
+			log.Printf("Error sending %s notification for %s/%s: %v", j.kind, j.event.EntityType, j.event.EntityId, err)
+		}
+	}
+}
+
+// send emails the owner of the event's entity, honoring preferences.
+func (m *Mailer) send(j job) error {
+	var email string
+	err := m.db.QueryRow(`SELECT email FROM entity_owners WHERE entity_type = ? AND entity_id = ?;`,
+		j.event.EntityType, j.event.EntityId).Scan(&email)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	p, err := m.preferences(email)
+	if err != nil {
+		return err
+	}
+	if !p.wants(j.kind) {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	data := mailData{
+		Index:          j.event,
+		Kind:           j.kind,
+		UnsubscribeURL: strings.TrimRight(m.cfg.BaseURL, "/") + "/notifications/unsubscribe?token=" + url.QueryEscape(p.Token),
+	}
+	if err := m.templates[j.kind].Execute(&buf, data); err != nil {
+		return err
+	}
+	subject, body, _ := strings.Cut(buf.String(), "\n")
+
+	msg := "From: " + m.cfg.From + "\r\n" +
+		"To: " + email + "\r\n" +
+		"Subject: " + strings.TrimSpace(subject) + "\r\n" +
+		"List-Unsubscribe: <" + data.UnsubscribeURL + ">\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n" +
+		strings.ReplaceAll(strings.TrimLeft(body, "\n"), "\n", "\r\n")
+
+	var auth smtp.Auth
+	if m.cfg.Username != "" {
+		host, _, _ := net.SplitHostPort(m.cfg.Addr)
+		auth = smtp.PlainAuth("", m.cfg.Username, m.cfg.Password, host)
+	}
+	if err := smtp.SendMail(m.cfg.Addr, auth, m.cfg.From, []string{email}, []byte(msg)); err != nil {
+		return err
+	}
+	sla.Observe(sla.Delivered, j.event)
+	return nil
+}
+
+// Preferences are an owner's notification settings.
+type Preferences struct {
+	Email        string `json:"email"`
+	Updates      bool   `json:"updates"`
+	Reviews      bool   `json:"reviews"`
+	Flags        bool   `json:"flags"`
+	Unsubscribed bool   `json:"unsubscribed"`
+	Token        string `json:"-"`
+}
+
+func (p Preferences) wants(kind string) bool {
+	if p.Unsubscribed {
+		return false
+	}
+	switch kind {
+	case KindUpdate:
+		return p.Updates
+	case KindReview:
+		return p.Reviews
+	case KindFlag:
+		return p.Flags
+	}
+	return false
+}
+
+// preferences loads the preferences of email, creating the default
+// (everything enabled) with a fresh unsubscribe token if none exist.
+func (m *Mailer) preferences(email string) (Preferences, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return Preferences{}, err
+	}
+	if _, err := m.db.Exec(`
+	INSERT INTO notification_prefs (email, token) VALUES (?, ?)
+	ON CONFLICT(email) DO NOTHING;`, email, hex.EncodeToString(token)); err != nil {
+		return Preferences{}, err
+	}
+
+	var p Preferences
+	err := m.db.QueryRow(`
+	SELECT email, updates, reviews, flags, unsubscribed, token
+	FROM notification_prefs WHERE email = ?;`, email).
+		Scan(&p.Email, &p.Updates, &p.Reviews, &p.Flags, &p.Unsubscribed, &p.Token)
+	return p, err
+}
+
+// OwnerHandler handles POST /notifications/owners, recording the contact
+// email of an entity's owner.
+func (m *Mailer) OwnerHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		apierror.Write(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var owner struct {
+		EntityType string `json:"entity_type"`
+		EntityId   string `json:"entity_id"`
+		Email      string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&owner); err != nil {
+		apierror.WriteCode(w, apierror.CodeInvalidJSON, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if owner.EntityType == "" || owner.EntityId == "" || !strings.Contains(owner.Email, "@") {
+		apierror.Write(w, "entity_type, entity_id and a valid email are required", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := m.db.Exec(`
+	INSERT INTO entity_owners (entity_type, entity_id, email) VALUES (?, ?, ?)
+	ON CONFLICT(entity_type, entity_id) DO UPDATE SET email = excluded.email;`,
+		owner.EntityType, owner.EntityId, owner.Email); err != nil {
+		apierror.Write(w, "Failed to store owner", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PreferencesHandler handles GET and PUT /notifications/preferences?token=
+// using the unsubscribe token from a notification as the credential.
+func (m *Mailer) PreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var p Preferences
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			apierror.WriteCode(w, apierror.CodeInvalidJSON, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		res, err := m.db.Exec(`
+		UPDATE notification_prefs SET updates = ?, reviews = ?, flags = ?, unsubscribed = ?
+		WHERE token = ?;`, p.Updates, p.Reviews, p.Flags, p.Unsubscribed, token)
+		if err != nil {
+			apierror.Write(w, "Failed to update preferences", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			apierror.Write(w, "Unknown token", http.StatusNotFound)
+			return
+		}
+	default:
+		apierror.Write(w, "Only GET and PUT requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var p Preferences
+	err := m.db.QueryRow(`
+	SELECT email, updates, reviews, flags, unsubscribed FROM notification_prefs WHERE token = ?;`, token).
+		Scan(&p.Email, &p.Updates, &p.Reviews, &p.Flags, &p.Unsubscribed)
+	if err == sql.ErrNoRows {
+		apierror.Write(w, "Unknown token", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		apierror.Write(w, "Failed to load preferences", http.StatusInternalServerError)
+		return
+	}
+
+	response, err := json.Marshal(p)
+	if err != nil {
+		apierror.Write(w, "Error encoding JSON", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
+
+// UnsubscribeHandler handles GET /notifications/unsubscribe?token= links
+// from notification emails.
+func (m *Mailer) UnsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		apierror.Write(w, "Only GET and POST requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	res, err := m.db.Exec(`UPDATE notification_prefs SET unsubscribed = 1 WHERE token = ?;`,
+		r.URL.Query().Get("token"))
+	if err != nil {
+		apierror.Write(w, "Failed to unsubscribe", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		apierror.Write(w, "Unknown token", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "You have been unsubscribed from QUICkie notifications.")
+}
@@ -0,0 +1,531 @@
+package notify
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"naevis/apierror"
+	"naevis/config"
+	"naevis/sla"
+	"naevis/structs"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Platforms a device token can belong to.
+const (
+	PlatformFCM  = "fcm"
+	PlatformAPNs = "apns"
+)
+
+// errUnregistered is returned by a sender when the device token is no
+// longer valid; the device is then removed.
+var errUnregistered = errors.New("device token is no longer registered")
+
+// pushMessage is the platform-neutral content of a push.
+type pushMessage struct {
+	Title string
+	Body  string
+	Data  map[string]string
+}
+
+type sender interface {
+	send(token string, msg pushMessage) error
+}
+
+// Pusher sends FCM and APNs pushes to devices subscribed to an entity when
+// it changes, and records every delivery attempt. A nil *Pusher is valid
+// and sends nothing.
+type Pusher struct {
+	db      *sql.DB
+	senders map[string]sender
+	jobs    chan job
+}
+
+// NewPusher creates a Pusher for the platforms configured in cfg and
+// starts its sender.
+func NewPusher(db *sql.DB, cfg config.Push) (*Pusher, error) {
+	p := &Pusher{
+		db:      db,
+		senders: make(map[string]sender),
+		jobs:    make(chan job, queueSize),
+	}
+	if cfg.FCM.CredentialsFile != "" {
+		s, err := newFCMSender(cfg.FCM)
+		if err != nil {
+			return nil, fmt.Errorf("invalid FCM configuration: %v", err)
+		}
+		p.senders[PlatformFCM] = s
+	}
+	if cfg.APNs.KeyFile != "" {
+		s, err := newAPNsSender(cfg.APNs)
+		if err != nil {
+			return nil, fmt.Errorf("invalid APNs configuration: %v", err)
+		}
+		p.senders[PlatformAPNs] = s
+	}
+	go p.run()
+	return p, nil
+}
+
+// EntityChanged queues pushes for devices subscribed to the event's entity.
+func (p *Pusher) EntityChanged(event structs.Index) {
+	if p == nil {
+		return
+	}
+	kind, ok := kindOf[strings.ToLower(event.Action)]
+	if !ok {
+		return
+	}
+	select {
+	case p.jobs <- job{event, kind}:
+	default:
+		log.Printf("Push queue full, dropping %s push for %s/%s", kind, event.EntityType, event.EntityId)
+	}
+}
+
+func (p *Pusher) run() {
+	for j := range p.jobs {
+		if err := p.deliver(j); err != nil {
+			log.Printf("Error sending %s pushes for %s/%s: %v", j.kind, j.event.EntityType, j.event.EntityId, err)
+		}
+	}
+}
+
+// deliver pushes to every device subscribed to the job's entity.
+func (p *Pusher) deliver(j job) error {
+	rows, err := p.db.Query(`
+	SELECT token, platform FROM push_devices WHERE entity_type = ? AND entity_id = ?;`,
+		j.event.EntityType, j.event.EntityId)
+	if err != nil {
+		return err
+	}
+	type target struct{ token, platform string }
+	var devices []target
+	for rows.Next() {
+		var d target
+		if err := rows.Scan(&d.token, &d.platform); err != nil {
+			rows.Close()
+			return err
+		}
+		devices = append(devices, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	msg := pushMessage{
+		Title: fmt.Sprintf("%s %s", j.event.EntityType, j.event.EntityId),
+		Body:  fmt.Sprintf("%s %s: %s", j.event.EntityType, j.event.EntityId, j.event.Action),
+		Data: map[string]string{
+			"entity_type": j.event.EntityType,
+			"entity_id":   j.event.EntityId,
+			"action":      j.event.Action,
+		},
+	}
+
+	delivered := false
+	for _, d := range devices {
+		s, ok := p.senders[d.platform]
+		if !ok {
+			continue
+		}
+		status, errText := "sent", ""
+		err := s.send(d.token, msg)
+		switch {
+		case errors.Is(err, errUnregistered):
+			status, errText = "unregistered", err.Error()
+			p.db.Exec(`DELETE FROM push_devices WHERE token = ?;`, d.token)
+		case err != nil:
+			status, errText = "failed", err.Error()
+		case !delivered:
+			delivered = true
+			sla.Observe(sla.Delivered, j.event)
+		}
+		if _, err := p.db.Exec(`
+		INSERT INTO push_deliveries (token, platform, entity_type, entity_id, action, status, error, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP);`,
+			d.token, d.platform, j.event.EntityType, j.event.EntityId, j.event.Action, status, errText); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// device is a registration request.
+type device struct {
+	Token      string `json:"token"`
+	Platform   string `json:"platform"`
+	EntityType string `json:"entity_type"`
+	EntityId   string `json:"entity_id"`
+}
+
+// DevicesHandler handles POST /notifications/devices to subscribe a
+// device token to an entity, and DELETE /notifications/devices?token= to
+// remove every subscription of a token.
+func (p *Pusher) DevicesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		var d device
+		if err := json.NewDecoder(r.Body).Decode(&d); err != nil {
+			apierror.WriteCode(w, apierror.CodeInvalidJSON, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if d.Token == "" || d.EntityType == "" || d.EntityId == "" {
+			apierror.Write(w, "token, entity_type and entity_id are required", http.StatusBadRequest)
+			return
+		}
+		if _, ok := p.senders[d.Platform]; !ok {
+			apierror.Write(w, "Unsupported or unconfigured platform", http.StatusBadRequest)
+			return
+		}
+		if _, err := p.db.Exec(`
+		INSERT INTO push_devices (token, platform, entity_type, entity_id, created_at)
+		VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(token, entity_type, entity_id) DO UPDATE SET platform = excluded.platform;`,
+			d.Token, d.Platform, d.EntityType, d.EntityId); err != nil {
+			apierror.Write(w, "Failed to register device", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if _, err := p.db.Exec(`DELETE FROM push_devices WHERE token = ?;`, r.URL.Query().Get("token")); err != nil {
+			apierror.Write(w, "Failed to remove device", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		apierror.Write(w, "Only POST and DELETE requests allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// DeliveriesHandler handles GET /notifications/deliveries?token= and lists
+// the most recent delivery attempts for a device token.
+func (p *Pusher) DeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apierror.Write(w, "Only GET requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rows, err := p.db.Query(`
+	SELECT entity_type, entity_id, action, status, error, created_at
+	FROM push_deliveries WHERE token = ? ORDER BY id DESC LIMIT 100;`, r.URL.Query().Get("token"))
+	if err != nil {
+		apierror.Write(w, "Failed to list deliveries", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	type delivery struct {
+		EntityType string `json:"entity_type"`
+		EntityId   string `json:"entity_id"`
+		Action     string `json:"action"`
+		Status     string `json:"status"`
+		Error      string `json:"error,omitempty"`
+		CreatedAt  string `json:"created_at"`
+	}
+	deliveries := []delivery{}
+	for rows.Next() {
+		var d delivery
+		if err := rows.Scan(&d.EntityType, &d.EntityId, &d.Action, &d.Status, &d.Error, &d.CreatedAt); err != nil {
+			apierror.Write(w, "Failed to list deliveries", http.StatusInternalServerError)
+			return
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	response, err := json.Marshal(deliveries)
+	if err != nil {
+		apierror.Write(w, "Error encoding JSON", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
+
+// signJWT returns a compact JWS over the given header and claims.
+func signJWT(header, claims map[string]any, sign func(digest []byte) ([]byte, error)) (string, error) {
+	h, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	input := enc.EncodeToString(h) + "." + enc.EncodeToString(c)
+	digest := sha256.Sum256([]byte(input))
+	sig, err := sign(digest[:])
+	if err != nil {
+		return "", err
+	}
+	return input + "." + enc.EncodeToString(sig), nil
+}
+
+// fcmSender sends through the FCM HTTP v1 API using a service account.
+type fcmSender struct {
+	projectID   string
+	clientEmail string
+	tokenURI    string
+	key         *rsa.PrivateKey
+	client      *http.Client
+
+	mu      sync.Mutex
+	access  string
+	expires time.Time
+}
+
+func newFCMSender(cfg config.FCM) (*fcmSender, error) {
+	b, err := os.ReadFile(cfg.CredentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	var creds struct {
+		ProjectID   string `json:"project_id"`
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(b, &creds); err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode([]byte(creds.PrivateKey))
+	if block == nil {
+		return nil, errors.New("service account has no PEM private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("service account key is not RSA")
+	}
+	return &fcmSender{
+		projectID:   creds.ProjectID,
+		clientEmail: creds.ClientEmail,
+		tokenURI:    creds.TokenURI,
+		key:         key,
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// accessToken exchanges a signed service account assertion for an OAuth
+// access token, cached until shortly before it expires.
+func (s *fcmSender) accessToken() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.access != "" && time.Now().Before(s.expires) {
+		return s.access, nil
+	}
+
+	now := time.Now()
+	assertion, err := signJWT(
+		map[string]any{"alg": "RS256", "typ": "JWT"},
+		map[string]any{
+			"iss":   s.clientEmail,
+			"scope": "https://www.googleapis.com/auth/firebase.messaging",
+			"aud":   s.tokenURI,
+			"iat":   now.Unix(),
+			"exp":   now.Add(time.Hour).Unix(),
+		},
+		func(digest []byte) ([]byte, error) {
+			return rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest)
+		})
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := s.client.PostForm(s.tokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("token exchange failed: %s: %s", resp.Status, b)
+	}
+
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", err
+	}
+	s.access = tok.AccessToken
+	s.expires = now.Add(time.Duration(tok.ExpiresIn)*time.Second - time.Minute)
+	return s.access, nil
+}
+
+func (s *fcmSender) send(token string, msg pushMessage) error {
+	access, err := s.accessToken()
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(map[string]any{
+		"message": map[string]any{
+			"token":        token,
+			"notification": map[string]string{"title": msg.Title, "body": msg.Body},
+			"data":         msg.Data,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost,
+		"https://fcm.googleapis.com/v1/projects/"+s.projectID+"/messages:send", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+access)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return errUnregistered
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("FCM returned %s: %s", resp.Status, b)
+}
+
+// apnsSender sends through the APNs provider API with token-based auth.
+type apnsSender struct {
+	cfg    config.APNs
+	key    *ecdsa.PrivateKey
+	host   string
+	client *http.Client
+
+	mu     sync.Mutex
+	jwt    string
+	issued time.Time
+}
+
+func newAPNsSender(cfg config.APNs) (*apnsSender, error) {
+	b, err := os.ReadFile(cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("APNs key file is not PEM")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("APNs key is not ECDSA")
+	}
+
+	host := "https://api.push.apple.com"
+	if cfg.Sandbox {
+		host = "https://api.sandbox.push.apple.com"
+	}
+	return &apnsSender{cfg: cfg, key: key, host: host, client: &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+// token returns the provider JWT. Apple rejects tokens older than an hour
+// and throttles refreshing more than every 20 minutes.
+func (s *apnsSender) token() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.jwt != "" && time.Since(s.issued) < 40*time.Minute {
+		return s.jwt, nil
+	}
+
+	now := time.Now()
+	jwt, err := signJWT(
+		map[string]any{"alg": "ES256", "kid": s.cfg.KeyID},
+		map[string]any{"iss": s.cfg.TeamID, "iat": now.Unix()},
+		func(digest []byte) ([]byte, error) {
+			r, ss, err := ecdsa.Sign(rand.Reader, s.key, digest)
+			if err != nil {
+				return nil, err
+			}
+			// JWS wants the fixed-size r||s form, not ASN.1.
+			sig := make([]byte, 64)
+			r.FillBytes(sig[:32])
+			ss.FillBytes(sig[32:])
+			return sig, nil
+		})
+	if err != nil {
+		return "", err
+	}
+	s.jwt, s.issued = jwt, now
+	return jwt, nil
+}
+
+func (s *apnsSender) send(token string, msg pushMessage) error {
+	jwt, err := s.token()
+	if err != nil {
+		return err
+	}
+
+	payload := map[string]any{
+		"aps": map[string]any{"alert": map[string]string{"title": msg.Title, "body": msg.Body}},
+	}
+	for k, v := range msg.Data {
+		payload[k] = v
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.host+"/3/device/"+token, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "bearer "+jwt)
+	req.Header.Set("apns-topic", s.cfg.Topic)
+	req.Header.Set("apns-push-type", "alert")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusGone:
+		return errUnregistered
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("APNs returned %s: %s", resp.Status, b)
+}
@@ -0,0 +1,560 @@
+// Package operations runs long tasks such as exports, imports, reindexes
+// and replays in the background. Creating one returns its ID at once;
+// its progress is polled, it can be cancelled, and its result stays
+// available for a retention window after it ends.
+package operations
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"naevis/apierror"
+	"naevis/config"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Operation states.
+const (
+	Running   = "running"
+	Succeeded = "succeeded"
+	Failed    = "failed"
+	Cancelled = "cancelled"
+)
+
+// maxList bounds the operations listed.
+const maxList = 100
+
+// metrics counts operations by final state, published under "operations"
+// in expvar.
+var metrics = expvar.NewMap("operations")
+
+const (
+	insertSQL = `
+	INSERT INTO operations (id, kind, tenant, state, created_at) VALUES (?, ?, ?, 'running', ?);`
+	finishSQL = `
+	UPDATE operations SET state = ?, done = ?, total = ?, result = ?, error = ?, file = ?, content_type = ?,
+		finished_at = ?, expires_at = ?
+	WHERE id = ?;`
+	selectSQL = `
+	SELECT id, kind, state, done, total, result, error, file, content_type, created_at, finished_at, expires_at
+	FROM operations WHERE id = ? AND tenant = ?;`
+	listSQL = `
+	SELECT id, kind, state, done, total, result, error, file, content_type, created_at, finished_at, expires_at
+	FROM operations WHERE tenant = ? ORDER BY created_at DESC, id LIMIT ?;`
+	deleteSQL = `
+	DELETE FROM operations WHERE id = ?;`
+	expiredSQL = `
+	SELECT id FROM operations WHERE expires_at < ?;`
+	// interruptedSQL fails the operations a previous process was running
+	// when it stopped.
+	interruptedSQL = `
+	UPDATE operations SET state = 'failed', error = 'interrupted by a restart', finished_at = ?1, expires_at = ?2
+	WHERE state = 'running';`
+)
+
+// Operation is the state of an operation. Done and Total count the items
+// processed and to process, Total being zero when unknown. Result is the
+// summary of a finished operation; ResultURL, when set, downloads its
+// output.
+type Operation struct {
+	ID         string          `json:"id"`
+	Kind       string          `json:"kind"`
+	State      string          `json:"state"`
+	Done       int64           `json:"done"`
+	Total      int64           `json:"total,omitempty"`
+	Result     json.RawMessage `json:"result,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	ResultURL  string          `json:"result_url,omitempty"`
+	CreatedAt  string          `json:"created_at"`
+	FinishedAt string          `json:"finished_at,omitempty"`
+	ExpiresAt  string          `json:"expires_at,omitempty"`
+
+	file, contentType string
+}
+
+// Func does the work of an operation until ctx is cancelled, and returns
+// a summary of it, which is kept as the operation's result even when it
+// fails.
+type Func func(ctx context.Context, op *Op) (any, error)
+
+// Start validates a request creating an operation of one kind and returns
+// the Func doing the work. It reads what the work needs from the request,
+// which is gone once the Func runs. An error made with Invalid rejects
+// the request with 400.
+type Start func(r *http.Request, op *Op) (Func, error)
+
+// invalidError rejects the creation of an operation.
+type invalidError string
+
+func (e invalidError) Error() string {
+	return string(e)
+}
+
+// Invalid returns an error rejecting the creation of an operation with
+// message.
+func Invalid(message string) error {
+	return invalidError(message)
+}
+
+// Op is an operation being started or run.
+type Op struct {
+	ID     string
+	Tenant string
+	// Params are the query parameters of the request that created it.
+	Params url.Values
+
+	m           *Manager
+	hasInput    bool
+	file        string
+	contentType string
+
+	cancel context.CancelFunc
+
+	mu          sync.Mutex
+	done, total int64
+}
+
+// SaveInput stores body for the operation to read with Input. Start calls
+// it for operations working on an upload.
+func (op *Op) SaveInput(body io.Reader) error {
+	f, err := os.Create(op.m.path(op.ID, "input"))
+	if err != nil {
+		return err
+	}
+	op.hasInput = true
+	if _, err := io.Copy(f, body); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Input opens the body stored with SaveInput.
+func (op *Op) Input() (io.ReadCloser, error) {
+	return os.Open(op.m.path(op.ID, "input"))
+}
+
+// Output creates the file of the operation's output, downloaded from
+// /operations/{ID}/result as name with contentType. The output of an
+// operation that does not succeed is removed.
+func (op *Op) Output(name, contentType string) (io.WriteCloser, error) {
+	f, err := os.Create(op.m.path(op.ID, "result"))
+	if err != nil {
+		return nil, err
+	}
+	op.file, op.contentType = name, contentType
+	return f, nil
+}
+
+// Progress records that done of total items are processed; total is zero
+// when unknown. It is cheap to call for every item: progress is kept in
+// memory until the operation ends, as a write could wait on the
+// operation's own reads.
+func (op *Op) Progress(done, total int64) {
+	op.mu.Lock()
+	op.done, op.total = done, total
+	op.mu.Unlock()
+}
+
+// progress returns the items processed and to process.
+func (op *Op) progress() (int64, int64) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	return op.done, op.total
+}
+
+// Manager runs operations and serves them. It implements http.Handler.
+type Manager struct {
+	db        *sql.DB
+	dir       string
+	retention time.Duration
+	kinds     map[string]Start
+
+	mu      sync.Mutex
+	running map[string]*Op
+	// wg counts the operations that have not finished.
+	wg sync.WaitGroup
+}
+
+// New creates a Manager keeping outputs in cfg.Dir. Operations a previous
+// process left running are failed, as their work stopped with it.
+func New(db *sql.DB, cfg config.Operations) (*Manager, error) {
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	if _, err := db.Exec(interruptedSQL, now.Format(time.DateTime), now.Add(cfg.Retention.Duration).Format(time.DateTime)); err != nil {
+		return nil, err
+	}
+	return &Manager{
+		db:        db,
+		dir:       cfg.Dir,
+		retention: cfg.Retention.Duration,
+		kinds:     make(map[string]Start),
+		running:   make(map[string]*Op),
+	}, nil
+}
+
+// Register makes operations of kind available, started by start.
+func (m *Manager) Register(kind string, start Start) {
+	m.kinds[kind] = start
+}
+
+// path is the file of the operation id holding what, its input or result.
+func (m *Manager) path(id, what string) string {
+	return filepath.Join(m.dir, id+"."+what)
+}
+
+// Run removes expired operations and their outputs every interval until
+// ctx is cancelled.
+func (m *Manager) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := m.prune(); err != nil {
+			log.Printf("Error removing expired operations: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *Manager) prune() error {
+	rows, err := m.db.Query(expiredSQL, time.Now().UTC().Format(time.DateTime))
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := m.remove(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove deletes the operation id and its files.
+func (m *Manager) remove(id string) error {
+	os.Remove(m.path(id, "input"))
+	os.Remove(m.path(id, "result"))
+	_, err := m.db.Exec(deleteSQL, id)
+	return err
+}
+
+// start creates an operation of kind for r and runs it in the background.
+func (m *Manager) start(r *http.Request, kind string) (*Operation, error) {
+	begin, ok := m.kinds[kind]
+	if !ok {
+		names := make([]string, 0, len(m.kinds))
+		for name := range m.kinds {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, Invalid(fmt.Sprintf("Unknown kind %q; use one of %s", kind, strings.Join(names, ", ")))
+	}
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	op := &Op{ID: id, Tenant: r.Header.Get("X-Tenant-ID"), Params: r.URL.Query(), m: m}
+	run, err := begin(r, op)
+	if err != nil {
+		os.Remove(m.path(id, "input"))
+		return nil, err
+	}
+	now := time.Now().UTC()
+	if _, err := m.db.Exec(insertSQL, id, kind, op.Tenant, now.Format(time.DateTime)); err != nil {
+		os.Remove(m.path(id, "input"))
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	op.cancel = cancel
+	m.mu.Lock()
+	m.running[id] = op
+	m.mu.Unlock()
+	m.wg.Add(1)
+	go m.execute(ctx, op, run)
+	return &Operation{ID: id, Kind: kind, State: Running, CreatedAt: now.Format(time.RFC3339)}, nil
+}
+
+// execute runs op and records how it ended.
+func (m *Manager) execute(ctx context.Context, op *Op, run Func) {
+	defer m.wg.Done()
+	summary, err := run(ctx, op)
+
+	cancelled := ctx.Err() != nil
+	op.cancel()
+
+	state, message := Succeeded, ""
+	switch {
+	case err != nil && cancelled:
+		state = Cancelled
+	case err != nil:
+		state, message = Failed, err.Error()
+		log.Printf("Operation %s failed: %v", op.ID, err)
+	}
+	if op.hasInput {
+		os.Remove(m.path(op.ID, "input"))
+	}
+	if state != Succeeded && op.file != "" {
+		os.Remove(m.path(op.ID, "result"))
+		op.file, op.contentType = "", ""
+	}
+	var result []byte
+	if summary != nil {
+		if result, err = json.Marshal(summary); err != nil {
+			log.Printf("Error encoding the result of operation %s: %v", op.ID, err)
+		}
+	}
+
+	done, total := op.progress()
+	now := time.Now().UTC()
+	if _, err := m.db.Exec(finishSQL, state, done, total, nullable(string(result)), nullable(message),
+		nullable(op.file), nullable(op.contentType),
+		now.Format(time.DateTime), now.Add(m.retention).Format(time.DateTime), op.ID); err != nil {
+		log.Printf("Error recording the end of operation %s: %v", op.ID, err)
+	}
+	// The operation is reported from the database from now on.
+	m.mu.Lock()
+	delete(m.running, op.ID)
+	m.mu.Unlock()
+	metrics.Add(state, 1)
+}
+
+// Close cancels the running operations and waits until they have been
+// recorded as cancelled.
+func (m *Manager) Close() {
+	m.mu.Lock()
+	for _, op := range m.running {
+		op.cancel()
+	}
+	m.mu.Unlock()
+	m.wg.Wait()
+}
+
+// cancel stops the running operation id, reporting false when it is not
+// running.
+func (m *Manager) cancel(id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	op, ok := m.running[id]
+	if ok {
+		op.cancel()
+	}
+	return ok
+}
+
+// withProgress fills in the progress of ops still running.
+func (m *Manager) withProgress(ops []Operation) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range ops {
+		if op, ok := m.running[ops[i].ID]; ok {
+			ops[i].Done, ops[i].Total = op.progress()
+		}
+	}
+}
+
+// get returns the operation id of tenant, or nil when there is none.
+func (m *Manager) get(id, tenant string) (*Operation, error) {
+	rows, err := m.db.Query(selectSQL, id, tenant)
+	if err != nil {
+		return nil, err
+	}
+	ops, err := scan(rows)
+	if err != nil || len(ops) == 0 {
+		return nil, err
+	}
+	m.withProgress(ops)
+	return &ops[0], nil
+}
+
+// scan reads and closes rows of operations.
+func scan(rows *sql.Rows) ([]Operation, error) {
+	defer rows.Close()
+	ops := []Operation{}
+	for rows.Next() {
+		var o Operation
+		var result, message, file, contentType, finishedAt, expiresAt sql.NullString
+		if err := rows.Scan(&o.ID, &o.Kind, &o.State, &o.Done, &o.Total, &result, &message, &file, &contentType,
+			&o.CreatedAt, &finishedAt, &expiresAt); err != nil {
+			return nil, err
+		}
+		if result.Valid {
+			o.Result = json.RawMessage(result.String)
+		}
+		o.Error, o.file, o.contentType = message.String, file.String, contentType.String
+		o.FinishedAt, o.ExpiresAt = finishedAt.String, expiresAt.String
+		if o.file != "" {
+			o.ResultURL = "/operations/" + o.ID + "/result"
+		}
+		ops = append(ops, o)
+	}
+	return ops, rows.Err()
+}
+
+// ServeHTTP handles the operations of the tenant in X-Tenant-ID:
+//
+//	POST   /operations?kind=KIND&...    start one; the other parameters and the body depend on the kind
+//	GET    /operations                  list the latest
+//	GET    /operations/{ID}             report its state and progress
+//	GET    /operations/{ID}/result      download its output
+//	DELETE /operations/{ID}             cancel it, or remove it once it ended
+func (m *Manager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/operations"), "/")
+	id, action, _ := strings.Cut(rest, "/")
+	tenant := r.Header.Get("X-Tenant-ID")
+
+	if rest == "" {
+		switch r.Method {
+		case http.MethodPost:
+			op, err := m.start(r, r.URL.Query().Get("kind"))
+			var invalid invalidError
+			switch {
+			case errors.As(err, &invalid):
+				apierror.Write(w, invalid.Error(), http.StatusBadRequest)
+			case err != nil:
+				apierror.Write(w, "Failed to start operation", http.StatusInternalServerError)
+				log.Printf("Error starting operation: %v", err)
+			default:
+				w.Header().Set("Location", "/operations/"+op.ID)
+				writeJSON(w, http.StatusAccepted, op)
+			}
+		case http.MethodGet:
+			rows, err := m.db.Query(listSQL, tenant, maxList)
+			var ops []Operation
+			if err == nil {
+				ops, err = scan(rows)
+			}
+			m.withProgress(ops)
+			if err != nil {
+				apierror.Write(w, "Failed to list operations", http.StatusInternalServerError)
+				log.Printf("Error listing operations: %v", err)
+				return
+			}
+			writeJSON(w, http.StatusOK, ops)
+		default:
+			apierror.Write(w, "Only GET and POST requests allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	op, err := m.get(id, tenant)
+	if err != nil {
+		apierror.Write(w, "Failed to load operation", http.StatusInternalServerError)
+		log.Printf("Error loading operation: %v", err)
+		return
+	}
+	if op == nil {
+		apierror.Write(w, "Operation not found", http.StatusNotFound)
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && action == "":
+		writeJSON(w, http.StatusOK, op)
+	case r.Method == http.MethodGet && action == "result":
+		m.serveResult(w, r, op)
+	case r.Method == http.MethodDelete && action == "":
+		if op.State == Running {
+			if !m.cancel(op.ID) {
+				// It ended in the meantime.
+				apierror.Write(w, "Operation already ended; delete it again to remove it", http.StatusConflict)
+				return
+			}
+			writeJSON(w, http.StatusAccepted, map[string]string{"message": "Operation cancelling"})
+			return
+		}
+		if err := m.remove(op.ID); err != nil {
+			apierror.Write(w, "Failed to remove operation", http.StatusInternalServerError)
+			log.Printf("Error removing operation: %v", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		apierror.Write(w, "Use GET /operations/{ID}, GET /operations/{ID}/result or DELETE /operations/{ID}", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveResult sends the output of op.
+func (m *Manager) serveResult(w http.ResponseWriter, r *http.Request, op *Operation) {
+	if op.file == "" {
+		if op.State == Running {
+			apierror.Write(w, "Operation still running", http.StatusConflict)
+		} else {
+			apierror.Write(w, "Operation has no output", http.StatusNotFound)
+		}
+		return
+	}
+	f, err := os.Open(m.path(op.ID, "result"))
+	if err != nil {
+		apierror.Write(w, "Operation output not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		apierror.Write(w, "Failed to read operation output", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", op.contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", op.file))
+	http.ServeContent(w, r, op.file, info.ModTime(), f)
+}
+
+// newID returns a random operation ID.
+func newID() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// nullable stores an empty string as NULL.
+func nullable(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	response, err := json.Marshal(v)
+	if err != nil {
+		apierror.Write(w, "Error encoding JSON", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(response)
+}
@@ -0,0 +1,240 @@
+package planwatch
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"log"
+	"naevis/apierror"
+	"naevis/config"
+	"naevis/sqlguard"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// metrics counts ANALYZE runs, checked statements, plan changes and
+// statements that could not be explained, published under "planwatch" in
+// expvar.
+var metrics = expvar.NewMap("planwatch")
+
+// Plan is the recorded query plan of a catalog statement. Previous is the
+// plan it replaced, until the change is accepted.
+type Plan struct {
+	Hash      string `json:"hash"`
+	Statement string `json:"statement"`
+	Plan      string `json:"plan"`
+	Previous  string `json:"previous,omitempty"`
+	ChangedAt string `json:"changed_at,omitempty"`
+}
+
+// Watcher keeps the planner statistics current with ANALYZE and watches
+// the plans of the statement catalog, so an index that stops being used as
+// the data grows is noticed.
+type Watcher struct {
+	db    *sql.DB
+	limit int
+}
+
+// limitSQL sets the analysis limit of a connection.
+var limitSQL = sqlguard.NewTemplate(`PRAGMA analysis_limit = %d;`)
+
+// New creates a Watcher for cfg, before the SQL guard is sealed.
+func New(db *sql.DB, cfg config.Planner) *Watcher {
+	w := &Watcher{db: db, limit: max(cfg.AnalysisLimit, 0)}
+	limitSQL.Register(w.limit)
+	return w
+}
+
+// Run analyzes the database and checks the plans every interval until
+// ctx is cancelled.
+func (w *Watcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := w.Analyze(ctx); err != nil {
+			log.Printf("Error analyzing database: %v", err)
+		}
+		if err := w.Check(); err != nil {
+			log.Printf("Error checking query plans: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Analyze refreshes the planner statistics, including the sqlite_stat4
+// samples. A positive analysis limit bounds the rows read per index.
+func (w *Watcher) Analyze(ctx context.Context) error {
+	// analysis_limit applies to the connection, so both run on one.
+	conn, err := w.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, limitSQL.Format(w.limit)); err != nil {
+		return err
+	}
+	if _, err := conn.ExecContext(ctx, `ANALYZE;`); err != nil {
+		return err
+	}
+	metrics.Add("analyze_runs", 1)
+	return nil
+}
+
+// Check explains every catalog statement and compares the plan with the
+// one recorded before. The first plan of a statement is recorded as its
+// baseline; a different plan later is logged as an alert and kept, with
+// the one it replaced, until accepted through the admin API.
+func (w *Watcher) Check() error {
+	recorded := make(map[string]string)
+	rows, err := w.db.Query(`SELECT hash, plan FROM query_plans;`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var hash, plan string
+		if err := rows.Scan(&hash, &plan); err != nil {
+			rows.Close()
+			return err
+		}
+		recorded[hash] = plan
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, stmt := range sqlguard.Statements() {
+		plan, err := w.explain(stmt)
+		if err != nil {
+			// Statements on optional schemas, such as the cold tier,
+			// cannot be explained without them.
+			metrics.Add("errors", 1)
+			continue
+		}
+		if plan == "" {
+			continue
+		}
+		metrics.Add("statements", 1)
+
+		hash := Hash(stmt)
+		old, ok := recorded[hash]
+		switch {
+		case !ok:
+			_, err = w.db.Exec(`
+			INSERT INTO query_plans (hash, statement, plan, checked_at) VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+			ON CONFLICT(hash) DO NOTHING;`, hash, stmt, plan)
+		case old != plan:
+			metrics.Add("changed", 1)
+			log.Printf("ALERT: query plan changed for %s (%s)\nwas:\n%s\nnow:\n%s", hash, stmt, old, plan)
+			_, err = w.db.Exec(`
+			UPDATE query_plans SET
+				previous_plan = CASE WHEN previous_plan = '' THEN plan ELSE previous_plan END,
+				plan = ?, changed_at = CURRENT_TIMESTAMP, checked_at = CURRENT_TIMESTAMP
+			WHERE hash = ?;`, plan, hash)
+		default:
+			_, err = w.db.Exec(`UPDATE query_plans SET checked_at = CURRENT_TIMESTAMP WHERE hash = ?;`, hash)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// explain returns the query plan of stmt as an indented tree, or "" for
+// statements without one. Parameters are bound to NULL; the driver needs a
+// value for each, and there are at most as many as question marks.
+func (w *Watcher) explain(stmt string) (string, error) {
+	args := make([]any, strings.Count(stmt, "?"))
+	rows, err := w.db.Query(sqlguard.Explain(stmt), args...)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	depth := make(map[int64]int)
+	var lines []string
+	for rows.Next() {
+		var id, parent, unused int64
+		var detail string
+		if err := rows.Scan(&id, &parent, &unused, &detail); err != nil {
+			return "", err
+		}
+		depth[id] = depth[parent] + 1
+		lines = append(lines, strings.Repeat("  ", depth[id]-1)+detail)
+	}
+	return strings.Join(lines, "\n"), rows.Err()
+}
+
+// Hash identifies a catalog statement.
+func Hash(stmt string) string {
+	sum := sha256.Sum256([]byte(stmt))
+	return hex.EncodeToString(sum[:8])
+}
+
+// AdminHandler handles GET /admin/query-plans, listing the changed plans
+// (or all with ?all=1), and DELETE /admin/query-plans/{HASH}, which
+// accepts a changed plan.
+func (w *Watcher) AdminHandler(rw http.ResponseWriter, r *http.Request) {
+	hash := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/query-plans"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && hash == "":
+		all := r.URL.Query().Get("all") == "1"
+		rows, err := w.db.Query(`
+		SELECT hash, statement, plan, previous_plan, IFNULL(changed_at, '') FROM query_plans
+		WHERE ? OR previous_plan != ''
+		ORDER BY changed_at DESC, hash;`, all)
+		if err != nil {
+			apierror.Write(rw, "Failed to list query plans", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		plans := []Plan{}
+		for rows.Next() {
+			var p Plan
+			if err := rows.Scan(&p.Hash, &p.Statement, &p.Plan, &p.Previous, &p.ChangedAt); err != nil {
+				apierror.Write(rw, "Failed to list query plans", http.StatusInternalServerError)
+				return
+			}
+			plans = append(plans, p)
+		}
+		writeJSON(rw, http.StatusOK, plans)
+	case r.Method == http.MethodDelete && hash != "":
+		res, err := w.db.Exec(`UPDATE query_plans SET previous_plan = '' WHERE hash = ?;`, hash)
+		if err != nil {
+			apierror.Write(rw, "Failed to accept query plan", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			apierror.Write(rw, "Unknown statement", http.StatusNotFound)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	default:
+		apierror.Write(rw, "Use GET /admin/query-plans or DELETE /admin/query-plans/{HASH}", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	response, err := json.Marshal(v)
+	if err != nil {
+		apierror.Write(w, "Error encoding JSON", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(response)
+}
@@ -0,0 +1,55 @@
+package public
+
+import (
+	"net/http"
+	"strings"
+)
+
+// crawlers are the user agent tokens of well-known crawlers, in lower
+// case. A user agent containing one is that crawler.
+var crawlers = []string{
+	"googlebot", "bingbot", "yandexbot", "baiduspider", "duckduckbot",
+	"applebot", "slurp", "facebookexternalhit", "twitterbot", "linkedinbot",
+	"semrushbot", "ahrefsbot", "mj12bot", "petalbot", "gptbot", "ccbot",
+}
+
+// generic are the words crawlers without a well-known token name
+// themselves by.
+var generic = []string{"bot", "crawler", "spider"}
+
+// Crawler returns the name of the crawler making r, in lower case, or
+// false for other clients. Crawlers without a well-known token are named
+// by the first product of their user agent.
+func Crawler(r *http.Request) (string, bool) {
+	agent := strings.ToLower(r.UserAgent())
+	for _, name := range crawlers {
+		if strings.Contains(agent, name) {
+			return name, true
+		}
+	}
+	for _, word := range generic {
+		if strings.Contains(agent, word) {
+			product, _, _ := strings.Cut(agent, " ")
+			name, _, _ := strings.Cut(product, "/")
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// RobotsHandler serves GET /robots.txt, allowing crawlers the searches,
+// related entities and documents of the public entity types and nothing
+// else.
+func (g *Gate) RobotsHandler(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	b.WriteString("User-agent: *\n")
+	for _, t := range g.typeList {
+		b.WriteString("Allow: /events/" + t + "\n")
+		b.WriteString("Allow: /entities/" + t + "/\n")
+		b.WriteString("Allow: /documents/" + t + "/\n")
+	}
+	b.WriteString("Disallow: /\n")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write([]byte(b.String()))
+}
@@ -0,0 +1,252 @@
+// Package public serves reads of chosen entity types to unauthenticated
+// callers, such as a public website calling the API straight from the
+// browser, with the responses stripped of contact details and internal
+// IDs.
+package public
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"maps"
+	"naevis/accounts"
+	"naevis/apierror"
+	"naevis/config"
+	"naevis/visibility"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redacted are the JSON fields always removed from public responses:
+// contact details, the IDs of upstream records and users, and tenants.
+var redacted = []string{
+	"contact", "email", "phone",
+	"placeid", "eventid", "businessid", "peopleid",
+	"user_id", "tenant",
+}
+
+// stats are published under "public" in /admin/vars.
+var stats = expvar.NewMap("public")
+
+// TypeFunc returns the entity type a request reads, or "" when only the
+// response tells.
+type TypeFunc func(r *http.Request) string
+
+// PathType reads the entity type from the path segment after prefix, as
+// in /events/{ENTITY_TYPE}.
+func PathType(prefix string) TypeFunc {
+	return func(r *http.Request) string {
+		rest := strings.TrimPrefix(r.URL.Path, prefix)
+		entityType, _, _ := strings.Cut(rest, "/")
+		return entityType
+	}
+}
+
+// QueryType reads the entity type from the query parameter name.
+func QueryType(name string) TypeFunc {
+	return func(r *http.Request) string {
+		return r.URL.Query().Get(name)
+	}
+}
+
+// Gate lets unauthenticated reads of public entity types through,
+// redacted, and turns other unauthenticated requests away. Crawlers get
+// responses shared caches may keep for maxAge.
+type Gate struct {
+	types    map[string]bool
+	typeList []string
+	redact   map[string]bool
+	origins  map[string]bool
+	maxAge   time.Duration
+}
+
+// New creates a Gate for cfg, or returns nil when public mode is off.
+func New(cfg config.Public) *Gate {
+	if len(cfg.EntityTypes) == 0 {
+		return nil
+	}
+	g := &Gate{
+		types:   make(map[string]bool),
+		redact:  make(map[string]bool),
+		origins: make(map[string]bool),
+		maxAge:  cfg.CrawlerMaxAge.Duration,
+	}
+	for _, t := range cfg.EntityTypes {
+		g.types[t] = true
+	}
+	g.typeList = slices.Sorted(maps.Keys(g.types))
+	for _, f := range append(redacted, cfg.Redact...) {
+		g.redact[f] = true
+	}
+	for _, o := range cfg.Origins {
+		g.origins[o] = true
+	}
+	return g
+}
+
+// Wrap guards next, a JSON read of the entity type typeOf returns. A nil
+// typeOf, or one returning "", takes the type from the entity_type field
+// of the response. Operators and admins signed in with a second factor
+// pass through untouched; other signed-in callers may read every type but
+// are served redacted responses too. Public responses carry an ETag and
+// are answered with 304 when it matches. A nil Gate returns next.
+func (g *Gate) Wrap(typeOf TypeFunc, next http.Handler) http.Handler {
+	if g == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if claims, ok := accounts.FromContext(r.Context()); ok {
+			if claims.Admin() || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			g.serve(w, r, next, nil)
+			return
+		}
+		g.cors(w, r)
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+		case http.MethodOptions:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		default:
+			stats.Add("rejected", 1)
+			apierror.Write(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		entityType := ""
+		if typeOf != nil {
+			entityType = typeOf(r)
+		}
+		if entityType != "" && !g.types[entityType] {
+			stats.Add("rejected", 1)
+			apierror.Write(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		allowed := func(doc any) bool {
+			if entityType != "" {
+				return true
+			}
+			m, ok := doc.(map[string]any)
+			return ok && g.types[stringField(m, "entity_type")]
+		}
+		g.serve(w, r, next, allowed)
+	})
+}
+
+// ReadOnly turns away unauthenticated writes to next, so that ingest
+// needs an access token once the API is open to the public. A nil Gate
+// returns next.
+func (g *Gate) ReadOnly(next http.Handler) http.Handler {
+	if g == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := accounts.FromContext(r.Context()); !ok {
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+			default:
+				stats.Add("rejected", 1)
+				apierror.Write(w, "Authentication required", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serve runs next and sends its response redacted. allowed is nil for
+// signed-in callers; for anonymous ones it decides from the decoded
+// response whether they may see it at all.
+func (g *Gate) serve(w http.ResponseWriter, r *http.Request, next http.Handler, allowed func(doc any) bool) {
+	rec := &recorder{header: make(http.Header), status: http.StatusOK}
+	next.ServeHTTP(rec, r)
+	body := rec.body.Bytes()
+	if rec.status < 300 {
+		var doc any
+		d := json.NewDecoder(bytes.NewReader(body))
+		d.UseNumber()
+		if err := d.Decode(&doc); err != nil {
+			apierror.Write(w, "Response cannot be made public", http.StatusInternalServerError)
+			return
+		}
+		if allowed != nil && !allowed(doc) {
+			stats.Add("rejected", 1)
+			apierror.Write(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		visibility.Strip(doc, g.redact)
+		var err error
+		if body, err = json.Marshal(doc); err != nil {
+			apierror.Write(w, "Error encoding JSON", http.StatusInternalServerError)
+			return
+		}
+		rec.header.Del("Content-Length")
+		sum := sha256.Sum256(body)
+		rec.header.Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+		if _, ok := Crawler(r); ok && allowed != nil {
+			stats.Add("crawler", 1)
+			rec.header.Set("Cache-Control", "public, max-age="+strconv.Itoa(int(g.maxAge.Seconds())))
+		}
+		stats.Add("served", 1)
+	}
+	for name, values := range rec.header {
+		w.Header()[name] = values
+	}
+	if etag := rec.header.Get("ETag"); rec.status < 300 && etag != "" && r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(rec.status)
+	if r.Method != http.MethodHead {
+		w.Write(body)
+	}
+}
+
+// cors lets the browsers of the configured origins read the response.
+func (g *Gate) cors(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Vary", "Origin")
+	origin := r.Header.Get("Origin")
+	if !g.origins[origin] {
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD")
+		w.Header().Set("Access-Control-Allow-Headers", "X-Tenant-ID")
+		w.Header().Set("Access-Control-Max-Age", "600")
+	}
+}
+
+func stringField(m map[string]any, name string) string {
+	s, _ := m[name].(string)
+	return s
+}
+
+// recorder buffers a response so it can be redacted.
+type recorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+	wrote  bool
+}
+
+func (r *recorder) Header() http.Header {
+	return r.header
+}
+
+func (r *recorder) WriteHeader(status int) {
+	if !r.wrote {
+		r.status, r.wrote = status, true
+	}
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(b)
+}
@@ -0,0 +1,226 @@
+package quotas
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"naevis/config"
+	"naevis/routing"
+	"naevis/sqlguard"
+	"naevis/structs"
+	"sync"
+	"time"
+)
+
+// Actions taken when an entity type exceeds its quota.
+const (
+	// Alert logs and counts the overage but keeps storing events.
+	Alert = "alert"
+	// Reject refuses new events of the type.
+	Reject = "reject"
+	// Prune deletes the type's oldest events.
+	Prune = "prune"
+)
+
+// ErrExceeded is returned by Check for an entity type over a rejecting
+// quota.
+var ErrExceeded = errors.New("entity type storage quota exceeded")
+
+// metrics publishes each quota's usage and the events rejected and
+// pruned, under "quotas" in expvar.
+var metrics = expvar.NewMap("quotas")
+
+// rowSize is the SQL expression for the bytes an event row's data takes
+// up. Interned strings are stored once, so they are not counted.
+const rowSize = `IFNULL(length(entity_id), 0) + IFNULL(length(item_id), 0) + IFNULL(length(additional_info), 0)`
+
+// typeID selects the interned id of an entity type.
+const typeID = `(SELECT id FROM main.dictionary WHERE kind = 'entity_type' AND value = ?)`
+
+// Statements on the events of an entity type, run on the schema it is
+// routed to.
+var (
+	measureSQL = sqlguard.NewSchemaTemplate(`SELECT COUNT(*), IFNULL(SUM(` + rowSize + `), 0) FROM %[1]s.event_rows WHERE entity_type_id = ` + typeID + `;`)
+	listSQL    = sqlguard.NewSchemaTemplate(`SELECT id, ` + rowSize + ` FROM %[1]s.event_rows WHERE entity_type_id = ` + typeID + ` ORDER BY id;`)
+	pruneSQL   = sqlguard.NewSchemaTemplate(`DELETE FROM %[1]s.event_rows WHERE entity_type_id = ` + typeID + ` AND id <= ?;`)
+)
+
+// usage is what an entity type has stored.
+type usage struct {
+	rows, bytes int64
+	over        bool
+	stats       *expvar.Map
+}
+
+// Enforcer keeps entity types within their configured storage quotas,
+// so a runaway type cannot crowd out the others.
+type Enforcer struct {
+	db     *sql.DB
+	quotas map[string]config.Quota
+
+	mu    sync.Mutex
+	usage map[string]*usage
+}
+
+// New creates an Enforcer for cfg. It returns an error for an unknown
+// action.
+func New(db *sql.DB, cfg config.Quotas) (*Enforcer, error) {
+	e := &Enforcer{db: db, quotas: make(map[string]config.Quota), usage: make(map[string]*usage)}
+	for _, q := range cfg.EntityTypes {
+		switch q.Action {
+		case "":
+			q.Action = Alert
+		case Alert, Reject, Prune:
+		default:
+			return nil, fmt.Errorf("quota for %s: unknown action %q", q.EntityType, q.Action)
+		}
+		e.quotas[q.EntityType] = q
+		u := &usage{stats: new(expvar.Map).Init()}
+		e.usage[q.EntityType] = u
+		metrics.Set(q.EntityType, u.stats)
+	}
+	return e, nil
+}
+
+// Run measures every quota'd type and prunes those over a pruning quota,
+// every interval until ctx is cancelled.
+func (e *Enforcer) Run(ctx context.Context, interval time.Duration) {
+	if len(e.quotas) == 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := e.Enforce(); err != nil {
+			log.Printf("Error enforcing storage quotas: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check returns ErrExceeded if event's type is over a rejecting quota.
+func (e *Enforcer) Check(event structs.Index) error {
+	q, ok := e.quotas[event.EntityType]
+	if !ok || q.Action != Reject {
+		return nil
+	}
+	e.mu.Lock()
+	u := e.usage[event.EntityType]
+	full := exceeds(q, u.rows+1, u.bytes+eventSize(event))
+	e.mu.Unlock()
+	if full {
+		u.stats.Add("rejected", 1)
+		return ErrExceeded
+	}
+	return nil
+}
+
+// Stored accounts for a stored event until the next measurement.
+func (e *Enforcer) Stored(event structs.Index, data structs.MongoData) {
+	if _, ok := e.quotas[event.EntityType]; !ok {
+		return
+	}
+	e.mu.Lock()
+	u := e.usage[event.EntityType]
+	u.rows++
+	u.bytes += eventSize(event) + int64(len(data.AdditionalInfo))
+	e.mu.Unlock()
+}
+
+// Enforce measures each quota'd type, prunes those over a pruning quota
+// and logs those that crossed their quota since the last measurement.
+func (e *Enforcer) Enforce() error {
+	for entityType, q := range e.quotas {
+		rows, bytes, err := e.measure(entityType)
+		if err != nil {
+			return err
+		}
+		if q.Action == Prune && exceeds(q, rows, bytes) {
+			n, freed, err := e.prune(q, rows, bytes)
+			if err != nil {
+				return err
+			}
+			rows, bytes = rows-n, bytes-freed
+			e.usage[entityType].stats.Add("pruned", n)
+			log.Printf("Pruned %d oldest %s events (%d bytes) to stay within quota", n, entityType, freed)
+		}
+
+		e.mu.Lock()
+		u := e.usage[entityType]
+		u.rows, u.bytes = rows, bytes
+		over := exceeds(q, rows, bytes)
+		crossed := over && !u.over
+		u.over = over
+		e.mu.Unlock()
+
+		u.stats.Set("rows", intVar(rows))
+		u.stats.Set("bytes", intVar(bytes))
+		if crossed && q.Action == Alert {
+			u.stats.Add("alerts", 1)
+			log.Printf("ALERT: %s events exceed their storage quota: %d rows, %d bytes (max %d rows, %d bytes)",
+				entityType, rows, bytes, q.MaxRows, q.MaxBytes)
+		}
+	}
+	return nil
+}
+
+// measure counts the rows and bytes stored for entityType.
+func (e *Enforcer) measure(entityType string) (rows, bytes int64, err error) {
+	err = e.db.QueryRow(measureSQL.Format(routing.Schema(entityType)), entityType).Scan(&rows, &bytes)
+	return rows, bytes, err
+}
+
+// prune deletes the oldest events of q's type until it fits its quota,
+// returning the rows and bytes removed.
+func (e *Enforcer) prune(q config.Quota, rows, bytes int64) (n, freed int64, err error) {
+	list, err := e.db.Query(listSQL.Format(routing.Schema(q.EntityType)), q.EntityType)
+	if err != nil {
+		return 0, 0, err
+	}
+	var cutoff int64
+	for list.Next() && exceeds(q, rows-n, bytes-freed) {
+		var size int64
+		if err := list.Scan(&cutoff, &size); err != nil {
+			list.Close()
+			return 0, 0, err
+		}
+		n++
+		freed += size
+	}
+	list.Close()
+	if err := list.Err(); err != nil || n == 0 {
+		return 0, 0, err
+	}
+
+	// Attachment references to the deleted events are dropped by the
+	// blob garbage collector.
+	_, err = e.db.Exec(pruneSQL.Format(routing.Schema(q.EntityType)), q.EntityType, cutoff)
+	return n, freed, err
+}
+
+// exceeds reports whether rows and bytes are over q. Zero limits are
+// unlimited.
+func exceeds(q config.Quota, rows, bytes int64) bool {
+	return q.MaxRows > 0 && rows > q.MaxRows || q.MaxBytes > 0 && bytes > q.MaxBytes
+}
+
+// eventSize is the bytes event's fields take up, as counted by rowSize.
+func eventSize(event structs.Index) int64 {
+	return int64(len(event.EntityId) + len(event.ItemId))
+}
+
+// intVar publishes a gauge in expvar.
+func intVar(n int64) *expvar.Int {
+	v := new(expvar.Int)
+	v.Set(n)
+	return v
+}
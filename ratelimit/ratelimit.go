@@ -0,0 +1,331 @@
+// Package ratelimit caps request rates per tenant, IP, user or crawler
+// across the instances of a cluster, with separate limits for crawlers if
+// need be. Requests are counted in windows aligned to the clock, so every
+// instance agrees on them, and weighed as a sliding window: the current
+// window's count plus the share of the previous one the sliding window
+// still covers. Instances send their counts to each other, and each adds
+// its peers' counts to its own, so a limit holds cluster-wide, give or
+// take the requests made between two syncs.
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"naevis/accounts"
+	"naevis/apierror"
+	"naevis/config"
+	"naevis/public"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// messageKind marks the count messages among those peers exchange.
+const messageKind = 'r'
+
+// metrics counts allowed and limited requests, and count messages sent,
+// received and dropped, published under "ratelimit" in expvar.
+var metrics = expvar.NewMap("ratelimit")
+
+// Peers carries messages between instances; gossip.Cluster implements it.
+type Peers interface {
+	Subscribe(kind byte, fn func(msg []byte))
+	Broadcast(kind byte, msg []byte)
+}
+
+// count is the requests of one key in a window, and in the window before.
+type count struct {
+	window    int64
+	cur, prev int64
+}
+
+// at returns the counts of window w and the one before it.
+func (c *count) at(w int64) (cur, prev int64) {
+	switch c.window {
+	case w:
+		return c.cur, c.prev
+	case w - 1:
+		return 0, c.cur
+	}
+	return 0, 0
+}
+
+// add counts n requests in window w.
+func (c *count) add(w, n int64) {
+	cur, prev := c.at(w)
+	c.window, c.cur, c.prev = w, cur+n, prev
+}
+
+// set records a peer's count n for window w. Counts of older windows than
+// the last one seen arrive late and are ignored.
+func (c *count) set(w, n int64) {
+	if w < c.window {
+		return
+	}
+	_, prev := c.at(w)
+	c.window, c.cur, c.prev = w, n, prev
+}
+
+// message is an instance's counts, keyed by rule name and key value.
+type message struct {
+	Node   string  `json:"node"`
+	Counts []entry `json:"counts"`
+}
+
+type entry struct {
+	Key    string `json:"k"`
+	Window int64  `json:"w"`
+	Count  int64  `json:"n"`
+}
+
+// Limiter enforces the configured rate rules.
+type Limiter struct {
+	self  string
+	rules []config.RateRule
+	byKey map[string]config.RateRule
+	peers Peers
+
+	mu     sync.Mutex
+	local  map[string]*count
+	remote map[string]map[string]*count
+}
+
+// New creates a Limiter for cfg on the instance named self.
+func New(cfg config.RateLimit, self string) (*Limiter, error) {
+	l := &Limiter{
+		self:   self,
+		byKey:  make(map[string]config.RateRule),
+		local:  make(map[string]*count),
+		remote: make(map[string]map[string]*count),
+	}
+	for _, r := range cfg.Rules {
+		switch {
+		case r.Name == "" || strings.Contains(r.Name, "\x00"):
+			return nil, fmt.Errorf("rate rule %q: invalid name", r.Name)
+		case l.byKey[r.Name].Name != "":
+			return nil, fmt.Errorf("rate rule %s: duplicate name", r.Name)
+		case r.Key != "tenant" && r.Key != "ip" && r.Key != "user" && r.Key != "crawler":
+			return nil, fmt.Errorf("rate rule %s: key must be tenant, ip, user or crawler", r.Name)
+		case r.Agent != "" && r.Agent != "crawler" && r.Agent != "human":
+			return nil, fmt.Errorf("rate rule %s: agent must be crawler or human", r.Name)
+		case r.Key == "crawler" && r.Agent != "crawler":
+			return nil, fmt.Errorf("rate rule %s: key crawler needs agent crawler", r.Name)
+		case r.Limit <= 0 || r.Window.Duration <= 0:
+			return nil, fmt.Errorf("rate rule %s: limit and window must be positive", r.Name)
+		}
+		l.rules = append(l.rules, r)
+		l.byKey[r.Name] = r
+	}
+	return l, nil
+}
+
+// SetPeers shares counts with peers.
+func (l *Limiter) SetPeers(peers Peers) {
+	l.peers = peers
+	peers.Subscribe(messageKind, l.receive)
+}
+
+// Run sends this instance's counts to its peers, and drops the counts of
+// past windows, every interval until ctx is cancelled.
+func (l *Limiter) Run(ctx context.Context, interval time.Duration) {
+	if len(l.rules) == 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		msg := l.sweep(time.Now())
+		if l.peers != nil && len(msg.Counts) > 0 {
+			buf, err := json.Marshal(msg)
+			if err != nil {
+				log.Printf("Error encoding rate counts: %v", err)
+				continue
+			}
+			l.peers.Broadcast(messageKind, buf)
+			metrics.Add("syncs", 1)
+		}
+	}
+}
+
+// sweep drops the counts of windows that no longer matter at now and
+// returns the local counts left, to send to peers.
+func (l *Limiter) sweep(now time.Time) message {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	msg := message{Node: l.self}
+	for key, c := range l.local {
+		if l.stale(key, c, now) {
+			delete(l.local, key)
+			continue
+		}
+		msg.Counts = append(msg.Counts, entry{key, c.window, c.cur})
+	}
+	for node, counts := range l.remote {
+		for key, c := range counts {
+			if l.stale(key, c, now) {
+				delete(counts, key)
+			}
+		}
+		if len(counts) == 0 {
+			delete(l.remote, node)
+		}
+	}
+	return msg
+}
+
+// stale reports whether c, counting key, says nothing about now.
+func (l *Limiter) stale(key string, c *count, now time.Time) bool {
+	name, _, _ := strings.Cut(key, "\x00")
+	rule, ok := l.byKey[name]
+	if !ok {
+		return true
+	}
+	cur, prev := c.at(now.UnixNano() / int64(rule.Window.Duration))
+	return cur == 0 && prev == 0
+}
+
+// receive records a peer's counts.
+func (l *Limiter) receive(buf []byte) {
+	var msg message
+	if err := json.Unmarshal(buf, &msg); err != nil || msg.Node == l.self {
+		metrics.Add("dropped", 1)
+		return
+	}
+	metrics.Add("received", 1)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	counts := l.remote[msg.Node]
+	if counts == nil {
+		counts = make(map[string]*count)
+		l.remote[msg.Node] = counts
+	}
+	for _, e := range msg.Counts {
+		c := counts[e.Key]
+		if c == nil {
+			c = &count{}
+			counts[e.Key] = c
+		}
+		c.set(e.Window, e.Count)
+	}
+}
+
+// Middleware refuses requests over a limit with 429 and the seconds until
+// the window turns in Retry-After. It must run after authentication for
+// limits per user.
+func (l *Limiter) Middleware(next http.Handler) http.Handler {
+	if len(l.rules) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if retry, ok := l.allow(r, time.Now()); !ok {
+			metrics.Add("limited", 1)
+			w.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds()+0.999)))
+			apierror.Write(w, "Rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		metrics.Add("allowed", 1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allow counts r against every rule applying to it, unless one of them is
+// exceeded, in which case it returns how long until that rule's window
+// turns.
+func (l *Limiter) allow(r *http.Request, now time.Time) (time.Duration, bool) {
+	type hit struct {
+		key    string
+		window int64
+	}
+	var hits []hit
+
+	crawler, isCrawler := public.Crawler(r)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, rule := range l.rules {
+		if !applies(rule, r.URL.Path, isCrawler) {
+			continue
+		}
+		value := crawler
+		if rule.Key != "crawler" {
+			value = keyOf(rule.Key, r)
+		}
+		key := rule.Name + "\x00" + value
+		size := int64(rule.Window.Duration)
+		w := now.UnixNano() / size
+		// The share of the previous window the sliding window covers.
+		share := 1 - float64(now.UnixNano()%size)/float64(size)
+
+		var cur, prev int64
+		if c := l.local[key]; c != nil {
+			cur, prev = c.at(w)
+		}
+		for _, counts := range l.remote {
+			if c := counts[key]; c != nil {
+				n, p := c.at(w)
+				cur, prev = cur+n, prev+p
+			}
+		}
+		if float64(cur)+float64(prev)*share >= float64(rule.Limit) {
+			return time.Duration(size - now.UnixNano()%size), false
+		}
+		hits = append(hits, hit{key, w})
+	}
+
+	for _, h := range hits {
+		c := l.local[h.key]
+		if c == nil {
+			c = &count{}
+			l.local[h.key] = c
+		}
+		c.add(h.window, 1)
+	}
+	return 0, true
+}
+
+// applies reports whether rule limits requests for path, made by a
+// crawler or not.
+func applies(rule config.RateRule, path string, crawler bool) bool {
+	switch {
+	case rule.Agent == "crawler" && !crawler, rule.Agent == "human" && crawler:
+		return false
+	case len(rule.Paths) == 0:
+		return true
+	}
+	for _, p := range rule.Paths {
+		if strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// keyOf returns the value of key for r.
+func keyOf(key string, r *http.Request) string {
+	switch key {
+	case "tenant":
+		return r.Header.Get("X-Tenant-ID")
+	case "user":
+		if claims, ok := accounts.FromContext(r.Context()); ok {
+			return "user:" + strconv.FormatInt(claims.Subject, 10)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
@@ -0,0 +1,326 @@
+// Package recovery checks the database files before the server opens them.
+// A file whose WAL does not checkpoint or that fails the integrity check
+// never serves requests: a corrupt file is moved aside and replaced with
+// its newest intact backup, and the server refuses to start when there is
+// none.
+package recovery
+
+import (
+	"database/sql"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"naevis/config"
+	"naevis/sqlguard"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// metrics are published under "recovery" in expvar.
+var metrics = expvar.NewMap("recovery")
+
+const (
+	// checkpointSQL moves the WAL into the database file. Its result is
+	// whether it was blocked, the frames in the WAL and the frames moved;
+	// without a WAL both counts are -1.
+	checkpointSQL = `PRAGMA wal_checkpoint(TRUNCATE);`
+	quickCheckSQL = `PRAGMA quick_check;`
+	fullCheckSQL  = `PRAGMA integrity_check;`
+)
+
+// quarantineMark is inserted in the name of a quarantined file, before
+// the time it was moved.
+const quarantineMark = ".corrupt-"
+
+// maxProblems bounds the problems reported for a file.
+const maxProblems = 5
+
+// sidecars are the suffixes of the files SQLite keeps next to a database.
+var sidecars = []string{"-wal", "-shm", "-journal"}
+
+// corruptError is a check that found the database damaged.
+type corruptError struct {
+	problem string
+}
+
+func (e corruptError) Error() string {
+	return "corrupt: " + e.problem
+}
+
+// Check verifies the database files in paths, restoring corrupt ones from
+// cfg.Backups. It returns an error when a file cannot be checked, is
+// corrupt without an intact backup, or was quarantined before and never
+// replaced; the server must not start then.
+func Check(paths []string, cfg config.Recovery) error {
+	for _, path := range paths {
+		if err := checkFile(path, cfg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkFile verifies the database at path.
+func checkFile(path string, cfg config.Recovery) error {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		// A missing file is a new database, unless it is missing because
+		// it was quarantined: starting empty would hide the loss.
+		moved, err := quarantined(path)
+		if err != nil || moved == "" {
+			return err
+		}
+		if restored, err := restore(path, cfg.Backups); err != nil || restored {
+			return err
+		}
+		return fmt.Errorf("%s was quarantined as %s and no intact backup was found; restore one, or remove the quarantined files to start empty",
+			path, moved)
+	} else if err != nil {
+		return err
+	}
+
+	err := verify(path, cfg.FullCheck)
+	var corrupt corruptError
+	if !errors.As(err, &corrupt) {
+		if err != nil {
+			return fmt.Errorf("checking %s: %v", path, err)
+		}
+		metrics.Add("checked", 1)
+		return nil
+	}
+
+	log.Printf("Database %s is %v", path, err)
+	moved, err := quarantine(path)
+	if err != nil {
+		return fmt.Errorf("quarantining %s: %v", path, err)
+	}
+	metrics.Add("quarantined", 1)
+	log.Printf("Moved %s to %s", path, moved)
+
+	restored, err := restore(path, cfg.Backups)
+	if err != nil {
+		return err
+	}
+	if !restored {
+		return fmt.Errorf("%s is %v and no intact backup was found; it was moved to %s", path, corrupt, moved)
+	}
+	return nil
+}
+
+// verify checkpoints the WAL of the database at path and checks its
+// integrity, fully or quickly. Damage is reported as a corruptError.
+func verify(path string, full bool) error {
+	db, err := sql.Open(sqlguard.DriverName, path+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var busy, frames, moved int
+	if err := db.QueryRow(checkpointSQL).Scan(&busy, &frames, &moved); err != nil {
+		return classify(err)
+	}
+	if busy != 0 {
+		return errors.New("WAL checkpoint blocked; is another process using the database?")
+	}
+	if moved != frames {
+		return fmt.Errorf("WAL checkpoint moved %d of %d frames", moved, frames)
+	}
+
+	var rows *sql.Rows
+	if full {
+		rows, err = db.Query(fullCheckSQL)
+	} else {
+		rows, err = db.Query(quickCheckSQL)
+	}
+	if err != nil {
+		return classify(err)
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var problem string
+		if err := rows.Scan(&problem); err != nil {
+			return classify(err)
+		}
+		if problem != "ok" && len(problems) < maxProblems {
+			problems = append(problems, problem)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return classify(err)
+	}
+	if len(problems) > 0 {
+		return corruptError{strings.Join(problems, "; ")}
+	}
+	return nil
+}
+
+// classify turns the errors of SQLite reading a damaged file into a
+// corruptError. Others, such as a locked file, leave the file in place.
+func classify(err error) error {
+	var e *sqlite.Error
+	if errors.As(err, &e) {
+		switch e.Code() & 0xff {
+		case sqlite3.SQLITE_CORRUPT, sqlite3.SQLITE_NOTADB:
+			return corruptError{err.Error()}
+		}
+	}
+	return err
+}
+
+// quarantine moves the database at path and its sidecar files aside, and
+// returns the new name of the database.
+func quarantine(path string) (string, error) {
+	moved := path + quarantineMark + time.Now().UTC().Format("20060102T150405Z")
+	if err := os.Rename(path, moved); err != nil {
+		return "", err
+	}
+	for _, suffix := range sidecars {
+		if err := os.Rename(path+suffix, moved+suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return moved, err
+		}
+	}
+	return moved, nil
+}
+
+// restore copies the newest intact backup of the database at path from
+// dir into place. Backups are the files of dir named like the database,
+// optionally followed by a dot and anything, such as events.db.20261015.
+// It reports false when dir is empty or holds no intact backup.
+func restore(path, dir string) (bool, error) {
+	if dir == "" {
+		return false, nil
+	}
+	backups, err := findBackups(dir, filepath.Base(path))
+	if err != nil {
+		return false, fmt.Errorf("listing backups of %s: %v", path, err)
+	}
+	for _, backup := range backups {
+		err := restoreFrom(path, backup)
+		if err == nil {
+			metrics.Add("restored", 1)
+			log.Printf("Restored %s from the backup %s", path, backup)
+			return true, nil
+		}
+		log.Printf("Skipping the backup %s: %v", backup, err)
+	}
+	return false, nil
+}
+
+// findBackups lists the backups of the database called name in dir,
+// newest first.
+func findBackups(dir, name string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	type backup struct {
+		path    string
+		modTime time.Time
+	}
+	var found []backup
+	for _, entry := range entries {
+		n := entry.Name()
+		if !entry.Type().IsRegular() || (n != name && !strings.HasPrefix(n, name+".")) ||
+			strings.Contains(n, quarantineMark) || isSidecar(n) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, backup{filepath.Join(dir, n), info.ModTime()})
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].modTime.After(found[j].modTime) })
+	paths := make([]string, len(found))
+	for i, b := range found {
+		paths[i] = b.path
+	}
+	return paths, nil
+}
+
+// restoreFrom copies backup next to path, verifies the copy, and moves it
+// into place. The backup itself is never opened as a database.
+func restoreFrom(path, backup string) error {
+	tmp := path + ".restore"
+	defer removeAll(tmp)
+	if err := copyFile(tmp, backup); err != nil {
+		return err
+	}
+	for _, suffix := range []string{"-wal", "-shm"} {
+		// The WAL of a backup taken by copying a live file.
+		if _, err := os.Stat(backup + suffix); err == nil {
+			if err := copyFile(tmp+suffix, backup+suffix); err != nil {
+				return err
+			}
+		}
+	}
+	// verify checkpoints the WAL into the copy.
+	if err := verify(tmp, true); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// copyFile copies src to dst and syncs it to disk.
+func copyFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// removeAll removes the database at path and its sidecar files, if any.
+func removeAll(path string) {
+	os.Remove(path)
+	for _, suffix := range sidecars {
+		os.Remove(path + suffix)
+	}
+}
+
+func isSidecar(name string) bool {
+	for _, suffix := range sidecars {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// quarantined returns a quarantined copy of the database at path, or ""
+// when there is none.
+func quarantined(path string) (string, error) {
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return "", err
+	}
+	prefix := filepath.Base(path) + quarantineMark
+	for _, entry := range entries {
+		if n := entry.Name(); strings.HasPrefix(n, prefix) && !isSidecar(n) {
+			return filepath.Join(filepath.Dir(path), n), nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,253 @@
+// Package regions steers clients to the nearest healthy region of a
+// multi-region deployment. Every instance knows the regions from its
+// config and polls their /health; GET /regions ranks them for the caller,
+// and the client SDK sends its requests to the first it reaches, failing
+// over along the list.
+package regions
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"naevis/apierror"
+	"naevis/config"
+	"naevis/geo"
+	"naevis/structs"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// checkTimeout bounds the wait for a region's health.
+const checkTimeout = 5 * time.Second
+
+// region is a configured region with its location and networks parsed.
+type region struct {
+	config.Region
+	location *structs.Point
+	networks []*net.IPNet
+}
+
+// health is the outcome of a region's last health check.
+type health struct {
+	healthy   bool
+	checkedAt time.Time
+}
+
+// Steering ranks the regions for clients.
+type Steering struct {
+	self    string
+	regions []region
+	client  *http.Client
+
+	mu     sync.RWMutex
+	health map[string]health
+}
+
+// New creates the Steering of cfg, or returns nil when no regions are
+// configured.
+func New(cfg config.Regions) (*Steering, error) {
+	if len(cfg.Regions) == 0 {
+		return nil, nil
+	}
+	s := &Steering{
+		self: cfg.Self,
+		// Instances only speak QUIC.
+		client: &http.Client{Transport: &http3.Transport{}, Timeout: checkTimeout},
+		health: make(map[string]health),
+	}
+	names := make(map[string]bool)
+	for _, r := range cfg.Regions {
+		if r.Name == "" || names[r.Name] {
+			return nil, fmt.Errorf("region %q: missing or repeated name", r.Name)
+		}
+		names[r.Name] = true
+		if u, err := url.Parse(r.URL); err != nil || u.Host == "" {
+			return nil, fmt.Errorf("region %s: invalid url %q", r.Name, r.URL)
+		}
+		reg := region{Region: r}
+		if r.Location != "" {
+			p, err := geo.ParsePoint(r.Location)
+			if err != nil {
+				return nil, fmt.Errorf("region %s: location: %v", r.Name, err)
+			}
+			reg.location = &p
+		}
+		for _, cidr := range r.Networks {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("region %s: %v", r.Name, err)
+			}
+			reg.networks = append(reg.networks, network)
+		}
+		s.regions = append(s.regions, reg)
+	}
+	if cfg.Self != "" && !names[cfg.Self] {
+		return nil, fmt.Errorf("regions.self %q is not a region", cfg.Self)
+	}
+	return s, nil
+}
+
+// Run checks the health of the other regions every interval until ctx is
+// cancelled. This instance's region is healthy as long as it answers.
+func (s *Steering) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		var wg sync.WaitGroup
+		for _, r := range s.regions {
+			if r.Name == s.self {
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.check(ctx, r)
+			}()
+		}
+		wg.Wait()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check records whether r's /health answers 200.
+func (s *Steering) check(ctx context.Context, r region) {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	u, _ := url.JoinPath(r.URL, "/health")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return
+	}
+	resp, err := s.client.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+	}
+	healthy := err == nil
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if prev, ok := s.health[r.Name]; (!ok || prev.healthy) && !healthy {
+		log.Printf("Region %s is unhealthy: %v", r.Name, err)
+	}
+	s.health[r.Name] = health{healthy: healthy, checkedAt: time.Now().UTC()}
+}
+
+// rank returns the regions for a client at addr, and at near if it is not
+// nil: healthy regions before the others, then the regions whose networks
+// hold addr, then the nearest. Without locations to compare, this
+// instance's region comes first, then the others in configured order.
+func (s *Steering) rank(addr net.IP, near *structs.Point) []structs.Region {
+	type ranked struct {
+		structs.Region
+		local    bool
+		distance float64
+	}
+
+	s.mu.RLock()
+	list := make([]ranked, 0, len(s.regions))
+	for _, r := range s.regions {
+		// Regions are healthy until a check says otherwise.
+		h, checked := s.health[r.Name]
+		item := ranked{
+			Region:   structs.Region{Name: r.Name, URL: r.URL, Healthy: !checked || h.healthy},
+			distance: math.Inf(1),
+		}
+		if checked {
+			item.CheckedAt = h.checkedAt.Format(time.RFC3339)
+		}
+		if r.Name == s.self {
+			item.Healthy = true
+		}
+		item.local = slices.ContainsFunc(r.networks, func(n *net.IPNet) bool { return addr != nil && n.Contains(addr) })
+		if near != nil && r.location != nil {
+			d := geo.DistanceKm(*near, *r.location)
+			item.DistanceKm, item.distance = &d, d
+		} else if near == nil && r.Name == s.self {
+			item.distance = 0
+		}
+		list = append(list, item)
+	}
+	s.mu.RUnlock()
+
+	// Stable, so ties keep the configured order.
+	slices.SortStableFunc(list, func(a, b ranked) int {
+		if a.Healthy != b.Healthy {
+			return boolOrder(a.Healthy)
+		}
+		if a.local != b.local {
+			return boolOrder(a.local)
+		}
+		return cmp.Compare(a.distance, b.distance)
+	})
+	regions := make([]structs.Region, len(list))
+	for i, r := range list {
+		regions[i] = r.Region
+	}
+	return regions
+}
+
+// boolOrder sorts true before false.
+func boolOrder(first bool) int {
+	if first {
+		return -1
+	}
+	return 1
+}
+
+// ServeHTTP handles GET /regions?near=LAT,LNG, the regions ranked for the
+// caller. Callers behind a proxy are ranked by the proxy's address.
+func (s *Steering) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apierror.Write(w, "Only GET requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var near *structs.Point
+	if v := r.URL.Query().Get("near"); v != "" {
+		p, err := geo.ParsePoint(v)
+		if err != nil {
+			apierror.Write(w, "Invalid near: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		near = &p
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	list := structs.RegionList{Regions: s.rank(net.ParseIP(host), near)}
+	if first := list.Regions[0]; first.Healthy {
+		list.Nearest = first.Name
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	response, err := json.Marshal(v)
+	if err != nil {
+		apierror.Write(w, "Error encoding JSON", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(response)
+}
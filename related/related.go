@@ -0,0 +1,221 @@
+package related
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"naevis/apierror"
+	"naevis/config"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// keep is how many related entities are stored per entity.
+	keep = 20
+	// maxSessionEntities bounds the pairs a single long session adds.
+	maxSessionEntities = 50
+	defaultLimit       = 10
+)
+
+// Entity identifies an entity within a tenant.
+type Entity struct {
+	Tenant     string `json:"-"`
+	EntityType string `json:"entity_type"`
+	EntityId   string `json:"entity_id"`
+}
+
+// Related is an entity seen in the same sessions as another.
+type Related struct {
+	EntityType string `json:"entity_type"`
+	EntityId   string `json:"entity_id"`
+	Sessions   int64  `json:"sessions"`
+}
+
+// Job precomputes "people who viewed X also viewed Y" into the
+// related_entities table. A session is a user's run of events with no gap
+// longer than the session gap; anonymous events have no session and are
+// ignored.
+type Job struct {
+	db     *sql.DB
+	window time.Duration
+	gap    time.Duration
+}
+
+// NewJob creates a related-entities job from cfg.
+func NewJob(db *sql.DB, cfg config.Related) *Job {
+	return &Job{db: db, window: cfg.Window.Duration, gap: cfg.SessionGap.Duration}
+}
+
+// Run recomputes related entities every interval until ctx is cancelled.
+func (j *Job) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := j.Refresh(); err != nil {
+			log.Printf("Error refreshing related entities: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type pair struct {
+	a, b Entity
+}
+
+// Refresh counts how many sessions each pair of entities shares and keeps
+// the most frequent partners of every entity.
+func (j *Job) Refresh() error {
+	rows, err := j.db.Query(`
+	SELECT user_id, tenant, entity_type, entity_id, created_at FROM events
+	WHERE user_id IS NOT NULL AND created_at >= ? AND entity_type != '' AND entity_id != ''
+	ORDER BY user_id, created_at;`, time.Now().UTC().Add(-j.window).Format(time.DateTime))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	counts := make(map[pair]int64)
+	var session []Entity
+	seen := make(map[Entity]bool)
+	flush := func() {
+		for i, a := range session {
+			for _, b := range session[i+1:] {
+				counts[pair{a, b}]++
+				counts[pair{b, a}]++
+			}
+		}
+		session = session[:0]
+		clear(seen)
+	}
+
+	var lastUser int64
+	var lastAt time.Time
+	for rows.Next() {
+		var user int64
+		var e Entity
+		var at time.Time
+		if err := rows.Scan(&user, &e.Tenant, &e.EntityType, &e.EntityId, &at); err != nil {
+			return err
+		}
+		if user != lastUser || at.Sub(lastAt) > j.gap {
+			flush()
+		}
+		lastUser, lastAt = user, at
+		if !seen[e] && len(session) < maxSessionEntities {
+			seen[e] = true
+			session = append(session, e)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	flush()
+
+	partners := make(map[Entity][]Related)
+	for p, n := range counts {
+		partners[p.a] = append(partners[p.a], Related{EntityType: p.b.EntityType, EntityId: p.b.EntityId, Sessions: n})
+	}
+
+	tx, err := j.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM related_entities;`); err != nil {
+		return err
+	}
+	for e, list := range partners {
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].Sessions != list[j].Sessions {
+				return list[i].Sessions > list[j].Sessions
+			}
+			return list[i].EntityType+"/"+list[i].EntityId < list[j].EntityType+"/"+list[j].EntityId
+		})
+		if len(list) > keep {
+			list = list[:keep]
+		}
+		for rank, r := range list {
+			if _, err := tx.Exec(`
+			INSERT INTO related_entities (tenant, entity_type, entity_id, rank, related_type, related_id, sessions, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP);`,
+				e.Tenant, e.EntityType, e.EntityId, rank+1, r.EntityType, r.EntityId, r.Sessions); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// Handler serves the precomputed related entities.
+type Handler struct {
+	db *sql.DB
+}
+
+// NewHandler creates a Handler.
+func NewHandler(db *sql.DB) *Handler {
+	return &Handler{db: db}
+}
+
+// ServeHTTP handles GET /entities/{ENTITY_TYPE}/{ENTITY_ID}/related?limit=N
+// for the caller's tenant.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apierror.Write(w, "Only GET requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/entities/"), "/"), "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] != "related" {
+		apierror.Write(w, "Use /entities/{ENTITY_TYPE}/{ENTITY_ID}/related", http.StatusNotFound)
+		return
+	}
+	limit := defaultLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			apierror.Write(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, keep)
+	}
+
+	rows, err := h.db.Query(`
+	SELECT related_type, related_id, sessions FROM related_entities
+	WHERE tenant = ? AND entity_type = ? AND entity_id = ?
+	ORDER BY rank LIMIT ?;`, r.Header.Get("X-Tenant-ID"), parts[0], parts[1], limit)
+	if err != nil {
+		apierror.Write(w, "Failed to load related entities", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	items := []Related{}
+	for rows.Next() {
+		var rel Related
+		if err := rows.Scan(&rel.EntityType, &rel.EntityId, &rel.Sessions); err != nil {
+			apierror.Write(w, "Failed to load related entities", http.StatusInternalServerError)
+			return
+		}
+		items = append(items, rel)
+	}
+
+	response, err := json.Marshal(items)
+	if err != nil {
+		apierror.Write(w, "Error encoding JSON", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
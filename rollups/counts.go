@@ -0,0 +1,182 @@
+package rollups
+
+import (
+	"database/sql"
+	"fmt"
+	"naevis/apierror"
+	"naevis/sqlguard"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxCountBuckets bounds the range of a counts query, in buckets.
+const maxCountBuckets = 1000
+
+// countsSQL sums the roll-up table %s of an interval per bucket and
+// group. The first three parameters tell whether to group by the entity
+// type, action and tenant; the other columns are empty. Then come the range, the end
+// exclusive, and the entity type, action and tenant filters, each twice.
+var countsSQL = sqlguard.NewTemplate(`
+SELECT bucket,
+	CASE WHEN ? THEN entity_type ELSE '' END,
+	CASE WHEN ? THEN action ELSE '' END,
+	CASE WHEN ? THEN tenant ELSE '' END,
+	SUM(count)
+FROM %s
+WHERE bucket >= ? AND bucket < ?
+	AND (? = '' OR entity_type = ?)
+	AND (? = '' OR action = ?)
+	AND (? = '' OR tenant = ?)
+GROUP BY 1, 2, 3, 4 ORDER BY 1, 2, 3, 4;`)
+
+// Count is the number of events in the bucket starting at Time, for the
+// groups asked for.
+type Count struct {
+	Time       time.Time `json:"time"`
+	EntityType string    `json:"entity_type,omitempty"`
+	Action     string    `json:"action,omitempty"`
+	Tenant     string    `json:"tenant,omitempty"`
+	Count      int64     `json:"count"`
+}
+
+// interval is a bucket size of the roll-ups.
+type interval struct {
+	table  string
+	layout string
+	step   time.Duration
+	// span is the range served when none is given.
+	span time.Duration
+}
+
+var intervals = map[string]interval{
+	"hour": {table: "rollup_hourly", layout: hourLayout, step: time.Hour, span: 48 * time.Hour},
+	"day":  {table: "rollup_daily", layout: dayLayout, step: 24 * time.Hour, span: 30 * 24 * time.Hour},
+}
+
+func init() {
+	for _, iv := range intervals {
+		countsSQL.Register(iv.table)
+	}
+}
+
+// Counts serves event counts over time from the roll-ups, so charting
+// ingest volume never scans the events. Counts lag the events by up to the
+// roll-up interval.
+type Counts struct {
+	db *sql.DB
+}
+
+// NewCounts creates the counts handler.
+func NewCounts(db *sql.DB) *Counts {
+	return &Counts{db: db}
+}
+
+// ServeHTTP handles GET
+// /stats/events?interval=hour|day&group_by=entity_type,action,tenant&from=&to=&entity_type=&action=&tenant=.
+// The interval defaults to day. Range bounds are YYYY-MM-DD or RFC 3339
+// times, the end exclusive, and are widened to whole buckets; the range
+// defaults to the last 30 days, or 48 hours by hour. Buckets without
+// events are left out.
+func (c *Counts) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apierror.Write(w, "Only GET requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	name := q.Get("interval")
+	if name == "" {
+		name = "day"
+	}
+	iv, ok := intervals[name]
+	if !ok {
+		apierror.Write(w, "interval must be hour or day", http.StatusBadRequest)
+		return
+	}
+	groupBy := []string{}
+	var byType, byAction, byTenant bool
+	if v := q.Get("group_by"); v != "" {
+		for _, field := range strings.Split(v, ",") {
+			switch field = strings.TrimSpace(field); field {
+			case "entity_type":
+				byType = true
+			case "action":
+				byAction = true
+			case "tenant":
+				byTenant = true
+			default:
+				apierror.Write(w, fmt.Sprintf("Cannot group by %q; use entity_type, action or tenant", field), http.StatusBadRequest)
+				return
+			}
+			groupBy = append(groupBy, field)
+		}
+	}
+
+	to := time.Now().UTC()
+	if v := q.Get("to"); v != "" {
+		t, err := parseBound(v)
+		if err != nil {
+			apierror.Write(w, "Invalid to: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		to = t
+	}
+	if t := to.Truncate(iv.step); t.Before(to) {
+		to = t.Add(iv.step)
+	}
+	from := to.Add(-iv.span)
+	if v := q.Get("from"); v != "" {
+		t, err := parseBound(v)
+		if err != nil {
+			apierror.Write(w, "Invalid from: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		from = t.Truncate(iv.step)
+	}
+	if !from.Before(to) {
+		apierror.Write(w, "from is not before to", http.StatusBadRequest)
+		return
+	}
+	if to.Sub(from) > maxCountBuckets*iv.step {
+		apierror.Write(w, fmt.Sprintf("Range spans more than %d buckets; use a coarser interval", maxCountBuckets), http.StatusBadRequest)
+		return
+	}
+
+	entityType, action, tenant := q.Get("entity_type"), q.Get("action"), q.Get("tenant")
+	rows, err := c.db.Query(countsSQL.Format(iv.table), byType, byAction, byTenant,
+		from.Format(iv.layout), to.Format(iv.layout),
+		entityType, entityType, action, action, tenant, tenant)
+	if err != nil {
+		apierror.Write(w, "Failed to load stats", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	result := struct {
+		Interval string    `json:"interval"`
+		GroupBy  []string  `json:"group_by"`
+		From     time.Time `json:"from"`
+		To       time.Time `json:"to"`
+		Total    int64     `json:"total"`
+		Counts   []Count   `json:"counts"`
+	}{Interval: name, GroupBy: groupBy, From: from, To: to, Counts: []Count{}}
+	for rows.Next() {
+		var n Count
+		var bucket string
+		if err := rows.Scan(&bucket, &n.EntityType, &n.Action, &n.Tenant, &n.Count); err != nil {
+			apierror.Write(w, "Failed to load stats", http.StatusInternalServerError)
+			return
+		}
+		if n.Time, err = time.Parse(iv.layout, bucket); err != nil {
+			apierror.Write(w, "Failed to load stats", http.StatusInternalServerError)
+			return
+		}
+		result.Total += n.Count
+		result.Counts = append(result.Counts, n)
+	}
+	if err := rows.Err(); err != nil {
+		apierror.Write(w, "Failed to load stats", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, result)
+}
@@ -0,0 +1,289 @@
+package rollups
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"naevis/apierror"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultDiffTop = 10
+	maxDiffTop     = 100
+)
+
+// Diffs read the raw events and tracking hits, as the roll-ups do not
+// keep entity ids. The parameters of each statement start with the entity
+// type, the range and the tenant filter twice.
+const (
+	// diffRowsSQL is the events and tracking hits together.
+	diffRowsSQL = `(
+		SELECT entity_type, action, entity_id, tenant, created_at FROM events
+		UNION ALL
+		SELECT entity_type, action, entity_id, tenant, created_at FROM tracking_events
+	)`
+	// diffActionsSQL counts the events of each action.
+	diffActionsSQL = `
+	SELECT IFNULL(action, ''), COUNT(*) FROM ` + diffRowsSQL + `
+	WHERE entity_type = ? AND created_at >= ? AND created_at < ? AND (? = '' OR tenant = ?)
+	GROUP BY 1;`
+	// diffTopSQL lists the entities with the most events, at most the
+	// last parameter.
+	diffTopSQL = `
+	SELECT entity_id, COUNT(*) FROM ` + diffRowsSQL + `
+	WHERE entity_type = ? AND created_at >= ? AND created_at < ? AND (? = '' OR tenant = ?)
+	GROUP BY entity_id ORDER BY 2 DESC, 1 LIMIT ?;`
+	// diffEntitiesSQL counts the events of the entities in the JSON array
+	// of the last parameter.
+	diffEntitiesSQL = `
+	SELECT entity_id, COUNT(*) FROM ` + diffRowsSQL + `
+	WHERE entity_type = ? AND created_at >= ? AND created_at < ? AND (? = '' OR tenant = ?)
+		AND entity_id IN (SELECT value FROM json_each(?))
+	GROUP BY entity_id;`
+)
+
+// Period is one of the time ranges compared by a diff. To is exclusive.
+type Period struct {
+	From    time.Time `json:"from"`
+	To      time.Time `json:"to"`
+	Events  int64     `json:"events"`
+	PerHour float64   `json:"per_hour"`
+}
+
+// hours is the length of the period in hours.
+func (p Period) hours() float64 {
+	return p.To.Sub(p.From).Hours()
+}
+
+// Change compares the events of an action or entity in both periods.
+// ChangePct compares their hourly rates, so periods of different lengths
+// compare fairly, and is omitted when the first period has none.
+type Change struct {
+	Key       string   `json:"key,omitempty"`
+	Range1    int64    `json:"range1"`
+	Range2    int64    `json:"range2"`
+	Change    int64    `json:"change"`
+	ChangePct *float64 `json:"change_pct,omitempty"`
+}
+
+// DiffReport summarizes how an entity type's events differ between two
+// periods.
+type DiffReport struct {
+	EntityType  string   `json:"entity_type"`
+	Tenant      string   `json:"tenant,omitempty"`
+	Range1      Period   `json:"range1"`
+	Range2      Period   `json:"range2"`
+	Volume      Change   `json:"volume"`
+	Actions     []Change `json:"actions"`
+	TopEntities []Change `json:"top_entities"`
+}
+
+// Diff compares the events of an entity type in two periods, such as
+// before and after a deploy.
+type Diff struct {
+	db *sql.DB
+}
+
+// NewDiff creates the diff handler.
+func NewDiff(db *sql.DB) *Diff {
+	return &Diff{db: db}
+}
+
+// ServeHTTP handles GET
+// /admin/diff?type=ENTITY_TYPE&range1=START/END&range2=START/END&tenant=&top=N.
+// Range bounds are YYYY-MM-DD or RFC 3339 times, the end exclusive. The
+// report compares the volume, the actions and the top N entities of
+// either range.
+func (d *Diff) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apierror.Write(w, "Only GET requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	entityType := q.Get("type")
+	if entityType == "" {
+		apierror.Write(w, "Missing type parameter", http.StatusBadRequest)
+		return
+	}
+	var ranges [2]Period
+	for i, name := range []string{"range1", "range2"} {
+		from, to, err := parseRange(q.Get(name))
+		if err != nil {
+			apierror.Write(w, fmt.Sprintf("Invalid %s: %v", name, err), http.StatusBadRequest)
+			return
+		}
+		ranges[i] = Period{From: from, To: to}
+	}
+	top := int64(defaultDiffTop)
+	if v := q.Get("top"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			apierror.Write(w, "Invalid top", http.StatusBadRequest)
+			return
+		}
+		top = min(n, maxDiffTop)
+	}
+
+	report, err := d.Report(entityType, q.Get("tenant"), ranges[0], ranges[1], top)
+	if err != nil {
+		apierror.Write(w, "Failed to compare events", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, report)
+}
+
+// parseRange parses START/END.
+func parseRange(s string) (time.Time, time.Time, error) {
+	start, end, ok := strings.Cut(s, "/")
+	if !ok {
+		return time.Time{}, time.Time{}, errors.New("want START/END")
+	}
+	from, err := parseBound(start)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	to, err := parseBound(end)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, errors.New("start is not before end")
+	}
+	return from, to, nil
+}
+
+func parseBound(s string) (time.Time, error) {
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is not YYYY-MM-DD or an RFC 3339 time", s)
+	}
+	return t.UTC(), nil
+}
+
+// Report compares the events of entityType, of one tenant or of all when
+// tenant is empty, in the periods p1 and p2. Their counts are filled in.
+func (d *Diff) Report(entityType, tenant string, p1, p2 Period, top int64) (DiffReport, error) {
+	report := DiffReport{EntityType: entityType, Tenant: tenant, Actions: []Change{}, TopEntities: []Change{}}
+	periods := []*Period{&p1, &p2}
+	args := func(p *Period, more ...any) []any {
+		from, to := p.From.Format(time.DateTime), p.To.Format(time.DateTime)
+		return append([]any{entityType, from, to, tenant, tenant}, more...)
+	}
+
+	// Actions, and the volume as their sum.
+	var actions [2]map[string]int64
+	for i, p := range periods {
+		n, err := counts(d.db.Query(diffActionsSQL, args(p)...))
+		if err != nil {
+			return report, err
+		}
+		actions[i] = n
+		for _, c := range n {
+			p.Events += c
+		}
+		p.PerHour = float64(p.Events) / p.hours()
+	}
+	report.Range1, report.Range2 = p1, p2
+	report.Volume = change("", p1.Events, p2.Events, p1, p2)
+	report.Actions = changes(actions, p1, p2)
+
+	// The top entities of either period, counted in both.
+	seen := map[string]bool{}
+	var ids []string
+	for _, p := range periods {
+		n, err := counts(d.db.Query(diffTopSQL, args(p, top)...))
+		if err != nil {
+			return report, err
+		}
+		for id := range n {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return report, nil
+	}
+	list, err := json.Marshal(ids)
+	if err != nil {
+		return report, err
+	}
+	var entities [2]map[string]int64
+	for i, p := range periods {
+		if entities[i], err = counts(d.db.Query(diffEntitiesSQL, args(p, string(list))...)); err != nil {
+			return report, err
+		}
+	}
+	report.TopEntities = changes(entities, p1, p2)
+	return report, nil
+}
+
+// counts reads the keys and counts a query returns.
+func counts(rows *sql.Rows, err error) (map[string]int64, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[string]int64{}
+	for rows.Next() {
+		var key string
+		var n int64
+		if err := rows.Scan(&key, &n); err != nil {
+			return nil, err
+		}
+		counts[key] = n
+	}
+	return counts, rows.Err()
+}
+
+// changes compares the counts of every key of either period, largest
+// changes first.
+func changes(counts [2]map[string]int64, p1, p2 Period) []Change {
+	keys := map[string]bool{}
+	for _, c := range counts {
+		for key := range c {
+			keys[key] = true
+		}
+	}
+	out := make([]Change, 0, len(keys))
+	for key := range keys {
+		out = append(out, change(key, counts[0][key], counts[1][key], p1, p2))
+	}
+	sort.Slice(out, func(i, j int) bool {
+		a, b := abs(out[i].Change), abs(out[j].Change)
+		if a != b {
+			return a > b
+		}
+		return out[i].Key < out[j].Key
+	})
+	return out
+}
+
+func change(key string, n1, n2 int64, p1, p2 Period) Change {
+	c := Change{Key: key, Range1: n1, Range2: n2, Change: n2 - n1}
+	if n1 > 0 {
+		rate1, rate2 := float64(n1)/p1.hours(), float64(n2)/p2.hours()
+		pct := math.Round((rate2-rate1)/rate1*1000) / 10
+		c.ChangePct = &pct
+	}
+	return c
+}
+
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,225 @@
+package rollups
+
+import (
+	"database/sql"
+	"encoding/json"
+	"naevis/apierror"
+	"naevis/ingest"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// dayLayout is the bucket format of rollup_daily.
+const dayLayout = "2006-01-02"
+
+// hourlySeriesSQL and dailySeriesSQL sum a target per bucket of each
+// roll-up table. Their parameters are the range, then the entity type,
+// action and tenant filters, each twice.
+const (
+	hourlySeriesSQL = `
+	SELECT bucket, SUM(count) FROM rollup_hourly
+	WHERE bucket >= ? AND bucket <= ?
+		AND (? = '' OR entity_type = ?)
+		AND (? = '' OR action = ?)
+		AND (? = '' OR tenant = ?)
+	GROUP BY bucket ORDER BY bucket;`
+	dailySeriesSQL = `
+	SELECT bucket, SUM(count) FROM rollup_daily
+	WHERE bucket >= ? AND bucket <= ?
+		AND (? = '' OR entity_type = ?)
+		AND (? = '' OR action = ?)
+		AND (? = '' OR tenant = ?)
+	GROUP BY bucket ORDER BY bucket;`
+)
+
+// Grafana serves the roll-up tables using the SimpleJSON datasource contract
+// (also understood by the Infinity and JSON datasource plugins).
+//
+// Targets are ingest.AllTypes, "*", for the overall total, "{entity_type}"
+// or "{entity_type}/{action}". No entity type can be "*", so the total
+// never hides a type. A "tenant" ad hoc filter narrows any target.
+type Grafana struct {
+	db *sql.DB
+}
+
+// NewGrafana creates the Grafana datasource handlers.
+func NewGrafana(db *sql.DB) *Grafana {
+	return &Grafana{db: db}
+}
+
+type grafanaQuery struct {
+	Range struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	} `json:"range"`
+	IntervalMs int64 `json:"intervalMs"`
+	Targets    []struct {
+		Target string `json:"target"`
+	} `json:"targets"`
+	AdhocFilters []struct {
+		Key      string `json:"key"`
+		Operator string `json:"operator"`
+		Value    string `json:"value"`
+	} `json:"adhocFilters"`
+}
+
+type grafanaSeries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+// ServeHTTP routes /grafana/{search,query,annotations,tag-keys,tag-values}.
+// The bare /grafana/ path answers the datasource connection test.
+func (g *Grafana) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch strings.TrimPrefix(r.URL.Path, "/grafana") {
+	case "", "/":
+		w.WriteHeader(http.StatusOK)
+	case "/search":
+		g.search(w, r)
+	case "/query":
+		g.query(w, r)
+	case "/annotations":
+		writeJSON(w, []struct{}{})
+	case "/tag-keys":
+		writeJSON(w, []map[string]string{{"type": "string", "text": "tenant"}})
+	case "/tag-values":
+		g.tagValues(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// search lists the available targets.
+func (g *Grafana) search(w http.ResponseWriter, r *http.Request) {
+	rows, err := g.db.Query(`
+	SELECT DISTINCT entity_type, action FROM event_totals ORDER BY entity_type, action;`)
+	if err != nil {
+		apierror.Write(w, "Failed to list metrics", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	targets := []string{ingest.AllTypes}
+	seen := make(map[string]bool)
+	for rows.Next() {
+		var entityType, action string
+		if err := rows.Scan(&entityType, &action); err != nil {
+			apierror.Write(w, "Failed to list metrics", http.StatusInternalServerError)
+			return
+		}
+		if !seen[entityType] {
+			seen[entityType] = true
+			targets = append(targets, entityType)
+		}
+		targets = append(targets, entityType+"/"+action)
+	}
+	writeJSON(w, targets)
+}
+
+// query returns one time series per requested target. Intervals of a day
+// or more are served from rollup_daily, anything finer from rollup_hourly.
+func (g *Grafana) query(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		apierror.Write(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var q grafanaQuery
+	if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+		apierror.WriteCode(w, apierror.CodeInvalidJSON, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	daily := q.IntervalMs >= int64(24*time.Hour/time.Millisecond)
+
+	var tenant string
+	for _, f := range q.AdhocFilters {
+		if f.Key == "tenant" && f.Operator == "=" {
+			tenant = f.Value
+		}
+	}
+
+	series := []grafanaSeries{}
+	for _, t := range q.Targets {
+		s, err := g.series(daily, t.Target, tenant, q.Range.From, q.Range.To)
+		if err != nil {
+			apierror.Write(w, "Failed to query roll-ups", http.StatusInternalServerError)
+			return
+		}
+		series = append(series, s)
+	}
+	writeJSON(w, series)
+}
+
+// series sums target per bucket of rollup_daily when daily is set,
+// otherwise of rollup_hourly.
+func (g *Grafana) series(daily bool, target, tenant string, from, to time.Time) (grafanaSeries, error) {
+	entityType, action, _ := strings.Cut(target, "/")
+	if target == ingest.AllTypes {
+		entityType = ""
+	}
+
+	var rows *sql.Rows
+	var err error
+	layout := hourLayout
+	if daily {
+		layout = dayLayout
+		rows, err = g.db.Query(dailySeriesSQL, from.UTC().Format(layout), to.UTC().Format(layout),
+			entityType, entityType, action, action, tenant, tenant)
+	} else {
+		rows, err = g.db.Query(hourlySeriesSQL, from.UTC().Format(layout), to.UTC().Format(layout),
+			entityType, entityType, action, action, tenant, tenant)
+	}
+	if err != nil {
+		return grafanaSeries{}, err
+	}
+	defer rows.Close()
+
+	s := grafanaSeries{Target: target, Datapoints: [][2]float64{}}
+	for rows.Next() {
+		var bucket string
+		var count int64
+		if err := rows.Scan(&bucket, &count); err != nil {
+			return grafanaSeries{}, err
+		}
+		ts, err := time.Parse(layout, bucket)
+		if err != nil {
+			return grafanaSeries{}, err
+		}
+		s.Datapoints = append(s.Datapoints, [2]float64{float64(count), float64(ts.UnixMilli())})
+	}
+	return s, rows.Err()
+}
+
+// tagValues lists the tenants with events.
+func (g *Grafana) tagValues(w http.ResponseWriter, r *http.Request) {
+	rows, err := g.db.Query(`SELECT DISTINCT tenant FROM event_totals WHERE tenant != '' ORDER BY tenant;`)
+	if err != nil {
+		apierror.Write(w, "Failed to list tenants", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	values := []map[string]string{}
+	for rows.Next() {
+		var tenant string
+		if err := rows.Scan(&tenant); err != nil {
+			apierror.Write(w, "Failed to list tenants", http.StatusInternalServerError)
+			return
+		}
+		values = append(values, map[string]string{"text": tenant})
+	}
+	writeJSON(w, values)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	response, err := json.Marshal(v)
+	if err != nil {
+		apierror.Write(w, "Error encoding JSON", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
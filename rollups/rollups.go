@@ -0,0 +1,133 @@
+package rollups
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"naevis/routing"
+	"naevis/sqlguard"
+	"strings"
+	"time"
+)
+
+// hourLayout is the bucket format of rollup_hourly.
+const hourLayout = "2006-01-02 15:00:00"
+
+// settleDelay keeps the watermark behind batched writers such as the
+// tracking fast path, so late rows still land in a recomputed bucket.
+const settleDelay = time.Minute
+
+// hourlySQL recomputes the hourly buckets from the watermark ?1. Events
+// are grouped by their interned ids, and only the groups are joined with
+// the dictionary. The hints pin the covering indexes, which keep the scans
+// proportional to the rows since the watermark. %s is eventGroupsSQL for
+// every schema events are stored in.
+var hourlySQL = sqlguard.NewTemplate(`
+INSERT INTO rollup_hourly (bucket, entity_type, action, tenant, count)
+SELECT bucket, entity_type, action, tenant, SUM(n)
+FROM (
+	SELECT e.bucket, IFNULL(et.value, '') AS entity_type, IFNULL(a.value, '') AS action, e.tenant, e.n
+	FROM (
+		%s
+	) e
+	LEFT JOIN dictionary et ON et.id = e.entity_type_id
+	LEFT JOIN dictionary a ON a.id = e.action_id
+	UNION ALL
+	SELECT strftime('%%Y-%%m-%%d %%H:00:00', created_at), IFNULL(entity_type, ''), IFNULL(action, ''), tenant, COUNT(*)
+	FROM tracking_events INDEXED BY tracking_events_created WHERE created_at >= ?1
+	GROUP BY 1, 2, 3, 4
+)
+GROUP BY 1, 2, 3, 4;`)
+
+// eventGroupsSQL groups the events of the schema %s by hour.
+const eventGroupsSQL = `SELECT strftime('%%Y-%%m-%%d %%H:00:00', created_at) AS bucket, entity_type_id, action_id, tenant, COUNT(*) AS n
+		FROM %s.event_rows INDEXED BY event_rows_created WHERE created_at >= ?1
+		GROUP BY 1, 2, 3, 4`
+
+// Job maintains the rollup_hourly and rollup_daily tables from the raw
+// events and tracking_events tables.
+type Job struct {
+	db *sql.DB
+	// groups is the argument of hourlySQL.
+	groups string
+}
+
+// NewJob creates a roll-up job for the schemas attached so far, before the
+// SQL guard is sealed.
+func NewJob(db *sql.DB) *Job {
+	var groups []string
+	for _, schema := range routing.Schemas() {
+		groups = append(groups, fmt.Sprintf(eventGroupsSQL, schema))
+	}
+	j := &Job{db: db, groups: strings.Join(groups, "\n\t\tUNION ALL\n\t\t")}
+	hourlySQL.Register(j.groups)
+	return j
+}
+
+// Run refreshes the roll-ups every interval until ctx is cancelled.
+func (j *Job) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := j.Refresh(); err != nil {
+			log.Printf("Error refreshing roll-ups: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Refresh recomputes every hourly bucket at or after the stored watermark
+// and the daily buckets covering them. Older buckets are never touched, so
+// they survive pruning of the raw rows.
+func (j *Job) Refresh() error {
+	tx, err := j.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var from string
+	err = tx.QueryRow(`SELECT value FROM job_state WHERE name = 'rollups';`).Scan(&from)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM rollup_hourly WHERE bucket >= ?;`, from); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(hourlySQL.Format(j.groups), from); err != nil {
+		return err
+	}
+
+	day := from
+	if len(day) > 10 {
+		day = day[:10]
+	}
+	if _, err := tx.Exec(`DELETE FROM rollup_daily WHERE bucket >= ?;`, day); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+	INSERT INTO rollup_daily (bucket, entity_type, action, tenant, count)
+	SELECT substr(bucket, 1, 10), entity_type, action, tenant, SUM(count)
+	FROM rollup_hourly
+	WHERE bucket >= ?
+	GROUP BY 1, 2, 3, 4;`, day); err != nil {
+		return err
+	}
+
+	watermark := time.Now().UTC().Add(-settleDelay).Format(hourLayout)
+	if _, err := tx.Exec(`
+	INSERT INTO job_state (name, value) VALUES ('rollups', ?)
+	ON CONFLICT(name) DO UPDATE SET value = excluded.value;`, watermark); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
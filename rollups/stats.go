@@ -0,0 +1,68 @@
+package rollups
+
+import (
+	"database/sql"
+	"naevis/apierror"
+	"net/http"
+)
+
+// totalsSQL lists event_totals. Its parameters are the entity type,
+// action and tenant filters, each twice.
+const totalsSQL = `
+SELECT entity_type, action, tenant, count FROM event_totals
+WHERE (? = '' OR entity_type = ?)
+	AND (? = '' OR action = ?)
+	AND (? = '' OR tenant = ?)
+ORDER BY entity_type, action, tenant;`
+
+// Total is the number of events stored for an entity type, action and
+// tenant.
+type Total struct {
+	EntityType string `json:"entity_type"`
+	Action     string `json:"action"`
+	Tenant     string `json:"tenant"`
+	Count      int64  `json:"count"`
+}
+
+// Stats serves the all-time event totals, which are kept current on
+// insert and so never scan the events.
+type Stats struct {
+	db *sql.DB
+}
+
+// NewStats creates the stats handler.
+func NewStats(db *sql.DB) *Stats {
+	return &Stats{db: db}
+}
+
+// ServeHTTP handles GET /stats?entity_type=&action=&tenant=.
+func (s *Stats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apierror.Write(w, "Only GET requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	entityType, action, tenant := q.Get("entity_type"), q.Get("action"), q.Get("tenant")
+
+	rows, err := s.db.Query(totalsSQL, entityType, entityType, action, action, tenant, tenant)
+	if err != nil {
+		apierror.Write(w, "Failed to load stats", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	result := struct {
+		Total  int64   `json:"total"`
+		Totals []Total `json:"totals"`
+	}{Totals: []Total{}}
+	for rows.Next() {
+		var t Total
+		if err := rows.Scan(&t.EntityType, &t.Action, &t.Tenant, &t.Count); err != nil {
+			apierror.Write(w, "Failed to load stats", http.StatusInternalServerError)
+			return
+		}
+		result.Total += t.Count
+		result.Totals = append(result.Totals, t)
+	}
+	writeJSON(w, result)
+}
@@ -0,0 +1,249 @@
+// Package routing stores the events of chosen entity types in their own
+// SQLite files, so a busy entity type's writes, index maintenance and
+// checkpoints do not contend with the main database. Each file is attached
+// to every connection under its name and holds its own event_rows,
+// event_totals, events_fts, search_terms, entity_names and
+// event_locations; dictionary and event_attachments stay in the main
+// database. Per-connection TEMP views named events and event_totals shadow
+// the main ones and union every file, so readers see all events. Writers use Schema to find the file of an entity type.
+package routing
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"hash/fnv"
+	"naevis/config"
+	"naevis/sqlguard"
+	"regexp"
+	"strings"
+
+	"modernc.org/sqlite"
+)
+
+// Main is the schema of the main database.
+const Main = "main"
+
+// idShift places each database's event ids in its own range, so ids stay
+// unique across databases: ids of a database start at its base, a
+// multiple of 1<<idShift derived from its name.
+const idShift = 47
+
+var validName = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// reserved are the schema names routed databases cannot take.
+var reserved = map[string]bool{Main: true, "temp": true, "cold": true}
+
+var (
+	schemas = []string{Main}
+	byType  = make(map[string]string)
+)
+
+// schema is the part of the main schema each routed database has, and
+// must gain the columns later added to event_rows. Triggers cannot reach
+// other databases, so its event_totals counts interned ids and the totals
+// view joins the strings in.
+var schema = []string{
+	`CREATE TABLE IF NOT EXISTS %[1]s.event_rows (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		entity_type_id INTEGER,
+		action_id INTEGER,
+		entity_id TEXT,
+		item_id TEXT,
+		item_type_id INTEGER,
+		additional_info TEXT,
+		created_at DATETIME,
+		tenant TEXT NOT NULL DEFAULT '',
+		user_id INTEGER
+	);`,
+	`CREATE INDEX IF NOT EXISTS %[1]s.event_rows_user ON event_rows (user_id, created_at);`,
+	`CREATE INDEX IF NOT EXISTS %[1]s.event_rows_entity_type ON event_rows (entity_type_id, id);`,
+	`CREATE INDEX IF NOT EXISTS %[1]s.event_rows_created ON event_rows (created_at, entity_type_id, action_id, tenant);`,
+	`CREATE TABLE IF NOT EXISTS %[1]s.event_totals (
+		entity_type_id INTEGER NOT NULL,
+		action_id INTEGER NOT NULL,
+		tenant TEXT NOT NULL,
+		count INTEGER NOT NULL,
+		PRIMARY KEY (entity_type_id, action_id, tenant)
+	);`,
+	`CREATE TRIGGER IF NOT EXISTS %[1]s.event_rows_totals AFTER INSERT ON event_rows BEGIN
+		INSERT INTO event_totals (entity_type_id, action_id, tenant, count)
+		VALUES (IFNULL(NEW.entity_type_id, 0), IFNULL(NEW.action_id, 0), NEW.tenant, 1)
+		ON CONFLICT (entity_type_id, action_id, tenant) DO UPDATE SET count = count + 1;
+	END;`,
+	`CREATE VIRTUAL TABLE IF NOT EXISTS %[1]s.events_fts USING fts5(
+		name, description, additional_info,
+		entity_type UNINDEXED, entity_id UNINDEXED, tenant UNINDEXED,
+		tokenize = 'porter unicode61'
+	);`,
+	`CREATE TRIGGER IF NOT EXISTS %[1]s.event_rows_fts AFTER DELETE ON event_rows BEGIN
+		DELETE FROM events_fts WHERE rowid = OLD.id;
+	END;`,
+	`CREATE TABLE IF NOT EXISTS %[1]s.entity_names (
+		entity_type TEXT NOT NULL,
+		tenant TEXT NOT NULL,
+		entity_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		key TEXT NOT NULL,
+		events INTEGER NOT NULL,
+		event_id INTEGER NOT NULL,
+		PRIMARY KEY (entity_type, tenant, entity_id)
+	);`,
+	`CREATE INDEX IF NOT EXISTS %[1]s.entity_names_key ON entity_names (entity_type, tenant, key);`,
+	`CREATE TABLE IF NOT EXISTS %[1]s.search_terms (
+		term TEXT PRIMARY KEY,
+		length INTEGER NOT NULL,
+		uses INTEGER NOT NULL
+	);`,
+	`CREATE INDEX IF NOT EXISTS %[1]s.search_terms_length ON search_terms (length, term, uses);`,
+	`CREATE TRIGGER IF NOT EXISTS %[1]s.event_rows_names AFTER DELETE ON event_rows BEGIN
+		DELETE FROM entity_names WHERE event_id = OLD.id;
+	END;`,
+	`CREATE TABLE IF NOT EXISTS %[1]s.event_locations (
+		event_id INTEGER PRIMARY KEY,
+		latitude REAL NOT NULL,
+		longitude REAL NOT NULL
+	);`,
+	`CREATE INDEX IF NOT EXISTS %[1]s.event_locations_position ON event_locations (latitude, longitude);`,
+	`CREATE TRIGGER IF NOT EXISTS %[1]s.event_rows_locations AFTER DELETE ON event_rows BEGIN
+		DELETE FROM event_locations WHERE event_id = OLD.id;
+	END;`,
+}
+
+// seedSQL starts the ids of a new routed database at its base.
+const seedSQL = `INSERT INTO %s.sqlite_sequence (name, seq) VALUES ('event_rows', %d);`
+
+// Attach attaches dbs to every connection of guarded databases opened
+// afterwards, creating their schema, and routes their entity types to
+// them. Call it before initdb.InitDB.
+func Attach(dbs []config.Database) error {
+	bases := make(map[int64]string)
+	names := make(map[string]bool)
+	for _, d := range dbs {
+		switch {
+		case !validName.MatchString(d.Name) || reserved[d.Name] || names[d.Name]:
+			return fmt.Errorf("database %q: invalid name", d.Name)
+		case d.Path == "":
+			return fmt.Errorf("database %s: missing path", d.Name)
+		}
+		base := idBase(d.Name)
+		if other, ok := bases[base]; ok {
+			return fmt.Errorf("databases %s and %s share an id range; rename one", other, d.Name)
+		}
+		bases[base] = d.Name
+		names[d.Name] = true
+		for _, entityType := range d.EntityTypes {
+			if other, ok := byType[entityType]; ok {
+				return fmt.Errorf("entity type %s is routed to both %s and %s", entityType, other, d.Name)
+			}
+			byType[entityType] = d.Name
+		}
+		schemas = append(schemas, d.Name)
+		sqlguard.AddSchema(d.Name)
+	}
+	if len(dbs) == 0 {
+		return nil
+	}
+
+	views := views(schemas[1:])
+	sqlguard.RegisterConnectionHook(func(conn sqlite.ExecQuerierContext, _ string) error {
+		ctx := context.Background()
+		for _, d := range dbs {
+			if _, err := conn.ExecContext(ctx, fmt.Sprintf(`ATTACH DATABASE ? AS %s;`, d.Name),
+				[]driver.NamedValue{{Ordinal: 1, Value: d.Path}}); err != nil {
+				return err
+			}
+			if err := createSchema(ctx, conn, d.Name); err != nil {
+				return fmt.Errorf("database %s: %v", d.Name, err)
+			}
+		}
+		for _, stmt := range views {
+			if _, err := conn.ExecContext(ctx, stmt, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return nil
+}
+
+// createSchema creates the schema of the routed database name where
+// missing. Only a new database is written to, so opening a connection
+// does not wait for writers.
+func createSchema(ctx context.Context, conn sqlite.ExecQuerierContext, name string) error {
+	rows, err := conn.QueryContext(ctx, fmt.Sprintf(`SELECT COUNT(*) FROM %s.sqlite_master WHERE name = 'event_rows';`, name), nil)
+	if err != nil {
+		return err
+	}
+	dest := make([]driver.Value, 1)
+	err = rows.Next(dest)
+	rows.Close()
+	if err != nil {
+		return err
+	}
+	existed := dest[0].(int64) > 0
+
+	for _, stmt := range schema {
+		if _, err := conn.ExecContext(ctx, fmt.Sprintf(stmt, name), nil); err != nil {
+			return err
+		}
+	}
+	if !existed {
+		_, err = conn.ExecContext(ctx, fmt.Sprintf(seedSQL, name, idBase(name)), nil)
+	}
+	return err
+}
+
+// views returns the TEMP views over the main database and the routed ones.
+func views(routed []string) []string {
+	events := []string{`SELECT id, entity_type, action, entity_id, item_id, item_type, additional_info, created_at, tenant, user_id FROM main.events`}
+	totals := []string{`SELECT entity_type, action, tenant, count FROM main.event_totals`}
+	for _, s := range routed {
+		events = append(events, fmt.Sprintf(`SELECT r.id, et.value, a.value, r.entity_id, r.item_id, it.value, r.additional_info, r.created_at, r.tenant, r.user_id
+		FROM %s.event_rows r
+		LEFT JOIN main.dictionary et ON et.id = r.entity_type_id
+		LEFT JOIN main.dictionary a ON a.id = r.action_id
+		LEFT JOIN main.dictionary it ON it.id = r.item_type_id`, s))
+		totals = append(totals, fmt.Sprintf(`SELECT IFNULL(et.value, ''), IFNULL(a.value, ''), t.tenant, t.count
+		FROM %s.event_totals t
+		LEFT JOIN main.dictionary et ON et.id = t.entity_type_id
+		LEFT JOIN main.dictionary a ON a.id = t.action_id`, s))
+	}
+	return []string{
+		`CREATE TEMP VIEW IF NOT EXISTS events AS ` + strings.Join(events, "\nUNION ALL\n") + `;`,
+		`CREATE TEMP VIEW IF NOT EXISTS event_totals AS
+		SELECT entity_type, action, tenant, SUM(count) AS count FROM (` + strings.Join(totals, "\nUNION ALL\n") + `)
+		GROUP BY 1, 2, 3;`,
+	}
+}
+
+// idBase is the first event id of the routed database name.
+func idBase(name string) int64 {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return int64(h.Sum32()%(1<<15-1)+1) << idShift
+}
+
+// Schema returns the schema storing the events of entityType.
+func Schema(entityType string) string {
+	if s, ok := byType[entityType]; ok {
+		return s
+	}
+	return Main
+}
+
+// Schemas returns the main schema followed by the routed ones.
+func Schemas() []string {
+	return schemas
+}
+
+// SchemaOf returns the schema storing the event id, found from the id
+// range it falls in.
+func SchemaOf(id int64) string {
+	for _, s := range schemas[1:] {
+		if id>>idShift == idBase(s)>>idShift {
+			return s
+		}
+	}
+	return Main
+}
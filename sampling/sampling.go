@@ -0,0 +1,184 @@
+package sampling
+
+import (
+	"database/sql"
+	"log"
+	"naevis/config"
+	"naevis/structs"
+	"sync"
+	"time"
+)
+
+// flushInterval is how often in-memory counts are added to event_counters.
+const flushInterval = time.Second
+
+type key struct {
+	entityType string
+	action     string
+}
+
+// counts tracks how many events were seen and how many were kept.
+type counts struct {
+	seen   int64
+	stored int64
+}
+
+// Sampler decides which events are stored. Every event stored or sampled
+// out is counted, so the totals in event_counters stay exact even for
+// sampled types. Events kept but then refused or failing to store are
+// not counted.
+type Sampler struct {
+	db    *sql.DB
+	rules map[key]int
+
+	mu      sync.Mutex
+	seq     map[key]int64
+	pending map[key]*counts
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// New creates a Sampler for the given rules and starts its counter flusher.
+func New(db *sql.DB, rules []config.SampleRule) *Sampler {
+	s := &Sampler{
+		db:      db,
+		rules:   make(map[key]int),
+		seq:     make(map[key]int64),
+		pending: make(map[key]*counts),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	for _, r := range rules {
+		if r.Rate > 1 {
+			s.rules[key{r.EntityType, r.Action}] = r.Rate
+		}
+	}
+	go s.run()
+	return s
+}
+
+// rate returns the sampling rate for an event, preferring an exact
+// entity_type/action rule over an entity_type-wide one.
+func (s *Sampler) rate(k key) int {
+	if n, ok := s.rules[k]; ok {
+		return n
+	}
+	if n, ok := s.rules[key{k.entityType, ""}]; ok {
+		return n
+	}
+	return 1
+}
+
+// Keep reports whether the event should be stored. An event sampled out
+// is counted as seen; one kept is counted by Stored once it is stored.
+func (s *Sampler) Keep(event structs.Index) bool {
+	k := key{event.EntityType, event.Action}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := s.seq[k]
+	s.seq[k] = n + 1
+	if n%int64(s.rate(k)) != 0 {
+		s.count(k).seen++
+		return false
+	}
+	return true
+}
+
+// Stored counts an event that Keep kept as seen and stored.
+func (s *Sampler) Stored(event structs.Index) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.count(key{event.EntityType, event.Action})
+	c.seen++
+	c.stored++
+}
+
+// count returns the pending counts of k. s.mu must be held.
+func (s *Sampler) count(k key) *counts {
+	c := s.pending[k]
+	if c == nil {
+		c = &counts{}
+		s.pending[k] = c
+	}
+	return c
+}
+
+// Close writes any outstanding counts and stops the flusher.
+func (s *Sampler) Close() {
+	close(s.stop)
+	<-s.done
+}
+
+func (s *Sampler) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.stop:
+			s.flush()
+			return
+		}
+	}
+}
+
+// flush adds the pending counts to event_counters. Counts that fail to
+// write are merged back so they are retried on the next flush.
+func (s *Sampler) flush() {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = make(map[key]*counts)
+	s.mu.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+
+	if err := s.write(pending); err != nil {
+		log.Printf("Error flushing event counters: %v", err)
+		s.mu.Lock()
+		for k, c := range pending {
+			if cur := s.pending[k]; cur != nil {
+				cur.seen += c.seen
+				cur.stored += c.stored
+			} else {
+				s.pending[k] = c
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *Sampler) write(pending map[key]*counts) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+	INSERT INTO event_counters (entity_type, action, seen, stored)
+	VALUES (?, ?, ?, ?)
+	ON CONFLICT(entity_type, action) DO UPDATE SET
+		seen = seen + excluded.seen,
+		stored = stored + excluded.stored;`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for k, c := range pending {
+		if _, err := stmt.Exec(k.entityType, k.action, c.seen, c.stored); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
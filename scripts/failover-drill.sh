@@ -0,0 +1,53 @@
+#!/bin/sh
+# Fail over to a warm standby and measure the RPO and RTO. See
+# docs/standby.md.
+#
+# Usage: ADMIN_TOKEN=... failover-drill.sh STANDBY_URL [STOP_PRIMARY_COMMAND]
+#
+# With STOP_PRIMARY_COMMAND, the primary is stopped with it and the drill
+# waits for the standby to promote itself (standby.promote_after must be
+# set); otherwise the standby is promoted through the admin API.
+set -eu
+
+standby=${1:?usage: failover-drill.sh STANDBY_URL [STOP_PRIMARY_COMMAND]}
+stop=${2:-}
+: "${ADMIN_TOKEN:?set ADMIN_TOKEN to an admin access token of the standby}"
+
+api() {
+	curl -sk --fail-with-body -H "Authorization: Bearer $ADMIN_TOKEN" "$@"
+}
+
+status() {
+	api "$standby/admin/standby"
+}
+
+field() {
+	sed -n "s/.*\"$1\":\([^,}]*\).*/\1/p" | tr -d '"'
+}
+
+before=$(status)
+if [ "$(echo "$before" | field role)" != standby ]; then
+	echo "$standby is not a standby: $before" >&2
+	exit 1
+fi
+echo "Before: $before"
+lag=$(echo "$before" | field lag_seconds)
+
+start=$(date +%s)
+if [ -n "$stop" ]; then
+	echo "Stopping the primary: $stop"
+	sh -c "$stop"
+else
+	api -X POST "$standby/admin/standby/promote" >/dev/null
+fi
+
+while [ "$(status | field role)" != primary ]; do
+	sleep 1
+done
+end=$(date +%s)
+
+after=$(status)
+behind=$(echo "$after" | field behind)
+echo "After: $after"
+echo "RPO: $behind changes not applied, ${lag}s since the standby last caught up"
+echo "RTO: $((end - start))s until the standby accepted writes"
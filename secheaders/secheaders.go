@@ -0,0 +1,117 @@
+package secheaders
+
+import (
+	"naevis/config"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// builtin are the hardened defaults per route group. "" applies to every
+// route; the API only serves JSON and plain text, so nothing needs to run
+// scripts or be framed.
+var builtin = map[string]map[string]string{
+	"": {
+		"X-Content-Type-Options":  "nosniff",
+		"Referrer-Policy":         "no-referrer",
+		"Content-Security-Policy": "default-src 'none'; frame-ancestors 'none'",
+	},
+	// The admin API must never be framed or cached by a shared cache.
+	"/admin/": {
+		"X-Frame-Options": "DENY",
+		"Cache-Control":   "no-store",
+	},
+	// Attachments are embedded by other sites, but an uploaded HTML or
+	// SVG file must not run script on this origin when opened directly.
+	"/blobs/": {
+		"Content-Security-Policy":      "default-src 'none'; img-src 'self'; media-src 'self'; style-src 'unsafe-inline'; sandbox",
+		"Cross-Origin-Resource-Policy": "cross-origin",
+	},
+	// The tracking pixel is embedded in pages and emails everywhere.
+	"/t": {
+		"Cross-Origin-Resource-Policy": "cross-origin",
+	},
+}
+
+type group struct {
+	route   string
+	headers map[string]string
+}
+
+// Policy sets security headers on responses by route group.
+type Policy struct {
+	groups []group
+	hsts   string
+}
+
+// New creates a Policy from the built-in groups with cfg.Routes applied
+// on top of them.
+func New(cfg config.Headers) *Policy {
+	merged := make(map[string]map[string]string)
+	for _, routes := range []map[string]map[string]string{builtin, cfg.Routes} {
+		for route, headers := range routes {
+			if merged[route] == nil {
+				merged[route] = make(map[string]string)
+			}
+			for name, value := range headers {
+				merged[route][http.CanonicalHeaderKey(name)] = value
+			}
+		}
+	}
+
+	p := &Policy{}
+	for route, headers := range merged {
+		p.groups = append(p.groups, group{route: route, headers: headers})
+	}
+	// Shorter routes first, so more specific groups override them.
+	sort.Slice(p.groups, func(i, j int) bool {
+		if len(p.groups[i].route) != len(p.groups[j].route) {
+			return len(p.groups[i].route) < len(p.groups[j].route)
+		}
+		return p.groups[i].route < p.groups[j].route
+	})
+	if secs := int64(cfg.HSTSMaxAge.Seconds()); secs > 0 {
+		p.hsts = "max-age=" + strconv.FormatInt(secs, 10) + "; includeSubDomains"
+	}
+	return p
+}
+
+// matches reports whether route covers path. Like http.ServeMux
+// patterns, routes ending in a slash match every path below them.
+func matches(route, path string) bool {
+	return route == "" || path == route || strings.HasSuffix(route, "/") && strings.HasPrefix(path, route)
+}
+
+// Middleware sets the headers of every group matching the request path.
+// An empty value removes a header set by a less specific group. Headers
+// are set before next runs, so handlers can still override them.
+func (p *Policy) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		for _, g := range p.groups {
+			if !matches(g.route, r.URL.Path) {
+				continue
+			}
+			for name, value := range g.headers {
+				if value == "" {
+					h.Del(name)
+				} else {
+					h.Set(name, value)
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Fallback adds Strict-Transport-Security for the TCP fallback listener,
+// where browsers first reach the server and learn to stay on HTTPS.
+func (p *Policy) Fallback(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p.hsts != "" {
+			w.Header().Set("Strict-Transport-Security", p.hsts)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
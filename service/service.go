@@ -0,0 +1,90 @@
+// Package service runs the server under the service managers it is
+// deployed with. Under systemd, a Type=notify unit is told when the
+// server is ready and when it stops, and its watchdog is pinged; on
+// Windows, the server runs as a service of the service control manager.
+// See docs/service.md.
+package service
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ready is closed by Ready.
+var (
+	ready     = make(chan struct{})
+	readyOnce sync.Once
+)
+
+// Notify sends state, such as "READY=1", to systemd's notification
+// socket. It does nothing when the server was not started by systemd
+// with NotifyAccess, i.e. NOTIFY_SOCKET is not set.
+func Notify(state string) error {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return nil
+	}
+	if name[0] == '@' {
+		// An abstract socket.
+		name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// Ready reports that the server is serving: to systemd, and to Run on
+// Windows. When the unit sets WatchdogSec, the watchdog is then pinged at
+// half its interval until ctx is cancelled, as long as healthy returns
+// nil, so systemd restarts a server that is up but cannot serve.
+func Ready(ctx context.Context, healthy func(context.Context) error) {
+	readyOnce.Do(func() { close(ready) })
+	if err := Notify("READY=1"); err != nil {
+		log.Printf("Error notifying systemd: %v", err)
+		return
+	}
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := healthy(ctx); err != nil {
+					log.Printf("Not pinging systemd watchdog: %v", err)
+					continue
+				}
+				if err := Notify("WATCHDOG=1"); err != nil {
+					log.Printf("Error pinging systemd watchdog: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// watchdogInterval returns half the watchdog timeout systemd expects
+// pings within, or 0 when there is no watchdog for this process.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
@@ -0,0 +1,40 @@
+//go:build !windows
+
+package service
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Chdir does nothing: systemd starts the server in the unit's
+// WorkingDirectory.
+func Chdir() error {
+	return nil
+}
+
+// Run calls serve until it returns. On SIGTERM or SIGINT, systemd is told
+// the server is stopping and stop is called, which must make serve
+// return; Run then returns nil.
+func Run(name string, serve func() error, stop func()) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+
+	done := make(chan error, 1)
+	go func() { done <- serve() }()
+	select {
+	case err := <-done:
+		return err
+	case sig := <-signals:
+		log.Printf("Received %v, stopping %s", sig, name)
+		if err := Notify("STOPPING=1"); err != nil {
+			log.Printf("Error notifying systemd: %v", err)
+		}
+		stop()
+		<-done
+		return nil
+	}
+}
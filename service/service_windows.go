@@ -0,0 +1,87 @@
+//go:build windows
+
+package service
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+// Chdir changes to the directory of the executable when it was started
+// by the service control manager, which starts services in
+// C:\Windows\System32, so relative paths are found next to the binary.
+func Chdir() error {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	return os.Chdir(filepath.Dir(exe))
+}
+
+// Run calls serve until it returns. Started by the service control
+// manager, the server runs as the service name: it is reported running
+// once Ready is called, and on a stop or shutdown request stop is called,
+// which must make serve return; Run then returns nil. Started from a
+// console, it just calls serve.
+func Run(name string, serve func() error, stop func()) error {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		return err
+	}
+	if !isService {
+		return serve()
+	}
+	h := &handler{name: name, serve: serve, stop: stop}
+	if err := svc.Run(name, h); err != nil {
+		return err
+	}
+	return h.err
+}
+
+// handler runs the server as a Windows service.
+type handler struct {
+	name  string
+	serve func() error
+	stop  func()
+	// err is what serve returned, when it ended without a stop request.
+	err error
+}
+
+// Execute runs the service until serve returns or it is asked to stop.
+func (h *handler) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	done := make(chan error, 1)
+	go func() { done <- h.serve() }()
+
+	select {
+	case <-ready:
+	case h.err = <-done:
+		return false, 1
+	}
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case h.err = <-done:
+			return false, 1
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				log.Printf("Stopping %s", h.name)
+				status <- svc.Status{State: svc.StopPending}
+				h.stop()
+				<-done
+				return false, 0
+			}
+		}
+	}
+}
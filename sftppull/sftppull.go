@@ -0,0 +1,195 @@
+package sftppull
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"naevis/config"
+	"naevis/ingest"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Puller periodically downloads new files from a partner's SFTP server
+// into the file drop directory, where the filedrop watcher ingests them.
+// Files are skipped when the same name or the same content has already
+// been pulled for the partner.
+type Puller struct {
+	db      *sql.DB
+	partner config.SFTPPartner
+	dropDir string
+}
+
+// New creates a puller for one partner.
+func New(db *sql.DB, partner config.SFTPPartner, dropDir string) *Puller {
+	return &Puller{db: db, partner: partner, dropDir: dropDir}
+}
+
+// Run pulls every partner interval until ctx is cancelled.
+func (p *Puller) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.partner.Interval.Duration)
+	defer ticker.Stop()
+
+	for {
+		if err := p.Pull(); err != nil {
+			log.Printf("Error pulling from partner %s: %v", p.partner.Name, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Pull connects once and downloads every new matching file.
+func (p *Puller) Pull() error {
+	client, conn, err := p.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer client.Close()
+
+	entries, err := client.ReadDir(p.partner.RemoteDir)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if !e.Mode().IsRegular() {
+			continue
+		}
+		if _, ok := ingest.FormatOf(e.Name()); !ok {
+			continue
+		}
+		if p.partner.Pattern != "" {
+			if ok, _ := path.Match(p.partner.Pattern, e.Name()); !ok {
+				continue
+			}
+		}
+
+		seen, err := p.seenName(e.Name())
+		if err != nil {
+			return err
+		}
+		if seen {
+			continue
+		}
+		if err := p.fetch(client, e.Name()); err != nil {
+			return fmt.Errorf("%s: %v", e.Name(), err)
+		}
+	}
+	return nil
+}
+
+// dial opens an SFTP session using key-based authentication. The server's
+// host key must be present in the partner's known_hosts file.
+func (p *Puller) dial() (*sftp.Client, *ssh.Client, error) {
+	key, err := os.ReadFile(p.partner.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	hostKeys, err := knownhosts.New(p.partner.KnownHostsFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	addr := p.partner.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr += ":22"
+	}
+	conn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            p.partner.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeys,
+		Timeout:         30 * time.Second,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return client, conn, nil
+}
+
+// fetch downloads one file into the drop directory. The file is written
+// under a temporary name and renamed once complete, so the watcher never
+// sees a partial download.
+func (p *Puller) fetch(client *sftp.Client, name string) error {
+	remote, err := client.Open(path.Join(p.partner.RemoteDir, name))
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+
+	dest := filepath.Join(p.dropDir, p.partner.Name+"-"+name)
+	tmp, err := os.CreateTemp(p.dropDir, ".pull-*.part")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hash), remote); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+
+	// The same content under a new name is recorded but not ingested again.
+	duplicate, err := p.seenHash(sum)
+	if err != nil {
+		return err
+	}
+	if !duplicate {
+		if err := os.Rename(tmp.Name(), dest); err != nil {
+			return err
+		}
+	}
+
+	_, err = p.db.Exec(`
+	INSERT INTO pulled_files (partner, name, sha256, duplicate, pulled_at)
+	VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP);`, p.partner.Name, name, sum, duplicate)
+	if err == nil {
+		log.Printf("Pulled %s from partner %s (duplicate: %v)", name, p.partner.Name, duplicate)
+	}
+	return err
+}
+
+func (p *Puller) seenName(name string) (bool, error) {
+	var n int
+	err := p.db.QueryRow(`SELECT COUNT(*) FROM pulled_files WHERE partner = ? AND name = ?;`,
+		p.partner.Name, name).Scan(&n)
+	return n > 0, err
+}
+
+func (p *Puller) seenHash(sum string) (bool, error) {
+	var n int
+	err := p.db.QueryRow(`SELECT COUNT(*) FROM pulled_files WHERE partner = ? AND sha256 = ?;`,
+		p.partner.Name, sum).Scan(&n)
+	return n > 0, err
+}
@@ -0,0 +1,429 @@
+// Package shards spreads tenants across server instances. Every tenant
+// is owned by one instance, which stores its events; ingest requests for
+// a tenant that reach another instance are redirected, or forwarded, to
+// the owner.
+package shards
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"naevis/apierror"
+	"naevis/config"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+const (
+	// forwardedHeader names the instance that forwarded a request.
+	// Forwarded requests are never forwarded again, and one that reaches
+	// the instance that sent it, through a misconfigured URL, is refused.
+	forwardedHeader = "X-Shard-Forwarded"
+	// ownerHeader names the owner an instance refusing a misdirected
+	// request knows of.
+	ownerHeader = "X-Shard-Owner"
+	// maxAttempts bounds the forwards of one request, which are retried
+	// while the shard map changes under it.
+	maxAttempts = 3
+	// maxForwardBody caps the bodies kept for forwarding, well above the
+	// ingest limits.
+	maxForwardBody = 8 << 20
+	// refreshGap is the least time between coordinator fetches prompted
+	// by misdirected requests.
+	refreshGap = time.Second
+	// replicas is the number of points each instance has on the ring.
+	replicas = 256
+)
+
+// metrics counts requests served locally, redirected, forwarded and
+// refused, and coordinator refreshes, published under "shards" in expvar.
+var metrics = expvar.NewMap("shards")
+
+// Map assigns tenants to instances, as served by a coordinator.
+// Instances maps instance names to base URLs; tenants missing from
+// Tenants belong to Default, or are spread over the instances by
+// consistent hashing when it is empty, so adding an instance only moves
+// the tenants it takes over. Version orders the maps spread by gossip,
+// where the highest wins.
+type Map struct {
+	Instances map[string]string `json:"instances"`
+	Tenants   map[string]string `json:"tenants"`
+	Default   string            `json:"default"`
+	Version   int64             `json:"version"`
+
+	urls map[string]*url.URL
+	ring []point
+}
+
+// point is an instance's position on the hash ring.
+type point struct {
+	hash uint64
+	name string
+}
+
+// hash places a key on the ring.
+func hash(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// parse checks that every instance named has a valid base URL.
+func (m *Map) parse() error {
+	m.urls = make(map[string]*url.URL, len(m.Instances))
+	m.ring = nil
+	for name, base := range m.Instances {
+		u, err := url.Parse(base)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("instance %s: invalid base URL %q", name, base)
+		}
+		m.urls[name] = u
+		for i := range replicas {
+			m.ring = append(m.ring, point{hash(name + "#" + strconv.Itoa(i)), name})
+		}
+	}
+	sort.Slice(m.ring, func(i, j int) bool { return m.ring[i].hash < m.ring[j].hash })
+	for tenant, name := range m.Tenants {
+		if m.urls[name] == nil {
+			return fmt.Errorf("tenant %s: unknown instance %s", tenant, name)
+		}
+	}
+	if m.Default != "" && m.urls[m.Default] == nil {
+		return fmt.Errorf("default: unknown instance %s", m.Default)
+	}
+	return nil
+}
+
+// owner returns the instance owning tenant and its base URL, or "" when
+// there are no instances.
+func (m *Map) owner(tenant string) (string, *url.URL) {
+	name, ok := m.Tenants[tenant]
+	if !ok {
+		name = m.Default
+	}
+	if name == "" && len(m.ring) > 0 {
+		h := hash(tenant)
+		i := sort.Search(len(m.ring), func(i int) bool { return m.ring[i].hash >= h })
+		name = m.ring[i%len(m.ring)].name
+	}
+	return name, m.urls[name]
+}
+
+// Router sends ingest requests to the instance owning their tenant.
+type Router struct {
+	self        string
+	proxy       bool
+	coordinator string
+	client      *http.Client
+	current     atomic.Pointer[Map]
+
+	mu        sync.Mutex
+	refreshed time.Time
+
+	// update serializes changes to the map. assigned is the map as
+	// configured, fetched or gossiped, and members the instances found by
+	// discovery, which replace its instances when set.
+	update   sync.Mutex
+	assigned Map
+	members  map[string]string
+}
+
+// New creates a Router for cfg. Without a Self name it serves every
+// request locally. Instances may be left empty when discovery finds them.
+func New(cfg config.Shards) (*Router, error) {
+	if cfg.Self != "" && cfg.Coordinator == "" && len(cfg.Instances) > 0 && cfg.Instances[cfg.Self] == "" {
+		return nil, fmt.Errorf("self: unknown instance %s", cfg.Self)
+	}
+	r := &Router{
+		self:        cfg.Self,
+		proxy:       cfg.Proxy,
+		coordinator: cfg.Coordinator,
+		// Instances only speak QUIC. The transport keeps one connection
+		// per peer, kept alive between forwards.
+		client: &http.Client{
+			Transport: &http3.Transport{QUICConfig: &quic.Config{KeepAlivePeriod: 15 * time.Second}},
+			Timeout:   30 * time.Second,
+		},
+	}
+	if len(cfg.Instances) == 0 && cfg.Coordinator == "" {
+		// The instances are left to discovery, until which every
+		// request is served locally.
+		r.members = map[string]string{}
+	}
+	m := Map{Instances: cfg.Instances, Tenants: cfg.Tenants, Default: cfg.Default, Version: cfg.Version}
+	if err := r.store(m); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Self returns the name of this instance.
+func (r *Router) Self() string {
+	return r.self
+}
+
+// Assignment returns the current map as configured, fetched or adopted,
+// before discovered members replace its instances.
+func (r *Router) Assignment() Map {
+	r.update.Lock()
+	defer r.update.Unlock()
+	return Map{Instances: r.assigned.Instances, Tenants: r.assigned.Tenants, Default: r.assigned.Default, Version: r.assigned.Version}
+}
+
+// Adopt makes m the current map if its version is higher, and reports
+// whether it did.
+func (r *Router) Adopt(m Map) (bool, error) {
+	r.update.Lock()
+	defer r.update.Unlock()
+	if m.Version <= r.assigned.Version {
+		return false, nil
+	}
+	if err := r.store(m); err != nil {
+		return false, err
+	}
+	metrics.Add("adopted", 1)
+	return true, nil
+}
+
+// SetMembers replaces the instances of the map with members, which maps
+// the live instances found by discovery to their base URLs.
+func (r *Router) SetMembers(members map[string]string) error {
+	r.update.Lock()
+	defer r.update.Unlock()
+	r.members = members
+	return r.store(r.assigned)
+}
+
+// store validates m and makes it current; the caller holds r.update.
+// With discovered members, tenants assigned to instances that are not
+// live are spread over the others until their instance joins.
+func (r *Router) store(m Map) error {
+	cur := m
+	if r.members != nil {
+		cur.Instances = r.members
+		cur.Tenants = make(map[string]string, len(m.Tenants))
+		for tenant, name := range m.Tenants {
+			if _, ok := r.members[name]; ok {
+				cur.Tenants[tenant] = name
+			}
+		}
+		if _, ok := r.members[m.Default]; !ok {
+			cur.Default = ""
+		}
+	}
+	if err := cur.parse(); err != nil {
+		return err
+	}
+	r.assigned = m
+	r.current.Store(&cur)
+	return nil
+}
+
+// Run fetches the map from the coordinator every interval until ctx is
+// cancelled. It returns at once without a coordinator.
+func (r *Router) Run(ctx context.Context, interval time.Duration) {
+	if r.coordinator == "" {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.Refresh(ctx); err != nil {
+			metrics.Add("refresh_errors", 1)
+			log.Printf("Error fetching shard map: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Refresh replaces the map with the coordinator's. An invalid map is
+// rejected and the current one kept.
+func (r *Router) Refresh(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.coordinator, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("coordinator returned %s", resp.Status)
+	}
+
+	var m Map
+	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return err
+	}
+	r.update.Lock()
+	defer r.update.Unlock()
+	if err := r.store(m); err != nil {
+		return err
+	}
+	metrics.Add("refreshes", 1)
+	return nil
+}
+
+// refreshSoon refreshes the map after a peer refused a request, unless it
+// was refreshed within refreshGap. It reports whether the map may have
+// changed.
+func (r *Router) refreshSoon(ctx context.Context) bool {
+	if r.coordinator == "" {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.refreshed) < refreshGap {
+		return true
+	}
+	r.refreshed = time.Now()
+	if err := r.Refresh(ctx); err != nil {
+		metrics.Add("refresh_errors", 1)
+		log.Printf("Error fetching shard map: %v", err)
+	}
+	return true
+}
+
+// Middleware serves requests for this instance's tenants, taken from
+// X-Tenant-ID, and sends the others to their owner: with a 307 redirect,
+// which keeps the method and body, or by forwarding them when proxying
+// is on, so clients need not know the topology.
+func (r *Router) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if r.self == "" {
+			next.ServeHTTP(w, req)
+			return
+		}
+		tenant := req.Header.Get("X-Tenant-ID")
+		if via := req.Header.Get(forwardedHeader); via != "" {
+			r.serveForwarded(w, req, tenant, via, next)
+			return
+		}
+		name, target := r.current.Load().owner(tenant)
+		if target == nil || name == r.self {
+			metrics.Add("local", 1)
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		if !r.proxy {
+			metrics.Add("redirected", 1)
+			http.Redirect(w, req, target.JoinPath(req.URL.Path).String()+query(req.URL), http.StatusTemporaryRedirect)
+			return
+		}
+		r.forward(w, req, tenant, next)
+	})
+}
+
+// serveForwarded serves a request forwarded by the instance via, if
+// this instance owns its tenant. Otherwise the maps disagree, and it is
+// refused with the owner this instance knows of, for the sender to
+// refresh its map.
+func (r *Router) serveForwarded(w http.ResponseWriter, req *http.Request, tenant, via string, next http.Handler) {
+	if via == r.self {
+		metrics.Add("loops", 1)
+		apierror.Write(w, "Request forwarded back to its sender", http.StatusLoopDetected)
+		return
+	}
+	name, target := r.current.Load().owner(tenant)
+	if target != nil && name != r.self {
+		metrics.Add("misdirected", 1)
+		w.Header().Set(ownerHeader, name)
+		apierror.Write(w, "Tenant is owned by another instance", http.StatusMisdirectedRequest)
+		return
+	}
+	metrics.Add("forwarded_in", 1)
+	next.ServeHTTP(w, req)
+}
+
+// forward sends req to the owner of tenant and relays the response. When
+// the owner refuses it as misdirected, the map is refreshed and the
+// request sent to the new owner, or served here if that is this instance.
+func (r *Router) forward(w http.ResponseWriter, req *http.Request, tenant string, next http.Handler) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxForwardBody))
+	if err != nil {
+		apierror.Write(w, "Body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var resp *http.Response
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		name, target := r.current.Load().owner(tenant)
+		if target == nil || name == r.self {
+			metrics.Add("local", 1)
+			req.Body = io.NopCloser(bytes.NewReader(body))
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		metrics.Add("forwarded", 1)
+		resp, err = r.send(req, target, body)
+		if err != nil {
+			log.Printf("Error forwarding to instance %s: %v", name, err)
+			apierror.Write(w, "Owning instance unavailable", http.StatusBadGateway)
+			return
+		}
+		if resp.StatusCode != http.StatusMisdirectedRequest || attempt == maxAttempts-1 {
+			break
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		metrics.Add("retries", 1)
+		if !r.refreshSoon(req.Context()) {
+			break
+		}
+	}
+	defer resp.Body.Close()
+
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// send forwards req, with body, to the instance at target. The Host the
+// client used is kept, as signatures cover it.
+func (r *Router) send(req *http.Request, target *url.URL, body []byte) (*http.Response, error) {
+	out, err := http.NewRequestWithContext(req.Context(), req.Method,
+		target.JoinPath(req.URL.Path).String()+query(req.URL), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	out.Header = req.Header.Clone()
+	out.Host = req.Host
+	out.Header.Set(forwardedHeader, r.self)
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		out.Header.Add("X-Forwarded-For", host)
+	}
+	return r.client.Do(out)
+}
+
+// query returns the query string of u with its "?", if any.
+func query(u *url.URL) string {
+	if u.RawQuery == "" {
+		return ""
+	}
+	return "?" + u.RawQuery
+}
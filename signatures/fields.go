@@ -0,0 +1,260 @@
+package signatures
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// This file parses the subset of RFC 8941 structured fields used by the
+// Signature-Input and Signature headers: dictionaries whose members are
+// inner lists or items, with parameters.
+
+var errSyntax = errors.New("malformed structured field")
+
+// token is a structured field token, as opposed to a string.
+type token string
+
+// param is a parameter of an item or inner list.
+type param struct {
+	key   string
+	value any
+}
+
+// item is a bare item with its parameters. raw is the item as it
+// appeared in the header, which is also its serialization in the
+// signature base.
+type item struct {
+	value  any
+	params []param
+	raw    string
+}
+
+// member is a dictionary member: either an inner list or an item.
+type member struct {
+	name   string
+	list   []item
+	isList bool
+	item   item
+	params []param
+	// raw is the member's value as it appeared in the header.
+	raw string
+}
+
+// param returns the value of the parameter key, or nil.
+func (m member) param(key string) any {
+	for _, p := range m.params {
+		if p.key == key {
+			return p.value
+		}
+	}
+	return nil
+}
+
+type parser struct {
+	s string
+	i int
+}
+
+// parseDictionary parses a dictionary header value. Later members with
+// the same name replace earlier ones.
+func parseDictionary(s string) ([]member, error) {
+	p := &parser{s: s}
+	p.skip(" ")
+	var members []member
+	for p.i < len(p.s) {
+		name, err := p.key()
+		if err != nil {
+			return nil, err
+		}
+		m := member{name: name}
+		start := p.i
+		if p.peek() == '=' {
+			p.i++
+			start = p.i
+			if p.peek() == '(' {
+				m.isList = true
+				if m.list, err = p.innerList(); err != nil {
+					return nil, err
+				}
+			} else if m.item.value, err = p.bareItem(); err != nil {
+				return nil, err
+			}
+		} else {
+			m.item.value = true
+		}
+		if m.params, err = p.params(); err != nil {
+			return nil, err
+		}
+		m.item.params = m.params
+		m.raw = p.s[start:p.i]
+
+		for j := range members {
+			if members[j].name == name {
+				members = append(members[:j], members[j+1:]...)
+				break
+			}
+		}
+		members = append(members, m)
+
+		p.skip(" \t")
+		if p.i == len(p.s) {
+			break
+		}
+		if p.peek() != ',' {
+			return nil, errSyntax
+		}
+		p.i++
+		p.skip(" \t")
+		if p.i == len(p.s) {
+			return nil, errSyntax
+		}
+	}
+	return members, nil
+}
+
+func (p *parser) peek() byte {
+	if p.i < len(p.s) {
+		return p.s[p.i]
+	}
+	return 0
+}
+
+func (p *parser) skip(chars string) {
+	for p.i < len(p.s) && strings.IndexByte(chars, p.s[p.i]) >= 0 {
+		p.i++
+	}
+}
+
+func (p *parser) innerList() ([]item, error) {
+	p.i++ // (
+	var items []item
+	for {
+		p.skip(" ")
+		if p.peek() == ')' {
+			p.i++
+			return items, nil
+		}
+		if p.i == len(p.s) {
+			return nil, errSyntax
+		}
+		start := p.i
+		value, err := p.bareItem()
+		if err != nil {
+			return nil, err
+		}
+		params, err := p.params()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item{value: value, params: params, raw: p.s[start:p.i]})
+		if c := p.peek(); c != ' ' && c != ')' {
+			return nil, errSyntax
+		}
+	}
+}
+
+func (p *parser) params() ([]param, error) {
+	var params []param
+	for p.peek() == ';' {
+		p.i++
+		p.skip(" ")
+		key, err := p.key()
+		if err != nil {
+			return nil, err
+		}
+		var value any = true
+		if p.peek() == '=' {
+			p.i++
+			if value, err = p.bareItem(); err != nil {
+				return nil, err
+			}
+		}
+		params = append(params, param{key: key, value: value})
+	}
+	return params, nil
+}
+
+func (p *parser) key() (string, error) {
+	start := p.i
+	if c := p.peek(); !('a' <= c && c <= 'z' || c == '*') {
+		return "", errSyntax
+	}
+	for p.i < len(p.s) {
+		c := p.s[p.i]
+		if !('a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("_-.*", c) >= 0) {
+			break
+		}
+		p.i++
+	}
+	return p.s[start:p.i], nil
+}
+
+func (p *parser) bareItem() (any, error) {
+	switch c := p.peek(); {
+	case c == '"':
+		return p.string()
+	case c == ':':
+		end := strings.IndexByte(p.s[p.i+1:], ':')
+		if end < 0 {
+			return nil, errSyntax
+		}
+		b, err := base64.StdEncoding.DecodeString(p.s[p.i+1 : p.i+1+end])
+		if err != nil {
+			return nil, errSyntax
+		}
+		p.i += end + 2
+		return b, nil
+	case c == '?':
+		if p.i+1 < len(p.s) && (p.s[p.i+1] == '0' || p.s[p.i+1] == '1') {
+			p.i += 2
+			return p.s[p.i-1] == '1', nil
+		}
+		return nil, errSyntax
+	case c == '-' || '0' <= c && c <= '9':
+		start := p.i
+		p.i++
+		for p.i < len(p.s) && '0' <= p.s[p.i] && p.s[p.i] <= '9' {
+			p.i++
+		}
+		n, err := strconv.ParseInt(p.s[start:p.i], 10, 64)
+		if err != nil || p.i-start > 16 {
+			return nil, errSyntax
+		}
+		return n, nil
+	case 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '*':
+		start := p.i
+		for p.i < len(p.s) {
+			c := p.s[p.i]
+			if c <= ' ' || c >= 0x7f || strings.IndexByte(`"(),;<=>?@[\]{}`, c) >= 0 {
+				break
+			}
+			p.i++
+		}
+		return token(p.s[start:p.i]), nil
+	}
+	return nil, errSyntax
+}
+
+func (p *parser) string() (string, error) {
+	var b strings.Builder
+	for p.i++; p.i < len(p.s); p.i++ {
+		switch c := p.s[p.i]; {
+		case c == '"':
+			p.i++
+			return b.String(), nil
+		case c == '\\':
+			p.i++
+			if p.i == len(p.s) || (p.s[p.i] != '"' && p.s[p.i] != '\\') {
+				return "", errSyntax
+			}
+			b.WriteByte(p.s[p.i])
+		case c < ' ' || c >= 0x7f:
+			return "", errSyntax
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", errSyntax
+}
@@ -0,0 +1,180 @@
+package signatures
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// verifier checks a signature over a signature base.
+type verifier func(base, sig []byte) bool
+
+// parseKey returns a verifier for a key of the RFC 9421 algorithm alg.
+// Asymmetric keys are PEM public keys; hmac-sha256 keys are base64
+// shared secrets.
+func parseKey(alg, key string) (verifier, error) {
+	if alg == "hmac-sha256" {
+		secret, err := base64.StdEncoding.DecodeString(key)
+		if err != nil || len(secret) < 32 {
+			return nil, errors.New("hmac-sha256 keys must be at least 32 base64 bytes")
+		}
+		return func(base, sig []byte) bool {
+			mac := hmac.New(sha256.New, secret)
+			mac.Write(base)
+			return hmac.Equal(mac.Sum(nil), sig)
+		}, nil
+	}
+
+	block, _ := pem.Decode([]byte(key))
+	if block == nil {
+		return nil, errors.New("key is not PEM encoded")
+	}
+	var pub any
+	var err error
+	if block.Type == "RSA PUBLIC KEY" {
+		pub, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	} else {
+		pub, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch alg {
+	case "ed25519":
+		if k, ok := pub.(ed25519.PublicKey); ok {
+			return func(base, sig []byte) bool {
+				return ed25519.Verify(k, base, sig)
+			}, nil
+		}
+	case "ecdsa-p256-sha256":
+		if k, ok := pub.(*ecdsa.PublicKey); ok && k.Curve.Params().Name == "P-256" {
+			return func(base, sig []byte) bool {
+				if len(sig) != 64 {
+					return false
+				}
+				sum := sha256.Sum256(base)
+				r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+				return ecdsa.Verify(k, sum[:], r, s)
+			}, nil
+		}
+	case "rsa-pss-sha512":
+		if k, ok := pub.(*rsa.PublicKey); ok {
+			return func(base, sig []byte) bool {
+				sum := sha512.Sum512(base)
+				return rsa.VerifyPSS(k, crypto.SHA512, sum[:], sig, &rsa.PSSOptions{SaltLength: 64}) == nil
+			}, nil
+		}
+	case "rsa-v1_5-sha256":
+		if k, ok := pub.(*rsa.PublicKey); ok {
+			return func(base, sig []byte) bool {
+				sum := sha256.Sum256(base)
+				return rsa.VerifyPKCS1v15(k, crypto.SHA256, sum[:], sig) == nil
+			}, nil
+		}
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	return nil, fmt.Errorf("key does not match algorithm %q", alg)
+}
+
+// signatureBase builds the RFC 9421 signature base of r for the
+// components covered by input.
+func signatureBase(r *http.Request, input member) ([]byte, error) {
+	var b strings.Builder
+	seen := make(map[string]bool)
+	for _, c := range input.list {
+		name, ok := c.value.(string)
+		if !ok || name != strings.ToLower(name) {
+			return nil, fmt.Errorf("invalid component %s", c.raw)
+		}
+		if seen[c.raw] {
+			return nil, fmt.Errorf("duplicate component %s", c.raw)
+		}
+		seen[c.raw] = true
+
+		value, err := componentValue(r, name, c.params)
+		if err != nil {
+			return nil, err
+		}
+		b.WriteString(c.raw)
+		b.WriteString(": ")
+		b.WriteString(value)
+		b.WriteByte('\n')
+	}
+	b.WriteString(`"@signature-params": `)
+	b.WriteString(input.raw)
+	return []byte(b.String()), nil
+}
+
+// componentValue returns the value of a derived component or header
+// field. Header field parameters (sf, key, bs, req, tr) are not
+// supported.
+func componentValue(r *http.Request, name string, params []param) (string, error) {
+	if name == "@query-param" {
+		if len(params) != 1 || params[0].key != "name" {
+			return "", errors.New(`@query-param needs a single "name" parameter`)
+		}
+		key, _ := params[0].value.(string)
+		values, ok := r.URL.Query()[key]
+		if !ok || len(values) != 1 {
+			return "", fmt.Errorf("query parameter %q missing or repeated", key)
+		}
+		return strings.ReplaceAll(url.QueryEscape(values[0]), "+", "%20"), nil
+	}
+	if len(params) > 0 {
+		return "", fmt.Errorf("parameters on component %q are not supported", name)
+	}
+
+	scheme := "https"
+	if r.TLS == nil && r.ProtoMajor < 3 {
+		scheme = "http"
+	}
+	switch name {
+	case "@method":
+		return r.Method, nil
+	case "@target-uri":
+		return scheme + "://" + strings.ToLower(r.Host) + r.URL.RequestURI(), nil
+	case "@authority":
+		return strings.ToLower(r.Host), nil
+	case "@scheme":
+		return scheme, nil
+	case "@request-target":
+		return r.URL.RequestURI(), nil
+	case "@path":
+		if path := r.URL.EscapedPath(); path != "" {
+			return path, nil
+		}
+		return "/", nil
+	case "@query":
+		return "?" + r.URL.RawQuery, nil
+	case "host":
+		return strings.ToLower(r.Host), nil
+	}
+	if strings.HasPrefix(name, "@") {
+		return "", fmt.Errorf("unsupported derived component %q", name)
+	}
+
+	values := r.Header.Values(name)
+	if len(values) == 0 {
+		return "", fmt.Errorf("covered header %q missing", name)
+	}
+	trimmed := make([]string, len(values))
+	for i, v := range values {
+		trimmed[i] = strings.TrimSpace(v)
+	}
+	return strings.Join(trimmed, ", "), nil
+}
@@ -0,0 +1,381 @@
+package signatures
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"naevis/apierror"
+	"naevis/config"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metrics counts signature checks, published under "signatures" in
+// expvar.
+var metrics = expvar.NewMap("signatures")
+
+// Key is a partner's signing key.
+type Key struct {
+	ID        string `json:"key_id"`
+	Partner   string `json:"partner"`
+	Algorithm string `json:"algorithm"`
+	Key       string `json:"key,omitempty"`
+	// Source is "config" or "admin"; admin keys override config ones.
+	Source string `json:"source"`
+
+	verify verifier
+}
+
+// Signer identifies the key that signed a request.
+type Signer struct {
+	Partner string
+	KeyID   string
+}
+
+// Verifier checks RFC 9421 HTTP message signatures against the keys
+// registered for partners, from the config file and the admin API.
+type Verifier struct {
+	db       *sql.DB
+	defaults map[string]config.SigningKey
+	required []string
+	maxAge   time.Duration
+
+	mu   sync.RWMutex
+	keys map[string]Key
+}
+
+// New creates a Verifier and loads the keys. It fails if a key in the
+// config file cannot be parsed.
+func New(db *sql.DB, cfg config.Signatures) (*Verifier, error) {
+	for id, k := range cfg.Keys {
+		if _, err := parseKey(k.Algorithm, k.Key); err != nil {
+			return nil, fmt.Errorf("signing key %s: %w", id, err)
+		}
+	}
+	v := &Verifier{db: db, defaults: cfg.Keys, required: cfg.Required, maxAge: cfg.MaxAge.Duration}
+	return v, v.Reload()
+}
+
+// Run reloads the keys every interval until ctx is cancelled, picking up
+// keys registered through other instances, and forgets nonces too old to
+// be replayed.
+func (v *Verifier) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := v.Reload(); err != nil {
+			log.Printf("Error reloading signing keys: %v", err)
+		}
+		if _, err := v.db.Exec(`DELETE FROM signature_nonces WHERE expires_at < ?;`, time.Now().Unix()); err != nil {
+			log.Printf("Error pruning signature nonces: %v", err)
+		}
+	}
+}
+
+// Reload rebuilds the keys from the config defaults and the database.
+// Stored keys that no longer parse are skipped.
+func (v *Verifier) Reload() error {
+	keys := make(map[string]Key)
+	for id, k := range v.defaults {
+		verify, _ := parseKey(k.Algorithm, k.Key)
+		keys[id] = Key{ID: id, Partner: k.Partner, Algorithm: k.Algorithm, Key: k.Key, Source: "config", verify: verify}
+	}
+
+	rows, err := v.db.Query(`SELECT key_id, partner, algorithm, key FROM signing_keys;`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		k := Key{Source: "admin"}
+		if err := rows.Scan(&k.ID, &k.Partner, &k.Algorithm, &k.Key); err != nil {
+			return err
+		}
+		if k.verify, err = parseKey(k.Algorithm, k.Key); err != nil {
+			log.Printf("Skipping signing key %s: %v", k.ID, err)
+			continue
+		}
+		keys[k.ID] = k
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	v.mu.Lock()
+	v.keys = keys
+	v.mu.Unlock()
+	return nil
+}
+
+type contextKey struct{}
+
+// Middleware verifies the signatures of signed requests and attaches the
+// signer to the request context. Requests to routes listed in the
+// config's Required must be signed; other routes accept unsigned
+// requests, but a signature that is present must be valid. A signature
+// must cover the method and target URI, and the Content-Digest of any
+// body, which digest.Middleware has already checked against the body.
+// To stop captured requests from being replayed, a signature must also
+// carry a created time within the configured MaxAge and a nonce that has
+// not been used with its key before.
+func (v *Verifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Signature-Input") == "" {
+			if v.requires(r.URL.Path) {
+				metrics.Add("missing", 1)
+				w.Header().Set("Accept-Signature", `sig1=("@method" "@target-uri" "content-digest");created;nonce`)
+				apierror.WriteCode(w, apierror.CodeSignatureRequired, "This route requires a signed request", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		signer, err := v.verify(r)
+		var replay *replayError
+		switch {
+		case errors.As(err, &replay):
+			metrics.Add(replay.reason, 1)
+			apierror.WriteCode(w, replay.code, err.Error(), http.StatusUnauthorized)
+			return
+		case err != nil:
+			metrics.Add("invalid", 1)
+			apierror.WriteCode(w, apierror.CodeInvalidSignature, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		metrics.Add("verified", 1)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, signer)))
+	})
+}
+
+// FromContext returns the signer of a verified request, if any.
+func FromContext(ctx context.Context) (Signer, bool) {
+	signer, ok := ctx.Value(contextKey{}).(Signer)
+	return signer, ok
+}
+
+// requires reports whether path needs a signature. Like http.ServeMux
+// patterns, required routes ending in a slash match every path below
+// them.
+func (v *Verifier) requires(path string) bool {
+	for _, route := range v.required {
+		if path == route || strings.HasSuffix(route, "/") && strings.HasPrefix(path, route) {
+			return true
+		}
+	}
+	return false
+}
+
+// verify checks the signatures of r from registered keys. Signatures by
+// unknown keys are ignored, but at least one must verify.
+func (v *Verifier) verify(r *http.Request) (Signer, error) {
+	inputs, err := parseDictionary(strings.Join(r.Header.Values("Signature-Input"), ", "))
+	if err != nil {
+		return Signer{}, fmt.Errorf("Signature-Input: %v", err)
+	}
+	sigs, err := parseDictionary(strings.Join(r.Header.Values("Signature"), ", "))
+	if err != nil {
+		return Signer{}, fmt.Errorf("Signature: %v", err)
+	}
+
+	v.mu.RLock()
+	keys := v.keys
+	v.mu.RUnlock()
+
+	for _, input := range inputs {
+		keyID, _ := input.param("keyid").(string)
+		key, ok := keys[keyID]
+		if !input.isList || !ok {
+			continue
+		}
+		if alg, ok := input.param("alg").(string); ok && alg != key.Algorithm {
+			return Signer{}, fmt.Errorf("signature %s: alg does not match key %s", input.name, keyID)
+		}
+		if err := checkInput(r, input); err != nil {
+			return Signer{}, fmt.Errorf("signature %s: %v", input.name, err)
+		}
+		if err := v.checkFresh(input); err != nil {
+			return Signer{}, err
+		}
+
+		var sig []byte
+		for _, s := range sigs {
+			if s.name == input.name {
+				sig, _ = s.item.value.([]byte)
+			}
+		}
+		if sig == nil {
+			return Signer{}, fmt.Errorf("signature %s: missing from Signature", input.name)
+		}
+		base, err := signatureBase(r, input)
+		if err != nil {
+			return Signer{}, fmt.Errorf("signature %s: %v", input.name, err)
+		}
+		if !key.verify(base, sig) {
+			return Signer{}, fmt.Errorf("signature %s: does not verify with key %s", input.name, keyID)
+		}
+		// The nonce is only spent by a valid signature, so forged
+		// requests cannot burn the nonces of genuine ones.
+		if err := v.spendNonce(keyID, input); err != nil {
+			return Signer{}, err
+		}
+		return Signer{Partner: key.Partner, KeyID: keyID}, nil
+	}
+	return Signer{}, fmt.Errorf("no signature from a registered key")
+}
+
+// checkInput rejects expired signatures, those without the created and
+// nonce parameters that guard against replays, and those that leave the
+// request's method, target or body unsigned.
+func checkInput(r *http.Request, input member) error {
+	if expires, ok := input.param("expires").(int64); ok && time.Now().Unix() > expires {
+		return fmt.Errorf("expired")
+	}
+	if _, ok := input.param("created").(int64); !ok {
+		return fmt.Errorf("must carry created")
+	}
+	if nonce, _ := input.param("nonce").(string); nonce == "" {
+		return fmt.Errorf("must carry a nonce")
+	}
+	covered := make(map[string]bool)
+	for _, c := range input.list {
+		if name, ok := c.value.(string); ok && len(c.params) == 0 {
+			covered[name] = true
+		}
+	}
+	if !covered["@method"] {
+		return fmt.Errorf("must cover @method")
+	}
+	if !covered["@target-uri"] && !(covered["@authority"] && (covered["@request-target"] || covered["@path"] && covered["@query"])) {
+		return fmt.Errorf("must cover @target-uri")
+	}
+	if r.ContentLength != 0 && !covered["content-digest"] {
+		return fmt.Errorf("must cover content-digest")
+	}
+	return nil
+}
+
+// replayError rejects a signature that may be a replay. reason is the
+// expvar counter it is counted under.
+type replayError struct {
+	code, reason, msg string
+}
+
+func (e *replayError) Error() string { return e.msg }
+
+// checkFresh requires the signature's created time to be within maxAge
+// of now, allowing for clock skew in either direction.
+func (v *Verifier) checkFresh(input member) error {
+	created, _ := input.param("created").(int64)
+	age := time.Since(time.Unix(created, 0))
+	if age > v.maxAge || age < -v.maxAge {
+		return &replayError{apierror.CodeStaleSignature, "stale",
+			fmt.Sprintf("signature %s: created %s ago, outside the allowed %s", input.name, age.Round(time.Second), v.maxAge)}
+	}
+	return nil
+}
+
+// spendNonce records the signature's nonce, failing if the key used it
+// before. Nonces are kept until their signature could no longer pass
+// checkFresh.
+func (v *Verifier) spendNonce(keyID string, input member) error {
+	nonce, _ := input.param("nonce").(string)
+	created, _ := input.param("created").(int64)
+	res, err := v.db.Exec(`
+	INSERT INTO signature_nonces (key_id, nonce, expires_at) VALUES (?, ?, ?)
+	ON CONFLICT(key_id, nonce) DO NOTHING;`,
+		keyID, nonce, created+int64((v.maxAge+time.Minute)/time.Second))
+	if err != nil {
+		return fmt.Errorf("signature %s: failed to record nonce: %v", input.name, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return &replayError{apierror.CodeReplayedRequest, "replayed", "signature " + input.name + ": nonce already used"}
+	}
+	return nil
+}
+
+// list returns all keys sorted by ID, without their key material.
+func (v *Verifier) list() []Key {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	keys := make([]Key, 0, len(v.keys))
+	for _, k := range v.keys {
+		k.Key = ""
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	return keys
+}
+
+// AdminHandler manages partner signing keys:
+//
+//	GET    /admin/signing-keys           list every key and its source
+//	PUT    /admin/signing-keys/{KEY_ID}  register a key, overriding the config file
+//	DELETE /admin/signing-keys/{KEY_ID}  remove a registered key
+func (v *Verifier) AdminHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/signing-keys"), "/")
+
+	var err error
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		writeJSON(w, http.StatusOK, v.list())
+		return
+	case r.Method == http.MethodPut && id != "":
+		var k Key
+		if err := json.NewDecoder(r.Body).Decode(&k); err != nil {
+			apierror.WriteCode(w, apierror.CodeInvalidJSON, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if k.Partner == "" {
+			apierror.Write(w, "partner is required", http.StatusBadRequest)
+			return
+		}
+		if _, err := parseKey(k.Algorithm, k.Key); err != nil {
+			apierror.Write(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		_, err = v.db.Exec(`
+		INSERT INTO signing_keys (key_id, partner, algorithm, key, updated_at)
+		VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(key_id) DO UPDATE SET partner = excluded.partner, algorithm = excluded.algorithm,
+			key = excluded.key, updated_at = CURRENT_TIMESTAMP;`,
+			id, k.Partner, k.Algorithm, k.Key)
+	case r.Method == http.MethodDelete && id != "":
+		_, err = v.db.Exec(`DELETE FROM signing_keys WHERE key_id = ?;`, id)
+	default:
+		apierror.Write(w, "Use GET /admin/signing-keys or PUT/DELETE /admin/signing-keys/{KEY_ID}", http.StatusMethodNotAllowed)
+		return
+	}
+	if err == nil {
+		err = v.Reload()
+	}
+	if err != nil {
+		apierror.Write(w, "Failed to update signing key", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	response, err := json.Marshal(v)
+	if err != nil {
+		apierror.Write(w, "Error encoding JSON", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(response)
+}
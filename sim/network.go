@@ -0,0 +1,112 @@
+package sim
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+// ErrDropped is returned for a request lost before reaching the server.
+var ErrDropped = errors.New("sim: request dropped")
+
+// ErrLost is returned for a request the server handled whose response was
+// lost, as when a connection resets after the server has replied.
+var ErrLost = errors.New("sim: response lost")
+
+// Faults sets how often the Network loses traffic, as probabilities from
+// 0 to 1.
+type Faults struct {
+	// Drop is the chance a request never reaches the server.
+	Drop float64
+	// LoseResponse is the chance a handled request's response is lost.
+	LoseResponse float64
+}
+
+// Stats counts what the Network did with requests.
+type Stats struct {
+	Delivered int
+	Dropped   int
+	Lost      int
+}
+
+// Network is an http.RoundTripper serving requests in process with a
+// handler and losing some of them as its Faults say. Faults are drawn from
+// a seeded source, so the same seed and requests lose the same ones.
+type Network struct {
+	handler http.Handler
+
+	mu     sync.Mutex
+	rand   *rand.Rand
+	faults Faults
+	stats  Stats
+}
+
+// NewNetwork creates a Network serving with handler.
+func NewNetwork(handler http.Handler, seed uint64, faults Faults) *Network {
+	return &Network{handler: handler, rand: rand.New(rand.NewPCG(seed, seed)), faults: faults}
+}
+
+// SetFaults changes the faults of later requests; the zero Faults heals
+// the network.
+func (n *Network) SetFaults(faults Faults) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.faults = faults
+}
+
+// Stats returns the counts so far.
+func (n *Network) Stats() Stats {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.stats
+}
+
+// RoundTrip serves req with the handler unless the request or its
+// response is lost.
+func (n *Network) RoundTrip(req *http.Request) (*http.Response, error) {
+	n.mu.Lock()
+	drop := n.rand.Float64() < n.faults.Drop
+	lose := n.rand.Float64() < n.faults.LoseResponse
+	n.mu.Unlock()
+
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if drop {
+		n.count(func(s *Stats) { s.Dropped++ })
+		return nil, ErrDropped
+	}
+
+	in := req.Clone(req.Context())
+	in.Body = io.NopCloser(bytes.NewReader(body))
+	in.ContentLength = int64(len(body))
+	in.RequestURI = req.URL.RequestURI()
+	in.RemoteAddr = "192.0.2.1:1234"
+	rec := httptest.NewRecorder()
+	n.handler.ServeHTTP(rec, in)
+
+	if lose {
+		n.count(func(s *Stats) { s.Lost++ })
+		return nil, ErrLost
+	}
+	n.count(func(s *Stats) { s.Delivered++ })
+	resp := rec.Result()
+	resp.Request = req
+	return resp, nil
+}
+
+func (n *Network) count(f func(*Stats)) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	f(&n.stats)
+}
@@ -0,0 +1,51 @@
+package sim
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"naevis/structs"
+	"time"
+)
+
+// Op is one step of a Workload: after waiting Wait, send Event to /event
+// or Hits to /track.
+type Op struct {
+	Wait  time.Duration
+	Event *structs.Index
+	Hits  []structs.Index
+}
+
+var (
+	entityTypes = []string{"event", "place", "merch", "media"}
+	actions     = []string{"create", "update", "view", "like"}
+	hitActions  = []string{"click", "impression"}
+)
+
+// Workload returns n ops derived from seed. Events carry entity ids unique
+// within the workload, so each can be found in storage afterwards.
+func Workload(seed uint64, n int) []Op {
+	r := rand.New(rand.NewPCG(seed, ^seed))
+	ops := make([]Op, n)
+	for i := range ops {
+		op := &ops[i]
+		op.Wait = time.Duration(r.IntN(600)) * time.Second
+		if r.IntN(3) == 0 {
+			op.Hits = make([]structs.Index, 1+r.IntN(20))
+			for j := range op.Hits {
+				op.Hits[j] = structs.Index{
+					EntityType: entityTypes[r.IntN(len(entityTypes))],
+					Action:     hitActions[r.IntN(len(hitActions))],
+					EntityId:   fmt.Sprintf("e%d", r.IntN(50)),
+				}
+			}
+			continue
+		}
+		op.Event = &structs.Index{
+			EntityType: entityTypes[r.IntN(len(entityTypes))],
+			Action:     actions[r.IntN(len(actions))],
+			EntityId:   fmt.Sprintf("sim-%d", i),
+			ItemId:     fmt.Sprintf("i%d", r.IntN(10)),
+		}
+	}
+	return ops
+}
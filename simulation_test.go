@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"naevis/analytics"
+	"naevis/client"
+	"naevis/config"
+	"naevis/costs"
+	"naevis/dedup"
+	"naevis/dictionary"
+	"naevis/follows"
+	"naevis/idempotency"
+	"naevis/ingest"
+	"naevis/initdb"
+	"naevis/quotas"
+	"naevis/sampling"
+	"naevis/sim"
+	"naevis/storage"
+	"naevis/structs"
+	"naevis/tiering"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var (
+	simSeed  = flag.Uint64("sim.seed", 0, "replay only this simulation seed")
+	simSeeds = flag.Int("sim.seeds", 5, "number of simulation seeds to run")
+	simOps   = flag.Int("sim.ops", 200, "operations per simulation run")
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+
+	// The cold tier is attached to every database opened from here on, so
+	// all runs share one, emptied at the start of each.
+	dir, err := os.MkdirTemp("", "quickie-sim")
+	if err != nil {
+		log.Fatal(err)
+	}
+	tiering.Attach(filepath.Join(dir, "cold.db"))
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// TestSimulation replays seeded workloads through the client queue, a
+// lossy network, ingest, tracking and the cold tier mover, checking that
+// no acknowledged write is lost or duplicated and that a seed always ends
+// in the same state. Rerun a failing seed with -sim.seed.
+func TestSimulation(t *testing.T) {
+	seeds := make([]uint64, 0, *simSeeds)
+	if *simSeed != 0 {
+		seeds = append(seeds, *simSeed)
+	} else {
+		for seed := 1; seed <= *simSeeds; seed++ {
+			seeds = append(seeds, uint64(seed))
+		}
+	}
+
+	for _, seed := range seeds {
+		t.Run(fmt.Sprintf("seed=%d", seed), func(t *testing.T) {
+			first := simulate(t, seed)
+			if again := simulate(t, seed); again != first {
+				t.Fatalf("seed %d ended in a different state when replayed", seed)
+			}
+		})
+	}
+}
+
+// simulate runs the workload of seed and returns a digest of the stored
+// state.
+func simulate(t *testing.T, seed uint64) string {
+	t.Helper()
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	db, err := initdb.InitDB(filepath.Join(dir, "events.db"), config.SQLite{JournalMode: "wal", BusyTimeout: config.Duration{Duration: 5 * time.Second}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	clk := sim.NewClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	retention := config.Tiering{After: config.Duration{Duration: time.Hour}, BatchSize: 50}
+	mover, err := tiering.New(db, retention, clk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`DELETE FROM cold.events;`); err != nil {
+		t.Fatal(err)
+	}
+
+	sampler := sampling.New(db, nil)
+	enforcer, err := quotas.New(db, config.Quotas{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{db: db, sampler: sampler, follows: follows.New(db), quotas: enforcer, dict: dictionary.New(db), clock: clk, maxBodyBytes: 1 << 20}
+	srv.validator = ingest.NewValidator(config.Validation{})
+	srv.dedup = dedup.New(db, config.Dedup{})
+	srv.costs = costs.New(db)
+	srv.store, err = storage.Open("", storage.Env{DB: db, Dictionary: srv.dict, Dedup: srv.dedup})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := analytics.NewTracker(db, sampler, srv.validator, srv.maxBodyBytes, clk)
+	idem := idempotency.New(db, config.Idempotency{TTL: config.Duration{Duration: 24 * time.Hour}})
+
+	mux := http.NewServeMux()
+	mux.Handle("/event", idem.Middleware(http.HandlerFunc(srv.EventHandler)))
+	mux.Handle("/track", idem.Middleware(http.HandlerFunc(tracker.TrackHandler)))
+	network := sim.NewNetwork(mux, seed, sim.Faults{Drop: 0.1, LoseResponse: 0.1})
+	httpClient := &http.Client{Transport: network}
+
+	c, err := client.New(client.Config{
+		BaseURL:    "https://quickie.test",
+		HTTPClient: httpClient,
+		Retry:      &client.RetryPolicy{MaxAttempts: 3},
+		Breaker:    &client.BreakerPolicy{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue, err := client.NewQueue(c, client.QueueConfig{Dir: filepath.Join(dir, "queue")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close()
+
+	var sent []string
+	hits := 0
+	for i, op := range sim.Workload(seed, *simOps) {
+		clk.Advance(op.Wait)
+		if _, err := mover.Move(); err != nil {
+			t.Fatalf("op %d: moving events: %v", i, err)
+		}
+
+		if op.Event != nil {
+			if err := queue.Enqueue(*op.Event); err != nil {
+				t.Fatalf("op %d: enqueueing: %v", i, err)
+			}
+			sent = append(sent, op.Event.EntityId)
+			// A failed flush leaves the event queued for the next one.
+			queue.Flush(ctx)
+			continue
+		}
+
+		if err := track(httpClient, fmt.Sprintf("hits-%d", i), op.Hits); err != nil {
+			t.Fatalf("op %d: %v", i, err)
+		}
+		hits += len(op.Hits)
+	}
+
+	network.SetFaults(sim.Faults{})
+	if err := queue.Flush(ctx); err != nil {
+		t.Fatalf("flushing the queue on a healed network: %v", err)
+	}
+	if n := queue.Pending(); n != 0 {
+		t.Fatalf("%d bytes still queued on a healed network", n)
+	}
+	tracker.Close()
+	if _, err := mover.Move(); err != nil {
+		t.Fatal(err)
+	}
+
+	checkEvents(t, db, sent, clk.Now().Add(-retention.After.Duration))
+	checkHits(t, db, hits)
+	if stats := network.Stats(); stats.Dropped == 0 || stats.Lost == 0 {
+		t.Logf("seed %d lost no traffic: %+v", seed, stats)
+	}
+	return stateDigest(t, db)
+}
+
+// track posts hits under key until the server acknowledges them, as a
+// client resending a batch whose fate it does not know would.
+func track(httpClient *http.Client, key string, hits []structs.Index) error {
+	body, err := json.Marshal(hits)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; attempt < 100; attempt++ {
+		req, err := http.NewRequest(http.MethodPost, "https://quickie.test/track", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", key)
+		resp, err := httpClient.Do(req)
+		if errors.Is(err, sim.ErrDropped) || errors.Is(err, sim.ErrLost) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			return fmt.Errorf("tracking %s: status %d", key, resp.StatusCode)
+		}
+		return nil
+	}
+	return fmt.Errorf("tracking %s: no attempt got through", key)
+}
+
+// checkEvents verifies that every sent event is stored exactly once
+// across both tiers and that none older than cutoff is left hot.
+func checkEvents(t *testing.T, db *sql.DB, sent []string, cutoff time.Time) {
+	t.Helper()
+	rows, err := db.Query(`
+	SELECT entity_id, COUNT(*) FROM (
+		SELECT entity_id FROM main.events UNION ALL SELECT entity_id FROM cold.events
+	) GROUP BY entity_id;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	stored := make(map[string]int)
+	for rows.Next() {
+		var id string
+		var n int
+		if err := rows.Scan(&id, &n); err != nil {
+			t.Fatal(err)
+		}
+		stored[id] = n
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range sent {
+		if stored[id] != 1 {
+			t.Errorf("event %s stored %d times, want once", id, stored[id])
+		}
+	}
+	if len(stored) != len(sent) {
+		t.Errorf("%d events stored, %d sent", len(stored), len(sent))
+	}
+
+	var stale int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM main.events WHERE created_at < ?;`,
+		cutoff.UTC().Format(time.DateTime)).Scan(&stale); err != nil {
+		t.Fatal(err)
+	}
+	if stale != 0 {
+		t.Errorf("%d events older than the retention cutoff left in the hot tier", stale)
+	}
+}
+
+// checkHits verifies that every acknowledged hit was written once.
+func checkHits(t *testing.T, db *sql.DB, want int) {
+	t.Helper()
+	var got int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM tracking_events;`).Scan(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("%d tracking hits stored, %d acknowledged", got, want)
+	}
+}
+
+// stateDigest hashes the stored events and hits in id order. Wall-clock
+// columns are left out, as only the fake clock is replayed.
+func stateDigest(t *testing.T, db *sql.DB) string {
+	t.Helper()
+	h := sha256.New()
+	for _, query := range []string{
+		`SELECT id, entity_type, action, entity_id, item_id, created_at FROM (
+			SELECT id, entity_type, action, entity_id, item_id, created_at FROM main.events
+			UNION ALL
+			SELECT id, entity_type, action, entity_id, item_id, created_at FROM cold.events
+		) ORDER BY id;`,
+		`SELECT id, entity_type, action, entity_id, '', '' FROM tracking_events ORDER BY id;`,
+	} {
+		rows, err := db.Query(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rows.Next() {
+			var id int64
+			var entityType, action, entityID, itemID, createdAt sql.NullString
+			if err := rows.Scan(&id, &entityType, &action, &entityID, &itemID, &createdAt); err != nil {
+				rows.Close()
+				t.Fatal(err)
+			}
+			fmt.Fprintln(h, id, entityType.String, action.String, entityID.String, itemID.String, createdAt.String)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,254 @@
+// Package sla tracks how quickly each tenant's events are stored and
+// their notifications delivered, and alerts when a tenant's latency
+// exceeds its target. Latencies are kept in memory per instance, as the
+// last samples of each tenant and stage.
+package sla
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"log"
+	"math"
+	"naevis/apierror"
+	"naevis/config"
+	"naevis/structs"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Stages of an event whose latency is tracked, from when it was received.
+const (
+	// Stored is when the event was committed.
+	Stored = "stored"
+	// Delivered is when a push or email notification of it was sent.
+	Delivered = "delivered"
+)
+
+// maxSamples caps the samples kept per tenant and stage; the window may
+// hold fewer for busy tenants.
+const maxSamples = 2048
+
+// metrics counts breaches and recoveries, published under "sla" in
+// expvar.
+var metrics = expvar.NewMap("sla")
+
+type sample struct {
+	at      time.Time
+	latency time.Duration
+}
+
+// samples is a ring of the latest samples of one tenant and stage.
+type samples struct {
+	ring []sample
+	next int
+}
+
+var tracked = struct {
+	mu sync.Mutex
+	// samples maps tenant and stage to their samples.
+	samples map[[2]string]*samples
+}{samples: make(map[[2]string]*samples)}
+
+// Observe records the latency of event reaching stage. Events without a
+// receive time are not tracked.
+func Observe(stage string, event structs.Index) {
+	if event.ReceivedAt.IsZero() {
+		return
+	}
+	s := sample{at: time.Now(), latency: time.Since(event.ReceivedAt)}
+
+	tracked.mu.Lock()
+	defer tracked.mu.Unlock()
+	key := [2]string{event.Tenant, stage}
+	r := tracked.samples[key]
+	if r == nil {
+		r = &samples{}
+		tracked.samples[key] = r
+	}
+	if len(r.ring) < maxSamples {
+		r.ring = append(r.ring, s)
+		return
+	}
+	r.ring[r.next] = s
+	r.next = (r.next + 1) % maxSamples
+}
+
+// Latency summarizes the latencies of a stage over the window, in
+// milliseconds. Observed is the latency at the configured percentile,
+// compared with Target; Target is zero when the stage has none.
+type Latency struct {
+	Count    int     `json:"count"`
+	P50      float64 `json:"p50_ms"`
+	P90      float64 `json:"p90_ms"`
+	P99      float64 `json:"p99_ms"`
+	Observed float64 `json:"observed_ms"`
+	Target   float64 `json:"target_ms,omitempty"`
+	Breached bool    `json:"breached"`
+}
+
+// Tenant is the SLA report of one tenant.
+type Tenant struct {
+	Tenant    string  `json:"tenant"`
+	Stored    Latency `json:"stored"`
+	Delivered Latency `json:"delivered"`
+}
+
+// Monitor checks the tracked latencies against the configured targets.
+type Monitor struct {
+	cfg config.SLA
+
+	mu sync.Mutex
+	// breached holds the tenants and stages over target at the last check.
+	breached map[[2]string]bool
+}
+
+// New creates a Monitor for cfg.
+func New(cfg config.SLA) *Monitor {
+	return &Monitor{cfg: cfg, breached: make(map[[2]string]bool)}
+}
+
+// Run checks the targets every interval until ctx is cancelled.
+func (m *Monitor) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		m.Check()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check logs an alert for each tenant and stage that went over its target
+// since the last check, and notes those back within it.
+func (m *Monitor) Check() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := make(map[[2]string]bool)
+	for _, t := range m.Report() {
+		for _, s := range []struct {
+			stage string
+			l     Latency
+		}{{Stored, t.Stored}, {Delivered, t.Delivered}} {
+			if !s.l.Breached {
+				continue
+			}
+			key := [2]string{t.Tenant, s.stage}
+			now[key] = true
+			if !m.breached[key] {
+				metrics.Add("breaches", 1)
+				log.Printf("ALERT: tenant %q events %s in %.1fms at p%g, over the SLA target of %.1fms",
+					t.Tenant, s.stage, s.l.Observed, m.cfg.Percentile, s.l.Target)
+			}
+		}
+	}
+	for key := range m.breached {
+		if !now[key] {
+			metrics.Add("recoveries", 1)
+			log.Printf("Tenant %q events %s within the SLA target again", key[0], key[1])
+		}
+	}
+	m.breached = now
+}
+
+// Report summarizes every tenant's latencies over the window, by tenant.
+func (m *Monitor) Report() []Tenant {
+	cutoff := time.Now().Add(-m.cfg.Window.Duration)
+
+	// Copy the latencies within the window, then sort them unlocked.
+	latencies := make(map[[2]string][]time.Duration)
+	tracked.mu.Lock()
+	for key, r := range tracked.samples {
+		for _, s := range r.ring {
+			if s.at.After(cutoff) {
+				latencies[key] = append(latencies[key], s.latency)
+			}
+		}
+	}
+	tracked.mu.Unlock()
+
+	byTenant := make(map[string]*Tenant)
+	for key, l := range latencies {
+		t := byTenant[key[0]]
+		if t == nil {
+			t = &Tenant{Tenant: key[0]}
+			byTenant[key[0]] = t
+		}
+		target, ok := m.cfg.Tenants[key[0]]
+		if !ok {
+			target = m.cfg.Default
+		}
+		switch key[1] {
+		case Stored:
+			t.Stored = summarize(l, target.Stored.Duration, m.cfg.Percentile)
+		case Delivered:
+			t.Delivered = summarize(l, target.Delivered.Duration, m.cfg.Percentile)
+		}
+	}
+
+	report := make([]Tenant, 0, len(byTenant))
+	for _, t := range byTenant {
+		report = append(report, *t)
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].Tenant < report[j].Tenant })
+	return report
+}
+
+// summarize computes the percentiles of latencies and whether the one at
+// percentile exceeds a non-zero target.
+func summarize(latencies []time.Duration, target time.Duration, percentile float64) Latency {
+	slices.Sort(latencies)
+	observed := rank(latencies, percentile)
+	return Latency{
+		Count:    len(latencies),
+		P50:      ms(rank(latencies, 50)),
+		P90:      ms(rank(latencies, 90)),
+		P99:      ms(rank(latencies, 99)),
+		Observed: ms(observed),
+		Target:   ms(target),
+		Breached: target > 0 && observed > target,
+	}
+}
+
+// rank returns the nearest-rank percentile p of sorted latencies.
+func rank(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	return sorted[min(max(i, 0), len(sorted)-1)]
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// AdminHandler handles GET /admin/sla, which reports every tenant's
+// latencies over the window against its targets.
+func (m *Monitor) AdminHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apierror.Write(w, "Only GET requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	response, err := json.Marshal(struct {
+		Window     string   `json:"window"`
+		Percentile float64  `json:"percentile"`
+		Tenants    []Tenant `json:"tenants"`
+	}{m.cfg.Window.String(), m.cfg.Percentile, m.Report()})
+	if err != nil {
+		apierror.Write(w, "Error encoding JSON", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
@@ -0,0 +1,193 @@
+// Code generated by cmd/sqlcheck; DO NOT EDIT.
+
+package sqlguard
+
+// statements are the constant statements the module passes to
+// database/sql, normalized.
+var statements = []string{
+	"ANALYZE;",
+	"CREATE INDEX IF NOT EXISTS cold.events_user ON events (user_id, created_at);",
+	"CREATE TABLE IF NOT EXISTS cold.events ( id INTEGER PRIMARY KEY, entity_type TEXT, action TEXT, entity_id TEXT, item_id TEXT, item_type TEXT, additional_info TEXT, created_at DATETIME, tenant TEXT NOT NULL DEFAULT '', user_id INTEGER );",
+	"CREATE TABLE IF NOT EXISTS dictionary ( id INTEGER PRIMARY KEY, kind TEXT NOT NULL, value TEXT NOT NULL, UNIQUE (kind, value) );",
+	"CREATE TABLE IF NOT EXISTS event_rows ( id INTEGER PRIMARY KEY AUTOINCREMENT, entity_type_id INTEGER, action_id INTEGER, entity_id TEXT, item_id TEXT, item_type_id INTEGER, additional_info TEXT, created_at DATETIME, tenant TEXT NOT NULL DEFAULT '', user_id INTEGER );",
+	"CREATE TABLE IF NOT EXISTS schema_migrations ( version INTEGER PRIMARY KEY, name TEXT NOT NULL, applied_at DATETIME NOT NULL );",
+	"DELETE FROM blob_uploads WHERE id = ?;",
+	"DELETE FROM blobs WHERE sha256 = ?;",
+	"DELETE FROM dead_letters WHERE id = ?;",
+	"DELETE FROM event_attachments WHERE event_id = ?;",
+	"DELETE FROM event_attachments WHERE event_id NOT IN (SELECT id FROM events);",
+	"DELETE FROM event_hashes WHERE created_at < ?;",
+	"DELETE FROM event_keys WHERE created_at < ?;",
+	"DELETE FROM experiment_variants WHERE experiment = ?;",
+	"DELETE FROM experiments WHERE name = ?;",
+	"DELETE FROM favorites WHERE user_id = ? AND entity_type = ? AND entity_id = ?;",
+	"DELETE FROM feature_flags WHERE name = ?;",
+	"DELETE FROM file_checkpoints WHERE dir = ? AND name = ?;",
+	"DELETE FROM follows WHERE user_id = ? AND entity_type = ? AND entity_id = ?;",
+	"DELETE FROM idempotency_keys WHERE created_at < ?;",
+	"DELETE FROM idempotency_keys WHERE tenant = ? AND key = ?;",
+	"DELETE FROM main.event_lineage WHERE event_id = ?;",
+	"DELETE FROM main.events WHERE id IN (SELECT value FROM json_each(?));",
+	"DELETE FROM operations WHERE id = ?;",
+	"DELETE FROM push_devices WHERE token = ?;",
+	"DELETE FROM recovery_codes WHERE user_id = ?;",
+	"DELETE FROM related_entities;",
+	"DELETE FROM rollup_daily WHERE bucket >= ?;",
+	"DELETE FROM rollup_hourly WHERE bucket >= ?;",
+	"DELETE FROM schema_migrations WHERE version = ?;",
+	"DELETE FROM sessions WHERE user_id = ?;",
+	"DELETE FROM signature_nonces WHERE expires_at < ?;",
+	"DELETE FROM signing_keys WHERE key_id = ?;",
+	"DELETE FROM sqlite_sequence WHERE name = 'event_rows';",
+	"DELETE FROM trending_scores;",
+	"DELETE FROM users WHERE id = ?;",
+	"DROP TABLE main.events;",
+	"INSERT INTO blob_uploads (id, length, received, content_type, created_at, updated_at) VALUES (?, ?, 0, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP);",
+	"INSERT INTO blobs (sha256, size, content_type, created_at, uploaded_at) VALUES (?, ?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP) ON CONFLICT(sha256) DO UPDATE SET uploaded_at = excluded.uploaded_at;",
+	"INSERT INTO dead_letters (tenant, payload, stage, error, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?);",
+	"INSERT INTO dictionary (kind, value) VALUES (?, ?) ON CONFLICT(kind, value) DO UPDATE SET value = excluded.value RETURNING id;",
+	"INSERT INTO entity_documents (tenant, entity_type, entity_id, version, body, updated_at) VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP) ON CONFLICT(tenant, entity_type, entity_id) DO UPDATE SET version = excluded.version, body = excluded.body, updated_at = excluded.updated_at;",
+	"INSERT INTO entity_owners (entity_type, entity_id, email) VALUES (?, ?, ?) ON CONFLICT(entity_type, entity_id) DO UPDATE SET email = excluded.email;",
+	"INSERT INTO event_counters (entity_type, action, seen, stored) VALUES (?, ?, ?, ?) ON CONFLICT(entity_type, action) DO UPDATE SET seen = seen + excluded.seen, stored = stored + excluded.stored;",
+	"INSERT INTO event_rows (id, entity_type_id, action_id, entity_id, item_id, item_type_id, additional_info, created_at, tenant, user_id) SELECT e.id, et.id, a.id, e.entity_id, e.item_id, it.id, e.additional_info, e.created_at, e.tenant, e.user_id FROM main.events e LEFT JOIN dictionary et ON et.kind = 'entity_type' AND et.value = e.entity_type LEFT JOIN dictionary a ON a.kind = 'action' AND a.value = e.action LEFT JOIN dictionary it ON it.kind = 'item_type' AND it.value = e.item_type;",
+	"INSERT INTO experiment_variants (experiment, name, weight, position) VALUES (?, ?, ?, ?);",
+	"INSERT INTO experiments (name, description, status, created_at, updated_at) VALUES (?, ?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP) ON CONFLICT(name) DO UPDATE SET description = excluded.description, status = excluded.status, updated_at = CURRENT_TIMESTAMP;",
+	"INSERT INTO favorites (user_id, entity_type, entity_id, created_at) VALUES (?, ?, ?, CURRENT_TIMESTAMP) ON CONFLICT(user_id, entity_type, entity_id) DO NOTHING;",
+	"INSERT INTO feature_flags (name, enabled, tenants, percent, updated_at) VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP) ON CONFLICT(name) DO UPDATE SET enabled = excluded.enabled, tenants = excluded.tenants, percent = excluded.percent, updated_at = CURRENT_TIMESTAMP;",
+	"INSERT INTO file_checkpoints (dir, name, line, updated_at) VALUES (?, ?, ?, CURRENT_TIMESTAMP) ON CONFLICT(dir, name) DO UPDATE SET line = excluded.line, updated_at = excluded.updated_at;",
+	"INSERT INTO follows (user_id, entity_type, entity_id, created_at) VALUES (?, ?, ?, CURRENT_TIMESTAMP) ON CONFLICT(user_id, entity_type, entity_id) DO NOTHING;",
+	"INSERT INTO idempotency_keys (tenant, key, fingerprint, created_at) VALUES (?, ?, ?, ?) ON CONFLICT (tenant, key) DO UPDATE SET created_at = excluded.created_at WHERE status IS NULL AND created_at < ? AND fingerprint = excluded.fingerprint;",
+	"INSERT INTO job_state (name, value) VALUES ('rollups', ?) ON CONFLICT(name) DO UPDATE SET value = excluded.value;",
+	"INSERT INTO job_state (name, value) VALUES (?, ?) ON CONFLICT (name) DO UPDATE SET value = excluded.value;",
+	"INSERT INTO main.event_hashes (tenant, hash, event_id, created_at) VALUES (?, ?, ?, ?) ON CONFLICT (tenant, hash) DO UPDATE SET event_id = excluded.event_id, created_at = excluded.created_at WHERE created_at < ?;",
+	"INSERT INTO main.event_keys (tenant, key, event_id) VALUES (?, ?, ?) ON CONFLICT (tenant, key) DO NOTHING;",
+	"INSERT INTO main.event_upserts (tenant, entity_type, entity_id, item_id, event_id) VALUES (?, ?, ?, ?, ?) ON CONFLICT (tenant, entity_type, entity_id, item_id) DO UPDATE SET event_id = excluded.event_id;",
+	"INSERT INTO main.generated_ids (tenant, entity_type, entity_id, event_id) VALUES (?, ?, ?, ?) ON CONFLICT (tenant, entity_type, entity_id) DO NOTHING;",
+	"INSERT INTO notification_prefs (email, token) VALUES (?, ?) ON CONFLICT(email) DO NOTHING;",
+	"INSERT INTO operations (id, kind, tenant, state, created_at) VALUES (?, ?, ?, 'running', ?);",
+	"INSERT INTO pulled_files (partner, name, sha256, duplicate, pulled_at) VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP);",
+	"INSERT INTO push_deliveries (token, platform, entity_type, entity_id, action, status, error, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP);",
+	"INSERT INTO push_devices (token, platform, entity_type, entity_id, created_at) VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP) ON CONFLICT(token, entity_type, entity_id) DO UPDATE SET platform = excluded.platform;",
+	"INSERT INTO query_plans (hash, statement, plan, checked_at) VALUES (?, ?, ?, CURRENT_TIMESTAMP) ON CONFLICT(hash) DO NOTHING;",
+	"INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?);",
+	"INSERT INTO related_entities (tenant, entity_type, entity_id, rank, related_type, related_id, sessions, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP);",
+	"INSERT INTO resume_tokens (source, token, updated_at) VALUES (?, ?, CURRENT_TIMESTAMP) ON CONFLICT(source) DO UPDATE SET token = excluded.token, updated_at = excluded.updated_at;",
+	"INSERT INTO rollup_daily (bucket, entity_type, action, tenant, count) SELECT substr(bucket, 1, 10), entity_type, action, tenant, SUM(count) FROM rollup_hourly WHERE bucket >= ? GROUP BY 1, 2, 3, 4;",
+	"INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?);",
+	"INSERT INTO sessions (id, user_id, refresh_hash, user_agent, mfa, created_at, last_used_at, expires_at) VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?);",
+	"INSERT INTO signature_nonces (key_id, nonce, expires_at) VALUES (?, ?, ?) ON CONFLICT(key_id, nonce) DO NOTHING;",
+	"INSERT INTO signing_keys (key_id, partner, algorithm, key, updated_at) VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP) ON CONFLICT(key_id) DO UPDATE SET partner = excluded.partner, algorithm = excluded.algorithm, key = excluded.key, updated_at = CURRENT_TIMESTAMP;",
+	"INSERT INTO sqlite_sequence (name, seq) SELECT 'event_rows', seq FROM sqlite_sequence WHERE name = 'events';",
+	"INSERT INTO tenant_usage (month, tenant, storage_bytes, peak_storage_bytes) VALUES (?, ?, ?, ?) ON CONFLICT (month, tenant) DO UPDATE SET storage_bytes = excluded.storage_bytes, peak_storage_bytes = MAX(peak_storage_bytes, excluded.storage_bytes);",
+	"INSERT INTO tenant_usage (month, tenant, writes, query_ms, egress_bytes) VALUES (?, ?, ?, ?, ?) ON CONFLICT (month, tenant) DO UPDATE SET writes = writes + excluded.writes, query_ms = query_ms + excluded.query_ms, egress_bytes = egress_bytes + excluded.egress_bytes;",
+	"INSERT INTO tracking_events (entity_type, action, entity_id, item_id, item_type, tenant) VALUES (?, ?, ?, ?, ?, ?);",
+	"INSERT INTO trending_scores (tenant, entity_type, entity_id, rank, score, events, updated_at) VALUES (?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP);",
+	"INSERT INTO user_notifications (user_id, reason, entity_type, entity_id, action, item_type, item_id, created_at) SELECT user_id, ?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP FROM follows WHERE entity_type = ? AND entity_id = ? AND user_id != ?;",
+	"INSERT INTO users (email, password_hash, display_name, created_at, updated_at) VALUES (?, ?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP) ON CONFLICT(email) DO NOTHING;",
+	"INSERT OR IGNORE INTO cold.events (id, entity_type, action, entity_id, item_id, item_type, additional_info, created_at, tenant, user_id) SELECT id, entity_type, action, entity_id, item_id, item_type, additional_info, created_at, tenant, user_id FROM main.events WHERE id IN (SELECT value FROM json_each(?));",
+	"INSERT OR IGNORE INTO dictionary (kind, value) SELECT 'entity_type', entity_type FROM main.events WHERE entity_type IS NOT NULL UNION SELECT 'action', action FROM main.events WHERE action IS NOT NULL UNION SELECT 'item_type', item_type FROM main.events WHERE item_type IS NOT NULL;",
+	"INSERT OR IGNORE INTO event_attachments (event_id, sha256) VALUES (?, ?);",
+	"INSERT OR REPLACE INTO cold.events (id, entity_type, action, entity_id, item_id, item_type, additional_info, created_at, tenant, user_id) VALUES (?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''), ?, NULLIF(?, 0));",
+	"INSERT OR REPLACE INTO main.event_lineage (event_id, tenant, connector, origin, position, source, enrichments, received_at, stored_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);",
+	"PRAGMA integrity_check;",
+	"PRAGMA quick_check;",
+	"PRAGMA wal_checkpoint(TRUNCATE);",
+	"SELECT COUNT(*) FROM blobs WHERE sha256 = ?;",
+	"SELECT COUNT(*) FROM pragma_table_info(?, 'main') WHERE name = ?;",
+	"SELECT COUNT(*) FROM pulled_files WHERE partner = ? AND name = ?;",
+	"SELECT COUNT(*) FROM pulled_files WHERE partner = ? AND sha256 = ?;",
+	"SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?;",
+	"SELECT DISTINCT entity_type, action FROM event_totals ORDER BY entity_type, action;",
+	"SELECT DISTINCT tenant FROM event_totals WHERE tenant != '' ORDER BY tenant;",
+	"SELECT IFNULL(MAX(version), 0) FROM schema_migrations;",
+	"SELECT IFNULL(action, ''), COUNT(*) FROM ( SELECT entity_type, action, entity_id, tenant, created_at FROM events UNION ALL SELECT entity_type, action, entity_id, tenant, created_at FROM tracking_events ) WHERE entity_type = ? AND created_at >= ? AND created_at < ? AND (? = '' OR tenant = ?) GROUP BY 1;",
+	"SELECT IFNULL(entity_type, ''), IFNULL(action, ''), IFNULL(entity_id, ''), IFNULL(item_id, ''), IFNULL(item_type, ''), additional_info, tenant, IFNULL(user_id, 0), IFNULL(created_at, '') FROM cold.events WHERE id = ?;",
+	"SELECT body, version FROM entity_documents WHERE tenant = ? AND entity_type = ? AND entity_id = ?;",
+	"SELECT bucket, SUM(count) FROM rollup_daily WHERE bucket >= ? AND bucket <= ? AND (? = '' OR entity_type = ?) AND (? = '' OR action = ?) AND (? = '' OR tenant = ?) GROUP BY bucket ORDER BY bucket;",
+	"SELECT bucket, SUM(count) FROM rollup_hourly WHERE bucket >= ? AND bucket <= ? AND (? = '' OR entity_type = ?) AND (? = '' OR action = ?) AND (? = '' OR tenant = ?) GROUP BY bucket ORDER BY bucket;",
+	"SELECT connector, origin, position, source, enrichments, received_at, stored_at FROM event_lineage WHERE event_id = ? AND tenant = ?;",
+	"SELECT content_type FROM blobs WHERE sha256 = ?;",
+	"SELECT e.name, e.description, e.status, IFNULL(v.name, ''), IFNULL(v.weight, 0) FROM experiments e LEFT JOIN experiment_variants v ON v.experiment = e.name WHERE ? = '' OR e.status = ? ORDER BY e.name, v.position;",
+	"SELECT email FROM entity_owners WHERE entity_type = ? AND entity_id = ?;",
+	"SELECT email, totp_enabled FROM users WHERE id = ?;",
+	"SELECT email, updates, reviews, flags, unsubscribed FROM notification_prefs WHERE token = ?;",
+	"SELECT email, updates, reviews, flags, unsubscribed, token FROM notification_prefs WHERE email = ?;",
+	"SELECT entity_id, COUNT(*) FROM ( SELECT entity_type, action, entity_id, tenant, created_at FROM events UNION ALL SELECT entity_type, action, entity_id, tenant, created_at FROM tracking_events ) WHERE entity_type = ? AND created_at >= ? AND created_at < ? AND (? = '' OR tenant = ?) AND entity_id IN (SELECT value FROM json_each(?)) GROUP BY entity_id;",
+	"SELECT entity_id, COUNT(*) FROM ( SELECT entity_type, action, entity_id, tenant, created_at FROM events UNION ALL SELECT entity_type, action, entity_id, tenant, created_at FROM tracking_events ) WHERE entity_type = ? AND created_at >= ? AND created_at < ? AND (? = '' OR tenant = ?) GROUP BY entity_id ORDER BY 2 DESC, 1 LIMIT ?;",
+	"SELECT entity_id, COUNT(*) FROM follows WHERE entity_type = ? AND entity_id IN (SELECT value FROM json_each(?)) GROUP BY entity_id;",
+	"SELECT entity_type, action, tenant, count FROM event_totals WHERE (? = '' OR entity_type = ?) AND (? = '' OR action = ?) AND (? = '' OR tenant = ?) ORDER BY entity_type, action, tenant;",
+	"SELECT entity_type, entity_id, action, status, error, created_at FROM push_deliveries WHERE token = ? ORDER BY id DESC LIMIT 100;",
+	"SELECT entity_type, entity_id, created_at FROM follows WHERE user_id = ? ORDER BY created_at DESC;",
+	"SELECT fingerprint, status, content_type, body FROM idempotency_keys WHERE tenant = ? AND key = ?;",
+	"SELECT hash, plan FROM query_plans;",
+	"SELECT hash, statement, plan, previous_plan, IFNULL(changed_at, '') FROM query_plans WHERE ? OR previous_plan != '' ORDER BY changed_at DESC, hash;",
+	"SELECT id FROM blob_uploads WHERE updated_at < ?;",
+	"SELECT id FROM dead_letters WHERE tenant = ? ORDER BY id;",
+	"SELECT id FROM main.events WHERE created_at < ? AND id NOT IN (SELECT event_id FROM main.event_attachments) ORDER BY id LIMIT ?;",
+	"SELECT id FROM operations WHERE expires_at < ?;",
+	"SELECT id, IFNULL(entity_type, ''), IFNULL(action, ''), IFNULL(entity_id, ''), IFNULL(item_id, ''), IFNULL(item_type, ''), additional_info, tenant, IFNULL(user_id, 0), IFNULL(created_at, '') FROM ( SELECT id, entity_type, action, entity_id, item_id, item_type, additional_info, user_id, created_at, tenant FROM events UNION ALL SELECT id, entity_type, action, entity_id, item_id, item_type, additional_info, user_id, created_at, tenant FROM cold.events ) WHERE tenant = ? AND (? = '' OR entity_type = ?) AND (? = '' OR created_at >= ?) AND (? = '' OR created_at < ?) ORDER BY created_at, id;",
+	"SELECT id, IFNULL(entity_type, ''), IFNULL(action, ''), IFNULL(entity_id, ''), IFNULL(item_id, ''), IFNULL(item_type, ''), additional_info, tenant, IFNULL(user_id, 0), IFNULL(created_at, '') FROM events WHERE tenant = ? AND (? = '' OR entity_type = ?) AND (? = '' OR created_at >= ?) AND (? = '' OR created_at < ?) ORDER BY created_at, id;",
+	"SELECT id, email, display_name, bio, avatar_url, role, created_at FROM users WHERE id = ?;",
+	"SELECT id, kind, state, done, total, result, error, file, content_type, created_at, finished_at, expires_at FROM operations WHERE id = ? AND tenant = ?;",
+	"SELECT id, kind, state, done, total, result, error, file, content_type, created_at, finished_at, expires_at FROM operations WHERE tenant = ? ORDER BY created_at DESC, id LIMIT ?;",
+	"SELECT id, password_hash, role, totp_enabled FROM users WHERE email = ?;",
+	"SELECT id, reason, entity_type, entity_id, action, item_type, item_id, created_at, read_at IS NOT NULL FROM user_notifications WHERE user_id = ? AND (? = '' OR read_at IS NULL) AND (? = 0 OR id < ?) ORDER BY id DESC LIMIT ? OFFSET ?;",
+	"SELECT id, tenant, payload, stage, error, attempts, created_at, updated_at FROM dead_letters WHERE ? OR tenant = ? ORDER BY id LIMIT ?;",
+	"SELECT id, user_agent, created_at, last_used_at, expires_at FROM sessions WHERE user_id = ? AND revoked = 0 AND expires_at > ? ORDER BY last_used_at DESC;",
+	"SELECT key_id, partner, algorithm, key FROM signing_keys;",
+	"SELECT kind, entity_type, entity_id, action, item_id, item_type, created_at, source, rid FROM ( SELECT CASE WHEN lower(action) IN ('review', 'reviewed') THEN 'review' ELSE 'submission' END AS kind, entity_type, entity_id, action, item_id, item_type, COALESCE(created_at, '') AS created_at, 0 AS source, id AS rid FROM ( SELECT id, entity_type, entity_id, action, item_id, item_type, created_at FROM events WHERE user_id = ? UNION ALL SELECT id, entity_type, entity_id, action, item_id, item_type, created_at FROM cold.events WHERE user_id = ? ) UNION ALL SELECT 'favorite', entity_type, entity_id, '', '', '', COALESCE(created_at, ''), 1, rowid FROM favorites WHERE user_id = ? ) WHERE (? = '' OR kind = ?) AND (? = 0 OR (created_at, source, rid) < (?, ?, ?)) ORDER BY created_at DESC, source DESC, rid DESC LIMIT ? OFFSET ?;",
+	"SELECT kind, entity_type, entity_id, action, item_id, item_type, created_at, source, rid FROM ( SELECT CASE WHEN lower(action) IN ('review', 'reviewed') THEN 'review' ELSE 'submission' END AS kind, entity_type, entity_id, action, item_id, item_type, COALESCE(created_at, '') AS created_at, 0 AS source, id AS rid FROM events WHERE user_id = ? UNION ALL SELECT 'favorite', entity_type, entity_id, '', '', '', COALESCE(created_at, ''), 1, rowid FROM favorites WHERE user_id = ? ) WHERE (? = '' OR kind = ?) AND (? = 0 OR (created_at, source, rid) < (?, ?, ?)) ORDER BY created_at DESC, source DESC, rid DESC LIMIT ? OFFSET ?;",
+	"SELECT length, received, content_type, sha256 FROM blob_uploads WHERE id = ?;",
+	"SELECT line FROM file_checkpoints WHERE dir = ? AND name = ?;",
+	"SELECT month, tenant, writes, query_ms, egress_bytes, storage_bytes, peak_storage_bytes FROM tenant_usage WHERE month = ? ORDER BY tenant;",
+	"SELECT name FROM pragma_database_list WHERE name NOT IN ('main', 'temp');",
+	"SELECT name FROM pragma_table_info(?);",
+	"SELECT name, enabled, tenants, percent FROM feature_flags;",
+	"SELECT payload FROM dead_letters WHERE id = ?;",
+	"SELECT related_type, related_id, sessions FROM related_entities WHERE tenant = ? AND entity_type = ? AND entity_id = ? ORDER BY rank LIMIT ?;",
+	"SELECT rowid, version, body FROM entity_documents WHERE rowid > ? AND typeof(body) = 'text' AND length(body) >= ? ORDER BY rowid LIMIT ?;",
+	"SELECT s.user_id, s.refresh_hash, s.previous_hash, s.revoked, s.mfa, u.role FROM sessions s JOIN users u ON u.id = s.user_id WHERE s.id = ? AND s.expires_at > ?;",
+	"SELECT sha256 FROM blobs WHERE uploaded_at < ? AND sha256 NOT IN (SELECT sha256 FROM event_attachments);",
+	"SELECT sha256 FROM event_attachments WHERE event_id = ? ORDER BY sha256;",
+	"SELECT sql FROM sqlite_master WHERE tbl_name = ? AND type IN ('index', 'trigger') AND sql IS NOT NULL ORDER BY type, name;",
+	"SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?;",
+	"SELECT tenant, entity_type, entity_id, strftime('%Y-%m-%d %H:00:00', created_at), COUNT(*) FROM ( SELECT tenant, entity_type, entity_id, created_at FROM events WHERE created_at >= ?1 UNION ALL SELECT tenant, entity_type, entity_id, created_at FROM tracking_events WHERE created_at >= ?1 ) WHERE entity_type != '' AND entity_id != '' GROUP BY 1, 2, 3, 4;",
+	"SELECT token FROM resume_tokens WHERE source = ?;",
+	"SELECT token, platform FROM push_devices WHERE entity_type = ? AND entity_id = ?;",
+	"SELECT totp_secret, totp_enabled FROM users WHERE id = ?;",
+	"SELECT totp_secret, totp_last_step, totp_locked_until FROM users WHERE id = ?;",
+	"SELECT type FROM sqlite_master WHERE name = 'events';",
+	"SELECT u.role, s.mfa FROM sessions s JOIN users u ON u.id = s.user_id WHERE s.id = ? AND s.user_id = ? AND s.revoked = 0 AND s.expires_at > ?;",
+	"SELECT user_id, tenant, entity_type, entity_id, created_at FROM events WHERE user_id IS NOT NULL AND created_at >= ? AND entity_type != '' AND entity_id != '' ORDER BY user_id, created_at;",
+	"SELECT value FROM job_state WHERE name = 'rollups';",
+	"SELECT value FROM job_state WHERE name = ?;",
+	"UPDATE blob_uploads SET received = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?;",
+	"UPDATE blob_uploads SET sha256 = ? WHERE id = ?;",
+	"UPDATE blobs SET uploaded_at = CURRENT_TIMESTAMP WHERE sha256 = ?;",
+	"UPDATE dead_letters SET error = ?, attempts = attempts + 1, updated_at = ? WHERE id = ?;",
+	"UPDATE entity_documents SET body = ? WHERE rowid = ? AND version = ?;",
+	"UPDATE idempotency_keys SET status = ?, content_type = ?, body = ? WHERE tenant = ? AND key = ?;",
+	"UPDATE notification_prefs SET unsubscribed = 1 WHERE token = ?;",
+	"UPDATE notification_prefs SET updates = ?, reviews = ?, flags = ?, unsubscribed = ? WHERE token = ?;",
+	"UPDATE operations SET state = 'failed', error = 'interrupted by a restart', finished_at = ?1, expires_at = ?2 WHERE state = 'running';",
+	"UPDATE operations SET state = ?, done = ?, total = ?, result = ?, error = ?, file = ?, content_type = ?, finished_at = ?, expires_at = ? WHERE id = ?;",
+	"UPDATE query_plans SET checked_at = CURRENT_TIMESTAMP WHERE hash = ?;",
+	"UPDATE query_plans SET previous_plan = '' WHERE hash = ?;",
+	"UPDATE query_plans SET previous_plan = CASE WHEN previous_plan = '' THEN plan ELSE previous_plan END, plan = ?, changed_at = CURRENT_TIMESTAMP, checked_at = CURRENT_TIMESTAMP WHERE hash = ?;",
+	"UPDATE recovery_codes SET used_at = CURRENT_TIMESTAMP WHERE user_id = ? AND code_hash = ? AND used_at IS NULL;",
+	"UPDATE sessions SET mfa = 0 WHERE user_id = ?;",
+	"UPDATE sessions SET mfa = 1 WHERE id = ?;",
+	"UPDATE sessions SET refresh_hash = ?, previous_hash = refresh_hash, last_used_at = CURRENT_TIMESTAMP, expires_at = ? WHERE id = ? AND refresh_hash = ?;",
+	"UPDATE sessions SET revoked = 1 WHERE id = ? AND user_id = ?;",
+	"UPDATE sessions SET revoked = 1 WHERE id = ?;",
+	"UPDATE user_notifications SET read_at = CURRENT_TIMESTAMP WHERE user_id = ? AND read_at IS NULL;",
+	"UPDATE users SET display_name = ?, bio = ?, avatar_url = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?;",
+	"UPDATE users SET role = 'admin', updated_at = CURRENT_TIMESTAMP WHERE email = ? AND NOT EXISTS (SELECT 1 FROM users WHERE role = 'admin');",
+	"UPDATE users SET role = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?;",
+	"UPDATE users SET totp_enabled = 0, totp_secret = '' WHERE id = ?;",
+	"UPDATE users SET totp_enabled = 1, totp_last_step = ? WHERE id = ?;",
+	"UPDATE users SET totp_failures = 0 WHERE id = ?;",
+	"UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?;",
+	"UPDATE users SET totp_locked_until = CASE WHEN totp_failures + 1 >= ? THEN ? ELSE totp_locked_until END, totp_failures = CASE WHEN totp_failures + 1 >= ? THEN 0 ELSE totp_failures + 1 END WHERE id = ?;",
+	"UPDATE users SET totp_secret = ?, totp_last_step = 0 WHERE id = ?;",
+}
@@ -0,0 +1,271 @@
+// Package sqlguard checks that every SQL statement sent to SQLite is one
+// the code base registered, so a query built from user input cannot reach
+// the database. The catalog of registered statements is generated by
+// cmd/sqlcheck, which also fails on queries that are not constants.
+// Statements that must name a schema or another trusted part are Templates
+// declared at package level, whose arguments are registered while the
+// server starts; Seal then closes the set, so it stays fixed while
+// requests are served.
+package sqlguard
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"modernc.org/sqlite"
+)
+
+// DriverName is the database/sql driver of a guarded SQLite database.
+const DriverName = "sqlite-guarded"
+
+// Modes of the guard.
+const (
+	// Off sends every statement.
+	Off = "off"
+	// Audit logs and counts unregistered statements but sends them.
+	Audit = "audit"
+	// Enforce rejects unregistered statements with ErrUnregistered.
+	Enforce = "enforce"
+)
+
+// ErrUnregistered is returned for statements outside the catalog in
+// Enforce mode.
+var ErrUnregistered = errors.New("sqlguard: unregistered SQL statement")
+
+// metrics counts unregistered statements, published under "sqlguard" in
+// expvar.
+var metrics = expvar.NewMap("sqlguard")
+
+var (
+	base    = &sqlite.Driver{}
+	mode    atomic.Value // string
+	catalog = make(map[string]bool)
+	logged  sync.Map // normalized statement -> true
+
+	// mu guards the statements registered from templates.
+	mu        sync.RWMutex
+	sealed    bool
+	schemas   = []string{"main"}
+	templates []*Template
+	expanded  = make(map[string]bool)
+)
+
+func init() {
+	for _, s := range statements {
+		catalog[s] = true
+	}
+	mode.Store(Audit)
+	sql.Register(DriverName, guardDriver{base})
+}
+
+// RegisterConnectionHook runs fn on every new connection of a guarded
+// database, before it is used. Statements fn runs are not checked.
+func RegisterConnectionHook(fn sqlite.ConnectionHookFn) {
+	base.RegisterConnectionHook(fn)
+}
+
+// SetMode switches the guard to Off, Audit or Enforce. The default is
+// Audit.
+func SetMode(m string) error {
+	switch m {
+	case Off, Audit, Enforce:
+		mode.Store(m)
+		return nil
+	case "":
+		mode.Store(Audit)
+		return nil
+	}
+	return fmt.Errorf("sqlguard: unknown mode %q", m)
+}
+
+// Template is a statement with verbs, filled in by Format. Only the
+// statements of registered arguments pass the guard: a schema template's
+// are registered for every schema added with AddSchema, and any template's
+// with Register. Templates are declared at package level, with a constant
+// text, which cmd/sqlcheck checks.
+type Template struct {
+	text   string
+	schema bool
+}
+
+// NewTemplate returns the template text, whose arguments are registered
+// with Register.
+func NewTemplate(text string) *Template {
+	return &Template{text: text}
+}
+
+// NewSchemaTemplate returns the template text, whose only argument is a
+// schema: main or one added with AddSchema.
+func NewSchemaTemplate(text string) *Template {
+	t := &Template{text: text, schema: true}
+	mu.Lock()
+	defer mu.Unlock()
+	templates = append(templates, t)
+	for _, s := range schemas {
+		expanded[Normalize(t.Format(s))] = true
+	}
+	return t
+}
+
+// Format returns the statement of t for args.
+func (t *Template) Format(args ...any) string {
+	return fmt.Sprintf(t.text, args...)
+}
+
+// Register lets the statement of t for args pass the guard. Only pass
+// arguments from trusted parts of the program, before Seal; values from
+// requests belong in query arguments.
+func (t *Template) Register(args ...any) {
+	mu.Lock()
+	defer mu.Unlock()
+	if sealed {
+		panic("sqlguard: statement registered after Seal")
+	}
+	expanded[Normalize(t.Format(args...))] = true
+}
+
+// AddSchema registers the statements of every schema template for the
+// attached database name, before Seal.
+func AddSchema(name string) {
+	mu.Lock()
+	defer mu.Unlock()
+	if sealed {
+		panic("sqlguard: schema added after Seal")
+	}
+	if slices.Contains(schemas, name) {
+		return
+	}
+	schemas = append(schemas, name)
+	for _, t := range templates {
+		expanded[Normalize(t.Format(name))] = true
+	}
+}
+
+// Seal ends registration: the statements passing the guard are fixed from
+// then on. Call it once the server is set up, before serving requests.
+func Seal() {
+	mu.Lock()
+	defer mu.Unlock()
+	sealed = true
+}
+
+// explainPrefix starts the query plan of a statement, see Explain.
+const explainPrefix = "EXPLAIN QUERY PLAN "
+
+// Explain returns the statement explaining the query plan of query, which
+// passes the guard whenever query does.
+func Explain(query string) string {
+	return explainPrefix + query
+}
+
+// Normalize collapses whitespace so formatting does not change how a
+// statement is looked up.
+func Normalize(query string) string {
+	return strings.Join(strings.Fields(query), " ")
+}
+
+// Registered reports whether query is in the catalog, was registered
+// from a template, or explains one that is.
+func Registered(query string) bool {
+	n := Normalize(query)
+	if explained, ok := strings.CutPrefix(n, explainPrefix); ok {
+		n = explained
+	}
+	if catalog[n] {
+		return true
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	return expanded[n]
+}
+
+// Statements returns the catalog, sorted.
+func Statements() []string {
+	return append([]string(nil), statements...)
+}
+
+// check applies the current mode to query.
+func check(query string) error {
+	m := mode.Load().(string)
+	if m == Off || Registered(query) {
+		return nil
+	}
+	metrics.Add("unregistered", 1)
+	n := Normalize(query)
+	if len(n) > 200 {
+		n = n[:200] + "..."
+	}
+	if m == Enforce {
+		metrics.Add("rejected", 1)
+		return fmt.Errorf("%w: %s", ErrUnregistered, n)
+	}
+	if _, seen := logged.LoadOrStore(n, true); !seen {
+		log.Printf("Unregistered SQL statement: %s", n)
+	}
+	return nil
+}
+
+// guardDriver wraps the SQLite driver, checking statements before they
+// are prepared or run.
+type guardDriver struct {
+	driver.Driver
+}
+
+func (d guardDriver) Open(name string) (driver.Conn, error) {
+	c, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return conn{c}, nil
+}
+
+// conn forwards to the SQLite connection, whose optional interfaces
+// database/sql would otherwise not see through the wrapper.
+type conn struct {
+	driver.Conn
+}
+
+func (c conn) Prepare(query string) (driver.Stmt, error) {
+	if err := check(query); err != nil {
+		return nil, err
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c conn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if err := check(query); err != nil {
+		return nil, err
+	}
+	return c.Conn.(driver.ConnPrepareContext).PrepareContext(ctx, query)
+}
+
+func (c conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if err := check(query); err != nil {
+		return nil, err
+	}
+	return c.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+}
+
+func (c conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if err := check(query); err != nil {
+		return nil, err
+	}
+	return c.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+}
+
+func (c conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+func (c conn) Ping(ctx context.Context) error {
+	return c.Conn.(driver.Pinger).Ping(ctx)
+}
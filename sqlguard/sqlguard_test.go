@@ -0,0 +1,127 @@
+package sqlguard
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+// Templates of the tests, declared at package level like the module's.
+var (
+	testCountSQL  = NewSchemaTemplate(`SELECT COUNT(*) FROM %s.items;`)
+	testColumnSQL = NewTemplate(`SELECT %s FROM main.items;`)
+)
+
+// unseal lets a test register statements again after one sealed the guard.
+func unseal(t *testing.T) {
+	t.Cleanup(func() {
+		mu.Lock()
+		sealed = false
+		mu.Unlock()
+	})
+}
+
+func TestSchemaTemplate(t *testing.T) {
+	if !Registered(testCountSQL.Format("main")) {
+		t.Error("statement on main not registered")
+	}
+	if Registered(testCountSQL.Format("extra")) {
+		t.Error("statement on a schema not yet added registered")
+	}
+	AddSchema("extra")
+	if !Registered(testCountSQL.Format("extra")) {
+		t.Error("statement on an added schema not registered")
+	}
+	// Templates declared after a schema was added cover it too.
+	late := NewSchemaTemplate(`DELETE FROM %s.items;`)
+	if !Registered(late.Format("extra")) {
+		t.Error("later template not registered for an added schema")
+	}
+	if Registered(testCountSQL.Format("main; DROP TABLE items")) {
+		t.Error("statement on an unknown schema registered")
+	}
+}
+
+func TestTemplateRegister(t *testing.T) {
+	if Registered(testColumnSQL.Format("name")) {
+		t.Error("statement registered before its arguments")
+	}
+	testColumnSQL.Register("name")
+	if !Registered(testColumnSQL.Format("name")) {
+		t.Error("statement of registered arguments not registered")
+	}
+	if Registered(testColumnSQL.Format("password")) {
+		t.Error("statement of other arguments registered")
+	}
+	// Formatting does not change how a statement is looked up.
+	if !Registered("SELECT name\n\tFROM main.items;") {
+		t.Error("reformatted statement not registered")
+	}
+}
+
+func TestExplain(t *testing.T) {
+	testColumnSQL.Register("id")
+	if !Registered(Explain(testColumnSQL.Format("id"))) {
+		t.Error("plan of a registered statement not registered")
+	}
+	if Registered(Explain(`SELECT password FROM main.items;`)) {
+		t.Error("plan of an unregistered statement registered")
+	}
+}
+
+func TestSeal(t *testing.T) {
+	unseal(t)
+	Seal()
+	for name, register := range map[string]func(){
+		"Register":  func() { testColumnSQL.Register("sealed") },
+		"AddSchema": func() { AddSchema("sealed") },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s after Seal did not panic", name)
+				}
+			}()
+			register()
+		}()
+	}
+	if Registered(testColumnSQL.Format("sealed")) {
+		t.Error("statement registered after Seal")
+	}
+}
+
+func TestEnforce(t *testing.T) {
+	t.Cleanup(func() { SetMode(Audit) })
+	db, err := sql.Open(DriverName, ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	if err := SetMode(Off); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`CREATE TABLE items (id INTEGER, name TEXT, password TEXT);`); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetMode(Enforce); err != nil {
+		t.Fatal(err)
+	}
+
+	var n int
+	if err := db.QueryRow(testCountSQL.Format("main")).Scan(&n); err != nil {
+		t.Errorf("registered statement: %v", err)
+	}
+	testColumnSQL.Register("name")
+	var name sql.NullString
+	if err := db.QueryRow(testColumnSQL.Format("name")).Scan(&name); err != nil && err != sql.ErrNoRows {
+		t.Errorf("registered statement: %v", err)
+	}
+	if err := db.QueryRow(testColumnSQL.Format("password")).Scan(&name); !errors.Is(err, ErrUnregistered) {
+		t.Errorf("unregistered statement: got %v, want ErrUnregistered", err)
+	}
+	if _, err := db.Exec(`DROP TABLE items;`); !errors.Is(err, ErrUnregistered) {
+		t.Errorf("unregistered statement: got %v, want ErrUnregistered", err)
+	}
+}
@@ -0,0 +1,310 @@
+// Package standby keeps a warm standby instance. The primary logs every
+// change to its events and serves the log as a change feed; the standby
+// applies the feed, refuses writes, and takes over once promoted.
+package standby
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"naevis/apierror"
+	"naevis/compression"
+	"naevis/config"
+	"naevis/cursor"
+	"naevis/routing"
+	"naevis/sqlguard"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// tokenHeader carries the token of the feed.
+	tokenHeader = "X-Replication-Token"
+	// defaultPage and maxPage bound the changes of a page, per schema.
+	defaultPage = 500
+	maxPage     = 5000
+)
+
+// metrics are published under "standby" in expvar.
+var metrics = expvar.NewMap("standby")
+
+// logSchema is the change log of the schema %[1]s: the ids of the events
+// inserted, updated or deleted, in order. Triggers cannot reach other
+// databases, so every schema logs its own. The log only holds ids; the
+// feed reads the events as they are when it is served, so a standby
+// catching up skips the states in between.
+var logSchema = []*sqlguard.Template{
+	sqlguard.NewSchemaTemplate(`CREATE TABLE IF NOT EXISTS %[1]s.change_log (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		event_id INTEGER NOT NULL,
+		at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);`),
+	sqlguard.NewSchemaTemplate(`CREATE INDEX IF NOT EXISTS %[1]s.change_log_at ON change_log (at);`),
+	sqlguard.NewSchemaTemplate(`CREATE TRIGGER IF NOT EXISTS %[1]s.event_rows_log_insert AFTER INSERT ON event_rows BEGIN
+		INSERT INTO change_log (event_id) VALUES (NEW.id);
+	END;`),
+	sqlguard.NewSchemaTemplate(`CREATE TRIGGER IF NOT EXISTS %[1]s.event_rows_log_update AFTER UPDATE ON event_rows BEGIN
+		INSERT INTO change_log (event_id) VALUES (NEW.id);
+	END;`),
+	sqlguard.NewSchemaTemplate(`CREATE TRIGGER IF NOT EXISTS %[1]s.event_rows_log_delete AFTER DELETE ON event_rows BEGIN
+		INSERT INTO change_log (event_id) VALUES (OLD.id);
+	END;`),
+}
+
+// Statements on the change log of the schema %[1]s.
+var (
+	// changesSQL reads the changes after a sequence number with the
+	// events changed, if still stored.
+	changesSQL = sqlguard.NewSchemaTemplate(`
+	SELECT c.seq, c.event_id, r.id IS NOT NULL, IFNULL(et.value, ''), IFNULL(a.value, ''), IFNULL(r.entity_id, ''),
+		IFNULL(r.item_id, ''), IFNULL(it.value, ''), r.additional_info, IFNULL(r.tenant, ''), IFNULL(r.user_id, 0),
+		IFNULL(r.created_at, '')
+	FROM %[1]s.change_log c
+	LEFT JOIN %[1]s.event_rows r ON r.id = c.event_id
+	LEFT JOIN main.dictionary et ON et.id = r.entity_type_id
+	LEFT JOIN main.dictionary a ON a.id = r.action_id
+	LEFT JOIN main.dictionary it ON it.id = r.item_type_id
+	WHERE c.seq > ? ORDER BY c.seq LIMIT ?;`)
+	// firstSQL returns the first sequence number the log still holds, or
+	// the next one when it is empty.
+	firstSQL = sqlguard.NewSchemaTemplate(`
+	SELECT IFNULL((SELECT MIN(seq) FROM %[1]s.change_log),
+		IFNULL((SELECT seq FROM %[1]s.sqlite_sequence WHERE name = 'change_log'), 0) + 1);`)
+	// lastSQL returns the last sequence number logged.
+	lastSQL = sqlguard.NewSchemaTemplate(`
+	SELECT IFNULL((SELECT seq FROM %[1]s.sqlite_sequence WHERE name = 'change_log'), 0);`)
+	pruneSQL = sqlguard.NewSchemaTemplate(`
+	DELETE FROM %[1]s.change_log WHERE at < ?;`)
+)
+
+// coldSQL reads an event moved to the cold tier.
+const coldSQL = `
+SELECT IFNULL(entity_type, ''), IFNULL(action, ''), IFNULL(entity_id, ''), IFNULL(item_id, ''), IFNULL(item_type, ''),
+	additional_info, tenant, IFNULL(user_id, 0), IFNULL(created_at, '')
+FROM cold.events WHERE id = ?;`
+
+// ensureLog creates the change log of every schema.
+func ensureLog(db *sql.DB) error {
+	for _, schema := range routing.Schemas() {
+		for _, stmt := range logSchema {
+			if _, err := db.Exec(stmt.Format(schema)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Event is the state of a changed event.
+type Event struct {
+	EntityType     string `json:"entity_type"`
+	Action         string `json:"action"`
+	EntityId       string `json:"entity_id"`
+	ItemId         string `json:"item_id"`
+	ItemType       string `json:"item_type"`
+	AdditionalInfo string `json:"additional_info"`
+	Tenant         string `json:"tenant"`
+	UserId         int64  `json:"user_id,omitempty"`
+	CreatedAt      string `json:"created_at"`
+}
+
+// Change is a change to the event ID: its state, or none when it was
+// deleted. Cold events were moved to the cold tier.
+type Change struct {
+	ID    int64  `json:"id"`
+	Event *Event `json:"event,omitempty"`
+	Cold  bool   `json:"cold,omitempty"`
+}
+
+// Page is a page of the feed. Cursor continues after it; Behind counts
+// the changes logged after it, so zero means the page is the last.
+type Page struct {
+	Changes []Change `json:"changes"`
+	Cursor  string   `json:"cursor"`
+	Behind  int64    `json:"behind"`
+}
+
+// position is the last sequence number read from each schema's log, the
+// key of a feed cursor.
+type position map[string]int64
+
+// Feed serves the change log. It implements http.Handler.
+type Feed struct {
+	db        *sql.DB
+	token     []byte
+	retention time.Duration
+	cold      bool
+}
+
+// NewFeed creates the change log and a Feed of it, or returns nil when
+// cfg has no token. cold tells whether the cold tier is attached.
+func NewFeed(db *sql.DB, cfg config.Standby, cold bool) (*Feed, error) {
+	if cfg.Token == "" {
+		return nil, nil
+	}
+	if err := ensureLog(db); err != nil {
+		return nil, err
+	}
+	return &Feed{db: db, token: []byte(cfg.Token), retention: cfg.Retention.Duration, cold: cold}, nil
+}
+
+// Run prunes changes older than the retention every interval until ctx
+// is cancelled.
+func (f *Feed) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		cutoff := time.Now().UTC().Add(-f.retention).Format(time.DateTime)
+		for _, schema := range routing.Schemas() {
+			res, err := f.db.ExecContext(ctx, pruneSQL.Format(schema), cutoff)
+			if err != nil {
+				log.Printf("Error pruning the change log of %s: %v", schema, err)
+				continue
+			}
+			if n, err := res.RowsAffected(); err == nil {
+				metrics.Add("pruned", n)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ServeHTTP handles GET /replication/changes?cursor=&limit=, which returns
+// the changes after cursor, or from the start of the log without one, up
+// to limit per schema. A cursor whose changes were pruned gets 410: the
+// standby must be seeded again.
+func (f *Feed) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apierror.Write(w, "Only GET requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(tokenHeader)), f.token) != 1 {
+		apierror.Write(w, "Invalid replication token", http.StatusUnauthorized)
+		return
+	}
+	q := r.URL.Query()
+	limit := defaultPage
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPage {
+			apierror.Write(w, fmt.Sprintf("limit must be between 1 and %d", maxPage), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	pos := position{}
+	if v := q.Get("cursor"); v != "" {
+		if err := cursor.Decode(v, &pos); err != nil {
+			apierror.Write(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+
+	page, err := f.page(r.Context(), pos, limit)
+	var expired expiredError
+	if errors.As(err, &expired) {
+		metrics.Add("expired", 1)
+		apierror.WriteCode(w, apierror.CodeFeedExpired, expired.Error()+"; seed the standby again", http.StatusGone)
+		return
+	}
+	if err != nil {
+		log.Printf("Error reading the change feed: %v", err)
+		apierror.Write(w, "Failed to read changes", http.StatusInternalServerError)
+		return
+	}
+	metrics.Add("served", int64(len(page.Changes)))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// expiredError names the schema whose log no longer holds the changes
+// after a cursor.
+type expiredError string
+
+func (e expiredError) Error() string {
+	return "change log of " + string(e) + " pruned past the cursor"
+}
+
+// page reads the changes after pos.
+func (f *Feed) page(ctx context.Context, pos position, limit int) (*Page, error) {
+	page := &Page{Changes: []Change{}}
+	next := position{}
+	for _, schema := range routing.Schemas() {
+		after := pos[schema]
+		var first, last int64
+		if err := f.db.QueryRowContext(ctx, firstSQL.Format(schema)).Scan(&first); err != nil {
+			return nil, err
+		}
+		if after+1 < first {
+			return nil, expiredError(schema)
+		}
+		rows, err := f.db.QueryContext(ctx, changesSQL.Format(schema), after, limit)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var c Change
+			var e Event
+			var stored bool
+			var info compression.Text
+			if err := rows.Scan(&after, &c.ID, &stored, &e.EntityType, &e.Action, &e.EntityId,
+				&e.ItemId, &e.ItemType, &info, &e.Tenant, &e.UserId, &e.CreatedAt); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if stored {
+				e.AdditionalInfo = string(info)
+				c.Event = &e
+			}
+			page.Changes = append(page.Changes, c)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		next[schema] = after
+		if err := f.db.QueryRowContext(ctx, lastSQL.Format(schema)).Scan(&last); err != nil {
+			return nil, err
+		}
+		page.Behind += last - after
+	}
+	if f.cold {
+		// Events gone from the hot tier may have moved to the cold one.
+		for i := range page.Changes {
+			if c := &page.Changes[i]; c.Event == nil {
+				if err := f.readCold(ctx, c); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	page.Cursor = cursor.Encode(next)
+	return page, nil
+}
+
+// readCold fills in c from the cold tier, if the event is there.
+func (f *Feed) readCold(ctx context.Context, c *Change) error {
+	var e Event
+	var info compression.Text
+	err := f.db.QueryRowContext(ctx, coldSQL, c.ID).Scan(&e.EntityType, &e.Action, &e.EntityId,
+		&e.ItemId, &e.ItemType, &info, &e.Tenant, &e.UserId, &e.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	e.AdditionalInfo = string(info)
+	c.Event, c.Cold = &e, true
+	return nil
+}
@@ -0,0 +1,493 @@
+package standby
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"naevis/accounts"
+	"naevis/apierror"
+	"naevis/compression"
+	"naevis/config"
+	"naevis/cursor"
+	"naevis/dictionary"
+	"naevis/fulltext"
+	"naevis/routing"
+	"naevis/sqlguard"
+	"naevis/structs"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// Roles of an instance.
+const (
+	RoleStandby = "standby"
+	RolePrimary = "primary"
+)
+
+// fetchTimeout bounds a poll of the feed, so an unreachable primary is
+// noticed quickly.
+const fetchTimeout = 10 * time.Second
+
+// Keys of the standby's state in job_state.
+const (
+	cursorKey   = "standby_cursor"
+	promotedKey = "standby_promoted"
+)
+
+// Statements applying the feed. %[1]s is the schema the event id belongs
+// to; routed databases keep their id ranges on both instances, as long as
+// both route the same entity types.
+var (
+	putSQL = sqlguard.NewSchemaTemplate(`
+	INSERT INTO %[1]s.event_rows (id, entity_type_id, action_id, entity_id, item_id, item_type_id, additional_info, created_at, tenant, user_id)
+	VALUES (?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''), ?, NULLIF(?, 0))
+	ON CONFLICT (id) DO UPDATE SET
+		entity_type_id = excluded.entity_type_id, action_id = excluded.action_id, entity_id = excluded.entity_id,
+		item_id = excluded.item_id, item_type_id = excluded.item_type_id, additional_info = excluded.additional_info,
+		created_at = excluded.created_at, tenant = excluded.tenant, user_id = excluded.user_id;`)
+	deleteSQL = sqlguard.NewSchemaTemplate(`
+	DELETE FROM %[1]s.event_rows WHERE id = ?;`)
+)
+
+// putColdSQL stores an event the primary moved to the cold tier.
+const putColdSQL = `
+INSERT OR REPLACE INTO cold.events (id, entity_type, action, entity_id, item_id, item_type, additional_info, created_at, tenant, user_id)
+VALUES (?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''), ?, NULLIF(?, 0));`
+
+// Standby applies the change feed of the primary until it is promoted.
+type Standby struct {
+	db           *sql.DB
+	dict         *dictionary.Dictionary
+	feed         *url.URL
+	token        string
+	promoteAfter time.Duration
+	cold         bool
+	client       *http.Client
+
+	mu           sync.Mutex
+	promoted     *time.Time
+	reason       string
+	onPromote    []func()
+	cursor       string
+	applied      int64
+	behind       int64
+	lastContact  time.Time
+	caughtUp     time.Time
+	failingSince time.Time
+	lastError    string
+	expired      bool
+}
+
+// New creates a Standby of the primary in cfg, or returns nil when cfg
+// names none. cold tells whether the cold tier is attached. An instance
+// promoted before stays the primary.
+func New(db *sql.DB, cfg config.Standby, cold bool) (*Standby, error) {
+	if cfg.Primary == "" {
+		return nil, nil
+	}
+	if cfg.Token == "" {
+		return nil, errors.New("standby: a primary needs a token")
+	}
+	base, err := url.Parse(cfg.Primary)
+	if err != nil {
+		return nil, fmt.Errorf("standby: primary: %w", err)
+	}
+	if err := ensureLog(db); err != nil {
+		return nil, err
+	}
+	s := &Standby{
+		db:           db,
+		dict:         dictionary.New(db),
+		feed:         base.JoinPath("/replication/changes"),
+		token:        cfg.Token,
+		promoteAfter: cfg.PromoteAfter.Duration,
+		cold:         cold,
+		// Instances only speak QUIC.
+		client: &http.Client{
+			Transport: &http3.Transport{QUICConfig: &quic.Config{KeepAlivePeriod: 15 * time.Second}},
+			Timeout:   fetchTimeout,
+		},
+	}
+	var promoted string
+	err = db.QueryRow(`SELECT value FROM job_state WHERE name = ?;`, promotedKey).Scan(&promoted)
+	switch {
+	case err == nil:
+		if t, err := time.Parse(time.RFC3339, promoted); err == nil {
+			s.promoted = &t
+		}
+		s.reason = "promoted before restart"
+	case err != sql.ErrNoRows:
+		return nil, err
+	}
+	err = db.QueryRow(`SELECT value FROM job_state WHERE name = ?;`, cursorKey).Scan(&s.cursor)
+	if err == sql.ErrNoRows {
+		s.cursor, err = seeded(db)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// seeded returns the cursor of a standby seeded with a copy of the
+// primary's database files: the end of the change log they hold, since
+// the copy has every change before it. A new, empty standby starts at the
+// beginning.
+func seeded(db *sql.DB) (string, error) {
+	pos := position{}
+	for _, schema := range routing.Schemas() {
+		var last int64
+		if err := db.QueryRow(lastSQL.Format(schema)).Scan(&last); err != nil {
+			return "", err
+		}
+		pos[schema] = last
+	}
+	return cursor.Encode(pos), nil
+}
+
+// Standing reports whether s is still a standby. A nil Standby is a
+// primary.
+func (s *Standby) Standing() bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.promoted == nil
+}
+
+// WhenPrimary runs fn now on a primary, or on a standby once it is
+// promoted. Jobs that write events of their own, such as ingest from
+// change streams and dropped files, start with it.
+func (s *Standby) WhenPrimary(fn func()) {
+	if s != nil {
+		s.mu.Lock()
+		if s.promoted == nil {
+			s.onPromote = append(s.onPromote, fn)
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+	}
+	fn()
+}
+
+// Promote makes s the primary: it stops applying the feed, accepts
+// writes and starts the jobs waiting for it. Promoting a primary does
+// nothing.
+func (s *Standby) Promote(reason string) error {
+	s.mu.Lock()
+	if s.promoted != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	now := time.Now().UTC()
+	if _, err := s.db.Exec(`
+	INSERT INTO job_state (name, value) VALUES (?, ?)
+	ON CONFLICT (name) DO UPDATE SET value = excluded.value;`, promotedKey, now.Format(time.RFC3339)); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.promoted, s.reason = &now, reason
+	waiting := s.onPromote
+	s.onPromote = nil
+	behind := s.behind
+	s.mu.Unlock()
+
+	metrics.Add("promotions", 1)
+	log.Printf("Promoted to primary (%s), %d changes behind the old primary at its last contact", reason, behind)
+	for _, fn := range waiting {
+		fn()
+	}
+	return nil
+}
+
+// Run applies the feed every interval until s is promoted or ctx is
+// cancelled. Each poll doubles as a health check of the primary: once
+// polls have failed for the promote_after window, s promotes itself.
+func (s *Standby) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for s.Standing() {
+		err := s.catchUp(ctx)
+		s.record(err)
+		if err != nil {
+			log.Printf("Error applying the change feed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// errExpired is returned when the primary pruned the changes after the
+// standby's cursor.
+var errExpired = errors.New("the primary no longer has the changes after the cursor; seed the standby again")
+
+// catchUp applies pages of the feed until it is caught up.
+func (s *Standby) catchUp(ctx context.Context) error {
+	for s.Standing() {
+		page, err := s.fetch(ctx)
+		if err != nil {
+			return err
+		}
+		if err := s.apply(page); err != nil {
+			return fmt.Errorf("applying changes: %w", err)
+		}
+		if page.Behind == 0 {
+			return nil
+		}
+	}
+	return nil
+}
+
+// fetch reads the page of the feed after the cursor.
+func (s *Standby) fetch(ctx context.Context) (*Page, error) {
+	u := *s.feed
+	if s.cursor != "" {
+		u.RawQuery = url.Values{"cursor": {s.cursor}}.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(tokenHeader, s.token)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return nil, errExpired
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("feed returned %s", resp.Status)
+	}
+	var page Page
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// apply stores the changes of page and its cursor in one transaction, so
+// a page is applied once whatever fails.
+func (s *Standby) apply(page *Page) error {
+	// Dictionary ids are taken outside the transaction; see
+	// dictionary.ID.
+	ids := make([][3]int64, len(page.Changes))
+	for i, c := range page.Changes {
+		if c.Event == nil || c.Cold {
+			continue
+		}
+		for j, field := range []struct{ kind, value string }{
+			{dictionary.EntityType, c.Event.EntityType},
+			{dictionary.Action, c.Event.Action},
+			{dictionary.ItemType, c.Event.ItemType},
+		} {
+			id, err := s.dict.ID(field.kind, field.value)
+			if err != nil {
+				return err
+			}
+			ids[i][j] = id
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for i, c := range page.Changes {
+		schema := routing.SchemaOf(c.ID)
+		switch {
+		case c.Event == nil || c.Cold:
+			if _, err := tx.Exec(deleteSQL.Format(schema), c.ID); err != nil {
+				return err
+			}
+			if c.Cold && s.cold {
+				e := c.Event
+				if _, err := tx.Exec(putColdSQL, c.ID, e.EntityType, e.Action, e.EntityId, e.ItemId, e.ItemType,
+					compression.Text(e.AdditionalInfo), e.CreatedAt, e.Tenant, e.UserId); err != nil {
+					return err
+				}
+			}
+		default:
+			e := c.Event
+			if _, err := tx.Exec(putSQL.Format(schema), c.ID, ids[i][0], ids[i][1], e.EntityId, e.ItemId, ids[i][2],
+				compression.Text(e.AdditionalInfo), e.CreatedAt, e.Tenant, e.UserId); err != nil {
+				return err
+			}
+			event := structs.Index{EntityType: e.EntityType, EntityId: e.EntityId, Tenant: e.Tenant}
+			if err := fulltext.Index(tx, c.ID, event, e.AdditionalInfo); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := tx.Exec(`
+	INSERT INTO job_state (name, value) VALUES (?, ?)
+	ON CONFLICT (name) DO UPDATE SET value = excluded.value;`, cursorKey, page.Cursor); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	metrics.Add("applied", int64(len(page.Changes)))
+	s.mu.Lock()
+	s.cursor, s.behind = page.Cursor, page.Behind
+	s.applied += int64(len(page.Changes))
+	s.mu.Unlock()
+	return nil
+}
+
+// record notes the outcome of a poll, and promotes s when the primary has
+// been unreachable for too long.
+func (s *Standby) record(err error) {
+	now := time.Now().UTC()
+	s.mu.Lock()
+	s.expired = errors.Is(err, errExpired)
+	switch {
+	case err == nil:
+		s.lastContact, s.failingSince, s.lastError = now, time.Time{}, ""
+		if s.behind == 0 {
+			s.caughtUp = now
+		}
+	case s.expired:
+		// The primary answered; it is up, so this is no reason to take
+		// over.
+		s.lastContact, s.failingSince, s.lastError = now, time.Time{}, err.Error()
+	default:
+		metrics.Add("errors", 1)
+		s.lastError = err.Error()
+		if s.failingSince.IsZero() {
+			s.failingSince = now
+		}
+	}
+	failing := now.Sub(s.failingSince)
+	due := s.promoteAfter > 0 && !s.failingSince.IsZero() && failing >= s.promoteAfter
+	s.mu.Unlock()
+
+	if due {
+		reason := fmt.Sprintf("primary unreachable for %s", failing.Round(time.Second))
+		if err := s.Promote(reason); err != nil {
+			log.Printf("Error promoting to primary: %v", err)
+		}
+	}
+}
+
+// Middleware refuses writes while s is a standby, other than signing in
+// and promoting it: its events come from the primary only. Reads are
+// served from the replicated events.
+func (s *Standby) Middleware(next http.Handler) http.Handler {
+	if s == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if writes(r) && s.Standing() {
+			metrics.Add("refused", 1)
+			apierror.WriteCode(w, apierror.CodeStandby, "This instance is a standby; send writes to the primary", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writes reports whether r may write to the database.
+func writes(r *http.Request) bool {
+	switch path := r.URL.Path; {
+	case strings.HasPrefix(path, "/accounts/"), path == "/admin/standby", strings.HasPrefix(path, "/admin/standby/"):
+		return false
+	case path == "/t":
+		// The tracking pixel records a GET.
+		return true
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// Status is the replication state of an instance.
+type Status struct {
+	Role         string     `json:"role"`
+	PromotedAt   *time.Time `json:"promoted_at,omitempty"`
+	Reason       string     `json:"reason,omitempty"`
+	Applied      int64      `json:"applied"`
+	Behind       int64      `json:"behind"`
+	LagSeconds   float64    `json:"lag_seconds"`
+	LastContact  *time.Time `json:"last_contact,omitempty"`
+	FailingSince *time.Time `json:"failing_since,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+	Expired      bool       `json:"expired,omitempty"`
+}
+
+// status reports the state of s. The lag is how long ago it last caught
+// up with the primary: the events it may miss if promoted now were
+// written since.
+func (s *Standby) status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := Status{
+		Role: RoleStandby, PromotedAt: s.promoted, Reason: s.reason,
+		Applied: s.applied, Behind: s.behind, LastError: s.lastError, Expired: s.expired,
+	}
+	if s.promoted != nil {
+		st.Role = RolePrimary
+	}
+	if !s.lastContact.IsZero() {
+		t := s.lastContact
+		st.LastContact = &t
+	}
+	if !s.failingSince.IsZero() {
+		t := s.failingSince
+		st.FailingSince = &t
+	}
+	if s.promoted == nil && !s.caughtUp.IsZero() && (s.behind > 0 || !s.failingSince.IsZero()) {
+		st.LagSeconds = time.Since(s.caughtUp).Seconds()
+	}
+	return st
+}
+
+// AdminHandler handles GET /admin/standby, which reports the replication
+// state, and POST /admin/standby/promote, which promotes the standby.
+func (s *Standby) AdminHandler(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/admin/standby" && r.Method == http.MethodGet:
+	case r.URL.Path == "/admin/standby/promote" && r.Method == http.MethodPost:
+		if err := s.Promote("promoted by " + requester(r)); err != nil {
+			log.Printf("Error promoting to primary: %v", err)
+			apierror.Write(w, "Failed to promote", http.StatusInternalServerError)
+			return
+		}
+	case r.URL.Path == "/admin/standby" || r.URL.Path == "/admin/standby/promote":
+		apierror.Write(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	default:
+		apierror.Write(w, "Not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.status())
+}
+
+// requester names the admin making r, for the log.
+func requester(r *http.Request) string {
+	if claims, ok := accounts.FromContext(r.Context()); ok {
+		return "user " + strconv.FormatInt(claims.Subject, 10)
+	}
+	return "an admin"
+}
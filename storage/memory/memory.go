@@ -0,0 +1,252 @@
+// Package memory keeps events in a map, for tests and demos that should
+// not touch disk. Importing it registers the "memory" storage driver;
+// its events are lost when the server stops.
+//
+// As with the postgres driver, routing, the cold tier, lineage and the
+// full-text index are features of the SQLite database, so they do not
+// cover events stored here.
+package memory
+
+import (
+	"cmp"
+	"context"
+	"naevis/dedup"
+	"naevis/storage"
+	"naevis/structs"
+	"slices"
+	"sync"
+	"time"
+)
+
+func init() {
+	storage.Register("memory", func(env storage.Env) (storage.Storage, error) {
+		return New(env.Dedup), nil
+	})
+}
+
+// event is a stored event and when it was stored, which orders queries.
+type event struct {
+	structs.Event
+	created time.Time
+}
+
+// upsertKey identifies the event last upserted for an entity and item.
+type upsertKey struct {
+	tenant, entityType, entityID, itemID string
+}
+
+// Memory stores events in memory. It is safe for concurrent use.
+type Memory struct {
+	dedup *dedup.Deduplicator
+
+	mu      sync.RWMutex
+	lastID  int64
+	events  map[int64]*event
+	keys    map[[2]string]int64
+	upserts map[upsertKey]int64
+	hashes  map[[2]string]time.Time
+	// generated holds the generated entity IDs taken, by tenant, entity
+	// type and ID.
+	generated map[[3]string]int64
+}
+
+// New creates an empty Memory deduplicating events with d.
+func New(d *dedup.Deduplicator) *Memory {
+	return &Memory{
+		dedup:     d,
+		events:    make(map[int64]*event),
+		keys:      make(map[[2]string]int64),
+		upserts:   make(map[upsertKey]int64),
+		hashes:    make(map[[2]string]time.Time),
+		generated: make(map[[3]string]int64),
+	}
+}
+
+// Store stores the event. Nothing is changed when it is a duplicate.
+func (m *Memory) Store(e structs.Index, mongoData structs.MongoData) (storage.Stored, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now().UTC()
+	var hash [2]string
+	if e.ContentHash != "" && m.dedup.Enabled() {
+		hash = [2]string{e.Tenant, e.ContentHash}
+		if at, ok := m.hashes[hash]; ok && !at.Before(now.Add(-m.dedup.Window())) {
+			return storage.Stored{}, storage.ErrDuplicateContent
+		}
+	}
+	var key [2]string
+	if e.IdempotencyKey != "" {
+		key = [2]string{e.Tenant, e.IdempotencyKey}
+		if _, ok := m.keys[key]; ok {
+			return storage.Stored{}, storage.ErrDuplicateEvent
+		}
+	}
+	if m.taken(e) {
+		return storage.Stored{}, storage.ErrDuplicateID
+	}
+
+	upsert := upsertKey{e.Tenant, e.EntityType, e.EntityId, e.ItemId}
+	var stored storage.Stored
+	if prev, ok := m.events[m.upserts[upsert]]; e.Upsert && ok {
+		// A refresh keeps when the event was first stored.
+		prev.Action = e.Action
+		prev.ItemType = e.ItemType
+		prev.AdditionalInfo = mongoData.AdditionalInfo
+		prev.UserId = e.UserId
+		prev.Attachments = attachments(e.Attachments)
+		stored = storage.Stored{ID: prev.ID, Refreshed: true}
+	} else {
+		created := now
+		if !e.Time.IsZero() {
+			created = e.Time.UTC()
+		}
+		m.lastID++
+		m.events[m.lastID] = &event{
+			Event: structs.Event{
+				ID:             m.lastID,
+				EntityType:     e.EntityType,
+				Action:         e.Action,
+				EntityId:       e.EntityId,
+				ItemId:         e.ItemId,
+				ItemType:       e.ItemType,
+				AdditionalInfo: mongoData.AdditionalInfo,
+				Attachments:    attachments(e.Attachments),
+				Tenant:         e.Tenant,
+				UserId:         e.UserId,
+				CreatedAt:      created.Format(time.DateTime),
+			},
+			created: created,
+		}
+		stored = storage.Stored{ID: m.lastID}
+	}
+	if e.Upsert {
+		m.upserts[upsert] = stored.ID
+	}
+	if hash[0] != "" {
+		m.hashes[hash] = now
+	}
+	if key[0] != "" {
+		m.keys[key] = stored.ID
+	}
+	if e.GeneratedID {
+		m.generated[[3]string{e.Tenant, e.EntityType, e.EntityId}] = stored.ID
+	}
+	return stored, nil
+}
+
+// taken reports whether the generated entity ID of e is taken.
+func (m *Memory) taken(e structs.Index) bool {
+	if !e.GeneratedID {
+		return false
+	}
+	_, ok := m.generated[[3]string{e.Tenant, e.EntityType, e.EntityId}]
+	return ok
+}
+
+// attachments returns keys sorted and without repeats, as Get returns
+// them.
+func attachments(keys []string) []string {
+	keys = append([]string{}, keys...)
+	slices.Sort(keys)
+	return slices.Compact(keys)
+}
+
+// Get returns a copy of the stored event id of tenant.
+func (m *Memory) Get(id int64, tenant string) (structs.Event, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	e, ok := m.events[id]
+	if !ok || e.Tenant != tenant {
+		return structs.Event{}, storage.ErrNotFound
+	}
+	event := e.Event
+	event.Attachments = slices.Clone(e.Attachments)
+	return event, nil
+}
+
+// owned returns the event id, stored for tenant, if it may be changed.
+func (m *Memory) owned(id int64, tenant string, mayChange func(userID int64) bool) (*event, error) {
+	e, ok := m.events[id]
+	switch {
+	case !ok || e.Tenant != tenant:
+		return nil, storage.ErrNotFound
+	case !mayChange(e.UserId):
+		return nil, storage.ErrForbidden
+	}
+	return e, nil
+}
+
+// Update replaces the stored event.
+func (m *Memory) Update(id int64, e structs.Index, mongoData structs.MongoData, mayChange func(userID int64) bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prev, err := m.owned(id, e.Tenant, mayChange)
+	if err != nil {
+		return err
+	}
+	if m.taken(e) {
+		return storage.ErrDuplicateID
+	}
+	if e.GeneratedID {
+		m.generated[[3]string{e.Tenant, e.EntityType, e.EntityId}] = id
+	}
+	prev.EntityType = e.EntityType
+	prev.Action = e.Action
+	prev.EntityId = e.EntityId
+	prev.ItemId = e.ItemId
+	prev.ItemType = e.ItemType
+	prev.AdditionalInfo = mongoData.AdditionalInfo
+	prev.Attachments = attachments(e.Attachments)
+	return nil
+}
+
+// Delete retracts the stored event.
+func (m *Memory) Delete(id int64, tenant string, mayChange func(userID int64) bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.owned(id, tenant, mayChange); err != nil {
+		return err
+	}
+	delete(m.events, id)
+	return nil
+}
+
+// Query calls fn with copies of the events q selects, taken before the
+// first call, so fn may use m. There is no cold tier, so q.Cold changes
+// nothing.
+func (m *Memory) Query(ctx context.Context, q storage.Query, fn func(structs.Event) error) error {
+	m.mu.RLock()
+	var matched []*event
+	for _, e := range m.events {
+		if e.Tenant != q.Tenant ||
+			q.EntityType != "" && e.EntityType != q.EntityType ||
+			!q.From.IsZero() && e.created.Before(q.From) ||
+			!q.To.IsZero() && !e.created.Before(q.To) {
+			continue
+		}
+		c := *e
+		c.Attachments = slices.Clone(e.Attachments)
+		matched = append(matched, &c)
+	}
+	m.mu.RUnlock()
+
+	slices.SortFunc(matched, func(a, b *event) int {
+		if c := a.created.Compare(b.created); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.ID, b.ID)
+	})
+	for _, e := range matched {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(e.Event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
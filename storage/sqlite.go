@@ -0,0 +1,392 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"naevis/compression"
+	"naevis/dedup"
+	"naevis/dictionary"
+	"naevis/fulltext"
+	"naevis/lineage"
+	"naevis/routing"
+	"naevis/sqlguard"
+	"naevis/structs"
+	"time"
+)
+
+// Statements on the events of the schema %s, the database the entity type
+// is routed to.
+var (
+	insertSQL = sqlguard.NewSchemaTemplate(`
+	INSERT INTO %s.event_rows (entity_type_id, action_id, entity_id, item_id, item_type_id, additional_info, tenant, user_id, created_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, NULLIF(?, 0), COALESCE(?, CURRENT_TIMESTAMP));`)
+	refreshSQL = sqlguard.NewSchemaTemplate(`
+	UPDATE %s.event_rows SET action_id = ?, item_type_id = ?, additional_info = ?, user_id = NULLIF(?, 0)
+	WHERE id = (SELECT event_id FROM main.event_upserts WHERE tenant = ? AND entity_type = ? AND entity_id = ? AND item_id = ?)
+	RETURNING id;`)
+	loadSQL = sqlguard.NewSchemaTemplate(`
+	SELECT r.id, IFNULL(et.value, ''), IFNULL(a.value, ''), IFNULL(r.entity_id, ''), IFNULL(r.item_id, ''),
+		IFNULL(it.value, ''), r.additional_info, r.tenant, IFNULL(r.user_id, 0), IFNULL(r.created_at, '')
+	FROM %s.event_rows r
+	LEFT JOIN main.dictionary et ON et.id = r.entity_type_id
+	LEFT JOIN main.dictionary a ON a.id = r.action_id
+	LEFT JOIN main.dictionary it ON it.id = r.item_type_id
+	WHERE r.id = ? AND r.tenant = ?;`)
+	ownerSQL  = sqlguard.NewSchemaTemplate(`SELECT tenant, IFNULL(user_id, 0) FROM %s.event_rows WHERE id = ?;`)
+	updateSQL = sqlguard.NewSchemaTemplate(`
+	UPDATE %s.event_rows SET entity_type_id = ?, action_id = ?, entity_id = ?, item_id = ?, item_type_id = ?, additional_info = ?
+	WHERE id = ?;`)
+	deleteSQL = sqlguard.NewSchemaTemplate(`DELETE FROM %s.event_rows WHERE id = ?;`)
+)
+
+// querySQL selects the events of a tenant, oldest first. Its parameters
+// are the tenant, then the entity type, the start and the end twice each;
+// an empty one matches every event.
+const querySQL = `
+SELECT id, IFNULL(entity_type, ''), IFNULL(action, ''), IFNULL(entity_id, ''), IFNULL(item_id, ''),
+	IFNULL(item_type, ''), additional_info, tenant, IFNULL(user_id, 0), IFNULL(created_at, '')
+FROM events
+WHERE tenant = ? AND (? = '' OR entity_type = ?) AND (? = '' OR created_at >= ?) AND (? = '' OR created_at < ?)
+ORDER BY created_at, id;`
+
+// queryAllSQL is querySQL over both event tiers.
+const queryAllSQL = `
+SELECT id, IFNULL(entity_type, ''), IFNULL(action, ''), IFNULL(entity_id, ''), IFNULL(item_id, ''),
+	IFNULL(item_type, ''), additional_info, tenant, IFNULL(user_id, 0), IFNULL(created_at, '')
+FROM (
+	SELECT id, entity_type, action, entity_id, item_id, item_type, additional_info, user_id, created_at, tenant FROM events
+	UNION ALL
+	SELECT id, entity_type, action, entity_id, item_id, item_type, additional_info, user_id, created_at, tenant FROM cold.events
+)
+WHERE tenant = ? AND (? = '' OR entity_type = ?) AND (? = '' OR created_at >= ?) AND (? = '' OR created_at < ?)
+ORDER BY created_at, id;`
+
+// SQLite stores events in the server's database. Their strings are
+// interned in the dictionary, and each entity type's events go to the
+// database file it is routed to.
+type SQLite struct {
+	db    *sql.DB
+	dict  *dictionary.Dictionary
+	dedup *dedup.Deduplicator
+}
+
+func openSQLite(env Env) (Storage, error) {
+	return &SQLite{db: env.DB, dict: env.Dictionary, dedup: env.Dedup}, nil
+}
+
+// intern returns the dictionary ids of event's entity type, action and
+// item type.
+func (s *SQLite) intern(event structs.Index) ([3]int64, error) {
+	var ids [3]int64
+	for i, field := range []struct{ kind, value string }{
+		{dictionary.EntityType, event.EntityType},
+		{dictionary.Action, event.Action},
+		{dictionary.ItemType, event.ItemType},
+	} {
+		id, err := s.dict.ID(field.kind, field.value)
+		if err != nil {
+			return ids, err
+		}
+		ids[i] = id
+	}
+	return ids, nil
+}
+
+// Store inserts the event data along with MongoDB data. Attachment
+// references, the idempotency key, the content hash, the lineage and the
+// full-text entry are stored in the same transaction.
+func (s *SQLite) Store(event structs.Index, mongoData structs.MongoData) (Stored, error) {
+	// Rows reference interned strings; the events view joins them back.
+	ids, err := s.intern(event)
+	if err != nil {
+		return Stored{}, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Stored{}, err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	if event.Upsert {
+		if id, err = refreshEvent(tx, event, ids, mongoData); err != nil {
+			return Stored{}, err
+		}
+	}
+	refreshed := id != 0
+	if !refreshed {
+		if id, err = insertEvent(tx, event, ids, mongoData); err != nil {
+			return Stored{}, err
+		}
+	}
+	if event.Upsert {
+		if _, err := tx.Exec(`
+		INSERT INTO main.event_upserts (tenant, entity_type, entity_id, item_id, event_id) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (tenant, entity_type, entity_id, item_id) DO UPDATE SET event_id = excluded.event_id;`,
+			event.Tenant, event.EntityType, event.EntityId, event.ItemId, id); err != nil {
+			return Stored{}, err
+		}
+	}
+	if first, err := s.dedup.Claim(tx, event, id); err != nil {
+		return Stored{}, err
+	} else if !first {
+		return Stored{}, ErrDuplicateContent
+	}
+	if event.IdempotencyKey != "" {
+		res, err := tx.Exec(`
+		INSERT INTO main.event_keys (tenant, key, event_id) VALUES (?, ?, ?)
+		ON CONFLICT (tenant, key) DO NOTHING;`, event.Tenant, event.IdempotencyKey, id)
+		if err != nil {
+			return Stored{}, err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return Stored{}, err
+		} else if n == 0 {
+			return Stored{}, ErrDuplicateEvent
+		}
+	}
+	if err := claimID(tx, event, id); err != nil {
+		return Stored{}, err
+	}
+	if err := lineage.Save(tx, id, event, mongoData.Enrichment); err != nil {
+		return Stored{}, err
+	}
+	if err := fulltext.Index(tx, id, event, mongoData.AdditionalInfo); err != nil {
+		return Stored{}, err
+	}
+	if refreshed {
+		if _, err := tx.Exec(`DELETE FROM event_attachments WHERE event_id = ?;`, id); err != nil {
+			return Stored{}, err
+		}
+	}
+	for _, key := range event.Attachments {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO event_attachments (event_id, sha256) VALUES (?, ?);`, id, key); err != nil {
+			return Stored{}, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return Stored{}, err
+	}
+	return Stored{ID: id, Refreshed: refreshed}, nil
+}
+
+// insertEvent inserts event, whose interned strings are ids, and returns
+// its id.
+func insertEvent(tx *sql.Tx, event structs.Index, ids [3]int64, mongoData structs.MongoData) (int64, error) {
+	var createdAt any
+	if !event.Time.IsZero() {
+		createdAt = event.Time.UTC().Format(time.DateTime)
+	}
+
+	res, err := tx.Exec(insertSQL.Format(routing.Schema(event.EntityType)),
+		ids[0],
+		ids[1],
+		event.EntityId,
+		event.ItemId,
+		ids[2],
+		compression.Text(mongoData.AdditionalInfo),
+		event.Tenant,
+		event.UserId,
+		createdAt,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// refreshEvent updates the event last upserted for event's tenant,
+// entity and item with the data of event, and returns its id, or 0 if
+// there is none or it was pruned or moved to the cold tier since. The
+// event keeps when it was first stored, so counts over time are not
+// changed by a refresh.
+func refreshEvent(tx *sql.Tx, event structs.Index, ids [3]int64, mongoData structs.MongoData) (int64, error) {
+	var id int64
+	err := tx.QueryRow(refreshSQL.Format(routing.Schema(event.EntityType)),
+		ids[1], ids[2], compression.Text(mongoData.AdditionalInfo), event.UserId,
+		event.Tenant, event.EntityType, event.EntityId, event.ItemId).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return id, err
+}
+
+// Get returns the stored event id of tenant. Events moved to the cold
+// tier are not found.
+func (s *SQLite) Get(id int64, tenant string) (structs.Event, error) {
+	var e structs.Event
+	var info compression.Text
+	err := s.db.QueryRow(loadSQL.Format(routing.SchemaOf(id)), id, tenant).Scan(
+		&e.ID, &e.EntityType, &e.Action, &e.EntityId, &e.ItemId, &e.ItemType, &info, &e.Tenant, &e.UserId, &e.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return e, ErrNotFound
+	}
+	if err != nil {
+		return e, err
+	}
+	e.AdditionalInfo = string(info)
+
+	rows, err := s.db.Query(`SELECT sha256 FROM event_attachments WHERE event_id = ? ORDER BY sha256;`, id)
+	if err != nil {
+		return e, err
+	}
+	defer rows.Close()
+	e.Attachments = []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return e, err
+		}
+		e.Attachments = append(e.Attachments, key)
+	}
+	return e, rows.Err()
+}
+
+// checkOwner checks, within tx, that the event id is stored in schema for
+// tenant and may be changed.
+func checkOwner(tx *sql.Tx, schema string, id int64, tenant string, mayChange func(userID int64) bool) error {
+	var owner string
+	var userID int64
+	err := tx.QueryRow(ownerSQL.Format(schema), id).Scan(&owner, &userID)
+	switch {
+	case errors.Is(err, sql.ErrNoRows) || err == nil && owner != tenant:
+		return ErrNotFound
+	case err != nil:
+		return err
+	case !mayChange(userID):
+		return ErrForbidden
+	}
+	return nil
+}
+
+// Update replaces the stored event. The full-text index and the
+// attachment references are updated in the same transaction. Totals and
+// roll-ups keep counting the event as first stored.
+func (s *SQLite) Update(id int64, event structs.Index, mongoData structs.MongoData, mayChange func(userID int64) bool) error {
+	schema := routing.SchemaOf(id)
+	if routing.Schema(event.EntityType) != schema {
+		return ErrMoved
+	}
+	ids, err := s.intern(event)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := checkOwner(tx, schema, id, event.Tenant, mayChange); err != nil {
+		return err
+	}
+	if err := claimID(tx, event, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSQL.Format(schema),
+		ids[0], ids[1], event.EntityId, event.ItemId, ids[2], compression.Text(mongoData.AdditionalInfo), id); err != nil {
+		return err
+	}
+	if err := lineage.Save(tx, id, event, mongoData.Enrichment); err != nil {
+		return err
+	}
+	if err := fulltext.Index(tx, id, event, mongoData.AdditionalInfo); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM event_attachments WHERE event_id = ?;`, id); err != nil {
+		return err
+	}
+	for _, key := range event.Attachments {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO event_attachments (event_id, sha256) VALUES (?, ?);`, id, key); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// claimID takes the generated entity ID of event for the event id,
+// returning ErrDuplicateID when another event has it.
+func claimID(tx *sql.Tx, event structs.Index, id int64) error {
+	if !event.GeneratedID {
+		return nil
+	}
+	res, err := tx.Exec(`
+	INSERT INTO main.generated_ids (tenant, entity_type, entity_id, event_id) VALUES (?, ?, ?, ?)
+	ON CONFLICT (tenant, entity_type, entity_id) DO NOTHING;`, event.Tenant, event.EntityType, event.EntityId, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrDuplicateID
+	}
+	return nil
+}
+
+// Delete retracts the stored event. Its full-text entry goes with it, and
+// blobs it alone referenced are left to the collector.
+func (s *SQLite) Delete(id int64, tenant string, mayChange func(userID int64) bool) error {
+	schema := routing.SchemaOf(id)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := checkOwner(tx, schema, id, tenant, mayChange); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(deleteSQL.Format(schema), id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM event_attachments WHERE event_id = ?;`, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM main.event_lineage WHERE event_id = ?;`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Query reads the events through the events view, and the cold tier's
+// when q.Cold is set, which must then be attached.
+func (s *SQLite) Query(ctx context.Context, q Query, fn func(structs.Event) error) error {
+	var start, end string
+	if !q.From.IsZero() {
+		start = q.From.UTC().Format(time.DateTime)
+	}
+	if !q.To.IsZero() {
+		end = q.To.UTC().Format(time.DateTime)
+	}
+	args := []any{q.Tenant, q.EntityType, q.EntityType, start, start, end, end}
+	var rows *sql.Rows
+	var err error
+	if q.Cold {
+		rows, err = s.db.QueryContext(ctx, queryAllSQL, args...)
+	} else {
+		rows, err = s.db.QueryContext(ctx, querySQL, args...)
+	}
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e structs.Event
+		var info compression.Text
+		if err := rows.Scan(&e.ID, &e.EntityType, &e.Action, &e.EntityId, &e.ItemId, &e.ItemType, &info,
+			&e.Tenant, &e.UserId, &e.CreatedAt); err != nil {
+			return err
+		}
+		e.AdditionalInfo = string(info)
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,139 @@
+// Package storage stores events behind the Storage interface, so handlers
+// do not depend on how events are kept. SQLite, the default driver, keeps
+// them in the server's database; other backends register a driver of
+// their own.
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"naevis/dedup"
+	"naevis/dictionary"
+	"naevis/structs"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Errors of a Storage.
+var (
+	// ErrNotFound is returned for an event that is not stored for the
+	// tenant.
+	ErrNotFound = errors.New("event not found")
+	// ErrForbidden is returned for a change to an event the caller may
+	// not change.
+	ErrForbidden = errors.New("event submitted by another user")
+	// ErrMoved is returned for a change of an event's entity type to one
+	// stored elsewhere.
+	ErrMoved = errors.New("entity type is stored in another database")
+	// ErrDuplicateEvent is returned by Store for an event whose
+	// Idempotency-Key was already stored with another event of the tenant.
+	ErrDuplicateEvent = errors.New("event already stored with this idempotency key")
+	// ErrDuplicateContent is returned by Store for an event whose content
+	// matches an event of the tenant stored within the dedup window.
+	ErrDuplicateContent = errors.New("event with this content already stored")
+	// ErrDuplicateID is returned by Store and Update for an event whose
+	// generated entity ID was already stored for its tenant and entity
+	// type.
+	ErrDuplicateID = errors.New("generated entity ID already taken")
+)
+
+// Storage keeps events.
+type Storage interface {
+	// Store stores event with the data it was enriched with. An upserted
+	// event refreshes the event last upserted for its entity and item, if
+	// that is still stored, rather than adding another.
+	Store(event structs.Index, mongoData structs.MongoData) (Stored, error)
+	// Get returns the stored event id of tenant, with its attachments.
+	Get(id int64, tenant string) (structs.Event, error)
+	// Update replaces the stored event id of event's tenant with event,
+	// keeping when it was received and its submitter. mayChange tells
+	// whether the caller may change an event submitted by a user ID.
+	Update(id int64, event structs.Index, mongoData structs.MongoData, mayChange func(userID int64) bool) error
+	// Delete retracts the stored event id of tenant, as Update.
+	Delete(id int64, tenant string, mayChange func(userID int64) bool) error
+	// Query calls fn with the events q selects, oldest first, until fn
+	// returns an error, which Query returns.
+	Query(ctx context.Context, q Query, fn func(structs.Event) error) error
+}
+
+// KeyExpirer is implemented by drivers that keep the Idempotency-Keys of
+// events in a database of their own, which the server's collector of
+// expired keys does not reach.
+type KeyExpirer interface {
+	// ExpireKeys deletes the keys stored before cutoff and returns how
+	// many it deleted.
+	ExpireKeys(cutoff time.Time) (int64, error)
+}
+
+// Stored is an event Store stored. Refreshed is set when it refreshed an
+// upserted event rather than adding one.
+type Stored struct {
+	ID        int64
+	Refreshed bool
+}
+
+// Query selects the events of Tenant, of EntityType or of every entity
+// type when it is empty, created from From until To, either unbounded
+// when zero. Cold includes the events moved to the cold tier.
+type Query struct {
+	Tenant     string
+	EntityType string
+	From, To   time.Time
+	Cold       bool
+}
+
+// Env is what drivers are opened with: the server's database, the
+// services events are stored with, and DSN, the data source name of the
+// driver's own database, if it has one.
+type Env struct {
+	DB         *sql.DB
+	Dictionary *dictionary.Dictionary
+	Dedup      *dedup.Deduplicator
+	DSN        string
+}
+
+// Driver opens a Storage.
+type Driver func(env Env) (Storage, error)
+
+// Default is the name of the default driver.
+const Default = "sqlite"
+
+var drivers = map[string]Driver{Default: openSQLite}
+
+// InDatabase reports whether the driver name stores events in the
+// server's SQLite database. Search, roll-ups, trending, related entities,
+// activity, lineage, quotas, costs, the change feed and the cold tier
+// read events from there, so they see none stored by other drivers.
+func InDatabase(name string) bool {
+	return name == "" || name == Default
+}
+
+// Register makes a driver available by name. It is meant to be called
+// from the init function of the package providing it.
+func Register(name string, driver Driver) {
+	if _, ok := drivers[name]; ok {
+		panic("storage: driver " + name + " registered twice")
+	}
+	drivers[name] = driver
+}
+
+// Open opens the storage of the driver name, or of Default when name is
+// empty.
+func Open(name string, env Env) (Storage, error) {
+	if name == "" {
+		name = Default
+	}
+	driver, ok := drivers[name]
+	if !ok {
+		names := make([]string, 0, len(drivers))
+		for n := range drivers {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown storage driver %q; use one of %s", name, strings.Join(names, ", "))
+	}
+	return driver(env)
+}
@@ -1,5 +1,7 @@
 package structs
 
+import "time"
+
 // Index represents the incoming JSON event structure.
 type Index struct {
 	EntityType string `json:"entity_type"`
@@ -7,12 +9,77 @@ type Index struct {
 	EntityId   string `json:"entity_id"`
 	ItemId     string `json:"item_id"`
 	ItemType   string `json:"item_type"`
+	// Source names the upstream system the entity and item IDs come
+	// from. They are stored as SOURCE:ID, so systems whose IDs collide
+	// keep separate entities.
+	Source string `json:"source,omitempty"`
+	// Attachments are the SHA-256 keys of blobs uploaded to /blobs.
+	Attachments []string `json:"attachments,omitempty"`
+	// Tenant is taken from the X-Tenant-ID header, not the JSON body.
+	Tenant string `json:"-"`
+	// Payer is the verified caller the write of an event posted over
+	// HTTP is attributed to, see costs.Payer. Events of configured
+	// sources leave it empty and are attributed to Tenant.
+	Payer string `json:"-"`
+	// IdempotencyKey is taken from the Idempotency-Key header, with the
+	// event's offset appended for streamed events. An event is stored
+	// once per tenant and key.
+	IdempotencyKey string `json:"-"`
+	// ContentHash identifies the event's content for deduplication. Set
+	// on ingest when deduplication is on.
+	ContentHash string `json:"-"`
+	// Upsert, set by ?upsert=true, refreshes the event last upserted for
+	// the same tenant, entity and item instead of storing another.
+	Upsert bool `json:"-"`
+	// UserId is the authenticated submitter, or 0 for anonymous events.
+	UserId int64 `json:"-"`
+	// ReceivedAt is when the server received the event, for latency
+	// tracking. Set on ingest when zero.
+	ReceivedAt time.Time `json:"-"`
+	// Time is when the event happened, as reported by compact frames. The
+	// zero value means when it was received.
+	Time time.Time `json:"-"`
+	// Lineage is set by the connector the event came in by.
+	Lineage Lineage `json:"-"`
+	// GeneratedID is set when the server generated EntityId. Storage
+	// refuses a generated ID already taken in the tenant's entity type.
+	GeneratedID bool `json:"-"`
+}
+
+// Lineage is where an event came from, kept for data governance.
+// Connector names how it came in: "http", "ndjson", "cbor", "import",
+// "filedrop", "mail", "cdc", "experiments" or "documents". Events read
+// from a file, stream or message are located in it by Origin, such as a
+// file name, and Offset, their 1-based line or record number.
+type Lineage struct {
+	Connector string `json:"connector"`
+	Origin    string `json:"origin,omitempty"`
+	Offset    int64  `json:"offset,omitempty"`
+}
+
+// Event is a stored event, as returned by GET /event/{ID}.
+// AdditionalInfo is the data the event was enriched with on ingest.
+type Event struct {
+	ID             int64    `json:"id"`
+	EntityType     string   `json:"entity_type"`
+	Action         string   `json:"action"`
+	EntityId       string   `json:"entity_id"`
+	ItemId         string   `json:"item_id"`
+	ItemType       string   `json:"item_type"`
+	AdditionalInfo string   `json:"additional_info"`
+	Attachments    []string `json:"attachments"`
+	Tenant         string   `json:"tenant"`
+	UserId         int64    `json:"user_id,omitempty"`
+	CreatedAt      string   `json:"created_at"`
 }
 
 // MongoData is a dummy structure for the additional data
 // fetched from MongoDB.
 type MongoData struct {
 	AdditionalInfo string
+	// Enrichment names what produced AdditionalInfo and its version, as
+	// NAME/VERSION, for the event's lineage.
+	Enrichment string
 }
 
 // Result represents a single search result.
@@ -33,4 +100,108 @@ type Result struct {
 	Contact     string `json:"contact,omitempty"`
 	Image       string `json:"image,omitempty"`
 	Link        string `json:"link,omitempty"`
+	Followers   int64  `json:"followers"`
+	// Latitude and Longitude locate the entity, if it has a place.
+	Latitude  *float64 `json:"latitude,omitempty"`
+	Longitude *float64 `json:"longitude,omitempty"`
+	// DistanceKm is how far the entity is from the point searched near.
+	DistanceKm *float64 `json:"distance_km,omitempty"`
+	// Highlight shows where the query matched, when asked for.
+	Highlight *Highlight `json:"highlight,omitempty"`
+}
+
+// Highlight is the name and a snippet of the description of a search
+// result, HTML-escaped, with the words matching the query in <mark> tags.
+// Either is empty when the query did not match in it.
+type Highlight struct {
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// Facet counts the search results having each value of the field Name,
+// most frequent first.
+type Facet struct {
+	Name   string       `json:"name"`
+	Values []FacetValue `json:"values"`
+}
+
+// FacetValue is a value of a faceted field and how many results have it.
+type FacetValue struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+}
+
+// Suggestion is an entity whose name completes a typed prefix.
+type Suggestion struct {
+	EntityId string `json:"entity_id"`
+	Name     string `json:"name"`
+}
+
+// Region is a region of a multi-region deployment as GET /regions
+// reports it. DistanceKm is set when the client and the region have
+// locations; CheckedAt is when its health was last checked, empty before
+// the first check.
+type Region struct {
+	Name       string   `json:"name"`
+	URL        string   `json:"url"`
+	Healthy    bool     `json:"healthy"`
+	DistanceKm *float64 `json:"distance_km,omitempty"`
+	CheckedAt  string   `json:"checked_at,omitempty"`
+}
+
+// RegionList lists the regions for a client, healthy ones first, nearest
+// first. Nearest names the first healthy one, if any.
+type RegionList struct {
+	Nearest string   `json:"nearest"`
+	Regions []Region `json:"regions"`
+}
+
+// Filter narrows search results by the fields of Result. Dates are
+// YYYY-MM-DD and both bounds are inclusive; Location matches any location
+// containing it. Zero fields do not filter. Fuzziness is how many typos,
+// 0 to 2, each query word may have and still match. With Near, only
+// results with coordinates pass, within RadiusKm of it unless that is
+// zero.
+type Filter struct {
+	From      string
+	To        string
+	Category  string
+	Location  string
+	MinPrice  *float64
+	MaxPrice  *float64
+	Fuzziness int
+	Near      *Point
+	RadiusKm  float64
+}
+
+// Point is a place on the Earth, in degrees.
+type Point struct {
+	Lat float64
+	Lng float64
+}
+
+// Paging selects a page of search results: Limit of them from Offset in
+// the order of Sort, with the values of the Facets fields counted over
+// every result.
+type Paging struct {
+	Sort   Sort
+	Limit  int64
+	Offset int64
+	Facets []string
+}
+
+// Sort orders search results by Field: relevance, date, price, rating or
+// distance. Results without the field come last either way.
+type Sort struct {
+	Field string
+	Desc  bool
+}
+
+// Matches is a page of search results, with Total, the number of results
+// of the whole search, and Facets, how many of them have each value of
+// each faceted field.
+type Matches struct {
+	Results []Result
+	Total   int64
+	Facets  map[string]map[string]int64
 }
@@ -0,0 +1,156 @@
+package tiering
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"expvar"
+	"log"
+	"naevis/clock"
+	"naevis/config"
+	"naevis/sqlguard"
+	"time"
+
+	"modernc.org/sqlite"
+)
+
+// metrics counts the events moved to the cold tier, published under
+// "tiering" in expvar.
+var metrics = expvar.NewMap("tiering")
+
+// schema is the cold tier. cold.events has every column of events, and
+// must gain the columns later added to it; ids stay unique across both
+// tiers since events never reuses them.
+var schema = []string{
+	`CREATE TABLE IF NOT EXISTS cold.events (
+		id INTEGER PRIMARY KEY,
+		entity_type TEXT,
+		action TEXT,
+		entity_id TEXT,
+		item_id TEXT,
+		item_type TEXT,
+		additional_info TEXT,
+		created_at DATETIME,
+		tenant TEXT NOT NULL DEFAULT '',
+		user_id INTEGER
+	);`,
+	`CREATE INDEX IF NOT EXISTS cold.events_user ON events (user_id, created_at);`,
+}
+
+// Attach attaches the cold database at path as "cold" to every connection
+// of guarded databases opened afterwards. Call it before initdb.InitDB.
+func Attach(path string) {
+	sqlguard.AddSchema("cold")
+	sqlguard.RegisterConnectionHook(func(conn sqlite.ExecQuerierContext, _ string) error {
+		_, err := conn.ExecContext(context.Background(), `ATTACH DATABASE ? AS cold;`,
+			[]driver.NamedValue{{Ordinal: 1, Value: path}})
+		return err
+	})
+}
+
+// Mover moves old events from the hot database into the cold one, so the
+// hot file stays small and fast. Events with attachments stay hot, where
+// the attachment garbage collector sees them.
+type Mover struct {
+	db    *sql.DB
+	clock clock.Clock
+	after time.Duration
+	batch int
+}
+
+// New creates a Mover for cfg and the cold schema, measuring the age of
+// events with clk. The cold database must have been attached with Attach.
+func New(db *sql.DB, cfg config.Tiering, clk clock.Clock) (*Mover, error) {
+	for _, stmt := range schema {
+		if _, err := db.Exec(stmt); err != nil {
+			return nil, err
+		}
+	}
+	return &Mover{db: db, clock: clk, after: cfg.After.Duration, batch: cfg.BatchSize}, nil
+}
+
+// Run moves old events every interval until ctx is cancelled.
+func (m *Mover) Run(ctx context.Context, interval time.Duration) {
+	ticker := m.clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		n, err := m.Move()
+		if err != nil {
+			log.Printf("Error moving events to the cold tier: %v", err)
+		}
+		if n > 0 {
+			log.Printf("Moved %d events to the cold tier", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+	}
+}
+
+// Move moves every event created before the cutoff to the cold tier,
+// returning how many it moved.
+func (m *Mover) Move() (int, error) {
+	cutoff := m.clock.Now().UTC().Add(-m.after).Format(time.DateTime)
+	total := 0
+	for {
+		n, err := m.moveBatch(cutoff)
+		total += n
+		metrics.Add("moved", int64(n))
+		if err != nil || n < m.batch {
+			return total, err
+		}
+	}
+}
+
+// moveBatch moves up to one batch of events created before cutoff. The
+// copy is idempotent, so a batch interrupted between the two files is
+// finished by the next one.
+func (m *Mover) moveBatch(cutoff string) (int, error) {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+	SELECT id FROM main.events
+	WHERE created_at < ? AND id NOT IN (SELECT event_id FROM main.event_attachments)
+	ORDER BY id LIMIT ?;`, cutoff, m.batch)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(ids) == 0 {
+		return 0, err
+	}
+	list, err := json.Marshal(ids)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec(`
+	INSERT OR IGNORE INTO cold.events
+		(id, entity_type, action, entity_id, item_id, item_type, additional_info, created_at, tenant, user_id)
+	SELECT id, entity_type, action, entity_id, item_id, item_type, additional_info, created_at, tenant, user_id
+	FROM main.events WHERE id IN (SELECT value FROM json_each(?));`, string(list)); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`DELETE FROM main.events WHERE id IN (SELECT value FROM json_each(?));`, string(list)); err != nil {
+		return 0, err
+	}
+	return len(ids), tx.Commit()
+}
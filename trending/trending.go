@@ -0,0 +1,230 @@
+package trending
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"math"
+	"naevis/apierror"
+	"naevis/config"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// hourLayout matches the hourly buckets the scores are computed over.
+	hourLayout = "2006-01-02 15:00:00"
+	// keep is how many entities are stored per tenant and type.
+	keep         = 100
+	defaultLimit = 20
+)
+
+// Entry is a trending entity and its decayed activity score.
+type Entry struct {
+	EntityType string  `json:"entity_type"`
+	EntityId   string  `json:"entity_id"`
+	Score      float64 `json:"score"`
+	Events     int64   `json:"events"`
+}
+
+type key struct {
+	tenant, entityType string
+}
+
+// Trending ranks entities by recent event velocity. Every event in the
+// window counts, but its weight halves each half-life, so a burst of
+// activity today outranks a larger one last week. Scores are recomputed
+// periodically into trending_scores and served from memory.
+type Trending struct {
+	db       *sql.DB
+	window   time.Duration
+	halfLife time.Duration
+
+	mu   sync.RWMutex
+	top  map[key][]Entry
+	asOf time.Time
+}
+
+// New creates a trending ranker from cfg.
+func New(db *sql.DB, cfg config.Trending) *Trending {
+	return &Trending{
+		db:       db,
+		window:   cfg.Window.Duration,
+		halfLife: cfg.HalfLife.Duration,
+		top:      make(map[key][]Entry),
+	}
+}
+
+// Run recomputes the scores every interval until ctx is cancelled.
+func (t *Trending) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := t.Refresh(); err != nil {
+			log.Printf("Error refreshing trending scores: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Refresh recomputes the scores from the hourly activity of each entity in
+// the window, stores the top entities per tenant and type, and swaps them
+// into the cache.
+func (t *Trending) Refresh() error {
+	now := time.Now().UTC()
+	rows, err := t.db.Query(`
+	SELECT tenant, entity_type, entity_id, strftime('%Y-%m-%d %H:00:00', created_at), COUNT(*)
+	FROM (
+		SELECT tenant, entity_type, entity_id, created_at FROM events WHERE created_at >= ?1
+		UNION ALL
+		SELECT tenant, entity_type, entity_id, created_at FROM tracking_events WHERE created_at >= ?1
+	)
+	WHERE entity_type != '' AND entity_id != ''
+	GROUP BY 1, 2, 3, 4;`, now.Add(-t.window).Format(time.DateTime))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type entity struct {
+		key
+		id string
+	}
+	scores := make(map[entity]*Entry)
+	for rows.Next() {
+		var e entity
+		var bucket string
+		var n int64
+		if err := rows.Scan(&e.tenant, &e.entityType, &e.id, &bucket, &n); err != nil {
+			return err
+		}
+		at, err := time.Parse(hourLayout, bucket)
+		if err != nil {
+			continue
+		}
+		// Weigh the bucket from its midpoint.
+		age := now.Sub(at.Add(30 * time.Minute))
+		if age < 0 {
+			age = 0
+		}
+		s, ok := scores[e]
+		if !ok {
+			s = &Entry{EntityType: e.entityType, EntityId: e.id}
+			scores[e] = s
+		}
+		s.Score += float64(n) * math.Exp2(-float64(age)/float64(t.halfLife))
+		s.Events += n
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	top := make(map[key][]Entry)
+	for e, s := range scores {
+		top[e.key] = append(top[e.key], *s)
+	}
+	for k, entries := range top {
+		sort.Slice(entries, func(i, j int) bool {
+			if entries[i].Score != entries[j].Score {
+				return entries[i].Score > entries[j].Score
+			}
+			return entries[i].EntityId < entries[j].EntityId
+		})
+		if len(entries) > keep {
+			entries = entries[:keep]
+		}
+		top[k] = entries
+	}
+
+	if err := t.store(top); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	t.top, t.asOf = top, now
+	t.mu.Unlock()
+	return nil
+}
+
+// store replaces trending_scores with top.
+func (t *Trending) store(top map[key][]Entry) error {
+	tx, err := t.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM trending_scores;`); err != nil {
+		return err
+	}
+	for k, entries := range top {
+		for rank, e := range entries {
+			if _, err := tx.Exec(`
+			INSERT INTO trending_scores (tenant, entity_type, entity_id, rank, score, events, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP);`,
+				k.tenant, k.entityType, e.EntityId, rank+1, e.Score, e.Events); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// ServeHTTP handles GET /trending?type=ENTITY_TYPE&limit=N for the
+// caller's tenant.
+func (t *Trending) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apierror.Write(w, "Only GET requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	entityType := q.Get("type")
+	if entityType == "" {
+		apierror.Write(w, "Missing type parameter", http.StatusBadRequest)
+		return
+	}
+	limit := defaultLimit
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			apierror.Write(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, keep)
+	}
+
+	t.mu.RLock()
+	entries := t.top[key{r.Header.Get("X-Tenant-ID"), entityType}]
+	asOf := t.asOf
+	t.mu.RUnlock()
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	if entries == nil {
+		entries = []Entry{}
+	}
+
+	response, err := json.Marshal(struct {
+		Items []Entry `json:"items"`
+		AsOf  string  `json:"as_of"`
+	}{entries, asOf.Format(time.RFC3339)})
+	if err != nil {
+		apierror.Write(w, "Error encoding JSON", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	w.Header().Set("Vary", "X-Tenant-ID")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
@@ -0,0 +1,273 @@
+// Package visibility removes the JSON fields a caller's role may not see
+// from every response, so that handlers serialize whole records and need
+// not check roles themselves.
+package visibility
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"naevis/accounts"
+	"naevis/config"
+	"net/http"
+	"strconv"
+)
+
+// anonymous stands for unauthenticated callers among the roles.
+const anonymous = ""
+
+// Rules are the fields each role may not see.
+type Rules struct {
+	hidden map[string]map[string]bool
+	exempt map[string]bool
+}
+
+// New creates the Rules of cfg, or returns nil when no field is limited.
+func New(cfg config.Visibility) (*Rules, error) {
+	if len(cfg.Fields) == 0 {
+		return nil, nil
+	}
+	v := &Rules{hidden: map[string]map[string]bool{
+		anonymous: {}, "user": {}, "operator": {}, "admin": {},
+	}, exempt: make(map[string]bool)}
+	for field, roles := range cfg.Fields {
+		if field == "" {
+			return nil, fmt.Errorf("visibility: empty field name")
+		}
+		allowed := make(map[string]bool)
+		for _, role := range roles {
+			if !accounts.ValidRole(role) {
+				return nil, fmt.Errorf("visibility: field %s: unknown role %q", field, role)
+			}
+			allowed[role] = true
+		}
+		for role, hidden := range v.hidden {
+			if !allowed[role] {
+				hidden[field] = true
+			}
+		}
+	}
+	return v, nil
+}
+
+// Exempt serves path unstripped to every caller. It is for endpoints that
+// authorize callers on their own and must pass records whole, such as the
+// change feed, which a standby reads with only its replication token.
+func (v *Rules) Exempt(path string) {
+	if v != nil {
+		v.exempt[path] = true
+	}
+}
+
+// hiddenFrom returns the fields the caller of r may not see.
+func (v *Rules) hiddenFrom(r *http.Request) map[string]bool {
+	claims, ok := accounts.FromContext(r.Context())
+	switch {
+	case !ok:
+		return v.hidden[anonymous]
+	case claims.Admin():
+		return v.hidden[claims.Role]
+	}
+	// Privileged roles without a second factor see what users see.
+	return v.hidden["user"]
+}
+
+// Middleware strips the fields hidden from the caller from JSON and NDJSON
+// responses. It must run after authentication. JSON responses are
+// buffered whole; NDJSON responses are stripped line by line as they
+// stream. Other responses pass through. A nil Rules returns next.
+func (v *Rules) Middleware(next http.Handler) http.Handler {
+	if v == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hidden := v.hiddenFrom(r)
+		if len(hidden) == 0 || r.Method == http.MethodHead || v.exempt[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		vw := &writer{ResponseWriter: w, hidden: hidden, status: http.StatusOK}
+		defer vw.finish()
+		next.ServeHTTP(vw, r)
+	})
+}
+
+// Strip removes the hidden fields from v, a decoded JSON document, at any
+// depth. additional_info holding a JSON object is stripped too. It
+// reports whether anything was removed.
+func Strip(v any, hidden map[string]bool) bool {
+	stripped := false
+	switch v := v.(type) {
+	case map[string]any:
+		for k, field := range v {
+			if hidden[k] {
+				delete(v, k)
+				stripped = true
+				continue
+			}
+			if s, ok := field.(string); ok && k == "additional_info" {
+				if text, ok := stripText(s, hidden); ok {
+					v[k], stripped = text, true
+				}
+				continue
+			}
+			stripped = Strip(field, hidden) || stripped
+		}
+	case []any:
+		for _, item := range v {
+			stripped = Strip(item, hidden) || stripped
+		}
+	}
+	return stripped
+}
+
+// stripText strips a JSON object held in a string, reporting whether
+// anything was removed.
+func stripText(s string, hidden map[string]bool) (string, bool) {
+	var doc map[string]any
+	if decode([]byte(s), &doc) != nil || !Strip(doc, hidden) {
+		return s, false
+	}
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return s, false
+	}
+	return string(b), true
+}
+
+// decode unmarshals data keeping numbers as written, so IDs beyond
+// float64 precision survive a round trip.
+func decode(data []byte, v any) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	return d.Decode(v)
+}
+
+// stripJSON returns data without the hidden fields. It reports false,
+// leaving data as it is, when data holds none or is not JSON.
+func stripJSON(data []byte, hidden map[string]bool) ([]byte, bool) {
+	var doc any
+	if decode(data, &doc) != nil || !Strip(doc, hidden) {
+		return data, false
+	}
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return data, false
+	}
+	return b, true
+}
+
+// Response body handling.
+const (
+	buffered = iota
+	lines
+	passthrough
+)
+
+// writer buffers JSON responses and strips NDJSON ones line by line.
+type writer struct {
+	http.ResponseWriter
+	hidden      map[string]bool
+	status      int
+	wroteHeader bool
+	mode        int
+	buf         bytes.Buffer
+}
+
+func (w *writer) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = status
+	mediaType, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		w.mode = buffered
+		return
+	case "application/x-ndjson":
+		w.mode = lines
+		w.Header().Del("Content-Length")
+	default:
+		w.mode = passthrough
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	switch w.mode {
+	case passthrough:
+		return w.ResponseWriter.Write(p)
+	case lines:
+		w.buf.Write(p)
+		if err := w.writeLines(false); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	return w.buf.Write(p)
+}
+
+// writeLines sends the complete lines buffered, stripped, and the rest
+// too when last is set.
+func (w *writer) writeLines(last bool) error {
+	for {
+		i := bytes.IndexByte(w.buf.Bytes(), '\n')
+		if i < 0 && (!last || w.buf.Len() == 0) {
+			return nil
+		}
+		var line []byte
+		if i < 0 {
+			line = w.buf.Next(w.buf.Len())
+		} else {
+			line = w.buf.Next(i + 1)
+		}
+		trimmed := bytes.TrimRight(line, "\r\n")
+		if out, ok := stripJSON(trimmed, w.hidden); ok {
+			line = append(out, line[len(trimmed):]...)
+		}
+		if _, err := w.ResponseWriter.Write(line); err != nil {
+			return err
+		}
+	}
+}
+
+// FlushError sends the NDJSON lines completed so far. A JSON response
+// cannot be stripped before it is whole, so it is only sent at the end.
+func (w *writer) FlushError() error {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.mode == buffered {
+		return nil
+	}
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// finish sends a buffered response, stripped, or the last NDJSON line.
+func (w *writer) finish() {
+	if !w.wroteHeader {
+		// Nothing was written; the handler's implicit 200 goes out as is.
+		return
+	}
+	switch w.mode {
+	case lines:
+		w.writeLines(true)
+		return
+	case passthrough:
+		return
+	}
+	body, _ := stripJSON(w.buf.Bytes(), w.hidden)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(body)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *writer) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,129 @@
+package webhooks_test
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"naevis/structs"
+	"naevis/webhooks"
+	"naevis/webhooks/webhooktest"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden payloads")
+
+// fixtures are the changes the goldens are made from, one per payload
+// shape.
+var fixtures = map[string]struct {
+	event structs.Index
+	id    string
+}{
+	"entity_created": {
+		event: structs.Index{EntityType: "event", Action: "create", EntityId: "e-1"},
+		id:    "6f0c1f1e2d3c4b5a69788796a5b4c3d2",
+	},
+	"entity_updated_item": {
+		event: structs.Index{EntityType: "place", Action: "update", EntityId: "p-7", ItemId: "m-3", ItemType: "media", Tenant: "acme"},
+		id:    "0a1b2c3d4e5f60718293a4b5c6d7e8f9",
+	},
+}
+
+var fixtureTime = time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+
+// TestGoldens fails when a payload no longer matches its golden, which
+// would break consumers checked against the kit. Run with -update after
+// an intended change and publish the new goldens with the release notes.
+func TestGoldens(t *testing.T) {
+	seen := make(map[string]bool)
+	for name, f := range fixtures {
+		body, err := json.MarshalIndent(webhooks.NewEvent(f.event, f.id, fixtureTime), "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body = append(body, '\n')
+		path := filepath.Join("webhooktest", "golden", name+".json")
+		if *update {
+			if err := os.WriteFile(path, body, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("%s has no golden; run with -update: %v", name, err)
+		}
+		if string(body) != string(want) {
+			t.Errorf("payload %s changed:\n got %s\nwant %s", name, body, want)
+		}
+		seen[name] = true
+	}
+	if *update {
+		return
+	}
+	for _, g := range webhooktest.Goldens() {
+		if !seen[g.Name] {
+			t.Errorf("golden %s has no fixture", g.Name)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"id":"1"}`)
+	now := time.Unix(1700000000, 0)
+	header := webhooks.Sign("secret", body, now)
+
+	for _, tc := range []struct {
+		name   string
+		secret string
+		header string
+		body   []byte
+		now    time.Time
+		want   error
+	}{
+		{"valid", "secret", header, body, now, nil},
+		{"within tolerance", "secret", header, body, now.Add(4 * time.Minute), nil},
+		{"other secret", "other", header, body, now, webhooks.ErrBadSignature},
+		{"tampered body", "secret", header, []byte(`{"id":"2"}`), now, webhooks.ErrBadSignature},
+		{"too old", "secret", header, body, now.Add(6 * time.Minute), webhooks.ErrExpired},
+		{"missing", "secret", "", body, now, webhooks.ErrNoSignature},
+		{"no timestamp", "secret", header[len("t=1700000000,"):], body, now, webhooks.ErrNoSignature},
+		{"rotated secret", "secret", header + ",v1=00ff", body, now, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := webhooks.Verify(tc.secret, tc.header, tc.body, tc.now, 5*time.Minute)
+			if !errors.Is(err, tc.want) {
+				t.Errorf("Verify = %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
+
+// consumer is a handler as a downstream team would write it.
+func consumer(secret string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := webhooks.Verify(secret, r.Header.Get(webhooks.SignatureHeader), body, time.Now(), 5*time.Minute); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		var event webhooks.Event
+		if err := json.Unmarshal(body, &event); err != nil || event.SpecVersion != "1.0" || event.Data.EntityId == "" {
+			http.Error(w, "unexpected payload", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func TestCheck(t *testing.T) {
+	webhooktest.Check(t, consumer(webhooktest.Secret))
+}
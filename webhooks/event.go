@@ -0,0 +1,57 @@
+package webhooks
+
+import (
+	"naevis/structs"
+	"time"
+)
+
+// SpecVersion is the CloudEvents version of every delivery.
+const SpecVersion = "1.0"
+
+// Source is the CloudEvents source of every delivery.
+const Source = "/quickie"
+
+// Event is a delivery body: a CloudEvents 1.0 event in structured JSON
+// mode, sent with Content-Type application/cloudevents+json. Its shape is
+// the contract with consumers; the goldens in package webhooktest pin it.
+type Event struct {
+	SpecVersion     string    `json:"specversion"`
+	ID              string    `json:"id"`
+	Source          string    `json:"source"`
+	Type            string    `json:"type"`
+	Subject         string    `json:"subject"`
+	Time            time.Time `json:"time"`
+	DataContentType string    `json:"datacontenttype"`
+	Data            Data      `json:"data"`
+}
+
+// Data is the changed entity.
+type Data struct {
+	EntityType string `json:"entity_type"`
+	EntityId   string `json:"entity_id"`
+	Action     string `json:"action"`
+	ItemId     string `json:"item_id,omitempty"`
+	ItemType   string `json:"item_type,omitempty"`
+	Tenant     string `json:"tenant,omitempty"`
+}
+
+// NewEvent describes event as the delivery id sent at t.
+func NewEvent(event structs.Index, id string, t time.Time) Event {
+	return Event{
+		SpecVersion:     SpecVersion,
+		ID:              id,
+		Source:          Source,
+		Type:            "com.quickie.entity." + event.Action,
+		Subject:         event.EntityType + "/" + event.EntityId,
+		Time:            t.UTC(),
+		DataContentType: "application/json",
+		Data: Data{
+			EntityType: event.EntityType,
+			EntityId:   event.EntityId,
+			Action:     event.Action,
+			ItemId:     event.ItemId,
+			ItemType:   event.ItemType,
+			Tenant:     event.Tenant,
+		},
+	}
+}
@@ -0,0 +1,73 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SignatureHeader carries the signature of a delivery, as
+// "t=<unix seconds>,v1=<hex HMAC-SHA256 of "<t>.<body>" keyed by the
+// endpoint secret>".
+const SignatureHeader = "Webhook-Signature"
+
+// Errors returned by Verify.
+var (
+	ErrNoSignature  = errors.New("webhooks: missing or malformed signature")
+	ErrBadSignature = errors.New("webhooks: signature does not match")
+	ErrExpired      = errors.New("webhooks: signature timestamp outside tolerance")
+)
+
+// Sign returns the SignatureHeader value for body sent at t.
+func Sign(secret string, body []byte, t time.Time) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac(secret, ts, body))
+}
+
+// Verify checks a SignatureHeader value against body. Signatures made
+// more than tolerance away from now are rejected, so a captured delivery
+// cannot be replayed later; a tolerance of zero skips the check.
+// Consumers should call it on the raw body, before decoding it.
+func Verify(secret, header string, body []byte, now time.Time, tolerance time.Duration) error {
+	var ts string
+	var sigs [][]byte
+	for _, part := range strings.Split(header, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch k {
+		case "t":
+			ts = v
+		case "v1":
+			if sig, err := hex.DecodeString(v); err == nil {
+				sigs = append(sigs, sig)
+			}
+		}
+	}
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || len(sigs) == 0 {
+		return ErrNoSignature
+	}
+
+	want := mac(secret, ts, body)
+	match := false
+	for _, sig := range sigs {
+		match = match || hmac.Equal(sig, want)
+	}
+	if !match {
+		return ErrBadSignature
+	}
+	if age := now.Sub(time.Unix(sec, 0)); tolerance > 0 && (age > tolerance || age < -tolerance) {
+		return ErrExpired
+	}
+	return nil
+}
+
+func mac(secret, ts string, body []byte) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(ts + "."))
+	h.Write(body)
+	return h.Sum(nil)
+}
@@ -0,0 +1,143 @@
+// Package webhooks sends entity changes to configured HTTP endpoints as
+// signed CloudEvents. Consumers can check their handlers against the
+// payload contract with package webhooktest.
+package webhooks
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"naevis/config"
+	"naevis/structs"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+)
+
+const (
+	// queueSize bounds the number of changes waiting to be delivered.
+	queueSize = 1000
+	// attempts is how many times a delivery is tried before it is dropped.
+	attempts = 4
+	// backoff is the wait before the second attempt; it doubles after.
+	backoff = time.Second
+)
+
+// metrics counts deliveries sent, failed for good and dropped with the
+// queue full, published under "webhooks" in expvar.
+var metrics = expvar.NewMap("webhooks")
+
+// Deliverer posts changes to the endpoints subscribed to their entity
+// type. A nil *Deliverer is valid and sends nothing.
+type Deliverer struct {
+	endpoints []config.Webhook
+	client    *http.Client
+	changes   chan structs.Index
+	backoff   time.Duration
+}
+
+// New creates a Deliverer for endpoints and starts its sender.
+func New(endpoints []config.Webhook) (*Deliverer, error) {
+	for _, e := range endpoints {
+		if u, err := url.Parse(e.URL); err != nil || u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+			return nil, fmt.Errorf("invalid webhook URL %q", e.URL)
+		}
+		if e.Secret == "" {
+			return nil, fmt.Errorf("webhook %s has no secret", e.URL)
+		}
+	}
+	d := &Deliverer{
+		endpoints: endpoints,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		changes:   make(chan structs.Index, queueSize),
+		backoff:   backoff,
+	}
+	go d.run()
+	return d, nil
+}
+
+// EntityChanged queues the event for delivery.
+func (d *Deliverer) EntityChanged(event structs.Index) {
+	if d == nil {
+		return
+	}
+	select {
+	case d.changes <- event:
+	default:
+		metrics.Add("dropped", 1)
+		log.Printf("Webhook queue full, dropping %s/%s", event.EntityType, event.EntityId)
+	}
+}
+
+func (d *Deliverer) run() {
+	for event := range d.changes {
+		for _, e := range d.endpoints {
+			if len(e.EntityTypes) > 0 && !slices.Contains(e.EntityTypes, event.EntityType) {
+				continue
+			}
+			if err := d.deliver(e, event); err != nil {
+				metrics.Add("failed", 1)
+				log.Printf("Error delivering %s/%s to %s: %v", event.EntityType, event.EntityId, e.URL, err)
+				continue
+			}
+			metrics.Add("delivered", 1)
+		}
+	}
+}
+
+// deliver posts event to e, retrying failures the endpoint may recover
+// from. Every attempt carries the same id, so consumers can deduplicate.
+func (d *Deliverer) deliver(e config.Webhook, event structs.Index) error {
+	body, err := json.Marshal(NewEvent(event, newID(), time.Now()))
+	if err != nil {
+		return err
+	}
+
+	wait := d.backoff
+	for attempt := 1; ; attempt++ {
+		retry, err := d.post(e, body)
+		if err == nil || !retry || attempt == attempts {
+			return err
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// post makes one attempt and reports whether a failure is worth retrying.
+func (d *Deliverer) post(e config.Webhook, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, e.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/cloudevents+json")
+	req.Header.Set(SignatureHeader, Sign(e.Secret, body, time.Now()))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("endpoint responded %s", resp.Status)
+	default:
+		return false, fmt.Errorf("endpoint responded %s", resp.Status)
+	}
+}
+
+// newID returns a random delivery id.
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,63 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"io"
+	"naevis/config"
+	"naevis/structs"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDeliver(t *testing.T) {
+	var mu sync.Mutex
+	var ids []string
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := Verify("secret", r.Header.Get(SignatureHeader), body, time.Now(), time.Minute); err != nil {
+			t.Errorf("delivery not verifiable: %v", err)
+		}
+		var event Event
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Errorf("delivery not a CloudEvent: %v", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		ids = append(ids, event.ID)
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	d := &Deliverer{client: srv.Client(), backoff: time.Millisecond}
+	err := d.deliver(config.Webhook{URL: srv.URL, Secret: "secret"}, structs.Index{EntityType: "event", Action: "update", EntityId: "1"})
+	if err != nil {
+		t.Fatalf("deliver = %v after a retryable failure", err)
+	}
+	if len(ids) != 2 || ids[0] != ids[1] {
+		t.Errorf("attempts carried ids %v, want two equal ones", ids)
+	}
+}
+
+func TestDeliverGivesUp(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusGone)
+	}))
+	defer srv.Close()
+
+	d := &Deliverer{client: srv.Client(), backoff: time.Millisecond}
+	if err := d.deliver(config.Webhook{URL: srv.URL, Secret: "secret"}, structs.Index{EntityType: "event"}); err == nil {
+		t.Fatal("deliver succeeded against 410")
+	}
+	if calls != 1 {
+		t.Errorf("%d attempts for a permanent failure, want 1", calls)
+	}
+}
@@ -0,0 +1,79 @@
+// Package webhooktest is the consumer contract kit for webhook
+// deliveries. It holds golden payloads in every shape the server sends;
+// a consumer checks its handler against them with Check before the
+// server's next release, and the server's tests fail when a change to
+// the payloads would break them.
+package webhooktest
+
+import (
+	"bytes"
+	"embed"
+	"naevis/webhooks"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Secret signs the golden deliveries sent by Check. Configure the handler
+// under test with it.
+const Secret = "whsec_contract_test"
+
+//go:embed golden/*.json
+var golden embed.FS
+
+// Golden is a delivery body as the server sends it.
+type Golden struct {
+	// Name is the golden file name without ".json".
+	Name string
+	Body []byte
+}
+
+// Goldens returns every golden payload, by name.
+func Goldens() []Golden {
+	entries, err := golden.ReadDir("golden")
+	if err != nil {
+		panic(err)
+	}
+	var goldens []Golden
+	for _, e := range entries {
+		body, err := golden.ReadFile("golden/" + e.Name())
+		if err != nil {
+			panic(err)
+		}
+		goldens = append(goldens, Golden{Name: e.Name()[:len(e.Name())-len(path.Ext(e.Name()))], Body: body})
+	}
+	sort.Slice(goldens, func(i, j int) bool { return goldens[i].Name < goldens[j].Name })
+	return goldens
+}
+
+// NewRequest returns a delivery of body signed with secret now, as the
+// server would send it.
+func NewRequest(body []byte, secret string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/cloudevents+json")
+	req.Header.Set(webhooks.SignatureHeader, webhooks.Sign(secret, body, time.Now()))
+	return req
+}
+
+// Check sends every golden payload to h signed with Secret and expects a
+// 2xx response, then sends each signed with another secret and expects a
+// 4xx one, as a handler must verify signatures.
+func Check(t testing.TB, h http.Handler) {
+	t.Helper()
+	for _, g := range Goldens() {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, NewRequest(g.Body, Secret))
+		if rec.Code < 200 || rec.Code > 299 {
+			t.Errorf("golden %s: handler responded %d, want 2xx: %s", g.Name, rec.Code, rec.Body)
+		}
+
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, NewRequest(g.Body, Secret+"-forged"))
+		if rec.Code < 400 || rec.Code > 499 {
+			t.Errorf("golden %s with a forged signature: handler responded %d, want 4xx", g.Name, rec.Code)
+		}
+	}
+}